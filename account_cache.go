@@ -0,0 +1,234 @@
+package ledger
+
+import (
+	"container/list"
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Defaults of WithAccountCache.
+const (
+	DefaultAccountCacheSize = 10_000
+	DefaultAccountCacheTTL  = 5 * time.Second
+)
+
+// MetricAccountCacheReads counts the account reads of GetAccount and
+// InquireBalance under WithAccountCache, by result: "hit" or "miss".
+const MetricAccountCacheReads = "ledger.account_cache.reads"
+
+// WithAccountCache caches the accounts read by GetAccount and InquireBalance
+// in the process, up to size accounts for at most ttl, evicting the least
+// recently used. It cuts the GetItem calls of hot accounts, such as a busy
+// merchant's balance polled by its dashboard. A size or ttl of zero takes
+// DefaultAccountCacheSize or DefaultAccountCacheTTL.
+//
+// Accounts missing from the cache are read with strong consistency, and
+// every write to an account through the Ledger evicts it, so reads see the
+// transfers this process made. Writes made by other processes are only seen
+// once the cached account expires, so keep ttl short. Strongly consistent
+// reads, including all reads under WithConsistentReads, and the reads of
+// transfers never use the cache.
+func WithAccountCache(size int, ttl time.Duration) Option {
+	return func(l *Ledger) {
+		if size <= 0 {
+			size = DefaultAccountCacheSize
+		}
+		if ttl <= 0 {
+			ttl = DefaultAccountCacheTTL
+		}
+		l.accounts = &accountCache{size: size, ttl: ttl, entries: map[accountKey]*list.Element{}, lru: list.New()}
+	}
+}
+
+type accountKey struct {
+	tenantId, accountId string
+}
+
+type cachedAccount struct {
+	key     accountKey
+	item    map[string]types.AttributeValue
+	expires time.Time
+}
+
+// accountCache is an LRU cache of NilUsers items with a TTL.
+type accountCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[accountKey]*list.Element
+	lru     *list.List // front is the most recently used
+	// generation is bumped by every eviction, so a read that raced a write
+	// does not cache the item from before it.
+	generation uint64
+}
+
+func (c *accountCache) get(key accountKey, now time.Time) (map[string]types.AttributeValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cachedAccount)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return maps.Clone(entry.item), true
+}
+
+// put caches an item read at generation, unless an account was evicted
+// since.
+func (c *accountCache) put(key accountKey, item map[string]types.AttributeValue, generation uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &cachedAccount{key: key, item: maps.Clone(item), expires: now.Add(c.ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedAccount).key)
+	}
+}
+
+func (c *accountCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *accountCache) evict(keys []accountKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// accountCacheOf returns dbSvc reading accounts through the account cache
+// of its Ledger, and from its read replica, or dbSvc itself when it has no
+// cache.
+func accountCacheOf(dbSvc DynamoDBAPI) DynamoDBAPI {
+	l, ok := dbSvc.(*Ledger)
+	if !ok || l.accounts == nil {
+		return replicaOf(dbSvc)
+	}
+	return &cachedAccountsDB{DynamoDBAPI: replicaOf(dbSvc), ledger: l}
+}
+
+// cachedAccountsDB serves the eventually consistent reads of NilUsers items
+// from a Ledger's account cache.
+type cachedAccountsDB struct {
+	DynamoDBAPI
+	ledger *Ledger
+}
+
+func (c *cachedAccountsDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	key, ok := accountKeyOf(aws.ToString(params.TableName), params.Key)
+	if !ok || aws.ToBool(params.ConsistentRead) {
+		return c.DynamoDBAPI.GetItem(ctx, params, optFns...)
+	}
+	cache := c.ledger.accounts
+	now := clockOf(c.ledger).Now()
+	if item, ok := cache.get(key, now); ok {
+		c.ledger.metrics.AddCounter(ctx, MetricAccountCacheReads, 1, Attr("result", "hit"))
+		return &dynamodb.GetItemOutput{Item: item}, nil
+	}
+	c.ledger.metrics.AddCounter(ctx, MetricAccountCacheReads, 1, Attr("result", "miss"))
+	// Misses are read consistently, so an account is never cached from
+	// before a write that evicted it.
+	p := *params
+	p.ConsistentRead = aws.Bool(true)
+	generation := cache.currentGeneration()
+	out, err := c.DynamoDBAPI.GetItem(ctx, &p, optFns...)
+	if err == nil && out.Item != nil && params.ProjectionExpression == nil {
+		cache.put(key, out.Item, generation, now)
+	}
+	return out, err
+}
+
+// accountKeyOf returns the account of a NilUsers key or item.
+func accountKeyOf(table string, item map[string]types.AttributeValue) (accountKey, bool) {
+	if table != NilUsers {
+		return accountKey{}, false
+	}
+	tenant, _ := item["TenantID"].(*types.AttributeValueMemberS)
+	account, _ := item["AccountID"].(*types.AttributeValueMemberS)
+	if tenant == nil || account == nil {
+		return accountKey{}, false
+	}
+	return accountKey{tenant.Value, account.Value}, true
+}
+
+// evictAccounts evicts the accounts of the NilUsers keys or items written
+// to table from the account cache. It is called after the write, whether or
+// not it failed, since a failed write may have been applied.
+func (l *Ledger) evictAccounts(table string, items ...map[string]types.AttributeValue) {
+	if l.accounts == nil {
+		return
+	}
+	var keys []accountKey
+	for _, item := range items {
+		if key, ok := accountKeyOf(table, item); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		l.accounts.evict(keys)
+	}
+}
+
+// evictTransactAccounts evicts the accounts written by a transaction.
+func (l *Ledger) evictTransactAccounts(items []types.TransactWriteItem) {
+	if l.accounts == nil {
+		return
+	}
+	for _, item := range items {
+		switch {
+		case item.Put != nil:
+			l.evictAccounts(aws.ToString(item.Put.TableName), item.Put.Item)
+		case item.Update != nil:
+			l.evictAccounts(aws.ToString(item.Update.TableName), item.Update.Key)
+		case item.Delete != nil:
+			l.evictAccounts(aws.ToString(item.Delete.TableName), item.Delete.Key)
+		}
+	}
+}
+
+// evictBatchAccounts evicts the accounts written by a batch.
+func (l *Ledger) evictBatchAccounts(items map[string][]types.WriteRequest) {
+	if l.accounts == nil {
+		return
+	}
+	for table, requests := range items {
+		for _, request := range requests {
+			switch {
+			case request.PutRequest != nil:
+				l.evictAccounts(table, request.PutRequest.Item)
+			case request.DeleteRequest != nil:
+				l.evictAccounts(table, request.DeleteRequest.Key)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Limits of CreateAccountsBatch. maxBatchWriteItems is DynamoDB's limit on a
+// single BatchWriteItem call.
+const (
+	maxBatchWriteItems   = 25
+	maxBatchWriteRetries = 5
+)
+
+// BatchWriteBackoff is the delay before the first retry of unprocessed
+// items; it doubles on every further retry.
+var BatchWriteBackoff = 50 * time.Millisecond
+
+// ErrDuplicateAccount is reported for an account appearing more than once in
+// a batch. Only its first occurrence is written.
+var ErrDuplicateAccount = errors.New("duplicate account in batch")
+
+// AccountResult is the outcome of creating one account of a batch. Err is nil
+// when the account was written.
+type AccountResult struct {
+	AccountID string `json:"account_id"`
+	Err       error  `json:"-"`
+}
+
+// CreateAccountsBatch creates many accounts with BatchWriteItem, 25 at a
+// time, for tenant onboarding. Items DynamoDB leaves unprocessed are retried
+// with exponential backoff.
+//
+// The results are in the order of users, and the returned error says how many
+// of them failed. Unlike CreateAccount, existing accounts are overwritten,
+// since BatchWriteItem takes no condition.
+func CreateAccountsBatch(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, users []User) ([]AccountResult, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if err := validation.TenantID("tenant_id", tenantId); err != nil {
+		return nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]AccountResult, len(users))
+	var pending []int
+	seen := make(map[string]bool, len(users))
+	users = slices.Clone(users)
+	for i, user := range users {
+		results[i].AccountID = user.AccountID
+		currency, err := cfg.newAccountCurrency(user.Currency)
+		switch idErr := validation.AccountID("account_id", user.AccountID); {
+		case idErr != nil:
+			results[i].Err = idErr
+		case seen[user.AccountID]:
+			results[i].Err = ErrDuplicateAccount
+		case err != nil:
+			results[i].Err = err
+		default:
+			users[i].Currency = currency
+			seen[user.AccountID] = true
+			pending = append(pending, i)
+		}
+	}
+
+	for start := 0; start < len(pending); start += maxBatchWriteItems {
+		chunk := pending[start:min(start+maxBatchWriteItems, len(pending))]
+		byID := make(map[string]int, len(chunk))
+		requests := make([]types.WriteRequest, 0, len(chunk))
+		for _, i := range chunk {
+			item := userItem(dbSvc, tenantId, users[i])
+			err := protectPII(ctx, dbSvc, tenantId, item)
+			if err == nil {
+				err = protectPassword(item)
+			}
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			byID[users[i].AccountID] = i
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+		}
+		befores := map[int]*User{}
+		if auditing(dbSvc) {
+			for _, i := range chunk {
+				befores[i] = auditAccount(ctx, dbSvc, tenantId, users[i].AccountID)
+			}
+		}
+		unprocessed, err := batchWrite(ctx, dbSvc, NilUsers, requests)
+		for _, req := range unprocessed {
+			id, _ := req.PutRequest.Item["AccountID"].(*types.AttributeValueMemberS)
+			if id != nil {
+				results[byID[id.Value]].Err = err
+			}
+		}
+		if err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "failed to create accounts", "tenant", tenantId, "count", len(unprocessed), "error", err)
+		}
+		if auditing(dbSvc) {
+			for _, i := range chunk {
+				auditCreateAccount(ctx, dbSvc, tenantId, users[i], befores[i], results[i].Err)
+			}
+		}
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("failed to create %d of %d accounts", failed, len(users))
+	}
+	return results, nil
+}
+
+// batchWrite writes requests to a table with BatchWriteItem, retrying
+// unprocessed items. When it gives up, it returns the requests that were not
+// written and the reason.
+func batchWrite(ctx context.Context, dbSvc DynamoDBAPI, table string, requests []types.WriteRequest) ([]types.WriteRequest, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	backoff := BatchWriteBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := dbSvc.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{table: requests},
+		})
+		if err != nil {
+			return requests, fmt.Errorf("failed to write batch: %v", err)
+		}
+		requests = result.UnprocessedItems[table]
+		if len(requests) == 0 {
+			return nil, nil
+		}
+		if attempt == maxBatchWriteRetries {
+			return requests, errors.New("failed to write batch: items left unprocessed")
+		}
+		select {
+		case <-ctx.Done():
+			return requests, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,203 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Statuses of the accounts listed by ListAccounts.
+const (
+	AccountActive  = "active"
+	AccountDormant = "dormant"
+)
+
+// Page sizes of ListAccounts.
+const (
+	DefaultAccountsPageSize = 50
+	MaxAccountsPageSize     = 500
+)
+
+// AccountFilter selects the accounts ListAccounts returns. Its zero fields
+// match every account.
+type AccountFilter struct {
+	IsVerified *bool `json:"is_verified,omitempty"`
+	// Status is AccountActive or AccountDormant.
+	Status string `json:"status,omitempty"`
+	// CreatedFrom and CreatedTo bound when accounts were created; CreatedTo
+	// is exclusive.
+	CreatedFrom time.Time `json:"created_from,omitempty"`
+	CreatedTo   time.Time `json:"created_to,omitempty"`
+	City        string    `json:"city,omitempty"`
+	// MinBalance and MaxBalance bound the balance, inclusively.
+	MinBalance *float64 `json:"min_balance,omitempty"`
+	MaxBalance *float64 `json:"max_balance,omitempty"`
+	// Limit is the page size, DefaultAccountsPageSize when zero and at most
+	// MaxAccountsPageSize.
+	Limit int32 `json:"limit,omitempty"`
+}
+
+// AccountSummary is an account listed by ListAccounts. The holder's personal
+// data is masked as in AccountMatch, so it can be shown on back-office
+// dashboards.
+type AccountSummary struct {
+	AccountMatch
+	City     string  `json:"city,omitempty"`
+	Balance  float64 `json:"balance"`
+	Currency string  `json:"currency,omitempty"`
+	Status   string  `json:"status"`
+	KYCTier  int     `json:"kyc_tier,omitempty"`
+	// CreatedAt is as stored when the account was created.
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// ListAccounts returns a page of a tenant's accounts matching filter, in
+// account ID order, and the cursor of the next page, "" after the last one.
+// Pass "" for the first page.
+//
+// Accounts are queried from the tenant's partition of NilUsers, with the
+// filters applied as they are read, so a selective filter reads more
+// accounts than it returns.
+func ListAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, filter AccountFilter, cursor string) ([]AccountSummary, string, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	limit := int(filter.Limit)
+	switch {
+	case limit < 0 || limit > MaxAccountsPageSize:
+		return nil, "", fmt.Errorf("limit must be between 1 and %d", MaxAccountsPageSize)
+	case limit == 0:
+		limit = DefaultAccountsPageSize
+	}
+	if filter.Status != "" && filter.Status != AccountActive && filter.Status != AccountDormant {
+		return nil, "", fmt.Errorf("unknown account status: %q", filter.Status)
+	}
+	startKey, err := DecodePageToken(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ExclusiveStartKey: startKey,
+		Limit:             aws.Int32(int32(limit)),
+	}
+	var conditions []string
+	if filter.IsVerified != nil {
+		conditions = append(conditions, "is_verified = :verified")
+		input.ExpressionAttributeValues[":verified"] = &types.AttributeValueMemberBOOL{Value: *filter.IsVerified}
+	}
+	switch filter.Status {
+	case AccountActive:
+		conditions = append(conditions, "attribute_not_exists(DormantSince)")
+	case AccountDormant:
+		conditions = append(conditions, "attribute_exists(DormantSince)")
+	}
+	if filter.City != "" {
+		conditions = append(conditions, "city = :city")
+		input.ExpressionAttributeValues[":city"] = &types.AttributeValueMemberS{Value: filter.City}
+	}
+	if filter.MinBalance != nil {
+		conditions = append(conditions, "amount >= :min")
+		input.ExpressionAttributeValues[":min"] = &types.AttributeValueMemberN{Value: FormatAmount(*filter.MinBalance, "")}
+	}
+	if filter.MaxBalance != nil {
+		conditions = append(conditions, "amount <= :max")
+		input.ExpressionAttributeValues[":max"] = &types.AttributeValueMemberN{Value: FormatAmount(*filter.MaxBalance, "")}
+	}
+	if len(conditions) > 0 {
+		input.FilterExpression = aws.String(strings.Join(conditions, " AND "))
+	}
+
+	var accounts []AccountSummary
+	for {
+		resp, err := replicaOf(dbSvc).Query(ctx, input)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for i := range page {
+			if !filter.createdWithin(page[i].CreatedAt) {
+				continue
+			}
+			if err := decryptPII(ctx, dbSvc, &page[i]); err != nil {
+				return nil, "", err
+			}
+			accounts = append(accounts, summarizeAccount(page[i]))
+			// The page ends at the account it is full with, for the next
+			// page to start after it.
+			if len(accounts) == limit {
+				next, err := EncodePageToken(map[string]types.AttributeValue{
+					"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+					"AccountID": &types.AttributeValueMemberS{Value: page[i].AccountID},
+				})
+				if i == len(page)-1 && len(resp.LastEvaluatedKey) == 0 {
+					next = ""
+				}
+				return accounts, next, err
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return accounts, "", nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// createdWithin reports whether an account created at createdAt, as stored,
+// is within the filter's creation range. Accounts whose creation time
+// cannot be read only match a filter without one.
+func (f AccountFilter) createdWithin(createdAt string) bool {
+	if f.CreatedFrom.IsZero() && f.CreatedTo.IsZero() {
+		return true
+	}
+	created, ok := parseCreatedAt(createdAt)
+	if !ok {
+		return false
+	}
+	return (f.CreatedFrom.IsZero() || !created.Before(f.CreatedFrom)) &&
+		(f.CreatedTo.IsZero() || created.Before(f.CreatedTo))
+}
+
+// parseCreatedAt parses the created_at of an account, written with
+// time.Time.String, which may end with a monotonic clock reading.
+func parseCreatedAt(createdAt string) (time.Time, bool) {
+	if i := strings.Index(createdAt, " m="); i >= 0 {
+		createdAt = createdAt[:i]
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999 -0700 MST", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, createdAt); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func summarizeAccount(user User) AccountSummary {
+	status := AccountActive
+	if user.DormantSince != 0 {
+		status = AccountDormant
+	}
+	return AccountSummary{
+		AccountMatch: maskAccount(user),
+		City:         user.City,
+		Balance:      user.Amount,
+		Currency:     user.Currency,
+		Status:       status,
+		KYCTier:      user.KYCTier,
+		CreatedAt:    user.CreatedAt,
+	}
+}
@@ -0,0 +1,77 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AccountIDIndex is the index of NilUsers (AccountID, TenantID) finding the
+// tenants that have an account ID, for clients that only know the account.
+const AccountIDIndex = "AccountIDIndex"
+
+// ErrAccountNotFound is returned by ResolveAccountTenant for an account ID
+// no tenant has.
+var ErrAccountNotFound = errors.New("user_not_found")
+
+// ErrAmbiguousAccount is returned by ResolveAccountTenant for an account ID
+// more than one tenant has. The caller must then name the tenant.
+var ErrAmbiguousAccount = errors.New("ambiguous_account")
+
+// ResolveAccountTenant returns the tenant of an account known only by its
+// ID, querying AccountIDIndex. It fails with ErrAccountNotFound when no
+// tenant has the account and ErrAmbiguousAccount when several do.
+func ResolveAccountTenant(ctx context.Context, dbSvc DynamoDBAPI, accountId string) (string, error) {
+	if accountId == "" {
+		return "", errors.New("account id is required")
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		IndexName:              aws.String(AccountIDIndex),
+		KeyConditionExpression: aws.String("AccountID = :account"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":account": &types.AttributeValueMemberS{Value: accountId},
+		},
+		ProjectionExpression: aws.String("TenantID"),
+		// Two tenants are enough to tell the account is ambiguous.
+		Limit: aws.Int32(2),
+	}
+	var tenants []string
+	for {
+		resp, err := replicaOf(dbSvc).Query(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("failed to query account tenants: %v", err)
+		}
+		for _, item := range resp.Items {
+			if v, ok := item["TenantID"].(*types.AttributeValueMemberS); ok {
+				tenants = append(tenants, v.Value)
+			}
+		}
+		if len(tenants) > 1 {
+			return "", fmt.Errorf("account %s exists in tenants %s and %s: %w", accountId, tenants[0], tenants[1], ErrAmbiguousAccount)
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	if len(tenants) == 0 {
+		return "", fmt.Errorf("account %s: %w", accountId, ErrAccountNotFound)
+	}
+	return tenants[0], nil
+}
+
+// LookupAccount is GetAccount for an account known only by its ID. Its
+// tenant is resolved with ResolveAccountTenant, and is the TenantID of the
+// returned account.
+func LookupAccount(ctx context.Context, dbSvc DynamoDBAPI, accountId string) (*User, error) {
+	tenantId, err := ResolveAccountTenant(ctx, dbSvc, accountId)
+	if err != nil {
+		return nil, err
+	}
+	return GetAccount(ctx, dbSvc, TransactionEntry{TenantID: tenantId, AccountID: accountId})
+}
@@ -0,0 +1,165 @@
+package ledger
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Indexes of NilUsers finding the accounts of a tenant by their holder's
+// mobile number and ID number. Their range keys are the lookup values of the
+// numbers, so they work whether or not the numbers are encrypted.
+const (
+	MobileNumberIndex = "MobileNumberIndex"
+	IDNumberIndex     = "IDNumberIndex"
+)
+
+// lookupAttributes maps the PII attributes FindAccount searches to the
+// attributes holding their lookup values.
+var lookupAttributes = map[string]string{
+	"mobile_number": "MobileLookup",
+	"id_number":     "IDLookup",
+}
+
+// AccountQuery selects the accounts FindAccount returns. Exactly one of its
+// fields is set.
+type AccountQuery struct {
+	MobileNumber string `json:"mobile_number,omitempty"`
+	IDNumber     string `json:"id_number,omitempty"`
+}
+
+// AccountMatch is an account found by FindAccount. The holder's personal
+// data is masked, so it can be shown to support staff, or to a sender
+// confirming who they pay, without disclosing it.
+type AccountMatch struct {
+	TenantID  string `json:"tenant_id"`
+	AccountID string `json:"account_id"`
+	// FullName keeps the first name and the initials of the others, e.g.
+	// "Mohamed A. O.".
+	FullName string `json:"full_name"`
+	// MobileNumber and IDNumber keep their last three characters.
+	MobileNumber string `json:"mobile_number,omitempty"`
+	IDNumber     string `json:"id_number,omitempty"`
+	IsVerified   bool   `json:"is_verified"`
+}
+
+// FindAccount returns the tenant's accounts with the mobile number or ID
+// number of query, masked, querying MobileNumberIndex or IDNumberIndex
+// rather than scanning NilUsers. Accounts created before the indexes are
+// only found once IndexAccounts has run.
+func FindAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, query AccountQuery) ([]AccountMatch, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	var name, index, value string
+	switch {
+	case query.MobileNumber != "" && query.IDNumber != "":
+		return nil, errors.New("query either the mobile number or the id number")
+	case query.MobileNumber != "":
+		name, index, value = "mobile_number", MobileNumberIndex, query.MobileNumber
+	case query.IDNumber != "":
+		name, index, value = "id_number", IDNumberIndex, query.IDNumber
+	default:
+		return nil, errors.New("a mobile number or id number is required")
+	}
+	lookup, err := lookupValue(ctx, dbSvc, tenantId, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []AccountMatch
+	var cursor map[string]types.AttributeValue
+	for {
+		resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(NilUsers),
+			IndexName:              aws.String(index),
+			KeyConditionExpression: aws.String("TenantID = :tenant AND #lookup = :lookup"),
+			ExpressionAttributeNames: map[string]string{
+				"#lookup": lookupAttributes[name],
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenant": &types.AttributeValueMemberS{Value: tenantId},
+				":lookup": &types.AttributeValueMemberS{Value: lookup},
+			},
+			ExclusiveStartKey: cursor,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for i := range page {
+			if err := decryptPII(ctx, dbSvc, &page[i]); err != nil {
+				return nil, err
+			}
+			matches = append(matches, maskAccount(page[i]))
+		}
+		if resp.LastEvaluatedKey == nil {
+			return matches, nil
+		}
+		cursor = resp.LastEvaluatedKey
+	}
+}
+
+// lookupValue returns the value of the lookup attribute of a PII attribute:
+// the number itself, or its HMAC under the tenant's index key when PII is
+// encrypted.
+func lookupValue(ctx context.Context, dbSvc DynamoDBAPI, tenantId, name, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	keyring := piiKeyringOf(dbSvc)
+	if keyring == nil {
+		return value, nil
+	}
+	key, err := keyring.IndexKey(ctx, tenantId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get index key: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + ":" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func maskAccount(user User) AccountMatch {
+	return AccountMatch{
+		TenantID:     user.TenantID,
+		AccountID:    user.AccountID,
+		FullName:     maskName(user.FullName),
+		MobileNumber: maskNumber(user.MobileNumber),
+		IDNumber:     maskNumber(user.IDNumber),
+		IsVerified:   user.IsVerified,
+	}
+}
+
+// maskName keeps the first name and the initials of the other names.
+func maskName(name string) string {
+	parts := strings.Fields(name)
+	for i := 1; i < len(parts); i++ {
+		parts[i] = string([]rune(parts[i])[0]) + "."
+	}
+	return strings.Join(parts, " ")
+}
+
+// maskNumber replaces all but the last three characters with asterisks, or
+// all of them for numbers that short.
+func maskNumber(number string) string {
+	runes := []rune(number)
+	keep := 3
+	if len(runes) <= keep {
+		keep = 0
+	}
+	for i := 0; i < len(runes)-keep; i++ {
+		runes[i] = '*'
+	}
+	return string(runes)
+}
@@ -0,0 +1,169 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrImmutableField is returned for an AccountPatch setting a field of the
+// account that cannot be updated, such as its ID, tenant or balance.
+var ErrImmutableField = errors.New("immutable_field")
+
+// ErrAccountConflict is returned by UpdateAccount when the account changed
+// since the Version its patch was made from.
+var ErrAccountConflict = errors.New("account_version_conflict")
+
+// AccountPatch is a partial update of an account's profile. Only its set
+// fields are updated. Version is the Version of the account the patch was
+// made from.
+type AccountPatch struct {
+	FullName     *string `json:"full_name,omitempty"`
+	City         *string `json:"city,omitempty"`
+	MobileNumber *string `json:"mobile_number,omitempty"`
+	Dependants   *int    `json:"dependants,omitempty"`
+	Version      int64   `json:"version"`
+}
+
+// UnmarshalJSON decodes a patch, failing with ErrImmutableField for the
+// fields of an account other than those of the patch, and for fields it
+// does not know.
+func (p *AccountPatch) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name := range fields {
+		switch name {
+		case "full_name", "city", "mobile_number", "dependants", "version":
+		default:
+			return fmt.Errorf("%w: %s cannot be updated", ErrImmutableField, name)
+		}
+	}
+	type patch AccountPatch
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*patch)(p))
+}
+
+// UpdateAccount applies a patch to an account's profile and returns the
+// updated account. It fails with ErrAccountConflict when the account's
+// Version is no longer the patch's, for the caller to read the account and
+// patch it again. The update is recorded in the audit log.
+func UpdateAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, patch AccountPatch) (*User, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	after, err := updateAccount(ctx, dbSvc, tenantId, accountId, patch)
+	recordAudit(ctx, dbSvc, AuditUpdateAccount, tenantId, accountId, patch, before, after, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptPII(ctx, dbSvc, after); err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+func updateAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, patch AccountPatch) (*User, error) {
+	var checks []error
+	if patch.FullName != nil {
+		checks = append(checks, validation.Comment("full_name", *patch.FullName))
+	}
+	if patch.City != nil {
+		checks = append(checks, validation.Comment("city", *patch.City))
+	}
+	if patch.Dependants != nil && *patch.Dependants < 0 {
+		checks = append(checks, &validation.Error{Field: "dependants", Code: "negative", Message: "must not be negative"})
+	}
+	if patch.Version == 0 {
+		checks = append(checks, &validation.Error{Field: "version", Code: validation.CodeRequired, Message: "is required"})
+	}
+	if err := validation.Collect(checks...); err != nil {
+		return nil, err
+	}
+
+	newVersion := max(nextVersion(dbSvc), patch.Version+1)
+	sets := []string{"Version = :newVersion"}
+	var removes []string
+	values := map[string]types.AttributeValue{
+		":version":    &types.AttributeValueMemberN{Value: strconv.FormatInt(patch.Version, 10)},
+		":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(newVersion, 10)},
+	}
+	if patch.FullName != nil {
+		sets = append(sets, "full_name = :fullName")
+		values[":fullName"] = &types.AttributeValueMemberS{Value: strings.TrimSpace(*patch.FullName)}
+	}
+	if patch.City != nil {
+		sets = append(sets, "city = :city")
+		values[":city"] = &types.AttributeValueMemberS{Value: strings.TrimSpace(*patch.City)}
+	}
+	if patch.Dependants != nil {
+		sets = append(sets, "dependants = :dependants")
+		values[":dependants"] = &types.AttributeValueMemberN{Value: strconv.Itoa(*patch.Dependants)}
+	}
+	if patch.MobileNumber != nil {
+		// The number is encrypted and its lookup value rewritten as when the
+		// account is created, so FindAccount finds it by the new number.
+		item := map[string]types.AttributeValue{
+			"AccountID":     &types.AttributeValueMemberS{Value: accountId},
+			"mobile_number": &types.AttributeValueMemberS{Value: strings.TrimSpace(*patch.MobileNumber)},
+		}
+		if err := protectPII(ctx, dbSvc, tenantId, item); err != nil {
+			return nil, err
+		}
+		sets = append(sets, "mobile_number = :mobile")
+		values[":mobile"] = item["mobile_number"]
+		if lookup, ok := item[lookupAttributes["mobile_number"]]; ok {
+			sets = append(sets, "MobileLookup = :mobileLookup")
+			values[":mobileLookup"] = lookup
+		} else {
+			removes = append(removes, "MobileLookup")
+		}
+	}
+	update := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		update += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	resp, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(AccountID) AND Version = :version"),
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		if _, getErr := fetchAccount(ctx, dbSvc, tenantId, accountId, true); getErr != nil {
+			return nil, fmt.Errorf("account %s does not exist", accountId)
+		}
+		return nil, fmt.Errorf("account %s changed since version %d: %w", accountId, patch.Version, ErrAccountConflict)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update account %s: %v", accountId, err)
+	}
+	var user User
+	if err := attributevalue.UnmarshalMap(resp.Attributes, &user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user: %v", err)
+	}
+	return &user, nil
+}
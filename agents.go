@@ -0,0 +1,343 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrFloatLimitExceeded is returned for money moved beyond the float limits
+// of an agent.
+var ErrFloatLimitExceeded = errors.New("float_limit_exceeded")
+
+// AgentFloatLimits bound the float of a cash agent: the e-money its account
+// holds to pay out cash-ins, and which grows with the cash-outs it takes.
+type AgentFloatLimits struct {
+	// MinFloat is the float the agent must keep; its cash-ins and
+	// withdrawals may not take the balance below it.
+	MinFloat float64 `dynamodbav:"MinFloat" json:"min_float"`
+	// MaxFloat caps the float the agent may hold, from cash-outs and
+	// AssignFloat; zero means no cap.
+	MaxFloat float64 `dynamodbav:"MaxFloat,omitempty" json:"max_float,omitempty"`
+}
+
+// floatLimitError checks the float limits of the agents of a move: sender
+// left with remaining, and receiver credited with credit. Either may be nil,
+// and accounts that are not agents are not checked.
+func floatLimitError(sender *User, remaining float64, receiver *User, credit float64) error {
+	if sender != nil && sender.AgentFloat != nil && remaining < sender.AgentFloat.MinFloat {
+		return fmt.Errorf("%w: agent %s must keep a float of %.2f", ErrFloatLimitExceeded, sender.AccountID, sender.AgentFloat.MinFloat)
+	}
+	if receiver != nil && receiver.AgentFloat != nil && receiver.AgentFloat.MaxFloat > 0 &&
+		RoundAmount(receiver.Amount+credit, currencyOf(receiver)) > receiver.AgentFloat.MaxFloat {
+		return fmt.Errorf("%w: agent %s may hold at most %.2f", ErrFloatLimitExceeded, receiver.AccountID, receiver.AgentFloat.MaxFloat)
+	}
+	return nil
+}
+
+// RegisterAgent makes an account a cash agent with the given float limits,
+// or changes the limits of an agent. Limits below what the agent holds do
+// not move its float, but block the moves that go further.
+func RegisterAgent(ctx context.Context, dbSvc DynamoDBAPI, tenantId, agentId string, limits AgentFloatLimits) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if limits.MinFloat < 0 || limits.MaxFloat < 0 {
+		return errors.New("float limits must not be negative")
+	}
+	if limits.MaxFloat > 0 && limits.MaxFloat < limits.MinFloat {
+		return errors.New("maximum float must not be below the minimum")
+	}
+	av, err := attributevalue.Marshal(limits)
+	if err != nil {
+		return fmt.Errorf("failed to marshal float limits: %v", err)
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, agentId)
+	}
+	_, err = dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: agentId},
+		},
+		UpdateExpression:          aws.String("SET AgentFloat = :limits"),
+		ConditionExpression:       aws.String("attribute_exists(AccountID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":limits": av},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("account %s does not exist", agentId)
+	} else if err != nil {
+		err = fmt.Errorf("failed to register agent %s: %v", agentId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, agentId)
+	}
+	recordAudit(ctx, dbSvc, AuditRegisterAgent, tenantId, agentId, limits, before, after, err)
+	return err
+}
+
+// FloatRequest assigns float to an agent, paid for at the tenant's bank.
+type FloatRequest struct {
+	TenantID      string  `json:"tenant_id,omitempty"`
+	AgentID       string  `json:"agent_id"`
+	Amount        float64 `json:"amount"`
+	BankReference string  `json:"bank_ref"`
+	InitiatorUUID string  `json:"uuid,omitempty"`
+}
+
+// AssignFloat credits an agent with float, debiting the tenant's
+// TreasuryAccount like a bank deposit. It fails with ErrFloatLimitExceeded
+// when the agent would hold more than its MaxFloat.
+func AssignFloat(ctx context.Context, dbSvc DynamoDBAPI, req FloatRequest) (*TransactionEntry, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	if err := checkAgent(ctx, dbSvc, req.TenantID, req.AgentID); err != nil {
+		return nil, err
+	}
+	return moveCash(ctx, dbSvc, CashRequest{
+		TenantID:      req.TenantID,
+		AccountID:     req.AgentID,
+		Amount:        req.Amount,
+		Channel:       ChannelBank,
+		BankReference: req.BankReference,
+		InitiatorUUID: req.InitiatorUUID,
+	}, LegDeposit)
+}
+
+// AgentCashIn transfers float from the agent req.FromAccount to the
+// customer req.ToAccount, who paid the agent the amount in cash. The agent
+// must keep its MinFloat; the transfer is otherwise charged, limited and
+// held like any other.
+func AgentCashIn(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) (NilResponse, error) {
+	return agentTransfer(ctx, dbSvc, req, req.FromAccount, NarrativeAgentCashIn)
+}
+
+// AgentCashOut transfers e-money from the customer req.FromAccount to the
+// agent req.ToAccount, who pays the customer the amount in cash. It is a
+// cash-out for the customer's limits, and the agent may not hold more than
+// its MaxFloat.
+func AgentCashOut(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) (NilResponse, error) {
+	req.IsCashOut = true
+	return agentTransfer(ctx, dbSvc, req, req.ToAccount, NarrativeAgentCashOut)
+}
+
+func agentTransfer(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest, agentId, comment string) (NilResponse, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	if err := checkAgent(ctx, dbSvc, req.TenantID, agentId); err != nil {
+		return failedResponse(req, "not_an_agent", "The account is not an agent.", err.Error()), err
+	}
+	metadata := map[string]string{}
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetadataChannel] = ChannelAgent
+	metadata[MetadataAgentID] = agentId
+	req.Metadata = metadata
+	return transferCredits(ctx, dbSvc, req, transferOptions{comment: comment})
+}
+
+// checkAgent returns an error unless the account is a registered agent.
+func checkAgent(ctx context.Context, dbSvc DynamoDBAPI, tenantId, agentId string) error {
+	agent, err := readAccount(ctx, dbSvc, tenantId, agentId)
+	if err != nil {
+		return fmt.Errorf("failed to read account %s: %v", agentId, err)
+	}
+	if agent.AgentFloat == nil {
+		return fmt.Errorf("account %s is not an agent", agentId)
+	}
+	return nil
+}
+
+// AgentFloatDay sums the float movements of an agent over a UTC day.
+// Amounts are what moved the agent's own balance, fees included.
+type AgentFloatDay struct {
+	AgentID string `json:"agent_id"`
+	// Day is formatted as 2006-01-02.
+	Day           string  `json:"day"`
+	FloatAssigned float64 `json:"float_assigned"`
+	FloatReturned float64 `json:"float_returned"`
+	CashIn        float64 `json:"cash_in"`
+	CashInCount   int     `json:"cash_in_count"`
+	CashOut       float64 `json:"cash_out"`
+	CashOutCount  int     `json:"cash_out_count"`
+	// OtherIn and OtherOut are the agent's other transfers.
+	OtherIn  float64 `json:"other_in"`
+	OtherOut float64 `json:"other_out"`
+	// Net is the change of the agent's float over the day.
+	Net float64 `json:"net"`
+}
+
+// GetAgentFloatReport summarizes the float movements of each agent per UTC
+// day between from and to, from its completed transactions. Without
+// agentIds, it covers every agent of the tenant. Days without movements
+// are left out.
+func GetAgentFloatReport(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, from, to time.Time, agentIds ...string) ([]AgentFloatDay, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if len(agentIds) == 0 {
+		agents, err := listAgents(ctx, dbSvc, tenantId)
+		if err != nil {
+			return nil, err
+		}
+		agentIds = agents
+	}
+	var report []AgentFloatDay
+	for _, agentId := range agentIds {
+		days := map[string]*AgentFloatDay{}
+		seen := map[string]bool{}
+		for _, index := range [][2]string{{"FromAccountIndex", "FromAccount"}, {"ToAccountIndex", "ToAccount"}} {
+			txs, err := completedTransactionsBetween(ctx, dbSvc, tenantId, index[0], index[1], agentId, from.Unix(), to.Unix())
+			if err != nil {
+				return nil, err
+			}
+			for _, tx := range txs {
+				if seen[tx.SystemTransactionID] {
+					continue
+				}
+				seen[tx.SystemTransactionID] = true
+				day := time.Unix(tx.TransactionDate, 0).UTC().Format(time.DateOnly)
+				if days[day] == nil {
+					days[day] = &AgentFloatDay{AgentID: agentId, Day: day}
+				}
+				days[day].add(tx, agentId)
+			}
+		}
+		for _, day := range days {
+			day.round()
+			report = append(report, *day)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].AgentID != report[j].AgentID {
+			return report[i].AgentID < report[j].AgentID
+		}
+		return report[i].Day < report[j].Day
+	})
+	return report, nil
+}
+
+// add counts a transaction of the agent in the day.
+func (d *AgentFloatDay) add(tx TransactionEntry, agentId string) {
+	var delta float64
+	for _, leg := range tx.Legs {
+		if leg.AccountID != agentId || bonusLeg(leg.Type) {
+			continue
+		}
+		if leg.Type == LegDebit || leg.Type == LegWithdrawal {
+			delta -= leg.Amount
+		} else {
+			delta += leg.Amount
+		}
+	}
+	d.Net += delta
+	switch {
+	case tx.Comment == NarrativeDeposit:
+		d.FloatAssigned += delta
+	case tx.Comment == NarrativeWithdrawal:
+		d.FloatReturned -= delta
+	case tx.Comment == NarrativeAgentCashIn && tx.FromAccount == agentId:
+		d.CashIn -= delta
+		d.CashInCount++
+	case tx.Comment == NarrativeAgentCashOut && tx.ToAccount == agentId:
+		d.CashOut += delta
+		d.CashOutCount++
+	case delta >= 0:
+		d.OtherIn += delta
+	default:
+		d.OtherOut -= delta
+	}
+}
+
+func (d *AgentFloatDay) round() {
+	d.FloatAssigned = roundAmount(d.FloatAssigned)
+	d.FloatReturned = roundAmount(d.FloatReturned)
+	d.CashIn = roundAmount(d.CashIn)
+	d.CashOut = roundAmount(d.CashOut)
+	d.OtherIn = roundAmount(d.OtherIn)
+	d.OtherOut = roundAmount(d.OtherOut)
+	d.Net = roundAmount(d.Net)
+}
+
+// listAgents returns the IDs of the tenant's agents.
+func listAgents(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		FilterExpression:       aws.String("attribute_exists(AgentFloat)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ProjectionExpression: aws.String("AccountID"),
+	}
+	var agents []string
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query agents: %v", err)
+		}
+		var rows []struct {
+			AccountID string `dynamodbav:"AccountID"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &rows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal agents: %v", err)
+		}
+		for _, row := range rows {
+			agents = append(agents, row.AccountID)
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return agents, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// completedTransactionsBetween returns the completed transactions sent or
+// received by an account, through index, between the unix times from and
+// to.
+func completedTransactionsBetween(ctx context.Context, dbSvc DynamoDBAPI, tenantId, index, attribute, accountId string, from, to int64) ([]TransactionEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TransactionsTable),
+		IndexName:              aws.String(index),
+		KeyConditionExpression: aws.String("TenantID = :tenantId AND " + attribute + " = :accountId"),
+		FilterExpression:       aws.String("TransactionDate BETWEEN :from AND :to AND TransactionStatus = :ok"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId":  &types.AttributeValueMemberS{Value: tenantId},
+			":accountId": &types.AttributeValueMemberS{Value: accountId},
+			":from":      &types.AttributeValueMemberN{Value: strconv.FormatInt(from, 10)},
+			":to":        &types.AttributeValueMemberN{Value: strconv.FormatInt(to, 10)},
+			":ok":        &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionCompleted))},
+		},
+	}
+	var txs []TransactionEntry
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query transactions of %s: %v", accountId, err)
+		}
+		var page []TransactionEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
+		}
+		txs = append(txs, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return txs, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,168 @@
+package ledger
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RoundingMode is how amounts are rounded to the precision of their
+// currency.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero: 0.125 becomes 0.13.
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven, or banker's rounding, rounds halves to the even
+	// digit: 0.125 becomes 0.12 and 0.135 becomes 0.14, so that rounding
+	// many amounts does not drift upwards.
+	RoundHalfEven
+	// RoundDown truncates towards zero.
+	RoundDown
+)
+
+// Rounding is the rounding mode of every amount the ledger computes, writes
+// and compares, such as fees, taxes and balances. Set it once at startup.
+var Rounding = RoundHalfUp
+
+// DefaultAmountPrecision is the number of decimals of currencies without a
+// precision of their own, and of amounts whose currency is not known.
+const DefaultAmountPrecision = 2
+
+var (
+	precisionMu sync.RWMutex
+	// currencyPrecisions are the ISO 4217 minor units of the currencies
+	// whose precision is not DefaultAmountPrecision.
+	currencyPrecisions = map[string]int{
+		"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+		"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+		"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+		"CLF": 4, "UYW": 4,
+	}
+)
+
+// SetCurrencyPrecision overrides the number of decimals amounts in currency
+// are kept to, e.g. to account for a currency without its minor unit.
+func SetCurrencyPrecision(currency string, decimals int) error {
+	if err := ValidateCurrency(currency); err != nil {
+		return err
+	}
+	if decimals < 0 || decimals > 8 {
+		return fmt.Errorf("precision of %s must be between 0 and 8 decimals", currency)
+	}
+	precisionMu.Lock()
+	defer precisionMu.Unlock()
+	currencyPrecisions[currency] = decimals
+	return nil
+}
+
+// CurrencyPrecision returns the number of decimals amounts in currency are
+// kept to; DefaultAmountPrecision for an empty currency.
+func CurrencyPrecision(currency string) int {
+	precisionMu.RLock()
+	defer precisionMu.RUnlock()
+	if decimals, ok := currencyPrecisions[currency]; ok {
+		return decimals
+	}
+	return DefaultAmountPrecision
+}
+
+// RoundAmount rounds amount to the precision of currency with Rounding. It
+// rounds the decimal amount as written, not its binary approximation, so
+// 2.675 rounds half up to 2.68.
+func RoundAmount(amount float64, currency string) float64 {
+	return roundDecimal(amount, CurrencyPrecision(currency), Rounding)
+}
+
+// FormatAmount formats amount with the precision of currency, as amounts are
+// written to the database and shown on receipts.
+func FormatAmount(amount float64, currency string) string {
+	decimals := CurrencyPrecision(currency)
+	return strconv.FormatFloat(roundDecimal(amount, decimals, Rounding), 'f', decimals, 64)
+}
+
+// ParseAmount parses a decimal amount in currency. It fails with
+// ErrInvalidAmount for an amount with more decimals than the currency has.
+func ParseAmount(s, currency string) (float64, error) {
+	amount, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, fmt.Errorf("%w: %q is not a number", ErrInvalidAmount, s)
+	}
+	if err := checkPrecision(amount, currency); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// checkPrecision fails with ErrInvalidAmount for an amount with more
+// decimals than currency has.
+func checkPrecision(amount float64, currency string) error {
+	if decimals := CurrencyPrecision(currency); roundDecimal(amount, decimals, RoundDown) != amount {
+		return fmt.Errorf("%w: %v has more than %d decimals", ErrInvalidAmount, amount, decimals)
+	}
+	return nil
+}
+
+// maxPrecision returns the most decimals of any currency, which amounts are
+// checked against until their currency is known.
+func maxPrecision() int {
+	precisionMu.RLock()
+	defer precisionMu.RUnlock()
+	decimals := DefaultAmountPrecision
+	for _, d := range currencyPrecisions {
+		decimals = max(decimals, d)
+	}
+	return decimals
+}
+
+// roundAmount rounds an amount whose currency is not at hand to
+// DefaultAmountPrecision.
+func roundAmount(amount float64) float64 {
+	return roundDecimal(amount, DefaultAmountPrecision, Rounding)
+}
+
+// formatAmount formats an amount whose currency is not at hand with
+// DefaultAmountPrecision.
+func formatAmount(amount float64) string {
+	return FormatAmount(amount, "")
+}
+
+// roundDecimal rounds amount to decimals with mode, working on the shortest
+// decimal representation of amount.
+func roundDecimal(amount float64, decimals int, mode RoundingMode) float64 {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return amount
+	}
+	digits := strconv.FormatFloat(math.Abs(amount), 'f', -1, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+	if len(frac) <= decimals {
+		return amount
+	}
+	kept, dropped := frac[:decimals], frac[decimals:]
+	up := false
+	switch mode {
+	case RoundHalfUp:
+		up = dropped[0] >= '5'
+	case RoundHalfEven:
+		switch {
+		case dropped[0] > '5':
+			up = true
+		case dropped[0] == '5':
+			last := whole[len(whole)-1]
+			if decimals > 0 {
+				last = kept[decimals-1]
+			}
+			up = strings.TrimRight(dropped[1:], "0") != "" || (last-'0')%2 == 1
+		}
+	}
+	rounded, _ := strconv.ParseFloat(whole+"."+kept, 64)
+	if up {
+		rounded, _ = strconv.ParseFloat(strconv.FormatFloat(rounded+math.Pow10(-decimals), 'f', decimals, 64), 64)
+	}
+	if amount < 0 {
+		rounded = -rounded
+	}
+	return rounded
+}
@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoundAmount(t *testing.T) {
+	defer func(mode RoundingMode) { Rounding = mode }(Rounding)
+	tests := []struct {
+		name     string
+		mode     RoundingMode
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{"half up", RoundHalfUp, 0.125, "SDG", 0.13},
+		{"half up of a binary approximation", RoundHalfUp, 2.675, "SDG", 2.68},
+		{"half up negative", RoundHalfUp, -0.125, "SDG", -0.13},
+		{"half even down", RoundHalfEven, 0.125, "SDG", 0.12},
+		{"half even up", RoundHalfEven, 0.135, "SDG", 0.14},
+		{"half even above half", RoundHalfEven, 0.1251, "SDG", 0.13},
+		{"half even whole", RoundHalfEven, 2.5, "JPY", 2},
+		{"down", RoundDown, 0.129, "SDG", 0.12},
+		{"no decimals", RoundHalfUp, 1234.5, "JPY", 1235},
+		{"three decimals", RoundHalfUp, 1.2345, "KWD", 1.235},
+		{"already rounded", RoundHalfEven, 10.5, "SDG", 10.5},
+		{"carry", RoundHalfUp, 9.995, "", 10},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			Rounding = tt.mode
+			if got := RoundAmount(tt.amount, tt.currency); got != tt.want {
+				t.Errorf("RoundAmount(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatAndParseAmount(t *testing.T) {
+	if got := FormatAmount(12.5, "SDG"); got != "12.50" {
+		t.Errorf("FormatAmount(SDG) = %q", got)
+	}
+	if got := FormatAmount(1234.4, "JPY"); got != "1234" {
+		t.Errorf("FormatAmount(JPY) = %q", got)
+	}
+	if got := FormatAmount(1.2, "KWD"); got != "1.200" {
+		t.Errorf("FormatAmount(KWD) = %q", got)
+	}
+	if got, err := ParseAmount(" 10.25 ", "USD"); err != nil || got != 10.25 {
+		t.Errorf("ParseAmount() = %v, %v", got, err)
+	}
+	for _, s := range []string{"10.255", "abc", "NaN"} {
+		if _, err := ParseAmount(s, "USD"); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("ParseAmount(%q) error = %v, want ErrInvalidAmount", s, err)
+		}
+	}
+	if _, err := ParseAmount("10.5", "JPY"); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("ParseAmount() of a fractional yen amount error = %v", err)
+	}
+	if err := SetCurrencyPrecision("SDG", 9); err == nil {
+		t.Error("SetCurrencyPrecision() to 9 decimals succeeded")
+	}
+}
@@ -0,0 +1,213 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TenantAnalyticsTable holds the transfers of each tenant aggregated per UTC
+// day, keyed by TenantID and Day. It is maintained by ledgers created with
+// WithAnalytics.
+var TenantAnalyticsTable = "TenantAnalytics"
+
+const analyticsDayLayout = "2006-01-02"
+
+// AnalyticsGroupBy is the period GetTenantAnalytics groups days by.
+type AnalyticsGroupBy string
+
+const (
+	AnalyticsByDay   AnalyticsGroupBy = "day"
+	AnalyticsByWeek  AnalyticsGroupBy = "week"
+	AnalyticsByMonth AnalyticsGroupBy = "month"
+)
+
+// ErrInvalidGroupBy is returned by GetTenantAnalytics for an unknown
+// grouping.
+var ErrInvalidGroupBy = errors.New("invalid_group_by")
+
+// WithAnalytics aggregates every recorded transfer into TenantAnalyticsTable
+// for GetTenantAnalytics. The aggregate is updated after the transfer, at
+// the cost of a write; a failed update is logged and does not fail the
+// transfer.
+func WithAnalytics() Option {
+	return func(l *Ledger) {
+		l.analytics = true
+	}
+}
+
+func analyticsEnabled(dbSvc DynamoDBAPI) bool {
+	l, ok := dbSvc.(*Ledger)
+	return ok && l.analytics
+}
+
+// analyticsDay is an item of TenantAnalyticsTable. Accounts holds the
+// accounts active on the day, the senders and recipients of its completed
+// transfers; it bounds a day to some ten thousand active accounts.
+type analyticsDay struct {
+	TenantID  string   `dynamodbav:"TenantID"`
+	Day       string   `dynamodbav:"Day"`
+	Transfers int64    `dynamodbav:"Transfers"`
+	Completed int64    `dynamodbav:"Completed"`
+	Failed    int64    `dynamodbav:"Failed"`
+	Volume    float64  `dynamodbav:"Volume"`
+	Accounts  []string `dynamodbav:"Accounts,stringset,omitempty"`
+}
+
+// recordAnalytics adds a recorded transfer to its day's aggregate. Failed
+// and blocked transfers count as failures; other statuses only count as
+// transfers.
+func recordAnalytics(ctx context.Context, dbSvc DynamoDBAPI, record TransactionRecord, status TransactionStatus) {
+	if !analyticsEnabled(dbSvc) {
+		return
+	}
+	day := time.Unix(record.TransactionDate, 0).UTC().Format(analyticsDayLayout)
+	update := "ADD Transfers :one"
+	values := map[string]types.AttributeValue{
+		":one": &types.AttributeValueMemberN{Value: "1"},
+	}
+	switch status {
+	case TransactionCompleted:
+		update += ", Completed :one, Volume :amount, Accounts :accounts"
+		values[":amount"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(record.Amount, 'f', -1, 64)}
+		accounts := []string{record.FromAccount}
+		if record.ToAccount != record.FromAccount {
+			accounts = append(accounts, record.ToAccount)
+		}
+		values[":accounts"] = &types.AttributeValueMemberSS{Value: accounts}
+	case TransactionFailed, TransactionBlocked:
+		update += ", Failed :one"
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TenantAnalyticsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: record.TenantID},
+			"Day":      &types.AttributeValueMemberS{Value: day},
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "failed to update tenant analytics", "tenant", record.TenantID, "txid", record.TransactionID, "day", day, "error", err)
+	}
+}
+
+// AnalyticsBucket is the activity of a tenant in a period.
+type AnalyticsBucket struct {
+	// Period is the period's first day, or its month for AnalyticsByMonth.
+	Period string `json:"period"`
+	Start  int64  `json:"start"`
+	// Transfers counts every recorded transfer, Completed and Failed those
+	// that completed and that failed or were blocked.
+	Transfers int64 `json:"transfers"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+	// Volume is the amount of the completed transfers, and AverageAmount
+	// their average.
+	Volume        float64 `json:"volume"`
+	AverageAmount float64 `json:"average_amount"`
+	// FailureRate is Failed over Transfers.
+	FailureRate float64 `json:"failure_rate"`
+	// ActiveAccounts counts the distinct senders and recipients of the
+	// completed transfers.
+	ActiveAccounts int `json:"active_accounts"`
+}
+
+// GetTenantAnalytics returns a tenant's transfers from from to to, both
+// inclusive and in whole UTC days, grouped by day, week (starting on
+// Monday) or month. Periods without transfers are left out. It reads the
+// aggregates maintained by WithAnalytics, never TransactionsTable.
+func GetTenantAnalytics(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, from, to time.Time, groupBy AnalyticsGroupBy) ([]AnalyticsBucket, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if groupBy == "" {
+		groupBy = AnalyticsByDay
+	}
+	if groupBy != AnalyticsByDay && groupBy != AnalyticsByWeek && groupBy != AnalyticsByMonth {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidGroupBy, groupBy)
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TenantAnalyticsTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId AND #day BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{
+			"#day": "Day",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+			":from":     &types.AttributeValueMemberS{Value: from.UTC().Format(analyticsDayLayout)},
+			":to":       &types.AttributeValueMemberS{Value: to.UTC().Format(analyticsDayLayout)},
+		},
+	}
+
+	var buckets []AnalyticsBucket
+	accounts := map[string]map[string]bool{}
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query tenant analytics: %v", err)
+		}
+		var days []analyticsDay
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &days); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tenant analytics: %v", err)
+		}
+		for _, day := range days {
+			period, start, err := analyticsPeriod(day.Day, groupBy)
+			if err != nil {
+				return nil, err
+			}
+			// Days are read in order, so a period's days are adjacent.
+			if len(buckets) == 0 || buckets[len(buckets)-1].Period != period {
+				buckets = append(buckets, AnalyticsBucket{Period: period, Start: start.Unix()})
+				accounts[period] = map[string]bool{}
+			}
+			bucket := &buckets[len(buckets)-1]
+			bucket.Transfers += day.Transfers
+			bucket.Completed += day.Completed
+			bucket.Failed += day.Failed
+			bucket.Volume += day.Volume
+			for _, account := range day.Accounts {
+				accounts[period][account] = true
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	for i := range buckets {
+		bucket := &buckets[i]
+		bucket.ActiveAccounts = len(accounts[bucket.Period])
+		if bucket.Completed > 0 {
+			bucket.AverageAmount = bucket.Volume / float64(bucket.Completed)
+		}
+		if bucket.Transfers > 0 {
+			bucket.FailureRate = float64(bucket.Failed) / float64(bucket.Transfers)
+		}
+	}
+	return buckets, nil
+}
+
+// analyticsPeriod returns the period of a day and its start.
+func analyticsPeriod(day string, groupBy AnalyticsGroupBy) (string, time.Time, error) {
+	start, err := time.Parse(analyticsDayLayout, day)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid analytics day %s: %v", day, err)
+	}
+	switch groupBy {
+	case AnalyticsByWeek:
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	case AnalyticsByMonth:
+		start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start, nil
+	}
+	return start.Format(analyticsDayLayout), start, nil
+}
@@ -0,0 +1,341 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	// AnnotationsTable holds the customers' private notes on transactions,
+	// keyed by OwnerID (tenant and account) and TransactionID. It is kept
+	// apart from TransactionsTable so annotating never touches the
+	// financial record.
+	AnnotationsTable = "TransactionAnnotations"
+
+	// ReceiptsBucket is the S3 bucket receipt files are uploaded to.
+	ReceiptsBucket = "nil-receipts"
+)
+
+// Annotation limits.
+const (
+	MaxNoteLength      = 500
+	MaxAnnotationTags  = 10
+	MaxTagLength       = 32
+	MaxReceipts        = 5
+	MaxReceiptSize     = 5 << 20
+	maxBatchGetKeys    = 100
+	maxBatchGetRetries = 3
+)
+
+// receiptContentTypes are the file types accepted as receipts.
+var receiptContentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/heic":      true,
+	"application/pdf": true,
+}
+
+// Annotation is what an account holder attached to one of their
+// transactions. It is private to the account: the sender and the receiver of
+// a transfer each have their own.
+type Annotation struct {
+	OwnerID       string    `dynamodbav:"OwnerID" json:"-"`
+	TransactionID string    `dynamodbav:"TransactionID" json:"transaction_id"`
+	TenantID      string    `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	AccountID     string    `dynamodbav:"AccountID" json:"account_id"`
+	Note          string    `dynamodbav:"Note,omitempty" json:"note,omitempty"`
+	Category      string    `dynamodbav:"Category,omitempty" json:"category,omitempty"`
+	Tags          []string  `dynamodbav:"Tags,omitempty" json:"tags,omitempty"`
+	Receipts      []Receipt `dynamodbav:"Receipts,omitempty" json:"receipts,omitempty"`
+	UpdatedAt     int64     `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// Receipt is a file stored in ReceiptsBucket under Key.
+type Receipt struct {
+	Key         string `dynamodbav:"Key" json:"key"`
+	ContentType string `dynamodbav:"ContentType" json:"content_type"`
+	Size        int64  `dynamodbav:"Size" json:"size"`
+	UploadedAt  int64  `dynamodbav:"UploadedAt" json:"uploaded_at"`
+}
+
+// AnnotationUpdate changes an annotation. Nil fields are left unchanged;
+// an empty Tags slice clears the tags.
+type AnnotationUpdate struct {
+	Note     *string
+	Category *string
+	Tags     []string
+}
+
+// Validate checks the update against the annotation limits.
+func (u AnnotationUpdate) Validate() error {
+	if u.Note == nil && u.Category == nil && u.Tags == nil {
+		return errors.New("nothing to update")
+	}
+	if u.Note != nil && utf8.RuneCountInString(*u.Note) > MaxNoteLength {
+		return fmt.Errorf("note is longer than %d characters", MaxNoteLength)
+	}
+	if u.Category != nil && utf8.RuneCountInString(*u.Category) > MaxTagLength {
+		return fmt.Errorf("category is longer than %d characters", MaxTagLength)
+	}
+	if len(u.Tags) > MaxAnnotationTags {
+		return fmt.Errorf("at most %d tags are allowed", MaxAnnotationTags)
+	}
+	for _, tag := range u.Tags {
+		if tag == "" || utf8.RuneCountInString(tag) > MaxTagLength {
+			return fmt.Errorf("tags must be 1 to %d characters", MaxTagLength)
+		}
+	}
+	return nil
+}
+
+// ObjectPutter uploads objects; *s3.Client satisfies it.
+type ObjectPutter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+func annotationOwner(tenantId, accountId string) string {
+	return tenantId + "#" + accountId
+}
+
+func annotationKey(tenantId, accountId, transactionId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"OwnerID":       &types.AttributeValueMemberS{Value: annotationOwner(tenantId, accountId)},
+		"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+	}
+}
+
+// checkTransactionParty returns an error unless accountId sent or received
+// the transaction.
+func checkTransactionParty(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, transactionId string) error {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+			"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+		},
+		ProjectionExpression: aws.String("FromAccount, ToAccount"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get transaction: %v", err)
+	}
+	if result.Item == nil {
+		return ErrTransactionNotFound
+	}
+	var tx TransactionEntry
+	if err := attributevalue.UnmarshalMap(result.Item, &tx); err != nil {
+		return fmt.Errorf("failed to unmarshal transaction: %v", err)
+	}
+	if tx.FromAccount != accountId && tx.ToAccount != accountId {
+		return fmt.Errorf("account %s is not a party to transaction %s", accountId, transactionId)
+	}
+	return nil
+}
+
+// AnnotateTransaction sets the note, category or tags an account holder
+// keeps on one of their transactions.
+func AnnotateTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, transactionId string, update AnnotationUpdate) (*Annotation, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if err := update.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkTransactionParty(ctx, dbSvc, tenantId, accountId, transactionId); err != nil {
+		return nil, err
+	}
+
+	updateExpr := "SET TenantID = :tenantID, AccountID = :accountID, UpdatedAt = :now"
+	values := map[string]types.AttributeValue{
+		":tenantID":  &types.AttributeValueMemberS{Value: tenantId},
+		":accountID": &types.AttributeValueMemberS{Value: accountId},
+		":now":       &types.AttributeValueMemberN{Value: fmt.Sprint(getCurrentTimestamp())},
+	}
+	var removes []string
+	if update.Note != nil {
+		if *update.Note == "" {
+			removes = append(removes, "Note")
+		} else {
+			updateExpr += ", Note = :note"
+			values[":note"] = &types.AttributeValueMemberS{Value: *update.Note}
+		}
+	}
+	if update.Category != nil {
+		if *update.Category == "" {
+			removes = append(removes, "Category")
+		} else {
+			updateExpr += ", Category = :category"
+			values[":category"] = &types.AttributeValueMemberS{Value: *update.Category}
+		}
+	}
+	if update.Tags != nil {
+		if len(update.Tags) == 0 {
+			removes = append(removes, "Tags")
+		} else {
+			tags, err := attributevalue.Marshal(update.Tags)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal tags: %v", err)
+			}
+			updateExpr += ", Tags = :tags"
+			values[":tags"] = tags
+		}
+	}
+	for i, attr := range removes {
+		if i == 0 {
+			updateExpr += " REMOVE " + attr
+		} else {
+			updateExpr += ", " + attr
+		}
+	}
+
+	result, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(AnnotationsTable),
+		Key:                       annotationKey(tenantId, accountId, transactionId),
+		UpdateExpression:          aws.String(updateExpr),
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to annotate transaction: %v", err)
+	}
+	var annotation Annotation
+	if err := attributevalue.UnmarshalMap(result.Attributes, &annotation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal annotation: %v", err)
+	}
+	return &annotation, nil
+}
+
+// AttachReceipt uploads a receipt file to ReceiptsBucket and adds it to the
+// account holder's annotation of the transaction.
+func AttachReceipt(ctx context.Context, dbSvc DynamoDBAPI, store ObjectPutter, tenantId, accountId, transactionId, contentType string, body []byte) (*Receipt, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if !receiptContentTypes[contentType] {
+		return nil, fmt.Errorf("unsupported receipt type %q", contentType)
+	}
+	if len(body) == 0 || len(body) > MaxReceiptSize {
+		return nil, fmt.Errorf("receipt must be between 1 byte and %d bytes", MaxReceiptSize)
+	}
+	if err := checkTransactionParty(ctx, dbSvc, tenantId, accountId, transactionId); err != nil {
+		return nil, err
+	}
+
+	receipt := Receipt{
+		Key:         fmt.Sprintf("receipts/%s/%s/%s/%s", tenantId, accountId, transactionId, ksuid.New().String()),
+		ContentType: contentType,
+		Size:        int64(len(body)),
+		UploadedAt:  getCurrentTimestamp(),
+	}
+	_, err := store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(ReceiptsBucket),
+		Key:           aws.String(receipt.Key),
+		Body:          bytes.NewReader(body),
+		ContentType:   aws.String(contentType),
+		ContentLength: receipt.Size,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload receipt: %v", err)
+	}
+
+	av, err := attributevalue.Marshal(receipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal receipt: %v", err)
+	}
+	_, err = dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(AnnotationsTable),
+		Key:                 annotationKey(tenantId, accountId, transactionId),
+		UpdateExpression:    aws.String("SET TenantID = :tenantID, AccountID = :accountID, UpdatedAt = :now, Receipts = list_append(if_not_exists(Receipts, :empty), :receipt)"),
+		ConditionExpression: aws.String("attribute_not_exists(Receipts) OR size(Receipts) < :max"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			":accountID": &types.AttributeValueMemberS{Value: accountId},
+			":now":       &types.AttributeValueMemberN{Value: fmt.Sprint(receipt.UploadedAt)},
+			":empty":     &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":receipt":   &types.AttributeValueMemberL{Value: []types.AttributeValue{av}},
+			":max":       &types.AttributeValueMemberN{Value: fmt.Sprint(MaxReceipts)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return nil, fmt.Errorf("at most %d receipts are allowed per transaction", MaxReceipts)
+		}
+		return nil, fmt.Errorf("failed to save receipt: %v", err)
+	}
+	return &receipt, nil
+}
+
+// GetAnnotation returns the account holder's annotation of a transaction,
+// or nil if there is none.
+func GetAnnotation(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, transactionId string) (*Annotation, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(AnnotationsTable),
+		Key:       annotationKey(tenantId, accountId, transactionId),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get annotation: %v", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var annotation Annotation
+	if err := attributevalue.UnmarshalMap(result.Item, &annotation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal annotation: %v", err)
+	}
+	return &annotation, nil
+}
+
+// AttachAnnotations sets the Annotation of every transaction accountId
+// annotated, reading them in batches.
+func AttachAnnotations(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, transactions []TransactionEntry) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	byID := map[string][]int{}
+	var keys []map[string]types.AttributeValue
+	for i, tx := range transactions {
+		if _, ok := byID[tx.SystemTransactionID]; !ok {
+			keys = append(keys, annotationKey(tenantId, accountId, tx.SystemTransactionID))
+		}
+		byID[tx.SystemTransactionID] = append(byID[tx.SystemTransactionID], i)
+	}
+
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		pending := map[string]types.KeysAndAttributes{
+			AnnotationsTable: {Keys: keys[start:min(start+maxBatchGetKeys, len(keys))]},
+		}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == maxBatchGetRetries {
+				return errors.New("failed to read annotations: keys left unprocessed")
+			}
+			result, err := dbSvc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: pending})
+			if err != nil {
+				return fmt.Errorf("failed to read annotations: %v", err)
+			}
+			var annotations []Annotation
+			if err := attributevalue.UnmarshalListOfMaps(result.Responses[AnnotationsTable], &annotations); err != nil {
+				return fmt.Errorf("failed to unmarshal annotations: %v", err)
+			}
+			for i := range annotations {
+				for _, j := range byID[annotations[i].TransactionID] {
+					transactions[j].Annotation = &annotations[i]
+				}
+			}
+			pending = result.UnprocessedKeys
+		}
+	}
+	return nil
+}
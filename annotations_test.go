@@ -0,0 +1,33 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnnotationUpdateValidate(t *testing.T) {
+	note := func(s string) *string { return &s }
+	tests := []struct {
+		name    string
+		update  AnnotationUpdate
+		wantErr bool
+	}{
+		{"note", AnnotationUpdate{Note: note("lunch with Sara")}, false},
+		{"clear note", AnnotationUpdate{Note: note("")}, false},
+		{"emoji tags", AnnotationUpdate{Tags: []string{"🍔", "food"}}, false},
+		{"clear tags", AnnotationUpdate{Tags: []string{}}, false},
+		{"nothing", AnnotationUpdate{}, true},
+		{"long note", AnnotationUpdate{Note: note(strings.Repeat("x", MaxNoteLength+1))}, true},
+		{"emoji note at limit", AnnotationUpdate{Note: note(strings.Repeat("🍔", MaxNoteLength))}, false},
+		{"empty tag", AnnotationUpdate{Tags: []string{""}}, true},
+		{"too many tags", AnnotationUpdate{Tags: strings.Split(strings.Repeat("t,", MaxAnnotationTags), ",")}, true},
+		{"long category", AnnotationUpdate{Category: note(strings.Repeat("c", MaxTagLength+1))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.update.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
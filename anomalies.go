@@ -0,0 +1,359 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AnomaliesTable holds the findings of DetectAnomalies and
+// AnomalyBaselinesTable what it learned of each tenant's normal activity.
+var (
+	AnomaliesTable        = "Anomalies"
+	AnomalyBaselinesTable = "AnomalyBaselines"
+)
+
+// Tuning of the anomaly detector.
+var (
+	// AnomalyThreshold is how many standard deviations from its baseline a
+	// window must be to be flagged.
+	AnomalyThreshold = 3.0
+	// AnomalyMinSamples is how many windows a baseline learns from before
+	// it is used to flag anything.
+	AnomalyMinSamples = 24
+	// AnomalyLearningRate is the weight of the newest window in the
+	// exponentially weighted baseline.
+	AnomalyLearningRate = 0.1
+)
+
+// Metrics tracked per segment.
+const (
+	AnomalyMetricCount    = "count"
+	AnomalyMetricVolume   = "volume"
+	AnomalyMetricFailures = "failures"
+)
+
+const (
+	AnomalySpike = "spike"
+	AnomalyDrop  = "drop"
+)
+
+// Segmenter returns the segments a transaction counts towards, e.g.
+// "corridor:international". Every segment gets its own baseline.
+type Segmenter func(tx TransactionEntry) []string
+
+// DefaultSegmenter groups a tenant's transactions as a whole, by corridor
+// and by amount band. Deployments with richer account segments (KYC tier,
+// region, merchant type) supply their own.
+func DefaultSegmenter(tx TransactionEntry) []string {
+	corridor := "corridor:domestic"
+	if tx.IsInternational {
+		corridor = "corridor:international"
+	}
+	band := "band:small"
+	switch {
+	case tx.Amount >= 100_000:
+		band = "band:large"
+	case tx.Amount >= 1_000:
+		band = "band:medium"
+	}
+	return []string{"all", corridor, band}
+}
+
+// AnomalyAlerter tells operators about an anomaly.
+type AnomalyAlerter func(ctx context.Context, anomaly Anomaly) error
+
+// DefaultAnomalyAlerter is called for every anomaly found. It only logs;
+// deployments route it to their paging or chat tool.
+var DefaultAnomalyAlerter AnomalyAlerter = func(ctx context.Context, a Anomaly) error {
+	slog.Default().WarnContext(ctx, "transaction anomaly",
+		"tenant", a.TenantID, "segment", a.Segment, "metric", a.Metric, "kind", a.Kind,
+		"observed", a.Observed, "expected", a.Expected, "score", a.Score)
+	return nil
+}
+
+// Anomaly is a window in which a segment's activity was unusually far from
+// its baseline.
+type Anomaly struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id"`
+	AnomalyID string `dynamodbav:"AnomalyID" json:"anomaly_id"`
+	Segment   string `dynamodbav:"Segment" json:"segment"`
+	Metric    string `dynamodbav:"Metric" json:"metric"`
+	// Kind is AnomalySpike or AnomalyDrop.
+	Kind     string  `dynamodbav:"Kind" json:"kind"`
+	Observed float64 `dynamodbav:"Observed" json:"observed"`
+	Expected float64 `dynamodbav:"Expected" json:"expected"`
+	StdDev   float64 `dynamodbav:"StdDev" json:"std_dev"`
+	// Score is the distance from the baseline in standard deviations.
+	Score       float64 `dynamodbav:"Score" json:"score"`
+	WindowStart int64   `dynamodbav:"WindowStart" json:"window_start"`
+	WindowEnd   int64   `dynamodbav:"WindowEnd" json:"window_end"`
+	DetectedAt  int64   `dynamodbav:"DetectedAt" json:"detected_at"`
+}
+
+// AnomalyBaseline is the learned normal value of one metric of a segment.
+type AnomalyBaseline struct {
+	TenantID string  `dynamodbav:"TenantID" json:"tenant_id"`
+	Key      string  `dynamodbav:"Key" json:"key"`
+	Mean     float64 `dynamodbav:"Mean" json:"mean"`
+	Variance float64 `dynamodbav:"Variance" json:"variance"`
+	Samples  int     `dynamodbav:"Samples" json:"samples"`
+	// LastWindowEnd is the end of the last window learned, so a window is
+	// never learned twice.
+	LastWindowEnd int64 `dynamodbav:"LastWindowEnd" json:"last_window_end"`
+}
+
+// stdDev is the baseline's standard deviation, floored so that a very
+// regular segment is not flagged for noise.
+func (b *AnomalyBaseline) stdDev() float64 {
+	return max(math.Sqrt(b.Variance), 0.1*math.Abs(b.Mean), 1)
+}
+
+// learn folds a window's value into the baseline.
+func (b *AnomalyBaseline) learn(x float64) {
+	if b.Samples == 0 {
+		b.Mean = x
+	} else {
+		diff := x - b.Mean
+		b.Mean += AnomalyLearningRate * diff
+		b.Variance = (1 - AnomalyLearningRate) * (b.Variance + AnomalyLearningRate*diff*diff)
+	}
+	b.Samples++
+}
+
+// score returns how unusual x is for the baseline and whether it is
+// anomalous. Nothing is anomalous before the baseline has learned enough.
+func (b *AnomalyBaseline) score(x float64) (float64, bool) {
+	if b.Samples < AnomalyMinSamples {
+		return 0, false
+	}
+	z := (x - b.Mean) / b.stdDev()
+	return z, math.Abs(z) >= AnomalyThreshold
+}
+
+// windowTotals sums the metrics of every segment over a window.
+func windowTotals(transactions []TransactionEntry, segmenter Segmenter) map[string]float64 {
+	totals := map[string]float64{}
+	for _, tx := range transactions {
+		failed := tx.Status != nil && *tx.Status == TransactionFailed
+		for _, segment := range segmenter(tx) {
+			if failed {
+				totals[segment+"#"+AnomalyMetricFailures]++
+				continue
+			}
+			totals[segment+"#"+AnomalyMetricCount]++
+			totals[segment+"#"+AnomalyMetricVolume] += tx.Amount
+		}
+	}
+	return totals
+}
+
+// DetectAnomalies compares a tenant's activity in the window [end-window,
+// end) with the baselines learned from the previous windows, records and
+// alerts on the segments that stand out, and then learns the window. It is
+// run by a job at the end of every window; a window already learned is
+// skipped, so reruns are harmless. A nil segmenter uses DefaultSegmenter.
+// It returns ErrDegraded while the ledger is degraded.
+func DetectAnomalies(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, end time.Time, window time.Duration, segmenter Segmenter) ([]Anomaly, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if segmenter == nil {
+		segmenter = DefaultSegmenter
+	}
+	if degraded(dbSvc) {
+		return nil, fmt.Errorf("%w: anomaly detection skipped", ErrDegraded)
+	}
+	start := end.Add(-window)
+	var transactions []TransactionEntry
+	err := eachTransaction(ctx, dbSvc, tenantId, start, end, nil, func(tx TransactionEntry) {
+		transactions = append(transactions, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	totals := windowTotals(transactions, segmenter)
+
+	baselines, err := getAnomalyBaselines(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	// Segments absent from the window count as zero, which is how drops
+	// are found.
+	for key := range baselines {
+		if _, ok := totals[key]; !ok {
+			totals[key] = 0
+		}
+	}
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var anomalies []Anomaly
+	var errs []error
+	for _, key := range keys {
+		baseline, ok := baselines[key]
+		if !ok {
+			baseline = &AnomalyBaseline{TenantID: tenantId, Key: key}
+		}
+		if baseline.LastWindowEnd >= end.Unix() {
+			continue
+		}
+		observed := totals[key]
+		if z, unusual := baseline.score(observed); unusual {
+			anomaly := newAnomaly(tenantId, key, baseline, observed, z, start, end)
+			if err := putAnomaly(ctx, dbSvc, anomaly); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			anomalies = append(anomalies, anomaly)
+			if DefaultAnomalyAlerter != nil {
+				if err := DefaultAnomalyAlerter(ctx, anomaly); err != nil {
+					loggerOf(dbSvc).WarnContext(ctx, "failed to alert on anomaly", "tenant", tenantId, "anomaly", anomaly.AnomalyID, "error", err)
+				}
+			}
+		}
+		errs = append(errs, putAnomalyBaseline(ctx, dbSvc, baseline, observed, end))
+	}
+	return anomalies, errors.Join(errs...)
+}
+
+func newAnomaly(tenantId, key string, baseline *AnomalyBaseline, observed, z float64, start, end time.Time) Anomaly {
+	i := strings.LastIndex(key, "#")
+	segment, metric := key[:i], key[i+1:]
+	kind := AnomalySpike
+	if z < 0 {
+		kind = AnomalyDrop
+	}
+	return Anomaly{
+		TenantID:    tenantId,
+		AnomalyID:   fmt.Sprintf("%019d#%s", end.Unix(), key),
+		Segment:     segment,
+		Metric:      metric,
+		Kind:        kind,
+		Observed:    observed,
+		Expected:    baseline.Mean,
+		StdDev:      baseline.stdDev(),
+		Score:       z,
+		WindowStart: start.Unix(),
+		WindowEnd:   end.Unix(),
+		DetectedAt:  getCurrentTimestamp(),
+	}
+}
+
+func putAnomaly(ctx context.Context, dbSvc DynamoDBAPI, anomaly Anomaly) error {
+	item, err := attributevalue.MarshalMap(anomaly)
+	if err != nil {
+		return fmt.Errorf("failed to marshal anomaly: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(AnomaliesTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store anomaly %s: %v", anomaly.AnomalyID, err)
+	}
+	return nil
+}
+
+// putAnomalyBaseline learns a window, unless a concurrent run learned it
+// first.
+func putAnomalyBaseline(ctx context.Context, dbSvc DynamoDBAPI, baseline *AnomalyBaseline, observed float64, end time.Time) error {
+	previous := baseline.LastWindowEnd
+	baseline.learn(observed)
+	baseline.LastWindowEnd = end.Unix()
+	item, err := attributevalue.MarshalMap(baseline)
+	if err != nil {
+		return fmt.Errorf("failed to marshal anomaly baseline: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(AnomalyBaselinesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(LastWindowEnd) OR LastWindowEnd = :previous"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":previous": &types.AttributeValueMemberN{Value: strconv.FormatInt(previous, 10)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return nil
+		}
+		return fmt.Errorf("failed to store anomaly baseline %s: %v", baseline.Key, err)
+	}
+	return nil
+}
+
+func getAnomalyBaselines(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (map[string]*AnomalyBaseline, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(AnomalyBaselinesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	baselines := map[string]*AnomalyBaseline{}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query anomaly baselines: %v", err)
+		}
+		var page []AnomalyBaseline
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal anomaly baselines: %v", err)
+		}
+		for i := range page {
+			baselines[page[i].Key] = &page[i]
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return baselines, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// ListAnomalies returns the anomalies of a tenant found in windows ending
+// at or after since, oldest first.
+func ListAnomalies(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, since time.Time) ([]Anomaly, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(AnomaliesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId AND AnomalyID >= :since"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+			":since":    &types.AttributeValueMemberS{Value: fmt.Sprintf("%019d", since.Unix())},
+		},
+	}
+	var anomalies []Anomaly
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query anomalies: %v", err)
+		}
+		var page []Anomaly
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal anomalies: %v", err)
+		}
+		anomalies = append(anomalies, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return anomalies, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
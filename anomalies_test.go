@@ -0,0 +1,71 @@
+package ledger
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAnomalyBaselineLearnAndScore(t *testing.T) {
+	var b AnomalyBaseline
+	for i := 0; i < AnomalyMinSamples; i++ {
+		if _, unusual := b.score(1000); unusual {
+			t.Fatalf("flagged after %d samples, want nothing before %d", i, AnomalyMinSamples)
+		}
+		// Alternates around 100.
+		b.learn(100 + float64(10*(i%2*2-1)))
+	}
+	if math.Abs(b.Mean-100) > 10 {
+		t.Errorf("Mean = %v, want about 100", b.Mean)
+	}
+
+	tests := []struct {
+		name      string
+		observed  float64
+		wantSign  float64
+		wantFlags bool
+	}{
+		{"usual", 105, 1, false},
+		{"spike", 400, 1, true},
+		{"drop", 0, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, unusual := b.score(tt.observed)
+			if unusual != tt.wantFlags || unusual && math.Signbit(z) != math.Signbit(tt.wantSign) {
+				t.Errorf("score(%v) = %v, %v, want flagged %v", tt.observed, z, unusual, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestWindowTotals(t *testing.T) {
+	failed := TransactionFailed
+	totals := windowTotals([]TransactionEntry{
+		{Amount: 50},
+		{Amount: 5_000, IsInternational: true},
+		{Amount: 20, Status: &failed},
+	}, DefaultSegmenter)
+	want := map[string]float64{
+		"all#count":                     2,
+		"all#volume":                    5_050,
+		"all#failures":                  1,
+		"corridor:domestic#count":       1,
+		"corridor:domestic#volume":      50,
+		"corridor:domestic#failures":    1,
+		"corridor:international#count":  1,
+		"corridor:international#volume": 5_000,
+		"band:small#count":              1,
+		"band:small#volume":             50,
+		"band:small#failures":           1,
+		"band:medium#count":             1,
+		"band:medium#volume":            5_000,
+	}
+	if len(totals) != len(want) {
+		t.Errorf("got %d totals, want %d: %v", len(totals), len(want), totals)
+	}
+	for key, value := range want {
+		if totals[key] != value {
+			t.Errorf("totals[%q] = %v, want %v", key, totals[key], value)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TransferApprovalsTable holds the transfers waiting for the sign-off of
+// their tenant's approvers.
+var TransferApprovalsTable = "TransferApprovals"
+
+const (
+	TransferPendingApproval = "pending_approval"
+	TransferApprovalRunning = "executing"
+	TransferApproved        = "executed"
+	TransferRejected        = "rejected"
+	TransferApprovalFailed  = "failed"
+)
+
+// TransferApproval is a transfer above its tenant's ApprovalThreshold. Like a
+// delayed transfer, nothing is debited while it is pending; it is executed,
+// and the balance checked again, once Required approvers have approved it.
+type TransferApproval struct {
+	TenantID   string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	TransferID string `dynamodbav:"TransferID" json:"transfer_id,omitempty"`
+	// AccountID is the sender.
+	AccountID string           `dynamodbav:"AccountID" json:"account_id,omitempty"`
+	Transfer  TransactionEntry `dynamodbav:"Transfer" json:"transfer"`
+	// Splits are the receivers of a split transfer, whose Transfer is their
+	// total to SplitToAccount.
+	Splits []Split `dynamodbav:"Splits,omitempty" json:"splits,omitempty"`
+	Status string  `dynamodbav:"Status" json:"status"`
+	// Required is the quorum, fixed when the transfer was requested.
+	Required int `dynamodbav:"Required" json:"required"`
+	// ApprovedBy lists the approvers who approved the transfer, in order.
+	ApprovedBy []string `dynamodbav:"ApprovedBy" json:"approved_by"`
+	RejectedBy string   `dynamodbav:"RejectedBy,omitempty" json:"rejected_by,omitempty"`
+	Reason     string   `dynamodbav:"Reason,omitempty" json:"reason,omitempty"`
+	// TransactionID is the transaction created once approved.
+	TransactionID string `dynamodbav:"TransactionID,omitempty" json:"transaction_id,omitempty"`
+	FailureReason string `dynamodbav:"FailureReason,omitempty" json:"failure_reason,omitempty"`
+	CreatedAt     int64  `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+	UpdatedAt     int64  `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// needsApproval reports whether a transfer of amount must be approved first.
+func (c *TenantConfig) needsApproval(amount float64) bool {
+	return c.ApprovalThreshold > 0 && amount > c.ApprovalThreshold
+}
+
+func (c *TenantConfig) validateApprovals() error {
+	if c.ApprovalThreshold < 0 || c.RequiredApprovals < 0 {
+		return errors.New("approval threshold and required approvals must not be negative")
+	}
+	if c.ApprovalThreshold == 0 {
+		return nil
+	}
+	if c.RequiredApprovals == 0 {
+		return errors.New("an approval threshold needs the number of required approvals")
+	}
+	seen := map[string]bool{}
+	for _, approver := range c.Approvers {
+		if approver == "" || approver == AuditSystemActor || seen[approver] {
+			return fmt.Errorf("invalid or duplicate approver %q", approver)
+		}
+		seen[approver] = true
+	}
+	if c.RequiredApprovals > len(c.Approvers) {
+		return fmt.Errorf("%d approvals are required but only %d approvers are set", c.RequiredApprovals, len(c.Approvers))
+	}
+	return nil
+}
+
+// requestApproval stores a transfer, or the total of splits, until its
+// approvers sign it off, and notifies the sender.
+func requestApproval(ctx context.Context, dbSvc DynamoDBAPI, tenantCfg *TenantConfig, req TransferRequest, splits []Split) (NilResponse, error) {
+	now := clockOf(dbSvc).Now().Unix()
+	pending := TransferApproval{
+		TenantID:   req.TenantID,
+		TransferID: newID(dbSvc),
+		AccountID:  req.FromAccount,
+		Transfer:   req.Entry(),
+		Splits:     splits,
+		Status:     TransferPendingApproval,
+		Required:   tenantCfg.RequiredApprovals,
+		ApprovedBy: []string{},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	item, err := attributevalue.MarshalMap(pending)
+	if err != nil {
+		return failedResponse(req, "approval_failed", "Failed to submit the transfer for approval.", err.Error()), fmt.Errorf("failed to marshal transfer approval: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TransferApprovalsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return failedResponse(req, "approval_failed", "Failed to submit the transfer for approval.", err.Error()), fmt.Errorf("failed to store transfer approval: %v", err)
+	}
+
+	notify(ctx, dbSvc, pending.TenantID, pending.AccountID, fmt.Sprintf(
+		"Your transfer of %.2f to %s needs %d approvals before it is sent. Reference: %s",
+		req.Amount, receiverOf(req.ToAccount, splits), pending.Required, pending.TransferID))
+
+	return NilResponse{
+		Status:    "pending",
+		Code:      "approval_required",
+		Message:   "The transfer is waiting for approval.",
+		Details:   fmt.Sprintf("The transfer will be executed once %d approvers have approved it.", pending.Required),
+		Timestamp: req.Timestamp,
+		Data: data{
+			TransactionID: pending.TransferID,
+			Amount:        req.Amount,
+			UUID:          req.InitiatorUUID,
+			SignedUUID:    req.SignedUUID,
+		},
+	}, nil
+}
+
+// GetTransferApproval retrieves a transfer submitted for approval by its ID.
+func GetTransferApproval(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transferId string) (*TransferApproval, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TransferApprovalsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: tenantId},
+			"TransferID": &types.AttributeValueMemberS{Value: transferId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer approval %s: %v", transferId, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("transfer approval %s not found", transferId)
+	}
+
+	var pending TransferApproval
+	if err := attributevalue.UnmarshalMap(result.Item, &pending); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transfer approval: %v", err)
+	}
+	return &pending, nil
+}
+
+// ListPendingApprovals returns the tenant's transfers still waiting for
+// approval.
+func ListPendingApprovals(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]TransferApproval, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(TransferApprovalsTable),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		FilterExpression:         aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant":  &types.AttributeValueMemberS{Value: tenantId},
+			":pending": &types.AttributeValueMemberS{Value: TransferPendingApproval},
+		},
+	}
+	var pending []TransferApproval
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query transfer approvals: %v", err)
+		}
+		var page []TransferApproval
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transfer approvals: %v", err)
+		}
+		pending = append(pending, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return pending, nil
+}
+
+// ApproveTransfer approves a pending transfer as the actor of ctx, who must
+// be one of the tenant's Approvers and can approve it only once. The
+// approval that completes the quorum executes the transfer; the returned
+// TransferApproval then says whether it was executed or failed.
+func ApproveTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transferId string) (*TransferApproval, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	approver := ActorFrom(ctx)
+	pending, err := GetTransferApproval(ctx, dbSvc, tenantId, transferId)
+	if err != nil {
+		return nil, err
+	}
+	before := *pending
+	if err = checkApprover(ctx, dbSvc, pending, approver); err == nil {
+		pending, err = addApproval(ctx, dbSvc, pending, approver)
+	}
+	if err == nil && len(pending.ApprovedBy) >= pending.Required {
+		err = executeApprovedTransfer(ctx, dbSvc, pending)
+	}
+	recordAudit(ctx, dbSvc, AuditApproveTransfer, tenantId, transferId, transferId, before, pending, err)
+	if err != nil {
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "transfer approved", "tenant", tenantId, "transfer", transferId, "status", pending.Status, "actor", approver)
+	return pending, nil
+}
+
+// RejectTransfer rejects a pending transfer as the actor of ctx, who must be
+// one of the tenant's Approvers. One rejection is final, whatever approvals
+// the transfer already has.
+func RejectTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transferId, reason string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if reason == "" {
+		return errors.New("a reason is required to reject a transfer")
+	}
+	approver := ActorFrom(ctx)
+	pending, err := GetTransferApproval(ctx, dbSvc, tenantId, transferId)
+	if err != nil {
+		return err
+	}
+	before := *pending
+	if err = checkApprover(ctx, dbSvc, pending, approver); err == nil {
+		err = setTransferApprovalStatus(ctx, dbSvc, pending, TransferPendingApproval, TransferRejected, map[string]types.AttributeValue{
+			"RejectedBy": &types.AttributeValueMemberS{Value: approver},
+			"Reason":     &types.AttributeValueMemberS{Value: reason},
+		})
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			err = fmt.Errorf("transfer %s is no longer pending approval", transferId)
+		}
+	}
+	if err == nil {
+		pending.Status, pending.RejectedBy, pending.Reason = TransferRejected, approver, reason
+		notify(ctx, dbSvc, tenantId, pending.AccountID, fmt.Sprintf(
+			"Your transfer %s of %.2f to %s was rejected: %s", transferId, pending.Transfer.Amount, receiverOf(pending.Transfer.ToAccount, pending.Splits), reason))
+	}
+	recordAudit(ctx, dbSvc, AuditRejectTransfer, tenantId, transferId, reason, before, pending, err)
+	return err
+}
+
+// checkApprover checks that approver may still approve or reject pending.
+func checkApprover(ctx context.Context, dbSvc DynamoDBAPI, pending *TransferApproval, approver string) error {
+	if pending.Status != TransferPendingApproval {
+		return fmt.Errorf("transfer %s is %s", pending.TransferID, pending.Status)
+	}
+	if approver == AuditSystemActor {
+		return errors.New("transfers must be approved by a named actor")
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, pending.TenantID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(cfg.Approvers, approver) {
+		return fmt.Errorf("%s is not an approver of tenant %s", approver, pending.TenantID)
+	}
+	if approver == pending.AccountID || approver == pending.Transfer.InitiatorUUID {
+		return fmt.Errorf("transfer %s must be approved by someone other than its sender", pending.TransferID)
+	}
+	if slices.Contains(pending.ApprovedBy, approver) {
+		return fmt.Errorf("%s has already approved transfer %s", approver, pending.TransferID)
+	}
+	return nil
+}
+
+// addApproval appends approver to the approvals of a pending transfer and
+// returns it as updated, so that concurrent approvals are all counted.
+func addApproval(ctx context.Context, dbSvc DynamoDBAPI, pending *TransferApproval, approver string) (*TransferApproval, error) {
+	resp, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TransferApprovalsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: pending.TenantID},
+			"TransferID": &types.AttributeValueMemberS{Value: pending.TransferID},
+		},
+		UpdateExpression:         aws.String("SET ApprovedBy = list_append(ApprovedBy, :approvers), UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending AND NOT contains(ApprovedBy, :approver)"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":approvers": &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: approver}}},
+			":approver":  &types.AttributeValueMemberS{Value: approver},
+			":pending":   &types.AttributeValueMemberS{Value: TransferPendingApproval},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return pending, fmt.Errorf("transfer %s is no longer pending approval by %s", pending.TransferID, approver)
+	}
+	if err != nil {
+		return pending, fmt.Errorf("failed to approve transfer %s: %v", pending.TransferID, err)
+	}
+	var updated TransferApproval
+	if err := attributevalue.UnmarshalMap(resp.Attributes, &updated); err != nil {
+		return pending, fmt.Errorf("failed to unmarshal transfer approval: %v", err)
+	}
+	return &updated, nil
+}
+
+// executeApprovedTransfer claims a transfer that reached its quorum so it is
+// executed only once, executes it and records the outcome in pending. A
+// transfer refused on execution is marked failed without an error, like a
+// delayed transfer that fails on release.
+func executeApprovedTransfer(ctx context.Context, dbSvc DynamoDBAPI, pending *TransferApproval) error {
+	if err := setTransferApprovalStatus(ctx, dbSvc, pending, TransferPendingApproval, TransferApprovalRunning, nil); err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			// Executed by a concurrent approval or rejected meanwhile.
+			return nil
+		}
+		return err
+	}
+
+	response, transferErr := executePending(ctx, dbSvc, pending.Transfer, pending.Splits, transferOptions{approved: true})
+	status := TransferApproved
+	updates := map[string]types.AttributeValue{
+		"TransactionID": &types.AttributeValueMemberS{Value: response.Data.TransactionID},
+	}
+	to := receiverOf(pending.Transfer.ToAccount, pending.Splits)
+	message := fmt.Sprintf("Your transfer %s of %.2f to %s was approved and sent.", pending.TransferID, pending.Transfer.Amount, to)
+	if transferErr != nil {
+		status = TransferApprovalFailed
+		updates = map[string]types.AttributeValue{
+			"FailureReason": &types.AttributeValueMemberS{Value: response.Code},
+		}
+		message = fmt.Sprintf("Your transfer %s of %.2f to %s was approved but could not be sent: %s", pending.TransferID, pending.Transfer.Amount, to, response.Message)
+	}
+	if err := setTransferApprovalStatus(ctx, dbSvc, pending, TransferApprovalRunning, status, updates); err != nil {
+		return errors.Join(transferErr, err)
+	}
+	pending.Status = status
+	if transferErr != nil {
+		pending.FailureReason = response.Code
+	} else {
+		pending.TransactionID = response.Data.TransactionID
+	}
+	notify(ctx, dbSvc, pending.TenantID, pending.AccountID, message)
+	return nil
+}
+
+func setTransferApprovalStatus(ctx context.Context, dbSvc DynamoDBAPI, pending *TransferApproval, from, to string, updates map[string]types.AttributeValue) error {
+	expr := "SET #status = :to, UpdatedAt = :now"
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: from},
+		":to":   &types.AttributeValueMemberS{Value: to},
+		":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+	}
+	for name, value := range updates {
+		expr += fmt.Sprintf(", %s = :%s", name, name)
+		values[":"+name] = value
+	}
+
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TransferApprovalsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: pending.TenantID},
+			"TransferID": &types.AttributeValueMemberS{Value: pending.TransferID},
+		},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String("#status = :from"),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update transfer approval %s: %w", pending.TransferID, err)
+	}
+	return nil
+}
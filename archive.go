@@ -0,0 +1,364 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	// ArchiveBucket is the S3 bucket ArchiveTransactions exports to.
+	ArchiveBucket = "nil-ledger-archive"
+	// ArchivesTable records every archive run with the objects it wrote,
+	// keyed by TenantID and ArchiveID.
+	ArchivesTable = "LedgerArchives"
+)
+
+// Kinds of ArchivePartition.
+const (
+	ArchiveTransactionsKind  = "transactions"
+	ArchiveLedgerEntriesKind = "ledger_entries"
+)
+
+// ObjectGetter downloads objects; *s3.Client satisfies it.
+type ObjectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// ArchiveStore is where archives are written to and read back from.
+type ArchiveStore interface {
+	ObjectPutter
+	ObjectGetter
+}
+
+// Archive is the marker of an ArchiveTransactions run.
+type Archive struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id"`
+	ArchiveID string `dynamodbav:"ArchiveID" json:"archive_id"`
+	// Before is the cutoff: everything archived is older.
+	Before     int64              `dynamodbav:"Before" json:"before"`
+	Partitions []ArchivePartition `dynamodbav:"Partitions" json:"partitions"`
+	// ExpiresAt is the TTL set on the archived items, zero when they are
+	// kept in DynamoDB.
+	ExpiresAt int64 `dynamodbav:"ExpiresAt,omitempty" json:"expires_at,omitempty"`
+	CreatedAt int64 `dynamodbav:"CreatedAt" json:"created_at"`
+}
+
+// ArchivePartition is one object of an archive: the transactions or ledger
+// entries of a tenant for one UTC day, as JSON Lines.
+type ArchivePartition struct {
+	Kind  string `dynamodbav:"Kind" json:"kind"`
+	Day   string `dynamodbav:"Day" json:"day"`
+	Key   string `dynamodbav:"Key" json:"key"`
+	Count int    `dynamodbav:"Count" json:"count"`
+}
+
+// ArchivedLedger is what RestoreFromArchive reads back.
+type ArchivedLedger struct {
+	Transactions  []TransactionEntry `json:"transactions"`
+	LedgerEntries []LedgerEntry      `json:"ledger_entries"`
+}
+
+// ArchiveTransactions exports the tenant's transactions and ledger entries
+// older than olderThan to ArchiveBucket, under
+// archive/<tenant>/<day>/<kind>-<archive>.jsonl, and records the run in
+// ArchivesTable. Pending, held and indeterminate transactions are left for
+// a later run, as are items already archived.
+//
+// The archived items are marked with the ArchiveID. With a non-zero
+// expireAfter they also get an ExpiresAt that far in the future, so that
+// DynamoDB deletes them once TTL is enabled on ExpiresAt of the ledger and
+// transactions tables; otherwise they are kept. Objects are written before
+// any item is marked, so a failed run loses nothing and is simply run again.
+func ArchiveTransactions(ctx context.Context, dbSvc DynamoDBAPI, store ArchiveStore, tenantId string, olderThan time.Time, expireAfter time.Duration) (*Archive, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	now := getCurrentTimestamp()
+	archive := &Archive{
+		TenantID:   tenantId,
+		ArchiveID:  ksuid.New().String(),
+		Before:     olderThan.Unix(),
+		Partitions: []ArchivePartition{},
+		CreatedAt:  now,
+	}
+	if expireAfter > 0 {
+		archive.ExpiresAt = now + int64(expireAfter/time.Second)
+	}
+
+	transactions, err := archivableTransactions(ctx, dbSvc, tenantId, archive.Before)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := archivableLedgerEntries(ctx, dbSvc, tenantId, archive.Before)
+	if err != nil {
+		return nil, err
+	}
+	if len(transactions) == 0 && len(entries) == 0 {
+		return archive, nil
+	}
+
+	byDay := map[string][]any{}
+	for _, tx := range transactions {
+		key := ArchiveTransactionsKind + "/" + archiveDay(tx.TransactionDate)
+		byDay[key] = append(byDay[key], tx)
+	}
+	for _, entry := range entries {
+		key := ArchiveLedgerEntriesKind + "/" + archiveDay(entry.Time)
+		byDay[key] = append(byDay[key], entry)
+	}
+	keys := make([]string, 0, len(byDay))
+	for key := range byDay {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		partition := ArchivePartition{Count: len(byDay[key])}
+		partition.Kind, partition.Day, _ = strings.Cut(key, "/")
+		partition.Key = fmt.Sprintf("archive/%s/%s/%s-%s.jsonl", tenantId, partition.Day, partition.Kind, archive.ArchiveID)
+		if err := putArchiveObject(ctx, store, partition.Key, byDay[key]); err != nil {
+			return nil, err
+		}
+		archive.Partitions = append(archive.Partitions, partition)
+	}
+
+	item, err := attributevalue.MarshalMap(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal archive: %v", err)
+	}
+	if _, err := dbSvc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ArchivesTable), Item: item}); err != nil {
+		return nil, fmt.Errorf("failed to store archive: %v", err)
+	}
+
+	var errs []error
+	for _, tx := range transactions {
+		errs = append(errs, markArchived(ctx, dbSvc, TransactionsTable, tenantId, tx.SystemTransactionID, archive))
+	}
+	for _, entry := range entries {
+		errs = append(errs, markArchived(ctx, dbSvc, LedgerTable, tenantId, entry.SystemTransactionID, archive))
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "ledger archived", "tenant", tenantId, "archive", archive.ArchiveID,
+		"transactions", len(transactions), "ledger_entries", len(entries))
+	return archive, errors.Join(errs...)
+}
+
+// RestoreFromArchive reads back the tenant's archived transactions and ledger
+// entries dated from from up to, but excluding, to, for historical queries.
+// Items are returned in the order they were archived in.
+func RestoreFromArchive(ctx context.Context, dbSvc DynamoDBAPI, store ObjectGetter, tenantId string, from, to time.Time) (*ArchivedLedger, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	archives, err := ListArchives(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	firstDay, lastDay := archiveDay(from.Unix()), archiveDay(to.Unix())
+	restored := &ArchivedLedger{Transactions: []TransactionEntry{}, LedgerEntries: []LedgerEntry{}}
+	for _, archive := range archives {
+		for _, partition := range archive.Partitions {
+			if partition.Day < firstDay || partition.Day > lastDay {
+				continue
+			}
+			resp, err := store.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(ArchiveBucket),
+				Key:    aws.String(partition.Key),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get archive object %s: %v", partition.Key, err)
+			}
+			scanner := bufio.NewScanner(resp.Body)
+			scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				switch partition.Kind {
+				case ArchiveTransactionsKind:
+					var tx TransactionEntry
+					if err = json.Unmarshal(scanner.Bytes(), &tx); err == nil && tx.TransactionDate >= from.Unix() && tx.TransactionDate < to.Unix() {
+						restored.Transactions = append(restored.Transactions, tx)
+					}
+				case ArchiveLedgerEntriesKind:
+					var entry LedgerEntry
+					if err = json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.Time >= from.Unix() && entry.Time < to.Unix() {
+						restored.LedgerEntries = append(restored.LedgerEntries, entry)
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+			resp.Body.Close()
+			if err == nil {
+				err = scanner.Err()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read archive object %s: %v", partition.Key, err)
+			}
+		}
+	}
+	return restored, nil
+}
+
+// ListArchives returns the tenant's archive runs, oldest first.
+func ListArchives(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]Archive, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ArchivesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var archives []Archive
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query archives: %v", err)
+		}
+		var page []Archive
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal archives: %v", err)
+		}
+		archives = append(archives, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return archives, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// archivableTransactions returns the tenant's settled transactions dated
+// before cutoff that are not archived yet.
+func archivableTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, cutoff int64) ([]TransactionEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TransactionsTable),
+		IndexName:              aws.String("TransactionDateIndex"),
+		KeyConditionExpression: aws.String("TenantID = :tenant AND TransactionDate < :cutoff"),
+		FilterExpression:       aws.String("attribute_not_exists(ArchiveID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":cutoff": &types.AttributeValueMemberN{Value: strconv.FormatInt(cutoff, 10)},
+		},
+	}
+	var transactions []TransactionEntry
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query transactions: %v", err)
+		}
+		var page []TransactionEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
+		}
+		for _, tx := range page {
+			if tx.Status != nil && (*tx.Status == TransactionPending || *tx.Status == TransactionHeld || *tx.Status == TransactionIndeterminate) {
+				continue
+			}
+			transactions = append(transactions, tx)
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return transactions, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// archivableLedgerEntries returns the tenant's ledger entries posted before
+// cutoff that are not archived yet.
+func archivableLedgerEntries(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, cutoff int64) ([]LedgerEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(LedgerTable),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		FilterExpression:         aws.String("#time < :cutoff AND attribute_not_exists(ArchiveID)"),
+		ExpressionAttributeNames: map[string]string{"#time": "Time"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":cutoff": &types.AttributeValueMemberN{Value: strconv.FormatInt(cutoff, 10)},
+		},
+	}
+	var entries []LedgerEntry
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ledger entries: %v", err)
+		}
+		var page []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ledger entries: %v", err)
+		}
+		entries = append(entries, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+func putArchiveObject(ctx context.Context, store ObjectPutter, key string, items []any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return fmt.Errorf("failed to encode archive object %s: %v", key, err)
+		}
+	}
+	_, err := store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(ArchiveBucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(buf.Bytes()),
+		ContentType:   aws.String("application/x-ndjson"),
+		ContentLength: int64(buf.Len()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload archive object %s: %v", key, err)
+	}
+	return nil
+}
+
+// markArchived marks an archived item with its archive, and its TTL if the
+// archive sets one. An item deleted meanwhile is skipped.
+func markArchived(ctx context.Context, dbSvc DynamoDBAPI, table, tenantId, transactionId string, archive *Archive) error {
+	update := "SET ArchiveID = :archive"
+	values := map[string]types.AttributeValue{
+		":archive": &types.AttributeValueMemberS{Value: archive.ArchiveID},
+	}
+	if archive.ExpiresAt != 0 {
+		update += ", ExpiresAt = :expires"
+		values[":expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(archive.ExpiresAt, 10)}
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+			"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(TransactionID)"),
+		ExpressionAttributeValues: values,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		return fmt.Errorf("failed to mark %s archived in %s: %v", transactionId, table, err)
+	}
+	return nil
+}
+
+// archiveDay is the UTC day of a Unix time, as archives are partitioned.
+func archiveDay(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.DateOnly)
+}
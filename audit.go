@@ -0,0 +1,292 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AuditLogTable is the append-only log of mutating operations, keyed by
+// TenantID and EntryID. Entries are only ever put, never updated; grant the
+// ledger's role PutItem and Query on it and nothing else.
+var AuditLogTable = "AuditLog"
+
+// Audited operations.
+const (
+	AuditCreateAccount     = "CreateAccount"
+	AuditTransferCredits   = "TransferCredits"
+	AuditUpdateTransaction = "UpdateTransaction"
+	AuditTransitionStatus  = "TransitionStatus"
+	AuditSetOverdraftLimit = "SetOverdraftLimit"
+	AuditStartMaintenance  = "StartMaintenance"
+	AuditEndMaintenance    = "EndMaintenance"
+	AuditSetAccountOwner   = "SetAccountOwner"
+	AuditGrantBonus        = "GrantBonus"
+	AuditDepositCredits    = "DepositCredits"
+	AuditWithdrawCredits   = "WithdrawCredits"
+	AuditMarkDormant       = "MarkDormant"
+	AuditReactivateAccount = "ReactivateAccount"
+	AuditSetKYCTier        = "SetKYCTier"
+	AuditRegisterAgent     = "RegisterAgent"
+	AuditApproveTransfer   = "ApproveTransfer"
+	AuditRejectTransfer    = "RejectTransfer"
+	AuditUpdateAccount     = "UpdateAccount"
+
+	AuditProposeConfigChange = "ProposeConfigChange"
+	AuditApproveConfigChange = "ApproveConfigChange"
+	AuditRejectConfigChange  = "RejectConfigChange"
+)
+
+// AuditSystemActor is recorded for operations whose context carries no
+// actor, such as the release of delayed transfers.
+const AuditSystemActor = "system"
+
+// AuditEntry records one mutating operation. Before and After are JSON
+// snapshots of what the operation changed; secrets such as passwords are
+// left out.
+type AuditEntry struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id"`
+	// EntryID orders the log; it starts with the time in nanoseconds.
+	EntryID   string `dynamodbav:"EntryID" json:"entry_id"`
+	Time      int64  `dynamodbav:"Time" json:"time"`
+	Actor     string `dynamodbav:"Actor" json:"actor"`
+	Operation string `dynamodbav:"Operation" json:"operation"`
+	// Subject is the account or transaction operated on.
+	Subject string `dynamodbav:"Subject" json:"subject"`
+	// PayloadHash is the hex SHA-256 of the request as JSON.
+	PayloadHash string `dynamodbav:"PayloadHash" json:"payload_hash"`
+	Before      string `dynamodbav:"Before,omitempty" json:"before,omitempty"`
+	After       string `dynamodbav:"After,omitempty" json:"after,omitempty"`
+	// Error is set when the operation failed.
+	Error string `dynamodbav:"Error,omitempty" json:"error,omitempty"`
+}
+
+// WithAuditLog records every CreateAccount, TransferCredits,
+// UpdateTransaction and TransitionStatus in AuditLogTable. Snapshots cost a
+// read or two per operation.
+func WithAuditLog() Option {
+	return func(l *Ledger) {
+		l.audit = true
+	}
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose operations are audited as done by actor,
+// e.g. the authenticated user or admin of a request.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor, or AuditSystemActor.
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return AuditSystemActor
+}
+
+// auditing reports whether dbSvc is a Ledger with the audit log enabled.
+func auditing(dbSvc DynamoDBAPI) bool {
+	l, ok := dbSvc.(*Ledger)
+	return ok && l.audit
+}
+
+// newAuditEntry builds the entry of an operation. Snapshots that cannot be
+// marshalled are recorded as their error rather than losing the entry.
+func newAuditEntry(ctx context.Context, operation, tenantId, subject string, payload, before, after any, opErr error) AuditEntry {
+	now := time.Now()
+	entry := AuditEntry{
+		TenantID:  tenantId,
+		EntryID:   eventID(now),
+		Time:      now.Unix(),
+		Actor:     ActorFrom(ctx),
+		Operation: operation,
+		Subject:   subject,
+		Before:    auditSnapshot(before),
+		After:     auditSnapshot(after),
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		data = []byte(err.Error())
+	}
+	sum := sha256.Sum256(data)
+	entry.PayloadHash = hex.EncodeToString(sum[:])
+	if opErr != nil {
+		entry.Error = opErr.Error()
+	}
+	return entry
+}
+
+func auditSnapshot(v any) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", "unmarshallable snapshot: "+err.Error())
+	}
+	if string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// recordAudit appends an entry to the audit log when dbSvc audits. A failure
+// to write it is logged as an error but does not fail the operation, which
+// has already happened.
+func recordAudit(ctx context.Context, dbSvc DynamoDBAPI, operation, tenantId, subject string, payload, before, after any, opErr error) {
+	if !auditing(dbSvc) {
+		return
+	}
+	entry := newAuditEntry(ctx, operation, tenantId, subject, payload, before, after, opErr)
+	item, err := attributevalue.MarshalMap(entry)
+	if err == nil {
+		_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(AuditLogTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(EntryID)"),
+		})
+	}
+	if err != nil {
+		loggerOf(dbSvc).ErrorContext(ctx, "failed to write audit log",
+			"tenant", tenantId, "operation", operation, "subject", subject, "actor", entry.Actor, "error", err)
+	}
+}
+
+// auditAccount returns the account snapshot recorded in the audit log, nil
+// when it does not exist.
+func auditAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) *User {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || result.Item == nil {
+		return nil
+	}
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil
+	}
+	user.Password = ""
+	return &user
+}
+
+// auditCreateAccount records the creation of an account, with the account
+// it replaced, if any, as before.
+func auditCreateAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, user User, before *User, err error) {
+	user.Password = ""
+	var after *User
+	if err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, user.AccountID)
+	}
+	recordAudit(ctx, dbSvc, AuditCreateAccount, tenantId, user.AccountID, user, before, after, err)
+}
+
+// auditBalances returns the balances of accounts, for transfer snapshots.
+func auditBalances(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, accounts ...string) map[string]float64 {
+	balances := make(map[string]float64, len(accounts))
+	for _, account := range accounts {
+		if account == "" {
+			continue
+		}
+		if balance, err := InquireBalance(ctx, dbSvc, tenantId, account); err == nil {
+			balances[account] = balance
+		}
+	}
+	return balances
+}
+
+// AuditQuery selects audit log entries. Zero fields match everything.
+type AuditQuery struct {
+	From      time.Time
+	To        time.Time
+	Actor     string
+	Operation string
+	Subject   string
+	// Limit is how many entries are read per call; filtered out entries
+	// count towards it, so a page can come back short.
+	Limit int32
+	// Cursor continues a previous query.
+	Cursor string
+}
+
+// QueryAuditLog returns the audit log entries of a tenant matching the query,
+// oldest first, and the cursor of the next page, empty after the last.
+func QueryAuditLog(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, query AuditQuery) ([]AuditEntry, string, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	from := "0"
+	if !query.From.IsZero() {
+		from = fmt.Sprintf("%019d", query.From.UnixNano())
+	}
+	to := query.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	values := map[string]types.AttributeValue{
+		":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		":from":     &types.AttributeValueMemberS{Value: from},
+		":to":       &types.AttributeValueMemberS{Value: fmt.Sprintf("%019d~", to.UnixNano())},
+	}
+	var filters []string
+	names := map[string]string{}
+	for _, f := range []struct{ name, value string }{
+		{"Actor", query.Actor},
+		{"Operation", query.Operation},
+		{"Subject", query.Subject},
+	} {
+		if f.value != "" {
+			placeholder := strings.ToLower(f.name)
+			filters = append(filters, fmt.Sprintf("#%s = :%s", placeholder, placeholder))
+			names["#"+placeholder] = f.name
+			values[":"+placeholder] = &types.AttributeValueMemberS{Value: f.value}
+		}
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(AuditLogTable),
+		KeyConditionExpression:    aws.String("TenantID = :tenantId AND EntryID BETWEEN :from AND :to"),
+		ExpressionAttributeValues: values,
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeNames = names
+	}
+	if query.Limit > 0 {
+		input.Limit = aws.Int32(query.Limit)
+	}
+	if query.Cursor != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"EntryID":  &types.AttributeValueMemberS{Value: query.Cursor},
+		}
+	}
+
+	resp, err := dbSvc.Query(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query audit log: %v", err)
+	}
+	var entries []AuditEntry
+	if err := attributevalue.UnmarshalListOfMaps(resp.Items, &entries); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal audit log: %v", err)
+	}
+	var next string
+	if id, ok := resp.LastEvaluatedKey["EntryID"].(*types.AttributeValueMemberS); ok {
+		next = id.Value
+	}
+	return entries, next, nil
+}
@@ -0,0 +1,48 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestActorFrom(t *testing.T) {
+	ctx := context.Background()
+	if got := ActorFrom(ctx); got != AuditSystemActor {
+		t.Errorf("ActorFrom(background) = %q, want %q", got, AuditSystemActor)
+	}
+	if got := ActorFrom(WithActor(ctx, "admin-1")); got != "admin-1" {
+		t.Errorf("ActorFrom() = %q, want admin-1", got)
+	}
+	if got := ActorFrom(WithActor(ctx, "")); got != AuditSystemActor {
+		t.Errorf("ActorFrom(empty actor) = %q, want %q", got, AuditSystemActor)
+	}
+}
+
+func TestNewAuditEntry(t *testing.T) {
+	ctx := WithActor(context.Background(), "ops")
+	payload := map[string]any{"amount": 10}
+	a := newAuditEntry(ctx, AuditTransferCredits, "nil", "alice", payload, nil, map[string]float64{"alice": 90}, nil)
+	b := newAuditEntry(ctx, AuditTransferCredits, "nil", "alice", payload, nil, nil, errors.New("boom"))
+
+	if a.PayloadHash != b.PayloadHash || len(a.PayloadHash) != 64 {
+		t.Errorf("payload hashes %q and %q, want the same SHA-256", a.PayloadHash, b.PayloadHash)
+	}
+	if a.EntryID >= b.EntryID {
+		t.Errorf("entry IDs %q, %q not increasing", a.EntryID, b.EntryID)
+	}
+	if a.Actor != "ops" || a.Before != "" || a.After != `{"alice":90}` || a.Error != "" {
+		t.Errorf("entry = %+v", a)
+	}
+	if b.Error != "boom" {
+		t.Errorf("Error = %q, want boom", b.Error)
+	}
+	var nilUser *User
+	if got := auditSnapshot(nilUser); got != "" {
+		t.Errorf("snapshot of nil user = %q, want empty", got)
+	}
+	if got := auditSnapshot(func() {}); !strings.Contains(got, "unmarshallable") {
+		t.Errorf("snapshot of func = %q", got)
+	}
+}
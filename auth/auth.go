@@ -0,0 +1,267 @@
+// Package auth issues API keys scoped to a tenant and authenticates
+// requests with them, so the HTTP and gRPC layers, and library callers, get
+// the tenant of a request from its credentials rather than trusting a raw
+// tenant ID.
+//
+// An API key is shown once, when GenerateKey creates it. Only the SHA-256 of
+// its secret is stored, in ledger.CredentialsTable, next to the tenant the
+// key belongs to:
+//
+//	apiKey, key, err := auth.GenerateKey(ctx, db, "tenant-1", "checkout service")
+//	ctx, err = auth.Authenticate(ctx, db, apiKey)
+//	tenantId := auth.TenantFrom(ctx)
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+	"google.golang.org/grpc/metadata"
+)
+
+// KeyPrefix starts every API key, so leaked keys are easy to scan for.
+const KeyPrefix = "nlk_"
+
+// ErrUnauthenticated is returned by Authenticate for a key that is
+// malformed, unknown or revoked. The reason is not told apart, so callers
+// cannot probe for key IDs.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Key is an API key as stored, without its secret.
+type Key struct {
+	KeyID    string `dynamodbav:"KeyID" json:"key_id"`
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id"`
+	// Name says what the key is for, e.g. the service using it.
+	Name       string `dynamodbav:"Name,omitempty" json:"name,omitempty"`
+	SecretHash string `dynamodbav:"SecretHash" json:"-"`
+	CreatedBy  string `dynamodbav:"CreatedBy" json:"created_by"`
+	CreatedAt  int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	// RevokedAt is set once the key is revoked; it then no longer
+	// authenticates.
+	RevokedAt int64  `dynamodbav:"RevokedAt,omitempty" json:"revoked_at,omitempty"`
+	RevokedBy string `dynamodbav:"RevokedBy,omitempty" json:"revoked_by,omitempty"`
+}
+
+// Actor is the actor recorded in the audit log for requests made with the
+// key.
+func (k Key) Actor() string {
+	return "apikey:" + k.KeyID
+}
+
+// GenerateKey creates an API key for a tenant. The returned apiKey is the
+// only copy of the key's secret: hand it to the caller, it cannot be read
+// back.
+func GenerateKey(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId, name string) (apiKey string, key *Key, err error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if err := validation.TenantID("tenant_id", tenantId); err != nil {
+		return "", nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %v", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key = &Key{
+		KeyID:      ksuid.New().String(),
+		TenantID:   tenantId,
+		Name:       strings.TrimSpace(name),
+		SecretHash: hashSecret(encoded),
+		CreatedBy:  ledger.ActorFrom(ctx),
+		CreatedAt:  time.Now().Unix(),
+	}
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal API key: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(ledger.CredentialsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(KeyID)"),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store API key: %v", err)
+	}
+	return KeyPrefix + key.KeyID + "_" + encoded, key, nil
+}
+
+// RevokeKey revokes an API key of a tenant. Revoking a revoked key fails.
+func RevokeKey(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId, keyId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ledger.CredentialsTable),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyId},
+		},
+		UpdateExpression:    aws.String("SET RevokedAt = :now, RevokedBy = :actor"),
+		ConditionExpression: aws.String("TenantID = :tenant AND attribute_not_exists(RevokedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			":actor":  &types.AttributeValueMemberS{Value: ledger.ActorFrom(ctx)},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return fmt.Errorf("API key %s of tenant %s not found or already revoked", keyId, tenantId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %v", err)
+	}
+	return nil
+}
+
+// ListKeys returns the API keys of a tenant, revoked ones included.
+func ListKeys(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId string) ([]Key, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ledger.CredentialsTable),
+		IndexName:              aws.String(ledger.CredentialsTenantIndex),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var keys []Key
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query API keys: %v", err)
+		}
+		var page []Key
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal API keys: %v", err)
+		}
+		keys = append(keys, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return keys, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+type keyContextKey struct{}
+
+// Authenticate checks an API key and returns ctx carrying its tenant, for
+// TenantFrom, and its actor, for ledger.ActorFrom. It fails with
+// ErrUnauthenticated for a key that does not authenticate.
+func Authenticate(ctx context.Context, dbSvc ledger.DynamoDBAPI, apiKey string) (context.Context, error) {
+	key, err := lookup(ctx, dbSvc, apiKey)
+	if err != nil {
+		return ctx, err
+	}
+	ctx = context.WithValue(ctx, keyContextKey{}, key)
+	return ledger.WithActor(ctx, key.Actor()), nil
+}
+
+// TenantFrom returns the tenant of the key Authenticate checked, or "" for
+// a context Authenticate did not return.
+func TenantFrom(ctx context.Context) string {
+	if key, ok := ctx.Value(keyContextKey{}).(*Key); ok {
+		return key.TenantID
+	}
+	return ""
+}
+
+// KeyFrom returns the key Authenticate checked, or nil.
+func KeyFrom(ctx context.Context) *Key {
+	key, _ := ctx.Value(keyContextKey{}).(*Key)
+	return key
+}
+
+// HTTPAuthenticator authenticates HTTP requests by the API key in their
+// "Authorization: Bearer" or X-API-Key header. It is an
+// httpapi.Authenticator.
+func HTTPAuthenticator(dbSvc ledger.DynamoDBAPI) func(r *http.Request) (tenantId, actor string, err error) {
+	return func(r *http.Request) (string, string, error) {
+		apiKey := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			apiKey = bearer
+		}
+		key, err := lookup(r.Context(), dbSvc, apiKey)
+		if err != nil {
+			return "", "", err
+		}
+		return key.TenantID, key.Actor(), nil
+	}
+}
+
+// GRPCAuthenticator authenticates gRPC calls by the API key in their
+// "authorization: Bearer" or x-api-key metadata. It is a
+// grpcserver.Authenticator.
+func GRPCAuthenticator(dbSvc ledger.DynamoDBAPI) func(ctx context.Context, md metadata.MD) (tenantId, actor string, err error) {
+	return func(ctx context.Context, md metadata.MD) (string, string, error) {
+		var apiKey string
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			apiKey = values[0]
+		}
+		if values := md.Get("authorization"); len(values) > 0 {
+			if bearer, ok := strings.CutPrefix(values[0], "Bearer "); ok {
+				apiKey = bearer
+			}
+		}
+		key, err := lookup(ctx, dbSvc, apiKey)
+		if err != nil {
+			return "", "", err
+		}
+		return key.TenantID, key.Actor(), nil
+	}
+}
+
+// lookup returns the unrevoked key an API key is the secret of.
+func lookup(ctx context.Context, dbSvc ledger.DynamoDBAPI, apiKey string) (*Key, error) {
+	keyId, secret, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(apiKey), KeyPrefix), "_")
+	if !ok || keyId == "" || secret == "" {
+		return nil, ErrUnauthenticated
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ledger.CredentialsTable),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %v", err)
+	}
+	if result.Item == nil {
+		return nil, ErrUnauthenticated
+	}
+	var key Key
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API key: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 || key.RevokedAt != 0 {
+		return nil, ErrUnauthenticated
+	}
+	return &key, nil
+}
+
+// hashSecret returns the SHA-256 of a key's secret. Secrets are 256 random
+// bits, so a fast hash is enough to keep a stolen table from yielding keys.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/grpcserver"
+	"github.com/adonese/ledger/httpapi"
+	"github.com/adonese/ledger/ledgertest"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	_ httpapi.Authenticator    = HTTPAuthenticator(nil)
+	_ grpcserver.Authenticator = GRPCAuthenticator(nil)
+)
+
+func TestAPIKeys(t *testing.T) {
+	ctx := ledger.WithActor(context.Background(), "alice@ops")
+	db := ledger.NewLedger(ledgertest.NewDB(), ledger.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	apiKey, key, err := GenerateKey(ctx, db, "acme", "checkout")
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	if !strings.HasPrefix(apiKey, KeyPrefix+key.KeyID+"_") || key.TenantID != "acme" || key.CreatedBy != "alice@ops" || strings.Contains(key.SecretHash, apiKey[len(KeyPrefix)+len(key.KeyID)+1:]) {
+		t.Fatalf("GenerateKey() = %q, %+v", apiKey, key)
+	}
+	other, _, _ := GenerateKey(ctx, db, "globex", "")
+
+	authed, err := Authenticate(context.Background(), db, apiKey)
+	if err != nil || TenantFrom(authed) != "acme" || ledger.ActorFrom(authed) != "apikey:"+key.KeyID || KeyFrom(authed).Name != "checkout" {
+		t.Fatalf("Authenticate() = tenant %q, actor %q, %v", TenantFrom(authed), ledger.ActorFrom(authed), err)
+	}
+	if TenantFrom(context.Background()) != "" {
+		t.Error("TenantFrom() of an unauthenticated context is not empty")
+	}
+	for name, bad := range map[string]string{
+		"empty":        "",
+		"no secret":    KeyPrefix + key.KeyID,
+		"wrong secret": KeyPrefix + key.KeyID + "_" + strings.Repeat("A", 43),
+		"unknown key":  KeyPrefix + "2ABCDEFGHIJKLMNOPQRSTUVWXYZ_secret",
+		"swapped":      other[:len(KeyPrefix)+len(key.KeyID)] + apiKey[len(KeyPrefix)+len(key.KeyID):],
+	} {
+		if _, err := Authenticate(context.Background(), db, bad); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("Authenticate(%s) error = %v, want ErrUnauthenticated", name, err)
+		}
+	}
+
+	if keys, err := ListKeys(ctx, db, "acme"); err != nil || len(keys) != 1 || keys[0].KeyID != key.KeyID {
+		t.Errorf("ListKeys() = %+v, %v", keys, err)
+	}
+	if err := RevokeKey(ctx, db, "globex", key.KeyID); err == nil {
+		t.Error("RevokeKey() by another tenant succeeded")
+	}
+	if err := RevokeKey(ctx, db, "acme", key.KeyID); err != nil {
+		t.Fatalf("RevokeKey() error = %v", err)
+	}
+	if err := RevokeKey(ctx, db, "acme", key.KeyID); err == nil {
+		t.Error("second RevokeKey() succeeded")
+	}
+	if _, err := Authenticate(context.Background(), db, apiKey); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate() with a revoked key error = %v, want ErrUnauthenticated", err)
+	}
+	if keys, _ := ListKeys(ctx, db, "acme"); len(keys) != 1 || keys[0].RevokedAt == 0 || keys[0].RevokedBy != "alice@ops" {
+		t.Errorf("ListKeys() after revoking = %+v", keys)
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	db := ledger.NewLedger(ledgertest.NewDB(), ledger.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	apiKey, key, err := GenerateKey(ctx, db, "acme", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "alice", Amount: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &httpapi.Handler{DB: db, Authenticate: HTTPAuthenticator(db)}
+	for _, tt := range []struct {
+		name, header, value string
+		want                int
+	}{
+		{"bearer", "Authorization", "Bearer " + apiKey, http.StatusOK},
+		{"x-api-key", "X-API-Key", apiKey, http.StatusOK},
+		{"bad key", "Authorization", "Bearer " + apiKey + "x", http.StatusUnauthorized},
+		{"no key", "", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/accounts/alice/balance", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: GET balance = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	auth := GRPCAuthenticator(db)
+	tenantId, actor, err := auth(ctx, metadata.Pairs("authorization", "Bearer "+apiKey))
+	if err != nil || tenantId != "acme" || actor != key.Actor() {
+		t.Errorf("GRPCAuthenticator() = %q, %q, %v", tenantId, actor, err)
+	}
+	if _, _, err := auth(ctx, metadata.MD{}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("GRPCAuthenticator() without a key error = %v, want ErrUnauthenticated", err)
+	}
+}
@@ -4,15 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/adonese/ledger/validation"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/segmentio/ksuid"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -43,7 +43,7 @@ type UserBalance struct {
 // CheckUsersExist checks if the provided account IDs exist in the DynamoDB table.
 // It takes a DynamoDB client and a slice of account IDs and returns a slice of
 // non-existent account IDs and an error, if any.
-func CheckUsersExist(context context.Context, dbSvc *dynamodb.Client, tenantId string, accountIds []string) ([]string, error) {
+func CheckUsersExist(context context.Context, dbSvc DynamoDBAPI, tenantId string, accountIds []string) ([]string, error) {
 	// Prepare the input for the BatchGetItem operation
 	if tenantId == "" {
 		tenantId = "nil"
@@ -94,11 +94,21 @@ func CheckUsersExist(context context.Context, dbSvc *dynamodb.Client, tenantId s
 //
 // FIXME(adonese): currently this creates a destructive operation where it overrides an existing user.
 // the only way we're yet allowing this, is because the logic is managed via another indirection layer.
-func CreateAccountWithBalance(context context.Context, dbSvc *dynamodb.Client, tenantId, accountId string, amount float64) error {
+func CreateAccountWithBalance(context context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, amount float64) error {
 	if tenantId == "" {
 		tenantId = "nil" // default value for old clients
 	}
-	log.Printf("the tenant id is: %s", tenantId)
+	err := validation.Collect(
+		validation.TenantID("tenant_id", tenantId),
+		validation.AccountID("account_id", accountId),
+	)
+	if err != nil {
+		return err
+	}
+	cfg, err := GetTenantConfig(context, dbSvc, tenantId)
+	if err != nil {
+		return err
+	}
 	item := map[string]types.AttributeValue{
 		"AccountID":           &types.AttributeValueMemberS{Value: accountId},
 		"full_name":           &types.AttributeValueMemberS{Value: "test-account"},
@@ -110,15 +120,16 @@ func CreateAccountWithBalance(context context.Context, dbSvc *dynamodb.Client, t
 		"confirm":             &types.AttributeValueMemberBOOL{Value: false},
 		"external_auth":       &types.AttributeValueMemberBOOL{Value: false},
 		"password":            &types.AttributeValueMemberS{Value: ""},
-		"created_at":          &types.AttributeValueMemberS{Value: time.Now().Local().String()},
+		"created_at":          &types.AttributeValueMemberS{Value: clockOf(dbSvc).Now().Local().String()},
 		"is_verified":         &types.AttributeValueMemberBOOL{Value: true},
 		"id_type":             &types.AttributeValueMemberS{Value: ""},
 		"mobile_number":       &types.AttributeValueMemberS{Value: ""},
 		"id_number":           &types.AttributeValueMemberS{Value: ""},
 		"pic_id_card":         &types.AttributeValueMemberS{Value: ""},
-		"amount":              &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", amount)},
-		"currency":            &types.AttributeValueMemberS{Value: "SDG"},
-		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+		"amount":              &types.AttributeValueMemberN{Value: FormatAmount(amount, cfg.currency())},
+		"currency":            &types.AttributeValueMemberS{Value: cfg.currency()},
+		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(nextVersion(dbSvc), 10)},
+		"LastActivity":        &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
 		"TenantID":            &types.AttributeValueMemberS{Value: tenantId},
 	}
 
@@ -131,15 +142,17 @@ func CreateAccountWithBalance(context context.Context, dbSvc *dynamodb.Client, t
 		ConditionExpression: &conditionExpression,
 	}
 
-	_, err := dbSvc.PutItem(context, input)
-	log.Printf("the error is: %v", err)
+	_, err = dbSvc.PutItem(context, input)
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(context, "failed to create account", "tenant", tenantId, "account", accountId, "error", err)
+	}
+	// The condition means nothing was replaced.
+	auditCreateAccount(context, dbSvc, tenantId, User{AccountID: accountId, Amount: amount}, nil, err)
 	return err
 }
 
-func CreateAccount(context context.Context, dbSvc *dynamodb.Client, tenantId string, user User) error {
-	if tenantId == "" {
-		tenantId = "nil"
-	}
+// userItem is the NilUsers item of a new account, whose currency is set.
+func userItem(dbSvc DynamoDBAPI, tenantId string, user User) map[string]types.AttributeValue {
 	item := map[string]types.AttributeValue{
 		"AccountID":           &types.AttributeValueMemberS{Value: user.AccountID},
 		"full_name":           &types.AttributeValueMemberS{Value: user.FullName},
@@ -151,42 +164,114 @@ func CreateAccount(context context.Context, dbSvc *dynamodb.Client, tenantId str
 		"confirm":             &types.AttributeValueMemberBOOL{Value: user.Confirm},
 		"external_auth":       &types.AttributeValueMemberBOOL{Value: user.ExternalAuth},
 		"password":            &types.AttributeValueMemberS{Value: user.Password},
-		"created_at":          &types.AttributeValueMemberS{Value: time.Now().Local().String()},
+		"created_at":          &types.AttributeValueMemberS{Value: clockOf(dbSvc).Now().Local().String()},
 		"is_verified":         &types.AttributeValueMemberBOOL{Value: user.IsVerified},
 		"id_type":             &types.AttributeValueMemberS{Value: user.IDType},
 		"mobile_number":       &types.AttributeValueMemberS{Value: user.MobileNumber},
 		"id_number":           &types.AttributeValueMemberS{Value: user.IDNumber},
 		"pic_id_card":         &types.AttributeValueMemberS{Value: user.PicIDCard},
-		"amount":              &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", user.Amount)},
-		"currency":            &types.AttributeValueMemberS{Value: "SDG"},
-		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+		"amount":              &types.AttributeValueMemberN{Value: FormatAmount(user.Amount, user.Currency)},
+		"currency":            &types.AttributeValueMemberS{Value: user.Currency},
+		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(nextVersion(dbSvc), 10)},
+		"LastActivity":        &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
 		"TenantID":            &types.AttributeValueMemberS{Value: tenantId},
 	}
+	if user.OverdraftLimit > 0 {
+		item["OverdraftLimit"] = &types.AttributeValueMemberN{Value: FormatAmount(user.OverdraftLimit, user.Currency)}
+	}
+	return item
+}
+
+// ErrAccountExists is returned by CreateAccount for an account that already
+// exists, which is left as it is.
+var ErrAccountExists = errors.New("account_exists")
+
+// CreateAccount creates an account; user.Amount is its opening balance. It
+// fails with ErrAccountExists when the account exists, so an account's
+// balance and chain are never reset by creating it again.
+func CreateAccount(context context.Context, dbSvc DynamoDBAPI, tenantId string, user User) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	err := validation.Collect(
+		validation.TenantID("tenant_id", tenantId),
+		validation.AccountID("account_id", user.AccountID),
+	)
+	if err != nil {
+		return err
+	}
+	cfg, err := GetTenantConfig(context, dbSvc, tenantId)
+	if err != nil {
+		return err
+	}
+	if user.Currency, err = cfg.newAccountCurrency(user.Currency); err != nil {
+		return err
+	}
+	item := userItem(dbSvc, tenantId, user)
+	if err := protectPII(context, dbSvc, tenantId, item); err != nil {
+		return err
+	}
+	if err := protectPassword(item); err != nil {
+		return err
+	}
 
 	// Put the item into the DynamoDB table
 	input := &dynamodb.PutItemInput{
-		TableName: aws.String(NilUsers),
-		Item:      item,
+		TableName:           aws.String(NilUsers),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(AccountID)"),
 	}
 
-	_, err := dbSvc.PutItem(context, input)
-	log.Printf("the error is: %v", err)
+	_, err = dbSvc.PutItem(context, input)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("%w: %s", ErrAccountExists, user.AccountID)
+	}
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(context, "failed to create account", "tenant", tenantId, "account", user.AccountID, "error", err)
+	}
+	// The condition means nothing was replaced.
+	auditCreateAccount(context, dbSvc, tenantId, user, nil, err)
 	return err
 }
 
 // GetAccount retrieves an account by tenant ID and account ID.
-func GetAccount(ctx context.Context, dbSvc *dynamodb.Client, trEntry TransactionEntry) (*User, error) {
-	if trEntry.TenantID == "" {
-		trEntry.TenantID = "nil"
+//
+// Deprecated: GetAccount reads the account from trEntry.AccountID. Use
+// Client.GetAccount of github.com/adonese/ledger/v2, which takes the account
+// ID itself.
+func GetAccount(ctx context.Context, dbSvc DynamoDBAPI, trEntry TransactionEntry) (*User, error) {
+	user, err := getAccount(ctx, accountCacheOf(dbSvc), trEntry.TenantID, trEntry.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptPII(ctx, dbSvc, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// getAccount retrieves an account by tenant ID and account ID. Its PII is
+// left encrypted, since transfers do not need it.
+func getAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*User, error) {
+	return fetchAccount(ctx, dbSvc, tenantId, accountId, consistentReads(dbSvc))
+}
+
+// fetchAccount is getAccount with the read's consistency chosen by the
+// caller.
+func fetchAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, consistent bool) (*User, error) {
+	if tenantId == "" {
+		tenantId = "nil"
 	}
 	key := map[string]types.AttributeValue{
-		"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
-		"AccountID": &types.AttributeValueMemberS{Value: trEntry.AccountID},
+		"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+		"AccountID": &types.AttributeValueMemberS{Value: accountId},
 	}
 
 	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String("NilUsers"),
-		Key:       key,
+		TableName:      aws.String("NilUsers"),
+		Key:            key,
+		ConsistentRead: aws.Bool(consistent),
 	})
 	if err != nil {
 		return nil, err
@@ -205,19 +290,45 @@ func GetAccount(ctx context.Context, dbSvc *dynamodb.Client, trEntry Transaction
 	return &user, nil
 }
 
+// WithConsistentReads makes InquireBalance and GetAccount read with strong
+// consistency, so they see the transfers that just completed, at twice the
+// read capacity. Transfers always read the sender consistently.
+func WithConsistentReads() Option {
+	return func(l *Ledger) {
+		l.consistentReads = true
+	}
+}
+
+// consistentReads reports whether dbSvc is a Ledger reading accounts with
+// strong consistency.
+func consistentReads(dbSvc DynamoDBAPI) bool {
+	l, ok := dbSvc.(*Ledger)
+	return ok && l.consistentReads
+}
+
 // InquireBalance inquires the balance of a given user account.
 // It takes a DynamoDB client and an account ID, returning the balance
 // as a float64 and an error if the inquiry fails or the user does not exist.
-func InquireBalance(context context.Context, dbSvc *dynamodb.Client, tenantId, AccountID string) (float64, error) {
+func InquireBalance(context context.Context, dbSvc DynamoDBAPI, tenantId, AccountID string) (balance float64, err error) {
 	if tenantId == "" {
 		tenantId = "nil"
 	}
-	result, err := dbSvc.GetItem(context, &dynamodb.GetItemInput{
+	context, span := startSpan(context, dbSvc, "InquireBalance", Attr("tenant", tenantId), Attr("account", AccountID))
+	defer func() { endSpan(span, err) }()
+	err = validation.Collect(
+		validation.TenantID("tenant_id", tenantId),
+		validation.AccountID("account_id", AccountID),
+	)
+	if err != nil {
+		return 0, err
+	}
+	result, err := accountCacheOf(dbSvc).GetItem(context, &dynamodb.GetItemInput{
 		TableName: aws.String(NilUsers),
 		Key: map[string]types.AttributeValue{
 			"AccountID": &types.AttributeValueMemberS{Value: AccountID},
 			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
 		},
+		ConsistentRead: aws.Bool(consistentReads(dbSvc)),
 	})
 	if err != nil {
 		return 0, fmt.Errorf("failed to inquire balance for user %s: %v", AccountID, err)
@@ -238,251 +349,522 @@ func InquireBalance(context context.Context, dbSvc *dynamodb.Client, tenantId, A
 // It takes a DynamoDB client, the account IDs for the sender and receiver, and
 // the amount to transfer. It returns a NilResponse and an error if the transfer fails due to
 // insufficient funds or other issues.
-func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry TransactionEntry) (NilResponse, error) {
+//
+// Transfers above the tenant's LargeTransferThreshold are not executed right
+// away: they are held for release and a "pending" response is returned instead.
+// Likewise, transfers above its ApprovalThreshold wait for ApproveTransfer.
+//
+// Deprecated: TransferCredits takes a TransactionEntry, whose AccountID
+// repeats the sender, and reports its outcome in a NilResponse shaped for the
+// HTTP API. Use Client.Transfer of github.com/adonese/ledger/v2.
+func TransferCredits(context context.Context, dbSvc DynamoDBAPI, trEntry TransactionEntry) (NilResponse, error) {
+	req, err := TransferRequestFromEntry(trEntry)
+	if err != nil {
+		return NilResponse{}, err
+	}
+	return transferCredits(context, dbSvc, req, transferOptions{})
+}
+
+// Transfer runs a transfer like TransferCredits, taking a TransferRequest
+// instead of a TransactionEntry.
+func Transfer(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) (NilResponse, error) {
+	return transferCredits(ctx, dbSvc, req, transferOptions{})
+}
+
+// transferOptions let the ledger itself run transfers that skip some of the
+// checks applied to customer initiated ones.
+type transferOptions struct {
+	// skipDelay executes a large transfer instead of holding it, used when
+	// a held transfer is released.
+	skipDelay bool
+	// approved executes a transfer its approvers signed off, without
+	// asking for approval or holding it again.
+	approved bool
+	// betweenWallets moves money between the wallets of one customer: it
+	// is neither charged, screened, limited nor held.
+	betweenWallets bool
+	// comment replaces the system narrative of the transfer, such as for
+	// agent cash-in and cash-out.
+	comment string
+}
+
+// transferCredits runs a transfer, and logs and audits its outcome.
+func transferCredits(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest, opts transferOptions) (NilResponse, error) {
+	start := time.Now()
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	defer beginTransfer(dbSvc, req.TenantID)()
+	ctx, span := startSpan(ctx, dbSvc, "TransferCredits",
+		Attr("tenant", req.TenantID),
+		Attr("account", req.FromAccount),
+		Attr("to_account", req.ToAccount),
+		Attr("amount", req.Amount),
+	)
+	var before map[string]float64
+	if auditing(dbSvc) {
+		before = auditBalances(ctx, dbSvc, req.TenantID, req.FromAccount, req.ToAccount)
+	}
+	response, err := postTransfer(ctx, dbSvc, req, opts)
+	if degraded(dbSvc) {
+		response.Mode = ModeDegraded
+	}
+	localizeResponse(req, &response)
+	if auditing(dbSvc) {
+		after := map[string]any{
+			"transaction_id": response.Data.TransactionID,
+			"code":           response.Code,
+			"balances":       auditBalances(ctx, dbSvc, req.TenantID, req.FromAccount, req.ToAccount),
+		}
+		recordAudit(ctx, dbSvc, AuditTransferCredits, req.TenantID, req.FromAccount, req.Entry(), map[string]any{"balances": before}, after, err)
+	}
+	span.SetAttributes(Attr("txid", response.Data.TransactionID), Attr("code", response.Code))
+	endSpan(span, err)
+	recordTransfer(ctx, dbSvc, req.TenantID, response.Code, req.Amount, start, err)
+	args := []any{
+		"tenant", req.TenantID,
+		"account", req.FromAccount,
+		"to_account", req.ToAccount,
+		"txid", response.Data.TransactionID,
+		"amount", req.Amount,
+		"code", response.Code,
+		"latency", time.Since(start),
+	}
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "transfer failed", append(args, "error", err)...)
+	} else {
+		loggerOf(dbSvc).InfoContext(ctx, "transfer posted", args...)
+	}
+	return response, err
+}
+
+func postTransfer(context context.Context, dbSvc DynamoDBAPI, req TransferRequest, opts transferOptions) (NilResponse, error) {
 	var response NilResponse
-	if trEntry.AccountID == "" {
-		return response, errors.New("you must provide Account ID, substitute it for FromAccount to mimic the older api")
-	}
-	if trEntry.TenantID == "" {
-		trEntry.TenantID = "nil"
-	}
-	timestamp := getCurrentTimestamp()
-	var transactionStatus int = 1
-	uid := ksuid.New().String()
-
-	transaction := TransactionEntry{
-		TenantID:            trEntry.TenantID,
-		AccountID:           trEntry.FromAccount,
-		SystemTransactionID: uid,
-		FromAccount:         trEntry.FromAccount,
-		ToAccount:           trEntry.ToAccount,
-		Amount:              trEntry.Amount,
-		Comment:             "Transfer credits",
-		TransactionDate:     timestamp,
-		Status:              &transactionStatus,
-		InitiatorUUID:       trEntry.InitiatorUUID,
-	}
-
-	// Fetch sender account
-	sender, err := GetAccount(context, dbSvc, trEntry)
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	if err := validateTransfer(req); err != nil {
+		return failedResponse(req, "invalid_request", "The request is not valid.", err.Error()), err
+	}
+	narrative, err := SanitizeNarrative(req.Narrative)
+	if err != nil {
+		return failedResponse(req, "invalid_narrative", "The narrative is not valid.", err.Error()), err
+	}
+	req.Narrative = narrative
+	req.Tags = normalizeTags(req.Tags)
+	if err := validateMetadata(req.Metadata, req.Tags); err != nil {
+		return failedResponse(req, "invalid_metadata", "The metadata or tags are not valid.", err.Error()), err
+	}
+	if err := ValidatePurposeCode(req.PurposeCode); err != nil {
+		return failedResponse(req, "invalid_purpose_code", "The purpose code is not valid.", err.Error()), err
+	}
+	reference, err := SanitizeReference(req.Reference)
+	if err != nil {
+		return failedResponse(req, "invalid_reference", "The reference is not valid.", err.Error()), err
+	}
+	req.Reference = reference
+	if err := ValidateCategory(req.Category); err != nil {
+		return failedResponse(req, "invalid_category", "The category is not valid.", err.Error()), err
+	}
+	if err := ValidateMCC(req.MCC); err != nil {
+		return failedResponse(req, "invalid_category", "The merchant category code is not valid.", err.Error()), err
+	}
+	if req.Category == "" && req.MCC != "" {
+		req.Category = CategoryOfMCC(req.MCC)
+	}
+	if err := checkParentTransaction(context, dbSvc, req); err != nil {
+		return failedResponse(req, "invalid_parent_transaction", "The parent transaction was not found.", err.Error()), err
+	}
+	// A transfer made again with the InitiatorUUID of one the ledger took,
+	// such as a client's retry, is answered as that one was instead of being
+	// made twice. Approved and released transfers were taken by their
+	// request.
+	keyed := req.InitiatorUUID != "" && !opts.approved && !opts.skipDelay
+	if keyed {
+		prior, found, err := keyResponse(context, dbSvc, req)
+		if found {
+			return prior, err
+		}
+		if err != nil {
+			return failedResponse(req, "idempotency_check_error", "The idempotency key could not be checked.", err.Error()), err
+		}
+	}
+	now := clockOf(dbSvc).Now()
+	timestamp := now.Unix()
+	uid := newID(dbSvc)
+	transaction := newTransactionRecord(req, transferNarrative(req, opts), uid, timestamp)
+
+	if err := VerifyTransferSignature(context, dbSvc, req.Entry()); err != nil {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		code := "signature_check_error"
+		if errors.Is(err, ErrSignatureInvalid) {
+			code = "signature_invalid"
+		}
+		return failedResponse(req, code, "The transfer signature could not be verified.", err.Error()), err
+	}
+
+	// Fetch sender account. The read is strongly consistent so that the
+	// balance check sees the sender's latest transfers.
+	sender, err := fetchAccount(context, dbSvc, req.TenantID, req.FromAccount, true)
 	if err != nil || sender == nil {
-		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
 		response = NilResponse{
 			Status:    "error",
 			Code:      "user_not_found",
 			Message:   "Error in retrieving sender.",
 			Details:   fmt.Sprintf("Error in retrieving sender: %v", err),
-			Timestamp: trEntry.Timestamp,
+			Timestamp: req.Timestamp,
 			Data: data{
-				UUID:       trEntry.InitiatorUUID,
-				SignedUUID: trEntry.SignedUUID,
+				UUID:       req.InitiatorUUID,
+				SignedUUID: req.SignedUUID,
 			},
 		}
 		return response, err
 	}
 
 	// Fetch receiver account
-	trEntry.AccountID = trEntry.ToAccount
-	receiver, err := GetAccount(context, dbSvc, trEntry)
+	receiver, err := getAccount(context, dbSvc, req.TenantID, req.ToAccount)
 	if err != nil || receiver == nil {
-		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
 		response = NilResponse{
 			Status:    "error",
 			Code:      "user_not_found",
 			Message:   "Error in retrieving receiver.",
 			Details:   fmt.Sprintf("Error in retrieving receiver: %v", err),
-			Timestamp: trEntry.Timestamp,
+			Timestamp: req.Timestamp,
 			Data: data{
-				UUID:       trEntry.InitiatorUUID,
-				SignedUUID: trEntry.SignedUUID,
+				UUID:       req.InitiatorUUID,
+				SignedUUID: req.SignedUUID,
 			},
 		}
 		return response, err
 	}
-
-	if trEntry.Amount > sender.Amount {
-		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
-		response = NilResponse{
-			Status:    "error",
-			Code:      "insufficient_balance",
-			Message:   "Insufficient balance to complete the transaction.",
-			Details:   "The sender does not have enough balance in their account.",
-			Timestamp: trEntry.Timestamp,
-			Data: data{
-				UUID:       trEntry.InitiatorUUID,
-				SignedUUID: trEntry.SignedUUID,
-			},
-		}
-		return response, errors.New("insufficient balance")
-	}
-
-	debitEntry := LedgerEntry{
-		TenantID:            trEntry.TenantID,
-		AccountID:           trEntry.FromAccount,
-		Amount:              trEntry.Amount,
-		SystemTransactionID: uid,
-		Type:                "debit",
-		Time:                timestamp,
-		InitiatorUUID:       trEntry.InitiatorUUID,
-	}
-	creditEntry := LedgerEntry{
-		TenantID:            trEntry.TenantID,
-		AccountID:           trEntry.ToAccount,
-		Amount:              trEntry.Amount,
-		SystemTransactionID: uid,
-		Type:                "credit",
-		Time:                timestamp,
-		InitiatorUUID:       trEntry.InitiatorUUID,
+	if err := checkDormant(sender); err != nil {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		return failedResponse(req, ErrAccountDormant.Error(), "The sender's account is dormant.", err.Error()), err
 	}
 
-	avDebit, err := attributevalue.MarshalMap(debitEntry)
-	if err != nil {
-		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
-	}
-	avCredit, err := attributevalue.MarshalMap(creditEntry)
+	tenantCfg, err := GetTenantConfig(context, dbSvc, req.TenantID)
 	if err != nil {
-		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
-	}
-
-	debitInput := &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Update: &types.Update{
-					TableName: aws.String(NilUsers),
-					Key: map[string]types.AttributeValue{
-						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
-						"AccountID": &types.AttributeValueMemberS{Value: trEntry.FromAccount},
-					},
-					UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
-					ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
-					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-						":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
-						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-					},
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		return failedResponse(req, "tenant_config_error", "Failed to load the tenant configuration.", err.Error()), err
+	}
+	// Transfers refused for maintenance are not recorded, as they are to be
+	// retried.
+	if err := tenantCfg.maintenanceError(); err != nil {
+		return maintenanceResponse(req, err), err
+	}
+	transaction.Currency = tenantCfg.accountCurrency(sender)
+	if err := tenantCfg.currencyMismatchError(sender, receiver); err != nil {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		return failedResponse(req, ErrCurrencyMismatch.Error(), "The accounts are in different currencies.", err.Error()), err
+	}
+	if err := checkPrecision(req.Amount, transaction.Currency); err != nil {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		return failedResponse(req, "invalid_amount", "The amount has more decimals than its currency.", err.Error()), err
+	}
+
+	// The fee and its tax are either added to what the sender pays or deducted
+	// from what the receiver gets, and are posted in the same journal as the transfer.
+	var fee, tax float64
+	if !opts.betweenWallets {
+		fee = RoundAmount(tenantCfg.FeeSchedule.Calculate(req.Amount), transaction.Currency)
+		tax = RoundAmount(tenantCfg.Tax.Calculate(fee), transaction.Currency)
+	}
+	legs := transferLegs(req, fee, tax, tenantCfg, transaction.Currency)
+	debitAmount, creditAmount := legs[0].Amount, legs[1].Amount
+	if fee > 0 {
+		transaction.Fee = fee
+		transaction.FeePaidBy = tenantCfg.FeeSchedule.payer()
+		transaction.FeeAccount = tenantCfg.FeeSchedule.CollectionAccount
+	}
+	if tax > 0 {
+		transaction.Tax = tax
+		transaction.TaxAccount = tenantCfg.Tax.CollectionAccount
+	}
+	if creditAmount <= 0 {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		return failedResponse(req, "invalid_amount", "The amount does not cover the transfer fee.",
+			fmt.Sprintf("The fee of %.2f is not less than the amount %.2f.", fee+tax, req.Amount)), errors.New("amount does not cover fee")
+	}
+
+	// Unexpired bonuses are spent before the sender's balance. The sender
+	// may go below zero down to its overdraft limit, or must keep the
+	// tenant's minimum balance. The balance is checked again on a fresh
+	// read of the sender when the journal finds it moved.
+	var bonusSpent, remaining float64
+	var bonuses []BonusBucket
+	checkBalance := func() (NilResponse, error) {
+		bonusSpent, bonuses = spendBonuses(sender.Bonuses, debitAmount, timestamp, transaction.Currency)
+		remaining = RoundAmount(sender.Amount-debitAmount+bonusSpent, transaction.Currency)
+		if remaining < tenantCfg.balanceFloor(sender) {
+			recordTransaction(context, dbSvc, transaction, TransactionFailed)
+			return NilResponse{
+				Status:    "error",
+				Code:      "insufficient_balance",
+				Message:   "Insufficient balance to complete the transaction.",
+				Details:   "The sender does not have enough balance in their account.",
+				Timestamp: req.Timestamp,
+				Data: data{
+					UUID:       req.InitiatorUUID,
+					SignedUUID: req.SignedUUID,
 				},
-			},
-			{Put: &types.Put{
-				TableName: aws.String(LedgerTable),
-				Item:      avDebit,
-			}},
-		},
+			}, errors.New("insufficient balance")
+		}
+		if err := floatLimitError(sender, remaining, receiver, creditAmount); err != nil {
+			recordTransaction(context, dbSvc, transaction, TransactionFailed)
+			return failedResponse(req, ErrFloatLimitExceeded.Error(), "The transfer exceeds the float limits of the agent.", err.Error()), err
+		}
+		return NilResponse{}, nil
+	}
+	if response, err := checkBalance(); err != nil {
+		return response, err
 	}
 
-	_, err = dbSvc.TransactWriteItems(context, debitInput)
-	if err != nil {
-		transactionStatus = 1
-		if err := SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus); err != nil {
-			panic(err)
+	// The controls shared by every movement out of a customer's account.
+	// Transfers above the approval threshold or the large transfer
+	// threshold wait for their approvers or their release.
+	err = tenantCfg.checkTransfer(context, dbSvc, transferCheck{
+		req:     req,
+		sender:  sender,
+		credits: []credit{{account: receiver, amount: creditAmount}},
+		now:     now,
+		opts:    opts,
+	})
+	var check *checkError
+	switch {
+	case errors.Is(err, ErrApprovalRequired):
+		response, err = requestApproval(context, dbSvc, tenantCfg, req, nil)
+		if err == nil && keyed {
+			rememberResponse(context, dbSvc, req, response, now)
 		}
-		response = NilResponse{
-			Status:    "error",
-			Code:      "debit_failed",
-			Message:   fmt.Sprintf("Failed to debit from balance for user %s", trEntry.FromAccount),
-			Details:   fmt.Sprintf("Error: %v", err),
-			Timestamp: trEntry.Timestamp,
-			Data: data{
-				UUID:       trEntry.InitiatorUUID,
-				SignedUUID: trEntry.SignedUUID,
-			},
+		return response, err
+	case errors.Is(err, ErrTransferDelayed):
+		response, err = holdTransfer(context, dbSvc, tenantCfg, req, nil)
+		if err == nil && keyed {
+			rememberResponse(context, dbSvc, req, response, now)
 		}
-		return response, fmt.Errorf("failed to debit from balance for user %s: %v", trEntry.FromAccount, err)
-	}
-
-	creditInput := &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Update: &types.Update{
-					TableName: aws.String(NilUsers),
-					Key: map[string]types.AttributeValue{
-						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
-						"AccountID": &types.AttributeValueMemberS{Value: trEntry.ToAccount},
-					},
-					UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
-					ConditionExpression: aws.String("attribute_exists(AccountID) AND TenantID = :tenantID"),
-					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-						":tenantID":   &types.AttributeValueMemberS{Value: trEntry.TenantID},
-					},
-				},
-			},
-			{Put: &types.Put{
-				TableName: aws.String(LedgerTable),
-				Item:      avCredit,
-			}},
-		},
+		return response, err
+	case errors.As(err, &check) && check.rejection != nil:
+		transaction.BlockReason = check.rejection.ReasonCode
+		recordTransaction(context, dbSvc, transaction, TransactionBlocked)
+		response = failedResponse(req, check.code, check.message, check.rejection.ReasonCode)
+		response.Data.TransactionID = uid
+		return response, check.err
+	case errors.As(err, &check):
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		if errors.Is(err, ErrRateLimited) {
+			return rateLimitedResponse(req, check.err), check.err
+		}
+		return failedResponse(req, check.code, check.message, err.Error()), check.err
 	}
 
-	_, err = dbSvc.TransactWriteItems(context, creditInput)
-	if err != nil {
-		rollbackInput := &dynamodb.UpdateItemInput{
-			TableName: aws.String(NilUsers),
-			Key: map[string]types.AttributeValue{
-				"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
-				"AccountID": &types.AttributeValueMemberS{Value: trEntry.FromAccount},
-			},
-			UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
-			ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
-			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-				":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
-				":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-			},
+	posted := NilResponse{
+		Status:  "success",
+		Code:    "successful_transaction",
+		Message: "Transaction initiated successfully.",
+		Data: data{
+			TransactionID: uid,
+			Amount:        req.Amount,
+			Fee:           fee,
+			Currency:      transaction.Currency,
+			UUID:          req.InitiatorUUID,
+			SignedUUID:    req.SignedUUID,
+		},
+	}
+	// The journal takes the transfer's InitiatorUUID, so of two transfers
+	// made with the same key at once only one is posted.
+	extra := []types.TransactWriteItem{{}}
+	if keyed {
+		key, err := takeKey(req, posted, now)
+		if err != nil {
+			return failedResponse(req, "idempotency_check_error", "The idempotency key could not be recorded.", err.Error()), err
+		}
+		extra = append(extra, key)
+	}
+
+	// A journal failing on the sender's version lost a race with another
+	// write to the sender, such as a concurrent transfer. The sender is read
+	// again, its balance checked again, and the journal posted again.
+	baseLegs := legs
+	retry := conflictRetryOf(dbSvc)
+	for attempt := 1; ; attempt++ {
+		legs = slices.Clone(baseLegs)
+		legs[0].Overdraft = remaining < 0
+		for i := range legs[:2] {
+			legs[i].Category, legs[i].MCC = req.Category, req.MCC
+		}
+		if bonusSpent > 0 {
+			legs = bonusLegs(legs, bonusSpent, transaction.Currency)
+		}
+		transaction.JournalID = uid
+		transaction.Legs = legs
+
+		// The transaction record is part of the journal, so a successful
+		// transfer can never be missing from the transactions table.
+		transaction.Status = TransactionCompleted
+		avTransaction, marshalErr := attributevalue.MarshalMap(transaction)
+		if marshalErr != nil {
+			return response, fmt.Errorf("failed to marshal transaction entry: %v", marshalErr)
 		}
 
-		_, rollbackErr := dbSvc.UpdateItem(context, rollbackInput)
-		if rollbackErr != nil {
-			panic(fmt.Errorf("failed to rollback debit for user %s: %v", trEntry.FromAccount, rollbackErr))
+		// Nothing is written yet, so a request cancelled by now simply fails.
+		if err := context.Err(); err != nil {
+			return failedResponse(req, "request_cancelled", "The request was cancelled before the transfer was made.", err.Error()), err
 		}
 
-		transactionStatus = 1
-		if err := SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus); err != nil {
-			panic(err)
+		accounts := map[string]*User{req.FromAccount: sender}
+		if attempt == 1 {
+			accounts[req.ToAccount] = receiver
+		}
+		extra[0] = types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(TransactionsTable),
+			Item:      avTransaction,
+		}}
+		err = postJournal(context, dbSvc, req.TenantID, uid, req.InitiatorUUID, sender, legs, bonuses, accounts, timestamp, extra...)
+		if err == nil || attempt >= retry.MaxAttempts || !senderConflict(err) {
+			break
+		}
+		delay := retry.Delay(attempt - 1)
+		metricsOf(dbSvc).AddCounter(context, MetricTransferRetries, 1, Attr("tenant", req.TenantID))
+		loggerOf(dbSvc).DebugContext(context, "retrying transfer after the sender moved", "tenant", req.TenantID, "account", req.FromAccount, "txid", uid, "attempt", attempt+1, "delay", delay)
+		select {
+		case <-context.Done():
+		case <-time.After(delay):
+		}
+		if err := context.Err(); err != nil {
+			return failedResponse(req, "request_cancelled", "The request was cancelled before the transfer was made.", err.Error()), err
+		}
+		fresh, readErr := fetchAccount(context, dbSvc, req.TenantID, req.FromAccount, true)
+		if readErr != nil || fresh == nil {
+			break
+		}
+		sender = fresh
+		if response, err := checkBalance(); err != nil {
+			return response, err
+		}
+	}
+	// A journal failing on its key lost the race to the same transfer.
+	if err != nil && keyed && context.Err() == nil {
+		if prior, found, keyErr := keyResponse(context, dbSvc, req); found {
+			return prior, keyErr
+		}
+	}
+	// A journal interrupted by the request's cancellation may or may not
+	// have been committed by DynamoDB; unless its record shows it was, it is
+	// left indeterminate for ResolveIndeterminate.
+	if err != nil && context.Err() != nil {
+		committed, recordErr := recordIndeterminate(context, dbSvc, transaction)
+		switch {
+		case recordErr != nil:
+			return indeterminateResponse(req, uid, errors.Join(err, recordErr))
+		case !committed:
+			return indeterminateResponse(req, uid, err)
+		}
+		err = nil
+	}
+	if err != nil {
+		recordTransaction(context, dbSvc, transaction, TransactionFailed)
+		// The sender's update is the first item, so a failed condition there
+		// means the debit failed; anything else failed on the credit side.
+		if !senderLegFailed(err) {
+			response = NilResponse{
+				Status:    "error",
+				Code:      "credit_failed",
+				Message:   fmt.Sprintf("Failed to credit to balance for user %s", req.ToAccount),
+				Details:   fmt.Sprintf("Error: %v", err),
+				Timestamp: req.Timestamp,
+				Data: data{
+					UUID:       req.InitiatorUUID,
+					SignedUUID: req.SignedUUID,
+				},
+			}
+			return response, fmt.Errorf("failed to credit to balance for user %s: %v", req.ToAccount, err)
 		}
 		response = NilResponse{
 			Status:    "error",
-			Code:      "credit_failed",
-			Message:   fmt.Sprintf("Failed to credit to balance for user %s", trEntry.ToAccount),
+			Code:      "debit_failed",
+			Message:   fmt.Sprintf("Failed to debit from balance for user %s", req.FromAccount),
 			Details:   fmt.Sprintf("Error: %v", err),
-			Timestamp: trEntry.Timestamp,
+			Timestamp: req.Timestamp,
 			Data: data{
-				UUID:       trEntry.InitiatorUUID,
-				SignedUUID: trEntry.SignedUUID,
+				UUID:       req.InitiatorUUID,
+				SignedUUID: req.SignedUUID,
 			},
 		}
-		return response, fmt.Errorf("failed to credit to balance for user %s: %v", trEntry.ToAccount, err)
+		return response, fmt.Errorf("failed to debit from balance for user %s: %v", req.FromAccount, err)
 	}
+	recordAnalytics(context, dbSvc, transaction, TransactionCompleted)
+	var cashback float64
+	if !opts.betweenWallets {
+		cashback = applyCashback(context, dbSvc, req, uid, timestamp)
+	}
+	evaluateSubscriptions(context, dbSvc, req.TenantID, uid, transaction.Currency,
+		balanceChange{accountId: req.FromAccount, counterparty: req.ToAccount, before: sender.Amount, after: remaining},
+		balanceChange{accountId: req.ToAccount, counterparty: req.FromAccount, before: receiver.Amount, after: RoundAmount(receiver.Amount+creditAmount, transaction.Currency)})
 
-	transactionStatus = 0
-	if err := SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus); err != nil {
-		panic(err)
+	response = posted
+	response.Data.Cashback = cashback
+	return response, nil
+}
+
+// ErrInvalidAmount is returned for a transfer of zero, including -0, a
+// negative amount or more decimals than its currency has. Posting such an
+// amount through the subtract-then-add balance updates would mint or destroy
+// money.
+var ErrInvalidAmount = errors.New("invalid_amount")
+
+// ErrSelfTransfer is returned for a transfer whose receiver is its sender.
+var ErrSelfTransfer = errors.New("self_transfer")
+
+// validateTransfer checks the tenant, accounts and amount of a transfer. Its
+// validation errors are wrapped with ErrInvalidAmount and ErrSelfTransfer,
+// so callers can tell them apart. The amount may have the decimals of any
+// currency; a transfer holds it to those of the sender's currency.
+func validateTransfer(req TransferRequest) error {
+	err := validation.Collect(
+		validation.TenantID("tenant_id", req.TenantID),
+		validation.AccountID("from_account", req.FromAccount),
+		validation.AccountID("to_account", req.ToAccount),
+		validation.Distinct("to_account", req.FromAccount, req.ToAccount),
+		validation.AmountPrecision("amount", req.Amount, maxPrecision()),
+	)
+	for _, field := range validation.Fields(err) {
+		switch {
+		case field.Code == validation.CodeSelfTransfer:
+			err = fmt.Errorf("%w: %w", ErrSelfTransfer, err)
+		case field.Field == "amount":
+			err = fmt.Errorf("%w: %w", ErrInvalidAmount, err)
+		}
 	}
+	return err
+}
 
-	response = NilResponse{
-		Status:  "success",
-		Code:    "successful_transaction",
-		Message: "Transaction initiated successfully.",
+// failedResponse builds the error response returned to the caller of a transfer.
+func failedResponse(req TransferRequest, code, message, details string) NilResponse {
+	return NilResponse{
+		Status:    "error",
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		Timestamp: req.Timestamp,
 		Data: data{
-			TransactionID: uid,
-			Amount:        trEntry.Amount,
-			Currency:      "SDG",
-			UUID:          trEntry.InitiatorUUID,
-			SignedUUID:    trEntry.SignedUUID,
+			UUID:       req.InitiatorUUID,
+			SignedUUID: req.SignedUUID,
 		},
 	}
-
-	return response, nil
 }
 
 // GetTransactions retrieves a list of transactions for a specified tenant and account.
 // It takes a DynamoDB client, a tenant ID, an account ID, a limit for the number of transactions
 // to retrieve, and an optional lastTransactionID for pagination.
 // It returns a slice of LedgerEntry, the ID of the last transaction, and an error, if any.
-func GetTransactions(context context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, limit int32, lastTransactionID string) ([]LedgerEntry, string, error) {
+func GetTransactions(context context.Context, dbSvc DynamoDBAPI, tenantID, accountID string, limit int32, lastTransactionID string) (entries []LedgerEntry, lastKey string, err error) {
 	if tenantID == "" {
 		tenantID = "nil"
 	}
+	context, span := startSpan(context, dbSvc, "GetTransactions", Attr("tenant", tenantID), Attr("account", accountID))
+	defer func() { endSpan(span, err) }()
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String("TransactionsTable"),
 		KeyConditionExpression: aws.String("TenantID = :tenantId AND AccountID = :accountId"),
@@ -502,7 +884,7 @@ func GetTransactions(context context.Context, dbSvc *dynamodb.Client, tenantID,
 	}
 
 	// Execute the query
-	resp, err := dbSvc.Query(context, input)
+	resp, err := replicaOf(dbSvc).Query(context, input)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to fetch transactions: %v", err)
 	}
@@ -526,7 +908,7 @@ func GetTransactions(context context.Context, dbSvc *dynamodb.Client, tenantID,
 // GetDetailedTransactions retrieves a list of transactions for a specified tenant and account.
 // It takes a DynamoDB client, a tenant ID, an account ID, and a limit for the number of transactions
 // to retrieve. It returns a slice of TransactionEntry and an error, if any.
-func GetDetailedTransactions(context context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, limit int32) ([]TransactionEntry, error) {
+func GetDetailedTransactions(context context.Context, dbSvc DynamoDBAPI, tenantID, accountID string, limit int32) ([]TransactionEntry, error) {
 	// Query for transactions sent by the account
 	if tenantID == "" {
 		tenantID = "nil"
@@ -548,7 +930,7 @@ func GetDetailedTransactions(context context.Context, dbSvc *dynamodb.Client, te
 }
 
 // getTransactionsByIndex is a helper function that queries for transactions on a specific index.
-func getTransactionsByIndex(context context.Context, dbSvc *dynamodb.Client, tenantID, indexName, attributeName, accountID string, limit int32, lastTransactionID string) ([]TransactionEntry, string, error) {
+func getTransactionsByIndex(context context.Context, dbSvc DynamoDBAPI, tenantID, indexName, attributeName, accountID string, limit int32, lastTransactionID string) ([]TransactionEntry, string, error) {
 	if tenantID == "" {
 		tenantID = "nil"
 	}
@@ -590,8 +972,10 @@ func getTransactionsByIndex(context context.Context, dbSvc *dynamodb.Client, ten
 	return transactions, newLastTransactionID, nil
 }
 
-// GetTransaction retrieves a single transaction by its composite key
-func GetTransaction(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID, systemTransactionID string) (*TransactionEntry, error) {
+// GetTransaction retrieves a single transaction by its composite key.
+// Transfers posted as a journal carry their JournalID and the full breakdown
+// of the principal, fee and tax legs in Legs.
+func GetTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantID, accountID, systemTransactionID string) (*TransactionEntry, error) {
     // Try GetItem first (optimal if SystemTransactionID is the sort key)
     getInput := &dynamodb.GetItemInput{
         TableName: aws.String("TransactionsTable"),
@@ -630,52 +1014,127 @@ func GetTransaction(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accou
     return unmarshalTransaction(queryResult.Items[0])
 }
 
-// UpdateTransaction updates specific fields of a transaction
-func UpdateTransaction(
+// updatableTransactionFields are the attributes UpdateTransaction may change.
+// Amounts, accounts and journal data are immutable once a transaction is
+// posted, and its status only changes through TransitionStatus. Comment and
+// Narrative are sanitized with SanitizeNarrative.
+var updatableTransactionFields = map[string]bool{
+    "Comment":         true,
+    "Narrative":       true,
+    "ApprovalStatus":  true,
+    "ApproverID":      true,
+    "ProcessedAt":     true,
+    "RejectionReason": true,
+}
+
+var (
+    // ErrTransactionNotFound is returned when updating a transaction that does not exist.
+    ErrTransactionNotFound = errors.New("transaction not found")
+    // ErrVersionConflict is returned when a transaction was changed since it was read.
+    ErrVersionConflict = errors.New("transaction was modified concurrently")
+)
+
+// UpdateTransaction updates specific fields of a transaction. expectedVersion
+// is the Version the caller read (0 for transactions never updated); the
+// update fails with ErrVersionConflict if another writer got there first and
+// with ErrTransactionNotFound instead of creating a new transaction. Only the
+// fields in updatableTransactionFields may be changed.
+func UpdateTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantID, systemTransactionID string, expectedVersion int64, updates map[string]interface{}) (*TransactionEntry, error) {
+	if tenantID == "" {
+		tenantID = "nil"
+	}
+	if !auditing(dbSvc) {
+		return updateTransaction(ctx, dbSvc, tenantID, systemTransactionID, expectedVersion, updates)
+	}
+	before, _ := getTransactionForUpdate(ctx, dbSvc, tenantID, systemTransactionID)
+	after, err := updateTransaction(ctx, dbSvc, tenantID, systemTransactionID, expectedVersion, updates)
+	payload := map[string]any{"expected_version": expectedVersion, "updates": updates}
+	recordAudit(ctx, dbSvc, AuditUpdateTransaction, tenantID, systemTransactionID, payload, before, after, err)
+	return after, err
+}
+
+func updateTransaction(
     ctx context.Context,
-    dbSvc *dynamodb.Client,
+    dbSvc DynamoDBAPI,
     tenantID string,
     systemTransactionID string,
+    expectedVersion int64,
     updates map[string]interface{},
 ) (*TransactionEntry, error) {
 
     if tenantID == "" {
         tenantID = "nil"
     }
+    if len(updates) == 0 {
+        return nil, errors.New("no fields to update")
+    }
 
     // 1. Prepare update expression
-    updateExpr := "SET "
-    attrValues := make(map[string]types.AttributeValue)
-    attrNames := make(map[string]string)
-    
+    updateExpr := "SET #version = :newVersion"
+    attrValues := map[string]types.AttributeValue{
+        ":expectedVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion, 10)},
+        ":newVersion":      &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion+1, 10)},
+    }
+    attrNames := map[string]string{
+        "#version":       "Version",
+        "#transactionID": "TransactionID",
+    }
+
     i := 0
     for field, value := range updates {
+        if !updatableTransactionFields[field] {
+            return nil, fmt.Errorf("field %s cannot be updated", field)
+        }
+        if field == "Comment" || field == "Narrative" {
+            text, ok := value.(string)
+            if !ok {
+                return nil, fmt.Errorf("field %s must be a string", field)
+            }
+            text, err := SanitizeNarrative(text)
+            if err != nil {
+                return nil, err
+            }
+            value = text
+            if field == "Narrative" {
+                updateExpr += ", #narrativeSearch = :narrativeSearch"
+                attrNames["#narrativeSearch"] = "NarrativeSearch"
+                attrValues[":narrativeSearch"] = &types.AttributeValueMemberS{Value: narrativeSearchKey(text)}
+            }
+        }
         placeholder := fmt.Sprintf(":val%d", i)
         namePlaceholder := fmt.Sprintf("#field%d", i)
-        
-        updateExpr += fmt.Sprintf("%s = %s, ", namePlaceholder, placeholder)
+
+        updateExpr += fmt.Sprintf(", %s = %s", namePlaceholder, placeholder)
         attrValues[placeholder] = createAttributeValue(value)
         attrNames[namePlaceholder] = field
-        
+
         i++
     }
-    updateExpr = strings.TrimSuffix(updateExpr, ", ")
 
     // 2. Execute update
     input := &dynamodb.UpdateItemInput{
-        TableName: aws.String("TransactionsTable"),
+        TableName: aws.String(TransactionsTable),
         Key: map[string]types.AttributeValue{
             "TenantID":      &types.AttributeValueMemberS{Value: tenantID},
             "TransactionID": &types.AttributeValueMemberS{Value: systemTransactionID},
         },
-        UpdateExpression:          aws.String(updateExpr),
-        ExpressionAttributeValues: attrValues,
-        ExpressionAttributeNames:  attrNames,
-        ReturnValues:              types.ReturnValueAllNew,
+        UpdateExpression:                    aws.String(updateExpr),
+        ConditionExpression:                 aws.String("attribute_exists(#transactionID) AND (attribute_not_exists(#version) OR #version = :expectedVersion)"),
+        ExpressionAttributeValues:           attrValues,
+        ExpressionAttributeNames:            attrNames,
+        ReturnValues:                        types.ReturnValueAllNew,
+        ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
     }
 
     result, err := dbSvc.UpdateItem(ctx, input)
     if err != nil {
+        var condErr *types.ConditionalCheckFailedException
+        if errors.As(err, &condErr) {
+            if len(condErr.Item) == 0 {
+                return nil, ErrTransactionNotFound
+            }
+            return nil, ErrVersionConflict
+        }
         return nil, fmt.Errorf("failed to update transaction: %w", err)
     }
 
@@ -695,7 +1154,7 @@ func createAttributeValue(value interface{}) types.AttributeValue {
     case string:
         return &types.AttributeValueMemberS{Value: v}
     case float64:
-        return &types.AttributeValueMemberN{Value: fmt.Sprintf("%f", v)}
+        return &types.AttributeValueMemberN{Value: formatAmount(v)}
     case int:
         return &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", v)}
     case bool:
@@ -715,7 +1174,13 @@ func unmarshalTransaction(item map[string]types.AttributeValue) (*TransactionEnt
     return &tx, nil
 }
 
-func GetAllNilTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantId string, filter TransactionFilter) ([]TransactionEntry, map[string]types.AttributeValue, error) {
+// GetAllNilTransactions returns a page of a tenant's transactions matching
+// the filter. When filter.AccountID is set, each transaction carries that
+// account's annotation. A filter.Direction reads the account's transactions
+// from FromAccountIndex or ToAccountIndex; without one they are filtered out
+// of the tenant's. A filter.Counterparty without a direction is served by
+// GetTransactionsBetween in a single page.
+func GetAllNilTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, filter TransactionFilter) ([]TransactionEntry, map[string]types.AttributeValue, error) {
 	if tenantId == "" {
 		tenantId = "nil"
 	}
@@ -730,9 +1195,38 @@ func GetAllNilTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantId
 	keyConditionExpression := "#tenantID = :tenantId"
 	filterExpressions := []string{}
 
+	if filter.Counterparty != "" && filter.Direction == "" {
+		if filter.AccountID == "" {
+			return nil, nil, errors.New("a counterparty filter needs an account id")
+		}
+		transactions, err := GetTransactionsBetween(ctx, dbSvc, tenantId, filter.AccountID, filter.Counterparty, filter)
+		return transactions, nil, err
+	}
+
 	// Determine which index to use based on the filter
 	var indexName *string
-	if filter.AccountID != "" {
+	switch {
+	case filter.AccountID != "" && filter.Direction != "":
+		// The account's side of the transfer is the index key, so only its
+		// own transactions are read.
+		own, other, index := "FromAccount", "ToAccount", "FromAccountIndex"
+		switch filter.Direction {
+		case DirectionSent:
+		case DirectionReceived:
+			own, other, index = "ToAccount", "FromAccount", "ToAccountIndex"
+		default:
+			return nil, nil, fmt.Errorf("unknown direction: %s", filter.Direction)
+		}
+		indexName = aws.String(index)
+		keyConditionExpression += " AND #account = :accountID"
+		expressionAttributeNames["#account"] = own
+		expressionAttributeValues[":accountID"] = &types.AttributeValueMemberS{Value: filter.AccountID}
+		if filter.Counterparty != "" {
+			filterExpressions = append(filterExpressions, "#counterparty = :counterparty")
+			expressionAttributeNames["#counterparty"] = other
+			expressionAttributeValues[":counterparty"] = &types.AttributeValueMemberS{Value: filter.Counterparty}
+		}
+	case filter.AccountID != "":
 		// Since we can't determine if it's FromAccount or ToAccount, we'll use a filter expression
 		filterExpressions = append(filterExpressions, "(#fromAccount = :accountID OR #toAccount = :accountID)")
 		expressionAttributeNames["#fromAccount"] = "FromAccount"
@@ -741,17 +1235,62 @@ func GetAllNilTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantId
 	}
 
 	if filter.StartTime != 0 && filter.EndTime != 0 {
-		indexName = aws.String("TransactionDateIndex")
-		keyConditionExpression += " AND #transactionDate BETWEEN :startTime AND :endTime"
 		expressionAttributeNames["#transactionDate"] = "TransactionDate"
 		expressionAttributeValues[":startTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.StartTime, 10)}
 		expressionAttributeValues[":endTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.EndTime, 10)}
+		if indexName == nil {
+			indexName = aws.String("TransactionDateIndex")
+			keyConditionExpression += " AND #transactionDate BETWEEN :startTime AND :endTime"
+		} else {
+			filterExpressions = append(filterExpressions, "#transactionDate BETWEEN :startTime AND :endTime")
+		}
 	}
 
 	if filter.TransactionStatus != nil {
 		filterExpressions = append(filterExpressions, "#transactionStatus = :transactionStatus")
 		expressionAttributeNames["#transactionStatus"] = "TransactionStatus"
-		expressionAttributeValues[":transactionStatus"] = &types.AttributeValueMemberN{Value: strconv.Itoa(*filter.TransactionStatus)}
+		expressionAttributeValues[":transactionStatus"] = &types.AttributeValueMemberN{Value: strconv.Itoa(int(*filter.TransactionStatus))}
+	}
+
+	if filter.Search != "" {
+		search, err := SanitizeNarrative(filter.Search)
+		if err != nil {
+			return nil, nil, err
+		}
+		filterExpressions = append(filterExpressions, "contains(#narrativeSearch, :search)")
+		expressionAttributeNames["#narrativeSearch"] = "NarrativeSearch"
+		expressionAttributeValues[":search"] = &types.AttributeValueMemberS{Value: narrativeSearchKey(search)}
+	}
+
+	if filter.Category != "" {
+		filterExpressions = append(filterExpressions, "#category = :category")
+		expressionAttributeNames["#category"] = "Category"
+		expressionAttributeValues[":category"] = &types.AttributeValueMemberS{Value: filter.Category}
+	}
+	if filter.MCC != "" {
+		filterExpressions = append(filterExpressions, "#mcc = :mcc")
+		expressionAttributeNames["#mcc"] = "MCC"
+		expressionAttributeValues[":mcc"] = &types.AttributeValueMemberS{Value: filter.MCC}
+	}
+
+	if filter.Tag != "" {
+		filterExpressions = append(filterExpressions, "contains(#tags, :tag)")
+		expressionAttributeNames["#tags"] = "Tags"
+		expressionAttributeValues[":tag"] = &types.AttributeValueMemberS{Value: strings.TrimSpace(filter.Tag)}
+	}
+	if len(filter.Metadata) > 0 {
+		expressionAttributeNames["#metadata"] = "Metadata"
+		keys := make([]string, 0, len(filter.Metadata))
+		for key := range filter.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			name, value := fmt.Sprintf("#metadataKey%d", i), fmt.Sprintf(":metadataValue%d", i)
+			filterExpressions = append(filterExpressions, fmt.Sprintf("#metadata.%s = %s", name, value))
+			expressionAttributeNames[name] = key
+			expressionAttributeValues[value] = &types.AttributeValueMemberS{Value: filter.Metadata[key]}
+		}
 	}
 
 	if filter.Limit == 0 {
@@ -776,16 +1315,19 @@ func GetAllNilTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantId
 		queryInput.ExclusiveStartKey = filter.LastEvaluatedKey
 	}
 
-	// Debug: Print the query input
-	fmt.Printf("Query Input: %+v\n", queryInput)
-
+	start := time.Now()
 	output, err := dbSvc.Query(ctx, queryInput)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to fetch transactions: %v", err)
 	}
-
-	// Debug: Print the number of items returned
-	fmt.Printf("Number of items returned: %d\n", len(output.Items))
+	loggerOf(dbSvc).DebugContext(ctx, "fetched transactions",
+		"tenant", tenantId,
+		"account", filter.AccountID,
+		"key_condition", keyConditionExpression,
+		"filter", aws.ToString(queryInput.FilterExpression),
+		"items", len(output.Items),
+		"latency", time.Since(start),
+	)
 
 	var transactions []TransactionEntry
 	err = attributevalue.UnmarshalListOfMaps(output.Items, &transactions)
@@ -793,6 +1335,13 @@ func GetAllNilTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantId
 		return nil, nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
 	}
 
+	// Annotations are private, so only an account's own history carries them.
+	if filter.AccountID != "" {
+		if err := AttachAnnotations(ctx, dbSvc, tenantId, filter.AccountID, transactions); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return transactions, output.LastEvaluatedKey, nil
 }
 
@@ -814,3 +1363,38 @@ func getCurrentTimestamp() int64 {
 
 	return timestamp
 }
+
+// GetTransactionsBetween returns the transactions between two accounts in
+// either direction, newest first, matching the status and time of filter.
+// Each direction is read from its account index keyed by accountA, so only
+// accountA's transactions are scanned. Every page is read; filter.Limit caps
+// the result.
+func GetTransactionsBetween(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountA, accountB string, filter TransactionFilter) ([]TransactionEntry, error) {
+	if accountA == "" || accountB == "" {
+		return nil, errors.New("both accounts are required")
+	}
+	limit := filter.Limit
+	filter.AccountID, filter.Counterparty, filter.Limit = accountA, accountB, 100
+
+	var all []TransactionEntry
+	for _, direction := range []string{DirectionSent, DirectionReceived} {
+		if direction == DirectionReceived && accountA == accountB {
+			break
+		}
+		filter.Direction, filter.LastEvaluatedKey = direction, nil
+		it := NewTransactionsIterator(dbSvc, tenantId, filter)
+		for it.Next(ctx) {
+			all = append(all, it.Transaction())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].TransactionDate > all[j].TransactionDate
+	})
+	if limit > 0 && len(all) > int(limit) {
+		all = all[:limit]
+	}
+	return all, nil
+}
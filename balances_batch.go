@@ -0,0 +1,104 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// InquireBalances returns the balances of many accounts of a tenant by
+// account ID, reading them with BatchGetItem 100 at a time instead of one
+// GetItem per account. Keys DynamoDB leaves unprocessed are retried with
+// exponential backoff. Accounts that
+// do not exist are returned in missing, in the order of accountIds;
+// repeated IDs are read once.
+func InquireBalances(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, accountIds []string) (balances map[string]float64, missing []string, err error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	ctx, span := startSpan(ctx, dbSvc, "InquireBalances", Attr("tenant", tenantId), Attr("accounts", len(accountIds)))
+	defer func() { endSpan(span, err) }()
+	checks := []error{validation.TenantID("tenant_id", tenantId)}
+	for i, accountId := range accountIds {
+		checks = append(checks, validation.AccountID(fmt.Sprintf("account_ids[%d]", i), accountId))
+	}
+	if err := validation.Collect(checks...); err != nil {
+		return nil, nil, err
+	}
+
+	var keys []map[string]types.AttributeValue
+	seen := make(map[string]bool, len(accountIds))
+	for _, accountId := range accountIds {
+		if seen[accountId] {
+			continue
+		}
+		seen[accountId] = true
+		keys = append(keys, map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		})
+	}
+
+	balances = make(map[string]float64, len(keys))
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		items, err := batchGet(ctx, replicaOf(dbSvc), NilUsers, types.KeysAndAttributes{
+			Keys:                 keys[start:min(start+maxBatchGetKeys, len(keys))],
+			ProjectionExpression: aws.String("AccountID, amount"),
+			ConsistentRead:       aws.Bool(consistentReads(dbSvc)),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to inquire balances: %v", err)
+		}
+		var page []UserBalance
+		if err := attributevalue.UnmarshalListOfMaps(items, &page); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal balances: %v", err)
+		}
+		for _, balance := range page {
+			balances[balance.AccountID] = balance.Amount
+		}
+	}
+	for _, accountId := range accountIds {
+		if _, ok := balances[accountId]; !ok && seen[accountId] {
+			missing = append(missing, accountId)
+			seen[accountId] = false
+		}
+	}
+	return balances, missing, nil
+}
+
+// batchGet reads up to maxBatchGetKeys keys of a table with BatchGetItem,
+// retrying unprocessed keys after BatchWriteBackoff, doubled on every further
+// retry.
+func batchGet(ctx context.Context, dbSvc DynamoDBAPI, table string, request types.KeysAndAttributes) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	backoff := BatchWriteBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := dbSvc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{table: request},
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, result.Responses[table]...)
+		unprocessed, ok := result.UnprocessedKeys[table]
+		if !ok || len(unprocessed.Keys) == 0 {
+			return items, nil
+		}
+		if attempt == maxBatchGetRetries {
+			return nil, fmt.Errorf("%d keys left unprocessed", len(unprocessed.Keys))
+		}
+		request = unprocessed
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
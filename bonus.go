@@ -0,0 +1,235 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// BonusBucket is promotional money granted to an account. Buckets are kept
+// apart from the account's balance: transfers spend them before the
+// balance, soonest to expire first, but they are never withdrawable, and
+// whatever is left when they expire returns to the tenant's
+// BonusFundingAccount.
+type BonusBucket struct {
+	// ID is the journal that granted the bucket.
+	ID        string  `dynamodbav:"ID" json:"id"`
+	Amount    float64 `dynamodbav:"Amount" json:"amount"`
+	ExpiresAt int64   `dynamodbav:"ExpiresAt" json:"expires_at"`
+	Campaign  string  `dynamodbav:"Campaign,omitempty" json:"campaign,omitempty"`
+}
+
+func (b BonusBucket) expired(at int64) bool {
+	return b.ExpiresAt <= at
+}
+
+// spendBonuses spends up to amount, in currency, from the buckets unexpired
+// at the given time, soonest to expire first. It returns what was spent and
+// the buckets left, which keep the expired ones for ExpireBonuses to return.
+func spendBonuses(buckets []BonusBucket, amount float64, at int64, currency string) (spent float64, left []BonusBucket) {
+	left = append([]BonusBucket(nil), buckets...)
+	sort.SliceStable(left, func(i, j int) bool { return left[i].ExpiresAt < left[j].ExpiresAt })
+	kept := left[:0]
+	for _, b := range left {
+		if !b.expired(at) && spent < amount {
+			take := RoundAmount(min(b.Amount, amount-spent), currency)
+			spent = RoundAmount(spent+take, currency)
+			b.Amount = RoundAmount(b.Amount-take, currency)
+		}
+		if b.Amount > 0 {
+			kept = append(kept, b)
+		}
+	}
+	return spent, kept
+}
+
+// bonusLegs moves spent from a transfer's debit leg to a bonus debit leg,
+// which comes first so the journal still starts with the sender. The debit
+// leg is dropped when bonuses pay for all of it.
+func bonusLegs(legs []JournalLeg, spent float64, currency string) []JournalLeg {
+	out := []JournalLeg{{AccountID: legs[0].AccountID, Type: LegBonusDebit, Amount: spent}}
+	if debit := RoundAmount(legs[0].Amount-spent, currency); debit > 0 {
+		legs[0].Amount = debit
+		out = append(out, legs[0])
+	}
+	return append(out, legs[1:]...)
+}
+
+// InquireBonusBalance returns the promotional money an account can spend,
+// which InquireBalance leaves out.
+func InquireBonusBalance(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (float64, error) {
+	buckets, err := GetBonuses(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return 0, err
+	}
+	var balance float64
+	for _, b := range buckets {
+		balance += b.Amount
+	}
+	return roundAmount(balance), nil
+}
+
+// GetBonuses returns the unexpired bonus buckets of an account, soonest to
+// expire first, which is the order transfers spend them in.
+func GetBonuses(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]BonusBucket, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	account, err := readAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	now := clockOf(dbSvc).Now().Unix()
+	var buckets []BonusBucket
+	for _, b := range account.Bonuses {
+		if !b.expired(now) {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].ExpiresAt < buckets[j].ExpiresAt })
+	return buckets, nil
+}
+
+// GrantBonus credits an account with promotional money expiring at
+// expiresAt, taken from the tenant's BonusFundingAccount. The funding
+// account carries the cost of promotions and is debited without a balance
+// check. The grant fails if the account changes while it is posted, and can
+// be retried.
+func GrantBonus(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, amount float64, expiresAt time.Time, campaign string) (*BonusBucket, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	amount = roundAmount(amount)
+	if amount <= 0 {
+		return nil, errors.New("bonus amount must be positive")
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	if expiresAt.Unix() <= timestamp {
+		return nil, errors.New("bonus must expire in the future")
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BonusFundingAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no bonus funding account", tenantId)
+	}
+	if cfg.BonusFundingAccount == accountId {
+		return nil, errors.New("the bonus funding account cannot be granted bonuses")
+	}
+	account, err := readAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", accountId, err)
+	}
+
+	bucket := BonusBucket{ID: newID(dbSvc), Amount: amount, ExpiresAt: expiresAt.Unix(), Campaign: campaign}
+	legs := []JournalLeg{
+		{AccountID: accountId, Type: LegBonusCredit, Amount: amount},
+		{AccountID: cfg.BonusFundingAccount, Type: LegDebit, Amount: amount},
+	}
+	bonuses := append(append([]BonusBucket(nil), account.Bonuses...), bucket)
+	accounts := map[string]*User{accountId: account}
+	err = postJournal(ctx, dbSvc, tenantId, bucket.ID, ActorFrom(ctx), account, legs, bonuses, accounts, timestamp)
+	if err != nil {
+		err = fmt.Errorf("failed to grant bonus to %s: %v", accountId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	payload := map[string]any{"amount": amount, "expires_at": bucket.ExpiresAt, "campaign": campaign}
+	recordAudit(ctx, dbSvc, AuditGrantBonus, tenantId, accountId, payload, account, after, err)
+	if err != nil {
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "bonus granted", "tenant", tenantId, "account", accountId, "amount", amount, "campaign", campaign)
+	return &bucket, nil
+}
+
+// ExpireBonuses returns what is left of the buckets expired by now to the
+// tenant's BonusFundingAccount, posting a bonus expiry leg for each account.
+// It is meant to be run periodically. An account that changes while its
+// bonuses are expired is left for the next run; errors are joined and the
+// other accounts are still expired. It returns the number of buckets
+// expired.
+func ExpireBonuses(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, now time.Time) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		FilterExpression:       aws.String("attribute_exists(Bonuses)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	var expired int
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return expired, fmt.Errorf("failed to query accounts with bonuses: %v", err)
+		}
+		var accounts []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &accounts); err != nil {
+			return expired, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for i := range accounts {
+			n, err := expireAccountBonuses(ctx, dbSvc, cfg, &accounts[i], now.Unix())
+			expired += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return expired, errors.Join(errs...)
+}
+
+func expireAccountBonuses(ctx context.Context, dbSvc DynamoDBAPI, cfg *TenantConfig, account *User, at int64) (int, error) {
+	var kept []BonusBucket
+	var amount float64
+	var n int
+	for _, b := range account.Bonuses {
+		if b.expired(at) {
+			amount += b.Amount
+			n++
+		} else {
+			kept = append(kept, b)
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if cfg.BonusFundingAccount == "" {
+		return 0, fmt.Errorf("tenant %s has no bonus funding account to return expired bonuses of %s to", cfg.TenantID, account.AccountID)
+	}
+	amount = roundAmount(amount)
+	legs := []JournalLeg{
+		{AccountID: account.AccountID, Type: LegBonusExpiry, Amount: amount},
+		{AccountID: cfg.BonusFundingAccount, Type: LegCredit, Amount: amount},
+	}
+	journalId := newID(dbSvc)
+	accounts := map[string]*User{account.AccountID: account}
+	if err := postJournal(ctx, dbSvc, cfg.TenantID, journalId, AuditSystemActor, account, legs, kept, accounts, clockOf(dbSvc).Now().Unix()); err != nil {
+		return 0, fmt.Errorf("failed to expire bonuses of %s: %v", account.AccountID, err)
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "bonuses expired", "tenant", cfg.TenantID, "account", account.AccountID, "amount", amount, "buckets", n)
+	return n, nil
+}
@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpendBonuses(t *testing.T) {
+	buckets := []BonusBucket{
+		{ID: "late", Amount: 10, ExpiresAt: 300},
+		{ID: "expired", Amount: 5, ExpiresAt: 100},
+		{ID: "soon", Amount: 4, ExpiresAt: 200},
+	}
+	tests := []struct {
+		name   string
+		amount float64
+		spent  float64
+		left   []BonusBucket
+	}{
+		{"soonest first", 3, 3, []BonusBucket{{ID: "expired", Amount: 5, ExpiresAt: 100}, {ID: "soon", Amount: 1, ExpiresAt: 200}, {ID: "late", Amount: 10, ExpiresAt: 300}}},
+		{"spans buckets", 6.5, 6.5, []BonusBucket{{ID: "expired", Amount: 5, ExpiresAt: 100}, {ID: "late", Amount: 7.5, ExpiresAt: 300}}},
+		{"more than the bonuses", 20, 14, []BonusBucket{{ID: "expired", Amount: 5, ExpiresAt: 100}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spent, left := spendBonuses(buckets, tt.amount, 150, "SDG")
+			if spent != tt.spent || !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("spendBonuses() = %v, %+v, want %v, %+v", spent, left, tt.spent, tt.left)
+			}
+		})
+	}
+	if buckets[0].Amount != 10 {
+		t.Errorf("spendBonuses() changed its input")
+	}
+}
+
+func TestBonusLegs(t *testing.T) {
+	legs := func() []JournalLeg {
+		return []JournalLeg{
+			{AccountID: "alice", Type: LegDebit, Amount: 102},
+			{AccountID: "bob", Type: LegCredit, Amount: 100},
+			{AccountID: "fees", Type: LegFee, Amount: 2},
+		}
+	}
+	want := []JournalLeg{
+		{AccountID: "alice", Type: LegBonusDebit, Amount: 40},
+		{AccountID: "alice", Type: LegDebit, Amount: 62},
+		{AccountID: "bob", Type: LegCredit, Amount: 100},
+		{AccountID: "fees", Type: LegFee, Amount: 2},
+	}
+	if got := bonusLegs(legs(), 40, "SDG"); !reflect.DeepEqual(got, want) {
+		t.Errorf("bonusLegs() = %v, want %v", got, want)
+	}
+	want = append(want[:1], want[2:]...)
+	want[0].Amount = 102
+	if got := bonusLegs(legs(), 102, "SDG"); !reflect.DeepEqual(got, want) {
+		t.Errorf("bonusLegs() paid in full = %v, want %v", got, want)
+	}
+}
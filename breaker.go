@@ -0,0 +1,200 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrProviderUnavailable matches the *ProviderUnavailableError returned for
+// calls refused by an open circuit breaker.
+var ErrProviderUnavailable = errors.New("provider_unavailable")
+
+// ProviderUnavailableError is returned instead of calling a provider whose
+// circuit breaker is open, so callers fail fast rather than wait on a
+// degraded provider.
+type ProviderUnavailableError struct {
+	Provider string
+	// RetryAfter is when the breaker lets a probe call through.
+	RetryAfter time.Duration
+}
+
+func (e *ProviderUnavailableError) Error() string {
+	return fmt.Sprintf("provider_unavailable: %s is unavailable, retry in %s", e.Provider, e.RetryAfter.Round(time.Second))
+}
+
+// Code is the error code reported to API clients.
+func (e *ProviderUnavailableError) Code() string {
+	return "provider_unavailable"
+}
+
+func (e *ProviderUnavailableError) Is(target error) bool {
+	return target == ErrProviderUnavailable
+}
+
+// Breaker states reported in ProviderHealth.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerConfig tunes the circuit breaker of a provider.
+type BreakerConfig struct {
+	// FailureThreshold is how many consecutive failures open the breaker.
+	FailureThreshold int
+	// OpenFor is how long an open breaker refuses calls before letting a
+	// single probe through.
+	OpenFor time.Duration
+}
+
+// DefaultBreaker applies to providers without their own config.
+var DefaultBreaker = BreakerConfig{FailureThreshold: 5, OpenFor: 30 * time.Second}
+
+// MaxQueuedCalls bounds the calls CallOrQueue holds for retry.
+const MaxQueuedCalls = 1000
+
+type breaker struct {
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type queuedCall struct {
+	provider string
+	fn       func(ctx context.Context, provider string) error
+}
+
+// SetBreaker sets the circuit breaker config of a provider.
+func (p *Providers) SetBreaker(provider string, cfg BreakerConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breakerConfigs[provider] = cfg
+}
+
+func (p *Providers) breakerConfig(provider string) BreakerConfig {
+	if cfg, ok := p.breakerConfigs[provider]; ok {
+		return cfg
+	}
+	return DefaultBreaker
+}
+
+func (p *Providers) breaker(provider string) *breaker {
+	b, ok := p.breakers[provider]
+	if !ok {
+		b = &breaker{state: BreakerClosed}
+		p.breakers[provider] = b
+	}
+	return b
+}
+
+// allow reports whether a call to provider may go ahead. An open breaker
+// past its OpenFor turns half-open and lets one probe through at a time.
+func (p *Providers) allow(provider string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.breaker(provider)
+	now := p.now()
+	switch {
+	case b.state == BreakerClosed:
+		return nil
+	case b.state == BreakerOpen && now.Before(b.openUntil):
+		return &ProviderUnavailableError{Provider: provider, RetryAfter: b.openUntil.Sub(now)}
+	case b.probing:
+		return &ProviderUnavailableError{Provider: provider, RetryAfter: p.breakerConfig(provider).OpenFor}
+	default:
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	}
+}
+
+// trip updates the breaker of provider with the outcome of a call.
+func (p *Providers) trip(provider string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.breaker(provider)
+	cfg := p.breakerConfig(provider)
+	b.probing = false
+	if err == nil {
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= cfg.FailureThreshold {
+		b.state = BreakerOpen
+		b.openUntil = p.now().Add(cfg.OpenFor)
+	}
+}
+
+// CallOrQueue is Call for calls that are safe to repeat later, such as
+// notifications. When every provider that could serve the call is
+// unavailable, the call is queued for RetryQueued and CallOrQueue returns
+// nil. Other failures are returned as by Call.
+func (p *Providers) CallOrQueue(ctx context.Context, provider string, fn func(ctx context.Context, provider string) error) error {
+	err := p.Call(ctx, provider, fn)
+	if !onlyUnavailable(err) {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) >= MaxQueuedCalls {
+		return err
+	}
+	p.queue = append(p.queue, queuedCall{provider: provider, fn: fn})
+	return nil
+}
+
+// onlyUnavailable reports whether err is a provider unavailable error, or
+// joins nothing but them.
+func onlyUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if !onlyUnavailable(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, ErrProviderUnavailable)
+}
+
+// Queued returns how many calls are waiting for RetryQueued.
+func (p *Providers) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// RetryQueued runs the queued calls, e.g. from a periodic job. Calls whose
+// provider is still unavailable stay queued; calls that fail otherwise are
+// dropped and their errors returned.
+func (p *Providers) RetryQueued(ctx context.Context) error {
+	p.mu.Lock()
+	queue := p.queue
+	p.queue = nil
+	p.mu.Unlock()
+
+	var errs []error
+	for i, call := range queue {
+		if ctx.Err() != nil {
+			p.requeue(queue[i:]...)
+			break
+		}
+		if err := p.CallOrQueue(ctx, call.provider, call.fn); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Providers) requeue(calls ...queuedCall) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, calls...)
+}
@@ -0,0 +1,103 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProvidersCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := NewProviders(time.Minute)
+	p.now = clock.now
+	p.SetBreaker("biller", BreakerConfig{FailureThreshold: 3, OpenFor: 10 * time.Second})
+
+	down := true
+	calls := 0
+	call := func() error {
+		return p.Call(ctx, "biller", func(ctx context.Context, provider string) error {
+			calls++
+			return errIf(down)
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := call(); err == nil || errors.Is(err, ErrProviderUnavailable) {
+			t.Fatalf("call %d error = %v, want the provider's error", i, err)
+		}
+	}
+	err := call()
+	var unavailable *ProviderUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Provider != "biller" || unavailable.Code() != "provider_unavailable" {
+		t.Fatalf("open breaker error = %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("provider called %d times, want 3", calls)
+	}
+	if h := p.Health("biller"); h.Breaker != BreakerOpen || h.Healthy {
+		t.Errorf("Health() = %+v, want open and unhealthy", h)
+	}
+
+	// A failed probe opens the breaker again.
+	clock.t = clock.t.Add(11 * time.Second)
+	if err := call(); err == nil || errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("probe error = %v, want the provider's error", err)
+	}
+	if err := call(); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("after failed probe error = %v", err)
+	}
+
+	// A successful probe closes it.
+	clock.t = clock.t.Add(11 * time.Second)
+	down = false
+	if err := call(); err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+	if h := p.Health("biller"); h.Breaker != BreakerClosed {
+		t.Errorf("Breaker = %s after a successful probe", h.Breaker)
+	}
+}
+
+func TestProvidersCallOrQueue(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := NewProviders(time.Minute)
+	p.now = clock.now
+	p.SetBreaker("sms", BreakerConfig{FailureThreshold: 1, OpenFor: time.Minute})
+
+	down := true
+	var sent []string
+	notifier := p.Notifier("sms", map[string]Notifier{
+		"sms": func(ctx context.Context, tenantId, accountId, message string) error {
+			if down {
+				return errors.New("gateway timeout")
+			}
+			sent = append(sent, message)
+			return nil
+		},
+	})
+
+	if err := notifier(ctx, "nil", "alice", "first"); err == nil {
+		t.Error("failing call was not reported")
+	}
+	if err := notifier(ctx, "nil", "alice", "second"); err != nil {
+		t.Errorf("call to open breaker error = %v, want it queued", err)
+	}
+	if p.Queued() != 1 {
+		t.Fatalf("Queued() = %d, want 1", p.Queued())
+	}
+
+	if err := p.RetryQueued(ctx); err != nil || p.Queued() != 1 {
+		t.Errorf("retry while open: error = %v, queued %d", err, p.Queued())
+	}
+	clock.t = clock.t.Add(2 * time.Minute)
+	down = false
+	if err := p.RetryQueued(ctx); err != nil || p.Queued() != 0 {
+		t.Errorf("retry after recovery: error = %v, queued %d", err, p.Queued())
+	}
+	if len(sent) != 1 || sent[0] != "second" {
+		t.Errorf("sent = %v, want the queued message", sent)
+	}
+}
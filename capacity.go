@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// WithCapacityMetrics makes every DynamoDB call request its consumed
+// capacity and records it through Metrics, as MetricDynamoDBReadCapacity or
+// MetricDynamoDBWriteCapacity, by DynamoDB call, table, ledger operation
+// and tenant. See WithOperation for how calls are attributed.
+func WithCapacityMetrics() Option {
+	return func(l *Ledger) {
+		l.capacityMetrics = true
+	}
+}
+
+type operationKey struct{}
+
+// operation is the ledger operation DynamoDB calls are made for.
+type operation struct {
+	name, tenant string
+}
+
+// WithOperation returns a context whose DynamoDB calls are attributed to a
+// ledger operation and tenant in the capacity metrics, e.g. the route of a
+// request. TransferCredits, InquireBalance, InquireBalances and
+// GetTransactions attribute their calls themselves.
+func WithOperation(ctx context.Context, name, tenantId string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation{name: name, tenant: tenantId})
+}
+
+// operationFrom returns the operation set by WithOperation.
+func operationFrom(ctx context.Context) (operation, bool) {
+	op, ok := ctx.Value(operationKey{}).(operation)
+	return op, ok
+}
+
+// readOps are the DynamoDB calls consuming read capacity; the others
+// consume write capacity.
+var readOps = map[string]bool{"GetItem": true, "Query": true, "Scan": true, "BatchGetItem": true}
+
+// recordCapacity records the capacity consumed by a DynamoDB call, by the
+// table it was consumed on.
+func (l *Ledger) recordCapacity(ctx context.Context, op string, capacity []types.ConsumedCapacity) {
+	if !l.capacityMetrics {
+		return
+	}
+	name := MetricDynamoDBWriteCapacity
+	if readOps[op] {
+		name = MetricDynamoDBReadCapacity
+	}
+	o, attributed := operationFrom(ctx)
+	for _, c := range capacity {
+		if c.CapacityUnits == nil {
+			continue
+		}
+		attrs := []Attribute{Attr("op", op), Attr("table", strings.TrimPrefix(aws.ToString(c.TableName), l.tablePrefix))}
+		if attributed {
+			attrs = append(attrs, Attr("operation", o.name), Attr("tenant", o.tenant))
+		}
+		l.metrics.AddCounter(ctx, name, *c.CapacityUnits, attrs...)
+	}
+}
+
+// appendCapacity appends the capacity consumed by a call on one table, if
+// it was returned.
+func appendCapacity(capacity []types.ConsumedCapacity, c *types.ConsumedCapacity) []types.ConsumedCapacity {
+	if c == nil {
+		return capacity
+	}
+	return append(capacity, *c)
+}
@@ -0,0 +1,240 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Channels money is deposited or withdrawn through.
+const (
+	ChannelBank  = "bank"
+	ChannelAgent = "agent"
+)
+
+// Metadata keys under which deposits and withdrawals store their channel.
+const (
+	MetadataChannel       = "channel"
+	MetadataBankReference = "bank_ref"
+	MetadataAgentID       = "agent_id"
+)
+
+// CashRequest is a deposit into or a withdrawal from an account, made
+// against the tenant's TreasuryAccount.
+type CashRequest struct {
+	TenantID  string  `json:"tenant_id,omitempty"`
+	AccountID string  `json:"account_id"`
+	Amount    float64 `json:"amount"`
+	// Channel is how the money came in or goes out. Bank deposits and
+	// withdrawals need the bank's BankReference, agent ones the AgentID of
+	// the agent handling the cash.
+	Channel       string `json:"channel"`
+	BankReference string `json:"bank_ref,omitempty"`
+	AgentID       string `json:"agent_id,omitempty"`
+	InitiatorUUID string `json:"uuid,omitempty"`
+	// Narrative and Metadata are stored on the transaction as for transfers.
+	Narrative string            `json:"narrative,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// metadata returns the request's metadata with its channel added.
+func (req CashRequest) metadata() map[string]string {
+	metadata := map[string]string{}
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetadataChannel] = req.Channel
+	if req.BankReference != "" {
+		metadata[MetadataBankReference] = req.BankReference
+	}
+	if req.AgentID != "" {
+		metadata[MetadataAgentID] = req.AgentID
+	}
+	return metadata
+}
+
+func (req CashRequest) validate() error {
+	err := validation.Collect(
+		validation.TenantID("tenant_id", req.TenantID),
+		validation.AccountID("account_id", req.AccountID),
+		validation.AmountPrecision("amount", req.Amount, maxPrecision()),
+	)
+	switch {
+	case err != nil:
+		return err
+	case req.Channel == "":
+		return errors.New("you must provide the channel")
+	case req.Channel == ChannelBank && req.BankReference == "":
+		return errors.New("bank deposits and withdrawals need the bank reference")
+	case req.Channel == ChannelAgent && req.AgentID == "":
+		return errors.New("agent deposits and withdrawals need the agent ID")
+	}
+	return nil
+}
+
+// DepositCredits credits an account with money received outside the
+// ledger, debiting the tenant's TreasuryAccount: the treasury goes below
+// zero by the money the tenant holds for its customers. The account gets a
+// "deposit" ledger entry and the transaction records the channel in its
+// Metadata.
+func DepositCredits(ctx context.Context, dbSvc DynamoDBAPI, req CashRequest) (*TransactionEntry, error) {
+	return moveCash(ctx, dbSvc, req, LegDeposit)
+}
+
+// WithdrawCredits debits an account with money paid out outside the ledger,
+// crediting the tenant's TreasuryAccount. Only the account's balance can be
+// withdrawn, down to the floor transfers keep; bonuses never are. The
+// account gets a "withdrawal" ledger entry.
+func WithdrawCredits(ctx context.Context, dbSvc DynamoDBAPI, req CashRequest) (*TransactionEntry, error) {
+	return moveCash(ctx, dbSvc, req, LegWithdrawal)
+}
+
+// moveCash posts a deposit or withdrawal, and audits it.
+func moveCash(ctx context.Context, dbSvc DynamoDBAPI, req CashRequest, legType string) (*TransactionEntry, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	operation := AuditDepositCredits
+	if legType == LegWithdrawal {
+		operation = AuditWithdrawCredits
+	}
+	var before map[string]float64
+	if auditing(dbSvc) {
+		before = auditBalances(ctx, dbSvc, req.TenantID, req.AccountID)
+	}
+	tx, err := postCash(ctx, dbSvc, req, legType)
+	if auditing(dbSvc) {
+		after := map[string]any{"balances": auditBalances(ctx, dbSvc, req.TenantID, req.AccountID)}
+		if tx != nil {
+			after["transaction_id"] = tx.SystemTransactionID
+		}
+		recordAudit(ctx, dbSvc, operation, req.TenantID, req.AccountID, req, map[string]any{"balances": before}, after, err)
+	}
+	args := []any{"tenant", req.TenantID, "account", req.AccountID, "amount", req.Amount, "channel", req.Channel}
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, legType+" failed", append(args, "error", err)...)
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, legType+" posted", append(args, "txid", tx.SystemTransactionID)...)
+	return tx, nil
+}
+
+func postCash(ctx context.Context, dbSvc DynamoDBAPI, req CashRequest, legType string) (*TransactionEntry, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	narrative, err := SanitizeNarrative(req.Narrative)
+	if err != nil {
+		return nil, err
+	}
+	metadata := req.metadata()
+	if err := validateMetadata(metadata, nil); err != nil {
+		return nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.TreasuryAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no treasury account", req.TenantID)
+	}
+	if cfg.TreasuryAccount == req.AccountID {
+		return nil, errors.New("the treasury account cannot deposit or withdraw")
+	}
+	account, err := readAccount(ctx, dbSvc, req.TenantID, req.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", req.AccountID, err)
+	}
+
+	now := clockOf(dbSvc).Now()
+	timestamp := now.Unix()
+	uid := newID(dbSvc)
+	transfer := TransferRequest{
+		TenantID:      req.TenantID,
+		FromAccount:   cfg.TreasuryAccount,
+		ToAccount:     req.AccountID,
+		Amount:        req.Amount,
+		InitiatorUUID: req.InitiatorUUID,
+		Narrative:     narrative,
+		Metadata:      metadata,
+	}
+	comment := NarrativeDeposit
+	// The account is the journal's sender either way. The busy treasury is
+	// guarded by its version too, and the journal is posted again when it
+	// moved.
+	legs := []JournalLeg{
+		{AccountID: req.AccountID, Type: LegDeposit, Amount: req.Amount},
+		{AccountID: cfg.TreasuryAccount, Type: LegDebit, Amount: req.Amount},
+	}
+	if legType == LegWithdrawal {
+		transfer.FromAccount, transfer.ToAccount = req.AccountID, cfg.TreasuryAccount
+		comment = NarrativeWithdrawal
+		legs = []JournalLeg{
+			{AccountID: req.AccountID, Type: LegWithdrawal, Amount: req.Amount},
+			{AccountID: cfg.TreasuryAccount, Type: LegCredit, Amount: req.Amount},
+		}
+	}
+	transaction := newTransactionRecord(transfer, comment, uid, timestamp)
+	transaction.AccountID = req.AccountID
+	transaction.Currency = cfg.accountCurrency(account)
+	if err := checkPrecision(req.Amount, transaction.Currency); err != nil {
+		recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+		return nil, err
+	}
+
+	if legType == LegWithdrawal {
+		if err := checkDormant(account); err != nil {
+			recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+			return nil, err
+		}
+		if err := enforceKYCDebit(ctx, dbSvc, cfg, req.TenantID, account, req.Amount, now); err != nil {
+			recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+			return nil, err
+		}
+		remaining := RoundAmount(account.Amount-req.Amount, transaction.Currency)
+		if remaining < cfg.balanceFloor(account) {
+			recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+			return nil, errors.New("insufficient balance")
+		}
+		if err := floatLimitError(account, remaining, nil, 0); err != nil {
+			recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+			return nil, err
+		}
+		legs[0].Overdraft = remaining < 0
+	} else {
+		err := cfg.kycCreditError(account, req.Amount, true)
+		if err == nil {
+			err = floatLimitError(nil, 0, account, req.Amount)
+		}
+		if err != nil {
+			recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+			return nil, err
+		}
+	}
+	transaction.JournalID = uid
+	transaction.Legs = legs
+	transaction.Status = TransactionCompleted
+	av, err := attributevalue.MarshalMap(transaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	accounts := map[string]*User{req.AccountID: account}
+	err = postJournal(ctx, dbSvc, req.TenantID, uid, req.InitiatorUUID, account, legs, nil, accounts, timestamp, types.TransactWriteItem{Put: &types.Put{
+		TableName: aws.String(TransactionsTable),
+		Item:      av,
+	}})
+	if err != nil {
+		recordTransaction(ctx, dbSvc, transaction, TransactionFailed)
+		return nil, fmt.Errorf("failed to post %s of %s: %v", legType, req.AccountID, err)
+	}
+	entry := transaction.Entry()
+	return &entry, nil
+}
@@ -0,0 +1,123 @@
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Spending categories a transfer may be filed under in
+// TransferRequest.Category, for spending analysis.
+const (
+	CategoryGroceries     = "groceries"
+	CategoryDining        = "dining"
+	CategoryTransport     = "transport"
+	CategoryFuel          = "fuel"
+	CategoryUtilities     = "utilities"
+	CategoryTelecom       = "telecom"
+	CategoryShopping      = "shopping"
+	CategoryEntertainment = "entertainment"
+	CategoryHealth        = "health"
+	CategoryEducation     = "education"
+	CategoryTravel        = "travel"
+	CategoryCash          = "cash"
+	CategoryTransfers     = "transfers"
+	CategoryOther         = "other"
+)
+
+var categories = map[string]bool{
+	CategoryGroceries:     true,
+	CategoryDining:        true,
+	CategoryTransport:     true,
+	CategoryFuel:          true,
+	CategoryUtilities:     true,
+	CategoryTelecom:       true,
+	CategoryShopping:      true,
+	CategoryEntertainment: true,
+	CategoryHealth:        true,
+	CategoryEducation:     true,
+	CategoryTravel:        true,
+	CategoryCash:          true,
+	CategoryTransfers:     true,
+	CategoryOther:         true,
+}
+
+// Categories returns the valid spending categories, sorted.
+func Categories() []string {
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCategory checks that category is one of Categories. An empty
+// category is valid: categorizing a transfer is optional.
+func ValidateCategory(category string) error {
+	if category == "" || categories[category] {
+		return nil
+	}
+	return fmt.Errorf("unknown category %q; use one of %s", category, strings.Join(Categories(), ", "))
+}
+
+// ValidateMCC checks that mcc is an ISO 18245 merchant category code, four
+// digits. An empty code is valid.
+func ValidateMCC(mcc string) error {
+	if mcc == "" {
+		return nil
+	}
+	if len(mcc) != 4 || strings.Trim(mcc, "0123456789") != "" {
+		return fmt.Errorf("merchant category code %q must be four digits", mcc)
+	}
+	return nil
+}
+
+// mccCategories map ranges of merchant category codes, inclusive, to the
+// category of their purchases. The first range holding a code wins, so
+// narrower ranges come before the wider ones they overlap.
+var mccCategories = []struct {
+	from, to int
+	category string
+}{
+	{3000, 3999, CategoryTravel},
+	{4011, 4131, CategoryTransport},
+	{4411, 4411, CategoryTravel},
+	{4511, 4582, CategoryTravel},
+	{4722, 4723, CategoryTravel},
+	{4784, 4789, CategoryTransport},
+	{4812, 4816, CategoryTelecom},
+	{4821, 4821, CategoryTelecom},
+	{4899, 4899, CategoryTelecom},
+	{4900, 4900, CategoryUtilities},
+	{5200, 5399, CategoryShopping},
+	{5411, 5411, CategoryGroceries},
+	{5422, 5499, CategoryGroceries},
+	{5541, 5542, CategoryFuel},
+	{5811, 5814, CategoryDining},
+	{5551, 5999, CategoryShopping},
+	{6010, 6011, CategoryCash},
+	{7011, 7012, CategoryTravel},
+	{7512, 7523, CategoryTransport},
+	{7832, 7841, CategoryEntertainment},
+	{7911, 7999, CategoryEntertainment},
+	{8011, 8099, CategoryHealth},
+	{8211, 8299, CategoryEducation},
+}
+
+// CategoryOfMCC returns the category of purchases with a merchant category
+// code, CategoryOther for codes outside the known ranges. A transfer with
+// an MCC and no category is filed under it.
+func CategoryOfMCC(mcc string) string {
+	code, err := strconv.Atoi(mcc)
+	if err != nil {
+		return CategoryOther
+	}
+	for _, r := range mccCategories {
+		if code >= r.from && code <= r.to {
+			return r.category
+		}
+	}
+	return CategoryOther
+}
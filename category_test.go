@@ -0,0 +1,33 @@
+package ledger
+
+import "testing"
+
+func TestCategoryOfMCC(t *testing.T) {
+	tests := []struct {
+		mcc  string
+		want string
+	}{
+		{"5411", CategoryGroceries},
+		{"5812", CategoryDining},
+		{"5651", CategoryShopping},
+		{"5541", CategoryFuel},
+		{"3058", CategoryTravel},
+		{"6011", CategoryCash},
+		{"8062", CategoryHealth},
+		{"0742", CategoryOther},
+		{"", CategoryOther},
+	}
+	for _, tt := range tests {
+		if got := CategoryOfMCC(tt.mcc); got != tt.want {
+			t.Errorf("CategoryOfMCC(%q) = %s, want %s", tt.mcc, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMCC(t *testing.T) {
+	for mcc, valid := range map[string]bool{"": true, "5411": true, "0742": true, "541": false, "54111": false, "54a1": false, "-541": false} {
+		if err := ValidateMCC(mcc); (err == nil) != valid {
+			t.Errorf("ValidateMCC(%q) = %v, want valid %v", mcc, err, valid)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrApprovalRequired is returned for an amount above the tenant's
+// ApprovalThreshold by the entry points that cannot wait for approval, such
+// as EscrowTransfer; transfers and split transfers wait for it instead.
+var ErrApprovalRequired = errors.New("approval_required")
+
+// ErrTransferDelayed is returned for an amount above the tenant's
+// LargeTransferThreshold by the entry points that cannot be held for
+// release, such as EscrowTransfer; transfers and split transfers are held
+// instead.
+var ErrTransferDelayed = errors.New("transfer_delayed")
+
+// credit is what an account is credited by a movement of money.
+type credit struct {
+	account *User
+	amount  float64
+}
+
+// transferCheck is a movement of money out of a customer's account, to be
+// checked by checkTransfer.
+type transferCheck struct {
+	// req is the movement as one transfer of its total. The receiver of a
+	// split is SplitToAccount, and that of a movement into a holding
+	// account, such as an escrow's, the holding account.
+	req    TransferRequest
+	sender *User
+	// splits are the transfers a split is made of, screened one by one
+	// instead of req.
+	splits []TransferRequest
+	// credits are the customer accounts credited, held to the balance limit
+	// of their KYC tier.
+	credits []credit
+	now     time.Time
+	opts    transferOptions
+}
+
+// checkError is a movement refused by checkTransfer, with the code and
+// message of the refusal.
+type checkError struct {
+	code    string
+	message string
+	err     error
+	// rejection is the screening's rejection of a blocked movement.
+	rejection *ScreeningRejection
+}
+
+func (e *checkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *checkError) Unwrap() error {
+	return e.err
+}
+
+// checkTransfer runs the controls every movement of money out of a
+// customer's account passes before it is posted, whatever its entry point:
+// screening, the KYC tier limits of the sender and of the accounts
+// credited, the sender's spending limits and velocity rules, and last the
+// approval threshold and the large transfer delay, which fail with
+// ErrApprovalRequired and ErrTransferDelayed for the caller to wait for
+// them or refuse the movement. Moves between the wallets of one customer
+// skip them all.
+func (cfg *TenantConfig) checkTransfer(ctx context.Context, dbSvc DynamoDBAPI, c transferCheck) error {
+	if c.opts.betweenWallets {
+		return nil
+	}
+	screened := c.splits
+	if len(screened) == 0 {
+		screened = []TransferRequest{c.req}
+	}
+	for _, part := range screened {
+		rejection, err := screenTransfer(ctx, dbSvc, part)
+		if err != nil {
+			return &checkError{code: "screening_error", message: "The transfer could not be screened.", err: err}
+		}
+		if rejection != nil {
+			err := fmt.Errorf("%w: %s", ErrTransferBlocked, rejection.ReasonCode)
+			if len(c.splits) > 0 {
+				err = fmt.Errorf("%w: %s to %s", ErrTransferBlocked, rejection.ReasonCode, part.ToAccount)
+			}
+			return &checkError{code: ErrTransferBlocked.Error(), message: "The transfer was blocked.", err: err, rejection: rejection}
+		}
+	}
+
+	err := enforceKYCDebit(ctx, dbSvc, cfg, c.req.TenantID, c.sender, c.req.Amount, c.now)
+	for _, credit := range c.credits {
+		if err == nil {
+			err = cfg.kycCreditError(credit.account, credit.amount, false)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrKYCLimitExceeded):
+		return &checkError{code: ErrKYCLimitExceeded.Error(), message: "The transfer exceeds the limits of the account's KYC tier.", err: err}
+	case err != nil:
+		return &checkError{code: "limit_check_error", message: "The transfer could not be checked against the KYC tier limits.", err: err}
+	}
+	if err := enforceSpendingLimits(ctx, dbSvc, cfg, c.req); err != nil {
+		return &checkError{code: "limit_exceeded", message: "The transfer exceeds the limits set on this account.", err: err}
+	}
+	if err := enforceVelocityRules(ctx, dbSvc, cfg, c.req, c.now); err != nil {
+		if errors.Is(err, ErrRateLimited) {
+			return &checkError{code: ErrRateLimited.Error(), message: "Too many transfers, please retry later.", err: err}
+		}
+		return &checkError{code: "velocity_check_error", message: "The transfer could not be checked against the velocity rules.", err: err}
+	}
+
+	if c.opts.skipDelay || c.opts.approved {
+		return nil
+	}
+	if cfg.needsApproval(c.req.Amount) {
+		return &checkError{code: ErrApprovalRequired.Error(), message: "The transfer needs approval.",
+			err: fmt.Errorf("%w: %s is over the approval threshold of %s", ErrApprovalRequired, formatAmount(c.req.Amount), formatAmount(cfg.ApprovalThreshold))}
+	}
+	if cfg.holdsTransfer(c.req.Amount) {
+		return &checkError{code: ErrTransferDelayed.Error(), message: "The transfer must be held for release.",
+			err: fmt.Errorf("%w: %s is over the large transfer threshold of %s", ErrTransferDelayed, formatAmount(c.req.Amount), formatAmount(cfg.LargeTransferThreshold))}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PendingClaimsTable holds the transfers sent to phone numbers without an
+// account, keyed by TenantID and ClaimID.
+var PendingClaimsTable = "PendingClaims"
+
+// DefaultClaimTTL is how long a transfer to an unregistered recipient can be
+// claimed when the tenant sets no ClaimTTL.
+var DefaultClaimTTL = 7 * 24 * time.Hour
+
+// ErrRecipientRegistered is returned by SendToUnregistered for a phone
+// number that already has an account, which is to be paid directly.
+var ErrRecipientRegistered = errors.New("recipient_registered")
+
+const (
+	ClaimPending  = "pending"
+	ClaimClaimed  = "claimed"
+	ClaimRefunded = "refunded"
+)
+
+// PendingClaim is money sent to a phone number without an account. The
+// sender's funds are held in the tenant's PendingClaimsAccount until the
+// recipient registers and claims them, or they are refunded on expiry. The
+// phone number is only stored as its lookup value and masked.
+type PendingClaim struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id"`
+	// ClaimID is the journal that funded the claim.
+	ClaimID     string  `dynamodbav:"ClaimID" json:"claim_id"`
+	FromAccount string  `dynamodbav:"FromAccount" json:"from_account"`
+	Amount      float64 `dynamodbav:"Amount" json:"amount"`
+	PhoneLookup string  `dynamodbav:"PhoneLookup" json:"-"`
+	// PhoneNumber keeps the last three digits of the recipient's number.
+	PhoneNumber string `dynamodbav:"PhoneNumber" json:"phone_number"`
+	Status      string `dynamodbav:"Status" json:"status"`
+	ExpiresAt   int64  `dynamodbav:"ExpiresAt" json:"expires_at"`
+	// PaidTo is the account the held funds went to: the recipient's once
+	// claimed, the sender's on a refund.
+	PaidTo    string `dynamodbav:"PaidTo,omitempty" json:"paid_to,omitempty"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt int64  `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+func (c *TenantConfig) claimTTL() time.Duration {
+	if c.ClaimTTL <= 0 {
+		return DefaultClaimTTL
+	}
+	return time.Duration(c.ClaimTTL) * time.Second
+}
+
+// SendToUnregistered sends amount to a phone number without an account: the
+// sender is debited into the tenant's PendingClaimsAccount, and the
+// recipient can ClaimTransfer the money once registered with that number.
+// A number that already has an account fails with ErrRecipientRegistered.
+//
+// The send passes the controls of a transfer to the pending claims account.
+// It cannot wait for approval or be held, so an amount over the tenant's
+// ApprovalThreshold or LargeTransferThreshold fails with ErrApprovalRequired
+// or ErrTransferDelayed.
+func SendToUnregistered(ctx context.Context, dbSvc DynamoDBAPI, tenantId, fromAccount, phoneNumber string, amount float64) (*PendingClaim, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	phoneNumber = strings.TrimSpace(phoneNumber)
+	if phoneNumber == "" {
+		return nil, errors.New("a phone number is required")
+	}
+	err := validation.Collect(
+		validation.TenantID("tenant_id", tenantId),
+		validation.AccountID("from_account", fromAccount),
+		validation.AmountPrecision("amount", amount, maxPrecision()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.PendingClaimsAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no pending claims account", tenantId)
+	}
+	matches, err := FindAccount(ctx, dbSvc, tenantId, AccountQuery{MobileNumber: phoneNumber})
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) > 0 {
+		return nil, fmt.Errorf("%w: %s has account %s", ErrRecipientRegistered, maskNumber(phoneNumber), matches[0].AccountID)
+	}
+	lookup, err := lookupValue(ctx, dbSvc, tenantId, "mobile_number", phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := readAccount(ctx, dbSvc, tenantId, fromAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", fromAccount, err)
+	}
+	if err := checkDormant(sender); err != nil {
+		return nil, err
+	}
+	currency := cfg.accountCurrency(sender)
+	if err := checkPrecision(amount, currency); err != nil {
+		return nil, err
+	}
+	remaining := RoundAmount(sender.Amount-amount, currency)
+	if remaining < cfg.balanceFloor(sender) {
+		return nil, errors.New("insufficient balance")
+	}
+
+	now := clockOf(dbSvc).Now().UTC()
+	err = cfg.checkTransfer(ctx, dbSvc, transferCheck{
+		req:    TransferRequest{TenantID: tenantId, FromAccount: fromAccount, ToAccount: cfg.PendingClaimsAccount, Amount: amount},
+		sender: sender,
+		now:    now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	timestamp := now.Unix()
+	claim := &PendingClaim{
+		TenantID:    tenantId,
+		ClaimID:     newID(dbSvc),
+		FromAccount: fromAccount,
+		Amount:      amount,
+		PhoneLookup: lookup,
+		PhoneNumber: maskNumber(phoneNumber),
+		Status:      ClaimPending,
+		ExpiresAt:   now.Add(cfg.claimTTL()).Unix(),
+		CreatedAt:   timestamp,
+		UpdatedAt:   timestamp,
+	}
+	item, err := attributevalue.MarshalMap(claim)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pending claim: %v", err)
+	}
+	legs := []JournalLeg{
+		{AccountID: fromAccount, Type: LegDebit, Amount: amount, Overdraft: remaining < 0},
+		{AccountID: cfg.PendingClaimsAccount, Type: LegCredit, Amount: amount},
+	}
+	record, err := claimRecord(*claim, claim.ClaimID, NarrativeUnregisteredTransfer, fromAccount, cfg.PendingClaimsAccount, legs, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[string]*User{fromAccount: sender}
+	err = postJournal(ctx, dbSvc, tenantId, claim.ClaimID, "", sender, legs, nil, accounts, timestamp, record, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(PendingClaimsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(ClaimID)"),
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fund pending claim: %v", err)
+	}
+	notify(ctx, dbSvc, tenantId, fromAccount, fmt.Sprintf(
+		"Your transfer of %.2f to %s can be claimed until %s once they register. Reference: %s",
+		amount, claim.PhoneNumber, time.Unix(claim.ExpiresAt, 0).UTC().Format(time.RFC3339), claim.ClaimID))
+	return claim, nil
+}
+
+// claimRecord returns the transaction item recording a movement of a
+// pending claim's funds.
+func claimRecord(claim PendingClaim, journalId, comment, from, to string, legs []JournalLeg, timestamp int64) (types.TransactWriteItem, error) {
+	record := newTransactionRecord(TransferRequest{
+		TenantID:    claim.TenantID,
+		FromAccount: from,
+		ToAccount:   to,
+		Amount:      claim.Amount,
+		Metadata:    map[string]string{"claim_id": claim.ClaimID},
+	}, comment, journalId, timestamp)
+	record.Status = TransactionCompleted
+	record.JournalID = journalId
+	record.Legs = legs
+	if journalId != claim.ClaimID {
+		record.ParentTransactionID = claim.ClaimID
+	}
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: av}}, nil
+}
+
+// GetPendingClaim returns a transfer sent to an unregistered recipient.
+func GetPendingClaim(ctx context.Context, dbSvc DynamoDBAPI, tenantId, claimId string) (*PendingClaim, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(PendingClaimsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"ClaimID":  &types.AttributeValueMemberS{Value: claimId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending claim: %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("pending claim %s not found", claimId)
+	}
+	var claim PendingClaim
+	if err := attributevalue.UnmarshalMap(result.Item, &claim); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending claim: %v", err)
+	}
+	return &claim, nil
+}
+
+// ListClaimsFor returns the pending transfers an account can claim: those
+// sent to its mobile number before it registered.
+func ListClaimsFor(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]PendingClaim, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	lookup, err := accountPhoneLookup(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(PendingClaimsTable),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		FilterExpression:         aws.String("#status = :pending AND PhoneLookup = :lookup AND ExpiresAt > :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant":  &types.AttributeValueMemberS{Value: tenantId},
+			":pending": &types.AttributeValueMemberS{Value: ClaimPending},
+			":lookup":  &types.AttributeValueMemberS{Value: lookup},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+		},
+	}
+	var claims []PendingClaim
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query pending claims: %v", err)
+		}
+		var page []PendingClaim
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pending claims: %v", err)
+		}
+		claims = append(claims, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return claims, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// ClaimTransfer credits a pending claim to the account of its recipient,
+// which must be registered with the phone number it was sent to. A claim is
+// paid at most once, and not after it expired, and fails with
+// ErrKYCLimitExceeded when it would take the account over the balance limit
+// of its KYC tier.
+func ClaimTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, claimId, accountId string) (*PendingClaim, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	claim, err := GetPendingClaim(ctx, dbSvc, tenantId, claimId)
+	if err != nil {
+		return nil, err
+	}
+	now := clockOf(dbSvc).Now()
+	if claim.Status != ClaimPending || now.Unix() >= claim.ExpiresAt {
+		return nil, fmt.Errorf("pending claim %s cannot be claimed", claimId)
+	}
+	lookup, err := accountPhoneLookup(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	if lookup != claim.PhoneLookup {
+		return nil, fmt.Errorf("pending claim %s was not sent to the mobile number of %s", claimId, accountId)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	account, err := readAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", accountId, err)
+	}
+	if err := cfg.kycCreditError(account, claim.Amount, false); err != nil {
+		return nil, err
+	}
+	if err := settleClaim(ctx, dbSvc, cfg, claim, accountId, ClaimClaimed, now); err != nil {
+		return nil, err
+	}
+	notify(ctx, dbSvc, tenantId, claim.FromAccount, fmt.Sprintf("Your transfer %s of %.2f to %s has been claimed.", claim.ClaimID, claim.Amount, claim.PhoneNumber))
+	return claim, nil
+}
+
+// ExpireClaims refunds the pending claims of a tenant not claimed by now. It
+// is meant to be run periodically; a refund that fails is left for the next
+// run, and the errors are joined. It returns the number of claims refunded.
+func ExpireClaims(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, now time.Time) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(PendingClaimsTable),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		FilterExpression:         aws.String("#status = :pending AND ExpiresAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant":  &types.AttributeValueMemberS{Value: tenantId},
+			":pending": &types.AttributeValueMemberS{Value: ClaimPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	var refunded int
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return refunded, fmt.Errorf("failed to query pending claims: %v", err)
+		}
+		var claims []PendingClaim
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &claims); err != nil {
+			return refunded, fmt.Errorf("failed to unmarshal pending claims: %v", err)
+		}
+		for i := range claims {
+			claim := &claims[i]
+			if err := settleClaim(ctx, dbSvc, cfg, claim, claim.FromAccount, ClaimRefunded, now); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			refunded++
+			notify(ctx, dbSvc, tenantId, claim.FromAccount, fmt.Sprintf("Your transfer %s to %s was not claimed and %.2f has been refunded.", claim.ClaimID, claim.PhoneNumber, claim.Amount))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return refunded, errors.Join(errs...)
+}
+
+// accountPhoneLookup returns the lookup value of an account's mobile number.
+func accountPhoneLookup(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (string, error) {
+	account, err := readAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return "", fmt.Errorf("failed to read account %s: %v", accountId, err)
+	}
+	if err := decryptPII(ctx, dbSvc, account); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(account.MobileNumber) == "" {
+		return "", fmt.Errorf("account %s has no mobile number", accountId)
+	}
+	return lookupValue(ctx, dbSvc, tenantId, "mobile_number", account.MobileNumber)
+}
+
+// settleClaim moves a pending claim's held funds to an account and sets its
+// status, in one transaction guarded by the claim still being pending:
+// unexpired at the given time to be claimed, expired to be refunded.
+func settleClaim(ctx context.Context, dbSvc DynamoDBAPI, cfg *TenantConfig, claim *PendingClaim, to, status string, at time.Time) error {
+	if cfg.PendingClaimsAccount == "" {
+		return fmt.Errorf("tenant %s has no pending claims account", cfg.TenantID)
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	comment := NarrativeClaimRefund
+	condition := "#status = :pending AND ExpiresAt <= :at"
+	if status == ClaimClaimed {
+		comment = NarrativeClaimedTransfer
+		condition = "#status = :pending AND ExpiresAt > :at"
+	}
+	_, err := settleHeld(ctx, dbSvc, claim.TenantID, cfg.PendingClaimsAccount, to, claim.Amount, timestamp, func(journalId string, legs []JournalLeg) ([]types.TransactWriteItem, error) {
+		record, err := claimRecord(*claim, journalId, comment, cfg.PendingClaimsAccount, to, legs, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return []types.TransactWriteItem{record, {Update: &types.Update{
+			TableName: aws.String(PendingClaimsTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID": &types.AttributeValueMemberS{Value: claim.TenantID},
+				"ClaimID":  &types.AttributeValueMemberS{Value: claim.ClaimID},
+			},
+			UpdateExpression:         aws.String("SET #status = :status, PaidTo = :to, UpdatedAt = :now"),
+			ConditionExpression:      aws.String(condition),
+			ExpressionAttributeNames: map[string]string{"#status": "Status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status":  &types.AttributeValueMemberS{Value: status},
+				":pending": &types.AttributeValueMemberS{Value: ClaimPending},
+				":to":      &types.AttributeValueMemberS{Value: to},
+				":at":      &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)},
+				":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+			},
+		}}}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle pending claim %s: %v", claim.ClaimID, err)
+	}
+	claim.Status, claim.PaidTo, claim.UpdatedAt = status, to, timestamp
+	return nil
+}
@@ -0,0 +1,420 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Logger is the structured logger used by the ledger. *slog.Logger satisfies
+// it; args are alternating keys and values as with slog.
+type Logger interface {
+	DebugContext(ctx context.Context, msg string, args ...any)
+	InfoContext(ctx context.Context, msg string, args ...any)
+	WarnContext(ctx context.Context, msg string, args ...any)
+	ErrorContext(ctx context.Context, msg string, args ...any)
+}
+
+// Ledger is a DynamoDB client carrying the ledger's configuration. It
+// implements DynamoDBAPI, so it is passed to the package functions in place
+// of the raw client, and they pick up its settings from it.
+type Ledger struct {
+	db      DynamoDBAPI
+	logger  Logger
+	level   *slog.LevelVar
+	tracer  Tracer
+	metrics Metrics
+	audit   bool
+	retry   *RetryPolicy
+
+	conflictRetry *RetryPolicy
+
+	clock    Clock
+	versions *versionCounter
+	ids      IDGenerator
+
+	capacityMetrics bool
+
+	accounts *accountCache
+
+	degradation *degradation
+	slowQueries *SlowQueryPolicy
+	inflight    *inflight
+	tablePrefix string
+	client      clientConfig
+	pii         PIIKeyring
+	screening   ScreeningHook
+	receiptKeys ReceiptKeyring
+
+	consistentReads bool
+	analytics       bool
+
+	readReplica       ReadReplica
+	invalidateReplica ReplicaInvalidator
+}
+
+var _ DynamoDBAPI = (*Ledger)(nil)
+
+// Option configures a Ledger.
+type Option func(*Ledger)
+
+// WithLogger sets the logger. Its own level applies; SetLogLevel only
+// controls the default logger.
+func WithLogger(logger Logger) Option {
+	return func(l *Ledger) {
+		l.logger = logger
+	}
+}
+
+// WithLogLevel sets the level of the default logger.
+func WithLogLevel(level slog.Level) Option {
+	return func(l *Ledger) {
+		l.level.Set(level)
+	}
+}
+
+// NewLedger wraps a DynamoDB client. Without WithLogger, logs are written as
+// text to stderr at info level and above.
+func NewLedger(db DynamoDBAPI, opts ...Option) *Ledger {
+	l := &Ledger{db: db, level: new(slog.LevelVar), tracer: noopTracer{}, metrics: noopMetrics{}, inflight: &inflight{}}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.logger == nil {
+		l.logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l.level}))
+	}
+	return l
+}
+
+// Logger returns the ledger's logger.
+func (l *Ledger) Logger() Logger {
+	return l.logger
+}
+
+// SetLogLevel changes the level of the default logger at runtime.
+func (l *Ledger) SetLogLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+// loggerOf returns the logger of dbSvc when it is a Ledger, and slog's
+// default logger for plain clients.
+func loggerOf(dbSvc DynamoDBAPI) Logger {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.logger
+	}
+	return slog.Default()
+}
+
+// call starts tracing a DynamoDB call; the returned function ends it with
+// the call's error and consumed capacity, logs it at debug level (warn if it
+// failed or was slow) and records its latency and capacity. details returns
+// the redacted key and expressions of the call, for the slow query log.
+func (l *Ledger) call(ctx context.Context, op string, table *string, details func() []any) (context.Context, func(error, []types.ConsumedCapacity)) {
+	start := time.Now()
+	ctx, span := l.tracer.Start(ctx, "dynamodb."+op,
+		Attr("db.system", "dynamodb"),
+		Attr("db.operation", op),
+		Attr("aws.dynamodb.table_names", aws.ToString(table)),
+	)
+	return ctx, func(err error, capacity []types.ConsumedCapacity) {
+		latency := time.Since(start)
+		units := capacityUnits(capacityOf(capacity)...)
+		l.metrics.RecordHistogram(ctx, MetricDynamoDBDuration, latency.Seconds(), Attr("op", op), Attr("error", err != nil))
+		l.recordCapacity(ctx, op, capacity)
+		endSpan(span, err)
+		args := []any{"op", op, "table", aws.ToString(table), "latency", latency}
+		if l.wantsCapacity() {
+			args = append(args, "capacity_units", units)
+		}
+		if err != nil {
+			l.logger.WarnContext(ctx, "dynamodb call failed", append(args, "error", err)...)
+			return
+		}
+		if l.slow(latency, units) {
+			if details != nil {
+				args = append(args, details()...)
+			}
+			l.logger.WarnContext(ctx, "slow dynamodb call", args...)
+			return
+		}
+		l.logger.DebugContext(ctx, "dynamodb call", args...)
+	}
+}
+
+func (l *Ledger) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	ctx, done := l.call(ctx, "GetItem", params.TableName, func() []any {
+		return []any{"key", logKey(params.Key)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.GetItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.withRetry(ctx, "GetItem", true, func() (err error) {
+		out, err = l.db.GetItem(ctx, params, optFns...)
+		if out != nil {
+			capacity = appendCapacity(capacity, out.ConsumedCapacity)
+		}
+		return err
+	})
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	ctx, done := l.call(ctx, "PutItem", params.TableName, func() []any {
+		return []any{"condition", logExpression(params.ConditionExpression, params.ExpressionAttributeNames)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	table := aws.ToString(params.TableName)
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.PutItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.write(ctx, table, func() (err error) {
+		return l.withRetry(ctx, "PutItem", params.ConditionExpression != nil, func() (err error) {
+			out, err = l.db.PutItem(ctx, params, optFns...)
+			if out != nil {
+				capacity = appendCapacity(capacity, out.ConsumedCapacity)
+			}
+			return err
+		})
+	})
+	l.evictAccounts(table, params.Item)
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	ctx, done := l.call(ctx, "UpdateItem", params.TableName, func() []any {
+		return []any{"key", logKey(params.Key), "condition", logExpression(params.ConditionExpression, params.ExpressionAttributeNames)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	table := aws.ToString(params.TableName)
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.UpdateItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.write(ctx, table, func() (err error) {
+		return l.withRetry(ctx, "UpdateItem", params.ConditionExpression != nil, func() (err error) {
+			out, err = l.db.UpdateItem(ctx, params, optFns...)
+			if out != nil {
+				capacity = appendCapacity(capacity, out.ConsumedCapacity)
+			}
+			return err
+		})
+	})
+	l.evictAccounts(table, params.Key)
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	ctx, done := l.call(ctx, "DeleteItem", params.TableName, func() []any {
+		return []any{"key", logKey(params.Key), "condition", logExpression(params.ConditionExpression, params.ExpressionAttributeNames)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	table := aws.ToString(params.TableName)
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.DeleteItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.write(ctx, table, func() (err error) {
+		return l.withRetry(ctx, "DeleteItem", params.ConditionExpression != nil, func() (err error) {
+			out, err = l.db.DeleteItem(ctx, params, optFns...)
+			if out != nil {
+				capacity = appendCapacity(capacity, out.ConsumedCapacity)
+			}
+			return err
+		})
+	})
+	l.evictAccounts(table, params.Key)
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	ctx, done := l.call(ctx, "Query", params.TableName, func() []any {
+		return []any{
+			"index", aws.ToString(params.IndexName),
+			"key_condition", logExpression(params.KeyConditionExpression, params.ExpressionAttributeNames),
+			"filter", logExpression(params.FilterExpression, params.ExpressionAttributeNames),
+		}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.QueryOutput
+	var capacity []types.ConsumedCapacity
+	err := l.withRetry(ctx, "Query", true, func() (err error) {
+		out, err = l.db.Query(ctx, params, optFns...)
+		if out != nil {
+			capacity = appendCapacity(capacity, out.ConsumedCapacity)
+		}
+		return err
+	})
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	ctx, done := l.call(ctx, "TransactWriteItems", nil, func() []any {
+		return []any{"items", len(params.TransactItems)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	items := params.TransactItems
+	if l.tablePrefix != "" {
+		params = l.prefixTransactWrite(params)
+	}
+	var out *dynamodb.TransactWriteItemsOutput
+	var capacity []types.ConsumedCapacity
+	err := l.write(ctx, "", func() (err error) {
+		return l.withRetry(ctx, "TransactWriteItems", params.ClientRequestToken != nil, func() (err error) {
+			out, err = l.db.TransactWriteItems(ctx, params, optFns...)
+			if out != nil {
+				capacity = append(capacity, out.ConsumedCapacity...)
+			}
+			return err
+		})
+	})
+	l.evictTransactAccounts(items)
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	ctx, done := l.call(ctx, "BatchGetItem", nil, func() []any {
+		return []any{"tables", len(params.RequestItems)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	if l.tablePrefix != "" {
+		params = l.prefixBatchGet(params)
+	}
+	var out *dynamodb.BatchGetItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.withRetry(ctx, "BatchGetItem", true, func() (err error) {
+		out, err = l.db.BatchGetItem(ctx, params, optFns...)
+		if out != nil {
+			l.unprefixBatchGet(out)
+			capacity = append(capacity, out.ConsumedCapacity...)
+		}
+		return err
+	})
+	done(err, capacity)
+	return out, err
+}
+
+func (l *Ledger) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	ctx, done := l.call(ctx, "BatchWriteItem", nil, func() []any {
+		return []any{"tables", len(params.RequestItems)}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	requests := params.RequestItems
+	if l.tablePrefix != "" {
+		params = l.prefixBatchWrite(params)
+	}
+	var out *dynamodb.BatchWriteItemOutput
+	var capacity []types.ConsumedCapacity
+	err := l.write(ctx, "", func() (err error) {
+		return l.withRetry(ctx, "BatchWriteItem", false, func() (err error) {
+			out, err = l.db.BatchWriteItem(ctx, params, optFns...)
+			if out != nil {
+				l.unprefixBatchWrite(out)
+				capacity = append(capacity, out.ConsumedCapacity...)
+			}
+			return err
+		})
+	})
+	l.evictBatchAccounts(requests)
+	done(err, capacity)
+	return out, err
+}
+
+// Scan implements Scanner when the client the Ledger wraps does.
+func (l *Ledger) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	scanner, ok := l.db.(Scanner)
+	if !ok {
+		return nil, errors.New("the dynamodb client cannot scan tables")
+	}
+	ctx, done := l.call(ctx, "Scan", params.TableName, func() []any {
+		return []any{
+			"index", aws.ToString(params.IndexName),
+			"filter", logExpression(params.FilterExpression, params.ExpressionAttributeNames),
+			"segment", aws.ToInt32(params.Segment),
+		}
+	})
+	if l.wantsCapacity() && params.ReturnConsumedCapacity == "" {
+		p := *params
+		p.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+		params = &p
+	}
+	if l.tablePrefix != "" {
+		p := *params
+		p.TableName = l.tableName(params.TableName)
+		params = &p
+	}
+	var out *dynamodb.ScanOutput
+	var capacity []types.ConsumedCapacity
+	err := l.withRetry(ctx, "Scan", true, func() (err error) {
+		out, err = scanner.Scan(ctx, params, optFns...)
+		if out != nil {
+			capacity = appendCapacity(capacity, out.ConsumedCapacity)
+		}
+		return err
+	})
+	done(err, capacity)
+	return out, err
+}
@@ -0,0 +1,97 @@
+package ledger
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// Clock tells the ledger the time. WithClock replaces the system clock,
+// e.g. with a fixed one for deterministic tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of time.Now.
+type SystemClock struct{}
+
+// Now returns time.Now().
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// WithClock sets the clock the ledger reads the time from.
+func WithClock(clock Clock) Option {
+	return func(l *Ledger) {
+		l.clock = clock
+		l.versions = &versionCounter{}
+	}
+}
+
+// IDGenerator makes the IDs of transactions. WithIDGenerator replaces the
+// KSUIDs the ledger makes them with, e.g. with a sequence for golden tests.
+// IDs must be unique, and should sort by when they were made.
+type IDGenerator interface {
+	NewID() string
+}
+
+// KSUIDGenerator is the IDGenerator of KSUIDs.
+type KSUIDGenerator struct{}
+
+// NewID returns a new KSUID.
+func (KSUIDGenerator) NewID() string { return ksuid.New().String() }
+
+// WithIDGenerator sets the generator of the ledger's transaction IDs.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(l *Ledger) {
+		l.ids = ids
+	}
+}
+
+// clockOf returns the clock of a Ledger, or SystemClock.
+func clockOf(dbSvc DynamoDBAPI) Clock {
+	if l, ok := dbSvc.(*Ledger); ok && l.clock != nil {
+		return l.clock
+	}
+	return SystemClock{}
+}
+
+// newID returns a new ID from the IDGenerator of a Ledger, or a KSUID.
+func newID(dbSvc DynamoDBAPI) string {
+	if l, ok := dbSvc.(*Ledger); ok && l.ids != nil {
+		return l.ids.NewID()
+	}
+	return KSUIDGenerator{}.NewID()
+}
+
+// versionCounter hands out account versions that never repeat.
+type versionCounter struct {
+	last atomic.Int64
+}
+
+// processVersions hands out the versions of the system clock, shared by the
+// process so that Ledgers over the same tables never hand out the same
+// version.
+var processVersions = &versionCounter{}
+
+// next returns the Unix time in nanoseconds of now, or one more than the
+// previous version when the clock has not moved past it.
+func (c *versionCounter) next(now time.Time) int64 {
+	for {
+		last := c.last.Load()
+		version := max(now.UnixNano(), last+1)
+		if c.last.CompareAndSwap(last, version) {
+			return version
+		}
+	}
+}
+
+// nextVersion returns a new Version for an account being written. Versions
+// are the optimistic lock of accounts, so two writes must never get the
+// same one, even within a nanosecond. Versions written as Unix seconds by
+// earlier releases are all below them.
+func nextVersion(dbSvc DynamoDBAPI) int64 {
+	if l, ok := dbSvc.(*Ledger); ok && l.versions != nil {
+		return l.versions.next(clockOf(dbSvc).Now())
+	}
+	return processVersions.next(time.Now())
+}
@@ -0,0 +1,54 @@
+package ledger
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestNextVersion(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewLedger(nil, WithClock(fixedClock(now)))
+	for i := int64(0); i < 3; i++ {
+		if got, want := nextVersion(l), now.UnixNano()+i; got != want {
+			t.Errorf("nextVersion() #%d = %d, want %d", i, got, want)
+		}
+	}
+	// Each ledger of its own clock starts from that clock.
+	other := NewLedger(nil, WithClock(fixedClock(now)))
+	if got := nextVersion(other); got != now.UnixNano() {
+		t.Errorf("nextVersion() of another ledger = %d, want %d", got, now.UnixNano())
+	}
+	// Versions never go back with the clock.
+	var c versionCounter
+	c.next(now)
+	if got := c.next(now.Add(-time.Hour)); got != now.UnixNano()+1 {
+		t.Errorf("next() after the clock went back = %d, want %d", got, now.UnixNano()+1)
+	}
+}
+
+func TestNextVersionConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[int64]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				v := nextVersion(nil)
+				mu.Lock()
+				if seen[v] {
+					t.Errorf("nextVersion() returned %d twice", v)
+				}
+				seen[v] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,315 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxTransactItems is the most items DynamoDB accepts in one TransactWriteItems call.
+const MaxTransactItems = 100
+
+// TxGroup is a set of writes that must commit together, such as the legs of
+// a journal. Compensate holds the writes undoing the group; it is required
+// for every group that may end up in an earlier transaction than others.
+type TxGroup struct {
+	Name       string
+	Items      []types.TransactWriteItem
+	Compensate []types.TransactWriteItem
+}
+
+// TxComposer packs groups of writes into as few DynamoDB transactions as the
+// item budget allows. Groups are never reordered, so a group that depends on
+// an earlier one (e.g. credits after the debits funding them) always commits
+// after it. When the groups do not fit in one transaction they are split into
+// phases, and a failed phase compensates the phases already committed.
+type TxComposer struct {
+	groups   []TxGroup
+	reserved int
+}
+
+// NewTxComposer returns an empty composer.
+func NewTxComposer() *TxComposer {
+	return &TxComposer{}
+}
+
+// Add appends groups, in commit order.
+func (c *TxComposer) Add(groups ...TxGroup) {
+	c.groups = append(c.groups, groups...)
+}
+
+// Reserve keeps n items free in every transaction for writes appended later,
+// such as outbox entries.
+func (c *TxComposer) Reserve(n int) {
+	c.reserved += n
+}
+
+// Budget returns the number of items available to groups in one transaction.
+func (c *TxComposer) Budget() int {
+	return MaxTransactItems - c.reserved
+}
+
+// TxPhase is one transaction of a plan.
+type TxPhase struct {
+	Groups []TxGroup
+	Items  []types.TransactWriteItem
+}
+
+// Plan packs the groups into phases and validates the budget without writing
+// anything: every group must fit in a transaction on its own, must not touch
+// the same item twice, and must be compensable unless it is in the last phase.
+func (c *TxComposer) Plan() ([]TxPhase, error) {
+	budget := c.Budget()
+	if budget < 1 {
+		return nil, fmt.Errorf("no transaction items left after reserving %d", c.reserved)
+	}
+
+	var phases []TxPhase
+	var touched map[string]bool
+	for _, group := range c.groups {
+		if len(group.Items) == 0 {
+			continue
+		}
+		if len(group.Items) > budget {
+			return nil, fmt.Errorf("group %s needs %d transaction items, more than the %d available", group.Name, len(group.Items), budget)
+		}
+		ids, err := itemIdentities(group.Items)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %v", group.Name, err)
+		}
+
+		fits := len(phases) > 0 && len(phases[len(phases)-1].Items)+len(group.Items) <= budget
+		for _, id := range ids {
+			if touched[id] {
+				fits = false
+			}
+		}
+		if !fits {
+			phases = append(phases, TxPhase{})
+			touched = map[string]bool{}
+		}
+		last := &phases[len(phases)-1]
+		last.Groups = append(last.Groups, group)
+		last.Items = append(last.Items, group.Items...)
+		for _, id := range ids {
+			touched[id] = true
+		}
+	}
+
+	for _, phase := range phases[:max(len(phases)-1, 0)] {
+		for _, group := range phase.Groups {
+			if len(group.Compensate) == 0 {
+				return nil, fmt.Errorf("group %s does not fit in one transaction with the groups after it and cannot be compensated", group.Name)
+			}
+		}
+	}
+	return phases, nil
+}
+
+// Execute commits the plan phase by phase. If a phase fails, the phases
+// already committed are compensated in reverse order and the phase error is
+// returned, wrapped so callers can still inspect it with errors.As.
+func (c *TxComposer) Execute(ctx context.Context, dbSvc DynamoDBAPI) error {
+	phases, err := c.Plan()
+	if err != nil {
+		return err
+	}
+	for i, phase := range phases {
+		_, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: phase.Items})
+		if err == nil {
+			continue
+		}
+		if len(phases) == 1 {
+			return err
+		}
+		phaseErr := fmt.Errorf("transaction phase %d of %d failed: %w", i+1, len(phases), err)
+		if compErr := compensate(ctx, dbSvc, phases[:i], c.Budget()); compErr != nil {
+			return errors.Join(phaseErr, compErr)
+		}
+		return phaseErr
+	}
+	return nil
+}
+
+// compensate undoes committed phases, newest group first.
+func compensate(ctx context.Context, dbSvc DynamoDBAPI, committed []TxPhase, budget int) error {
+	undo := &TxComposer{reserved: MaxTransactItems - budget}
+	for i := len(committed) - 1; i >= 0; i-- {
+		groups := committed[i].Groups
+		for j := len(groups) - 1; j >= 0; j-- {
+			undo.Add(TxGroup{Name: "compensate " + groups[j].Name, Items: groups[j].Compensate, Compensate: groups[j].Items})
+		}
+	}
+	phases, err := undo.Plan()
+	if err != nil {
+		return fmt.Errorf("failed to plan compensation: %v", err)
+	}
+	for _, phase := range phases {
+		if _, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: phase.Items}); err != nil {
+			var names []string
+			for _, group := range phase.Groups {
+				names = append(names, group.Name)
+			}
+			return fmt.Errorf("failed to compensate %s: %v", strings.Join(names, ", "), err)
+		}
+	}
+	return nil
+}
+
+// itemIdentities returns an identity per item written, failing if two
+// writes of the group touch the same item.
+func itemIdentities(items []types.TransactWriteItem) ([]string, error) {
+	seen := map[string]bool{}
+	var ids []string
+	for _, op := range items {
+		var table *string
+		var key map[string]types.AttributeValue
+		switch {
+		case op.Put != nil:
+			table = op.Put.TableName
+			key = putKey(aws.ToString(table), op.Put.Item)
+		case op.Update != nil:
+			table, key = op.Update.TableName, op.Update.Key
+		case op.Delete != nil:
+			table, key = op.Delete.TableName, op.Delete.Key
+		case op.ConditionCheck != nil:
+			table, key = op.ConditionCheck.TableName, op.ConditionCheck.Key
+		default:
+			return nil, errors.New("empty transaction item")
+		}
+		if key == nil {
+			// A put to a table of unknown schema cannot be compared.
+			continue
+		}
+		id := aws.ToString(table) + "|" + keyIdentity(key)
+		if seen[id] {
+			return nil, fmt.Errorf("two writes to the same item in %s", aws.ToString(table))
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// putKey extracts the key of an item put to one of the ledger tables.
+func putKey(table string, item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	attributes := primaryKeyAttributes(table)
+	if attributes == nil {
+		return nil
+	}
+	key := map[string]types.AttributeValue{}
+	for _, name := range attributes {
+		key[name] = item[name]
+	}
+	return key
+}
+
+// primaryKeyAttributes returns the key attributes of the ledger tables.
+func primaryKeyAttributes(table string) []string {
+	switch table {
+	case NilUsers, CustomerLimitsTable:
+		return []string{"TenantID", "AccountID"}
+	case LedgerTable, TransactionsTable:
+		return []string{"TenantID", "TransactionID"}
+	case TenantConfigTable:
+		return []string{"TenantID"}
+	case DelayedTransfersTable, TransferApprovalsTable:
+		return []string{"TenantID", "TransferID"}
+	case ReportSubscriptionsTable:
+		return []string{"TenantID", "SubscriptionID"}
+	case AnomaliesTable:
+		return []string{"TenantID", "AnomalyID"}
+	case AnomalyBaselinesTable:
+		return []string{"TenantID", "Key"}
+	case AuditLogTable:
+		return []string{"TenantID", "EntryID"}
+	case TenantKeysTable:
+		return []string{"TenantID", "KeyID"}
+	case SnapshotsTable:
+		return []string{"AccountKey", "Day"}
+	case ExchangeRatesTable:
+		return []string{"TenantID", "Currency"}
+	case PayoutsTable:
+		return []string{"TenantID", "CodeHash"}
+	case PendingClaimsTable:
+		return []string{"TenantID", "ClaimID"}
+	case IdempotencyKeysTable:
+		return []string{"TenantID", "IdempotencyKey"}
+	case ConfigChangesTable:
+		return []string{"TenantID", "ChangeID"}
+	case ArchivesTable:
+		return []string{"TenantID", "ArchiveID"}
+	case CredentialsTable:
+		return []string{"KeyID"}
+	case ReserveProofsTable:
+		return []string{"TenantID", "ProofID"}
+	case ReserveInclusionsTable:
+		return []string{"ProofKey", "AccountID"}
+	case FailedOperationsTable:
+		return []string{"TenantID", "OperationID"}
+	case PaymentRequestsTable:
+		return []string{"TenantID", "RequestID"}
+	case InterTenantObligationsTable:
+		return []string{"Period", "Pair"}
+	case SettlementBatchesTable:
+		return []string{"Period"}
+	case EscrowHoldsTable:
+		return []string{"TenantID", "EscrowID"}
+	case DisputesTable:
+		return []string{"TenantID", "TransactionID"}
+	case ProjectionsTable:
+		return []string{"ProjectionID", "ItemKey"}
+	case StreamCheckpointsTable:
+		return []string{"Consumer", "ShardID"}
+	case TenantAnalyticsTable:
+		return []string{"TenantID", "Day"}
+	case VelocityCountersTable:
+		return []string{"TenantID", "CounterID"}
+	case CampaignsTable:
+		return []string{"TenantID", "CampaignID"}
+	case CampaignUsageTable:
+		return []string{"TenantID", "UsageID"}
+	case BalanceSubscriptionsTable:
+		return []string{"AccountKey", "SubscriptionID"}
+	case ThirdPartyAppsTable:
+		return []string{"TenantID", "AppID"}
+	case ConsentsTable:
+		return []string{"TenantID", "ConsentID"}
+	case AnnotationsTable:
+		return []string{"OwnerID", "TransactionID"}
+	case AccountEventsTable:
+		return []string{"StreamID", "EventID"}
+	case EscrowTransactionsTable:
+		return []string{"UUID", "TransactionID"}
+	}
+	return nil
+}
+
+func keyIdentity(key map[string]types.AttributeValue) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		switch v := key[name].(type) {
+		case *types.AttributeValueMemberS:
+			b.WriteString("S:" + v.Value)
+		case *types.AttributeValueMemberN:
+			b.WriteString("N:" + v.Value)
+		case *types.AttributeValueMemberB:
+			b.WriteString(fmt.Sprintf("B:%x", v.Value))
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package ledger
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func accountUpdates(prefix string, count int) []types.TransactWriteItem {
+	items := make([]types.TransactWriteItem, count)
+	for i := range items {
+		items[i] = types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+				"AccountID": &types.AttributeValueMemberS{Value: prefix + strconv.Itoa(i)},
+			},
+			UpdateExpression: aws.String("SET amount = amount + :amount"),
+		}}
+	}
+	return items
+}
+
+func TestTxComposerPlan(t *testing.T) {
+	undo := accountUpdates("undo", 1)
+	tests := []struct {
+		name    string
+		reserve int
+		groups  []TxGroup
+		phases  []int
+		wantErr bool
+	}{
+		{"empty", 0, nil, nil, false},
+		{"one transaction", 0, []TxGroup{{Name: "a", Items: accountUpdates("a", 60)}, {Name: "b", Items: accountUpdates("b", 40)}}, []int{100}, false},
+		{"split over budget", 0, []TxGroup{{Name: "a", Items: accountUpdates("a", 60), Compensate: undo}, {Name: "b", Items: accountUpdates("b", 41)}}, []int{60, 41}, false},
+		{"split on reserve", 10, []TxGroup{{Name: "a", Items: accountUpdates("a", 60), Compensate: undo}, {Name: "b", Items: accountUpdates("b", 40)}}, []int{60, 40}, false},
+		{"split on shared item", 0, []TxGroup{{Name: "a", Items: accountUpdates("x", 2), Compensate: undo}, {Name: "b", Items: accountUpdates("x", 1)}}, []int{2, 1}, false},
+		{"group over budget", 0, []TxGroup{{Name: "a", Items: accountUpdates("a", 101)}}, nil, true},
+		{"duplicate within group", 0, []TxGroup{{Name: "a", Items: append(accountUpdates("a", 1), accountUpdates("a", 1)...)}}, nil, true},
+		{"split without compensation", 0, []TxGroup{{Name: "a", Items: accountUpdates("a", 60)}, {Name: "b", Items: accountUpdates("b", 41)}}, nil, true},
+		{"reserved everything", 100, []TxGroup{{Name: "a", Items: accountUpdates("a", 1)}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			composer := NewTxComposer()
+			composer.Reserve(tt.reserve)
+			composer.Add(tt.groups...)
+			phases, err := composer.Plan()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Plan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []int
+			for _, phase := range phases {
+				got = append(got, len(phase.Items))
+			}
+			if len(got) != len(tt.phases) {
+				t.Fatalf("Plan() phases = %v, want %v", got, tt.phases)
+			}
+			for i := range got {
+				if got[i] != tt.phases[i] {
+					t.Errorf("Plan() phases = %v, want %v", got, tt.phases)
+				}
+			}
+		})
+	}
+}
+
+func TestPutKey(t *testing.T) {
+	item := map[string]types.AttributeValue{
+		"TenantID":      &types.AttributeValueMemberS{Value: "nil"},
+		"TransactionID": &types.AttributeValueMemberS{Value: "tx1"},
+		"Amount":        &types.AttributeValueMemberN{Value: "10"},
+	}
+	if got := putKey(TransactionsTable, item); len(got) != 2 || got["Amount"] != nil {
+		t.Errorf("putKey() = %v, want TenantID and TransactionID", got)
+	}
+	if got := putKey("Unknown", item); got != nil {
+		t.Errorf("putKey() of an unknown table = %v, want nil", got)
+	}
+}
@@ -0,0 +1,592 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// ConfigChangesTable holds the configuration changes of tenants under dual
+// control. It needs a StatusActivateAtIndex GSI (Status, ActivateAt) for the
+// activation job.
+var ConfigChangesTable = "ConfigChanges"
+
+// ErrDualControl is returned when a sensitive setting of a tenant under dual
+// control is changed directly rather than through ProposeConfigChange.
+var ErrDualControl = errors.New("dual_control_required")
+
+const (
+	ConfigChangePending = "pending"
+	// ConfigChangeScheduled is an approved change waiting for ActivateAt.
+	ConfigChangeScheduled = "scheduled"
+	ConfigChangeApplied   = "applied"
+	ConfigChangeRejected  = "rejected"
+	// ConfigChangeFailed is a change that could not be applied, e.g.
+	// because the config was changed after it was proposed.
+	ConfigChangeFailed = "failed"
+)
+
+// Kinds of ConfigChange.
+const (
+	ConfigChangeTenantConfig = "tenant_config"
+	ConfigChangeRegisterKey  = "register_key"
+	ConfigChangeRevokeKey    = "revoke_key"
+)
+
+// dualControlFields are the TenantConfig settings, by JSON name, that a
+// tenant under dual control can only change through ProposeConfigChange.
+var dualControlFields = map[string]bool{
+	"daily_spend_limit":        true,
+	"fee_schedule":             true,
+	"tax":                      true,
+	"large_transfer_threshold": true,
+	"large_transfer_delay":     true,
+	"approval_threshold":       true,
+	"required_approvals":       true,
+	"approvers":                true,
+	"minimum_balance":          true,
+	"bonus_funding_account":    true,
+	"treasury_account":         true,
+	"payout_holding_account":   true,
+	"pending_claims_account":   true,
+	"escrow_holding_account":   true,
+	"settlement_account":       true,
+	"velocity_rules":           true,
+	"kyc_tier_limits":          true,
+	"dual_control":             true,
+}
+
+// ConfigFieldChange is a setting changed by a ConfigChange, with its values
+// as JSON; an empty value means unset.
+type ConfigFieldChange struct {
+	Field string `dynamodbav:"Field" json:"field"`
+	From  string `dynamodbav:"From,omitempty" json:"from,omitempty"`
+	To    string `dynamodbav:"To,omitempty" json:"to,omitempty"`
+}
+
+// ConfigChange is a change to a tenant's configuration proposed by one
+// person and approved by another before it applies.
+type ConfigChange struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	ChangeID string `dynamodbav:"ChangeID" json:"change_id,omitempty"`
+	Kind     string `dynamodbav:"Kind" json:"kind"`
+	// Config is the proposed config of a tenant_config change, KeyID and
+	// PublicKey the tenant key registered or revoked by a key change.
+	Config    *TenantConfig `dynamodbav:"Config,omitempty" json:"config,omitempty"`
+	KeyID     string        `dynamodbav:"KeyID,omitempty" json:"key_id,omitempty"`
+	PublicKey string        `dynamodbav:"PublicKey,omitempty" json:"public_key,omitempty"`
+	// Diff previews the change against the config it was proposed on. Only
+	// the settings in it are applied, and the change fails rather than
+	// apply over any of them changed since.
+	Diff       []ConfigFieldChange `dynamodbav:"Diff" json:"diff"`
+	Status     string              `dynamodbav:"Status" json:"status"`
+	ProposedBy string              `dynamodbav:"ProposedBy" json:"proposed_by"`
+	ReviewedBy string              `dynamodbav:"ReviewedBy,omitempty" json:"reviewed_by,omitempty"`
+	// Reason is why the change was rejected or failed.
+	Reason string `dynamodbav:"Reason,omitempty" json:"reason,omitempty"`
+	// ActivateAt is when an approved change applies; a change approved
+	// after it applies right away.
+	ActivateAt int64 `dynamodbav:"ActivateAt" json:"activate_at"`
+	CreatedAt  int64 `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+	UpdatedAt  int64 `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// configDiff returns the settings that differ between two configs, sorted by
+// name. The tenant, maintenance and update time are not settings.
+func configDiff(from, to TenantConfig) ([]ConfigFieldChange, error) {
+	fields := func(cfg TenantConfig) (map[string]json.RawMessage, error) {
+		cfg.TenantID, cfg.Maintenance, cfg.UpdatedAt = "", nil, 0
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]json.RawMessage
+		return m, json.Unmarshal(data, &m)
+	}
+	before, err := fields(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tenant config: %v", err)
+	}
+	after, err := fields(to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tenant config: %v", err)
+	}
+	var diff []ConfigFieldChange
+	for name, value := range after {
+		if string(before[name]) != string(value) {
+			diff = append(diff, ConfigFieldChange{Field: name, From: string(before[name]), To: string(value)})
+		}
+	}
+	for name, value := range before {
+		if _, ok := after[name]; !ok {
+			diff = append(diff, ConfigFieldChange{Field: name, From: string(value)})
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Field < diff[j].Field })
+	return diff, nil
+}
+
+// applyConfigDiff returns cfg with the settings of diff changed, or an error
+// if any of them no longer has the value diff changes it from.
+func applyConfigDiff(cfg TenantConfig, diff []ConfigFieldChange) (TenantConfig, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to marshal tenant config: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return cfg, fmt.Errorf("failed to unmarshal tenant config: %v", err)
+	}
+	for _, change := range diff {
+		if string(fields[change.Field]) != change.From {
+			return cfg, fmt.Errorf("%s was changed after the change was proposed", change.Field)
+		}
+		if change.To == "" {
+			delete(fields, change.Field)
+		} else {
+			fields[change.Field] = json.RawMessage(change.To)
+		}
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return cfg, fmt.Errorf("failed to marshal tenant config: %v", err)
+	}
+	var changed TenantConfig
+	if err := json.Unmarshal(data, &changed); err != nil {
+		return cfg, fmt.Errorf("failed to unmarshal tenant config: %v", err)
+	}
+	return changed, nil
+}
+
+// dualControlError returns ErrDualControl if cfg is under dual control
+// and diff changes any of its sensitive settings.
+func (cfg *TenantConfig) dualControlError(diff []ConfigFieldChange) error {
+	if !cfg.DualControl {
+		return nil
+	}
+	var sensitive []string
+	for _, change := range diff {
+		if dualControlFields[change.Field] {
+			sensitive = append(sensitive, change.Field)
+		}
+	}
+	if len(sensitive) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s of tenant %s must be changed with ProposeConfigChange", ErrDualControl, strings.Join(sensitive, ", "), cfg.TenantID)
+}
+
+// ProposeConfigChange records a change of a tenant's configuration for a
+// second person to approve. change.Kind says what it changes: a
+// tenant_config change replaces the config with change.Config, a key change
+// registers or revokes change.KeyID. change.ActivateAt schedules it; zero
+// applies it as soon as it is approved. The proposer is the actor of ctx,
+// who cannot approve it.
+//
+// The stored change's Diff previews what it does.
+func ProposeConfigChange(ctx context.Context, dbSvc DynamoDBAPI, change ConfigChange) (*ConfigChange, error) {
+	if change.TenantID == "" {
+		change.TenantID = "nil"
+	}
+	actor := ActorFrom(ctx)
+	if actor == AuditSystemActor {
+		return nil, errors.New("config changes must be proposed by a named actor")
+	}
+	current, err := GetTenantConfig(ctx, dbSvc, change.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	now := getCurrentTimestamp()
+	change.ChangeID = ksuid.New().String()
+	change.Status = ConfigChangePending
+	change.ProposedBy = actor
+	change.ReviewedBy, change.Reason = "", ""
+	change.CreatedAt, change.UpdatedAt = now, now
+	if change.ActivateAt < now {
+		change.ActivateAt = now
+	}
+
+	switch change.Kind {
+	case ConfigChangeTenantConfig:
+		if change.Config == nil {
+			return nil, errors.New("a tenant config change needs the config")
+		}
+		cfg := *change.Config
+		cfg.TenantID, cfg.Maintenance, cfg.UpdatedAt = change.TenantID, nil, 0
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		change.Config = &cfg
+		change.KeyID, change.PublicKey = "", ""
+		if change.Diff, err = configDiff(*current, cfg); err != nil {
+			return nil, err
+		}
+	case ConfigChangeRegisterKey, ConfigChangeRevokeKey:
+		if change.KeyID == "" {
+			return nil, errors.New("key id is required")
+		}
+		change.Config = nil
+		keys, err := GetTenantPublicKeys(ctx, dbSvc, change.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		field := ConfigFieldChange{Field: "public_key:" + change.KeyID}
+		for _, key := range keys {
+			if key.KeyID == change.KeyID {
+				field.From = key.PublicKey
+			}
+		}
+		if change.Kind == ConfigChangeRegisterKey {
+			if _, _, err := parsePublicKey(change.PublicKey); err != nil {
+				return nil, err
+			}
+			field.To = change.PublicKey
+		} else {
+			change.PublicKey = ""
+			if field.From == "" {
+				return nil, fmt.Errorf("tenant %s has no key %s", change.TenantID, change.KeyID)
+			}
+		}
+		if field.From != field.To {
+			change.Diff = []ConfigFieldChange{field}
+		}
+	default:
+		return nil, fmt.Errorf("unknown config change kind %q", change.Kind)
+	}
+	if len(change.Diff) == 0 {
+		return nil, errors.New("the change does not change anything")
+	}
+
+	item, err := attributevalue.MarshalMap(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config change: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ConfigChangesTable),
+		Item:      item,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to store config change: %v", err)
+	}
+	recordAudit(ctx, dbSvc, AuditProposeConfigChange, change.TenantID, change.ChangeID, change, nil, change.Diff, err)
+	if err != nil {
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "config change proposed", "tenant", change.TenantID, "change", change.ChangeID, "kind", change.Kind, "actor", actor)
+	return &change, nil
+}
+
+// GetConfigChange retrieves a config change by its ID.
+func GetConfigChange(ctx context.Context, dbSvc DynamoDBAPI, tenantId, changeId string) (*ConfigChange, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ConfigChangesTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"ChangeID": &types.AttributeValueMemberS{Value: changeId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config change %s: %v", changeId, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("config change %s not found", changeId)
+	}
+	var change ConfigChange
+	if err := attributevalue.UnmarshalMap(result.Item, &change); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config change: %v", err)
+	}
+	return &change, nil
+}
+
+// ListConfigChanges returns a tenant's config changes in the given status,
+// or all of them when status is empty, oldest first.
+func ListConfigChanges(ctx context.Context, dbSvc DynamoDBAPI, tenantId, status string) ([]ConfigChange, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ConfigChangesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	if status != "" {
+		input.FilterExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames = map[string]string{"#status": "Status"}
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+	}
+	var changes []ConfigChange
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query config changes: %v", err)
+		}
+		var page []ConfigChange
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal config changes: %v", err)
+		}
+		changes = append(changes, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return changes, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// ApproveConfigChange approves a pending config change as the actor of ctx,
+// who must not be its proposer. The change applies right away unless it is
+// scheduled for later, in which case ActivateConfigChanges applies it.
+func ApproveConfigChange(ctx context.Context, dbSvc DynamoDBAPI, tenantId, changeId string) (*ConfigChange, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	actor := ActorFrom(ctx)
+	if actor == AuditSystemActor {
+		return nil, errors.New("config changes must be approved by a named actor")
+	}
+	change, err := GetConfigChange(ctx, dbSvc, tenantId, changeId)
+	if err != nil {
+		return nil, err
+	}
+	before := *change
+	switch {
+	case change.Status != ConfigChangePending:
+		err = fmt.Errorf("config change %s is %s", changeId, change.Status)
+	case change.ProposedBy == actor:
+		err = fmt.Errorf("config change %s must be approved by someone other than its proposer", changeId)
+	default:
+		err = setConfigChangeStatus(ctx, dbSvc, change, ConfigChangePending, ConfigChangeScheduled, map[string]string{"ReviewedBy": actor})
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			err = fmt.Errorf("config change %s is no longer pending", changeId)
+		}
+	}
+	if err == nil && change.ActivateAt <= getCurrentTimestamp() {
+		err = applyConfigChange(ctx, dbSvc, change)
+	}
+	recordAudit(ctx, dbSvc, AuditApproveConfigChange, tenantId, changeId, changeId, before, change, err)
+	if err != nil {
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "config change approved", "tenant", tenantId, "change", changeId, "status", change.Status, "actor", actor)
+	return change, nil
+}
+
+// RejectConfigChange rejects a pending or scheduled config change. Its
+// proposer may reject it to withdraw it.
+func RejectConfigChange(ctx context.Context, dbSvc DynamoDBAPI, tenantId, changeId, reason string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if reason == "" {
+		return errors.New("a reason is required to reject a config change")
+	}
+	change, err := GetConfigChange(ctx, dbSvc, tenantId, changeId)
+	if err != nil {
+		return err
+	}
+	before := *change
+	if change.Status != ConfigChangePending && change.Status != ConfigChangeScheduled {
+		err = fmt.Errorf("config change %s is %s", changeId, change.Status)
+	} else {
+		err = setConfigChangeStatus(ctx, dbSvc, change, change.Status, ConfigChangeRejected, map[string]string{"ReviewedBy": ActorFrom(ctx), "Reason": reason})
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			err = fmt.Errorf("config change %s cannot be rejected anymore", changeId)
+		}
+	}
+	recordAudit(ctx, dbSvc, AuditRejectConfigChange, tenantId, changeId, reason, before, change, err)
+	return err
+}
+
+// ActivateConfigChanges is run periodically to apply the approved config
+// changes whose ActivateAt has come. A change that cannot be applied is
+// marked failed; the others are still applied.
+func ActivateConfigChanges(ctx context.Context, dbSvc DynamoDBAPI, now time.Time) error {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(ConfigChangesTable),
+		IndexName:                aws.String("StatusActivateAtIndex"),
+		KeyConditionExpression:   aws.String("#status = :scheduled AND ActivateAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":scheduled": &types.AttributeValueMemberS{Value: ConfigChangeScheduled},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to query config changes: %v", err)
+		}
+		var page []ConfigChange
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return fmt.Errorf("failed to unmarshal config changes: %v", err)
+		}
+		for i := range page {
+			errs = append(errs, applyConfigChange(ctx, dbSvc, &page[i]))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return errors.Join(errs...)
+}
+
+// applyConfigChange applies a scheduled change and marks it applied in the
+// same transaction, or marks it failed. change is updated to match.
+func applyConfigChange(ctx context.Context, dbSvc DynamoDBAPI, change *ConfigChange) error {
+	now := getCurrentTimestamp()
+	var write types.TransactWriteItem
+	switch change.Kind {
+	case ConfigChangeTenantConfig:
+		current, err := GetTenantConfig(ctx, dbSvc, change.TenantID)
+		if err != nil {
+			return err
+		}
+		cfg, err := applyConfigDiff(*current, change.Diff)
+		if err != nil {
+			return failConfigChange(ctx, dbSvc, change, err.Error())
+		}
+		cfg.TenantID, cfg.Maintenance, cfg.UpdatedAt = change.TenantID, current.Maintenance, now
+		item, err := attributevalue.MarshalMap(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal tenant config: %v", err)
+		}
+		// The config must not change between the read and the write.
+		put := &types.Put{
+			TableName:           aws.String(TenantConfigTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(TenantID)"),
+		}
+		if current.UpdatedAt != 0 {
+			put.ConditionExpression = aws.String("UpdatedAt = :read")
+			put.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":read": &types.AttributeValueMemberN{Value: strconv.FormatInt(current.UpdatedAt, 10)},
+			}
+		}
+		write.Put = put
+	case ConfigChangeRegisterKey:
+		item, err := tenantKeyItem(change.TenantID, change.KeyID, change.PublicKey)
+		if err != nil {
+			return failConfigChange(ctx, dbSvc, change, err.Error())
+		}
+		write.Put = &types.Put{TableName: aws.String(TenantKeysTable), Item: item}
+	case ConfigChangeRevokeKey:
+		write.Delete = &types.Delete{
+			TableName: aws.String(TenantKeysTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID": &types.AttributeValueMemberS{Value: change.TenantID},
+				"KeyID":    &types.AttributeValueMemberS{Value: change.KeyID},
+			},
+		}
+	default:
+		return failConfigChange(ctx, dbSvc, change, fmt.Sprintf("unknown config change kind %q", change.Kind))
+	}
+
+	_, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: &types.Update{
+				TableName: aws.String(ConfigChangesTable),
+				Key: map[string]types.AttributeValue{
+					"TenantID": &types.AttributeValueMemberS{Value: change.TenantID},
+					"ChangeID": &types.AttributeValueMemberS{Value: change.ChangeID},
+				},
+				UpdateExpression:         aws.String("SET #status = :applied, UpdatedAt = :now"),
+				ConditionExpression:      aws.String("#status = :scheduled"),
+				ExpressionAttributeNames: map[string]string{"#status": "Status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":applied":   &types.AttributeValueMemberS{Value: ConfigChangeApplied},
+					":scheduled": &types.AttributeValueMemberS{Value: ConfigChangeScheduled},
+					":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+				},
+			}},
+			write,
+		},
+	})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) == 2 {
+			if aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+				// Rejected or applied by another run in the meantime.
+				return nil
+			}
+			if aws.ToString(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+				// Left scheduled for ActivateConfigChanges to retry.
+				return fmt.Errorf("the config of tenant %s changed while config change %s was applied", change.TenantID, change.ChangeID)
+			}
+		}
+		return fmt.Errorf("failed to apply config change %s: %v", change.ChangeID, err)
+	}
+	change.Status, change.UpdatedAt = ConfigChangeApplied, now
+	loggerOf(dbSvc).WarnContext(ctx, "config change applied", "tenant", change.TenantID, "change", change.ChangeID, "kind", change.Kind,
+		"proposed_by", change.ProposedBy, "approved_by", change.ReviewedBy)
+	return nil
+}
+
+// failConfigChange marks a scheduled change failed for reason.
+func failConfigChange(ctx context.Context, dbSvc DynamoDBAPI, change *ConfigChange, reason string) error {
+	err := setConfigChangeStatus(ctx, dbSvc, change, ConfigChangeScheduled, ConfigChangeFailed, map[string]string{"Reason": reason})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("config change %s failed: %s", change.ChangeID, reason)
+}
+
+// setConfigChangeStatus moves a change from one status to another, setting
+// the given string attributes, and updates change to match.
+func setConfigChangeStatus(ctx context.Context, dbSvc DynamoDBAPI, change *ConfigChange, from, to string, updates map[string]string) error {
+	now := getCurrentTimestamp()
+	expr := "SET #status = :to, UpdatedAt = :now"
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: from},
+		":to":   &types.AttributeValueMemberS{Value: to},
+		":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+	}
+	for name, value := range updates {
+		expr += fmt.Sprintf(", %s = :%s", name, name)
+		values[":"+name] = &types.AttributeValueMemberS{Value: value}
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ConfigChangesTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: change.TenantID},
+			"ChangeID": &types.AttributeValueMemberS{Value: change.ChangeID},
+		},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String("#status = :from"),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update config change %s: %w", change.ChangeID, err)
+	}
+	change.Status, change.UpdatedAt = to, now
+	if v, ok := updates["ReviewedBy"]; ok {
+		change.ReviewedBy = v
+	}
+	if v, ok := updates["Reason"]; ok {
+		change.Reason = v
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigDiff(t *testing.T) {
+	from := TenantConfig{TenantID: "t1", DailySpendLimit: 100, TreasuryAccount: "treasury", UpdatedAt: 1}
+	to := TenantConfig{TenantID: "t1", DailySpendLimit: 200, FeeSchedule: &FeeSchedule{Type: FeeFlat, Flat: 1}, UpdatedAt: 2}
+	diff, err := configDiff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConfigFieldChange{
+		{Field: "daily_spend_limit", From: "100", To: "200"},
+		{Field: "fee_schedule", To: `{"type":"flat","flat":1,"collection_account":""}`},
+		{Field: "treasury_account", From: `"treasury"`},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("configDiff() = %+v, want %+v", diff, want)
+	}
+
+	got, err := applyConfigDiff(TenantConfig{DailySpendLimit: 100, TreasuryAccount: "treasury", PayoutTTL: 60}, diff)
+	if err != nil || got.DailySpendLimit != 200 || got.FeeSchedule == nil || got.TreasuryAccount != "" || got.PayoutTTL != 60 {
+		t.Errorf("applyConfigDiff() = %+v, %v", got, err)
+	}
+	if _, err := applyConfigDiff(TenantConfig{DailySpendLimit: 150, TreasuryAccount: "treasury"}, diff); err == nil {
+		t.Error("applyConfigDiff() over a changed setting succeeded")
+	}
+
+	cfg := TenantConfig{TenantID: "t1", DualControl: true}
+	if err := cfg.dualControlError(diff); err == nil {
+		t.Error("dualControlError() = nil for a fee change")
+	}
+	if err := cfg.dualControlError([]ConfigFieldChange{{Field: "payout_ttl", To: "60"}}); err != nil {
+		t.Errorf("dualControlError() = %v for a payout TTL change", err)
+	}
+}
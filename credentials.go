@@ -0,0 +1,205 @@
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordHashParams are the argon2id parameters of new password hashes.
+// Changing them makes VerifyPassword rehash the passwords hashed with other
+// parameters as their owners sign in.
+var PasswordHashParams = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// Argon2Params are the cost parameters of an argon2id hash, as in RFC 9106.
+type Argon2Params struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory is the memory used, in KiB.
+	Memory  uint32
+	Threads uint8
+}
+
+// passwordHashPrefix starts the password hashes of HashPassword. Stored
+// passwords without it are plaintext, from before passwords were hashed.
+const passwordHashPrefix = "$argon2id$"
+
+const (
+	passwordSaltBytes = 16
+	passwordKeyBytes  = 32
+)
+
+// HashPassword hashes a password with argon2id under a random salt and
+// PasswordHashParams, in the PHC string format
+// "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>". Accounts
+// store their passwords so hashed; CreateAccount hashes them on write.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate password salt: %v", err)
+	}
+	return encodePasswordHash(password, salt, PasswordHashParams), nil
+}
+
+func encodePasswordHash(password string, salt []byte, params Argon2Params) string {
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, passwordKeyBytes)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", passwordHashPrefix, argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// checkPassword reports whether password is the one stored, hashed or, for
+// accounts predating hashing, in plaintext, and whether the stored value
+// should be rehashed with the current parameters: plaintext passwords
+// always are.
+func checkPassword(stored, password string) (ok, rehash bool) {
+	if strings.HasPrefix(stored, passwordHashPrefix) {
+		var params Argon2Params
+		var version int
+		parts := strings.Split(strings.TrimPrefix(stored, passwordHashPrefix), "$")
+		if len(parts) != 4 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil || params.Time < 1 || params.Threads < 1 {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false, false
+		}
+		want := encodePasswordHash(password, salt, params)
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(want)) == 1
+		return ok, ok && params != PasswordHashParams
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
+
+// protectPassword hashes the password of a new NilUsers item in place.
+// Empty passwords, of accounts signing in elsewhere, are left empty. A
+// password that looks hashed is hashed like any other, so a caller cannot
+// store a hash of its choosing.
+func protectPassword(item map[string]types.AttributeValue) error {
+	password, ok := item["password"].(*types.AttributeValueMemberS)
+	if !ok || password.Value == "" {
+		return nil
+	}
+	hash, err := HashPassword(password.Value)
+	if err != nil {
+		return err
+	}
+	item["password"] = &types.AttributeValueMemberS{Value: hash}
+	return nil
+}
+
+// VerifyPassword reports whether password is the password of an account. A
+// password stored in plaintext, or hashed with other parameters than
+// PasswordHashParams, is rehashed once it is verified. Accounts without a
+// password never verify.
+func VerifyPassword(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, password string) (bool, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	user, err := fetchAccount(ctx, dbSvc, tenantId, accountId, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to get account %s: %v", accountId, err)
+	}
+	if user.Password == "" || password == "" {
+		return false, nil
+	}
+	ok, rehash := checkPassword(user.Password, password)
+	if rehash {
+		hash, err := HashPassword(password)
+		if err == nil {
+			err = replacePassword(ctx, dbSvc, tenantId, accountId, user.Password, hash)
+		}
+		if err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "failed to rehash password", "tenant", tenantId, "account", accountId, "error", err)
+		}
+	}
+	return ok, nil
+}
+
+// MigratePasswords hashes the passwords the tenant's accounts still store
+// in plaintext and returns how many it hashed. It can be run while accounts
+// are in use, and again until it hashes none.
+func MigratePasswords(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	migrated := 0
+	var cursor map[string]types.AttributeValue
+	for {
+		resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(NilUsers),
+			KeyConditionExpression: aws.String("TenantID = :tenant"),
+			FilterExpression:       aws.String("password <> :empty AND NOT begins_with(password, :prefix)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenant": &types.AttributeValueMemberS{Value: tenantId},
+				":empty":  &types.AttributeValueMemberS{Value: ""},
+				":prefix": &types.AttributeValueMemberS{Value: passwordHashPrefix},
+			},
+			ProjectionExpression: aws.String("AccountID, password"),
+			ExclusiveStartKey:    cursor,
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		for _, item := range resp.Items {
+			id, _ := item["AccountID"].(*types.AttributeValueMemberS)
+			password, _ := item["password"].(*types.AttributeValueMemberS)
+			if id == nil || password == nil {
+				continue
+			}
+			hash, err := HashPassword(password.Value)
+			if err != nil {
+				return migrated, err
+			}
+			err = replacePassword(ctx, dbSvc, tenantId, id.Value, password.Value, hash)
+			var condErr *types.ConditionalCheckFailedException
+			if errors.As(err, &condErr) {
+				// The password changed since it was read; it was written
+				// hashed.
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+		if resp.LastEvaluatedKey == nil {
+			return migrated, nil
+		}
+		cursor = resp.LastEvaluatedKey
+	}
+}
+
+// replacePassword stores hash as the password of an account, unless its
+// password is no longer old.
+func replacePassword(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, old, hash string) error {
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:    aws.String("SET password = :hash"),
+		ConditionExpression: aws.String("password = :old"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: hash},
+			":old":  &types.AttributeValueMemberS{Value: old},
+		},
+	})
+	return err
+}
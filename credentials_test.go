@@ -0,0 +1,41 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	defer func(p Argon2Params) { PasswordHashParams = p }(PasswordHashParams)
+	PasswordHashParams = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+	hash, err := HashPassword("hunter2")
+	if err != nil || !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") || strings.Contains(hash, "hunter2") {
+		t.Fatalf("HashPassword() = %q, %v", hash, err)
+	}
+	if other, _ := HashPassword("hunter2"); other == hash {
+		t.Error("HashPassword() is not salted")
+	}
+	tests := []struct {
+		stored, password string
+		ok, rehash       bool
+	}{
+		{hash, "hunter2", true, false},
+		{hash, "hunter3", false, false},
+		{"hunter2", "hunter2", true, true},
+		{"hunter2", "hunter", false, false},
+		{"$argon2id$v=19$m=64,t=0,p=1$salt$key", "hunter2", false, false},
+		{strings.Replace(hash, "v=19", "v=16", 1), "hunter2", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash := checkPassword(tt.stored, tt.password)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("checkPassword(%q, %q) = %v, %v, want %v, %v", tt.stored, tt.password, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+
+	PasswordHashParams.Time = 2
+	if ok, rehash := checkPassword(hash, "hunter2"); !ok || !rehash {
+		t.Errorf("checkPassword() after raising the parameters = %v, %v, want a rehash", ok, rehash)
+	}
+}
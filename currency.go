@@ -0,0 +1,110 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultCurrency is the currency of tenants that do not set
+// TenantConfig.DefaultCurrency.
+const DefaultCurrency = "SDG"
+
+// ErrInvalidCurrency is returned for a currency that is not an ISO 4217
+// code.
+var ErrInvalidCurrency = errors.New("invalid_currency")
+
+// ErrCurrencyMismatch is returned for a transfer between accounts in
+// different currencies, which the ledger does not convert.
+var ErrCurrencyMismatch = errors.New("currency_mismatch")
+
+// isoCurrencies are the active ISO 4217 alphabetic codes.
+var isoCurrencies = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+		BOB BOV BRL BSD BTN BWP BYN BZD CAD CDF CHE CHF CHW CLF CLP CNY COP COU
+		CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP
+		GMD GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES
+		KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD
+		MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR MZN NAD NGN NIO NOK NPR NZD OMR
+		PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD
+		SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS
+		UAH UGX USD USN UYI UYU UYW UZS VED VES VND VUV WST XAF XCD XOF XPF YER
+		ZAR ZMW ZWG`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// ValidateCurrency checks that code is an active ISO 4217 alphabetic code,
+// such as SDG or USD, in upper case.
+func ValidateCurrency(code string) error {
+	if !isoCurrencies[code] {
+		return fmt.Errorf("%w: %q is not an ISO 4217 currency code", ErrInvalidCurrency, code)
+	}
+	return nil
+}
+
+// currencyOf returns the currency of an account, DefaultCurrency for
+// accounts stored without one.
+func currencyOf(account *User) string {
+	if account == nil || account.Currency == "" {
+		return DefaultCurrency
+	}
+	return account.Currency
+}
+
+// currency returns the currency of the tenant's new accounts.
+func (cfg *TenantConfig) currency() string {
+	if cfg == nil || cfg.DefaultCurrency == "" {
+		return DefaultCurrency
+	}
+	return cfg.DefaultCurrency
+}
+
+// newAccountCurrency returns the currency of a new account, in upper case,
+// or the tenant's when the account sets none.
+func (cfg *TenantConfig) newAccountCurrency(currency string) (string, error) {
+	if currency == "" {
+		return cfg.currency(), nil
+	}
+	currency = strings.ToUpper(currency)
+	return currency, ValidateCurrency(currency)
+}
+
+// currencyMismatchError returns ErrCurrencyMismatch when the receiver's
+// currency is not the sender's.
+func (cfg *TenantConfig) currencyMismatchError(sender, receiver *User) error {
+	if from, to := cfg.accountCurrency(sender), cfg.accountCurrency(receiver); from != to {
+		return fmt.Errorf("%w: %s to %s", ErrCurrencyMismatch, from, to)
+	}
+	return nil
+}
+
+// accountCurrency returns the currency of an account, the tenant's for
+// accounts stored without one.
+func (cfg *TenantConfig) accountCurrency(account *User) string {
+	if account == nil || account.Currency == "" {
+		return cfg.currency()
+	}
+	return account.Currency
+}
+
+// AccountCurrency returns the currency of an account, or that of the
+// tenant's new accounts when accountId is empty.
+func AccountCurrency(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (string, error) {
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return "", err
+	}
+	if accountId == "" {
+		return cfg.currency(), nil
+	}
+	account, err := getAccount(ctx, dbSvc, cfg.TenantID, accountId)
+	if err != nil {
+		return "", err
+	}
+	return cfg.accountCurrency(account), nil
+}
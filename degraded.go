@@ -0,0 +1,275 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Ledger modes reported by Mode and in the Mode of transfer responses.
+const (
+	ModeNormal = "normal"
+	// ModeDegraded is entered while DynamoDB writes fail too often. Transfers
+	// still run; non-essential writes are refused and deferrable work is
+	// queued, to leave DynamoDB's capacity to them.
+	ModeDegraded = "degraded"
+)
+
+// MetricModeChanges counts mode changes, by the mode entered.
+const MetricModeChanges = "ledger.mode.changes"
+
+// ErrDegraded is returned for non-essential work refused in degraded mode,
+// such as anomaly detection and scheduled reports. Retry it once Mode is
+// back to normal.
+var ErrDegraded = errors.New("degraded_mode")
+
+// MaxDeferredWork bounds the work Defer holds in degraded mode.
+const MaxDeferredWork = 1000
+
+// DegradationPolicy decides when a Ledger enters and leaves degraded mode.
+type DegradationPolicy struct {
+	// MaxWriteErrorRate is the share of failed DynamoDB writes over Window
+	// above which the ledger degrades. Failed conditions are not errors.
+	MaxWriteErrorRate float64
+	// MinWrites is how many writes Window needs before the rate is judged.
+	MinWrites int
+	Window    time.Duration
+	// MinDuration is how long the ledger stays degraded before it may
+	// return to normal, so a flapping error rate does not flap the mode.
+	MinDuration time.Duration
+}
+
+// DefaultDegradationPolicy is used by WithDegradation for zero fields.
+var DefaultDegradationPolicy = DegradationPolicy{
+	MaxWriteErrorRate: 0.25,
+	MinWrites:         20,
+	Window:            time.Minute,
+	MinDuration:       30 * time.Second,
+}
+
+type writeSample struct {
+	at     time.Time
+	failed bool
+}
+
+type deferredWork struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// degradation tracks the write error rate of a Ledger and its mode.
+type degradation struct {
+	policy DegradationPolicy
+	now    func() time.Time
+
+	mu       sync.Mutex
+	samples  []writeSample
+	mode     string
+	since    time.Time
+	forced   string
+	deferred []deferredWork
+}
+
+// WithDegradation makes the Ledger enter degraded mode when its DynamoDB
+// write error rate exceeds the policy, and leave it once the rate recovers.
+func WithDegradation(policy DegradationPolicy) Option {
+	if policy.MaxWriteErrorRate <= 0 {
+		policy.MaxWriteErrorRate = DefaultDegradationPolicy.MaxWriteErrorRate
+	}
+	if policy.MinWrites <= 0 {
+		policy.MinWrites = DefaultDegradationPolicy.MinWrites
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultDegradationPolicy.Window
+	}
+	if policy.MinDuration < 0 {
+		policy.MinDuration = 0
+	}
+	return func(l *Ledger) {
+		l.degradation = &degradation{policy: policy, now: time.Now, mode: ModeNormal}
+	}
+}
+
+// Mode returns the mode of the ledger, ModeNormal unless WithDegradation is
+// set and writes are failing.
+func (l *Ledger) Mode() string {
+	if l.degradation == nil {
+		return ModeNormal
+	}
+	l.degradation.mu.Lock()
+	defer l.degradation.mu.Unlock()
+	if l.degradation.forced != "" {
+		return l.degradation.forced
+	}
+	return l.degradation.mode
+}
+
+// ForceMode pins the mode, e.g. ahead of a planned DynamoDB maintenance;
+// an empty mode goes back to following the error rate. It needs
+// WithDegradation.
+func (l *Ledger) ForceMode(ctx context.Context, mode string) {
+	if l.degradation == nil {
+		return
+	}
+	d := l.degradation
+	d.mu.Lock()
+	from := d.current()
+	d.forced = mode
+	to := d.current()
+	d.mu.Unlock()
+	l.modeChanged(ctx, from, to)
+}
+
+// current returns the effective mode. d.mu must be held.
+func (d *degradation) current() string {
+	if d.forced != "" {
+		return d.forced
+	}
+	return d.mode
+}
+
+// recordWrite adds the outcome of a write and returns the modes before and
+// after it.
+func (d *degradation) recordWrite(err error) (from, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	from = d.current()
+	now := d.now()
+	d.samples = append(d.samples, writeSample{at: now, failed: writeFailed(err)})
+	cutoff := now.Add(-d.policy.Window)
+	i := sort.Search(len(d.samples), func(i int) bool { return d.samples[i].at.After(cutoff) })
+	d.samples = d.samples[i:]
+
+	failures := 0
+	for _, s := range d.samples {
+		if s.failed {
+			failures++
+		}
+	}
+	judged := len(d.samples) >= d.policy.MinWrites
+	rate := float64(failures) / float64(len(d.samples))
+	switch {
+	case d.mode == ModeNormal && judged && rate > d.policy.MaxWriteErrorRate:
+		d.mode, d.since = ModeDegraded, now
+	case d.mode == ModeDegraded && now.Sub(d.since) >= d.policy.MinDuration && (!judged || rate <= d.policy.MaxWriteErrorRate):
+		d.mode, d.since = ModeNormal, now
+	}
+	return from, d.current()
+}
+
+// writeFailed reports whether err says DynamoDB is struggling, as opposed to
+// a failed condition or a canceled caller.
+func writeFailed(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var condErr *types.ConditionalCheckFailedException
+	var canceled *types.TransactionCanceledException
+	return !errors.As(err, &condErr) && !errors.As(err, &canceled) && !errors.Is(err, ErrDegraded)
+}
+
+func (l *Ledger) modeChanged(ctx context.Context, from, to string) {
+	if from == to {
+		return
+	}
+	l.metrics.AddCounter(ctx, MetricModeChanges, 1, Attr("mode", to))
+	if to == ModeNormal {
+		l.logger.InfoContext(ctx, "ledger mode changed", "from", from, "to", to, "deferred", l.Deferred())
+		return
+	}
+	l.logger.WarnContext(ctx, "ledger mode changed", "from", from, "to", to)
+}
+
+// write runs a DynamoDB write and feeds its outcome to the degradation
+// policy. Writes to non-essential tables are refused while degraded.
+func (l *Ledger) write(ctx context.Context, table string, fn func() error) error {
+	if l.degradation == nil {
+		return fn()
+	}
+	if l.Mode() == ModeDegraded && nonEssentialTable(table) {
+		return fmt.Errorf("%w: write to %s refused", ErrDegraded, table)
+	}
+	err := fn()
+	from, to := l.degradation.recordWrite(err)
+	l.modeChanged(ctx, from, to)
+	return err
+}
+
+// nonEssentialTable reports whether writes to table can be dropped in
+// degraded mode: analytics and reporting state that is rebuilt by a later
+// run.
+func nonEssentialTable(table string) bool {
+	switch table {
+	case AnomaliesTable, AnomalyBaselinesTable, ReportSubscriptionsTable:
+		return true
+	}
+	return false
+}
+
+// degraded reports whether dbSvc is a Ledger in degraded mode.
+func degraded(dbSvc DynamoDBAPI) bool {
+	l, ok := dbSvc.(*Ledger)
+	return ok && l.Mode() == ModeDegraded
+}
+
+// Defer runs fn now, unless dbSvc is a Ledger in degraded mode, in which case
+// fn is queued for RunDeferred. Use it for work that may be late but should
+// not be lost, such as notifications. It returns ErrDegraded when the queue
+// is full.
+func Defer(ctx context.Context, dbSvc DynamoDBAPI, name string, fn func(ctx context.Context) error) error {
+	l, ok := dbSvc.(*Ledger)
+	if !ok || l.Mode() != ModeDegraded {
+		return fn(ctx)
+	}
+	d := l.degradation
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.deferred) >= MaxDeferredWork {
+		return fmt.Errorf("%w: deferred work queue is full, dropping %s", ErrDegraded, name)
+	}
+	d.deferred = append(d.deferred, deferredWork{name: name, fn: fn})
+	return nil
+}
+
+// Deferred returns how much work is waiting for RunDeferred.
+func (l *Ledger) Deferred() int {
+	if l.degradation == nil {
+		return 0
+	}
+	l.degradation.mu.Lock()
+	defer l.degradation.mu.Unlock()
+	return len(l.degradation.deferred)
+}
+
+// RunDeferred runs the work queued by Defer, e.g. from a periodic job. It
+// does nothing while the ledger is degraded; work that fails is dropped and
+// its errors returned.
+func (l *Ledger) RunDeferred(ctx context.Context) error {
+	if l.degradation == nil || l.Mode() == ModeDegraded {
+		return nil
+	}
+	d := l.degradation
+	d.mu.Lock()
+	queue := d.deferred
+	d.deferred = nil
+	d.mu.Unlock()
+
+	var errs []error
+	for i, work := range queue {
+		if ctx.Err() != nil || l.Mode() == ModeDegraded {
+			d.mu.Lock()
+			d.deferred = append(queue[i:len(queue):len(queue)], d.deferred...)
+			d.mu.Unlock()
+			break
+		}
+		if err := work.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", work.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
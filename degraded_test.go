@@ -0,0 +1,70 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestWriteFailed(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("ProvisionedThroughputExceededException"), true},
+		{fmt.Errorf("wrapped: %w", &types.ConditionalCheckFailedException{}), false},
+		{&types.TransactionCanceledException{}, false},
+		{context.Canceled, false},
+		{ErrDegraded, false},
+	}
+	for _, tt := range tests {
+		if got := writeFailed(tt.err); got != tt.want {
+			t.Errorf("writeFailed(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDegradationModes(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), step: time.Second}
+	d := &degradation{
+		policy: DegradationPolicy{MaxWriteErrorRate: 0.4, MinWrites: 4, Window: 10 * time.Second, MinDuration: 5 * time.Second},
+		now:    clock.now,
+		mode:   ModeNormal,
+	}
+	fail := errors.New("throttled")
+
+	steps := []struct {
+		err  error
+		want string
+	}{
+		// Too few writes to judge.
+		{fail, ModeNormal},
+		{fail, ModeNormal},
+		{fail, ModeNormal},
+		{fail, ModeDegraded},
+		// Degraded for at least MinDuration, however the writes go.
+		{nil, ModeDegraded},
+		{nil, ModeDegraded},
+		{nil, ModeDegraded},
+		{nil, ModeDegraded},
+		// 4 of 9 writes failed.
+		{nil, ModeDegraded},
+		// 4 of 10.
+		{nil, ModeNormal},
+	}
+	for i, step := range steps {
+		if _, got := d.recordWrite(step.err); got != step.want {
+			t.Fatalf("write %d: mode = %s, want %s", i, got, step.want)
+		}
+	}
+
+	d.forced = ModeDegraded
+	if from, to := d.recordWrite(nil); from != ModeDegraded || to != ModeDegraded {
+		t.Errorf("forced mode = %s -> %s, want degraded", from, to)
+	}
+}
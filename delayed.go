@@ -0,0 +1,348 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DelayedTransfersTable holds large transfers waiting for release. It needs a
+// StatusReleaseAtIndex GSI (Status, ReleaseAt) for the release job.
+var DelayedTransfersTable = "DelayedTransfers"
+
+// DefaultLargeTransferDelay is the hold applied when a tenant sets a large
+// transfer threshold without a delay.
+var DefaultLargeTransferDelay = time.Hour
+
+// DelayedTransferReminderLead is how long before release the sender gets a
+// last reminder that the transfer can still be cancelled.
+var DelayedTransferReminderLead = 15 * time.Minute
+
+const (
+	DelayedTransferPending   = "pending"
+	DelayedTransferReleasing = "releasing"
+	DelayedTransferReleased  = "released"
+	DelayedTransferCancelled = "cancelled"
+	DelayedTransferFailed    = "failed"
+)
+
+// DelayedTransfer is a large transfer held until ReleaseAt. Nothing is debited
+// while it is pending; the balance is checked again when it is released.
+type DelayedTransfer struct {
+	TenantID   string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	TransferID string `dynamodbav:"TransferID" json:"transfer_id,omitempty"`
+	// AccountID is the sender, the only account allowed to cancel.
+	AccountID string           `dynamodbav:"AccountID" json:"account_id,omitempty"`
+	Transfer  TransactionEntry `dynamodbav:"Transfer" json:"transfer"`
+	// Splits are the receivers of a split transfer, whose Transfer is their
+	// total to SplitToAccount.
+	Splits       []Split `dynamodbav:"Splits,omitempty" json:"splits,omitempty"`
+	Status       string  `dynamodbav:"Status" json:"status"`
+	ReleaseAt    int64   `dynamodbav:"ReleaseAt" json:"release_at"`
+	ReminderSent bool    `dynamodbav:"ReminderSent" json:"reminder_sent,omitempty"`
+	// TransactionID is the transaction created on release.
+	TransactionID string `dynamodbav:"TransactionID,omitempty" json:"transaction_id,omitempty"`
+	FailureReason string `dynamodbav:"FailureReason,omitempty" json:"failure_reason,omitempty"`
+	CreatedAt     int64  `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+	UpdatedAt     int64  `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// holdsTransfer reports whether a transfer of amount must wait for release.
+func (c *TenantConfig) holdsTransfer(amount float64) bool {
+	return c.LargeTransferThreshold > 0 && amount > c.LargeTransferThreshold
+}
+
+func (c *TenantConfig) largeTransferDelay() time.Duration {
+	if c.LargeTransferDelay <= 0 {
+		return DefaultLargeTransferDelay
+	}
+	return time.Duration(c.LargeTransferDelay) * time.Second
+}
+
+// holdTransfer stores a transfer, or the total of splits, for later release
+// and notifies the sender.
+func holdTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantCfg *TenantConfig, req TransferRequest, splits []Split) (NilResponse, error) {
+	now := clockOf(dbSvc).Now().UTC()
+	held := DelayedTransfer{
+		TenantID:   req.TenantID,
+		TransferID: newID(dbSvc),
+		AccountID:  req.FromAccount,
+		Transfer:   req.Entry(),
+		Splits:     splits,
+		Status:     DelayedTransferPending,
+		ReleaseAt:  now.Add(tenantCfg.largeTransferDelay()).Unix(),
+		CreatedAt:  now.Unix(),
+		UpdatedAt:  now.Unix(),
+	}
+	item, err := attributevalue.MarshalMap(held)
+	if err != nil {
+		return failedResponse(req, "hold_failed", "Failed to hold the transfer.", err.Error()), fmt.Errorf("failed to marshal delayed transfer: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DelayedTransfersTable),
+		Item:      item,
+	})
+	if err != nil {
+		return failedResponse(req, "hold_failed", "Failed to hold the transfer.", err.Error()), fmt.Errorf("failed to store delayed transfer: %v", err)
+	}
+
+	releaseAt := time.Unix(held.ReleaseAt, 0).UTC().Format(time.RFC3339)
+	notify(ctx, dbSvc, held.TenantID, held.AccountID, fmt.Sprintf(
+		"Your transfer of %.2f to %s will be sent at %s. If you did not make it, cancel it before then. Reference: %s",
+		req.Amount, receiverOf(req.ToAccount, splits), releaseAt, held.TransferID))
+
+	return NilResponse{
+		Status:    "pending",
+		Code:      "transfer_delayed",
+		Message:   "The transfer is held for review and will be released later.",
+		Details:   fmt.Sprintf("The transfer will be released at %s unless it is cancelled.", releaseAt),
+		Timestamp: req.Timestamp,
+		Data: data{
+			TransactionID: held.TransferID,
+			Amount:        req.Amount,
+			UUID:          req.InitiatorUUID,
+			SignedUUID:    req.SignedUUID,
+		},
+	}, nil
+}
+
+// GetDelayedTransfer retrieves a held transfer by its ID.
+func GetDelayedTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transferId string) (*DelayedTransfer, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(DelayedTransfersTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: tenantId},
+			"TransferID": &types.AttributeValueMemberS{Value: transferId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delayed transfer %s: %v", transferId, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("delayed transfer %s not found", transferId)
+	}
+
+	var held DelayedTransfer
+	if err := attributevalue.UnmarshalMap(result.Item, &held); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal delayed transfer: %v", err)
+	}
+	return &held, nil
+}
+
+// CancelDelayedTransfer cancels a held transfer on behalf of its sender. It
+// fails once the transfer has been released or cancelled.
+func CancelDelayedTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, transferId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DelayedTransfersTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: tenantId},
+			"TransferID": &types.AttributeValueMemberS{Value: transferId},
+		},
+		UpdateExpression:         aws.String("SET #status = :cancelled, UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending AND AccountID = :accountId"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":cancelled": &types.AttributeValueMemberS{Value: DelayedTransferCancelled},
+			":pending":   &types.AttributeValueMemberS{Value: DelayedTransferPending},
+			":accountId": &types.AttributeValueMemberS{Value: accountId},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("delayed transfer %s cannot be cancelled", transferId)
+		}
+		return fmt.Errorf("failed to cancel delayed transfer %s: %v", transferId, err)
+	}
+	notify(ctx, dbSvc, tenantId, accountId, fmt.Sprintf("Your transfer %s has been cancelled.", transferId))
+	return nil
+}
+
+// ProcessDelayedTransfers is run periodically to send the pre-release
+// reminders and release the held transfers that are due. A transfer that
+// fails on release is marked failed and reported to the sender; the other
+// transfers are still processed. Transfers of tenants under maintenance are
+// left for a later run.
+func ProcessDelayedTransfers(ctx context.Context, dbSvc DynamoDBAPI, now time.Time) error {
+	horizon := now.Add(DelayedTransferReminderLead).Unix()
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(DelayedTransfersTable),
+		IndexName:                aws.String("StatusReleaseAtIndex"),
+		KeyConditionExpression:   aws.String("#status = :pending AND ReleaseAt <= :horizon"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: DelayedTransferPending},
+			":horizon": &types.AttributeValueMemberN{Value: strconv.FormatInt(horizon, 10)},
+		},
+	}
+
+	var errs []error
+	maintenance := map[string]bool{}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to query delayed transfers: %v", err)
+		}
+		var page []DelayedTransfer
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return fmt.Errorf("failed to unmarshal delayed transfers: %v", err)
+		}
+		for _, held := range page {
+			switch held.dueAction(now) {
+			case delayedRemind:
+				errs = append(errs, remindDelayedTransfer(ctx, dbSvc, held))
+			case delayedRelease:
+				paused, ok := maintenance[held.TenantID]
+				if !ok {
+					cfg, err := GetTenantConfig(ctx, dbSvc, held.TenantID)
+					if err != nil {
+						errs = append(errs, err)
+						continue
+					}
+					paused = cfg.Maintenance != nil
+					maintenance[held.TenantID] = paused
+				}
+				if !paused {
+					errs = append(errs, releaseDelayedTransfer(ctx, dbSvc, held))
+				}
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return errors.Join(errs...)
+}
+
+type delayedAction int
+
+const (
+	delayedNone delayedAction = iota
+	delayedRemind
+	delayedRelease
+)
+
+// dueAction returns what the release job has to do with a held transfer at now.
+func (d DelayedTransfer) dueAction(now time.Time) delayedAction {
+	switch {
+	case d.Status != DelayedTransferPending:
+		return delayedNone
+	case now.Unix() >= d.ReleaseAt:
+		return delayedRelease
+	case !d.ReminderSent && now.Add(DelayedTransferReminderLead).Unix() >= d.ReleaseAt:
+		return delayedRemind
+	default:
+		return delayedNone
+	}
+}
+
+func remindDelayedTransfer(ctx context.Context, dbSvc DynamoDBAPI, held DelayedTransfer) error {
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DelayedTransfersTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: held.TenantID},
+			"TransferID": &types.AttributeValueMemberS{Value: held.TransferID},
+		},
+		UpdateExpression:         aws.String("SET ReminderSent = :true, UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending AND ReminderSent = :false"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":    &types.AttributeValueMemberBOOL{Value: true},
+			":false":   &types.AttributeValueMemberBOOL{Value: false},
+			":pending": &types.AttributeValueMemberS{Value: DelayedTransferPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			// Cancelled or reminded by another run in the meantime.
+			return nil
+		}
+		return fmt.Errorf("failed to mark reminder for delayed transfer %s: %v", held.TransferID, err)
+	}
+	notify(ctx, dbSvc, held.TenantID, held.AccountID, fmt.Sprintf(
+		"Your transfer of %.2f to %s will be sent at %s. This is the last chance to cancel it. Reference: %s",
+		held.Transfer.Amount, receiverOf(held.Transfer.ToAccount, held.Splits), time.Unix(held.ReleaseAt, 0).UTC().Format(time.RFC3339), held.TransferID))
+	return nil
+}
+
+// releaseDelayedTransfer claims a due transfer so it is executed only once,
+// executes it and records the outcome.
+func releaseDelayedTransfer(ctx context.Context, dbSvc DynamoDBAPI, held DelayedTransfer) error {
+	if err := setDelayedTransferStatus(ctx, dbSvc, held, DelayedTransferPending, DelayedTransferReleasing, nil); err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			// Cancelled or claimed by another run in the meantime.
+			return nil
+		}
+		return err
+	}
+
+	response, transferErr := executePending(ctx, dbSvc, held.Transfer, held.Splits, transferOptions{skipDelay: true})
+	status := DelayedTransferReleased
+	updates := map[string]types.AttributeValue{
+		"TransactionID": &types.AttributeValueMemberS{Value: response.Data.TransactionID},
+	}
+	to := receiverOf(held.Transfer.ToAccount, held.Splits)
+	message := fmt.Sprintf("Your transfer %s of %.2f to %s has been sent.", held.TransferID, held.Transfer.Amount, to)
+	if transferErr != nil {
+		status = DelayedTransferFailed
+		updates = map[string]types.AttributeValue{
+			"FailureReason": &types.AttributeValueMemberS{Value: response.Code},
+		}
+		message = fmt.Sprintf("Your transfer %s of %.2f to %s could not be sent: %s", held.TransferID, held.Transfer.Amount, to, response.Message)
+	}
+	if err := setDelayedTransferStatus(ctx, dbSvc, held, DelayedTransferReleasing, status, updates); err != nil {
+		return errors.Join(transferErr, err)
+	}
+	notify(ctx, dbSvc, held.TenantID, held.AccountID, message)
+	if transferErr != nil {
+		return fmt.Errorf("failed to release delayed transfer %s: %v", held.TransferID, transferErr)
+	}
+	return nil
+}
+
+func setDelayedTransferStatus(ctx context.Context, dbSvc DynamoDBAPI, held DelayedTransfer, from, to string, updates map[string]types.AttributeValue) error {
+	expr := "SET #status = :to, UpdatedAt = :now"
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: from},
+		":to":   &types.AttributeValueMemberS{Value: to},
+		":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+	}
+	for name, value := range updates {
+		expr += fmt.Sprintf(", %s = :%s", name, name)
+		values[":"+name] = value
+	}
+
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DelayedTransfersTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: held.TenantID},
+			"TransferID": &types.AttributeValueMemberS{Value: held.TransferID},
+		},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String("#status = :from"),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update delayed transfer %s: %w", held.TransferID, err)
+	}
+	return nil
+}
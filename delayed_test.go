@@ -0,0 +1,75 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTenantConfigHoldsTransfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    TenantConfig
+		amount float64
+		want   bool
+	}{
+		{"no threshold", TenantConfig{}, 1_000_000, false},
+		{"below threshold", TenantConfig{LargeTransferThreshold: 500}, 499, false},
+		{"at threshold", TenantConfig{LargeTransferThreshold: 500}, 500, false},
+		{"above threshold", TenantConfig{LargeTransferThreshold: 500}, 500.01, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.holdsTransfer(tt.amount); got != tt.want {
+				t.Errorf("holdsTransfer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelayedTransferDueAction(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	lead := DelayedTransferReminderLead
+	tests := []struct {
+		name string
+		held DelayedTransfer
+		want delayedAction
+	}{
+		{
+			name: "far from release",
+			held: DelayedTransfer{Status: DelayedTransferPending, ReleaseAt: now.Add(2 * lead).Unix()},
+			want: delayedNone,
+		},
+		{
+			name: "within reminder lead",
+			held: DelayedTransfer{Status: DelayedTransferPending, ReleaseAt: now.Add(lead / 2).Unix()},
+			want: delayedRemind,
+		},
+		{
+			name: "already reminded",
+			held: DelayedTransfer{Status: DelayedTransferPending, ReleaseAt: now.Add(lead / 2).Unix(), ReminderSent: true},
+			want: delayedNone,
+		},
+		{
+			name: "due",
+			held: DelayedTransfer{Status: DelayedTransferPending, ReleaseAt: now.Unix()},
+			want: delayedRelease,
+		},
+		{
+			name: "due without reminder",
+			held: DelayedTransfer{Status: DelayedTransferPending, ReleaseAt: now.Add(-time.Minute).Unix()},
+			want: delayedRelease,
+		},
+		{
+			name: "cancelled",
+			held: DelayedTransfer{Status: DelayedTransferCancelled, ReleaseAt: now.Add(-time.Minute).Unix()},
+			want: delayedNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.held.dueAction(now); got != tt.want {
+				t.Errorf("dueAction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
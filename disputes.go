@@ -0,0 +1,476 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DisputesTable holds the disputes of OpenDispute, keyed by TenantID and
+// the TransactionID of the disputed transfer, so a transfer is disputed at
+// most once.
+var DisputesTable = "Disputes"
+
+const (
+	DisputeOpen     = "open"
+	DisputeReversed = "reversed"
+	DisputeReleased = "released"
+)
+
+// MaxDisputeEvidence is the most evidence attachments a dispute may have,
+// and MaxEvidenceKeyLength the longest S3 object key accepted for one.
+const (
+	MaxDisputeEvidence   = 20
+	MaxEvidenceKeyLength = 1024
+)
+
+// ErrNotDisputable is returned for a transaction that is not a completed
+// transfer, or for more than its amount.
+var ErrNotDisputable = errors.New("not_disputable")
+
+// ErrDisputeExists is returned when a transfer already has a dispute.
+var ErrDisputeExists = errors.New("dispute_exists")
+
+// ErrDisputeNotOpen is returned for a dispute that was already resolved.
+var ErrDisputeNotOpen = errors.New("dispute_not_open")
+
+// Dispute is a chargeback of a transfer. While it is open the disputed
+// amount is frozen: it is taken from the receiver into the tenant's
+// DisputeHoldingAccount, so it cannot be spent. ResolveDispute then either
+// reverses it to the sender or releases it back to the receiver.
+//
+// The freeze and the settlement are transactions of their own in
+// TransactionsTable, carrying the dispute_id metadata, and every change of
+// the dispute's status is appended to its History.
+type Dispute struct {
+	TenantID      string `dynamodbav:"TenantID" json:"tenant_id"`
+	TransactionID string `dynamodbav:"TransactionID" json:"transaction_id"`
+	// FromAccount is the sender of the disputed transfer, who gets the
+	// money back if the dispute is reversed, and ToAccount its receiver,
+	// whose money is frozen.
+	FromAccount string  `dynamodbav:"FromAccount" json:"from_account"`
+	ToAccount   string  `dynamodbav:"ToAccount" json:"to_account"`
+	Amount      float64 `dynamodbav:"Amount" json:"amount"`
+	Currency    string  `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
+	Reason      string  `dynamodbav:"Reason" json:"reason"`
+	OpenedBy    string  `dynamodbav:"OpenedBy" json:"opened_by"`
+	Status      string  `dynamodbav:"Status" json:"status"`
+	// FreezeID is the transaction that froze the amount, and SettlementID
+	// the one that reversed or released it.
+	FreezeID     string            `dynamodbav:"FreezeID" json:"freeze_id"`
+	SettlementID string            `dynamodbav:"SettlementID,omitempty" json:"settlement_id,omitempty"`
+	Evidence     []DisputeEvidence `dynamodbav:"Evidence,omitempty" json:"evidence,omitempty"`
+	History      []DisputeChange   `dynamodbav:"History" json:"history"`
+	CreatedAt    int64             `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt    int64             `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// DisputeEvidence is a document attached to a dispute, stored in S3 under
+// Key.
+type DisputeEvidence struct {
+	Key     string `dynamodbav:"Key" json:"key"`
+	AddedBy string `dynamodbav:"AddedBy" json:"added_by"`
+	Time    int64  `dynamodbav:"Time" json:"time"`
+}
+
+// DisputeChange is an entry of a dispute's status history. From is empty
+// for the opening of the dispute.
+type DisputeChange struct {
+	From   string `dynamodbav:"From,omitempty" json:"from,omitempty"`
+	To     string `dynamodbav:"To" json:"to"`
+	Actor  string `dynamodbav:"Actor" json:"actor"`
+	Reason string `dynamodbav:"Reason,omitempty" json:"reason,omitempty"`
+	Time   int64  `dynamodbav:"Time" json:"time"`
+}
+
+// OpenDisputeRequest disputes a transfer with OpenDispute.
+type OpenDisputeRequest struct {
+	TenantID      string `json:"tenant_id,omitempty"`
+	TransactionID string `json:"transaction_id"`
+	// Amount is how much of the transfer is disputed; all of it when zero.
+	Amount float64 `json:"amount,omitempty"`
+	Reason string  `json:"reason"`
+	// Actor is who opens the dispute, such as the sender or an operator.
+	Actor string `json:"actor"`
+}
+
+// OpenDispute disputes a completed transfer, freezing the disputed amount
+// in the tenant's DisputeHoldingAccount until ResolveDispute. The receiver
+// must still hold the amount.
+func OpenDispute(ctx context.Context, dbSvc DynamoDBAPI, req OpenDisputeRequest) (*Dispute, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	if strings.TrimSpace(req.Actor) == "" {
+		return nil, errors.New("actor is required to open a dispute")
+	}
+	reason, err := SanitizeNarrative(req.Reason)
+	if err != nil {
+		return nil, err
+	}
+	if reason == "" {
+		return nil, errors.New("a dispute needs a reason")
+	}
+	tx, err := getTransactionForUpdate(ctx, dbSvc, req.TenantID, req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Status == nil || *tx.Status != TransactionCompleted || tx.FromAccount == "" || tx.ToAccount == "" {
+		return nil, fmt.Errorf("%w: transaction %s is not a completed transfer", ErrNotDisputable, req.TransactionID)
+	}
+	if _, err := GetDispute(ctx, dbSvc, req.TenantID, req.TransactionID); err == nil {
+		return nil, fmt.Errorf("%w: transaction %s", ErrDisputeExists, req.TransactionID)
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = tx.Amount
+	}
+	if amount < 0 || roundAmount(amount) != amount {
+		return nil, errors.New("amount must be positive with at most two decimals")
+	}
+	if amount > tx.Amount {
+		return nil, fmt.Errorf("%w: %.2f is more than the %.2f transferred", ErrNotDisputable, amount, tx.Amount)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.DisputeHoldingAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no dispute holding account", req.TenantID)
+	}
+	receiver, err := readAccount(ctx, dbSvc, req.TenantID, tx.ToAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", tx.ToAccount, err)
+	}
+	if roundAmount(receiver.Amount-amount) < cfg.balanceFloor(receiver) {
+		return nil, fmt.Errorf("insufficient balance: account %s no longer holds %.2f", tx.ToAccount, amount)
+	}
+
+	timestamp := clockOf(dbSvc).Now().Unix()
+	dispute := &Dispute{
+		TenantID:      req.TenantID,
+		TransactionID: req.TransactionID,
+		FromAccount:   tx.FromAccount,
+		ToAccount:     tx.ToAccount,
+		Amount:        amount,
+		Currency:      tx.Currency,
+		Reason:        reason,
+		OpenedBy:      req.Actor,
+		Status:        DisputeOpen,
+		FreezeID:      newID(dbSvc),
+		History:       []DisputeChange{{To: DisputeOpen, Actor: req.Actor, Reason: reason, Time: timestamp}},
+		CreatedAt:     timestamp,
+		UpdatedAt:     timestamp,
+	}
+	item, err := attributevalue.MarshalMap(dispute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dispute: %v", err)
+	}
+	legs := []JournalLeg{
+		{AccountID: tx.ToAccount, Type: LegDebit, Amount: amount},
+		{AccountID: cfg.DisputeHoldingAccount, Type: LegCredit, Amount: amount},
+	}
+	record, err := disputeRecord(*dispute, dispute.FreezeID, NarrativeDisputeFrozen, tx.ToAccount, cfg.DisputeHoldingAccount, legs, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[string]*User{tx.ToAccount: receiver}
+	err = postJournal(ctx, dbSvc, req.TenantID, dispute.FreezeID, "", receiver, legs, nil, accounts, timestamp, record, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(DisputesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(TransactionID)"),
+	}})
+	if err != nil {
+		if _, getErr := GetDispute(ctx, dbSvc, req.TenantID, req.TransactionID); getErr == nil {
+			return nil, fmt.Errorf("%w: transaction %s", ErrDisputeExists, req.TransactionID)
+		}
+		return nil, fmt.Errorf("failed to freeze disputed amount: %v", err)
+	}
+	dispute.notify(ctx, dbSvc, fmt.Sprintf("Transaction %s is disputed; %.2f is frozen until the dispute is resolved.", dispute.TransactionID, dispute.Amount))
+	return dispute, nil
+}
+
+// disputeRecord returns the transaction item recording a movement of a
+// dispute's funds.
+func disputeRecord(dispute Dispute, journalId, comment, from, to string, legs []JournalLeg, timestamp int64) (types.TransactWriteItem, error) {
+	record := newTransactionRecord(TransferRequest{
+		TenantID:    dispute.TenantID,
+		FromAccount: from,
+		ToAccount:   to,
+		Amount:      dispute.Amount,
+		Narrative:   dispute.Reason,
+		Metadata:    map[string]string{"dispute_id": dispute.TransactionID},
+	}, comment, journalId, timestamp)
+	record.Status = TransactionCompleted
+	record.Currency = dispute.Currency
+	record.JournalID = journalId
+	record.ParentTransactionID = dispute.TransactionID
+	record.Legs = legs
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: av}}, nil
+}
+
+// notify tells both parties of a dispute about it.
+func (d *Dispute) notify(ctx context.Context, dbSvc DynamoDBAPI, message string) {
+	notify(ctx, dbSvc, d.TenantID, d.FromAccount, message)
+	notify(ctx, dbSvc, d.TenantID, d.ToAccount, message)
+}
+
+// GetDispute returns the dispute of a transaction.
+func GetDispute(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) (*Dispute, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(DisputesTable),
+		Key:            disputeKey(tenantId, transactionId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dispute: %v", err)
+	}
+	if result.Item == nil {
+		return nil, errors.New("dispute not found")
+	}
+	var dispute Dispute
+	if err := attributevalue.UnmarshalMap(result.Item, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dispute: %v", err)
+	}
+	return &dispute, nil
+}
+
+func disputeKey(tenantId, transactionId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+		"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+	}
+}
+
+// GetAccountDisputes returns the disputes of a tenant in which an account
+// is the sender or the receiver of the disputed transfer.
+func GetAccountDisputes(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]Dispute, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(DisputesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		FilterExpression:       aws.String("FromAccount = :accountId OR ToAccount = :accountId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId":  &types.AttributeValueMemberS{Value: tenantId},
+			":accountId": &types.AttributeValueMemberS{Value: accountId},
+		},
+	}
+	var disputes []Dispute
+	for {
+		output, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query disputes: %v", err)
+		}
+		var page []Dispute
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal disputes: %v", err)
+		}
+		disputes = append(disputes, page...)
+		if len(output.LastEvaluatedKey) == 0 {
+			return disputes, nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// AddDisputeEvidence attaches the S3 object key of a document, such as a
+// receipt or a delivery note, to an open dispute.
+func AddDisputeEvidence(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId, actor, key string) (*Dispute, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if strings.TrimSpace(actor) == "" {
+		return nil, errors.New("actor is required to add evidence")
+	}
+	if key == "" || len(key) > MaxEvidenceKeyLength {
+		return nil, fmt.Errorf("evidence key must be 1 to %d bytes", MaxEvidenceKeyLength)
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	evidence, err := attributevalue.Marshal(DisputeEvidence{Key: key, AddedBy: actor, Time: timestamp})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal evidence: %v", err)
+	}
+	result, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(DisputesTable),
+		Key:              disputeKey(tenantId, transactionId),
+		UpdateExpression: aws.String("SET #evidence = list_append(if_not_exists(#evidence, :empty), :evidence), UpdatedAt = :now"),
+		ConditionExpression: aws.String("#status = :open AND " +
+			"(attribute_not_exists(#evidence) OR size(#evidence) < :max)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":   "Status",
+			"#evidence": "Evidence",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":open":     &types.AttributeValueMemberS{Value: DisputeOpen},
+			":evidence": &types.AttributeValueMemberL{Value: []types.AttributeValue{evidence}},
+			":empty":    &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":max":      &types.AttributeValueMemberN{Value: strconv.Itoa(MaxDisputeEvidence)},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			dispute, getErr := GetDispute(ctx, dbSvc, tenantId, transactionId)
+			switch {
+			case getErr != nil:
+				return nil, getErr
+			case dispute.Status != DisputeOpen:
+				return nil, fmt.Errorf("%w: dispute of %s is %s", ErrDisputeNotOpen, transactionId, dispute.Status)
+			}
+			return nil, fmt.Errorf("dispute of %s already has %d evidence attachments", transactionId, MaxDisputeEvidence)
+		}
+		return nil, fmt.Errorf("failed to add evidence: %v", err)
+	}
+	var dispute Dispute
+	if err := attributevalue.UnmarshalMap(result.Attributes, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dispute: %v", err)
+	}
+	return &dispute, nil
+}
+
+// ResolveDispute closes an open dispute with outcome DisputeReversed, paying
+// the frozen amount back to the sender, or DisputeReleased, returning it to
+// the receiver. Reversing a dispute of the whole amount also moves the
+// disputed transfer to TransactionReversed.
+func ResolveDispute(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId, outcome, actor, reason string) (*Dispute, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if outcome != DisputeReversed && outcome != DisputeReleased {
+		return nil, fmt.Errorf("unknown dispute outcome: %s", outcome)
+	}
+	if strings.TrimSpace(actor) == "" {
+		return nil, errors.New("actor is required to resolve a dispute")
+	}
+	reason, err := SanitizeNarrative(reason)
+	if err != nil {
+		return nil, err
+	}
+	dispute, err := GetDispute(ctx, dbSvc, tenantId, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	if dispute.Status != DisputeOpen {
+		return nil, fmt.Errorf("%w: dispute of %s is %s", ErrDisputeNotOpen, transactionId, dispute.Status)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.DisputeHoldingAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no dispute holding account", tenantId)
+	}
+
+	to, comment := dispute.ToAccount, NarrativeDisputeReleased
+	if outcome == DisputeReversed {
+		to, comment = dispute.FromAccount, NarrativeDisputeReversed
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	change := DisputeChange{From: DisputeOpen, To: outcome, Actor: actor, Reason: reason, Time: timestamp}
+	history, err := attributevalue.Marshal(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dispute change: %v", err)
+	}
+	var reversal *types.TransactWriteItem
+	if outcome == DisputeReversed {
+		if reversal, err = disputedTransferReversal(ctx, dbSvc, *dispute, actor, reason, timestamp); err != nil {
+			return nil, err
+		}
+	}
+	journalId, err := settleHeld(ctx, dbSvc, tenantId, cfg.DisputeHoldingAccount, to, dispute.Amount, timestamp, func(journalId string, legs []JournalLeg) ([]types.TransactWriteItem, error) {
+		record, err := disputeRecord(*dispute, journalId, comment, cfg.DisputeHoldingAccount, to, legs, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		items := []types.TransactWriteItem{record, {Update: &types.Update{
+			TableName:                aws.String(DisputesTable),
+			Key:                      disputeKey(tenantId, transactionId),
+			UpdateExpression:         aws.String("SET #status = :status, SettlementID = :settlement, UpdatedAt = :now, History = list_append(History, :change)"),
+			ConditionExpression:      aws.String("#status = :open"),
+			ExpressionAttributeNames: map[string]string{"#status": "Status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status":     &types.AttributeValueMemberS{Value: outcome},
+				":open":       &types.AttributeValueMemberS{Value: DisputeOpen},
+				":settlement": &types.AttributeValueMemberS{Value: journalId},
+				":now":        &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+				":change":     &types.AttributeValueMemberL{Value: []types.AttributeValue{history}},
+			},
+		}}}
+		if reversal != nil {
+			items = append(items, *reversal)
+		}
+		return items, nil
+	})
+	if err != nil {
+		if current, getErr := GetDispute(ctx, dbSvc, tenantId, transactionId); getErr == nil && current.Status != DisputeOpen {
+			return nil, fmt.Errorf("%w: dispute of %s was %s concurrently", ErrDisputeNotOpen, transactionId, current.Status)
+		}
+		return nil, fmt.Errorf("failed to resolve dispute of %s: %v", transactionId, err)
+	}
+	dispute.Status, dispute.SettlementID, dispute.UpdatedAt = outcome, journalId, timestamp
+	dispute.History = append(dispute.History, change)
+	dispute.notify(ctx, dbSvc, fmt.Sprintf("The dispute of transaction %s is resolved: %.2f was %s to %s.", transactionId, dispute.Amount, outcome, to))
+	return dispute, nil
+}
+
+// disputedTransferReversal returns the update moving a transfer disputed in
+// full to TransactionReversed, or nil for a partial dispute, whose transfer
+// stays completed.
+func disputedTransferReversal(ctx context.Context, dbSvc DynamoDBAPI, dispute Dispute, actor, reason string, timestamp int64) (*types.TransactWriteItem, error) {
+	tx, err := getTransactionForUpdate(ctx, dbSvc, dispute.TenantID, dispute.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if dispute.Amount != tx.Amount {
+		return nil, nil
+	}
+	change, err := attributevalue.Marshal(StatusChange{From: TransactionCompleted, To: TransactionReversed, Actor: actor, Reason: "dispute reversed: " + reason, Time: timestamp})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal status change: %v", err)
+	}
+	return &types.TransactWriteItem{Update: &types.Update{
+		TableName: aws.String(TransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: dispute.TenantID},
+			"TransactionID": &types.AttributeValueMemberS{Value: dispute.TransactionID},
+		},
+		UpdateExpression:    aws.String("SET #status = :reversed, #history = list_append(if_not_exists(#history, :empty), :change), #version = :newVersion"),
+		ConditionExpression: aws.String("#status = :completed"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":  "TransactionStatus",
+			"#history": "StatusHistory",
+			"#version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":reversed":   &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionReversed))},
+			":completed":  &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionCompleted))},
+			":change":     &types.AttributeValueMemberL{Value: []types.AttributeValue{change}},
+			":empty":      &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(tx.Version+1, 10)},
+		},
+	}}, nil
+}
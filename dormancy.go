@@ -0,0 +1,241 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrAccountDormant is returned for money moved out of a dormant account.
+// Deposits into it are still accepted; see ReactivateAccount.
+var ErrAccountDormant = errors.New("account_dormant")
+
+// KYCRefresh is the identity check a dormant account is reactivated with.
+type KYCRefresh struct {
+	IDType   string `json:"id_type,omitempty"`
+	IDNumber string `json:"id_number"`
+	// VerifiedBy is the officer or provider who checked the documents.
+	VerifiedBy string `json:"verified_by"`
+}
+
+// MarkDormantAccounts flags the tenant's accounts with no ledger activity
+// since inactiveSince as dormant, e.g. run daily with a cutoff N days ago.
+// The tenant's system accounts are never flagged. Accounts written before
+// activity was recorded fall back to their latest ledger entry. It returns
+// the accounts flagged by this run; an account posted to while it runs is
+// left active.
+func MarkDormantAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, inactiveSince time.Time) ([]string, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		FilterExpression:       aws.String("attribute_not_exists(DormantSince)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	var marked []string
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return marked, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var accounts []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &accounts); err != nil {
+			return marked, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for i := range accounts {
+			if cfg.isSystemAccount(accounts[i].AccountID) {
+				continue
+			}
+			ok, err := markDormant(ctx, dbSvc, tenantId, &accounts[i], inactiveSince.Unix())
+			if err != nil {
+				errs = append(errs, err)
+			} else if ok {
+				marked = append(marked, accounts[i].AccountID)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return marked, errors.Join(errs...)
+}
+
+// markDormant flags account as dormant if its last activity is before
+// cutoff, reporting whether it did.
+func markDormant(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, account *User, cutoff int64) (bool, error) {
+	lastActivity := account.LastActivity
+	if lastActivity == 0 {
+		entries, err := accountLedgerEntries(ctx, dbSvc, tenantId, account.AccountID)
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			lastActivity = max(lastActivity, entry.Time)
+		}
+	}
+	if lastActivity >= cutoff {
+		return false, nil
+	}
+	// The account stays active if a journal posted to it since it was
+	// read.
+	condition := "attribute_exists(AccountID) AND attribute_not_exists(DormantSince) AND "
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+	}
+	if account.LastActivity == 0 {
+		condition += "attribute_not_exists(LastActivity)"
+	} else {
+		condition += "LastActivity = :last"
+		values[":last"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(account.LastActivity, 10)}
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: account.AccountID},
+		},
+		UpdateExpression:          aws.String("SET DormantSince = :now"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to mark %s dormant: %v", account.AccountID, err)
+	}
+	recordAudit(ctx, dbSvc, AuditMarkDormant, tenantId, account.AccountID, map[string]any{"last_activity": lastActivity}, nil, nil, nil)
+	return true, nil
+}
+
+// ReactivateAccount lifts the dormancy of an account after a fresh KYC
+// check: the ID document replaces the one on file, the account is marked
+// verified by kyc.VerifiedBy, and its activity starts again from now.
+func ReactivateAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, kyc KYCRefresh) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if kyc.IDNumber == "" || kyc.VerifiedBy == "" {
+		return errors.New("reactivation needs an id number and who verified it")
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	item := map[string]types.AttributeValue{
+		"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		"id_number": &types.AttributeValueMemberS{Value: kyc.IDNumber},
+	}
+	if err := protectPII(ctx, dbSvc, tenantId, item); err != nil {
+		return err
+	}
+	delete(item, "AccountID")
+	now := strconv.FormatInt(getCurrentTimestamp(), 10)
+	update := "SET is_verified = :verified, KYCVerifiedAt = :now, KYCVerifiedBy = :by, LastActivity = :now"
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":verified": &types.AttributeValueMemberBOOL{Value: true},
+		":now":      &types.AttributeValueMemberN{Value: now},
+		":by":       &types.AttributeValueMemberS{Value: kyc.VerifiedBy},
+	}
+	if kyc.IDType != "" {
+		item["id_type"] = &types.AttributeValueMemberS{Value: kyc.IDType}
+	}
+	i := 0
+	for name, value := range item {
+		update += fmt.Sprintf(", #kyc%d = :kyc%d", i, i)
+		names[fmt.Sprintf("#kyc%d", i)] = name
+		values[fmt.Sprintf(":kyc%d", i)] = value
+		i++
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:          aws.String(update + " REMOVE DormantSince"),
+		ConditionExpression:       aws.String("attribute_exists(DormantSince)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("account %s is not dormant", accountId)
+	} else if err != nil {
+		err = fmt.Errorf("failed to reactivate %s: %v", accountId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	recordAudit(ctx, dbSvc, AuditReactivateAccount, tenantId, accountId, map[string]any{"id_type": kyc.IDType, "verified_by": kyc.VerifiedBy}, before, after, err)
+	return err
+}
+
+// ListDormantAccounts returns the tenant's dormant accounts, for compliance
+// reporting.
+func ListDormantAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]User, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		FilterExpression:       aws.String("attribute_exists(DormantSince)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var dormant []User
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query dormant accounts: %v", err)
+		}
+		var accounts []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &accounts); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for i := range accounts {
+			if err := decryptPII(ctx, dbSvc, &accounts[i]); err != nil {
+				return nil, err
+			}
+		}
+		dormant = append(dormant, accounts...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return dormant, nil
+}
+
+// checkDormant returns ErrAccountDormant for a dormant account money is
+// moved out of.
+func checkDormant(account *User) error {
+	if account.DormantSince != 0 {
+		return fmt.Errorf("%w: account %s has been dormant since %s", ErrAccountDormant, account.AccountID,
+			time.Unix(account.DormantSince, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// TransferRequest is the input of a transfer. FromAccount is the sender; no
+// other field stands for it, unlike TransactionEntry, which is at once the
+// input of older functions, a stored row and their output. A transfer maps
+// its request to a TransactionRecord for TransactionsTable and a LedgerEntry
+// per leg for LedgerTable.
+type TransferRequest struct {
+	TenantID    string  `json:"tenant_id,omitempty"`
+	FromAccount string  `json:"from_account"`
+	ToAccount   string  `json:"to_account"`
+	Amount      float64 `json:"amount"`
+	// InitiatorUUID identifies the request; SignedUUID is its signature when
+	// the tenant requires signed transfers.
+	InitiatorUUID string `json:"uuid,omitempty"`
+	SignedUUID    string `json:"signed_uuid,omitempty"`
+	// Timestamp is echoed back in error responses.
+	Timestamp string `json:"timestamp,omitempty"`
+	// ThirdPartyID and ConsentID are set when an app transfers on the
+	// sender's behalf.
+	ThirdPartyID    string `json:"third_party_id,omitempty"`
+	ConsentID       string `json:"consent_id,omitempty"`
+	IsInternational bool   `json:"is_international,omitempty"`
+	IsCashOut       bool   `json:"is_cash_out,omitempty"`
+	// Narrative is the caller's description of the transfer, sanitized with
+	// SanitizeNarrative before it is stored.
+	Narrative string `json:"narrative,omitempty"`
+	// Metadata and Tags are stored on the transaction for the caller to
+	// query by; see MaxMetadataEntries and MaxTransactionTags for their bounds.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// PurposeCode is the declared purpose of the transfer, one of
+	// PurposeCodes; optional.
+	PurposeCode string `json:"purpose_code,omitempty"`
+	// Reference is the customer's or merchant's reference for the transfer,
+	// such as an invoice number, for SearchTransactions; optional.
+	Reference string `json:"reference,omitempty"`
+	// Category is the spending category of the transfer, one of
+	// Categories, and MCC the merchant category code of a purchase; both
+	// optional. A transfer with an MCC and no category gets CategoryOfMCC.
+	Category string `json:"category,omitempty"`
+	MCC      string `json:"mcc,omitempty"`
+	// Locale, such as LocaleArabic, asks for the response message in that
+	// language, from the message catalog; see Localize. The message is in
+	// English without it.
+	Locale string `json:"locale,omitempty"`
+	// ParentTransactionID links the transfer to the transaction it follows
+	// from, such as the payment it refunds; optional. See
+	// GetTransactionTree.
+	ParentTransactionID string `json:"parent_transaction_id,omitempty"`
+}
+
+// TransferRequestFromEntry maps the TransactionEntry taken by TransferCredits
+// to a TransferRequest. The sender is FromAccount, or AccountID for callers
+// that only set that; an entry naming two different senders is refused. The
+// narrative is Narrative, or Comment for callers that only set that.
+func TransferRequestFromEntry(trEntry TransactionEntry) (TransferRequest, error) {
+	from := trEntry.FromAccount
+	switch {
+	case trEntry.AccountID == "" && from == "":
+		return TransferRequest{}, errors.New("you must provide Account ID, substitute it for FromAccount to mimic the older api")
+	case from == "":
+		from = trEntry.AccountID
+	case trEntry.AccountID != "" && trEntry.AccountID != from:
+		return TransferRequest{}, fmt.Errorf("account id %s and from account %s differ", trEntry.AccountID, from)
+	}
+	narrative := trEntry.Narrative
+	if narrative == "" {
+		narrative = trEntry.Comment
+	}
+	return TransferRequest{
+		TenantID:        trEntry.TenantID,
+		FromAccount:     from,
+		ToAccount:       trEntry.ToAccount,
+		Amount:          trEntry.Amount,
+		InitiatorUUID:   trEntry.InitiatorUUID,
+		SignedUUID:      trEntry.SignedUUID,
+		Timestamp:       trEntry.Timestamp,
+		ThirdPartyID:    trEntry.ThirdPartyID,
+		ConsentID:       trEntry.ConsentID,
+		IsInternational: trEntry.IsInternational,
+		IsCashOut:       trEntry.IsCashOut,
+		Narrative:       narrative,
+		Metadata:        trEntry.Metadata,
+		Tags:            trEntry.Tags,
+		PurposeCode:     trEntry.PurposeCode,
+		Reference:       trEntry.Reference,
+		Category:        trEntry.Category,
+		MCC:             trEntry.MCC,
+
+		ParentTransactionID: trEntry.ParentTransactionID,
+	}, nil
+}
+
+// Entry returns the request as the TransactionEntry taken by older
+// functions, such as VerifyTransferSignature, with AccountID set to the
+// sender.
+func (r TransferRequest) Entry() TransactionEntry {
+	return TransactionEntry{
+		TenantID:        r.TenantID,
+		AccountID:       r.FromAccount,
+		FromAccount:     r.FromAccount,
+		ToAccount:       r.ToAccount,
+		Amount:          r.Amount,
+		InitiatorUUID:   r.InitiatorUUID,
+		SignedUUID:      r.SignedUUID,
+		Timestamp:       r.Timestamp,
+		ThirdPartyID:    r.ThirdPartyID,
+		ConsentID:       r.ConsentID,
+		IsInternational: r.IsInternational,
+		IsCashOut:       r.IsCashOut,
+		Narrative:       r.Narrative,
+		Metadata:        r.Metadata,
+		Tags:            r.Tags,
+		PurposeCode:     r.PurposeCode,
+		Reference:       r.Reference,
+		Category:        r.Category,
+		MCC:             r.MCC,
+	}
+}
+
+// TransactionRecord is a transaction as stored in TransactionsTable. It uses
+// the attribute names of TransactionEntry, so records read back as entries.
+type TransactionRecord struct {
+	TenantID      string `dynamodbav:"TenantID"`
+	TransactionID string `dynamodbav:"TransactionID"`
+	// AccountID is the sender, kept for the queries by account.
+	AccountID   string  `dynamodbav:"AccountID"`
+	FromAccount string  `dynamodbav:"FromAccount"`
+	ToAccount   string  `dynamodbav:"ToAccount"`
+	Amount      float64 `dynamodbav:"Amount"`
+	Currency    string  `dynamodbav:"Currency,omitempty"`
+	Comment     string  `dynamodbav:"Comment"`
+	Narrative   string  `dynamodbav:"Narrative,omitempty"`
+	// NarrativeSearch is Narrative as searched by TransactionFilter.Search.
+	NarrativeSearch string            `dynamodbav:"NarrativeSearch,omitempty"`
+	Metadata        map[string]string `dynamodbav:"Metadata,omitempty"`
+	Tags            []string          `dynamodbav:"Tags,stringset,omitempty"`
+	PurposeCode     string            `dynamodbav:"PurposeCode,omitempty"`
+	Reference       string            `dynamodbav:"Reference,omitempty"`
+	// ReferenceLookup is Reference as searched by SearchTransactions, the
+	// range key of ReferenceIndex.
+	ReferenceLookup string `dynamodbav:"ReferenceLookup,omitempty"`
+	Category        string `dynamodbav:"Category,omitempty"`
+	MCC             string `dynamodbav:"MCC,omitempty"`
+	// BlockReason is the reason code of a transfer blocked by screening.
+	BlockReason     string            `dynamodbav:"BlockReason,omitempty"`
+	TransactionDate int64             `dynamodbav:"TransactionDate"`
+	Status          TransactionStatus `dynamodbav:"TransactionStatus"`
+	InitiatorUUID   string            `dynamodbav:"UUID"`
+	ThirdPartyID    string            `dynamodbav:"ThirdPartyID"`
+	ConsentID       string            `dynamodbav:"ConsentID"`
+	IsInternational bool              `dynamodbav:"IsInternational"`
+	Fee             float64           `dynamodbav:"Fee"`
+	FeePaidBy       string            `dynamodbav:"FeePaidBy"`
+	FeeAccount      string            `dynamodbav:"FeeAccount"`
+	Tax             float64           `dynamodbav:"Tax"`
+	TaxAccount      string            `dynamodbav:"TaxAccount"`
+	JournalID       string            `dynamodbav:"JournalID"`
+	Version         int64             `dynamodbav:"Version,omitempty"`
+	Legs            []JournalLeg      `dynamodbav:"Legs,omitempty"`
+	StatusHistory   []StatusChange    `dynamodbav:"StatusHistory,omitempty"`
+
+	// ParentTransactionID and RelatedTransactionIDs link the transaction to
+	// others; ParentTransactionID is the range key of ParentIndex.
+	ParentTransactionID   string   `dynamodbav:"ParentTransactionID,omitempty"`
+	RelatedTransactionIDs []string `dynamodbav:"RelatedTransactionIDs,stringset,omitempty"`
+}
+
+// newTransactionRecord returns the record of a transfer, failed until it is
+// posted. comment is the system narrative of the operation; req.Narrative
+// must be sanitized.
+func newTransactionRecord(req TransferRequest, comment, transactionId string, timestamp int64) TransactionRecord {
+	return TransactionRecord{
+		TenantID:        req.TenantID,
+		TransactionID:   transactionId,
+		AccountID:       req.FromAccount,
+		FromAccount:     req.FromAccount,
+		ToAccount:       req.ToAccount,
+		Amount:          req.Amount,
+		Comment:         comment,
+		Narrative:       req.Narrative,
+		NarrativeSearch: narrativeSearchKey(req.Narrative),
+		Metadata:        req.Metadata,
+		Tags:            req.Tags,
+		PurposeCode:     req.PurposeCode,
+		Reference:       req.Reference,
+		ReferenceLookup: referenceLookupKey(req.Reference),
+		Category:        req.Category,
+		MCC:             req.MCC,
+		TransactionDate: timestamp,
+		Status:          TransactionFailed,
+		InitiatorUUID:   req.InitiatorUUID,
+		ThirdPartyID:    req.ThirdPartyID,
+		ConsentID:       req.ConsentID,
+		IsInternational: req.IsInternational,
+
+		ParentTransactionID: req.ParentTransactionID,
+	}
+}
+
+// Entry returns the record as a TransactionEntry.
+func (r TransactionRecord) Entry() TransactionEntry {
+	status := r.Status
+	return TransactionEntry{
+		TenantID:            r.TenantID,
+		SystemTransactionID: r.TransactionID,
+		AccountID:           r.AccountID,
+		FromAccount:         r.FromAccount,
+		ToAccount:           r.ToAccount,
+		Amount:              r.Amount,
+		Currency:            r.Currency,
+		Comment:             r.Comment,
+		Narrative:           r.Narrative,
+		Metadata:            r.Metadata,
+		Tags:                r.Tags,
+		PurposeCode:         r.PurposeCode,
+		Reference:           r.Reference,
+		Category:            r.Category,
+		MCC:                 r.MCC,
+		BlockReason:         r.BlockReason,
+		TransactionDate:     r.TransactionDate,
+		Status:              &status,
+		InitiatorUUID:       r.InitiatorUUID,
+		ThirdPartyID:        r.ThirdPartyID,
+		ConsentID:           r.ConsentID,
+		IsInternational:     r.IsInternational,
+		Fee:                 r.Fee,
+		FeePaidBy:           r.FeePaidBy,
+		FeeAccount:          r.FeeAccount,
+		Tax:                 r.Tax,
+		TaxAccount:          r.TaxAccount,
+		JournalID:           r.JournalID,
+		Version:             r.Version,
+		Legs:                r.Legs,
+		StatusHistory:       r.StatusHistory,
+
+		ParentTransactionID:   r.ParentTransactionID,
+		RelatedTransactionIDs: r.RelatedTransactionIDs,
+	}
+}
+
+// saveTransactionRecord stores a record with the given status.
+func saveTransactionRecord(ctx context.Context, dbSvc DynamoDBAPI, record TransactionRecord, status TransactionStatus) error {
+	record.Status = status
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transaction record: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TransactionsTable),
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store transaction: %v", err)
+	}
+	return nil
+}
+
+// ledgerEntry returns the LedgerTable row of a journal leg.
+func (leg JournalLeg) ledgerEntry(tenantId, journalId, initiatorUUID string, timestamp int64) LedgerEntry {
+	return LedgerEntry{
+		TenantID:            tenantId,
+		AccountID:           leg.AccountID,
+		Amount:              leg.Amount,
+		SystemTransactionID: journalId + "#" + leg.Type,
+		Type:                leg.Type,
+		Time:                timestamp,
+		InitiatorUUID:       initiatorUUID,
+		JournalID:           journalId,
+		Overdraft:           leg.Overdraft,
+		Category:            leg.Category,
+		MCC:                 leg.MCC,
+	}
+}
@@ -0,0 +1,54 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func TestTransferRequestFromEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		trEntry  TransactionEntry
+		wantFrom string
+		wantErr  bool
+	}{
+		{"account id only", TransactionEntry{AccountID: "alice", ToAccount: "bob"}, "alice", false},
+		{"from account only", TransactionEntry{FromAccount: "alice", ToAccount: "bob"}, "alice", false},
+		{"both agree", TransactionEntry{AccountID: "alice", FromAccount: "alice", ToAccount: "bob"}, "alice", false},
+		{"both differ", TransactionEntry{AccountID: "bob", FromAccount: "alice", ToAccount: "bob"}, "", true},
+		{"no sender", TransactionEntry{ToAccount: "bob"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := TransferRequestFromEntry(tt.trEntry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TransferRequestFromEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if req.FromAccount != tt.wantFrom {
+				t.Errorf("FromAccount = %q, want %q", req.FromAccount, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestTransactionRecordReadsAsEntry(t *testing.T) {
+	req := TransferRequest{TenantID: "t1", FromAccount: "alice", ToAccount: "bob", Amount: 10, InitiatorUUID: "u1", ConsentID: "c1", Narrative: "Rent"}
+	record := newTransactionRecord(req, NarrativeTransfer, "tx1", 1700000000)
+	record.Status = TransactionCompleted
+	record.Fee = 1
+	record.Legs = []JournalLeg{{AccountID: "alice", Type: LegDebit, Amount: 11}}
+
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got TransactionEntry
+	if err := attributevalue.UnmarshalMap(av, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := record.Entry(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored record reads as %+v, want %+v", got, want)
+	}
+}
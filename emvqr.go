@@ -0,0 +1,337 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QRGlobalID identifies the ledger in the merchant account information of
+// the EMVCo QR codes it generates; ParseQR rejects codes without it.
+var QRGlobalID = "com.nilpay.ledger"
+
+// QRDefaultCountry is the country of QR codes that do not set one.
+var QRDefaultCountry = "SD"
+
+// ErrInvalidQR is returned for a QR payload that is malformed, fails its
+// CRC or was not generated for the ledger.
+var ErrInvalidQR = errors.New("invalid_qr")
+
+// qrCurrencies maps the currencies of QR codes to their ISO 4217 numeric
+// codes, which EMVCo payloads carry.
+var qrCurrencies = map[string]string{
+	"SDG": "938",
+	"USD": "840",
+	"EUR": "978",
+	"GBP": "826",
+	"SAR": "682",
+	"AED": "784",
+	"EGP": "818",
+}
+
+// IDs of the EMVCo merchant-presented mode data objects used by the ledger.
+const (
+	qrPayloadFormat   = "00"
+	qrInitiation      = "01"
+	qrMerchantAccount = "26"
+	qrMCC             = "52"
+	qrCurrency        = "53"
+	qrAmount          = "54"
+	qrCountry         = "58"
+	qrMerchantName    = "59"
+	qrMerchantCity    = "60"
+	qrAdditionalData  = "62"
+	qrCRC             = "63"
+
+	// In the merchant account information template.
+	qrGlobalID = "00"
+	qrTenant   = "01"
+	qrAccount  = "02"
+
+	// In the additional data template.
+	qrBillNumber     = "01"
+	qrReferenceLabel = "05"
+
+	qrStatic  = "11"
+	qrDynamic = "12"
+)
+
+// QRCode is the content of an EMVCo merchant-presented QR code: a merchant
+// account, which the payer pays any amount into, or a payment request.
+type QRCode struct {
+	TenantID   string
+	MerchantID string
+	// MerchantName and MerchantCity are shown by the payer's app; EMVCo
+	// limits them to 25 and 15 characters.
+	MerchantName string
+	MerchantCity string
+	// MCC is the merchant category code; "0000" when empty.
+	MCC string
+	// Currency is the alphabetic code, DefaultCurrency when empty.
+	Currency string
+	// Country is the ISO 3166 code, QRDefaultCountry when empty.
+	Country string
+	// Amount is zero for a code the payer enters the amount of.
+	Amount float64
+	// RequestID is the payment request the code pays, if any. Such a code
+	// is dynamic: it is only valid for that request.
+	RequestID string
+	// Reference is the merchant's reference, sent as the bill number.
+	Reference string
+}
+
+// PaymentRequestQR returns the QR code of a payment request.
+func PaymentRequestQR(request *PaymentRequest, merchantName, merchantCity string) QRCode {
+	return QRCode{
+		TenantID:     request.TenantID,
+		MerchantID:   request.MerchantID,
+		MerchantName: merchantName,
+		MerchantCity: merchantCity,
+		Amount:       request.Amount,
+		RequestID:    request.RequestID,
+		Reference:    request.Reference,
+	}
+}
+
+// GenerateQR encodes a QR code as an EMVCo payload, ending with its CRC.
+func GenerateQR(code QRCode) (string, error) {
+	if code.TenantID == "" {
+		code.TenantID = "nil"
+	}
+	currency := code.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	numeric, ok := qrCurrencies[currency]
+	if !ok {
+		return "", fmt.Errorf("unsupported qr currency %s", currency)
+	}
+	switch {
+	case code.MerchantID == "":
+		return "", errors.New("merchant id is required")
+	case code.MerchantName == "" || len(code.MerchantName) > 25:
+		return "", errors.New("merchant name must be 1 to 25 characters")
+	case code.MerchantCity == "" || len(code.MerchantCity) > 15:
+		return "", errors.New("merchant city must be 1 to 15 characters")
+	case code.Amount < 0 || math.IsNaN(code.Amount):
+		return "", fmt.Errorf("invalid amount %.2f", code.Amount)
+	}
+	mcc := code.MCC
+	if mcc == "" {
+		mcc = "0000"
+	}
+	country := code.Country
+	if country == "" {
+		country = QRDefaultCountry
+	}
+	initiation := qrStatic
+	if code.RequestID != "" {
+		initiation = qrDynamic
+	}
+
+	account, err := qrTemplate(map[string]string{qrGlobalID: QRGlobalID, qrTenant: code.TenantID, qrAccount: code.MerchantID})
+	if err != nil {
+		return "", err
+	}
+	additional, err := qrTemplate(map[string]string{qrBillNumber: code.Reference, qrReferenceLabel: code.RequestID})
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fields := []struct{ id, value string }{
+		{qrPayloadFormat, "01"},
+		{qrInitiation, initiation},
+		{qrMerchantAccount, account},
+		{qrMCC, mcc},
+		{qrCurrency, numeric},
+		{qrAmount, qrFormatAmount(code.Amount)},
+		{qrCountry, country},
+		{qrMerchantName, code.MerchantName},
+		{qrMerchantCity, code.MerchantCity},
+		{qrAdditionalData, additional},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if err := writeQRField(&b, field.id, field.value); err != nil {
+			return "", err
+		}
+	}
+	b.WriteString(qrCRC + "04")
+	return b.String() + fmt.Sprintf("%04X", crc16(b.String())), nil
+}
+
+// ParseQR decodes an EMVCo payload generated for the ledger, after checking
+// its CRC.
+func ParseQR(payload string) (*QRCode, error) {
+	payload = strings.TrimSpace(payload)
+	if len(payload) < 8 || payload[len(payload)-8:len(payload)-4] != qrCRC+"04" {
+		return nil, fmt.Errorf("%w: no crc", ErrInvalidQR)
+	}
+	sum, err := strconv.ParseUint(payload[len(payload)-4:], 16, 16)
+	if err != nil || uint16(sum) != crc16(payload[:len(payload)-4]) {
+		return nil, fmt.Errorf("%w: crc mismatch", ErrInvalidQR)
+	}
+	fields, err := parseQRFields(payload[:len(payload)-8])
+	if err != nil {
+		return nil, err
+	}
+	if fields[qrPayloadFormat] != "01" {
+		return nil, fmt.Errorf("%w: unsupported payload format", ErrInvalidQR)
+	}
+
+	var account map[string]string
+	for id := 26; id <= 51; id++ {
+		template, err := parseQRFields(fields[strconv.Itoa(id)])
+		if err == nil && template[qrGlobalID] == QRGlobalID {
+			account = template
+			break
+		}
+	}
+	if account == nil || account[qrAccount] == "" {
+		return nil, fmt.Errorf("%w: not a ledger merchant", ErrInvalidQR)
+	}
+	code := &QRCode{
+		TenantID:     account[qrTenant],
+		MerchantID:   account[qrAccount],
+		MerchantName: fields[qrMerchantName],
+		MerchantCity: fields[qrMerchantCity],
+		MCC:          fields[qrMCC],
+		Country:      fields[qrCountry],
+	}
+	for alpha, numeric := range qrCurrencies {
+		if numeric == fields[qrCurrency] {
+			code.Currency = alpha
+		}
+	}
+	if code.Currency == "" {
+		return nil, fmt.Errorf("%w: unsupported currency %s", ErrInvalidQR, fields[qrCurrency])
+	}
+	if amount := fields[qrAmount]; amount != "" {
+		code.Amount, err = strconv.ParseFloat(amount, 64)
+		if err != nil || code.Amount <= 0 {
+			return nil, fmt.Errorf("%w: invalid amount %s", ErrInvalidQR, amount)
+		}
+	}
+	if data := fields[qrAdditionalData]; data != "" {
+		additional, err := parseQRFields(data)
+		if err != nil {
+			return nil, err
+		}
+		code.Reference = additional[qrBillNumber]
+		code.RequestID = additional[qrReferenceLabel]
+	}
+	if (code.RequestID != "") != (fields[qrInitiation] == qrDynamic) {
+		return nil, fmt.Errorf("%w: a payment request code must be dynamic", ErrInvalidQR)
+	}
+	return code, nil
+}
+
+// PayFromQR pays a scanned QR code from the payer's account. A payment
+// request code pays the request with PayRequest. A merchant code pays the
+// amount it carries, or, when it carries none, amount, which must otherwise
+// be zero or equal to it. The payer and merchant must be of the same tenant.
+func PayFromQR(ctx context.Context, dbSvc DynamoDBAPI, tenantId, payerId, payload string, amount float64) (NilResponse, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	req := TransferRequest{TenantID: tenantId, FromAccount: payerId, Amount: amount}
+	code, err := ParseQR(payload)
+	if err != nil {
+		return failedResponse(req, ErrInvalidQR.Error(), "The QR code is not valid.", err.Error()), err
+	}
+	if code.TenantID != tenantId {
+		err := fmt.Errorf("%w: merchant of tenant %s", ErrInvalidQR, code.TenantID)
+		return failedResponse(req, ErrInvalidQR.Error(), "The QR code is of another provider.", err.Error()), err
+	}
+	if code.RequestID != "" {
+		return PayRequest(ctx, dbSvc, tenantId, payerId, code.RequestID)
+	}
+	switch {
+	case code.Amount == 0 && amount <= 0:
+		err = errors.New("the qr code has no amount; the payer must enter one")
+	case code.Amount != 0 && amount != 0 && amount != code.Amount:
+		err = fmt.Errorf("amount %.2f differs from the qr code's %.2f", amount, code.Amount)
+	}
+	if err != nil {
+		return failedResponse(req, "invalid_amount", "The amount is not valid.", err.Error()), err
+	}
+	if code.Amount != 0 {
+		req.Amount = code.Amount
+	}
+	req.ToAccount = code.MerchantID
+	req.Narrative = code.Reference
+	return Transfer(ctx, dbSvc, req)
+}
+
+// qrTemplate encodes the non-empty fields of a template, in ID order.
+func qrTemplate(fields map[string]string) (string, error) {
+	ids := make([]string, 0, len(fields))
+	for id, value := range fields {
+		if value != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		if err := writeQRField(&b, id, fields[id]); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+func writeQRField(b *strings.Builder, id, value string) error {
+	if len(value) > 99 {
+		return fmt.Errorf("qr field %s is longer than 99 characters", id)
+	}
+	fmt.Fprintf(b, "%s%02d%s", id, len(value), value)
+	return nil
+}
+
+// parseQRFields splits an EMVCo payload or template into its fields by ID.
+func parseQRFields(s string) (map[string]string, error) {
+	fields := map[string]string{}
+	for len(s) > 0 {
+		if len(s) < 4 {
+			return nil, fmt.Errorf("%w: truncated field", ErrInvalidQR)
+		}
+		n, err := strconv.Atoi(s[2:4])
+		if err != nil || n > len(s)-4 {
+			return nil, fmt.Errorf("%w: bad length of field %s", ErrInvalidQR, s[:2])
+		}
+		fields[s[:2]] = s[4 : 4+n]
+		s = s[4+n:]
+	}
+	return fields, nil
+}
+
+func qrFormatAmount(amount float64) string {
+	if amount == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// crc16 is the CRC-16/CCITT-FALSE EMVCo payloads end with.
+func crc16(s string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
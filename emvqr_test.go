@@ -0,0 +1,42 @@
+package ledger
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if got := crc16("123456789"); got != 0x29B1 {
+		t.Errorf("crc16(123456789) = %04X, want 29B1", got)
+	}
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	for _, code := range []QRCode{
+		{TenantID: "acme", MerchantID: "shop-1", MerchantName: "Corner Shop", MerchantCity: "Khartoum", MCC: "5411", Currency: "SDG", Country: "SD"},
+		{TenantID: "acme", MerchantID: "shop-1", MerchantName: "Corner Shop", MerchantCity: "Khartoum", MCC: "5411", Currency: "USD", Country: "SD", Amount: 12.5, RequestID: "req-1", Reference: "order 7"},
+	} {
+		payload, err := GenerateQR(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(payload, "000201") {
+			t.Errorf("payload %s does not start with the payload format", payload)
+		}
+		got, err := ParseQR(payload)
+		if err != nil || *got != code {
+			t.Errorf("ParseQR(%s) = %+v, %v, want %+v", payload, got, err, code)
+		}
+		tampered := strings.Replace(payload, "shop-1", "shop-2", 1)
+		if _, err := ParseQR(tampered); !errors.Is(err, ErrInvalidQR) {
+			t.Errorf("ParseQR() of a tampered payload: %v", err)
+		}
+	}
+	if _, err := GenerateQR(QRCode{MerchantID: "shop-1", MerchantName: "A merchant name far too long", MerchantCity: "Khartoum"}); err == nil {
+		t.Error("GenerateQR() accepted a 28 character merchant name")
+	}
+	if _, err := GenerateQR(QRCode{MerchantID: "shop-1", MerchantName: "Shop", MerchantCity: "Khartoum", Reference: strings.Repeat("x", 100)}); err == nil {
+		t.Error("GenerateQR() accepted a 100 character reference")
+	}
+}
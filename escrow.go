@@ -13,7 +13,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/davecgh/go-spew/spew"
-	"github.com/segmentio/ksuid"
 )
 
 // Optional: Implement MarshalDynamoDBAttributeValue for consistency
@@ -31,14 +30,23 @@ const ESCROW_ACCOUNT = "NIL_ESCROW_ACCOUNT"
 const ESCROW_TENANT = "ESCROW_TENANT"
 const ServiceProvidersTransactions = "ServiceProviderTransactions"
 
-func EscrowRequest(context context.Context, dbSvc *dynamodb.Client, esEntry EscrowEntry) (NilResponse, error) {
+func EscrowRequest(context context.Context, dbSvc DynamoDBAPI, esEntry EscrowEntry) (NilResponse, error) {
 	log.Printf("the escrow request is %+v", esEntry)
 	var response NilResponse
 
-	timestamp := getCurrentTimestamp()
+	defer beginTransfer(dbSvc, esEntry.FromTenantID)()
+	tenantCfg, err := GetTenantConfig(context, dbSvc, esEntry.FromTenantID)
+	if err != nil {
+		return NilResponse{}, err
+	}
+	if err := tenantCfg.maintenanceError(); err != nil {
+		return maintenanceResponse(TransferRequest{InitiatorUUID: esEntry.InitiatorUUID, SignedUUID: esEntry.SignedUUID, Timestamp: esEntry.Timestamp}, err), err
+	}
+
+	timestamp := clockOf(dbSvc).Now().Unix()
 	transactionStatus := StatusPending
 
-	uid := ksuid.New().String()
+	uid := newID(dbSvc)
 
 	es := EscrowTransaction{
 		FromAccount:      esEntry.FromAccount,
@@ -104,15 +112,15 @@ func EscrowRequest(context context.Context, dbSvc *dynamodb.Client, esEntry Escr
 	return response, nil
 }
 
-func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry EscrowTransaction) (NilResponse, error) {
+func EscrowTransferCredits(context context.Context, dbSvc DynamoDBAPI, trEntry EscrowTransaction) (NilResponse, error) {
 	var response NilResponse
 	if trEntry.FromAccount == "" || trEntry.ToAccount == "" {
 		return response, errors.New("you must provide Account ID for both to/from account, substitute it for FromAccount to mimic the older api")
 	}
 
-	timestamp := getCurrentTimestamp()
-	var transactionStatus int = 1
-	uid := ksuid.New().String()
+	timestamp := clockOf(dbSvc).Now().Unix()
+	transactionStatus := TransactionFailed
+	uid := newID(dbSvc)
 
 	combinedTenants := trEntry.FromTenantID + ":" + trEntry.ToTenantID
 
@@ -123,7 +131,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		FromAccount:         trEntry.FromAccount,
 		ToAccount:           trEntry.ToAccount,
 		Amount:              trEntry.Amount,
-		Comment:             "Transfer credits",
+		Comment:             NarrativeTransfer,
 		TransactionDate:     timestamp,
 		Status:              &transactionStatus,
 		InitiatorUUID:       trEntry.InitiatorUUID,
@@ -132,7 +140,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	// Fetch sender account - sender here is the escrow account
 	sender, err := GetAccount(context, dbSvc, TransactionEntry{AccountID: trEntry.FromAccount, FromAccount: trEntry.FromAccount, TenantID: trEntry.FromTenantID})
 	if err != nil || sender == nil {
-		SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus)
+		recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 		response = NilResponse{
 			Status:    "error",
 			Code:      "user_not_found",
@@ -151,7 +159,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	if trEntry.CashoutProvider == "bok" {
 		receiver, err := GetAccount(context, dbSvc, TransactionEntry{AccountID: trEntry.ToAccount, FromAccount: trEntry.ToAccount, TenantID: trEntry.ToTenantID})
 		if err != nil || receiver == nil {
-			SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus)
+			recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 			response = NilResponse{
 				Status:    "error",
 				Code:      "user_not_found",
@@ -167,7 +175,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		}
 
 		if trEntry.Amount > sender.Amount {
-			SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus)
+			recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 			response = NilResponse{
 				Status:    "error",
 				Code:      "insufficient_balance",
@@ -183,66 +191,13 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		}
 	}
 
-	debitEntry := LedgerEntry{
-		TenantID:            trEntry.FromTenantID,
-		AccountID:           trEntry.FromAccount,
-		Amount:              trEntry.Amount,
-		SystemTransactionID: uid,
-		Type:                "debit",
-		Time:                timestamp,
-		InitiatorUUID:       trEntry.InitiatorUUID,
-	}
-	// FIXME(adonese): if the cashout provider is bok, then the receiver is the escrow account for nilbok
-	creditEntry := LedgerEntry{
-		TenantID:            trEntry.ToTenantID,
-		AccountID:           trEntry.ToAccount,
-		Amount:              trEntry.Amount,
-		SystemTransactionID: uid,
-		Type:                "credit",
-		Time:                timestamp,
-		InitiatorUUID:       trEntry.InitiatorUUID,
-	}
-
-	avDebit, err := attributevalue.MarshalMap(debitEntry)
-	if err != nil {
-		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
-	}
-	avCredit, err := attributevalue.MarshalMap(creditEntry)
-	if err != nil {
-		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
-	}
-
-	debitInput := &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Update: &types.Update{
-					TableName: aws.String(NilUsers),
-					Key: map[string]types.AttributeValue{
-						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.FromTenantID}, // use old tenant you got
-						"AccountID": &types.AttributeValueMemberS{Value: trEntry.FromAccount},
-					},
-					UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
-					ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
-					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-						":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
-						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-					},
-				},
-			},
-			{Put: &types.Put{
-				TableName: aws.String(LedgerTable),
-				Item:      avDebit,
-			}},
-		},
-	}
-
-	_, err = dbSvc.TransactWriteItems(context, debitInput)
+	// Each side is a journal of its tenant, chained onto its account's
+	// ledger. The debit is guarded by the sender as read.
+	debit := []JournalLeg{{AccountID: trEntry.FromAccount, Type: LegDebit, Amount: trEntry.Amount, Overdraft: sender.Amount < trEntry.Amount}}
+	err = postJournal(context, dbSvc, trEntry.FromTenantID, uid, trEntry.InitiatorUUID, sender, debit, nil, map[string]*User{trEntry.FromAccount: sender}, timestamp)
 	if err != nil {
-		transactionStatus = 1
-		if err := SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus); err != nil {
-			panic(err)
-		}
+		transactionStatus = TransactionFailed
+		recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 		response = NilResponse{
 			Status:    "error",
 			Code:      "debit_failed",
@@ -257,57 +212,25 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		return response, fmt.Errorf("failed to debit from balance for user %s: %v", trEntry.FromAccount, err)
 	}
 
-	creditInput := &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Update: &types.Update{
-					TableName: aws.String(NilUsers),
-					Key: map[string]types.AttributeValue{
-						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.ToTenantID},
-						"AccountID": &types.AttributeValueMemberS{Value: trEntry.ToAccount},
-					},
-					UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
-					ConditionExpression: aws.String("attribute_exists(AccountID) AND TenantID = :tenantID"),
-					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-						":tenantID":   &types.AttributeValueMemberS{Value: trEntry.ToTenantID},
-					},
-				},
-			},
-			{Put: &types.Put{
-				TableName: aws.String(LedgerTable),
-				Item:      avCredit,
-			}},
-		},
-	}
-
-	_, err = dbSvc.TransactWriteItems(context, creditInput)
+	// FIXME(adonese): if the cashout provider is bok, then the receiver is the escrow account for nilbok
+	var obligation []types.TransactWriteItem
+	// Money crossing tenants is owed by the sender's tenant to the
+	// receiver's until RunSettlement settles it.
+	if trEntry.FromTenantID != trEntry.ToTenantID {
+		obligation = append(obligation, types.TransactWriteItem{
+			Update: obligationUpdate(trEntry.FromTenantID, trEntry.ToTenantID, trEntry.Amount, timestamp),
+		})
+	}
+	err = postLeg(context, dbSvc, trEntry.ToTenantID, uid, trEntry.InitiatorUUID, JournalLeg{AccountID: trEntry.ToAccount, Type: LegCredit, Amount: trEntry.Amount}, obligation...)
 	if err != nil {
-		rollbackInput := &dynamodb.UpdateItemInput{
-			TableName: aws.String(NilUsers),
-			Key: map[string]types.AttributeValue{
-				"TenantID":  &types.AttributeValueMemberS{Value: trEntry.FromTenantID},
-				"AccountID": &types.AttributeValueMemberS{Value: trEntry.FromAccount},
-			},
-			UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
-			ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
-			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
-				":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
-				":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
-			},
-		}
-
-		_, rollbackErr := dbSvc.UpdateItem(context, rollbackInput)
+		rollbackErr := postRefund(context, dbSvc, trEntry.FromTenantID, uid, trEntry.InitiatorUUID, trEntry.FromAccount, trEntry.Amount)
 		if rollbackErr != nil {
-			panic(fmt.Errorf("failed to rollback debit for user %s: %v", trEntry.FromAccount, rollbackErr))
+			deadLetter(context, dbSvc, FailedOperation{TenantID: trEntry.FromTenantID, Kind: FailedOpRefund, TransactionID: uid,
+				AccountID: trEntry.FromAccount, Amount: trEntry.Amount}, fmt.Errorf("failed to rollback debit for user %s: %v", trEntry.FromAccount, rollbackErr))
 		}
 
-		transactionStatus = 1
-		if err := SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus); err != nil {
-			panic(err)
-		}
+		transactionStatus = TransactionFailed
+		recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 		response = NilResponse{
 			Status:    "error",
 			Code:      "credit_failed",
@@ -322,10 +245,8 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		return response, fmt.Errorf("failed to credit to balance for user %s: %v", trEntry.ToAccount, err)
 	}
 
-	transactionStatus = 0
-	if err := SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus); err != nil {
-		panic(err)
-	}
+	transactionStatus = TransactionCompleted
+	recordEscrowTransaction(context, dbSvc, combinedTenants, transaction, transactionStatus)
 
 	// now finally here: if cashout.provider was bok, then we should make a table for nil that will include:
 	// - the transaction id
@@ -345,7 +266,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		Data: data{
 			TransactionID: uid,
 			Amount:        trEntry.Amount,
-			Currency:      "SDG",
+			Currency:      currencyOf(sender),
 			UUID:          trEntry.InitiatorUUID,
 			SignedUUID:    trEntry.SignedUUID,
 		},
@@ -354,7 +275,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	return response, nil
 }
 
-func GetEscrowTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) ([]EscrowTransaction, error) {
+func GetEscrowTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantID string) ([]EscrowTransaction, error) {
 	indexName := "FromTenantIDIndex"
 	input := &dynamodb.QueryInput{
 		TableName: aws.String("EscrowTransactions"),
@@ -383,7 +304,7 @@ func GetEscrowTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantID
 	return transactions, nil
 }
 
-func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider ServiceProvider) error {
+func CreateServiceProvider(ctx context.Context, dbSvc DynamoDBAPI, serviceProvider ServiceProvider) error {
 	// Marshal the ServiceProvider struct into a DynamoDB item
 	if serviceProvider.Email == "" {
 		return fmt.Errorf("email is required")
@@ -392,7 +313,10 @@ func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceP
 		return fmt.Errorf("tenantID and escrowAccount are required")
 	}
 	if serviceProvider.Currency == "" {
-		serviceProvider.Currency = "SDG"
+		serviceProvider.Currency = DefaultCurrency
+	}
+	if err := ValidateCurrency(serviceProvider.Currency); err != nil {
+		return err
 	}
 
 	serviceProvider.LastAccessed = time.Now().Format(time.RFC3339)
@@ -421,7 +345,7 @@ func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceP
 	return nil
 }
 
-func GetServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email string) (*ServiceProvider, error) {
+func GetServiceProvider(ctx context.Context, dbSvc DynamoDBAPI, email string) (*ServiceProvider, error) {
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String("ServiceProviders"),
 		Key: map[string]types.AttributeValue{
@@ -446,7 +370,7 @@ func GetServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email strin
 	return &serviceProvider, nil
 }
 
-func UpdateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email string, svcProvider ServiceProvider) error {
+func UpdateServiceProvider(ctx context.Context, dbSvc DynamoDBAPI, email string, svcProvider ServiceProvider) error {
 	// Initialize an empty update expression and attribute values map
 	updateExpression := "SET"
 	expressionAttributeValues := make(map[string]types.AttributeValue)
@@ -499,7 +423,7 @@ func UpdateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email st
 	return nil
 }
 
-func ReverseEscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+func ReverseEscrowTransferCredits(context context.Context, dbSvc DynamoDBAPI, es EscrowTransaction) error {
 	// Create a new EscrowTransaction with reversed From and To accounts
 	reversedEs := EscrowTransaction{
 		FromAccount:   ESCROW_ACCOUNT,
@@ -519,7 +443,7 @@ func ReverseEscrowTransferCredits(context context.Context, dbSvc *dynamodb.Clien
 }
 
 // StoreLocalWebhooks saves transactions in webhooks into a state so that it is retrievable later
-func StoreLocalWebhooks(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider string, transaction EscrowTransaction) error {
+func StoreLocalWebhooks(ctx context.Context, dbSvc DynamoDBAPI, serviceProvider string, transaction EscrowTransaction) error {
 	item, err := attributevalue.MarshalMap(transaction)
 	if err != nil {
 		// reverse the transfer here if fails!
@@ -558,7 +482,7 @@ func parseTimeInput(input string) (int64, error) {
 	return 0, fmt.Errorf("unable to parse time input: %s", input)
 }
 
-func QueryServiceProviderTransactions(ctx context.Context, svc *dynamodb.Client, serviceProvider, startDateStr, endDateStr string, pageSize int32, lastEvaluatedKey map[string]types.AttributeValue) (*QueryResultEscrowWebhookTable, error) {
+func QueryServiceProviderTransactions(ctx context.Context, svc DynamoDBAPI, serviceProvider, startDateStr, endDateStr string, pageSize int32, lastEvaluatedKey map[string]types.AttributeValue) (*QueryResultEscrowWebhookTable, error) {
 	startTimestamp, err := parseTimeInput(startDateStr)
 	if err != nil {
 		log.Printf("Warning: invalid start date (%s), using 1 month ago as default", startDateStr)
@@ -611,7 +535,7 @@ func QueryServiceProviderTransactions(ctx context.Context, svc *dynamodb.Client,
 	}, nil
 }
 
-func GetEscrowTransactionByUUID(ctx context.Context, svc *dynamodb.Client, uuid string) ([]EscrowTransaction, error) {
+func GetEscrowTransactionByUUID(ctx context.Context, svc DynamoDBAPI, uuid string) ([]EscrowTransaction, error) {
 	// Prepare the query input
 	input := &dynamodb.QueryInput{
 		TableName: aws.String(EscrowTransactionsTable),
@@ -644,7 +568,7 @@ func GetEscrowTransactionByUUID(ctx context.Context, svc *dynamodb.Client, uuid
 	return transactions, nil
 }
 
-func IsDuplicateEscrowTransaction(ctx context.Context, svc *dynamodb.Client, uuid string) bool {
+func IsDuplicateEscrowTransaction(ctx context.Context, svc DynamoDBAPI, uuid string) bool {
 	// Prepare the Query input
 	input := &dynamodb.QueryInput{
 		TableName: aws.String(EscrowTransactionsTable),
@@ -0,0 +1,334 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EscrowHoldsTable holds the escrowed transfers of EscrowTransfer, keyed by
+// TenantID and EscrowID.
+var EscrowHoldsTable = "EscrowHolds"
+
+const (
+	EscrowHeld     = "held"
+	EscrowReleased = "released"
+	EscrowRefunded = "refunded"
+)
+
+// ErrNotArbitrator is returned when someone other than an escrow's
+// arbitrator tries to release or refund it.
+var ErrNotArbitrator = errors.New("not_arbitrator")
+
+// ErrEscrowNotHeld is returned for an escrow that was already released or
+// refunded.
+var ErrEscrowNotHeld = errors.New("escrow_not_held")
+
+// EscrowHold is money a buyer paid a seller that the tenant holds in its
+// EscrowHoldingAccount until the arbitrator, such as the marketplace,
+// releases it to the seller or refunds it to the buyer.
+//
+// Every step is recorded in TransactionsTable: the funding transaction,
+// whose TransactionID is the EscrowID, stays pending while the money is held
+// and is completed with the arbitrator's decision in its StatusHistory; the
+// release or refund is a transaction of its own. All of them carry the
+// escrow_id metadata.
+type EscrowHold struct {
+	TenantID    string  `dynamodbav:"TenantID" json:"tenant_id"`
+	EscrowID    string  `dynamodbav:"EscrowID" json:"escrow_id"`
+	FromAccount string  `dynamodbav:"FromAccount" json:"from_account"`
+	ToAccount   string  `dynamodbav:"ToAccount" json:"to_account"`
+	Amount      float64 `dynamodbav:"Amount" json:"amount"`
+	// Arbitrator is the identity allowed to release or refund the escrow.
+	Arbitrator string `dynamodbav:"Arbitrator" json:"arbitrator"`
+	Narrative  string `dynamodbav:"Narrative,omitempty" json:"narrative,omitempty"`
+	Status     string `dynamodbav:"Status" json:"status"`
+	// SettlementID is the transaction that released or refunded the escrow,
+	// and Reason the arbitrator's reason for it.
+	SettlementID string `dynamodbav:"SettlementID,omitempty" json:"settlement_id,omitempty"`
+	Reason       string `dynamodbav:"Reason,omitempty" json:"reason,omitempty"`
+	CreatedAt    int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt    int64  `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// EscrowTransferRequest is a transfer to be escrowed by EscrowTransfer.
+type EscrowTransferRequest struct {
+	TenantID      string  `json:"tenant_id,omitempty"`
+	FromAccount   string  `json:"from_account"`
+	ToAccount     string  `json:"to_account"`
+	Amount        float64 `json:"amount"`
+	Arbitrator    string  `json:"arbitrator"`
+	Narrative     string  `json:"narrative,omitempty"`
+	InitiatorUUID string  `json:"uuid,omitempty"`
+}
+
+// EscrowTransfer debits the sender into the tenant's EscrowHoldingAccount,
+// where the money is held for the receiver until the arbitrator calls
+// ReleaseEscrow or RefundEscrow.
+//
+// The escrow passes the controls of a transfer to the receiver before the
+// money is held. It cannot wait for approval or be held for release, so an
+// amount over the tenant's ApprovalThreshold or LargeTransferThreshold fails
+// with ErrApprovalRequired or ErrTransferDelayed.
+func EscrowTransfer(ctx context.Context, dbSvc DynamoDBAPI, req EscrowTransferRequest) (*EscrowHold, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	err := validation.Collect(
+		validation.TenantID("tenant_id", req.TenantID),
+		validation.AccountID("from_account", req.FromAccount),
+		validation.AccountID("to_account", req.ToAccount),
+		validation.Distinct("to_account", req.FromAccount, req.ToAccount),
+		validation.AmountPrecision("amount", req.Amount, maxPrecision()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Arbitrator) == "" {
+		return nil, errors.New("an escrow needs an arbitrator")
+	}
+	narrative, err := SanitizeNarrative(req.Narrative)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.EscrowHoldingAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no escrow holding account", req.TenantID)
+	}
+	sender, err := readAccount(ctx, dbSvc, req.TenantID, req.FromAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", req.FromAccount, err)
+	}
+	if err := checkDormant(sender); err != nil {
+		return nil, err
+	}
+	receiver, err := readAccount(ctx, dbSvc, req.TenantID, req.ToAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", req.ToAccount, err)
+	}
+	if err := cfg.currencyMismatchError(sender, receiver); err != nil {
+		return nil, err
+	}
+	currency := cfg.accountCurrency(sender)
+	if err := checkPrecision(req.Amount, currency); err != nil {
+		return nil, err
+	}
+	remaining := RoundAmount(sender.Amount-req.Amount, currency)
+	if remaining < cfg.balanceFloor(sender) {
+		return nil, errors.New("insufficient balance")
+	}
+	now := clockOf(dbSvc).Now()
+	err = cfg.checkTransfer(ctx, dbSvc, transferCheck{
+		req:     TransferRequest{TenantID: req.TenantID, FromAccount: req.FromAccount, ToAccount: req.ToAccount, Amount: req.Amount},
+		sender:  sender,
+		credits: []credit{{receiver, req.Amount}},
+		now:     now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now.Unix()
+	hold := &EscrowHold{
+		TenantID:    req.TenantID,
+		EscrowID:    newID(dbSvc),
+		FromAccount: req.FromAccount,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Arbitrator:  req.Arbitrator,
+		Narrative:   narrative,
+		Status:      EscrowHeld,
+		CreatedAt:   timestamp,
+		UpdatedAt:   timestamp,
+	}
+	item, err := attributevalue.MarshalMap(hold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal escrow: %v", err)
+	}
+	legs := []JournalLeg{
+		{AccountID: req.FromAccount, Type: LegDebit, Amount: req.Amount, Overdraft: remaining < 0},
+		{AccountID: cfg.EscrowHoldingAccount, Type: LegCredit, Amount: req.Amount},
+	}
+	record, err := escrowRecord(*hold, hold.EscrowID, NarrativeEscrow, req.FromAccount, cfg.EscrowHoldingAccount, legs, req.InitiatorUUID, TransactionPending, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[string]*User{req.FromAccount: sender}
+	err = postJournal(ctx, dbSvc, req.TenantID, hold.EscrowID, req.InitiatorUUID, sender, legs, nil, accounts, timestamp, record, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(EscrowHoldsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(EscrowID)"),
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fund escrow: %v", err)
+	}
+	notify(ctx, dbSvc, req.TenantID, req.ToAccount, fmt.Sprintf("%.2f from %s is held in escrow for you. Reference: %s", req.Amount, req.FromAccount, hold.EscrowID))
+	return hold, nil
+}
+
+// escrowRecord returns the transaction item recording a movement of an
+// escrow's funds.
+func escrowRecord(hold EscrowHold, journalId, comment, from, to string, legs []JournalLeg, initiatorUUID string, status TransactionStatus, timestamp int64) (types.TransactWriteItem, error) {
+	record := newTransactionRecord(TransferRequest{
+		TenantID:      hold.TenantID,
+		FromAccount:   from,
+		ToAccount:     to,
+		Amount:        hold.Amount,
+		InitiatorUUID: initiatorUUID,
+		Narrative:     hold.Narrative,
+		Metadata:      map[string]string{"escrow_id": hold.EscrowID},
+	}, comment, journalId, timestamp)
+	record.Status = status
+	record.JournalID = journalId
+	record.Legs = legs
+	if journalId != hold.EscrowID {
+		record.ParentTransactionID = hold.EscrowID
+	}
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: av}}, nil
+}
+
+// GetEscrow returns an escrow.
+func GetEscrow(ctx context.Context, dbSvc DynamoDBAPI, tenantId, escrowId string) (*EscrowHold, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowHoldsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"EscrowID": &types.AttributeValueMemberS{Value: escrowId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow: %v", err)
+	}
+	if result.Item == nil {
+		return nil, errors.New("escrow not found")
+	}
+	var hold EscrowHold
+	if err := attributevalue.UnmarshalMap(result.Item, &hold); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow: %v", err)
+	}
+	return &hold, nil
+}
+
+// ReleaseEscrow pays a held escrow to its receiver. Only the escrow's
+// arbitrator can release it, and only once.
+func ReleaseEscrow(ctx context.Context, dbSvc DynamoDBAPI, tenantId, escrowId, arbitrator, reason string) (*EscrowHold, error) {
+	return resolveEscrow(ctx, dbSvc, tenantId, escrowId, arbitrator, reason, EscrowReleased)
+}
+
+// RefundEscrow pays a held escrow back to its sender. Only the escrow's
+// arbitrator can refund it, and only once.
+func RefundEscrow(ctx context.Context, dbSvc DynamoDBAPI, tenantId, escrowId, arbitrator, reason string) (*EscrowHold, error) {
+	return resolveEscrow(ctx, dbSvc, tenantId, escrowId, arbitrator, reason, EscrowRefunded)
+}
+
+// resolveEscrow moves a held escrow's funds to its receiver or sender,
+// completes its funding transaction and sets its status, in one transaction
+// guarded by the escrow still being held.
+func resolveEscrow(ctx context.Context, dbSvc DynamoDBAPI, tenantId, escrowId, arbitrator, reason, status string) (*EscrowHold, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	hold, err := GetEscrow(ctx, dbSvc, tenantId, escrowId)
+	if err != nil {
+		return nil, err
+	}
+	if arbitrator == "" || arbitrator != hold.Arbitrator {
+		return nil, fmt.Errorf("%w: escrow %s", ErrNotArbitrator, escrowId)
+	}
+	if hold.Status != EscrowHeld {
+		return nil, fmt.Errorf("%w: escrow %s is %s", ErrEscrowNotHeld, escrowId, hold.Status)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if cfg.EscrowHoldingAccount == "" {
+		return nil, fmt.Errorf("tenant %s has no escrow holding account", tenantId)
+	}
+
+	to, comment := hold.ToAccount, NarrativeEscrowReleased
+	if status == EscrowRefunded {
+		to, comment = hold.FromAccount, NarrativeEscrowRefunded
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	change, err := attributevalue.Marshal(StatusChange{From: TransactionPending, To: TransactionCompleted, Actor: arbitrator, Reason: status + ": " + reason, Time: timestamp})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal status change: %v", err)
+	}
+	funding := types.TransactWriteItem{Update: &types.Update{
+		TableName: aws.String(TransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+			"TransactionID": &types.AttributeValueMemberS{Value: hold.EscrowID},
+		},
+		UpdateExpression:    aws.String("SET #status = :completed, #history = list_append(if_not_exists(#history, :empty), :change)"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":  "TransactionStatus",
+			"#history": "StatusHistory",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed": &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionCompleted))},
+			":pending":   &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionPending))},
+			":change":    &types.AttributeValueMemberL{Value: []types.AttributeValue{change}},
+			":empty":     &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+	}}
+	journalId, err := settleHeld(ctx, dbSvc, tenantId, cfg.EscrowHoldingAccount, to, hold.Amount, timestamp, func(journalId string, legs []JournalLeg) ([]types.TransactWriteItem, error) {
+		record, err := escrowRecord(*hold, journalId, comment, cfg.EscrowHoldingAccount, to, legs, "", TransactionCompleted, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return []types.TransactWriteItem{record, funding, {Update: &types.Update{
+			TableName: aws.String(EscrowHoldsTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+				"EscrowID": &types.AttributeValueMemberS{Value: hold.EscrowID},
+			},
+			UpdateExpression:         aws.String("SET #status = :status, SettlementID = :settlement, Reason = :reason, UpdatedAt = :now"),
+			ConditionExpression:      aws.String("#status = :held"),
+			ExpressionAttributeNames: map[string]string{"#status": "Status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status":     &types.AttributeValueMemberS{Value: status},
+				":held":       &types.AttributeValueMemberS{Value: EscrowHeld},
+				":settlement": &types.AttributeValueMemberS{Value: journalId},
+				":reason":     &types.AttributeValueMemberS{Value: reason},
+				":now":        &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+			},
+		}}}, nil
+	})
+	if err != nil {
+		if current, getErr := GetEscrow(ctx, dbSvc, tenantId, escrowId); getErr == nil && current.Status != EscrowHeld {
+			return nil, fmt.Errorf("%w: escrow %s was %s concurrently", ErrEscrowNotHeld, escrowId, current.Status)
+		}
+		return nil, fmt.Errorf("failed to resolve escrow %s: %v", escrowId, err)
+	}
+	hold.Status, hold.SettlementID, hold.Reason, hold.UpdatedAt = status, journalId, reason, timestamp
+	notify(ctx, dbSvc, tenantId, to, fmt.Sprintf("Escrow %s of %.2f has been %s to you.", hold.EscrowID, hold.Amount, status))
+	return hold, nil
+}
@@ -0,0 +1,191 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	// AccountEventsTable holds one event stream per account, keyed by StreamID
+	// (tenant and account) and EventID. ExpiresAt should be enabled as the
+	// table's TTL attribute.
+	AccountEventsTable = "AccountEvents"
+
+	// AccountEventRetention is how long events stay readable by GetEventsSince.
+	AccountEventRetention = 7 * 24 * time.Hour
+
+	// AccountEventSettleDelay holds back the newest events until writes that
+	// started earlier have committed, so a cursor never skips past an event.
+	AccountEventSettleDelay = 2 * time.Second
+
+	// ProjectionsTable holds the projections the streams package derives
+	// from the TransactionsTable and LedgerTable streams, keyed by
+	// ProjectionID and ItemKey. ExpiresAt should be enabled as the table's TTL
+	// attribute; it expires the markers of applied stream records.
+	ProjectionsTable = "Projections"
+
+	// StreamCheckpointsTable holds the position of each stream consumer in
+	// each shard, keyed by Consumer and ShardID.
+	StreamCheckpointsTable = "StreamCheckpoints"
+)
+
+// ErrInvalidCursor is returned by GetEventsSince for a cursor it did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EventBalanceChanged is the type of the event posted for every account a
+// journal moves money in or out of.
+const EventBalanceChanged = "balance_changed"
+
+// AccountEvent is an entry of an account's event stream. EventIDs start with
+// the creation time in nanoseconds, so they sort by time and double as the
+// stream cursor.
+type AccountEvent struct {
+	StreamID      string  `dynamodbav:"StreamID" json:"-"`
+	EventID       string  `dynamodbav:"EventID" json:"event_id"`
+	TenantID      string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	AccountID     string  `dynamodbav:"AccountID" json:"account_id"`
+	Type          string  `dynamodbav:"Type" json:"type"`
+	TransactionID string  `dynamodbav:"TransactionID" json:"transaction_id,omitempty"`
+	Amount        float64 `dynamodbav:"Amount" json:"amount"`
+	Time          int64   `dynamodbav:"Time" json:"time"`
+	ExpiresAt     int64   `dynamodbav:"ExpiresAt" json:"-"`
+}
+
+func eventStreamID(tenantId, accountId string) string {
+	return tenantId + "#" + accountId
+}
+
+// eventID returns a unique ID sorting after every event created before t.
+func eventID(t time.Time) string {
+	return fmt.Sprintf("%019d-%s", t.UnixNano(), ksuid.New().String())
+}
+
+// newAccountEvent returns an event for the stream of accountId. Amount is the
+// signed change of the account's balance.
+func newAccountEvent(tenantId, accountId, eventType, transactionId string, amount float64, timestamp int64) AccountEvent {
+	return AccountEvent{
+		StreamID:      eventStreamID(tenantId, accountId),
+		EventID:       eventID(time.Now()),
+		TenantID:      tenantId,
+		AccountID:     accountId,
+		Type:          eventType,
+		TransactionID: transactionId,
+		Amount:        amount,
+		Time:          timestamp,
+		ExpiresAt:     timestamp + int64(AccountEventRetention.Seconds()),
+	}
+}
+
+// GetEventsSince returns up to limit events of an account posted after the
+// cursor, oldest first, and the cursor to pass on the next call. An empty
+// cursor starts at the oldest retained event. When nothing new is available
+// the events are empty and the cursor is returned unchanged.
+func GetEventsSince(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, cursor string, limit int32) ([]AccountEvent, string, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	if cursor != "" {
+		if _, err := strconv.ParseInt(strings.SplitN(cursor, "-", 2)[0], 10, 64); err != nil {
+			return nil, cursor, fmt.Errorf("%w %q", ErrInvalidCursor, cursor)
+		}
+	}
+
+	// Events not yet settled are left for the next call; "~" sorts after
+	// the rest of any event ID of that nanosecond.
+	settled := fmt.Sprintf("%019d~", time.Now().Add(-AccountEventSettleDelay).UnixNano())
+	from := cursor
+	if from == "" {
+		from = "0"
+	}
+	if from >= settled {
+		return nil, cursor, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(AccountEventsTable),
+		KeyConditionExpression: aws.String("StreamID = :streamID AND EventID BETWEEN :from AND :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":streamID": &types.AttributeValueMemberS{Value: eventStreamID(tenantId, accountId)},
+			":from":     &types.AttributeValueMemberS{Value: from},
+			":to":       &types.AttributeValueMemberS{Value: settled},
+		},
+		Limit: aws.Int32(limit + 1),
+	}
+	result, err := dbSvc.Query(ctx, input)
+	if err != nil {
+		return nil, cursor, fmt.Errorf("failed to query account events: %v", err)
+	}
+
+	var events []AccountEvent
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &events); err != nil {
+		return nil, cursor, fmt.Errorf("failed to unmarshal account events: %v", err)
+	}
+	// BETWEEN is inclusive, so the event at the cursor comes back first.
+	if len(events) > 0 && events[0].EventID == cursor {
+		events = events[1:]
+	}
+	if len(events) > int(limit) {
+		events = events[:limit]
+	}
+	if len(events) == 0 {
+		return nil, cursor, nil
+	}
+	return events, events[len(events)-1].EventID, nil
+}
+
+// WaitForEvents long-polls GetEventsSince every interval until there is at
+// least one event, the context is done, or wait has elapsed, in which case
+// it returns no events and the unchanged cursor.
+func WaitForEvents(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, cursor string, limit int32, wait, interval time.Duration) ([]AccountEvent, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		events, next, err := GetEventsSince(ctx, dbSvc, tenantId, accountId, cursor, limit)
+		if err != nil || len(events) > 0 {
+			return events, next, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, cursor, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetAppEventsSince is GetEventsSince for a third-party app, reading the
+// stream of the account that granted consentId to appId.
+func GetAppEventsSince(ctx context.Context, dbSvc DynamoDBAPI, tenantId, appId, consentId, cursor string, limit int32) ([]AccountEvent, string, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	app, err := GetThirdPartyApp(ctx, dbSvc, tenantId, appId)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if app.Disabled {
+		return nil, cursor, fmt.Errorf("third-party app %s is disabled", appId)
+	}
+	consent, err := GetConsent(ctx, dbSvc, tenantId, consentId)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if err := consent.active(appId, getCurrentTimestamp()); err != nil {
+		return nil, cursor, err
+	}
+	return GetEventsSince(ctx, dbSvc, tenantId, consent.AccountID, cursor, limit)
+}
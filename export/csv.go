@@ -0,0 +1,63 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+var csvHeader = []string{"transaction_id", "date", "from_account", "to_account", "amount", "fee", "tax", "currency", "status", "comment"}
+
+type csvEncoder struct {
+	w  *csv.Writer
+	st statement
+}
+
+func newCSVEncoder(w io.Writer, st statement) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w), st: st}
+}
+
+func (e *csvEncoder) begin() error {
+	return e.w.Write(csvHeader)
+}
+
+func (e *csvEncoder) write(tx ledger.TransactionEntry) error {
+	amount := tx.Amount
+	if e.st.AccountID != "" && succeeded(tx) {
+		amount = tx.NetAmount(e.st.AccountID)
+	}
+	status := "failed"
+	if succeeded(tx) {
+		status = "success"
+	}
+	return e.w.Write([]string{
+		csvCell(tx.SystemTransactionID),
+		time.Unix(tx.TransactionDate, 0).UTC().Format(time.RFC3339),
+		csvCell(tx.FromAccount),
+		csvCell(tx.ToAccount),
+		strconv.FormatFloat(amount, 'f', 2, 64),
+		strconv.FormatFloat(tx.Fee, 'f', 2, 64),
+		strconv.FormatFloat(tx.Tax, 'f', 2, 64),
+		e.st.currency(tx),
+		status,
+		csvCell(tx.Comment),
+	})
+}
+
+func (e *csvEncoder) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvCell neutralizes text that spreadsheets would evaluate as a formula.
+// Quoting of separators and quotes is left to encoding/csv.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
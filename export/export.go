@@ -0,0 +1,165 @@
+// Package export writes ledger transactions in formats understood by
+// accounting software: CSV, OFX and QIF.
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+// Format is an export file format.
+type Format string
+
+const (
+	FormatCSV Format = "csv"
+	FormatOFX Format = "ofx"
+	FormatQIF Format = "qif"
+)
+
+// ParseFormat returns the format named s, e.g. from a download request.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case FormatCSV, FormatOFX, FormatQIF:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unsupported export format: %s", s)
+	}
+}
+
+// ContentType returns the MIME type to serve the format with.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatOFX:
+		return "application/x-ofx"
+	case FormatQIF:
+		return "application/qif"
+	default:
+		return "text/csv"
+	}
+}
+
+// pageSize is how many transactions are read per query while exporting.
+const pageSize = 100
+
+// statement describes what is being exported.
+type statement struct {
+	TenantID  string
+	AccountID string
+	Start     time.Time
+	End       time.Time
+	// Currency is the account's, or the tenant's for tenant exports; rows
+	// of transactions recorded without a currency are written in it.
+	Currency string
+}
+
+type encoder interface {
+	begin() error
+	write(tx ledger.TransactionEntry) error
+	end() error
+}
+
+// ExportTransactions streams the transactions of a tenant to w in the given
+// format, reading them page by page so exports of any size use constant
+// memory. When accountId is set only that account's transactions are
+// exported and amounts are signed from its point of view; OFX and QIF are
+// account statements and require it. The filter's AccountID,
+// LastEvaluatedKey and Limit are managed by the export.
+func ExportTransactions(ctx context.Context, dbSvc ledger.DynamoDBAPI, w io.Writer, tenantId, accountId string, filter ledger.TransactionFilter, format Format) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	st := statement{TenantID: tenantId, AccountID: accountId, End: time.Now().UTC()}
+	if filter.StartTime != 0 {
+		st.Start = time.Unix(filter.StartTime, 0).UTC()
+	}
+	if filter.EndTime != 0 {
+		st.End = time.Unix(filter.EndTime, 0).UTC()
+	}
+	currency, err := ledger.AccountCurrency(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return err
+	}
+	st.Currency = currency
+
+	enc, err := newEncoder(w, format, st)
+	if err != nil {
+		return err
+	}
+	if err := enc.begin(); err != nil {
+		return fmt.Errorf("failed to write export header: %v", err)
+	}
+
+	filter.AccountID = accountId
+	filter.LastEvaluatedKey = nil
+	filter.Limit = pageSize
+	for {
+		transactions, lastKey, err := ledger.GetAllNilTransactions(ctx, dbSvc, tenantId, filter)
+		if err != nil {
+			return err
+		}
+		for _, tx := range transactions {
+			if err := enc.write(tx); err != nil {
+				return fmt.Errorf("failed to write transaction %s: %v", tx.SystemTransactionID, err)
+			}
+		}
+		if len(lastKey) == 0 {
+			break
+		}
+		filter.LastEvaluatedKey = lastKey
+	}
+
+	if err := enc.end(); err != nil {
+		return fmt.Errorf("failed to write export trailer: %v", err)
+	}
+	return nil
+}
+
+func newEncoder(w io.Writer, format Format, st statement) (encoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVEncoder(w, st), nil
+	case FormatOFX, FormatQIF:
+		if st.AccountID == "" {
+			return nil, fmt.Errorf("%s export requires an account ID", format)
+		}
+		if format == FormatOFX {
+			return &ofxEncoder{w: w, st: st}, nil
+		}
+		return &qifEncoder{w: w, st: st}, nil
+	default:
+		return nil, errors.New("unsupported export format: " + string(format))
+	}
+}
+
+// succeeded reports whether a transaction moved money. Statements only list
+// those; the CSV export includes failed ones with their status.
+func succeeded(tx ledger.TransactionEntry) bool {
+	return tx.Status != nil && *tx.Status == ledger.TransactionCompleted
+}
+
+// currency returns the currency of a transaction in the statement.
+func (st statement) currency(tx ledger.TransactionEntry) string {
+	if tx.Currency != "" {
+		return tx.Currency
+	}
+	return st.Currency
+}
+
+// counterparty returns the other side of a transaction for accountId.
+func counterparty(tx ledger.TransactionEntry, accountId string) string {
+	if tx.FromAccount == accountId {
+		return tx.ToAccount
+	}
+	return tx.FromAccount
+}
+
+// singleLine collapses line breaks, which the line based formats cannot hold.
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,123 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+func encode(t *testing.T, format Format, st statement, txs []ledger.TransactionEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := newEncoder(&buf, format, st)
+	if err != nil {
+		t.Fatalf("newEncoder() error = %v", err)
+	}
+	if err := enc.begin(); err != nil {
+		t.Fatalf("begin() error = %v", err)
+	}
+	for _, tx := range txs {
+		if err := enc.write(tx); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	if err := enc.end(); err != nil {
+		t.Fatalf("end() error = %v", err)
+	}
+	return buf.String()
+}
+
+func testTransactions() []ledger.TransactionEntry {
+	ok, failed := ledger.TransactionCompleted, ledger.TransactionFailed
+	date := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC).Unix()
+	return []ledger.TransactionEntry{
+		{SystemTransactionID: "tx1", FromAccount: "A", ToAccount: "B", Amount: 100, Fee: 2, FeePaidBy: ledger.FeePaidBySender, TransactionDate: date, Status: &ok, Comment: "rent, \"March\"\nthanks"},
+		{SystemTransactionID: "tx2", FromAccount: "C & Co", ToAccount: "A", Amount: 50, TransactionDate: date, Status: &ok, Comment: "=HYPERLINK(\"x\")"},
+		{SystemTransactionID: "tx3", FromAccount: "A", ToAccount: "B", Amount: 10, TransactionDate: date, Status: &failed},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Format
+		wantErr bool
+	}{
+		{"csv", FormatCSV, false},
+		{" OFX ", FormatOFX, false},
+		{"qif", FormatQIF, false},
+		{"xlsx", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFormat(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFormat(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseFormat(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStatementFormatsRequireAccount(t *testing.T) {
+	for _, format := range []Format{FormatOFX, FormatQIF} {
+		if _, err := newEncoder(&bytes.Buffer{}, format, statement{TenantID: "nil"}); err == nil {
+			t.Errorf("newEncoder(%s) without account should fail", format)
+		}
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	got := encode(t, FormatCSV, statement{TenantID: "nil", AccountID: "A", Currency: "SDG"}, testTransactions())
+	want := `transaction_id,date,from_account,to_account,amount,fee,tax,currency,status,comment
+tx1,2024-03-01T10:30:00Z,A,B,-102.00,2.00,0.00,SDG,success,"rent, ""March""
+thanks"
+tx2,2024-03-01T10:30:00Z,C & Co,A,50.00,0.00,0.00,SDG,success,"'=HYPERLINK(""x"")"
+tx3,2024-03-01T10:30:00Z,A,B,10.00,0.00,0.00,SDG,failed,
+`
+	if got != want {
+		t.Errorf("CSV export = \n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOFXExport(t *testing.T) {
+	st := statement{TenantID: "nil", AccountID: "A", Currency: "SDG", Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)}
+	got := encode(t, FormatOFX, st, testTransactions())
+	for _, want := range []string{
+		"<DTSTART>20240301000000</DTSTART>",
+		"<TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20240301103000</DTPOSTED><TRNAMT>-102.00</TRNAMT><FITID>tx1</FITID><NAME>B</NAME><MEMO>rent, &#34;March&#34; thanks</MEMO>",
+		"<TRNTYPE>CREDIT</TRNTYPE><DTPOSTED>20240301103000</DTPOSTED><TRNAMT>50.00</TRNAMT><FITID>tx2</FITID><NAME>C &amp; Co</NAME>",
+		"</OFX>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("OFX export missing %q in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "tx3") {
+		t.Errorf("OFX export includes a failed transaction")
+	}
+}
+
+func TestQIFExport(t *testing.T) {
+	got := encode(t, FormatQIF, statement{TenantID: "nil", AccountID: "A"}, testTransactions())
+	want := `!Type:Bank
+D03/01/2024
+T-102.00
+Ntx1
+PB
+Mrent, "March" thanks
+^
+D03/01/2024
+T50.00
+Ntx2
+PC & Co
+M=HYPERLINK("x")
+^
+`
+	if got != want {
+		t.Errorf("QIF export = \n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package export
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+// ofxNameLimit is the maximum length of the OFX NAME element.
+const ofxNameLimit = 32
+
+// ofxEncoder writes an OFX 2.2 bank statement.
+type ofxEncoder struct {
+	w  io.Writer
+	st statement
+}
+
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405")
+}
+
+func (e *ofxEncoder) begin() error {
+	_, err := fmt.Fprintf(e.w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<TRNUID>0</TRNUID>
+<STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS>
+<CURDEF>%s</CURDEF>
+<BANKACCTFROM><BANKID>%s</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST>
+<DTSTART>%s</DTSTART>
+<DTEND>%s</DTEND>
+`, e.st.Currency, xmlText(e.st.TenantID), xmlText(e.st.AccountID), ofxTime(e.st.Start), ofxTime(e.st.End))
+	return err
+}
+
+func (e *ofxEncoder) write(tx ledger.TransactionEntry) error {
+	if !succeeded(tx) {
+		return nil
+	}
+	amount := tx.NetAmount(e.st.AccountID)
+	trnType := "CREDIT"
+	if amount < 0 {
+		trnType = "DEBIT"
+	}
+	name := []rune(singleLine(counterparty(tx, e.st.AccountID)))
+	if len(name) > ofxNameLimit {
+		name = name[:ofxNameLimit]
+	}
+	_, err := fmt.Fprintf(e.w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%.2f</TRNAMT><FITID>%s</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+		trnType, ofxTime(time.Unix(tx.TransactionDate, 0)), amount, xmlText(tx.SystemTransactionID), xmlText(string(name)), xmlText(singleLine(tx.Comment)))
+	return err
+}
+
+func (e *ofxEncoder) end() error {
+	_, err := io.WriteString(e.w, `</BANKTRANLIST>
+</STMTRS>
+</STMTTRNRS>
+</BANKMSGSRSV1>
+</OFX>
+`)
+	return err
+}
+
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
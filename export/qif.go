@@ -0,0 +1,38 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+// qifEncoder writes a QIF bank register. QIF has no escaping: every field is
+// one line, so line breaks are collapsed out of free text.
+type qifEncoder struct {
+	w  io.Writer
+	st statement
+}
+
+func (e *qifEncoder) begin() error {
+	_, err := io.WriteString(e.w, "!Type:Bank\n")
+	return err
+}
+
+func (e *qifEncoder) write(tx ledger.TransactionEntry) error {
+	if !succeeded(tx) {
+		return nil
+	}
+	_, err := fmt.Fprintf(e.w, "D%s\nT%.2f\nN%s\nP%s\nM%s\n^\n",
+		time.Unix(tx.TransactionDate, 0).UTC().Format("01/02/2006"),
+		tx.NetAmount(e.st.AccountID),
+		singleLine(tx.SystemTransactionID),
+		singleLine(counterparty(tx, e.st.AccountID)),
+		singleLine(tx.Comment))
+	return err
+}
+
+func (e *qifEncoder) end() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// FailedOperationsTable is the dead-letter table of writes that failed after
+// money moved, or that left no record of a transfer. It needs a
+// StatusCreatedAtIndex GSI (Status, CreatedAt) for ReplayFailedOperations.
+var FailedOperationsTable = "FailedOperations"
+
+const (
+	FailedOperationPending  = "pending"
+	FailedOperationReplayed = "replayed"
+)
+
+// Kinds of FailedOperation.
+const (
+	// FailedOpSaveRecord stores Record, the transaction record of a
+	// transfer.
+	FailedOpSaveRecord = "save_record"
+	// FailedOpSaveTransaction stores Transaction, the record of an escrow
+	// transfer.
+	FailedOpSaveTransaction = "save_transaction"
+	// FailedOpRefund credits Amount back to AccountID, the sender of an
+	// escrow transfer debited without the matching credit, as a reversal
+	// journal of the transfer.
+	FailedOpRefund = "refund"
+)
+
+// FailedOperation is a write that failed where the transfer could neither
+// stop nor undo it. It holds everything needed to make the write again.
+type FailedOperation struct {
+	TenantID    string `dynamodbav:"TenantID" json:"tenant_id"`
+	OperationID string `dynamodbav:"OperationID" json:"operation_id"`
+	Kind        string `dynamodbav:"Kind" json:"kind"`
+	// TransactionID is the transaction the operation belongs to.
+	TransactionID string             `dynamodbav:"TransactionID" json:"transaction_id"`
+	Record        *TransactionRecord `dynamodbav:"Record,omitempty" json:"record,omitempty"`
+	Transaction   *TransactionEntry  `dynamodbav:"Transaction,omitempty" json:"transaction,omitempty"`
+	AccountID     string             `dynamodbav:"AccountID,omitempty" json:"account_id,omitempty"`
+	Amount        float64            `dynamodbav:"Amount,omitempty" json:"amount,omitempty"`
+	Status        string             `dynamodbav:"Status" json:"status"`
+	// Error is the error of the first attempt, LastError that of the last
+	// replay.
+	Error     string `dynamodbav:"Error" json:"error"`
+	LastError string `dynamodbav:"LastError,omitempty" json:"last_error,omitempty"`
+	Attempts  int    `dynamodbav:"Attempts" json:"attempts"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt int64  `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// recordTransaction stores a transaction record, and dead-letters it if it
+// cannot be stored.
+func recordTransaction(ctx context.Context, dbSvc DynamoDBAPI, record TransactionRecord, status TransactionStatus) {
+	if err := saveTransactionRecord(ctx, dbSvc, record, status); err != nil {
+		record.Status = status
+		deadLetter(ctx, dbSvc, FailedOperation{TenantID: record.TenantID, Kind: FailedOpSaveRecord, TransactionID: record.TransactionID, Record: &record}, err)
+	}
+	recordAnalytics(ctx, dbSvc, record, status)
+}
+
+// recordEscrowTransaction is recordTransaction for escrow transfers, whose
+// records are stored under both tenants.
+func recordEscrowTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, transaction TransactionEntry, status TransactionStatus) {
+	if err := SaveToTransactionTable(dbSvc, tenantId, transaction, status); err != nil {
+		transaction.TenantID, transaction.Status = tenantId, &status
+		deadLetter(ctx, dbSvc, FailedOperation{TenantID: tenantId, Kind: FailedOpSaveTransaction, TransactionID: transaction.SystemTransactionID, Transaction: &transaction}, err)
+	}
+}
+
+// deadLetter stores a failed operation for ReplayFailedOperations. When
+// even that fails, the operation is logged at error level with all of its
+// context, as a last resort.
+func deadLetter(ctx context.Context, dbSvc DynamoDBAPI, op FailedOperation, cause error) {
+	now := clockOf(dbSvc).Now().Unix()
+	op.OperationID = newID(dbSvc)
+	op.Status = FailedOperationPending
+	op.Error = cause.Error()
+	op.CreatedAt, op.UpdatedAt = now, now
+	item, err := attributevalue.MarshalMap(op)
+	if err == nil {
+		_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(FailedOperationsTable),
+			Item:      item,
+		})
+	}
+	logger := loggerOf(dbSvc)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to store failed operation", "tenant", op.TenantID, "kind", op.Kind, "txid", op.TransactionID,
+			"account", op.AccountID, "amount", op.Amount, "record", op.Record, "transaction", op.Transaction, "cause", cause, "error", err)
+		return
+	}
+	logger.WarnContext(ctx, "operation dead-lettered", "tenant", op.TenantID, "kind", op.Kind, "txid", op.TransactionID, "operation", op.OperationID, "error", cause)
+}
+
+// ListFailedOperations returns the failed operations of a tenant, oldest
+// first.
+func ListFailedOperations(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]FailedOperation, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(FailedOperationsTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var ops []FailedOperation
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query failed operations: %v", err)
+		}
+		var page []FailedOperation
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failed operations: %v", err)
+		}
+		ops = append(ops, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return ops, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// ReplayFailedOperations makes the pending failed operations of every
+// tenant again, and returns how many succeeded. Each operation is applied
+// in one transaction with its move to replayed, so it is never applied
+// twice. Operations that fail again stay pending, with their attempts and
+// last error updated. It is run periodically by a job.
+func ReplayFailedOperations(ctx context.Context, dbSvc DynamoDBAPI) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(FailedOperationsTable),
+		IndexName:                aws.String("StatusCreatedAtIndex"),
+		KeyConditionExpression:   aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: FailedOperationPending},
+		},
+	}
+	replayed := 0
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to query failed operations: %v", err)
+		}
+		var page []FailedOperation
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return replayed, fmt.Errorf("failed to unmarshal failed operations: %v", err)
+		}
+		for _, op := range page {
+			if err := replayFailedOperation(ctx, dbSvc, op); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			replayed++
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return replayed, errors.Join(errs...)
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+func replayFailedOperation(ctx context.Context, dbSvc DynamoDBAPI, op FailedOperation) error {
+	now := strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)
+	key := map[string]types.AttributeValue{
+		"TenantID":    &types.AttributeValueMemberS{Value: op.TenantID},
+		"OperationID": &types.AttributeValueMemberS{Value: op.OperationID},
+	}
+	replayed := types.TransactWriteItem{Update: &types.Update{
+		TableName:                aws.String(FailedOperationsTable),
+		Key:                      key,
+		UpdateExpression:         aws.String("SET #status = :replayed, Attempts = Attempts + :one, UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":replayed": &types.AttributeValueMemberS{Value: FailedOperationReplayed},
+			":pending":  &types.AttributeValueMemberS{Value: FailedOperationPending},
+			":one":      &types.AttributeValueMemberN{Value: "1"},
+			":now":      &types.AttributeValueMemberN{Value: now},
+		},
+	}}
+	var err error
+	if op.Kind == FailedOpRefund {
+		err = postRefund(ctx, dbSvc, op.TenantID, op.TransactionID, "", op.AccountID, op.Amount, replayed)
+	} else {
+		var item types.TransactWriteItem
+		if item, err = op.write(); err != nil {
+			return err
+		}
+		_, err = dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{item, replayed},
+		})
+	}
+	if err == nil {
+		return nil
+	}
+	replayErr := fmt.Errorf("failed to replay %s operation %s of transaction %s: %v", op.Kind, op.OperationID, op.TransactionID, err)
+	_, updateErr := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(FailedOperationsTable),
+		Key:                      key,
+		UpdateExpression:         aws.String("SET Attempts = Attempts + :one, LastError = :error, UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: FailedOperationPending},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":error":   &types.AttributeValueMemberS{Value: err.Error()},
+			":now":     &types.AttributeValueMemberN{Value: now},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if updateErr != nil && !errors.As(updateErr, &condErr) {
+		return errors.Join(replayErr, fmt.Errorf("failed to update failed operation %s: %v", op.OperationID, updateErr))
+	}
+	return replayErr
+}
+
+// write returns the write the operation failed to make. Refunds are
+// journals, posted by postRefund instead.
+func (op FailedOperation) write() (types.TransactWriteItem, error) {
+	switch op.Kind {
+	case FailedOpSaveRecord, FailedOpSaveTransaction:
+		var item map[string]types.AttributeValue
+		var err error
+		switch {
+		case op.Record != nil:
+			item, err = attributevalue.MarshalMap(op.Record)
+		case op.Transaction != nil:
+			item, err = attributevalue.MarshalMap(op.Transaction)
+		default:
+			return types.TransactWriteItem{}, fmt.Errorf("failed operation %s has no transaction", op.OperationID)
+		}
+		if err != nil {
+			return types.TransactWriteItem{}, fmt.Errorf("failed to marshal transaction of failed operation %s: %v", op.OperationID, err)
+		}
+		return types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: item}}, nil
+	default:
+		return types.TransactWriteItem{}, fmt.Errorf("failed operation %s has unknown kind %q", op.OperationID, op.Kind)
+	}
+}
+
+// postRefund credits amount back to an account debited by a transaction
+// that could not complete, as a reversal journal of the transaction, with
+// the extra items.
+func postRefund(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId, initiatorUUID, accountId string, amount float64, extra ...types.TransactWriteItem) error {
+	return postLeg(ctx, dbSvc, tenantId, transactionId, initiatorUUID, JournalLeg{AccountID: accountId, Type: LegReversal, Amount: amount}, extra...)
+}
@@ -0,0 +1,148 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FeeType selects how a FeeSchedule computes the fee.
+type FeeType string
+
+const (
+	FeeFlat       FeeType = "flat"
+	FeePercentage FeeType = "percentage"
+	FeeTiered     FeeType = "tiered"
+)
+
+// Who pays the fee: the sender pays on top of the amount, the receiver gets
+// the amount minus the fee.
+const (
+	FeePaidBySender   = "sender"
+	FeePaidByReceiver = "receiver"
+)
+
+// FeeTier is one band of a tiered schedule. It applies to amounts up to and
+// including UpTo; the last tier may leave UpTo as zero to cover everything above.
+type FeeTier struct {
+	UpTo       float64 `dynamodbav:"UpTo" json:"up_to,omitempty"`
+	Flat       float64 `dynamodbav:"Flat" json:"flat,omitempty"`
+	Percentage float64 `dynamodbav:"Percentage" json:"percentage,omitempty"`
+}
+
+// FeeSchedule is the fee configuration of a tenant. Percentages are expressed
+// in percent, so 1.5 means 1.5% of the amount.
+type FeeSchedule struct {
+	Type       FeeType   `dynamodbav:"Type" json:"type"`
+	Flat       float64   `dynamodbav:"Flat" json:"flat,omitempty"`
+	Percentage float64   `dynamodbav:"Percentage" json:"percentage,omitempty"`
+	Tiers      []FeeTier `dynamodbav:"Tiers" json:"tiers,omitempty"`
+	// Min and Max clamp the computed fee; zero disables the bound.
+	Min    float64 `dynamodbav:"Min" json:"min,omitempty"`
+	Max    float64 `dynamodbav:"Max" json:"max,omitempty"`
+	PaidBy string  `dynamodbav:"PaidBy" json:"paid_by,omitempty"`
+	// CollectionAccount is the account in the same tenant credited with the fees.
+	CollectionAccount string `dynamodbav:"CollectionAccount" json:"collection_account"`
+}
+
+// Validate checks that the schedule is usable.
+func (f *FeeSchedule) Validate() error {
+	if f.CollectionAccount == "" {
+		return errors.New("fee schedule requires a collection account")
+	}
+	if f.PaidBy != "" && f.PaidBy != FeePaidBySender && f.PaidBy != FeePaidByReceiver {
+		return fmt.Errorf("unknown fee payer: %s", f.PaidBy)
+	}
+	if f.Flat < 0 || f.Percentage < 0 || f.Min < 0 || f.Max < 0 {
+		return errors.New("fee values must not be negative")
+	}
+	if f.Max != 0 && f.Min > f.Max {
+		return errors.New("minimum fee is greater than maximum fee")
+	}
+	switch f.Type {
+	case FeeFlat, FeePercentage:
+	case FeeTiered:
+		if len(f.Tiers) == 0 {
+			return errors.New("tiered fee schedule has no tiers")
+		}
+		for i, tier := range f.Tiers {
+			if tier.Flat < 0 || tier.Percentage < 0 {
+				return errors.New("fee values must not be negative")
+			}
+			last := i == len(f.Tiers)-1
+			if tier.UpTo == 0 && !last {
+				return errors.New("only the last fee tier may be unbounded")
+			}
+			if i > 0 && tier.UpTo != 0 && tier.UpTo <= f.Tiers[i-1].UpTo {
+				return errors.New("fee tiers must be sorted by ascending bound")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown fee type: %s", f.Type)
+	}
+	return nil
+}
+
+// Calculate returns the fee for a transfer of amount, rounded to 2 decimals.
+// A nil schedule charges nothing.
+func (f *FeeSchedule) Calculate(amount float64) float64 {
+	if f == nil || amount <= 0 {
+		return 0
+	}
+	var fee float64
+	switch f.Type {
+	case FeeFlat:
+		fee = f.Flat
+	case FeePercentage:
+		fee = amount * f.Percentage / 100
+	case FeeTiered:
+		for _, tier := range f.Tiers {
+			if tier.UpTo == 0 || amount <= tier.UpTo {
+				fee = tier.Flat + amount*tier.Percentage/100
+				break
+			}
+		}
+	}
+	if f.Min != 0 && fee < f.Min {
+		fee = f.Min
+	}
+	if f.Max != 0 && fee > f.Max {
+		fee = f.Max
+	}
+	return roundAmount(fee)
+}
+
+// payer returns who pays the fee, defaulting to the sender.
+func (f *FeeSchedule) payer() string {
+	if f == nil || f.PaidBy == "" {
+		return FeePaidBySender
+	}
+	return f.PaidBy
+}
+
+// TaxSchedule levies a tax, e.g. VAT, on the transfer fee. The tax is paid by
+// whoever pays the fee. Rate is expressed in percent of the fee.
+type TaxSchedule struct {
+	Rate float64 `dynamodbav:"Rate" json:"rate"`
+	// CollectionAccount is the account in the same tenant credited with the tax.
+	CollectionAccount string `dynamodbav:"CollectionAccount" json:"collection_account"`
+}
+
+// Validate checks that the schedule is usable.
+func (t *TaxSchedule) Validate() error {
+	if t.CollectionAccount == "" {
+		return errors.New("tax schedule requires a collection account")
+	}
+	if t.Rate < 0 {
+		return errors.New("tax rate must not be negative")
+	}
+	return nil
+}
+
+// Calculate returns the tax due on fee, rounded to 2 decimals. A nil schedule
+// charges nothing.
+func (t *TaxSchedule) Calculate(fee float64) float64 {
+	if t == nil || fee <= 0 {
+		return 0
+	}
+	return roundAmount(fee * t.Rate / 100)
+}
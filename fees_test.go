@@ -0,0 +1,83 @@
+package ledger
+
+import "testing"
+
+func TestFeeScheduleCalculate(t *testing.T) {
+	tiered := &FeeSchedule{
+		Type: FeeTiered,
+		Tiers: []FeeTier{
+			{UpTo: 1000, Flat: 5},
+			{UpTo: 10000, Percentage: 1},
+			{Flat: 50, Percentage: 0.5},
+		},
+	}
+	tests := []struct {
+		name     string
+		schedule *FeeSchedule
+		amount   float64
+		want     float64
+	}{
+		{"nil schedule", nil, 100, 0},
+		{"flat", &FeeSchedule{Type: FeeFlat, Flat: 2.5}, 100, 2.5},
+		{"percentage", &FeeSchedule{Type: FeePercentage, Percentage: 1.5}, 200, 3},
+		{"percentage rounded", &FeeSchedule{Type: FeePercentage, Percentage: 1}, 10.555, 0.11},
+		{"percentage min", &FeeSchedule{Type: FeePercentage, Percentage: 1, Min: 1}, 10, 1},
+		{"percentage max", &FeeSchedule{Type: FeePercentage, Percentage: 1, Max: 20}, 10000, 20},
+		{"tiered first band", tiered, 1000, 5},
+		{"tiered second band", tiered, 5000, 50},
+		{"tiered open band", tiered, 20000, 150},
+		{"zero amount", &FeeSchedule{Type: FeeFlat, Flat: 2.5}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Calculate(tt.amount); got != tt.want {
+				t.Errorf("Calculate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeeScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule FeeSchedule
+		wantErr  bool
+	}{
+		{"valid flat", FeeSchedule{Type: FeeFlat, Flat: 1, CollectionAccount: "FEES"}, false},
+		{"missing account", FeeSchedule{Type: FeeFlat, Flat: 1}, true},
+		{"unknown type", FeeSchedule{Type: "weird", CollectionAccount: "FEES"}, true},
+		{"unknown payer", FeeSchedule{Type: FeeFlat, PaidBy: "bank", CollectionAccount: "FEES"}, true},
+		{"negative", FeeSchedule{Type: FeePercentage, Percentage: -1, CollectionAccount: "FEES"}, true},
+		{"unsorted tiers", FeeSchedule{Type: FeeTiered, Tiers: []FeeTier{{UpTo: 100}, {UpTo: 50}}, CollectionAccount: "FEES"}, true},
+		{"unbounded middle tier", FeeSchedule{Type: FeeTiered, Tiers: []FeeTier{{}, {UpTo: 50}}, CollectionAccount: "FEES"}, true},
+		{"min above max", FeeSchedule{Type: FeeFlat, Min: 5, Max: 1, CollectionAccount: "FEES"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTaxScheduleCalculate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule *TaxSchedule
+		fee      float64
+		want     float64
+	}{
+		{"nil schedule", nil, 10, 0},
+		{"no fee", &TaxSchedule{Rate: 17}, 0, 0},
+		{"rate", &TaxSchedule{Rate: 17}, 10, 1.7},
+		{"rounded", &TaxSchedule{Rate: 17}, 2.5, 0.43},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Calculate(tt.fee); got != tt.want {
+				t.Errorf("Calculate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Scanner is implemented by clients that can scan tables, such as
+// *dynamodb.Client and the ledgertest fake. ExportFullLedger needs the
+// client a Ledger wraps to implement it.
+type Scanner interface {
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+var _ Scanner = (*dynamodb.Client)(nil)
+
+// Defaults and limits of FullExportOptions.
+const (
+	DefaultExportSegments = 4
+	MaxExportSegments     = 64
+	DefaultExportPageSize = 1000
+)
+
+// FullExportOptions tunes ExportFullLedger. Its zero value scans
+// DefaultExportSegments segments of DefaultExportPageSize items, as fast as
+// DynamoDB allows.
+type FullExportOptions struct {
+	// Segments is the number of segments scanned in parallel, at most
+	// MaxExportSegments.
+	Segments int
+	// PageSize is the number of items each Scan call reads.
+	PageSize int32
+	// PagesPerSecond caps the Scan calls of all segments together, to
+	// leave the table's capacity to transfers; zero does not limit them.
+	PagesPerSecond float64
+	// Resume continues the export a checkpoint was taken of. Its segments
+	// are used when Segments is zero, and must match it otherwise.
+	Resume *ExportCheckpoint
+	// Checkpoint is called with the progress of the export after each page
+	// is written. Persisting it with the output written so far lets an
+	// interrupted export resume where it stopped.
+	Checkpoint func(ExportCheckpoint) error
+}
+
+// ExportCheckpoint is the progress of ExportFullLedger.
+type ExportCheckpoint struct {
+	TenantID string          `json:"tenant_id"`
+	Segments []ExportSegment `json:"segments"`
+	// Exported counts the ledger entries written.
+	Exported int64 `json:"exported"`
+}
+
+// ExportSegment is the progress of one scan segment: the page token of its
+// next page, "" before its first page, and whether it is done.
+type ExportSegment struct {
+	Cursor string `json:"cursor,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// ExportFullLedger writes every ledger entry of a tenant to w as JSON Lines,
+// for regulator data requests and warehouse loads, and returns the
+// checkpoint it stopped at. LedgerTable is scanned in parallel segments,
+// and entries are written as their pages arrive, in no particular order.
+//
+// The scan reads the entries of every tenant and keeps the tenant's, so it
+// consumes the read capacity of the whole table; see PagesPerSecond. On
+// failure, the error is returned with the checkpoint of what was written,
+// for the export to be resumed with FullExportOptions.Resume.
+func ExportFullLedger(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, w io.Writer, opts FullExportOptions) (*ExportCheckpoint, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	scanner, ok := dbSvc.(Scanner)
+	if !ok {
+		return nil, errors.New("the dynamodb client cannot scan tables")
+	}
+	progress := &ExportCheckpoint{TenantID: tenantId}
+	segments := opts.Segments
+	if resume := opts.Resume; resume != nil {
+		switch {
+		case resume.TenantID != tenantId:
+			return nil, fmt.Errorf("checkpoint is of tenant %s", resume.TenantID)
+		case segments != 0 && segments != len(resume.Segments):
+			return nil, fmt.Errorf("checkpoint has %d segments, not %d", len(resume.Segments), segments)
+		}
+		segments = len(resume.Segments)
+		progress.Segments = slices.Clone(resume.Segments)
+		progress.Exported = resume.Exported
+	}
+	if segments == 0 {
+		segments = DefaultExportSegments
+	}
+	if segments < 1 || segments > MaxExportSegments {
+		return nil, fmt.Errorf("segments must be between 1 and %d", MaxExportSegments)
+	}
+	if progress.Segments == nil {
+		progress.Segments = make([]ExportSegment, segments)
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultExportPageSize
+	}
+
+	export := &fullExport{
+		scanner:    scanner,
+		w:          w,
+		progress:   progress,
+		checkpoint: opts.Checkpoint,
+	}
+	if opts.PagesPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.PagesPerSecond))
+		defer ticker.Stop()
+		export.pages = ticker.C
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range progress.Segments {
+		if progress.Segments[i].Done {
+			continue
+		}
+		input := &dynamodb.ScanInput{
+			TableName:        aws.String(LedgerTable),
+			FilterExpression: aws.String("TenantID = :tenant"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			},
+			Segment:       aws.Int32(int32(i)),
+			TotalSegments: aws.Int32(int32(segments)),
+			Limit:         aws.Int32(pageSize),
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := export.segment(ctx, i, input); err != nil {
+				export.fail(err)
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if export.err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "ledger export failed", "tenant", tenantId, "exported", progress.Exported, "error", export.err)
+	}
+	return progress, export.err
+}
+
+// fullExport is an ExportFullLedger in progress. mu serializes the writes
+// of its segments, and guards progress and err.
+type fullExport struct {
+	scanner    Scanner
+	w          io.Writer
+	checkpoint func(ExportCheckpoint) error
+	pages      <-chan time.Time
+
+	mu       sync.Mutex
+	progress *ExportCheckpoint
+	err      error
+}
+
+// segment scans one segment of the export from its cursor to its end.
+func (e *fullExport) segment(ctx context.Context, i int, input *dynamodb.ScanInput) error {
+	e.mu.Lock()
+	cursor := e.progress.Segments[i].Cursor
+	e.mu.Unlock()
+	startKey, err := DecodePageToken(cursor)
+	if err != nil {
+		return err
+	}
+	input.ExclusiveStartKey = startKey
+	for {
+		if e.pages != nil {
+			select {
+			case <-e.pages:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		resp, err := e.scanner.Scan(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to scan segment %d: %v", i, err)
+		}
+		var entries []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &entries); err != nil {
+			return fmt.Errorf("failed to unmarshal ledger entries: %v", err)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return fmt.Errorf("failed to encode ledger entry: %v", err)
+			}
+		}
+		next, err := EncodePageToken(resp.LastEvaluatedKey)
+		if err != nil {
+			return err
+		}
+		if err := e.write(i, buf.Bytes(), len(entries), next); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// write writes a page of a segment and moves the segment's cursor past it.
+func (e *fullExport) write(i int, page []byte, entries int, next string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	if len(page) > 0 {
+		if _, err := e.w.Write(page); err != nil {
+			return fmt.Errorf("failed to write ledger entries: %v", err)
+		}
+	}
+	e.progress.Segments[i] = ExportSegment{Cursor: next, Done: next == ""}
+	e.progress.Exported += int64(entries)
+	if e.checkpoint == nil {
+		return nil
+	}
+	checkpoint := *e.progress
+	checkpoint.Segments = slices.Clone(e.progress.Segments)
+	if err := e.checkpoint(checkpoint); err != nil {
+		return fmt.Errorf("failed to save export checkpoint: %v", err)
+	}
+	return nil
+}
+
+// fail records the first error of the export's segments.
+func (e *fullExport) fail(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
@@ -0,0 +1,282 @@
+// Package grpcclient is the Go client of the ledger's gRPC service, served
+// by the grpcserver package. It wraps the generated ledgerpb stubs with the
+// semantics every caller needs: transient failures are retried, transfers
+// carry an idempotency key the ledger deduplicates them on, and failures are
+// returned as typed errors.
+//
+// Calls are authenticated by the server's authenticator from their
+// metadata, so set the credentials on the connection, with
+// grpc.WithPerRPCCredentials, or on each call's context:
+//
+//	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+//	...
+//	c := grpcclient.New(conn)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", apiKey)
+//	res, err := c.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30})
+//	if errors.Is(err, grpcclient.ErrInsufficientBalance) {
+//		...
+//	}
+package grpcclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors of the ledger, to match with errors.Is. Transfer refusals match on
+// the ledger's code, other errors on their gRPC status code.
+var (
+	ErrUnauthenticated     = &Error{Status: codes.Unauthenticated}
+	ErrInvalidArgument     = &Error{Status: codes.InvalidArgument}
+	ErrNotFound            = &Error{Status: codes.NotFound}
+	ErrAlreadyExists       = &Error{Status: codes.AlreadyExists}
+	ErrUnavailable         = &Error{Status: codes.Unavailable}
+	ErrInsufficientBalance = &Error{Code: "insufficient_balance"}
+	ErrLimitExceeded       = &Error{Code: "limit_exceeded"}
+	ErrMaintenance         = &Error{Code: "tenant_maintenance"}
+	ErrRateLimited         = &Error{Code: "rate_limited"}
+	// ErrIdempotencyKeyReused is returned for a transfer whose idempotency
+	// key was used for a different transfer.
+	ErrIdempotencyKeyReused = &Error{Code: "idempotency_key_reused"}
+	// ErrIndeterminate is returned for a transfer that may or may not have
+	// moved money; it is not retried.
+	ErrIndeterminate = &Error{Code: "transaction_indeterminate"}
+)
+
+// Error is a call that failed with a gRPC status.
+type Error struct {
+	// Status is the status code of the call.
+	Status codes.Code
+	// Code is the ledger's code of a refused transfer, such as
+	// "insufficient_balance". It is empty for other calls.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("ledger: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("ledger: %s: %s", e.Status, e.Message)
+}
+
+// Is matches the errors of the package: those with a Code by their code,
+// the others by their status code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	if t.Code != "" {
+		return e.Code == t.Code
+	}
+	return e.Status == t.Status
+}
+
+// Unwrap returns the context error of a cancelled or timed out call.
+func (e *Error) Unwrap() error {
+	switch e.Status {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// Client calls the ledger's gRPC service.
+type Client struct {
+	rpc   ledgerpb.LedgerClient
+	retry ledger.RetryPolicy
+	ids   ledger.IDGenerator
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithRetry sets how calls failing with transient errors are retried, as
+// ledger.WithRetry does for DynamoDB calls. Zero fields are taken from
+// ledger.DefaultRetryPolicy; a MaxAttempts of 1 turns retrying off.
+func WithRetry(policy ledger.RetryPolicy) Option {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = ledger.DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = ledger.DefaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = max(ledger.DefaultRetryPolicy.MaxDelay, policy.BaseDelay)
+	}
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithIDGenerator sets the generator of the idempotency keys Transfer sends,
+// KSUIDs by default.
+func WithIDGenerator(ids ledger.IDGenerator) Option {
+	return func(c *Client) {
+		c.ids = ids
+	}
+}
+
+// New returns a Client calling the ledger over conn.
+func New(conn grpc.ClientConnInterface, opts ...Option) *Client {
+	c := &Client{rpc: ledgerpb.NewLedgerClient(conn), retry: ledger.DefaultRetryPolicy, ids: ledger.KSUIDGenerator{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateAccount creates an empty account. It fails with ErrAlreadyExists for
+// an account that exists, so it is retried on transient errors: the repeat
+// of a creation that went through fails with ErrAlreadyExists.
+func (c *Client) CreateAccount(ctx context.Context, req *ledgerpb.CreateAccountRequest) (*ledgerpb.CreateAccountResponse, error) {
+	var res *ledgerpb.CreateAccountResponse
+	err := c.do(ctx, readCall, func() (err error) {
+		res, err = c.rpc.CreateAccount(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// Transfer runs a transfer. Its idempotency key is req.InitiatorUuid, set to
+// a new ID when empty so the caller can read it back, and sent unchanged on
+// every attempt.
+//
+// The ledger answers a transfer made again with the key of one it took as it
+// answered that one, so a transfer is retried on transient errors, such as a
+// dropped connection, as well as when the ledger refused it in maintenance or
+// rate limited. A transfer that may or may not have moved money fails with
+// ErrIndeterminate and is not retried: the caller makes it again with the
+// same key once the ledger recovered.
+func (c *Client) Transfer(ctx context.Context, req *ledgerpb.TransferRequest) (*ledgerpb.TransferResponse, error) {
+	if req.InitiatorUuid == "" {
+		req.InitiatorUuid = c.ids.NewID()
+	}
+	var res *ledgerpb.TransferResponse
+	err := c.do(ctx, transferCall, func() (err error) {
+		res, err = c.rpc.Transfer(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// InquireBalance returns the balance of an account.
+func (c *Client) InquireBalance(ctx context.Context, accountId string) (float64, error) {
+	var res *ledgerpb.InquireBalanceResponse
+	err := c.do(ctx, readCall, func() (err error) {
+		res, err = c.rpc.InquireBalance(ctx, &ledgerpb.InquireBalanceRequest{AccountId: accountId})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Balance, nil
+}
+
+// ListTransactions returns a page of the tenant's transactions.
+func (c *Client) ListTransactions(ctx context.Context, req *ledgerpb.ListTransactionsRequest) (*ledgerpb.ListTransactionsResponse, error) {
+	var res *ledgerpb.ListTransactionsResponse
+	err := c.do(ctx, readCall, func() (err error) {
+		res, err = c.rpc.ListTransactions(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// GetTransaction returns one transaction; accountId, when set, is the
+// account it must involve.
+func (c *Client) GetTransaction(ctx context.Context, accountId, transactionId string) (*ledgerpb.Transaction, error) {
+	var res *ledgerpb.Transaction
+	err := c.do(ctx, readCall, func() (err error) {
+		res, err = c.rpc.GetTransaction(ctx, &ledgerpb.GetTransactionRequest{AccountId: accountId, TransactionId: transactionId})
+		return err
+	})
+	return res, err
+}
+
+// callKind is how the errors of a call are read and retried.
+type callKind int
+
+const (
+	// readCall is retried on transient errors. Conditional writes, whose
+	// repeat fails its condition, are too.
+	readCall callKind = iota
+	// transferCall has the ledger's code in its errors. It is retried on
+	// transient errors and when the ledger refused it before posting.
+	transferCall
+)
+
+// do runs a call of a kind under the retry policy and returns its error as
+// an *Error.
+func (c *Client) do(ctx context.Context, kind callKind, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := toError(call(), kind == transferCall)
+		if err == nil || attempt+1 >= c.retry.MaxAttempts || !retryable(err, kind) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(c.retry.Delay(attempt)):
+		}
+	}
+}
+
+// retryable reports whether a call of a kind failing with err can be tried
+// again.
+func retryable(err error, kind callKind) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	if kind == transferCall && e.Code != "" {
+		return e.Code == ErrMaintenance.Code || e.Code == ErrRateLimited.Code
+	}
+	switch e.Status {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// toError returns the *Error of a call's status. The status message of a
+// refused transfer starts with the ledger's code.
+func toError(err error, transfer bool) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	e := &Error{Status: s.Code(), Message: s.Message()}
+	if code, message, ok := strings.Cut(s.Message(), ": "); transfer && ok && ledgerCode(code) {
+		e.Code, e.Message = code, message
+	}
+	return e
+}
+
+// ledgerCode reports whether s is a ledger code, such as
+// "insufficient_balance".
+func ledgerCode(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
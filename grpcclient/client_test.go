@@ -0,0 +1,191 @@
+package grpcclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/grpcserver"
+	"github.com/adonese/ledger/ledgerpb"
+	"github.com/adonese/ledger/ledgertest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dial serves db on an in-memory listener, authenticating the "tenant"
+// metadata key, and returns a Client of it.
+func dial(t *testing.T, db ledger.DynamoDBAPI, opts ...Option) *Client {
+	t.Helper()
+	auth := func(ctx context.Context, md metadata.MD) (string, string, error) {
+		if v := md.Get("tenant"); len(v) == 1 {
+			return v[0], "grpc-test", nil
+		}
+		return "", "", errors.New("no tenant")
+	}
+	lis := bufconn.Listen(1 << 20)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := grpcserver.NewServer(ledger.NewLedger(db, ledger.WithLogger(logger)), auth)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return New(conn, opts...)
+}
+
+func TestClient(t *testing.T) {
+	db := ledgertest.NewDB()
+	c := dial(t, db)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant", "acme")
+
+	if _, err := c.InquireBalance(context.Background(), "alice"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("InquireBalance() without a tenant error = %v, want ErrUnauthenticated", err)
+	}
+	if err := ledger.CreateAccount(context.Background(), db, "acme", ledger.User{AccountID: "alice", Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateAccount(ctx, &ledgerpb.CreateAccountRequest{AccountId: "bob"}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	if _, err := c.CreateAccount(ctx, &ledgerpb.CreateAccountRequest{AccountId: "alice"}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("CreateAccount() of an existing account error = %v, want ErrAlreadyExists", err)
+	}
+
+	req := &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30}
+	res, err := c.Transfer(ctx, req)
+	if err != nil || res.Status != "success" {
+		t.Fatalf("Transfer() = %v, %v", res, err)
+	}
+	if req.InitiatorUuid == "" {
+		t.Error("Transfer() did not set an idempotency key")
+	}
+	if tx, err := c.GetTransaction(ctx, "alice", res.TransactionId); err != nil || tx.Amount != 30 {
+		t.Errorf("GetTransaction() = %v, %v", tx, err)
+	}
+	if again, err := c.Transfer(ctx, req); err != nil || again.TransactionId != res.TransactionId {
+		t.Errorf("repeated Transfer() = %v, %v, want %s", again, err, res.TransactionId)
+	}
+	req.Amount = 40
+	if _, err := c.Transfer(ctx, req); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("Transfer() reusing a key error = %v, want ErrIdempotencyKeyReused", err)
+	}
+
+	_, err = c.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 500})
+	var e *Error
+	if !errors.Is(err, ErrInsufficientBalance) || !errors.As(err, &e) || e.Status != codes.FailedPrecondition {
+		t.Errorf("overdrawing Transfer() error = %v, want ErrInsufficientBalance", err)
+	}
+	if _, err := c.InquireBalance(ctx, "carol"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("InquireBalance() of a missing account error = %v, want ErrNotFound", err)
+	}
+	if balance, err := c.InquireBalance(ctx, "alice"); err != nil || balance != 70 {
+		t.Errorf("InquireBalance() = %v, %v, want 70", balance, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.InquireBalance(cancelled, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("InquireBalance() of a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+// flakyLedger fails the calls of a LedgerClient with errs, in turn, before
+// letting them through.
+type flakyLedger struct {
+	ledgerpb.LedgerClient
+	errs  []error
+	calls int
+	keys  []string
+}
+
+func (f *flakyLedger) fail() error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *flakyLedger) InquireBalance(ctx context.Context, req *ledgerpb.InquireBalanceRequest, opts ...grpc.CallOption) (*ledgerpb.InquireBalanceResponse, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return &ledgerpb.InquireBalanceResponse{AccountId: req.AccountId, Balance: 70}, nil
+}
+
+func (f *flakyLedger) CreateAccount(ctx context.Context, req *ledgerpb.CreateAccountRequest, opts ...grpc.CallOption) (*ledgerpb.CreateAccountResponse, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return &ledgerpb.CreateAccountResponse{AccountId: req.AccountId}, nil
+}
+
+func (f *flakyLedger) Transfer(ctx context.Context, req *ledgerpb.TransferRequest, opts ...grpc.CallOption) (*ledgerpb.TransferResponse, error) {
+	f.keys = append(f.keys, req.InitiatorUuid)
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return &ledgerpb.TransferResponse{TransactionId: "tx-1", Status: "success"}, nil
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	client := func(errs ...error) (*Client, *flakyLedger) {
+		f := &flakyLedger{errs: errs}
+		c := &Client{rpc: f, ids: ledger.KSUIDGenerator{}}
+		WithRetry(ledger.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})(c)
+		return c, f
+	}
+	unavailable := status.Error(codes.Unavailable, "connection reset")
+
+	c, f := client(unavailable, status.Error(codes.ResourceExhausted, "throttled"))
+	if balance, err := c.InquireBalance(ctx, "alice"); err != nil || balance != 70 || f.calls != 3 {
+		t.Errorf("InquireBalance() = %v, %v after %d calls, want 70 after 3", balance, err, f.calls)
+	}
+	c, f = client(unavailable, unavailable, unavailable)
+	if _, err := c.InquireBalance(ctx, "alice"); !errors.Is(err, ErrUnavailable) || f.calls != 3 {
+		t.Errorf("InquireBalance() error = %v after %d calls, want ErrUnavailable after 3", err, f.calls)
+	}
+	c, f = client(status.Error(codes.NotFound, "user alice does not exist"))
+	if _, err := c.InquireBalance(ctx, "alice"); !errors.Is(err, ErrNotFound) || f.calls != 1 {
+		t.Errorf("InquireBalance() error = %v after %d calls, want ErrNotFound after 1", err, f.calls)
+	}
+	c, f = client(unavailable)
+	if _, err := c.CreateAccount(ctx, &ledgerpb.CreateAccountRequest{AccountId: "carol"}); err != nil || f.calls != 2 {
+		t.Errorf("CreateAccount() error = %v after %d calls, want success after 2", err, f.calls)
+	}
+
+	// A transfer refused before posting is retried with the same key.
+	c, f = client(status.Error(codes.Unavailable, "tenant_maintenance: The tenant is in maintenance."))
+	res, err := c.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30})
+	if err != nil || res.TransactionId != "tx-1" || len(f.keys) != 2 || f.keys[0] == "" || f.keys[0] != f.keys[1] {
+		t.Errorf("Transfer() = %v, %v with keys %q, want tx-1 with one key twice", res, err, f.keys)
+	}
+	// So is one failing on a transient error, which the ledger deduplicates
+	// on its key.
+	c, f = client(unavailable)
+	res, err = c.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30, InitiatorUuid: "req-1"})
+	if err != nil || res.TransactionId != "tx-1" || len(f.keys) != 2 || f.keys[0] != "req-1" || f.keys[1] != "req-1" {
+		t.Errorf("Transfer() = %v, %v with keys %q, want tx-1 with req-1 twice", res, err, f.keys)
+	}
+	// One that may have been posted is not.
+	c, f = client(status.Error(codes.Unknown, "transaction_indeterminate: The transaction may or may not have been posted."))
+	if _, err := c.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30}); !errors.Is(err, ErrIndeterminate) || f.calls != 1 {
+		t.Errorf("Transfer() error = %v after %d calls, want ErrIndeterminate after 1", err, f.calls)
+	}
+}
@@ -0,0 +1,328 @@
+// Package grpcserver serves the ledger over gRPC, for services not written
+// in Go. It implements the Ledger service of the ledgerpb package on top of
+// the ledger's package functions.
+//
+// Calls are authenticated by the TenantAuth interceptor, which resolves the
+// tenant from the call's metadata; request messages never name the tenant,
+// so a caller cannot reach another tenant's accounts. NewServer installs it
+// along with the Logging interceptor.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgerpb"
+	"github.com/adonese/ledger/validation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator resolves the tenant of a call, and the actor recorded in the
+// audit log, from its metadata. Returning an error rejects the call with
+// Unauthenticated.
+type Authenticator func(ctx context.Context, md metadata.MD) (tenantId, actor string, err error)
+
+// DefaultPageSize is the page size of ListTransactions when the request
+// does not set one.
+const DefaultPageSize = 50
+
+// Server implements ledgerpb.LedgerServer. It expects the tenant to be set
+// by TenantAuth, and fails calls with Unauthenticated otherwise.
+type Server struct {
+	ledgerpb.UnimplementedLedgerServer
+
+	DB ledger.DynamoDBAPI
+}
+
+// NewServer returns a gRPC server serving the ledger from db, with the
+// TenantAuth and Logging interceptors installed ahead of any in opts. The
+// logger of db is used when it is a *ledger.Ledger.
+func NewServer(db ledger.DynamoDBAPI, auth Authenticator, opts ...grpc.ServerOption) *grpc.Server {
+	var logger ledger.Logger
+	if l, ok := db.(*ledger.Ledger); ok {
+		logger = l.Logger()
+	}
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(Logging(logger), TenantAuth(auth))}, opts...)
+	s := grpc.NewServer(opts...)
+	ledgerpb.RegisterLedgerServer(s, &Server{DB: db})
+	return s
+}
+
+// CreateAccount creates an empty account.
+func (s *Server) CreateAccount(ctx context.Context, req *ledgerpb.CreateAccountRequest) (*ledgerpb.CreateAccountResponse, error) {
+	tenantId, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.AccountId == "" {
+		return nil, status.Error(codes.InvalidArgument, "account_id is required")
+	}
+	err = ledger.CreateAccount(ctx, s.DB, tenantId, ledger.User{
+		AccountID:    req.AccountId,
+		FullName:     req.FullName,
+		MobileNumber: req.MobileNumber,
+		Email:        req.Email,
+		Currency:     req.Currency,
+		TenantID:     tenantId,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &ledgerpb.CreateAccountResponse{AccountId: req.AccountId}, nil
+}
+
+// Transfer runs a transfer. A held transfer succeeds with status "pending".
+func (s *Server) Transfer(ctx context.Context, req *ledgerpb.TransferRequest) (*ledgerpb.TransferResponse, error) {
+	tenantId, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.FromAccount == "" || req.ToAccount == "" {
+		return nil, status.Error(codes.InvalidArgument, "from_account and to_account are required")
+	}
+	var locale string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("accept-language")) > 0 {
+		locale = md.Get("accept-language")[0]
+	}
+	res, err := ledger.Transfer(ctx, s.DB, ledger.TransferRequest{
+		TenantID:      tenantId,
+		FromAccount:   req.FromAccount,
+		ToAccount:     req.ToAccount,
+		Amount:        req.Amount,
+		InitiatorUUID: req.InitiatorUuid,
+		SignedUUID:    req.SignedUuid,
+		Narrative:     req.Narrative,
+		Metadata:      req.Metadata,
+		Tags:          req.Tags,
+		Locale:        locale,
+	})
+	if err != nil || res.Status == "error" {
+		return nil, status.Error(transferCode(res.Code), res.Code+": "+res.Message)
+	}
+	return &ledgerpb.TransferResponse{
+		TransactionId: res.Data.TransactionID,
+		Amount:        res.Data.Amount,
+		Fee:           res.Data.Fee,
+		Status:        res.Status,
+		Code:          res.Code,
+		Message:       res.Message,
+	}, nil
+}
+
+// InquireBalance returns the balance of an account.
+func (s *Server) InquireBalance(ctx context.Context, req *ledgerpb.InquireBalanceRequest) (*ledgerpb.InquireBalanceResponse, error) {
+	tenantId, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.AccountId == "" {
+		return nil, status.Error(codes.InvalidArgument, "account_id is required")
+	}
+	balance, err := ledger.InquireBalance(ctx, s.DB, tenantId, req.AccountId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &ledgerpb.InquireBalanceResponse{AccountId: req.AccountId, Balance: balance}, nil
+}
+
+// ListTransactions returns a page of the tenant's transactions.
+func (s *Server) ListTransactions(ctx context.Context, req *ledgerpb.ListTransactionsRequest) (*ledgerpb.ListTransactionsResponse, error) {
+	tenantId, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Direction != "" && req.AccountId == "" {
+		return nil, status.Error(codes.InvalidArgument, "a direction needs an account_id")
+	}
+	startKey, err := ledger.DecodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid page_token")
+	}
+	limit := req.PageSize
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	transactions, lastKey, err := ledger.GetAllNilTransactions(ctx, s.DB, tenantId, ledger.TransactionFilter{
+		AccountID:        req.AccountId,
+		Direction:        req.Direction,
+		StartTime:        req.StartTime,
+		EndTime:          req.EndTime,
+		Limit:            limit,
+		LastEvaluatedKey: startKey,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	res := &ledgerpb.ListTransactionsResponse{}
+	for i := range transactions {
+		res.Transactions = append(res.Transactions, toTransaction(&transactions[i]))
+	}
+	if res.NextPageToken, err = ledger.EncodePageToken(lastKey); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return res, nil
+}
+
+// GetTransaction returns one transaction.
+func (s *Server) GetTransaction(ctx context.Context, req *ledgerpb.GetTransactionRequest) (*ledgerpb.Transaction, error) {
+	tenantId, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.TransactionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transaction_id is required")
+	}
+	tx, err := ledger.GetTransaction(ctx, s.DB, tenantId, req.AccountId, req.TransactionId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	// The transaction must involve the account asked for, if any.
+	if tx == nil || (req.AccountId != "" && tx.FromAccount != req.AccountId && tx.ToAccount != req.AccountId) {
+		return nil, status.Errorf(codes.NotFound, "transaction %s not found", req.TransactionId)
+	}
+	return toTransaction(tx), nil
+}
+
+func toTransaction(tx *ledger.TransactionEntry) *ledgerpb.Transaction {
+	pb := &ledgerpb.Transaction{
+		TransactionId:   tx.SystemTransactionID,
+		AccountId:       tx.AccountID,
+		FromAccount:     tx.FromAccount,
+		ToAccount:       tx.ToAccount,
+		Amount:          tx.Amount,
+		Fee:             tx.Fee,
+		Comment:         tx.Comment,
+		Narrative:       tx.Narrative,
+		Metadata:        tx.Metadata,
+		Tags:            tx.Tags,
+		TransactionDate: tx.TransactionDate,
+		JournalId:       tx.JournalID,
+	}
+	if tx.Status != nil {
+		pb.Status = tx.Status.String()
+	}
+	return pb
+}
+
+// transferCode maps the code of a refused transfer to a gRPC code.
+func transferCode(code string) codes.Code {
+	switch code {
+	case "user_not_found":
+		return codes.NotFound
+	case "invalid_request", "invalid_amount", "invalid_metadata", "invalid_narrative", "invalid_purpose_code":
+		return codes.InvalidArgument
+	case "insufficient_balance", "limit_exceeded", "account_dormant", "kyc_limit_exceeded", "float_limit_exceeded", "currency_mismatch":
+		return codes.FailedPrecondition
+	case "consent_invalid", "signature_invalid", "transfer_blocked":
+		return codes.PermissionDenied
+	case "tenant_maintenance":
+		return codes.Unavailable
+	case "rate_limited":
+		return codes.ResourceExhausted
+	case "idempotency_key_reused":
+		return codes.AlreadyExists
+	case "request_cancelled":
+		return codes.Canceled
+	case "transaction_indeterminate":
+		return codes.Unknown
+	}
+	return codes.Internal
+}
+
+// toStatus maps an error of the ledger functions to a gRPC status.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, ledger.ErrMaintenance):
+		return status.Error(codes.Unavailable, err.Error())
+	case validation.Fields(err) != nil, errors.Is(err, ledger.ErrInvalidMetadata), errors.Is(err, ledger.ErrInvalidNarrative):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ledger.ErrAccountExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ledger.ErrAccountDormant), errors.Is(err, ledger.ErrKYCLimitExceeded), errors.Is(err, ledger.ErrFloatLimitExceeded):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case strings.Contains(err.Error(), "already exists"):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case strings.Contains(err.Error(), "does not exist"):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// tenantKey is the context key of the tenant set by TenantAuth.
+type tenantKey struct{}
+
+// callInfo is where TenantAuth leaves the tenant for Logging, which runs
+// outside it.
+type callInfo struct {
+	tenantId string
+}
+
+type callInfoKey struct{}
+
+// tenantFrom returns the tenant set by TenantAuth.
+func tenantFrom(ctx context.Context) (string, error) {
+	tenantId, _ := ctx.Value(tenantKey{}).(string)
+	if tenantId == "" {
+		return "", status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	return tenantId, nil
+}
+
+// TenantAuth authenticates unary calls with auth, and puts the tenant and
+// actor it resolves on the call's context.
+func TenantAuth(auth Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if auth == nil {
+			return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		tenantId, actor, err := auth(ctx, md)
+		if err != nil || tenantId == "" {
+			return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+		}
+		ctx = context.WithValue(ctx, tenantKey{}, tenantId)
+		if call, ok := ctx.Value(callInfoKey{}).(*callInfo); ok {
+			call.tenantId = tenantId
+		}
+		if actor != "" {
+			ctx = ledger.WithActor(ctx, actor)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Logging logs every unary call with its method, tenant, status code and
+// duration: at info level when it succeeded and at warn level otherwise. A
+// nil logger logs to slog's default logger. Installed ahead of TenantAuth,
+// it also logs the calls TenantAuth rejects.
+func Logging(logger ledger.Logger) grpc.UnaryServerInterceptor {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		call := &callInfo{}
+		res, err := handler(context.WithValue(ctx, callInfoKey{}, call), req)
+		args := []any{"method", info.FullMethod, "code", status.Code(err).String(), "duration", time.Since(start)}
+		if call.tenantId != "" {
+			args = append(args, "tenant", call.tenantId)
+		}
+		if err != nil {
+			logger.WarnContext(ctx, "grpc call failed", append(args, "error", err)...)
+		} else {
+			logger.InfoContext(ctx, "grpc call", args...)
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,101 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgerpb"
+	"github.com/adonese/ledger/ledgertest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dial serves db on an in-memory listener, authenticating the "tenant"
+// metadata key, and returns a client of it.
+func dial(t *testing.T, db ledger.DynamoDBAPI) ledgerpb.LedgerClient {
+	t.Helper()
+	auth := func(ctx context.Context, md metadata.MD) (string, string, error) {
+		if v := md.Get("tenant"); len(v) == 1 {
+			return v[0], "grpc-test", nil
+		}
+		return "", "", errors.New("no tenant")
+	}
+	lis := bufconn.Listen(1 << 20)
+	s := NewServer(ledger.NewLedger(db, ledger.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))), auth)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ledgerpb.NewLedgerClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	db := ledgertest.NewDB()
+	client := dial(t, db)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant", "acme")
+
+	if _, err := client.InquireBalance(context.Background(), &ledgerpb.InquireBalanceRequest{AccountId: "alice"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("InquireBalance() without a tenant error = %v, want Unauthenticated", err)
+	}
+	if err := ledger.CreateAccount(context.Background(), db, "acme", ledger.User{AccountID: "alice", Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateAccount(ctx, &ledgerpb.CreateAccountRequest{AccountId: "bob"}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	if _, err := client.CreateAccount(ctx, &ledgerpb.CreateAccountRequest{AccountId: "alice"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateAccount() of an existing account error = %v, want AlreadyExists", err)
+	}
+
+	res, err := client.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30, Narrative: "rent"})
+	if err != nil || res.Status != "success" || res.TransactionId == "" {
+		t.Fatalf("Transfer() = %v, %v", res, err)
+	}
+	if _, err := client.Transfer(ctx, &ledgerpb.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 500}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("overdrawing Transfer() error = %v, want FailedPrecondition", err)
+	}
+
+	balance, err := client.InquireBalance(ctx, &ledgerpb.InquireBalanceRequest{AccountId: "alice"})
+	if err != nil || balance.Balance != 70 {
+		t.Errorf("InquireBalance() = %v, %v, want 70", balance, err)
+	}
+	if _, err := client.InquireBalance(ctx, &ledgerpb.InquireBalanceRequest{AccountId: "carol"}); status.Code(err) != codes.NotFound {
+		t.Errorf("InquireBalance() of a missing account error = %v, want NotFound", err)
+	}
+	// Another tenant does not see acme's accounts.
+	other := metadata.AppendToOutgoingContext(context.Background(), "tenant", "other")
+	if _, err := client.InquireBalance(other, &ledgerpb.InquireBalanceRequest{AccountId: "alice"}); status.Code(err) != codes.NotFound {
+		t.Errorf("InquireBalance() from another tenant error = %v, want NotFound", err)
+	}
+
+	tx, err := client.GetTransaction(ctx, &ledgerpb.GetTransactionRequest{AccountId: "bob", TransactionId: res.TransactionId})
+	if err != nil || tx.Amount != 30 || tx.Narrative != "rent" || tx.Status != "Completed" {
+		t.Errorf("GetTransaction() = %v, %v", tx, err)
+	}
+	if _, err := client.GetTransaction(ctx, &ledgerpb.GetTransactionRequest{AccountId: "carol", TransactionId: res.TransactionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetTransaction() for an unrelated account error = %v, want NotFound", err)
+	}
+
+	// The refused transfer is listed as failed.
+	page, err := client.ListTransactions(ctx, &ledgerpb.ListTransactionsRequest{AccountId: "bob", Direction: ledger.DirectionReceived})
+	if err != nil || len(page.Transactions) != 2 {
+		t.Errorf("ListTransactions() = %v, %v", page, err)
+	}
+	if _, err := client.ListTransactions(ctx, &ledgerpb.ListTransactionsRequest{PageToken: "!"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListTransactions() with a bad token error = %v, want InvalidArgument", err)
+	}
+}
@@ -11,7 +11,7 @@ import (
 )
 
 // The StoreTransaction function stores the details of a transaction
-func SaveToTransactionTable(dbSvc *dynamodb.Client, tenantId string, transaction TransactionEntry, status int) error {
+func SaveToTransactionTable(dbSvc DynamoDBAPI, tenantId string, transaction TransactionEntry, status TransactionStatus) error {
 	transaction.Status = &status
 	transaction.TenantID = tenantId
 
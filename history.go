@@ -0,0 +1,163 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Granularity is the bucket size of a balance history.
+type Granularity string
+
+const (
+	GranularityHourly Granularity = "hourly"
+	GranularityDaily  Granularity = "daily"
+)
+
+func (g Granularity) duration() (time.Duration, error) {
+	switch g {
+	case GranularityHourly:
+		return time.Hour, nil
+	case GranularityDaily, "":
+		return 24 * time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unknown granularity: %s", g)
+	}
+}
+
+// BalancePoint is the closing balance of an account for the bucket starting at Time.
+type BalancePoint struct {
+	Time    int64   `json:"time"`
+	Balance float64 `json:"balance"`
+}
+
+// GetBalanceHistory returns the closing balance of an account for every hour
+// or day between from and to. The history is reconstructed by walking back
+// from the current balance over the successful transfers since from, so only
+// the transactions in the window are read.
+func GetBalanceHistory(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, from, to time.Time, granularity Granularity) ([]BalancePoint, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	step, err := granularity.duration()
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, errors.New("from must be before to")
+	}
+
+	current, err := InquireBalance(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	from = from.UTC().Truncate(step)
+	transactions, err := getAccountTransactionsSince(ctx, dbSvc, tenantId, accountId, from.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return balanceHistory(current, transactions, accountId, from, to.UTC(), step, time.Now().UTC()), nil
+}
+
+// balanceHistory rewinds current over the transactions, which must contain
+// every successful transfer of the account after from.
+func balanceHistory(current float64, transactions []TransactionEntry, accountId string, from, to time.Time, step time.Duration, now time.Time) []BalancePoint {
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].TransactionDate > transactions[j].TransactionDate
+	})
+
+	var points []BalancePoint
+	balance := current
+	next := 0
+	for bucket := to.Truncate(step); !bucket.Before(from); bucket = bucket.Add(-step) {
+		closing := bucket.Add(step)
+		if closing.After(now) {
+			closing = now
+		}
+		// Undo everything that happened after the bucket closed.
+		for next < len(transactions) && transactions[next].TransactionDate >= closing.Unix() {
+			balance -= transactions[next].NetAmount(accountId)
+			next++
+		}
+		points = append(points, BalancePoint{Time: bucket.Unix(), Balance: balance})
+	}
+
+	// Points were collected newest first.
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points
+}
+
+// NetAmount returns how much the transaction changed the balance of
+// accountId, negative for money leaving the account and including any fee
+// and tax the account paid.
+func (tx TransactionEntry) NetAmount(accountId string) float64 {
+	var delta float64
+	if tx.FromAccount == accountId {
+		delta -= tx.Amount
+		if tx.FeePaidBy == FeePaidBySender {
+			delta -= tx.Fee + tx.Tax
+		}
+	}
+	if tx.ToAccount == accountId {
+		delta += tx.Amount
+		if tx.FeePaidBy == FeePaidByReceiver {
+			delta -= tx.Fee + tx.Tax
+		}
+	}
+	return delta
+}
+
+// getAccountTransactionsSince returns the successful transactions sent or
+// received by an account since the given unix time.
+func getAccountTransactionsSince(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, since int64) ([]TransactionEntry, error) {
+	var all []TransactionEntry
+	for _, index := range []struct{ name, attribute string }{
+		{"FromAccountIndex", "FromAccount"},
+		{"ToAccountIndex", "ToAccount"},
+	} {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(TransactionsTable),
+			IndexName:              aws.String(index.name),
+			KeyConditionExpression: aws.String("TenantID = :tenantId AND " + index.attribute + " = :accountId"),
+			FilterExpression:       aws.String("TransactionDate >= :since AND TransactionStatus = :ok"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenantId":  &types.AttributeValueMemberS{Value: tenantId},
+				":accountId": &types.AttributeValueMemberS{Value: accountId},
+				":since":     &types.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+				":ok":        &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionCompleted))},
+			},
+		}
+		for {
+			resp, err := dbSvc.Query(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch transactions: %v", err)
+			}
+			var page []TransactionEntry
+			if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
+			}
+			for _, tx := range page {
+				// A self-transfer shows up on both indexes; keep it once.
+				if index.attribute == "ToAccount" && tx.FromAccount == accountId {
+					continue
+				}
+				all = append(all, tx)
+			}
+			if len(resp.LastEvaluatedKey) == 0 {
+				break
+			}
+			input.ExclusiveStartKey = resp.LastEvaluatedKey
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,51 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBalanceHistory(t *testing.T) {
+	day := 24 * time.Hour
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(2 * day)
+	now := from.Add(2*day + 12*time.Hour)
+
+	transactions := []TransactionEntry{
+		{FromAccount: "A", ToAccount: "B", Amount: 10, TransactionDate: from.Add(2 * time.Hour).Unix()},
+		{FromAccount: "B", ToAccount: "A", Amount: 50, TransactionDate: from.Add(day + time.Hour).Unix()},
+		{FromAccount: "A", ToAccount: "B", Amount: 5, Fee: 1, FeePaidBy: FeePaidBySender, TransactionDate: from.Add(2*day + time.Hour).Unix()},
+	}
+
+	got := balanceHistory(134, transactions, "A", from, to, day, now)
+	want := []BalancePoint{
+		{Time: from.Unix(), Balance: 90},
+		{Time: from.Add(day).Unix(), Balance: 140},
+		{Time: from.Add(2 * day).Unix(), Balance: 134},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("balanceHistory() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTransactionEntryNetAmount(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   TransactionEntry
+		want float64
+	}{
+		{"sent", TransactionEntry{FromAccount: "A", ToAccount: "B", Amount: 10}, -10},
+		{"received", TransactionEntry{FromAccount: "B", ToAccount: "A", Amount: 10}, 10},
+		{"sent with fee", TransactionEntry{FromAccount: "A", ToAccount: "B", Amount: 10, Fee: 1, FeePaidBy: FeePaidBySender}, -11},
+		{"received net of fee", TransactionEntry{FromAccount: "B", ToAccount: "A", Amount: 10, Fee: 1, FeePaidBy: FeePaidByReceiver}, 9},
+		{"unrelated", TransactionEntry{FromAccount: "B", ToAccount: "C", Amount: 10}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tx.NetAmount("A"); got != tt.want {
+				t.Errorf("NetAmount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
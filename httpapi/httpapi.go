@@ -0,0 +1,472 @@
+// Package httpapi serves the core ledger operations as a JSON HTTP API, so
+// services need not write their own handlers around the package functions.
+// Every response has the shape of ledger.NilResponse: transfers return it
+// as is, and the other operations put their result in its data field.
+//
+// Handler routes:
+//
+//	POST /accounts                         create an account
+//	PATCH /accounts/{id}                   update an account's profile
+//	GET  /accounts/{id}/balance            the balance of an account
+//	GET  /accounts/{id}/transactions       a page of an account's transactions
+//	POST /transfers                        transfer between two accounts
+//	POST /deposits, POST /withdrawals      move cash in or out of an account
+//	GET  /transactions/{id}                a transaction
+//
+// Mount it under a prefix with http.StripPrefix. The tenant of every request
+// is resolved by the Authenticator, never read from the request.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/validation"
+)
+
+// Authenticator resolves the tenant of a request, and the actor recorded in
+// the audit log. Returning an error rejects the request with 401
+// Unauthorized.
+type Authenticator func(r *http.Request) (tenantId, actor string, err error)
+
+// Middleware wraps a handler, e.g. to rate limit or to add request IDs.
+type Middleware func(http.Handler) http.Handler
+
+// Page sizes of the transaction listing.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 1000
+)
+
+// maxBodyBytes bounds request bodies.
+const maxBodyBytes = 1 << 20
+
+// Handler serves the API.
+type Handler struct {
+	DB           ledger.DynamoDBAPI
+	Authenticate Authenticator
+	// Middleware wraps every request, the first outermost, ahead of
+	// authentication.
+	Middleware []Middleware
+
+	once    sync.Once
+	handler http.Handler
+}
+
+// Response is the body of every response but transfers', which are the
+// ledger.NilResponse of the transfer.
+type Response struct {
+	// Status is "success" or "error".
+	Status string `json:"status"`
+	// Code is machine readable, e.g. "user_not_found".
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Details    string `json:"details,omitempty"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+	Data       any    `json:"data,omitempty"`
+}
+
+// CreateAccountRequest is the body of POST /accounts. Accounts are created
+// empty; they are funded by deposits and transfers, which are journalled.
+type CreateAccountRequest struct {
+	AccountID    string `json:"account_id"`
+	FullName     string `json:"full_name,omitempty"`
+	MobileNumber string `json:"mobile_number,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Currency     string `json:"currency,omitempty"`
+}
+
+// Balance is the data of GET /accounts/{id}/balance.
+type Balance struct {
+	AccountID string  `json:"account_id"`
+	Balance   float64 `json:"balance"`
+}
+
+// AccountProfile is the data of PATCH /accounts/{id}: the updated profile,
+// whose Version the next patch is made from.
+type AccountProfile struct {
+	AccountID    string `json:"account_id"`
+	FullName     string `json:"full_name,omitempty"`
+	City         string `json:"city,omitempty"`
+	MobileNumber string `json:"mobile_number,omitempty"`
+	Dependants   int    `json:"dependants,omitempty"`
+	Version      int64  `json:"version"`
+}
+
+// TransactionPage is the data of GET /accounts/{id}/transactions. Pass
+// NextPageToken as the page_token query parameter for the next page; it is
+// empty on the last page.
+type TransactionPage struct {
+	Transactions  []ledger.TransactionEntry `json:"transactions"`
+	NextPageToken string                    `json:"next_page_token,omitempty"`
+}
+
+// ServeHTTP serves a request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/accounts", h.createAccount)
+		mux.HandleFunc("/accounts/", h.account)
+		mux.HandleFunc("/transfers", h.transfer)
+		mux.HandleFunc("/deposits", h.cash(ledger.DepositCredits))
+		mux.HandleFunc("/withdrawals", h.cash(ledger.WithdrawCredits))
+		mux.HandleFunc("/transactions/", h.transaction)
+		var handler http.Handler = h.authenticate(mux)
+		for i := len(h.Middleware) - 1; i >= 0; i-- {
+			handler = h.Middleware[i](handler)
+		}
+		h.handler = handler
+	})
+	h.handler.ServeHTTP(w, r)
+}
+
+type tenantKey struct{}
+
+// authenticate resolves the tenant of every request before next serves it.
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Authenticate == nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication is required.", "")
+			return
+		}
+		tenantId, actor, err := h.Authenticate(r)
+		if err != nil || tenantId == "" {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication is required.", "")
+			return
+		}
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenantId)
+		if actor != "" {
+			ctx = ledger.WithActor(ctx, actor)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func tenantOf(r *http.Request) string {
+	tenantId, _ := r.Context().Value(tenantKey{}).(string)
+	return tenantId
+}
+
+func (h *Handler) createAccount(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var req CreateAccountRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.AccountID == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "account_id is required.", "")
+		return
+	}
+	tenantId := tenantOf(r)
+	err := ledger.CreateAccount(r.Context(), h.DB, tenantId, ledger.User{
+		AccountID:    req.AccountID,
+		FullName:     req.FullName,
+		MobileNumber: req.MobileNumber,
+		Email:        req.Email,
+		Currency:     req.Currency,
+		TenantID:     tenantId,
+	})
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, Response{Status: "success", Code: "account_created", Message: "The account was created.", Data: Balance{AccountID: req.AccountID}})
+}
+
+// account serves /accounts/{id}, /accounts/{id}/balance and
+// /accounts/{id}/transactions.
+func (h *Handler) account(w http.ResponseWriter, r *http.Request) {
+	accountId, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+	if accountId == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch resource {
+	case "":
+		if !allow(w, r, http.MethodPatch) {
+			return
+		}
+		h.updateAccount(w, r, accountId)
+	case "balance":
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		balance, err := ledger.InquireBalance(r.Context(), h.DB, tenantOf(r), accountId)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Status: "success", Code: "balance", Message: "The balance of the account.", Data: Balance{AccountID: accountId, Balance: balance}})
+	case "transactions":
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		h.transactions(w, r, accountId)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// updateAccount applies the ledger.AccountPatch of the request body.
+func (h *Handler) updateAccount(w http.ResponseWriter, r *http.Request, accountId string) {
+	var patch ledger.AccountPatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&patch); err != nil {
+		if errors.Is(err, ledger.ErrImmutableField) {
+			writeErr(w, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid_request", "The request body is not valid JSON.", err.Error())
+		return
+	}
+	user, err := ledger.UpdateAccount(r.Context(), h.DB, tenantOf(r), accountId, patch)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Status: "success", Code: "account_updated", Message: "The account was updated.", Data: AccountProfile{
+		AccountID:    user.AccountID,
+		FullName:     user.FullName,
+		City:         user.City,
+		MobileNumber: user.MobileNumber,
+		Dependants:   user.Dependants,
+		Version:      user.Version,
+	}})
+}
+
+// transactions lists a page of an account's transactions. The query takes
+// direction ("sent" or "received"), start and end in Unix seconds, limit
+// and page_token.
+func (h *Handler) transactions(w http.ResponseWriter, r *http.Request, accountId string) {
+	query := r.URL.Query()
+	filter := ledger.TransactionFilter{AccountID: accountId, Direction: query.Get("direction"), Limit: DefaultPageSize}
+	var err error
+	if filter.LastEvaluatedKey, err = ledger.DecodePageToken(query.Get("page_token")); err != nil {
+		writeErr(w, err)
+		return
+	}
+	for name, v := range map[string]*int64{"start": &filter.StartTime, "end": &filter.EndTime} {
+		if s := query.Get(name); s != "" {
+			if *v, err = strconv.ParseInt(s, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", name+" must be a Unix time in seconds.", "")
+				return
+			}
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > MaxPageSize {
+			writeError(w, http.StatusBadRequest, "invalid_request", "limit must be between 1 and "+strconv.Itoa(MaxPageSize)+".", "")
+			return
+		}
+		filter.Limit = int32(limit)
+	}
+	transactions, lastKey, err := ledger.GetAllNilTransactions(r.Context(), h.DB, tenantOf(r), filter)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	page := TransactionPage{Transactions: transactions}
+	if page.Transactions == nil {
+		page.Transactions = []ledger.TransactionEntry{}
+	}
+	if page.NextPageToken, err = ledger.EncodePageToken(lastKey); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Status: "success", Code: "transactions", Message: "The transactions of the account.", Data: page})
+}
+
+// transaction serves GET /transactions/{id}. An account_id query parameter
+// limits it to the transactions of that account.
+func (h *Handler) transaction(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	transactionId := strings.TrimPrefix(r.URL.Path, "/transactions/")
+	if transactionId == "" || strings.Contains(transactionId, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	accountId := r.URL.Query().Get("account_id")
+	tx, err := ledger.GetTransaction(r.Context(), h.DB, tenantOf(r), accountId, transactionId)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if tx == nil || (accountId != "" && tx.FromAccount != accountId && tx.ToAccount != accountId) {
+		writeErr(w, ledger.ErrTransactionNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Status: "success", Code: "transaction", Message: "The transaction.", Data: tx})
+}
+
+// transfer serves POST /transfers with a ledger.TransferRequest, answering
+// with the transfer's ledger.NilResponse.
+func (h *Handler) transfer(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var req ledger.TransferRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	req.TenantID = tenantOf(r)
+	if req.Locale == "" {
+		req.Locale = r.Header.Get("Accept-Language")
+	}
+	res, _ := ledger.Transfer(r.Context(), h.DB, req)
+	status := transferStatus(res.Code)
+	if res.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(res.RetryAfter, 10))
+	}
+	writeJSON(w, status, res)
+}
+
+// cash serves POST /deposits and POST /withdrawals with a
+// ledger.CashRequest.
+func (h *Handler) cash(move func(context.Context, ledger.DynamoDBAPI, ledger.CashRequest) (*ledger.TransactionEntry, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodPost) {
+			return
+		}
+		var req ledger.CashRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		req.TenantID = tenantOf(r)
+		tx, err := move(r.Context(), h.DB, req)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, Response{Status: "success", Code: "successful_transaction", Message: "The transaction was posted.", Data: tx})
+	}
+}
+
+// transferStatus maps the code of a transfer response to its HTTP status.
+func transferStatus(code string) int {
+	switch code {
+	case "successful_transaction":
+		return http.StatusOK
+	case "transfer_delayed", "approval_required":
+		return http.StatusAccepted
+	case "invalid_request", "invalid_amount", "invalid_metadata", "invalid_narrative", "invalid_purpose_code":
+		return http.StatusBadRequest
+	case "user_not_found":
+		return http.StatusNotFound
+	case "insufficient_balance", "limit_exceeded", "account_dormant", "kyc_limit_exceeded", "float_limit_exceeded", "currency_mismatch":
+		return http.StatusUnprocessableEntity
+	case "consent_invalid", "signature_invalid", "transfer_blocked":
+		return http.StatusForbidden
+	case "rate_limited":
+		return http.StatusTooManyRequests
+	case "tenant_maintenance":
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errorStatus maps an error of the ledger functions to an HTTP status and
+// response code.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ledger.ErrMaintenance):
+		return http.StatusServiceUnavailable, "tenant_maintenance"
+	case errors.Is(err, ledger.ErrDegraded):
+		return http.StatusServiceUnavailable, "degraded_mode"
+	case errors.Is(err, ledger.ErrProviderUnavailable):
+		return http.StatusServiceUnavailable, "provider_unavailable"
+	case errors.Is(err, ledger.ErrInvalidMetadata):
+		return http.StatusBadRequest, "invalid_metadata"
+	case errors.Is(err, ledger.ErrInvalidNarrative):
+		return http.StatusBadRequest, "invalid_narrative"
+	case errors.Is(err, ledger.ErrInvalidPageToken):
+		return http.StatusBadRequest, "invalid_page_token"
+	case errors.Is(err, ledger.ErrSignatureInvalid):
+		return http.StatusForbidden, "signature_invalid"
+	case errors.Is(err, ledger.ErrDualControl):
+		return http.StatusForbidden, "dual_control_required"
+	case errors.Is(err, ledger.ErrTransactionNotFound):
+		return http.StatusNotFound, "transaction_not_found"
+	case errors.Is(err, ledger.ErrAccountExists):
+		return http.StatusConflict, "account_exists"
+	case errors.Is(err, ledger.ErrVersionConflict), errors.Is(err, ledger.ErrAccountConflict):
+		return http.StatusConflict, "version_conflict"
+	case errors.Is(err, ledger.ErrImmutableField):
+		return http.StatusBadRequest, "immutable_field"
+	case errors.Is(err, ledger.ErrAccountDormant):
+		return http.StatusUnprocessableEntity, "account_dormant"
+	case errors.Is(err, ledger.ErrKYCLimitExceeded):
+		return http.StatusUnprocessableEntity, "kyc_limit_exceeded"
+	case errors.Is(err, ledger.ErrFloatLimitExceeded):
+		return http.StatusUnprocessableEntity, "float_limit_exceeded"
+	case errors.Is(err, ledger.ErrCurrencyMismatch):
+		return http.StatusUnprocessableEntity, "currency_mismatch"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	case validation.Fields(err) != nil:
+		return http.StatusBadRequest, "invalid_request"
+	}
+	// The remaining errors are untyped.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "does not exist"), strings.Contains(msg, "not found"):
+		return http.StatusNotFound, "not_found"
+	case strings.Contains(msg, "already exists"):
+		return http.StatusConflict, "already_exists"
+	case strings.Contains(msg, "insufficient balance"):
+		return http.StatusUnprocessableEntity, "insufficient_balance"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	var retryAfter int64
+	var maintenance *ledger.MaintenanceError
+	if errors.As(err, &maintenance) {
+		retryAfter = int64(math.Ceil(maintenance.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+	writeJSON(w, status, Response{Status: "error", Code: code, Message: http.StatusText(status), Details: err.Error(), RetryAfter: retryAfter})
+}
+
+func writeError(w http.ResponseWriter, status int, code, message, details string) {
+	writeJSON(w, status, Response{Status: "error", Code: code, Message: message, Details: details})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// allow answers 405 Method Not Allowed to requests of another method.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.", "")
+	return false
+}
+
+// decode reads a JSON request body into v, answering 400 Bad Request when it
+// cannot.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "The request body is not valid JSON.", err.Error())
+		return false
+	}
+	return true
+}
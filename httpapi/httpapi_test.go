@@ -0,0 +1,176 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgertest"
+)
+
+func newHandler() *Handler {
+	db := ledger.NewLedger(ledgertest.NewDB(), ledger.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	return &Handler{
+		DB: db,
+		Authenticate: func(r *http.Request) (string, string, error) {
+			if tenant := r.Header.Get("X-Tenant"); tenant != "" {
+				return tenant, "api-test", nil
+			}
+			return "", "", errors.New("no tenant")
+		},
+	}
+}
+
+// fund creates an account of tenant acme with a balance, which the API does
+// not take.
+func fund(t *testing.T, h *Handler, accountId string, amount float64) {
+	t.Helper()
+	if err := ledger.CreateAccount(context.Background(), h.DB, "acme", ledger.User{AccountID: accountId, Amount: amount}); err != nil {
+		t.Fatalf("CreateAccount(%s) error = %v", accountId, err)
+	}
+}
+
+// do serves a request as tenant acme and decodes the response body into v.
+func do(t *testing.T, h http.Handler, method, path, body string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-Tenant", "acme")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, rec.Body)
+		}
+	}
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	h := newHandler()
+	var res Response
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/alice/balance", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request status = %d, want 401", rec.Code)
+	}
+	fund(t, h, "alice", 100)
+	if rec := do(t, h, http.MethodPost, "/accounts", `{"account_id":"bob"}`, &res); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /accounts = %d %+v", rec.Code, res)
+	}
+	if rec := do(t, h, http.MethodPost, "/accounts", `{"account_id":`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /accounts with bad JSON = %d, want 400", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/accounts", `{"account_id":"carol","opening_balance":100}`, &res); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /accounts with an opening balance = %d %+v, want 400", rec.Code, res)
+	}
+
+	var transfer ledger.NilResponse
+	rec = do(t, h, http.MethodPost, "/transfers", `{"from_account":"alice","to_account":"bob","amount":30,"narrative":"rent"}`, &transfer)
+	if rec.Code != http.StatusOK || transfer.Status != "success" || transfer.Data.TransactionID == "" {
+		t.Fatalf("POST /transfers = %d %+v", rec.Code, transfer)
+	}
+	txID := transfer.Data.TransactionID
+	if rec := do(t, h, http.MethodPost, "/transfers", `{"from_account":"alice","to_account":"bob","amount":500}`, &transfer); rec.Code != http.StatusUnprocessableEntity || transfer.Code != "insufficient_balance" {
+		t.Errorf("overdrawing POST /transfers = %d %+v", rec.Code, transfer)
+	}
+	if rec := do(t, h, http.MethodGet, "/transfers", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /transfers = %d, want 405", rec.Code)
+	}
+
+	// Creating an account again leaves it as it is.
+	if rec := do(t, h, http.MethodPost, "/accounts", `{"account_id":"alice"}`, &res); rec.Code != http.StatusConflict || res.Code != "account_exists" {
+		t.Errorf("POST /accounts of an existing account = %d %+v, want 409", rec.Code, res)
+	}
+	var balance struct{ Data Balance }
+	if rec := do(t, h, http.MethodGet, "/accounts/alice/balance", "", &balance); rec.Code != http.StatusOK || balance.Data.Balance != 70 {
+		t.Errorf("GET balance = %d %+v", rec.Code, balance)
+	}
+	if rec := do(t, h, http.MethodGet, "/accounts/carol/balance", "", &res); rec.Code != http.StatusNotFound || res.Status != "error" {
+		t.Errorf("GET balance of a missing account = %d %+v", rec.Code, res)
+	}
+
+	var tx struct{ Data ledger.TransactionEntry }
+	if rec := do(t, h, http.MethodGet, "/transactions/"+txID+"?account_id=bob", "", &tx); rec.Code != http.StatusOK || tx.Data.Narrative != "rent" {
+		t.Errorf("GET transaction = %d %+v", rec.Code, tx)
+	}
+	if rec := do(t, h, http.MethodGet, "/transactions/"+txID+"?account_id=carol", "", &res); rec.Code != http.StatusNotFound {
+		t.Errorf("GET transaction of another account = %d %+v", rec.Code, res)
+	}
+
+	var page struct{ Data TransactionPage }
+	if rec := do(t, h, http.MethodGet, "/accounts/bob/transactions?direction=received&limit=10", "", &page); rec.Code != http.StatusOK || len(page.Data.Transactions) != 2 {
+		t.Errorf("GET transactions = %d %+v", rec.Code, page)
+	}
+	if rec := do(t, h, http.MethodGet, "/accounts/bob/transactions?page_token=!", "", &res); rec.Code != http.StatusBadRequest || res.Code != "invalid_page_token" {
+		t.Errorf("GET transactions with a bad token = %d %+v", rec.Code, res)
+	}
+}
+
+func TestHandlerUpdateAccount(t *testing.T) {
+	h := newHandler()
+	var res Response
+	if rec := do(t, h, http.MethodPost, "/accounts", `{"account_id":"alice","full_name":"Alice"}`, &res); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /accounts = %d %+v", rec.Code, res)
+	}
+	user, err := ledger.GetAccount(context.Background(), h.DB, ledger.TransactionEntry{TenantID: "acme", AccountID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var profile struct{ Data AccountProfile }
+	body := `{"city":"Khartoum","dependants":2,"version":` + strconv.FormatInt(user.Version, 10) + `}`
+	if rec := do(t, h, http.MethodPatch, "/accounts/alice", body, &profile); rec.Code != http.StatusOK || profile.Data.City != "Khartoum" || profile.Data.FullName != "Alice" || profile.Data.Version <= user.Version {
+		t.Fatalf("PATCH /accounts/alice = %d %+v", rec.Code, profile)
+	}
+	if rec := do(t, h, http.MethodPatch, "/accounts/alice", body, &res); rec.Code != http.StatusConflict || res.Code != "version_conflict" {
+		t.Errorf("PATCH with a stale version = %d %+v", rec.Code, res)
+	}
+	if rec := do(t, h, http.MethodPatch, "/accounts/alice", `{"amount":1000,"version":1}`, &res); rec.Code != http.StatusBadRequest || res.Code != "immutable_field" {
+		t.Errorf("PATCH of the balance = %d %+v", rec.Code, res)
+	}
+	if rec := do(t, h, http.MethodPatch, "/accounts/carol", `{"city":"Bahri","version":1}`, &res); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH of a missing account = %d %+v", rec.Code, res)
+	}
+}
+
+func TestHandlerMaintenance(t *testing.T) {
+	h := newHandler()
+	fund(t, h, "alice", 100)
+	fund(t, h, "bob", 0)
+	if err := ledger.StartMaintenance(ledger.WithActor(context.Background(), "ops"), h.DB, "acme", "migration", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var transfer ledger.NilResponse
+	rec := do(t, h, http.MethodPost, "/transfers", `{"from_account":"alice","to_account":"bob","amount":1}`, &transfer)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" || transfer.Code != "tenant_maintenance" {
+		t.Errorf("POST /transfers under maintenance = %d %v %+v", rec.Code, rec.Header(), transfer)
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	h := newHandler()
+	var order []string
+	for _, name := range []string{"outer", "inner"} {
+		name := name
+		h.Middleware = append(h.Middleware, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	do(t, h, http.MethodGet, "/accounts/alice/balance", "", nil)
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("middleware ran in order %v", order)
+	}
+}
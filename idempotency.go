@@ -0,0 +1,107 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// IdempotencyKeysTable holds the InitiatorUUID of every transfer the ledger
+// took, keyed by TenantID and IdempotencyKey, with the response the transfer
+// was answered with and a TTL on ExpiresAt.
+var IdempotencyKeysTable = "IdempotencyKeys"
+
+// IdempotencyKeyTTL is how long a transfer's response is kept for its
+// retries.
+var IdempotencyKeyTTL = 7 * 24 * time.Hour
+
+// ErrIdempotencyKeyReused is returned for a transfer made with the
+// InitiatorUUID of an earlier, different transfer.
+var ErrIdempotencyKeyReused = errors.New("idempotency_key_reused")
+
+// idempotencyKey is the transfer an InitiatorUUID was taken by.
+type idempotencyKey struct {
+	TenantID    string      `dynamodbav:"TenantID"`
+	Key         string      `dynamodbav:"IdempotencyKey"`
+	FromAccount string      `dynamodbav:"FromAccount"`
+	ToAccount   string      `dynamodbav:"ToAccount"`
+	Amount      float64     `dynamodbav:"Amount"`
+	Response    NilResponse `dynamodbav:"Response"`
+	ExpiresAt   int64       `dynamodbav:"ExpiresAt"`
+}
+
+// takeKey returns the put recording response as that of the transfer
+// taking req's InitiatorUUID. It fails its condition when another transfer
+// took the key first.
+func takeKey(req TransferRequest, response NilResponse, now time.Time) (types.TransactWriteItem, error) {
+	item, err := attributevalue.MarshalMap(idempotencyKey{
+		TenantID:    req.TenantID,
+		Key:         req.InitiatorUUID,
+		FromAccount: req.FromAccount,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Response:    response,
+		ExpiresAt:   now.Add(IdempotencyKeyTTL).Unix(),
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal idempotency key: %v", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(IdempotencyKeysTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(IdempotencyKey)"),
+	}}, nil
+}
+
+// rememberResponse records response as that of req's InitiatorUUID, for a
+// transfer taken without posting a journal, such as one waiting for
+// approval. A failure is logged: the transfer was taken all the same.
+func rememberResponse(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest, response NilResponse, now time.Time) {
+	put, err := takeKey(req, response, now)
+	if err == nil {
+		_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           put.Put.TableName,
+			Item:                put.Put.Item,
+			ConditionExpression: put.Put.ConditionExpression,
+		})
+	}
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "failed to record idempotency key", "tenant", req.TenantID, "key", req.InitiatorUUID, "error", err)
+	}
+}
+
+// keyResponse returns the response of the transfer that took req's
+// InitiatorUUID, and whether one did. A different transfer having taken it
+// fails with ErrIdempotencyKeyReused.
+func keyResponse(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) (NilResponse, bool, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(IdempotencyKeysTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":       &types.AttributeValueMemberS{Value: req.TenantID},
+			"IdempotencyKey": &types.AttributeValueMemberS{Value: req.InitiatorUUID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return NilResponse{}, false, fmt.Errorf("failed to get idempotency key: %v", err)
+	}
+	if result.Item == nil {
+		return NilResponse{}, false, nil
+	}
+	var key idempotencyKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return NilResponse{}, false, fmt.Errorf("failed to unmarshal idempotency key: %v", err)
+	}
+	if key.FromAccount != req.FromAccount || key.ToAccount != req.ToAccount || key.Amount != req.Amount {
+		err := fmt.Errorf("%w: %s was used for a transfer of %s from %s to %s", ErrIdempotencyKeyReused,
+			req.InitiatorUUID, formatAmount(key.Amount), key.FromAccount, key.ToAccount)
+		return failedResponse(req, ErrIdempotencyKeyReused.Error(), "The idempotency key was used for another transfer.", err.Error()), true, err
+	}
+	return key.Response, true, nil
+}
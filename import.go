@@ -0,0 +1,368 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ImportFormat is the file format of a ledger import.
+type ImportFormat string
+
+const (
+	// ImportCSV is a CSV file with a header row naming the columns
+	// external_ref, account_id, type, amount and time, and optionally
+	// currency, in any order.
+	ImportCSV ImportFormat = "csv"
+	// ImportJSON is a JSON array of ImportRow.
+	ImportJSON ImportFormat = "json"
+)
+
+// ImportRow is one entry of a ledger import. The rows sharing an ExternalRef
+// are the entries of one transaction of the system the ledger is imported
+// from, and must balance: their debits must add up to their credits.
+type ImportRow struct {
+	ExternalRef string `json:"external_ref"`
+	AccountID   string `json:"account_id"`
+	// Type is LegDebit or LegCredit.
+	Type   string  `json:"type"`
+	Amount float64 `json:"amount"`
+	// Time is RFC 3339, a date, or Unix seconds.
+	Time string `json:"time"`
+	// Currency, when set, must be that of the account.
+	Currency string `json:"currency,omitempty"`
+}
+
+// ImportError is a row of an import that was not imported, numbered from 1.
+// An error of a whole transaction is reported on its first row.
+type ImportError struct {
+	Row         int    `json:"row"`
+	ExternalRef string `json:"external_ref,omitempty"`
+	Message     string `json:"message"`
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Message)
+}
+
+// ImportReport is the outcome of ImportLedgerEntries.
+type ImportReport struct {
+	Rows int `json:"rows"`
+	// Imported and Duplicates count transactions: those written, and those
+	// skipped because an earlier import wrote them.
+	Imported   int           `json:"imported"`
+	Duplicates int           `json:"duplicates"`
+	Entries    int           `json:"entries"`
+	Errors     []ImportError `json:"errors,omitempty"`
+}
+
+// importedTx is a transaction of an import, with the rows it was read from.
+type importedTx struct {
+	ref     string
+	rows    []int
+	entries []LedgerEntry
+	err     string
+}
+
+// ImportLedgerEntries imports the ledger entries of a legacy system, such as
+// a core-banking export, into LedgerTable. Rows are grouped into
+// transactions by their external reference; a transaction that does not
+// balance, or has a row that is invalid or names an unknown account, is
+// reported and not imported. Transactions get IDs derived from their
+// reference, so importing a file again skips what is already imported and
+// completes what was not. Entries are written with BatchWriteItem.
+//
+// Imported entries record history only: balances are not changed, and the
+// entries are not part of the accounts' hash chains. Migrate balances with
+// the accounts, e.g. with CreateAccountsBatch.
+func ImportLedgerEntries(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, r io.Reader, format ImportFormat) (*ImportReport, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if err := validation.TenantID("tenant_id", tenantId); err != nil {
+		return nil, err
+	}
+	var rows []ImportRow
+	var err error
+	switch format {
+	case ImportCSV:
+		rows, err = readImportCSV(r)
+	case ImportJSON:
+		err = json.NewDecoder(r).Decode(&rows)
+	default:
+		return nil, fmt.Errorf("unsupported import format: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import: %v", err)
+	}
+
+	report := &ImportReport{Rows: len(rows)}
+	var txs []*importedTx
+	byRef := map[string]*importedTx{}
+	accounts := map[string]*User{}
+	for i, row := range rows {
+		n := i + 1
+		ref := strings.TrimSpace(row.ExternalRef)
+		if ref == "" {
+			report.Errors = append(report.Errors, ImportError{Row: n, Message: "external_ref is required"})
+			continue
+		}
+		tx := byRef[ref]
+		if tx == nil {
+			tx = &importedTx{ref: ref}
+			byRef[ref] = tx
+			txs = append(txs, tx)
+		}
+		tx.rows = append(tx.rows, n)
+		if tx.err != "" {
+			continue
+		}
+		entry, err := importEntry(ctx, dbSvc, tenantId, row, accounts)
+		if err != nil {
+			tx.err = fmt.Sprintf("row %d: %v", n, err)
+			continue
+		}
+		tx.entries = append(tx.entries, entry)
+	}
+
+	var pending []*importedTx
+	for _, tx := range txs {
+		if tx.err == "" {
+			tx.err = tx.finish(tenantId)
+		}
+		if tx.err != "" {
+			report.Errors = append(report.Errors, ImportError{Row: tx.rows[0], ExternalRef: tx.ref, Message: tx.err})
+			continue
+		}
+		imported, err := importedBefore(ctx, dbSvc, tx.entries)
+		switch {
+		case err != nil:
+			return report, err
+		case imported:
+			report.Duplicates++
+		default:
+			pending = append(pending, tx)
+		}
+	}
+
+	// Transactions are kept within one batch where they fit, so that a
+	// batch that fails leaves few of them partly written.
+	for len(pending) > 0 {
+		var batch []*importedTx
+		var requests []types.WriteRequest
+		for len(pending) > 0 && (len(requests) == 0 || len(requests)+len(pending[0].entries) <= maxBatchWriteItems) {
+			tx := pending[0]
+			pending = pending[1:]
+			batch = append(batch, tx)
+			for _, entry := range tx.entries {
+				av, err := attributevalue.MarshalMap(entry)
+				if err != nil {
+					return report, fmt.Errorf("failed to marshal ledger entry: %v", err)
+				}
+				requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: av}})
+			}
+		}
+		var unprocessed []types.WriteRequest
+		var err error
+		for start := 0; start < len(requests); start += maxBatchWriteItems {
+			left, chunkErr := batchWrite(ctx, dbSvc, LedgerTable, requests[start:min(start+maxBatchWriteItems, len(requests))])
+			unprocessed = append(unprocessed, left...)
+			if chunkErr != nil {
+				err = chunkErr
+			}
+		}
+		failed := map[string]bool{}
+		for _, req := range unprocessed {
+			if journal, ok := req.PutRequest.Item["JournalID"].(*types.AttributeValueMemberS); ok {
+				failed[journal.Value] = true
+			}
+		}
+		for _, tx := range batch {
+			if failed[tx.entries[0].JournalID] {
+				report.Errors = append(report.Errors, ImportError{Row: tx.rows[0], ExternalRef: tx.ref, Message: fmt.Sprint(err)})
+				continue
+			}
+			report.Imported++
+			report.Entries += len(tx.entries)
+		}
+	}
+	if len(report.Errors) > 0 {
+		return report, fmt.Errorf("import has %d errors", len(report.Errors))
+	}
+	return report, nil
+}
+
+// readImportCSV reads the rows of a CSV import, finding the columns by the
+// names in its header.
+func readImportCSV(r io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"external_ref", "account_id", "type", "amount", "time"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+	cell := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := ImportRow{
+			ExternalRef: cell(record, "external_ref"),
+			AccountID:   cell(record, "account_id"),
+			Type:        cell(record, "type"),
+			Time:        cell(record, "time"),
+			Currency:    cell(record, "currency"),
+		}
+		// An amount that does not parse is left NaN, for importEntry to
+		// report on its row.
+		row.Amount, err = strconv.ParseFloat(cell(record, "amount"), 64)
+		if err != nil {
+			row.Amount = math.NaN()
+		}
+		rows = append(rows, row)
+	}
+}
+
+// importEntry validates a row of an import and returns its ledger entry,
+// without its IDs. accounts caches the accounts read.
+func importEntry(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, row ImportRow, accounts map[string]*User) (LedgerEntry, error) {
+	entryType := strings.ToLower(strings.TrimSpace(row.Type))
+	if entryType != LegDebit && entryType != LegCredit {
+		return LedgerEntry{}, fmt.Errorf("type must be %s or %s", LegDebit, LegCredit)
+	}
+	if err := validation.Collect(
+		validation.AccountID("account_id", row.AccountID),
+		validation.AmountPrecision("amount", row.Amount, maxPrecision()),
+	); err != nil {
+		return LedgerEntry{}, err
+	}
+	at, err := parseImportTime(row.Time)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	account, ok := accounts[row.AccountID]
+	if !ok {
+		account, err = readAccount(ctx, dbSvc, tenantId, row.AccountID)
+		if err != nil {
+			return LedgerEntry{}, fmt.Errorf("failed to read account %s: %v", row.AccountID, err)
+		}
+		accounts[row.AccountID] = account
+	}
+	currency := currencyOf(account)
+	if row.Currency != "" && !strings.EqualFold(row.Currency, currency) {
+		return LedgerEntry{}, fmt.Errorf("currency %s is not that of account %s", row.Currency, row.AccountID)
+	}
+	if err := checkPrecision(row.Amount, currency); err != nil {
+		return LedgerEntry{}, err
+	}
+	return LedgerEntry{
+		TenantID:  tenantId,
+		AccountID: row.AccountID,
+		Amount:    row.Amount,
+		Type:      entryType,
+		Time:      at.Unix(),
+		Currency:  account.Currency,
+	}, nil
+}
+
+// finish checks that a transaction balances, and gives its entries their
+// IDs, derived from its external reference. It returns why the transaction
+// cannot be imported, if it cannot.
+func (tx *importedTx) finish(tenantId string) string {
+	var debits, credits float64
+	for _, entry := range tx.entries {
+		if entry.Type == LegDebit {
+			debits += entry.Amount
+		} else {
+			credits += entry.Amount
+		}
+	}
+	if debits == 0 || roundAmount(debits) != roundAmount(credits) {
+		return fmt.Sprintf("debits of %s do not balance credits of %s", formatAmount(debits), formatAmount(credits))
+	}
+	sum := sha256.Sum256([]byte(tenantId + "\x00" + tx.ref))
+	journalId := "import-" + hex.EncodeToString(sum[:16])
+	seen := map[string]int{}
+	for i := range tx.entries {
+		entry := &tx.entries[i]
+		entry.JournalID = journalId
+		entry.ExternalRef = tx.ref
+		entry.SystemTransactionID = journalId + "#" + entry.Type
+		if seen[entry.Type]++; seen[entry.Type] > 1 {
+			entry.SystemTransactionID += "#" + strconv.Itoa(seen[entry.Type])
+		}
+	}
+	return ""
+}
+
+// importedBefore reports whether all the entries of a transaction are
+// already in LedgerTable.
+func importedBefore(ctx context.Context, dbSvc DynamoDBAPI, entries []LedgerEntry) (bool, error) {
+	for _, entry := range entries {
+		result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(LedgerTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID":      &types.AttributeValueMemberS{Value: entry.TenantID},
+				"TransactionID": &types.AttributeValueMemberS{Value: entry.SystemTransactionID},
+			},
+			ProjectionExpression: aws.String("TransactionID"),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to get ledger entry: %v", err)
+		}
+		if result.Item == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// parseImportTime parses the time of an import row: RFC 3339, a date, or
+// Unix seconds.
+func parseImportTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
@@ -0,0 +1,111 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// IndeterminateSettleTime is how long after a transfer's context was
+// cancelled its journal may still be committed by DynamoDB.
+// ResolveIndeterminate waits this long before deciding a transfer failed.
+const IndeterminateSettleTime = time.Minute
+
+// indeterminateRecordTimeout bounds recording a transfer as indeterminate
+// once its own context is done.
+const indeterminateRecordTimeout = 5 * time.Second
+
+// ErrIndeterminate is returned for a transfer whose context was cancelled
+// while its journal was being posted, so whether it moved money is not
+// known. The transfer is recorded as TransactionIndeterminate until
+// ResolveIndeterminate settles it.
+var ErrIndeterminate = errors.New("transaction_indeterminate")
+
+// recordIndeterminate stores a transfer whose journal was interrupted as
+// indeterminate, on a context of its own since the transfer's is done. The
+// record is only put when the journal has not stored its own, so it reports
+// whether the journal turned out to be committed.
+func recordIndeterminate(ctx context.Context, dbSvc DynamoDBAPI, record TransactionRecord) (committed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), indeterminateRecordTimeout)
+	defer cancel()
+	record.Status = TransactionIndeterminate
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal transaction record: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(TransactionsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(TransactionID)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record indeterminate transaction %s: %v", record.TransactionID, err)
+	}
+	loggerOf(dbSvc).WarnContext(ctx, "transfer indeterminate", "tenant", record.TenantID, "txid", record.TransactionID, "account", record.FromAccount)
+	return false, nil
+}
+
+// indeterminateResponse is the response to a transfer interrupted while its
+// journal was posted. It carries the transaction ID to resolve.
+func indeterminateResponse(req TransferRequest, transactionId string, cause error) (NilResponse, error) {
+	response := failedResponse(req, "transaction_indeterminate", "The transaction was interrupted; its outcome will be confirmed shortly.", cause.Error())
+	response.Data.TransactionID = transactionId
+	return response, fmt.Errorf("%w: transaction %s: %v", ErrIndeterminate, transactionId, cause)
+}
+
+// ResolveIndeterminate settles a transfer left indeterminate: it is marked
+// completed when its journal was posted and failed otherwise. Journals are
+// posted atomically, so either the whole transfer moved money or none of it
+// did, and nothing needs to be reversed. Transactions that are not
+// indeterminate are returned as they are.
+//
+// A transfer is only resolved IndeterminateSettleTime after it was made,
+// since its journal may still be committed until then; earlier calls fail
+// with ErrIndeterminate.
+func ResolveIndeterminate(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) (*TransactionEntry, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	tx, err := getTransactionForUpdate(ctx, dbSvc, tenantId, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Status == nil || *tx.Status != TransactionIndeterminate {
+		return tx, nil
+	}
+	if settled := time.Unix(tx.TransactionDate, 0).Add(IndeterminateSettleTime); time.Now().Before(settled) {
+		return nil, fmt.Errorf("%w: transaction %s may still be posted, retry after %s", ErrIndeterminate, transactionId, settled.UTC().Format(time.RFC3339))
+	}
+
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(LedgerTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+			"TransactionID": &types.AttributeValueMemberS{Value: transactionId + "#" + LegCredit},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get journal of transaction %s: %v", transactionId, err)
+	}
+	to, reason := TransactionFailed, "journal was not posted"
+	if result.Item != nil {
+		to, reason = TransactionCompleted, "journal was posted"
+	}
+	resolved, err := TransitionStatus(ctx, dbSvc, tenantId, transactionId, to, ActorFrom(ctx), reason)
+	if err != nil {
+		return nil, err
+	}
+	loggerOf(dbSvc).InfoContext(ctx, "indeterminate transfer resolved", "tenant", tenantId, "txid", transactionId, "status", to)
+	return resolved, nil
+}
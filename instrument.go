@@ -0,0 +1,145 @@
+package ledger
+
+import (
+	"context"
+	"time"
+)
+
+// Attribute is a key/value pair attached to spans and measurements.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr returns an Attribute.
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans. It mirrors the part of OpenTelemetry's trace.Tracer
+// the ledger uses, so an OTel tracer is adapted by converting attributes to
+// attribute.KeyValue.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Metrics records the ledger's measurements. Counters map to OTel
+// Float64Counters and histograms to Float64Histograms, created on first use
+// of a name.
+type Metrics interface {
+	AddCounter(ctx context.Context, name string, value float64, attrs ...Attribute)
+	RecordHistogram(ctx context.Context, name string, value float64, attrs ...Attribute)
+}
+
+// Metric names recorded through Metrics. Durations are in seconds.
+const (
+	MetricTransferCount    = "ledger.transfer.count"
+	MetricTransferVolume   = "ledger.transfer.volume"
+	MetricTransferFailures = "ledger.transfer.failures"
+	MetricTransferDuration = "ledger.transfer.duration"
+	// MetricTransferRetries counts transfers posted again because the
+	// sender moved since it was read; see WithConflictRetry.
+	MetricTransferRetries  = "ledger.transfer.retries"
+	MetricDynamoDBDuration = "ledger.dynamodb.duration"
+	// MetricDynamoDBReadCapacity and MetricDynamoDBWriteCapacity count the
+	// capacity units consumed by DynamoDB calls; see WithCapacityMetrics.
+	MetricDynamoDBReadCapacity  = "ledger.dynamodb.read_capacity_units"
+	MetricDynamoDBWriteCapacity = "ledger.dynamodb.write_capacity_units"
+)
+
+// WithTracer traces every DynamoDB call and the main public API calls.
+func WithTracer(tracer Tracer) Option {
+	return func(l *Ledger) {
+		l.tracer = tracer
+	}
+}
+
+// WithMetrics records transfer and DynamoDB metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(l *Ledger) {
+		l.metrics = metrics
+	}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+type noopMetrics struct{}
+
+func (noopMetrics) AddCounter(ctx context.Context, name string, value float64, attrs ...Attribute) {
+}
+func (noopMetrics) RecordHistogram(ctx context.Context, name string, value float64, attrs ...Attribute) {
+}
+
+// tracerOf and metricsOf return the instrumentation of dbSvc when it is a
+// Ledger, and no-ops for plain clients.
+func tracerOf(dbSvc DynamoDBAPI) Tracer {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.tracer
+	}
+	return noopTracer{}
+}
+
+func metricsOf(dbSvc DynamoDBAPI) Metrics {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.metrics
+	}
+	return noopMetrics{}
+}
+
+// startSpan starts a span for a public API call.
+// Its DynamoDB calls are attributed to the call, and to the tenant of a
+// "tenant" attribute, unless WithOperation attributed them already.
+func startSpan(ctx context.Context, dbSvc DynamoDBAPI, name string, attrs ...Attribute) (context.Context, Span) {
+	if _, ok := operationFrom(ctx); !ok {
+		op := operation{name: name}
+		for _, attr := range attrs {
+			if tenant, ok := attr.Value.(string); ok && attr.Key == "tenant" {
+				op.tenant = tenant
+			}
+		}
+		ctx = context.WithValue(ctx, operationKey{}, op)
+	}
+	return tracerOf(dbSvc).Start(ctx, "ledger."+name, attrs...)
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// recordTransfer records the metrics of a transfer attempt.
+func recordTransfer(ctx context.Context, dbSvc DynamoDBAPI, tenantId, code string, amount float64, start time.Time, err error) {
+	metrics := metricsOf(dbSvc)
+	tenant := Attr("tenant", tenantId)
+	metrics.RecordHistogram(ctx, MetricTransferDuration, time.Since(start).Seconds(), tenant)
+	if err != nil {
+		metrics.AddCounter(ctx, MetricTransferFailures, 1, tenant, Attr("code", code))
+		return
+	}
+	metrics.AddCounter(ctx, MetricTransferCount, 1, tenant, Attr("code", code))
+	// Held transfers and those awaiting approval are counted, but their
+	// volume only once executed.
+	if code != "transfer_delayed" && code != "approval_required" {
+		metrics.AddCounter(ctx, MetricTransferVolume, amount, tenant)
+	}
+}
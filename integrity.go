@@ -0,0 +1,225 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Kinds of IntegrityProblem.
+const (
+	// IntegrityAltered is an entry whose contents no longer match its hash.
+	IntegrityAltered = "altered"
+	// IntegrityMissing is an entry the chain links to that is not stored,
+	// because it was deleted.
+	IntegrityMissing = "missing"
+	// IntegrityUnlinked is a hashed entry the chain does not link to: one
+	// inserted outside of a journal, or one cut off from the head by a
+	// missing entry.
+	IntegrityUnlinked = "unlinked"
+	// IntegrityUnhashed is an entry without a hash posted after the
+	// account's first hashed entry: one inserted outside of a journal.
+	IntegrityUnhashed = "unhashed"
+)
+
+// IntegrityProblem is a break in an account's hash chain.
+type IntegrityProblem struct {
+	Kind string `json:"kind"`
+	// TransactionID is the ledger entry with the problem; for a missing
+	// entry, the entry linking to it, or empty when the account's head does.
+	TransactionID string `json:"transaction_id,omitempty"`
+	Hash          string `json:"hash"`
+}
+
+// IntegrityReport is the result of VerifyLedgerIntegrity.
+type IntegrityReport struct {
+	TenantID  string `json:"tenant_id"`
+	AccountID string `json:"account_id"`
+	// Entries is the number of hashed entries checked.
+	Entries int `json:"entries"`
+	// Unchained is the number of entries without a hash posted before the
+	// account's first hashed entry, such as those posted before the chain
+	// was introduced or imported with ImportLedgerEntries. Unhashed entries
+	// posted after it are problems.
+	Unchained int                `json:"unchained"`
+	Problems  []IntegrityProblem `json:"problems,omitempty"`
+}
+
+// Valid reports whether the account's chain is intact.
+func (r *IntegrityReport) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+// hash returns the SHA-256 of the entry's contents and PrevHash, hex
+// encoded. Fields are encoded as a JSON array so their boundaries are
+// unambiguous. Amounts are fixed to the precision of their currency, as
+// they are stored, but to no fewer than two decimals, which entries were
+// hashed with before amounts had their currency's precision.
+func (e LedgerEntry) hash() string {
+	contents, _ := json.Marshal([]string{
+		e.TenantID,
+		e.AccountID,
+		e.SystemTransactionID,
+		e.JournalID,
+		e.Type,
+		strconv.FormatFloat(e.Amount, 'f', max(CurrencyPrecision(e.Currency), DefaultAmountPrecision), 64),
+		strconv.FormatInt(e.Time, 10),
+		e.InitiatorUUID,
+		strconv.FormatBool(e.Overdraft),
+		e.PrevHash,
+	})
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// balanceDelta is what the entry changed the balance of its account by.
+// Bonus entries move promotional money, not the balance.
+func (e LedgerEntry) balanceDelta() float64 {
+	switch {
+	case bonusLeg(e.Type):
+		return 0
+	case e.Type == LegDebit || e.Type == LegWithdrawal:
+		return -e.Amount
+	}
+	return e.Amount
+}
+
+// VerifyLedgerIntegrity walks the hash chain of an account's ledger
+// entries back from the head stored on the account, and reports entries
+// that were altered, deleted or inserted since they were posted. It reads
+// every ledger entry of the tenant, so it is meant for audits rather than
+// the request path.
+func VerifyLedgerIntegrity(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*IntegrityReport, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	account, err := getAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := accountLedgerEntries(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IntegrityReport{TenantID: tenantId, AccountID: accountId}
+	// The chain starts at the account's first hashed entry; only entries
+	// older than it may lack a hash.
+	chainStart := int64(math.MaxInt64)
+	for _, e := range entries {
+		if e.Hash != "" {
+			chainStart = min(chainStart, e.Time)
+		}
+	}
+	byHash := map[string]LedgerEntry{}
+	for _, e := range entries {
+		switch {
+		case e.Hash == "" && e.Time > chainStart:
+			report.Problems = append(report.Problems, IntegrityProblem{Kind: IntegrityUnhashed, TransactionID: e.SystemTransactionID})
+			continue
+		case e.Hash == "":
+			report.Unchained++
+			continue
+		}
+		report.Entries++
+		byHash[e.Hash] = e
+		if e.hash() != e.Hash {
+			report.Problems = append(report.Problems, IntegrityProblem{Kind: IntegrityAltered, TransactionID: e.SystemTransactionID, Hash: e.Hash})
+		}
+	}
+
+	linked := map[string]bool{}
+	from := ""
+	for hash := account.LastEntryHash; hash != "" && !linked[hash]; {
+		e, ok := byHash[hash]
+		if !ok {
+			report.Problems = append(report.Problems, IntegrityProblem{Kind: IntegrityMissing, TransactionID: from, Hash: hash})
+			break
+		}
+		linked[hash] = true
+		from, hash = e.SystemTransactionID, e.PrevHash
+	}
+	for _, e := range entries {
+		if e.Hash != "" && !linked[e.Hash] {
+			report.Problems = append(report.Problems, IntegrityProblem{Kind: IntegrityUnlinked, TransactionID: e.SystemTransactionID, Hash: e.Hash})
+		}
+	}
+	return report, nil
+}
+
+// GetLedgerEntries returns every ledger entry posted to an account.
+func GetLedgerEntries(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]LedgerEntry, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	return accountLedgerEntries(ctx, dbSvc, tenantId, accountId)
+}
+
+// accountLedgerEntries returns the ledger entries of an account. LedgerTable
+// has no index by account, so the tenant's entries are filtered.
+func accountLedgerEntries(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]LedgerEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(LedgerTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		FilterExpression:       aws.String("AccountID = :account"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant":  &types.AttributeValueMemberS{Value: tenantId},
+			":account": &types.AttributeValueMemberS{Value: accountId},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	var entries []LedgerEntry
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ledger entries: %v", err)
+		}
+		var page []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ledger entries: %v", err)
+		}
+		entries = append(entries, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// senderConflict reports whether a journal was cancelled because the sender
+// moved since it was read, such as by a concurrent transfer, so it can be
+// posted again on a fresh read of the sender.
+func senderConflict(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	reasons := canceled.CancellationReasons
+	return len(reasons) > 0 && aws.ToString(reasons[0].Code) == "ConditionalCheckFailed"
+}
+
+// chainConflict reports whether a journal was cancelled because an account
+// other than the sender moved since it was read, so it can be posted again
+// on fresh reads of those accounts.
+func chainConflict(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || senderLegFailed(err) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
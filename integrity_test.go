@@ -0,0 +1,60 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestLedgerEntryHash(t *testing.T) {
+	e := LedgerEntry{TenantID: "nil", AccountID: "alice", SystemTransactionID: "j#debit", JournalID: "j", Type: LegDebit, Amount: 10, Time: 1700000000, PrevHash: "prev"}
+	h := e.hash()
+	if len(h) != 64 || e.hash() != h {
+		t.Fatalf("hash() = %q", h)
+	}
+	for name, change := range map[string]func(*LedgerEntry){
+		"amount":    func(e *LedgerEntry) { e.Amount = 10.01 },
+		"account":   func(e *LedgerEntry) { e.AccountID = "bob" },
+		"time":      func(e *LedgerEntry) { e.Time++ },
+		"prev hash": func(e *LedgerEntry) { e.PrevHash = "other" },
+		"overdraft": func(e *LedgerEntry) { e.Overdraft = true },
+	} {
+		changed := e
+		change(&changed)
+		if changed.hash() == h {
+			t.Errorf("changing the %s keeps the hash", name)
+		}
+	}
+	// The stored hash is not part of what is hashed.
+	e.Hash = h
+	if e.hash() != h {
+		t.Error("hash() depends on Hash")
+	}
+}
+
+func TestChainConflict(t *testing.T) {
+	canceled := func(codes ...string) error {
+		var reasons []types.CancellationReason
+		for _, code := range codes {
+			reasons = append(reasons, types.CancellationReason{Code: aws.String(code)})
+		}
+		return &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"receiver moved", canceled("None", "ConditionalCheckFailed"), true},
+		{"sender moved", canceled("ConditionalCheckFailed", "None"), false},
+		{"conflict", canceled("None", "TransactionConflict"), false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := chainConflict(tt.err); got != tt.want {
+			t.Errorf("chainConflict(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
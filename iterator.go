@@ -0,0 +1,77 @@
+package ledger
+
+import (
+	"context"
+)
+
+// TransactionsIterator walks every transaction matching a filter, reading
+// the pages of GetAllNilTransactions as it goes, so callers can go over any
+// number of transactions without handling cursors:
+//
+//	it := ledger.NewTransactionsIterator(dbSvc, tenantId, filter)
+//	for it.Next(ctx) {
+//		tx := it.Transaction()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// filter.Limit is the page size. An iterator is not safe for concurrent use.
+type TransactionsIterator struct {
+	dbSvc    DynamoDBAPI
+	tenantId string
+	filter   TransactionFilter
+
+	page    []TransactionEntry
+	current TransactionEntry
+	started bool
+	done    bool
+	err     error
+}
+
+// NewTransactionsIterator returns an iterator over the transactions of a
+// tenant matching filter, starting at filter.LastEvaluatedKey if set.
+func NewTransactionsIterator(dbSvc DynamoDBAPI, tenantId string, filter TransactionFilter) *TransactionsIterator {
+	if filter.Limit == 0 {
+		filter.Limit = 100
+	}
+	return &TransactionsIterator{dbSvc: dbSvc, tenantId: tenantId, filter: filter}
+}
+
+// Next advances to the next transaction, reading the next page when needed.
+// It returns false when there are no more transactions or a read failed;
+// Err tells which.
+func (it *TransactionsIterator) Next(ctx context.Context) bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		if it.started && len(it.filter.LastEvaluatedKey) == 0 {
+			it.done = true
+			return false
+		}
+		if err := ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		page, lastKey, err := GetAllNilTransactions(ctx, it.dbSvc, it.tenantId, it.filter)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.started = true
+		it.page, it.filter.LastEvaluatedKey = page, lastKey
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Transaction returns the transaction Next advanced to.
+func (it *TransactionsIterator) Transaction() TransactionEntry {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *TransactionsIterator) Err() error {
+	return it.err
+}
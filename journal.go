@@ -0,0 +1,359 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Leg types of a journal.
+const (
+	LegDebit  = "debit"
+	LegCredit = "credit"
+	LegFee    = "fee"
+	LegTax    = "tax"
+	// Deposit and withdrawal legs move money into and out of the ledger
+	// through the tenant's treasury; see DepositCredits.
+	LegDeposit    = "deposit"
+	LegWithdrawal = "withdrawal"
+	// Bonus legs move promotional money, held in an account's Bonuses
+	// rather than its balance; see GrantBonus.
+	LegBonusCredit = "bonus_credit"
+	LegBonusDebit  = "bonus_debit"
+	LegBonusExpiry = "bonus_expiry"
+	// LegCashback credits a sender with the cashback of a campaign; see
+	// CreateCampaign.
+	LegCashback = "cashback"
+	// LegReversal credits back an account debited by a transaction that
+	// could not complete.
+	LegReversal = "reversal"
+)
+
+// bonusLeg reports whether a leg type moves promotional money.
+func bonusLeg(legType string) bool {
+	return legType == LegBonusCredit || legType == LegBonusDebit || legType == LegBonusExpiry
+}
+
+// JournalLeg is one balance movement of a journal. All the legs of a journal
+// are posted in a single DynamoDB transaction and share its JournalID; the
+// debit leg always equals the sum of the other legs.
+type JournalLeg struct {
+	AccountID string  `dynamodbav:"AccountID" json:"account_id"`
+	Type      string  `dynamodbav:"Type" json:"type"`
+	Amount    float64 `dynamodbav:"Amount" json:"amount"`
+	// Overdraft is set on a debit or withdrawal leg that takes the account
+	// below zero.
+	Overdraft bool `dynamodbav:"Overdraft,omitempty" json:"overdraft,omitempty"`
+	// Category and MCC are copied onto the leg's ledger entry; they are set
+	// on the debit and credit legs of a categorized transfer.
+	Category string `dynamodbav:"Category,omitempty" json:"category,omitempty"`
+	MCC      string `dynamodbav:"MCC,omitempty" json:"mcc,omitempty"`
+}
+
+// transferLegs splits a transfer in currency into its journal legs. The
+// debit and credit legs always come first, followed by the fee and tax legs
+// when they apply.
+func transferLegs(req TransferRequest, fee, tax float64, tenantCfg *TenantConfig, currency string) []JournalLeg {
+	debit, credit := req.Amount, req.Amount
+	if tenantCfg.FeeSchedule.payer() == FeePaidByReceiver {
+		credit -= fee + tax
+	} else {
+		debit += fee + tax
+	}
+
+	legs := []JournalLeg{
+		{AccountID: req.FromAccount, Type: LegDebit, Amount: RoundAmount(debit, currency)},
+		{AccountID: req.ToAccount, Type: LegCredit, Amount: RoundAmount(credit, currency)},
+	}
+	if fee > 0 {
+		legs = append(legs, JournalLeg{AccountID: tenantCfg.FeeSchedule.CollectionAccount, Type: LegFee, Amount: fee})
+	}
+	if tax > 0 {
+		legs = append(legs, JournalLeg{AccountID: tenantCfg.Tax.CollectionAccount, Type: LegTax, Amount: tax})
+	}
+	return legs
+}
+
+// journalItems returns the transaction items posting the legs of a journal:
+// one balance update per account, the sender's first, one ledger entry per
+// leg and one event per account. Legs hitting
+// the same account are netted since a DynamoDB transaction cannot touch an
+// item twice.
+//
+// Every balance update is guarded by the version and chain head of its
+// account as read, in accounts, so a journal never lands on an account that
+// changed since; a credited account that moved makes the journal fail and
+// be posted again by postJournal. Each ledger entry is linked to its
+// account's hash chain and every update moves its account's head, so two
+// journals cannot fork a chain.
+//
+// Bonus legs leave balances as they are. When a journal has any, the
+// sender's Bonuses are replaced with bonuses, which is safe since the
+// sender's update is guarded by its version; bonus legs are only ever
+// posted on the sender.
+func journalItems(tenantId, journalId, initiatorUUID, sender string, legs []JournalLeg, bonuses []BonusBucket, accounts map[string]*User, timestamp, version int64) ([]types.TransactWriteItem, error) {
+	var ids []string
+	deltas := map[string]float64{}
+	var hasBonus bool
+	for _, leg := range legs {
+		if !(leg.Amount > 0) {
+			return nil, fmt.Errorf("%w: %s leg of %s is %v", ErrInvalidAmount, leg.Type, leg.AccountID, leg.Amount)
+		}
+		if _, ok := deltas[leg.AccountID]; !ok {
+			ids = append(ids, leg.AccountID)
+			deltas[leg.AccountID] = 0
+		}
+		if bonusLeg(leg.Type) {
+			if leg.AccountID != sender {
+				return nil, fmt.Errorf("bonus leg of %s must be on the sender", leg.AccountID)
+			}
+			hasBonus = true
+			continue
+		}
+		if leg.Type == LegDebit || leg.Type == LegWithdrawal {
+			deltas[leg.AccountID] -= leg.Amount
+		} else {
+			deltas[leg.AccountID] += leg.Amount
+		}
+	}
+	if len(ids) == 0 || ids[0] != sender {
+		return nil, errors.New("journal must start with the sender's debit leg")
+	}
+
+	entries := make([]LedgerEntry, len(legs))
+	newHeads := map[string]string{}
+	// Entries are keyed by the journal and leg type; the repeated legs of a
+	// type, such as the credits of a split transfer, are numbered from 2.
+	seen := map[string]int{}
+	for i, leg := range legs {
+		entry := leg.ledgerEntry(tenantId, journalId, initiatorUUID, timestamp)
+		if account := accounts[leg.AccountID]; account != nil {
+			entry.Currency = account.Currency
+		}
+		if seen[leg.Type]++; seen[leg.Type] > 1 {
+			entry.SystemTransactionID += "#" + strconv.Itoa(seen[leg.Type])
+		}
+		prev, ok := newHeads[leg.AccountID]
+		if !ok {
+			prev = lastEntryHash(accounts[leg.AccountID])
+		}
+		entry.PrevHash = prev
+		entry.Hash = entry.hash()
+		newHeads[leg.AccountID] = entry.Hash
+		entries[i] = entry
+	}
+
+	newVersion := &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+	var items []types.TransactWriteItem
+	for _, account := range ids {
+		update := &types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+				"AccountID": &types.AttributeValueMemberS{Value: account},
+			},
+			UpdateExpression: aws.String("SET amount = amount + :amount, Version = :newVersion, LastEntryHash = :head, LastActivity = :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":amount":     &types.AttributeValueMemberN{Value: FormatAmount(deltas[account], currencyOf(accounts[account]))},
+				":newVersion": newVersion,
+				":head":       &types.AttributeValueMemberS{Value: newHeads[account]},
+				":now":        &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+			},
+		}
+		var version int64
+		if read := accounts[account]; read != nil {
+			version = read.Version
+		}
+		condition := "(attribute_not_exists(Version) OR Version = :oldVersion)"
+		update.ExpressionAttributeValues[":oldVersion"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+		if account == sender {
+			switch {
+			case hasBonus && len(bonuses) == 0:
+				update.UpdateExpression = aws.String(aws.ToString(update.UpdateExpression) + " REMOVE Bonuses")
+			case hasBonus:
+				av, err := attributevalue.Marshal(bonuses)
+				if err != nil {
+					return nil, fmt.Errorf("failed to marshal bonuses: %v", err)
+				}
+				update.UpdateExpression = aws.String(aws.ToString(update.UpdateExpression) + ", Bonuses = :bonuses")
+				update.ExpressionAttributeValues[":bonuses"] = av
+			}
+		} else {
+			condition = "attribute_exists(AccountID) AND TenantID = :tenantID AND " + condition
+			update.ExpressionAttributeValues[":tenantID"] = &types.AttributeValueMemberS{Value: tenantId}
+		}
+		if prev := lastEntryHash(accounts[account]); prev != "" {
+			condition += " AND LastEntryHash = :prevHead"
+			update.ExpressionAttributeValues[":prevHead"] = &types.AttributeValueMemberS{Value: prev}
+		} else {
+			condition += " AND attribute_not_exists(LastEntryHash)"
+		}
+		update.ConditionExpression = aws.String(condition)
+		items = append(items, types.TransactWriteItem{Update: update})
+	}
+
+	for _, entry := range entries {
+		av, err := attributevalue.MarshalMap(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(LedgerTable),
+			Item:      av,
+		}})
+	}
+
+	for _, account := range ids {
+		av, err := attributevalue.MarshalMap(newAccountEvent(tenantId, account, EventBalanceChanged, journalId, RoundAmount(deltas[account], currencyOf(accounts[account])), timestamp))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal account event: %v", err)
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(AccountEventsTable),
+			Item:      av,
+		}})
+	}
+	return items, nil
+}
+
+// postJournal posts a journal with the extra items, such as its
+// transaction record, in one transaction. A journal racing another write to
+// an account it credits, such as a busy merchant or fee account, finds that
+// account's version or chain head moved; the account is read again and the
+// journal posted again after a jittered delay, as the conflict retry policy
+// of dbSvc allows. accounts holds the accounts already read, at least the
+// sender.
+func postJournal(ctx context.Context, dbSvc DynamoDBAPI, tenantId, journalId, initiatorUUID string, sender *User, legs []JournalLeg, bonuses []BonusBucket, accounts map[string]*User, timestamp int64, extra ...types.TransactWriteItem) error {
+	retry := conflictRetryOf(dbSvc)
+	for attempt := 1; ; attempt++ {
+		readJournalAccounts(ctx, dbSvc, tenantId, legs, accounts)
+		items, err := journalItems(tenantId, journalId, initiatorUUID, sender.AccountID, legs, bonuses, accounts, timestamp, nextVersion(dbSvc))
+		if err != nil {
+			return err
+		}
+		composer := NewTxComposer()
+		composer.Add(TxGroup{Name: "journal " + journalId, Items: append(items, extra...)})
+		err = composer.Execute(ctx, dbSvc)
+		if err == nil {
+			invalidateReplica(ctx, dbSvc, tenantId, legs)
+			return nil
+		}
+		if attempt >= retry.MaxAttempts || !chainConflict(err) || extraFailed(err, len(items)) {
+			return err
+		}
+		delay := retry.Delay(attempt - 1)
+		loggerOf(dbSvc).DebugContext(ctx, "retrying journal after a credited account moved", "tenant", tenantId, "journal", journalId, "attempt", attempt+1, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		accounts = map[string]*User{sender.AccountID: sender}
+	}
+}
+
+// postLeg posts a journal of a single leg, such as one side of a transfer
+// across tenants or a refund, with the extra items. The account is read
+// afresh for every attempt, and the journal posted again when it moves
+// before the journal lands, as the conflict retry policy of dbSvc allows.
+// An account that does not exist fails the journal.
+func postLeg(ctx context.Context, dbSvc DynamoDBAPI, tenantId, journalId, initiatorUUID string, leg JournalLeg, extra ...types.TransactWriteItem) error {
+	timestamp := clockOf(dbSvc).Now().Unix()
+	retry := conflictRetryOf(dbSvc)
+	for attempt := 1; ; attempt++ {
+		account, err := fetchAccount(ctx, dbSvc, tenantId, leg.AccountID, true)
+		if err != nil {
+			return fmt.Errorf("failed to get account %s: %v", leg.AccountID, err)
+		}
+		err = postJournal(ctx, dbSvc, tenantId, journalId, initiatorUUID, account, []JournalLeg{leg}, nil, map[string]*User{leg.AccountID: account}, timestamp, extra...)
+		if err == nil || attempt >= retry.MaxAttempts || !senderConflict(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retry.Delay(attempt - 1)):
+		}
+	}
+}
+
+// settleHeld pays amount held in a holding account, such as that of a
+// payout, claim, dispute or escrow, to an account in one journal. items
+// returns the items posted with it for its ID and legs, such as its
+// transaction record and the move of the holder to its final status. The
+// account paid is the journal's sender. The holding account is guarded by its
+// version and chain head like any other, and postJournal posts the journal
+// again when a concurrent settlement moved it. It returns the journal's ID.
+func settleHeld(ctx context.Context, dbSvc DynamoDBAPI, tenantId, holding, to string, amount float64, timestamp int64, items func(journalId string, legs []JournalLeg) ([]types.TransactWriteItem, error)) (string, error) {
+	account, err := readAccount(ctx, dbSvc, tenantId, to)
+	if err != nil {
+		return "", fmt.Errorf("failed to read account %s: %v", to, err)
+	}
+	legs := []JournalLeg{
+		{AccountID: to, Type: LegCredit, Amount: amount},
+		{AccountID: holding, Type: LegDebit, Amount: amount},
+	}
+	journalId := newID(dbSvc)
+	extra, err := items(journalId, legs)
+	if err != nil {
+		return "", err
+	}
+	accounts := map[string]*User{to: account}
+	return journalId, postJournal(ctx, dbSvc, tenantId, journalId, "", account, legs, nil, accounts, timestamp, extra...)
+}
+
+// readJournalAccounts reads the journal's accounts missing from accounts,
+// such as fee and tax collection accounts. The reads are strongly
+// consistent, since the journal is conditioned on the versions and chain
+// heads read. An account that cannot be read is left nil for the journal's
+// conditions to reject.
+func readJournalAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, legs []JournalLeg, accounts map[string]*User) {
+	for _, leg := range legs {
+		if _, ok := accounts[leg.AccountID]; ok {
+			continue
+		}
+		accounts[leg.AccountID], _ = fetchAccount(ctx, dbSvc, tenantId, leg.AccountID, true)
+	}
+}
+
+// lastEntryHash is the chain head of an account read, or "" for one that
+// could not be read.
+func lastEntryHash(account *User) string {
+	if account == nil {
+		return ""
+	}
+	return account.LastEntryHash
+}
+
+// senderLegFailed reports whether a journal was cancelled because of the
+// sender's balance update, which is always its first item.
+func senderLegFailed(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return true
+	}
+	reasons := canceled.CancellationReasons
+	return len(reasons) > 0 && aws.ToString(reasons[0].Code) != "None"
+}
+
+// extraFailed reports whether a journal of n items was cancelled by the
+// condition of one of its extra items, such as an idempotency key another
+// transfer took, which posting the journal again cannot pass.
+func extraFailed(err error, n int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for i, reason := range canceled.CancellationReasons {
+		if i >= n && aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
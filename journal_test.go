@@ -0,0 +1,167 @@
+package ledger
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestTransferLegs(t *testing.T) {
+	req := TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 100}
+	tests := []struct {
+		name string
+		cfg  *TenantConfig
+		fee  float64
+		tax  float64
+		want []JournalLeg
+	}{
+		{
+			name: "no fee",
+			cfg:  &TenantConfig{},
+			want: []JournalLeg{
+				{AccountID: "alice", Type: LegDebit, Amount: 100},
+				{AccountID: "bob", Type: LegCredit, Amount: 100},
+			},
+		},
+		{
+			name: "sender pays fee and tax",
+			cfg: &TenantConfig{
+				FeeSchedule: &FeeSchedule{CollectionAccount: "fees"},
+				Tax:         &TaxSchedule{CollectionAccount: "tax"},
+			},
+			fee: 2,
+			tax: 0.34,
+			want: []JournalLeg{
+				{AccountID: "alice", Type: LegDebit, Amount: 102.34},
+				{AccountID: "bob", Type: LegCredit, Amount: 100},
+				{AccountID: "fees", Type: LegFee, Amount: 2},
+				{AccountID: "tax", Type: LegTax, Amount: 0.34},
+			},
+		},
+		{
+			name: "receiver pays fee and tax",
+			cfg: &TenantConfig{
+				FeeSchedule: &FeeSchedule{PaidBy: FeePaidByReceiver, CollectionAccount: "fees"},
+				Tax:         &TaxSchedule{CollectionAccount: "tax"},
+			},
+			fee: 2,
+			tax: 0.34,
+			want: []JournalLeg{
+				{AccountID: "alice", Type: LegDebit, Amount: 100},
+				{AccountID: "bob", Type: LegCredit, Amount: 97.66},
+				{AccountID: "fees", Type: LegFee, Amount: 2},
+				{AccountID: "tax", Type: LegTax, Amount: 0.34},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transferLegs(req, tt.fee, tt.tax, tt.cfg, "SDG"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("transferLegs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalItems(t *testing.T) {
+	legs := []JournalLeg{
+		{AccountID: "alice", Type: LegDebit, Amount: 103},
+		{AccountID: "bob", Type: LegCredit, Amount: 100},
+		{AccountID: "fees", Type: LegFee, Amount: 2},
+		{AccountID: "fees", Type: LegTax, Amount: 1},
+	}
+	items, err := journalItems("nil", "journal", "uuid", "alice", legs, nil, map[string]*User{"alice": {Version: 7, LastEntryHash: "head"}, "bob": {Version: 3}}, 1700000000, 1700000000000000000)
+	if err != nil {
+		t.Fatalf("journalItems() error = %v", err)
+	}
+
+	// Fee and tax share an account, so they are netted into one update.
+	var updates []string
+	var amounts []string
+	var puts, events int
+	for _, item := range items {
+		if item.Update != nil {
+			updates = append(updates, item.Update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+			amounts = append(amounts, item.Update.ExpressionAttributeValues[":amount"].(*types.AttributeValueMemberN).Value)
+		}
+		if item.Put != nil && aws.ToString(item.Put.TableName) == AccountEventsTable {
+			events++
+		} else if item.Put != nil {
+			puts++
+			if got := item.Put.Item["JournalID"].(*types.AttributeValueMemberS).Value; got != "journal" {
+				t.Errorf("JournalID = %v, want journal", got)
+			}
+		}
+	}
+	if want := []string{"alice", "bob", "fees"}; !reflect.DeepEqual(updates, want) {
+		t.Errorf("updated accounts = %v, want %v", updates, want)
+	}
+	if want := []string{"-103.00", "100.00", "3.00"}; !reflect.DeepEqual(amounts, want) {
+		t.Errorf("update amounts = %v, want %v", amounts, want)
+	}
+	if puts != len(legs) {
+		t.Errorf("ledger entries = %d, want %d", puts, len(legs))
+	}
+	if events != len(updates) {
+		t.Errorf("account events = %d, want %d", events, len(updates))
+	}
+	// Every update is guarded by the version read, or by the absence of one
+	// for the fee account, which was not read.
+	for i, want := range []string{"7", "3", "0"} {
+		if got, ok := items[i].Update.ExpressionAttributeValues[":oldVersion"].(*types.AttributeValueMemberN); !ok || got.Value != want {
+			t.Errorf("update of %s is guarded by version %v, want %s", updates[i], got, want)
+		}
+	}
+
+	// Entries link to their account's previous entry, and each update moves
+	// the account's head from the one read.
+	var entries []LedgerEntry
+	for _, item := range items {
+		if item.Put != nil && aws.ToString(item.Put.TableName) == LedgerTable {
+			var e LedgerEntry
+			if err := attributevalue.UnmarshalMap(item.Put.Item, &e); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if entries[0].PrevHash != "head" || entries[1].PrevHash != "" || entries[3].PrevHash != entries[2].Hash {
+		t.Errorf("entries are not chained: %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Hash != e.hash() {
+			t.Errorf("entry %s has hash %s, want %s", e.SystemTransactionID, e.Hash, e.hash())
+		}
+	}
+	if got := items[2].Update.ExpressionAttributeValues[":head"].(*types.AttributeValueMemberS).Value; got != entries[3].Hash {
+		t.Errorf("fee account head = %s, want the tax entry's hash", got)
+	}
+	if got := aws.ToString(items[0].Update.ConditionExpression); !strings.Contains(got, "LastEntryHash = :prevHead") {
+		t.Errorf("sender update condition %q is not guarded by its head", got)
+	}
+	if got := aws.ToString(items[1].Update.ConditionExpression); !strings.Contains(got, "attribute_not_exists(LastEntryHash)") {
+		t.Errorf("receiver update condition %q is not guarded by its empty head", got)
+	}
+
+	if _, err := journalItems("nil", "journal", "uuid", "bob", legs, nil, nil, 1700000000, 1700000000000000000); err == nil {
+		t.Errorf("journalItems() with a foreign sender should fail")
+	}
+}
+
+func TestJournalItemsRefusesNonPositiveLegs(t *testing.T) {
+	for _, amount := range []float64{0, math.Copysign(0, -1), -10, math.NaN()} {
+		legs := []JournalLeg{
+			{AccountID: "alice", Type: LegDebit, Amount: amount},
+			{AccountID: "bob", Type: LegCredit, Amount: amount},
+		}
+		if _, err := journalItems("nil", "journal", "", "alice", legs, nil, map[string]*User{}, 1700000000, 1700000000000000000); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("journalItems() with legs of %v: error = %v, want ErrInvalidAmount", amount, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxKYCTier is the highest KYC tier, of fully verified owners.
+const MaxKYCTier = 3
+
+// ErrKYCLimitExceeded is returned for money moved beyond the limits of an
+// account's KYC tier.
+var ErrKYCLimitExceeded = errors.New("kyc_limit_exceeded")
+
+// KYCTierLimits are the limits of the accounts of a KYC tier; zero means
+// unlimited.
+type KYCTierLimits struct {
+	Tier int `dynamodbav:"Tier" json:"tier"`
+	// MaxBalance caps the balance transfers received and deposits may
+	// leave on the account.
+	MaxBalance float64 `dynamodbav:"MaxBalance,omitempty" json:"max_balance,omitempty"`
+	// MaxTransaction caps each transfer sent, deposit and withdrawal.
+	MaxTransaction float64 `dynamodbav:"MaxTransaction,omitempty" json:"max_transaction,omitempty"`
+	// MaxMonthlyVolume caps what the account sends and withdraws per UTC
+	// calendar month.
+	MaxMonthlyVolume float64 `dynamodbav:"MaxMonthlyVolume,omitempty" json:"max_monthly_volume,omitempty"`
+}
+
+func (l KYCTierLimits) validate() error {
+	if l.Tier < 0 || l.Tier > MaxKYCTier {
+		return fmt.Errorf("KYC tier %d is not between 0 and %d", l.Tier, MaxKYCTier)
+	}
+	if l.MaxBalance < 0 || l.MaxTransaction < 0 || l.MaxMonthlyVolume < 0 {
+		return fmt.Errorf("limits of KYC tier %d must not be negative", l.Tier)
+	}
+	return nil
+}
+
+// kycLimits returns the limits of account's tier, or nil when it has none.
+// The tenant's system accounts are never limited.
+func (cfg *TenantConfig) kycLimits(account *User) *KYCTierLimits {
+	if cfg.isSystemAccount(account.AccountID) {
+		return nil
+	}
+	for i := range cfg.KYCTierLimits {
+		if cfg.KYCTierLimits[i].Tier == account.KYCTier {
+			return &cfg.KYCTierLimits[i]
+		}
+	}
+	return nil
+}
+
+// SetKYCTier sets the KYC tier of an account, e.g. once its owner's
+// documents are verified, which changes the limits its transfers and
+// deposits are held to.
+func SetKYCTier(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, tier int) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if tier < 0 || tier > MaxKYCTier {
+		return fmt.Errorf("KYC tier %d is not between 0 and %d", tier, MaxKYCTier)
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:    aws.String("REMOVE KYCTier"),
+		ConditionExpression: aws.String("attribute_exists(AccountID)"),
+	}
+	if tier > 0 {
+		input.UpdateExpression = aws.String("SET KYCTier = :tier")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":tier": &types.AttributeValueMemberN{Value: strconv.Itoa(tier)},
+		}
+	}
+	_, err := dbSvc.UpdateItem(ctx, input)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("account %s does not exist", accountId)
+	} else if err != nil {
+		err = fmt.Errorf("failed to set KYC tier of %s: %v", accountId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	recordAudit(ctx, dbSvc, AuditSetKYCTier, tenantId, accountId, map[string]any{"kyc_tier": tier}, before, after, err)
+	return err
+}
+
+// enforceKYCDebit checks amount leaving account against the transaction
+// and monthly limits of its tier. The month's volume is only queried when
+// a monthly limit applies.
+func enforceKYCDebit(ctx context.Context, dbSvc DynamoDBAPI, cfg *TenantConfig, tenantId string, account *User, amount float64, now time.Time) error {
+	limits := cfg.kycLimits(account)
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxTransaction > 0 && amount > limits.MaxTransaction {
+		return fmt.Errorf("%w: %.2f is over the %.2f transaction limit of KYC tier %d", ErrKYCLimitExceeded, amount, limits.MaxTransaction, account.KYCTier)
+	}
+	if limits.MaxMonthlyVolume > 0 {
+		now = now.UTC()
+		startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+		sent, err := sumOutgoingSince(ctx, dbSvc, tenantId, account.AccountID, startOfMonth)
+		if err != nil {
+			return err
+		}
+		if sent+amount > limits.MaxMonthlyVolume {
+			return fmt.Errorf("%w: the %.2f monthly limit of KYC tier %d would be exceeded", ErrKYCLimitExceeded, limits.MaxMonthlyVolume, account.KYCTier)
+		}
+	}
+	return nil
+}
+
+// kycCreditError checks amount credited to account against the balance
+// limit of its tier, and deposit against its transaction limit.
+func (cfg *TenantConfig) kycCreditError(account *User, amount float64, deposit bool) error {
+	limits := cfg.kycLimits(account)
+	if limits == nil {
+		return nil
+	}
+	if deposit && limits.MaxTransaction > 0 && amount > limits.MaxTransaction {
+		return fmt.Errorf("%w: %.2f is over the %.2f transaction limit of KYC tier %d", ErrKYCLimitExceeded, amount, limits.MaxTransaction, account.KYCTier)
+	}
+	if limits.MaxBalance > 0 && RoundAmount(account.Amount+amount, currencyOf(account)) > limits.MaxBalance {
+		return fmt.Errorf("%w: the %.2f balance limit of KYC tier %d would be exceeded", ErrKYCLimitExceeded, limits.MaxBalance, account.KYCTier)
+	}
+	return nil
+}
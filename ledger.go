@@ -62,10 +62,26 @@ type LedgerEntry struct {
 	Time                int64   `dynamodbav:"Time" json:"time,omitempty"`
 	TenantID            string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
 	InitiatorUUID       string  `dynamodbav:"UUID" json:"uuid,omitempty"`
+	JournalID           string  `dynamodbav:"JournalID,omitempty" json:"journal_id,omitempty"`
+	// Currency is that of the account.
+	Currency string `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
+	// Category and MCC are those of the transfer the entry posts.
+	Category string `dynamodbav:"Category,omitempty" json:"category,omitempty"`
+	MCC      string `dynamodbav:"MCC,omitempty" json:"mcc,omitempty"`
+	// Overdraft is set on a debit that took the account below zero.
+	Overdraft bool `dynamodbav:"Overdraft,omitempty" json:"overdraft,omitempty"`
+	// PrevHash is the Hash of the account's previous entry, and Hash the
+	// SHA-256 of this entry's contents and PrevHash; see
+	// VerifyLedgerIntegrity. Escrow postings and older entries have neither.
+	PrevHash string `dynamodbav:"PrevHash,omitempty" json:"prev_hash,omitempty"`
+	Hash     string `dynamodbav:"Hash,omitempty" json:"hash,omitempty"`
+	// ExternalRef is the reference of the transaction of another system the
+	// entry was imported from; see ImportLedgerEntries.
+	ExternalRef string `dynamodbav:"ExternalRef,omitempty" json:"external_ref,omitempty"`
 }
 
 // DeleteAccount by its tenantID and accountID
-func DeleteAccount(ctx context.Context, dbSvc *dynamodb.Client, tenantId string, accountId string) error {
+func DeleteAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, accountId string) error {
 	if tenantId == "" {
 		tenantId = "nil"
 	}
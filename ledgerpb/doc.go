@@ -0,0 +1,7 @@
+// Package ledgerpb holds the protocol buffer messages and gRPC stubs of the
+// ledger service defined in ledger.proto, for services written in other
+// languages to generate their own clients from. The grpcserver package
+// serves it.
+package ledgerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ledger.proto
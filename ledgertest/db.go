@@ -0,0 +1,867 @@
+// Package ledgertest provides an in-memory implementation of
+// ledger.DynamoDBAPI, so code built on the ledger can be unit tested without
+// DynamoDB Local.
+//
+// The fake keeps items per table, evaluates condition, filter, key condition,
+// update and projection expressions, maintains global secondary indexes,
+// scans tables in parallel segments and executes TransactWriteItems
+// atomically. Batch operations always process every request. It does not
+// model capacity, item size limits or eventual consistency.
+package ledgertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// IndexSchema is the key schema of a global secondary index.
+type IndexSchema struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+// TableSchema is the key schema of a table and its indexes.
+type TableSchema struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+	Indexes  []IndexSchema
+	// TTLAttribute is reported by DescribeTimeToLive; items are not expired.
+	TTLAttribute string
+}
+
+// Schemas returns the schemas of the tables used by the ledger, read from
+// the ledger's table name variables when called.
+func Schemas() []TableSchema {
+	return []TableSchema{
+		{Name: ledger.NilUsers, HashKey: "TenantID", RangeKey: "AccountID", Indexes: []IndexSchema{
+			{Name: "EmailIndex", HashKey: "Email", RangeKey: "TenantID"},
+			{Name: "UsernameIndex", HashKey: "AccountID", RangeKey: "TenantID"},
+			{Name: "OwnerIDIndex", HashKey: "TenantID", RangeKey: "OwnerID"},
+			{Name: ledger.MobileNumberIndex, HashKey: "TenantID", RangeKey: "MobileLookup"},
+			{Name: ledger.IDNumberIndex, HashKey: "TenantID", RangeKey: "IDLookup"},
+			{Name: ledger.AccountIDIndex, HashKey: "AccountID", RangeKey: "TenantID"},
+		}},
+		{Name: ledger.LedgerTable, HashKey: "TenantID", RangeKey: "TransactionID", Indexes: []IndexSchema{
+			{Name: "UserUUIDIndex", HashKey: "TenantID", RangeKey: "UUID"},
+		}},
+		{Name: ledger.TransactionsTable, HashKey: "TenantID", RangeKey: "TransactionID", Indexes: []IndexSchema{
+			{Name: "FromAccountIndex", HashKey: "TenantID", RangeKey: "FromAccount"},
+			{Name: "ToAccountIndex", HashKey: "TenantID", RangeKey: "ToAccount"},
+			{Name: "TransactionDateIndex", HashKey: "TenantID", RangeKey: "TransactionDate"},
+			{Name: "UserUUIDIndex", HashKey: "TenantID", RangeKey: "UUID"},
+			{Name: ledger.ReferenceIndex, HashKey: "TenantID", RangeKey: "ReferenceLookup"},
+			{Name: ledger.ParentIndex, HashKey: "TenantID", RangeKey: "ParentTransactionID"},
+		}},
+		{Name: "DeletedNilUsers", HashKey: "TenantID", RangeKey: "AccountID"},
+		{Name: "QRPaymentsTable", HashKey: "TenantID", RangeKey: "PaymentID", Indexes: []IndexSchema{
+			{Name: "UUIDIndex", HashKey: "TenantID", RangeKey: "UUID"},
+			{Name: "StatusIndex", HashKey: "TenantID", RangeKey: "Status"},
+			{Name: "AccountIDIndex", HashKey: "TenantID", RangeKey: "AccountID"},
+		}},
+		{Name: "EscrowMeta", HashKey: "TenantID"},
+		{Name: ledger.EscrowTransactionsTable, HashKey: "UUID", RangeKey: "TransactionID", Indexes: []IndexSchema{
+			{Name: "FromAccountIndex", HashKey: "UUID", RangeKey: "FromAccount"},
+			{Name: "ToAccountIndex", HashKey: "UUID", RangeKey: "ToAccount"},
+			{Name: "TransactionDateIndex", HashKey: "UUID", RangeKey: "TransactionDate"},
+			{Name: "SystemID", HashKey: "TransactionID", RangeKey: "UUID"},
+			{Name: "FromTenantIDIndex", HashKey: "FromTenantID", RangeKey: "TransactionID"},
+			{Name: "ToTenantIDIndex", HashKey: "ToTenantID", RangeKey: "TransactionID"},
+			{Name: "StatusTransactionDateIndex", HashKey: "TransactionStatus", RangeKey: "TransactionDate"},
+		}},
+		{Name: "ServiceProviders", HashKey: "Email"},
+		{Name: "ServiceProviderTransactions", HashKey: "ServiceProvider", RangeKey: "TransactionID", Indexes: []IndexSchema{
+			{Name: "ServiceProviderDateIndex", HashKey: "ServiceProvider", RangeKey: "TransactionDate"},
+		}},
+		{Name: ledger.TenantConfigTable, HashKey: "TenantID"},
+		{Name: ledger.CustomerLimitsTable, HashKey: "TenantID", RangeKey: "AccountID"},
+		{Name: ledger.ThirdPartyAppsTable, HashKey: "TenantID", RangeKey: "AppID"},
+		{Name: ledger.ConsentsTable, HashKey: "TenantID", RangeKey: "ConsentID"},
+		{Name: ledger.AnnotationsTable, HashKey: "OwnerID", RangeKey: "TransactionID"},
+		{Name: ledger.AccountEventsTable, HashKey: "StreamID", RangeKey: "EventID", TTLAttribute: "ExpiresAt"},
+		{Name: ledger.IdempotencyKeysTable, HashKey: "TenantID", RangeKey: "IdempotencyKey", TTLAttribute: "ExpiresAt"},
+		{Name: ledger.DelayedTransfersTable, HashKey: "TenantID", RangeKey: "TransferID", Indexes: []IndexSchema{
+			{Name: "StatusReleaseAtIndex", HashKey: "Status", RangeKey: "ReleaseAt"},
+		}},
+		{Name: ledger.TransferApprovalsTable, HashKey: "TenantID", RangeKey: "TransferID"},
+		{Name: ledger.ArchivesTable, HashKey: "TenantID", RangeKey: "ArchiveID"},
+		{Name: ledger.CredentialsTable, HashKey: "KeyID", Indexes: []IndexSchema{
+			{Name: ledger.CredentialsTenantIndex, HashKey: "TenantID", RangeKey: "KeyID"},
+		}},
+		{Name: ledger.ReportSubscriptionsTable, HashKey: "TenantID", RangeKey: "SubscriptionID", Indexes: []IndexSchema{
+			{Name: "StatusNextRunAtIndex", HashKey: "Status", RangeKey: "NextRunAt"},
+		}},
+		{Name: ledger.AnomaliesTable, HashKey: "TenantID", RangeKey: "AnomalyID"},
+		{Name: ledger.AnomalyBaselinesTable, HashKey: "TenantID", RangeKey: "Key"},
+		{Name: ledger.AuditLogTable, HashKey: "TenantID", RangeKey: "EntryID"},
+		{Name: ledger.TenantKeysTable, HashKey: "TenantID", RangeKey: "KeyID"},
+		{Name: ledger.SnapshotsTable, HashKey: "AccountKey", RangeKey: "Day"},
+		{Name: ledger.ExchangeRatesTable, HashKey: "TenantID", RangeKey: "Currency"},
+		{Name: ledger.PayoutsTable, HashKey: "TenantID", RangeKey: "CodeHash"},
+		{Name: ledger.PendingClaimsTable, HashKey: "TenantID", RangeKey: "ClaimID"},
+		{Name: ledger.ConfigChangesTable, HashKey: "TenantID", RangeKey: "ChangeID", Indexes: []IndexSchema{
+			{Name: "StatusActivateAtIndex", HashKey: "Status", RangeKey: "ActivateAt"},
+		}},
+		{Name: ledger.ReserveProofsTable, HashKey: "TenantID", RangeKey: "ProofID"},
+		{Name: ledger.ReserveInclusionsTable, HashKey: "ProofKey", RangeKey: "AccountID"},
+		{Name: ledger.FailedOperationsTable, HashKey: "TenantID", RangeKey: "OperationID", Indexes: []IndexSchema{
+			{Name: "StatusCreatedAtIndex", HashKey: "Status", RangeKey: "CreatedAt"},
+		}},
+		{Name: ledger.PaymentRequestsTable, HashKey: "TenantID", RangeKey: "RequestID", Indexes: []IndexSchema{
+			{Name: "MerchantCreatedAtIndex", HashKey: "MerchantKey", RangeKey: "CreatedAt"},
+			{Name: "StatusExpiresAtIndex", HashKey: "Status", RangeKey: "ExpiresAt"},
+		}},
+		{Name: ledger.InterTenantObligationsTable, HashKey: "Period", RangeKey: "Pair"},
+		{Name: ledger.SettlementBatchesTable, HashKey: "Period"},
+		{Name: ledger.EscrowHoldsTable, HashKey: "TenantID", RangeKey: "EscrowID"},
+		{Name: ledger.DisputesTable, HashKey: "TenantID", RangeKey: "TransactionID"},
+		{Name: ledger.ProjectionsTable, HashKey: "ProjectionID", RangeKey: "ItemKey", TTLAttribute: "ExpiresAt"},
+		{Name: ledger.StreamCheckpointsTable, HashKey: "Consumer", RangeKey: "ShardID"},
+		{Name: ledger.TenantAnalyticsTable, HashKey: "TenantID", RangeKey: "Day"},
+		{Name: ledger.VelocityCountersTable, HashKey: "TenantID", RangeKey: "CounterID", TTLAttribute: "ExpiresAt"},
+		{Name: ledger.CampaignsTable, HashKey: "TenantID", RangeKey: "CampaignID"},
+		{Name: ledger.CampaignUsageTable, HashKey: "TenantID", RangeKey: "UsageID", TTLAttribute: "ExpiresAt"},
+		{Name: ledger.BalanceSubscriptionsTable, HashKey: "AccountKey", RangeKey: "SubscriptionID"},
+	}
+}
+
+// DB is an in-memory DynamoDB. It is safe for concurrent use.
+type DB struct {
+	mu     sync.Mutex
+	tables map[string]*table
+}
+
+var (
+	_ ledger.DynamoDBAPI    = (*DB)(nil)
+	_ ledger.TableDescriber = (*DB)(nil)
+	_ ledger.Scanner        = (*DB)(nil)
+)
+
+type table struct {
+	schema TableSchema
+	items  map[string]item
+}
+
+// NewDB returns an empty database with all the ledger tables created.
+func NewDB() *DB {
+	db := &DB{tables: map[string]*table{}}
+	for _, schema := range Schemas() {
+		db.CreateTable(schema)
+	}
+	return db
+}
+
+// CreateTable creates an empty table, replacing any table with the same name.
+func (db *DB) CreateTable(schema TableSchema) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tables[schema.Name] = &table{schema: schema, items: map[string]item{}}
+}
+
+// Items returns a copy of every item stored in a table, in no particular order.
+func (db *DB) Items(tableName string) []map[string]types.AttributeValue {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.tables[tableName]
+	if !ok {
+		return nil
+	}
+	items := make([]map[string]types.AttributeValue, 0, len(t.items))
+	for _, it := range t.items {
+		items = append(items, copyItem(it))
+	}
+	return items
+}
+
+func (db *DB) table(name *string) (*table, error) {
+	t, ok := db.tables[aws.ToString(name)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("Requested resource not found: table " + aws.ToString(name))}
+	}
+	return t, nil
+}
+
+// DescribeTable implements ledger.TableDescriber with the key schema of a
+// table and its indexes.
+func (db *DB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &types.TableDescription{
+		TableName:   aws.String(t.schema.Name),
+		TableStatus: types.TableStatusActive,
+		KeySchema:   keySchemaElements(t.schema.HashKey, t.schema.RangeKey),
+		ItemCount:   aws.Int64(int64(len(t.items))),
+	}
+	for _, index := range t.schema.Indexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   aws.String(index.Name),
+			IndexStatus: types.IndexStatusActive,
+			KeySchema:   keySchemaElements(index.HashKey, index.RangeKey),
+		})
+	}
+	return &dynamodb.DescribeTableOutput{Table: desc}, nil
+}
+
+// DescribeTimeToLive implements ledger.TableDescriber.
+func (db *DB) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if t.schema.TTLAttribute != "" {
+		desc.AttributeName = aws.String(t.schema.TTLAttribute)
+		desc.TimeToLiveStatus = types.TimeToLiveStatusEnabled
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+func keySchemaElements(hash, rng string) []types.KeySchemaElement {
+	elements := []types.KeySchemaElement{{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash}}
+	if rng != "" {
+		elements = append(elements, types.KeySchemaElement{AttributeName: aws.String(rng), KeyType: types.KeyTypeRange})
+	}
+	return elements
+}
+
+// primaryKey returns the map key of the item with the given key attributes.
+func (t *table) primaryKey(key item) (string, error) {
+	hash, ok := key[t.schema.HashKey]
+	if !ok {
+		return "", fmt.Errorf("ValidationException: missing key attribute %s for table %s", t.schema.HashKey, t.schema.Name)
+	}
+	k, err := keyString(hash)
+	if err != nil {
+		return "", err
+	}
+	if t.schema.RangeKey == "" {
+		return k, nil
+	}
+	rng, ok := key[t.schema.RangeKey]
+	if !ok {
+		return "", fmt.Errorf("ValidationException: missing key attribute %s for table %s", t.schema.RangeKey, t.schema.Name)
+	}
+	r, err := keyString(rng)
+	if err != nil {
+		return "", err
+	}
+	return k + "\x00" + r, nil
+}
+
+// keyOf extracts the key attributes of the table, and of index when set, from an item.
+func (t *table) keyOf(it item, index *IndexSchema) item {
+	key := item{}
+	names := []string{t.schema.HashKey, t.schema.RangeKey}
+	if index != nil {
+		names = append(names, index.HashKey, index.RangeKey)
+	}
+	for _, name := range names {
+		if v, ok := it[name]; ok && name != "" {
+			key[name] = copyValue(v)
+		}
+	}
+	return key
+}
+
+func (t *table) index(name string) (*IndexSchema, error) {
+	for i := range t.schema.Indexes {
+		if t.schema.Indexes[i].Name == name {
+			return &t.schema.Indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("ValidationException: table %s has no index %s", t.schema.Name, name)
+}
+
+func checkCondition(expr *string, names map[string]string, values map[string]types.AttributeValue, it item) (bool, error) {
+	if aws.ToString(expr) == "" {
+		return true, nil
+	}
+	c, err := parseCondition(*expr, names, values)
+	if err != nil {
+		return false, err
+	}
+	if it == nil {
+		it = item{}
+	}
+	return c(it)
+}
+
+func conditionFailed(old item, returnOld types.ReturnValuesOnConditionCheckFailure) error {
+	err := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	if returnOld == types.ReturnValuesOnConditionCheckFailureAllOld {
+		err.Item = copyItem(old)
+	}
+	return err
+}
+
+func project(it item, expr *string, names map[string]string) (item, error) {
+	if it == nil || aws.ToString(expr) == "" {
+		return copyItem(it), nil
+	}
+	paths, err := parseProjection(*expr, names)
+	if err != nil {
+		return nil, err
+	}
+	out := item{}
+	for _, pth := range paths {
+		if v, ok := it[pth.top()]; ok {
+			out[pth.top()] = copyValue(v)
+		}
+	}
+	return out, nil
+}
+
+// GetItem implements ledger.DynamoDBAPI.
+func (db *DB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := t.primaryKey(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	it, err := project(t.items[pk], params.ProjectionExpression, params.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: it}, nil
+}
+
+// PutItem implements ledger.DynamoDBAPI.
+func (db *DB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := t.primaryKey(params.Item)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[pk]
+	ok, err := checkCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed(old, params.ReturnValuesOnConditionCheckFailure)
+	}
+	t.items[pk] = copyItem(params.Item)
+
+	out := &dynamodb.PutItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+// UpdateItem implements ledger.DynamoDBAPI. As in DynamoDB, updating a
+// missing item creates it.
+func (db *DB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	pk, updated, err := t.prepareUpdate(params.Key, params.UpdateExpression, params.ConditionExpression,
+		params.ExpressionAttributeNames, params.ExpressionAttributeValues, params.ReturnValuesOnConditionCheckFailure)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[pk]
+	t.items[pk] = updated
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch params.ReturnValues {
+	case types.ReturnValueAllOld, types.ReturnValueUpdatedOld:
+		out.Attributes = copyItem(old)
+	case types.ReturnValueAllNew, types.ReturnValueUpdatedNew:
+		out.Attributes = copyItem(updated)
+	}
+	return out, nil
+}
+
+// prepareUpdate evaluates an update without storing it.
+func (t *table) prepareUpdate(key item, updateExpr, conditionExpr *string, names map[string]string, values map[string]types.AttributeValue, returnOld types.ReturnValuesOnConditionCheckFailure) (string, item, error) {
+	pk, err := t.primaryKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	old := t.items[pk]
+	ok, err := checkCondition(conditionExpr, names, values, old)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, conditionFailed(old, returnOld)
+	}
+
+	base := old
+	if base == nil {
+		base = t.keyOf(key, nil)
+	}
+	if aws.ToString(updateExpr) == "" {
+		return pk, copyItem(base), nil
+	}
+	upd, err := parseUpdate(*updateExpr, names, values)
+	if err != nil {
+		return "", nil, err
+	}
+	updated, err := upd(base)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, name := range []string{t.schema.HashKey, t.schema.RangeKey} {
+		if name != "" && !equal(updated[name], key[name]) {
+			return "", nil, fmt.Errorf("ValidationException: cannot update attribute %s, it is part of the key", name)
+		}
+	}
+	return pk, updated, nil
+}
+
+// DeleteItem implements ledger.DynamoDBAPI.
+func (db *DB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := t.primaryKey(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[pk]
+	ok, err := checkCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, old)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed(old, params.ReturnValuesOnConditionCheckFailure)
+	}
+	delete(t.items, pk)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+// BatchGetItem implements ledger.DynamoDBAPI. All keys are always processed.
+func (db *DB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	out := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	for name, req := range params.RequestItems {
+		t, err := db.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range req.Keys {
+			pk, err := t.primaryKey(key)
+			if err != nil {
+				return nil, err
+			}
+			it, ok := t.items[pk]
+			if !ok {
+				continue
+			}
+			projected, err := project(it, req.ProjectionExpression, req.ExpressionAttributeNames)
+			if err != nil {
+				return nil, err
+			}
+			out.Responses[name] = append(out.Responses[name], projected)
+		}
+	}
+	return out, nil
+}
+
+// BatchWriteItem implements ledger.DynamoDBAPI. All requests are always
+// processed, so UnprocessedItems is empty.
+func (db *DB) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	type write struct {
+		t    *table
+		pk   string
+		item item
+	}
+	var writes []write
+	seen := map[string]bool{}
+	for name, reqs := range params.RequestItems {
+		t, err := db.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range reqs {
+			var w write
+			switch {
+			case req.PutRequest != nil:
+				w.item = req.PutRequest.Item
+				w.pk, err = t.primaryKey(req.PutRequest.Item)
+			case req.DeleteRequest != nil:
+				w.pk, err = t.primaryKey(req.DeleteRequest.Key)
+			default:
+				err = errors.New("ValidationException: write request has neither PutRequest nor DeleteRequest")
+			}
+			if err != nil {
+				return nil, err
+			}
+			w.t = t
+			if seen[name+"/"+w.pk] {
+				return nil, errors.New("ValidationException: Provided list of item keys contains duplicates")
+			}
+			seen[name+"/"+w.pk] = true
+			writes = append(writes, w)
+		}
+	}
+	if len(writes) > 25 {
+		return nil, fmt.Errorf("ValidationException: too many items requested for the BatchWriteItem call: %d", len(writes))
+	}
+	for _, w := range writes {
+		if w.item == nil {
+			delete(w.t.items, w.pk)
+			continue
+		}
+		w.t.items[w.pk] = copyItem(w.item)
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// Query implements ledger.DynamoDBAPI on tables and global secondary indexes.
+// Limit is applied before the filter and pages end early only because of it.
+func (db *DB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	var index *IndexSchema
+	if params.IndexName != nil {
+		if index, err = t.index(*params.IndexName); err != nil {
+			return nil, err
+		}
+	}
+	if aws.ToString(params.KeyConditionExpression) == "" {
+		return nil, errors.New("ValidationException: KeyConditionExpression is required")
+	}
+	keyCond, err := parseCondition(*params.KeyConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	var filter condition
+	if aws.ToString(params.FilterExpression) != "" {
+		if filter, err = parseCondition(*params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []item
+	for _, it := range t.items {
+		if index != nil {
+			if _, ok := it[index.HashKey]; !ok {
+				continue
+			}
+			if _, ok := it[index.RangeKey]; index.RangeKey != "" && !ok {
+				continue
+			}
+		}
+		ok, err := keyCond(it)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, it)
+		}
+	}
+
+	order := t.orderKeys(index)
+	less := func(a, b item) bool { return compareKeys(a, b, order) < 0 }
+	sort.Slice(matches, func(i, j int) bool { return less(matches[i], matches[j]) })
+	forward := params.ScanIndexForward == nil || *params.ScanIndexForward
+	if !forward {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+
+	start := 0
+	if len(params.ExclusiveStartKey) > 0 {
+		for start < len(matches) {
+			c := compareKeys(matches[start], params.ExclusiveStartKey, order)
+			if forward && c > 0 || !forward && c < 0 {
+				break
+			}
+			start++
+		}
+	}
+
+	out := &dynamodb.QueryOutput{}
+	end := len(matches)
+	if params.Limit != nil {
+		if *params.Limit < 1 {
+			return nil, errors.New("ValidationException: Limit must be at least 1")
+		}
+		end = min(end, start+int(*params.Limit))
+	}
+	for _, it := range matches[start:end] {
+		out.ScannedCount++
+		if filter != nil {
+			ok, err := filter(it)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		out.Count++
+		if params.Select == types.SelectCount {
+			continue
+		}
+		projected, err := project(it, params.ProjectionExpression, params.ExpressionAttributeNames)
+		if err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, projected)
+	}
+	if end < len(matches) {
+		out.LastEvaluatedKey = t.keyOf(matches[end-1], index)
+	}
+	return out, nil
+}
+
+// Scan implements ledger.Scanner. Items are split into segments by a hash of
+// their key, and each segment is read in key order.
+func (db *DB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	segment, segments := aws.ToInt32(params.Segment), aws.ToInt32(params.TotalSegments)
+	if segments == 0 {
+		segments = 1
+	}
+	if segments < 1 || segment < 0 || segment >= segments {
+		return nil, fmt.Errorf("ValidationException: invalid segment %d of %d", segment, segments)
+	}
+	var filter condition
+	if aws.ToString(params.FilterExpression) != "" {
+		if filter, err = parseCondition(*params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []item
+	for key, it := range t.items {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if h.Sum32()%uint32(segments) == uint32(segment) {
+			matches = append(matches, it)
+		}
+	}
+	order := t.orderKeys(nil)
+	sort.Slice(matches, func(i, j int) bool { return compareKeys(matches[i], matches[j], order) < 0 })
+	start := 0
+	if len(params.ExclusiveStartKey) > 0 {
+		for start < len(matches) && compareKeys(matches[start], params.ExclusiveStartKey, order) <= 0 {
+			start++
+		}
+	}
+
+	out := &dynamodb.ScanOutput{}
+	end := len(matches)
+	if params.Limit != nil {
+		if *params.Limit < 1 {
+			return nil, errors.New("ValidationException: Limit must be at least 1")
+		}
+		end = min(end, start+int(*params.Limit))
+	}
+	for _, it := range matches[start:end] {
+		out.ScannedCount++
+		if filter != nil {
+			ok, err := filter(it)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		out.Count++
+		projected, err := project(it, params.ProjectionExpression, params.ExpressionAttributeNames)
+		if err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, projected)
+	}
+	if end < len(matches) {
+		out.LastEvaluatedKey = t.keyOf(matches[end-1], nil)
+	}
+	return out, nil
+}
+
+// orderKeys returns the attributes items are sorted by: the range key of the
+// index or table, then the table key to make the order total.
+func (t *table) orderKeys(index *IndexSchema) []string {
+	var keys []string
+	if index != nil && index.RangeKey != "" {
+		keys = append(keys, index.RangeKey)
+	}
+	keys = append(keys, t.schema.RangeKey, t.schema.HashKey)
+	return keys
+}
+
+func compareKeys(a, b item, keys []string) int {
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		av, aok := a[k]
+		bv, bok := b[k]
+		if !aok || !bok {
+			continue
+		}
+		if c, ok := compare(av, bv); ok && c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// TransactWriteItems implements ledger.DynamoDBAPI. Either every item is
+// written or none is; failed conditions cancel the transaction with a
+// cancellation reason per item, like DynamoDB.
+func (db *DB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(params.TransactItems) == 0 || len(params.TransactItems) > 100 {
+		return nil, errors.New("ValidationException: a transaction must contain between 1 and 100 items")
+	}
+
+	type write struct {
+		table  *table
+		pk     string
+		item   item // nil deletes
+		delete bool
+	}
+	var writes []write
+	seen := map[string]bool{}
+	reasons := make([]types.CancellationReason, len(params.TransactItems))
+	failed := false
+
+	for i, op := range params.TransactItems {
+		var (
+			tableName *string
+			key       item
+			err       error
+			w         write
+			condOK    = true
+		)
+		switch {
+		case op.Put != nil:
+			tableName, key = op.Put.TableName, op.Put.Item
+			if w.table, err = db.table(tableName); err != nil {
+				return nil, err
+			}
+			if w.pk, err = w.table.primaryKey(key); err != nil {
+				return nil, err
+			}
+			condOK, err = checkCondition(op.Put.ConditionExpression, op.Put.ExpressionAttributeNames, op.Put.ExpressionAttributeValues, w.table.items[w.pk])
+			w.item = copyItem(op.Put.Item)
+		case op.Update != nil:
+			tableName, key = op.Update.TableName, op.Update.Key
+			if w.table, err = db.table(tableName); err != nil {
+				return nil, err
+			}
+			w.pk, w.item, err = w.table.prepareUpdate(key, op.Update.UpdateExpression, op.Update.ConditionExpression,
+				op.Update.ExpressionAttributeNames, op.Update.ExpressionAttributeValues, op.Update.ReturnValuesOnConditionCheckFailure)
+			var condErr *types.ConditionalCheckFailedException
+			if errors.As(err, &condErr) {
+				condOK, err = false, nil
+				w.pk, _ = w.table.primaryKey(key)
+			}
+		case op.Delete != nil:
+			tableName, key = op.Delete.TableName, op.Delete.Key
+			if w.table, err = db.table(tableName); err != nil {
+				return nil, err
+			}
+			if w.pk, err = w.table.primaryKey(key); err != nil {
+				return nil, err
+			}
+			condOK, err = checkCondition(op.Delete.ConditionExpression, op.Delete.ExpressionAttributeNames, op.Delete.ExpressionAttributeValues, w.table.items[w.pk])
+			w.delete = true
+		case op.ConditionCheck != nil:
+			tableName, key = op.ConditionCheck.TableName, op.ConditionCheck.Key
+			if w.table, err = db.table(tableName); err != nil {
+				return nil, err
+			}
+			if w.pk, err = w.table.primaryKey(key); err != nil {
+				return nil, err
+			}
+			condOK, err = checkCondition(op.ConditionCheck.ConditionExpression, op.ConditionCheck.ExpressionAttributeNames, op.ConditionCheck.ExpressionAttributeValues, w.table.items[w.pk])
+			w.table = nil
+		default:
+			return nil, errors.New("ValidationException: empty transaction item")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id := aws.ToString(tableName) + "\x01" + w.pk
+		if seen[id] {
+			return nil, errors.New("ValidationException: Transaction request cannot include multiple operations on one item")
+		}
+		seen[id] = true
+
+		reasons[i] = types.CancellationReason{Code: aws.String("None")}
+		if !condOK {
+			failed = true
+			reasons[i] = types.CancellationReason{Code: aws.String("ConditionalCheckFailed"), Message: aws.String("The conditional request failed")}
+			continue
+		}
+		if w.table != nil {
+			writes = append(writes, w)
+		}
+	}
+
+	if failed {
+		return nil, &types.TransactionCanceledException{
+			Message:             aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+			CancellationReasons: reasons,
+		}
+	}
+	for _, w := range writes {
+		if w.delete {
+			delete(w.table.items, w.pk)
+		} else {
+			w.table.items[w.pk] = w.item
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
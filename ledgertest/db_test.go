@@ -0,0 +1,236 @@
+package ledgertest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func s(v string) types.AttributeValue { return &types.AttributeValueMemberS{Value: v} }
+func n(v string) types.AttributeValue { return &types.AttributeValueMemberN{Value: v} }
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := &DB{tables: map[string]*table{}}
+	db.CreateTable(TableSchema{Name: "Accounts", HashKey: "TenantID", RangeKey: "AccountID", Indexes: []IndexSchema{
+		{Name: "CityIndex", HashKey: "City", RangeKey: "Balance"},
+	}})
+	ctx := context.Background()
+	for i, city := range []string{"KRT", "KRT", "PSD", "KRT"} {
+		_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String("Accounts"),
+			Item: item{
+				"TenantID":  s("nil"),
+				"AccountID": s("acc" + strconv.Itoa(i)),
+				"City":      s(city),
+				"Balance":   n(strconv.Itoa(100 * (4 - i))),
+			},
+		})
+		if err != nil {
+			t.Fatalf("PutItem() error = %v", err)
+		}
+	}
+	return db
+}
+
+func key(account string) item {
+	return item{"TenantID": s("nil"), "AccountID": s(account)}
+}
+
+func TestConditionExpressions(t *testing.T) {
+	it := item{
+		"A":    n("10"),
+		"B":    s("hello"),
+		"Tags": &types.AttributeValueMemberSS{Value: []string{"x", "y"}},
+		"M":    &types.AttributeValueMemberM{Value: item{"Inner": n("1")}},
+		"L":    &types.AttributeValueMemberL{Value: []types.AttributeValue{s("first")}},
+	}
+	values := map[string]types.AttributeValue{":ten": n("10.00"), ":five": n("5"), ":h": s("he"), ":x": s("x"), ":one": n("1"), ":first": s("first")}
+	names := map[string]string{"#a": "A"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"A = :ten", true},
+		{"#a > :five AND B <> :h", true},
+		{"A < :five OR begins_with(B, :h)", true},
+		{"NOT attribute_exists(C)", true},
+		{"attribute_not_exists(A)", false},
+		{"A BETWEEN :five AND :ten", true},
+		{"A IN (:five, :one)", false},
+		{"contains(Tags, :x) AND size(B) = :five", true},
+		{"M.Inner = :one AND L[0] = :first", true},
+		{"(A = :five OR A = :ten) AND C <> :one", true},
+		{"C = :one", false},
+	}
+	for _, tt := range tests {
+		got, err := checkCondition(aws.String(tt.expr), names, values, it)
+		if err != nil {
+			t.Errorf("%q: error = %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	if _, err := checkCondition(aws.String("A = :missing"), names, values, it); err == nil {
+		t.Errorf("undefined value placeholder should fail")
+	}
+}
+
+func TestUpdateItem(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	out, err := db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String("Accounts"),
+		Key:              key("acc0"),
+		UpdateExpression: aws.String("SET Balance = Balance - :amount, Note = if_not_exists(Note, :note) REMOVE City ADD Visits :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":amount": n("0.25"),
+			":note":   s("first"),
+			":one":    n("1"),
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		t.Fatalf("UpdateItem() error = %v", err)
+	}
+	want := item{"TenantID": s("nil"), "AccountID": s("acc0"), "Balance": n("399.75"), "Note": s("first"), "Visits": n("1")}
+	if !equal(&types.AttributeValueMemberM{Value: out.Attributes}, &types.AttributeValueMemberM{Value: want}) {
+		t.Errorf("UpdateItem() = %v, want %v", out.Attributes, want)
+	}
+
+	_, err = db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String("Accounts"),
+		Key:                       key("acc0"),
+		UpdateExpression:          aws.String("SET Balance = :zero"),
+		ConditionExpression:       aws.String("Balance > :min"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":zero": n("0"), ":min": n("1000")},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &condErr) {
+		t.Errorf("UpdateItem() with a failing condition error = %v, want ConditionalCheckFailedException", err)
+	}
+
+	_, err = db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String("Accounts"),
+		Key:                       key("acc0"),
+		UpdateExpression:          aws.String("SET Missing = Missing + :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":one": n("1")},
+	})
+	if err == nil {
+		t.Errorf("arithmetic on a missing attribute should fail")
+	}
+}
+
+func TestQueryIndexPagination(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String("Accounts"),
+		IndexName:                 aws.String("CityIndex"),
+		KeyConditionExpression:    aws.String("City = :city AND Balance >= :min"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":city": s("KRT"), ":min": n("100")},
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(2),
+	}
+
+	var got []string
+	pages := 0
+	for {
+		out, err := db.Query(ctx, input)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		pages++
+		for _, it := range out.Items {
+			got = append(got, it["AccountID"].(*types.AttributeValueMemberS).Value)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	want := []string{"acc0", "acc1", "acc3"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+	if pages != 2 {
+		t.Errorf("Query() pages = %d, want 2", pages)
+	}
+}
+
+func TestTransactWriteItemsIsAtomic(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	debit := func(account, amount string) types.TransactWriteItem {
+		return types.TransactWriteItem{Update: &types.Update{
+			TableName:                 aws.String("Accounts"),
+			Key:                       key(account),
+			UpdateExpression:          aws.String("SET Balance = Balance - :amount"),
+			ConditionExpression:       aws.String("Balance >= :amount"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":amount": n(amount)},
+		}}
+	}
+
+	_, err := db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		debit("acc0", "50"),
+		debit("acc3", "500"),
+	}})
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		t.Fatalf("TransactWriteItems() error = %v, want TransactionCanceledException", err)
+	}
+	if codes := []string{aws.ToString(canceled.CancellationReasons[0].Code), aws.ToString(canceled.CancellationReasons[1].Code)}; codes[0] != "None" || codes[1] != "ConditionalCheckFailed" {
+		t.Errorf("cancellation reasons = %v", codes)
+	}
+	out, _ := db.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String("Accounts"), Key: key("acc0")})
+	if got := out.Item["Balance"].(*types.AttributeValueMemberN).Value; got != "400" {
+		t.Errorf("balance after cancelled transaction = %v, want 400", got)
+	}
+
+	_, err = db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		debit("acc0", "50"),
+		debit("acc0", "50"),
+	}})
+	if err == nil {
+		t.Errorf("two operations on one item should fail")
+	}
+}
+
+// Schemas holds tables only the fake's callers use, and indexes the ledger
+// does not validate, on top of every table the ledger validates.
+func TestSchemasCoverLedgerTables(t *testing.T) {
+	schemas := map[string]TableSchema{}
+	for _, schema := range Schemas() {
+		schemas[schema.Name] = schema
+	}
+	for _, spec := range ledger.TableSpecs() {
+		schema, ok := schemas[spec.Name]
+		if !ok {
+			t.Errorf("Schemas() has no table %s", spec.Name)
+			continue
+		}
+		if schema.HashKey != spec.HashKey || schema.RangeKey != spec.RangeKey || schema.TTLAttribute != spec.TTL {
+			t.Errorf("Schemas() has %s keyed %s, %s with TTL %q, want %s, %s with TTL %q", spec.Name,
+				schema.HashKey, schema.RangeKey, schema.TTLAttribute, spec.HashKey, spec.RangeKey, spec.TTL)
+		}
+		for _, index := range spec.Indexes {
+			found := false
+			for _, got := range schema.Indexes {
+				found = found || got == IndexSchema(index)
+			}
+			if !found {
+				t.Errorf("Schemas() has no index %s of %s keyed %s, %s", index.Name, spec.Name, index.HashKey, index.RangeKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package ledgertest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// item is a DynamoDB item.
+type item = map[string]types.AttributeValue
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName  // #placeholder
+	tokValue // :placeholder
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(expr string) ([]token, error) {
+	var toks []token
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || r == ':' || r == '_' || unicode.IsLetter(r):
+			j := i + 1
+			for j < len(rs) && (rs[j] == '_' || unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			kind := tokIdent
+			if r == '#' {
+				kind = tokName
+			} else if r == ':' {
+				kind = tokValue
+			}
+			toks = append(toks, token{kind, string(rs[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i + 1
+			for j < len(rs) && unicode.IsDigit(rs[j]) {
+				j++
+			}
+			toks = append(toks, token{tokNumber, string(rs[i:j])})
+			i = j
+		case strings.ContainsRune("<>", r) && i+1 < len(rs) && (rs[i+1] == '=' || r == '<' && rs[i+1] == '>'):
+			toks = append(toks, token{tokPunct, string(rs[i : i+2])})
+			i += 2
+		case strings.ContainsRune("()[],.=<>+-", r):
+			toks = append(toks, token{tokPunct, string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("ValidationException: invalid character %q in expression %q", r, expr)
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+// pathElem is one step of a document path: a map key or a list index.
+type pathElem struct {
+	name  string
+	index int
+	isIdx bool
+}
+
+type path []pathElem
+
+func (p path) top() string {
+	return p[0].name
+}
+
+// operand evaluates to a value, or reports that it refers to a missing attribute.
+type operand func(it item) (types.AttributeValue, bool, error)
+
+// condition evaluates a condition, filter or key condition expression.
+type condition func(it item) (bool, error)
+
+type parser struct {
+	toks   []token
+	pos    int
+	expr   string
+	names  map[string]string
+	values map[string]types.AttributeValue
+}
+
+func newParser(expr string, names map[string]string, values map[string]types.AttributeValue) (*parser, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{toks: toks, expr: expr, names: names, values: values}, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q", s)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("ValidationException: invalid expression %q: %s near %q", p.expr, fmt.Sprintf(format, args...), p.peek().text)
+}
+
+// parseCondition parses a complete condition expression.
+func parseCondition(expr string, names map[string]string, values map[string]types.AttributeValue) (condition, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected token")
+	}
+	return c, nil
+}
+
+func (p *parser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) (bool, error) {
+			ok, err := l(it)
+			if err != nil || ok {
+				return ok, err
+			}
+			return right(it)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) (bool, error) {
+			ok, err := l(it)
+			if err != nil || !ok {
+				return ok, err
+			}
+			return right(it)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) (bool, error) {
+			ok, err := c(it)
+			return !ok, err
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.isPunct("(") {
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+
+	if t := p.peek(); t.kind == tokIdent && p.toks[p.pos+1].text == "(" {
+		switch strings.ToLower(t.text) {
+		case "attribute_exists", "attribute_not_exists":
+			p.next()
+			p.next()
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			want := strings.EqualFold(t.text, "attribute_exists")
+			return func(it item) (bool, error) {
+				_, ok := getPath(it, pth)
+				return ok == want, nil
+			}, nil
+		case "attribute_type":
+			p.next()
+			p.next()
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			typ, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return func(it item) (bool, error) {
+				v, ok := getPath(it, pth)
+				want, _, err := typ(it)
+				if err != nil || !ok {
+					return false, err
+				}
+				s, isS := want.(*types.AttributeValueMemberS)
+				return isS && typeName(v) == s.Value, nil
+			}, nil
+		case "begins_with", "contains":
+			p.next()
+			p.next()
+			a, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			fn := beginsWith
+			if strings.EqualFold(t.text, "contains") {
+				fn = contains
+			}
+			return func(it item) (bool, error) {
+				av, aok, err := a(it)
+				if err != nil {
+					return false, err
+				}
+				bv, bok, err := b(it)
+				if err != nil || !aok || !bok {
+					return false, err
+				}
+				return fn(av, bv), nil
+			}, nil
+		}
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, p.errorf("expected AND in BETWEEN")
+		}
+		p.next()
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) (bool, error) {
+			v, ok, err := left(it)
+			if err != nil || !ok {
+				return false, err
+			}
+			lv, _, err := low(it)
+			if err != nil {
+				return false, err
+			}
+			hv, _, err := high(it)
+			if err != nil {
+				return false, err
+			}
+			c1, ok1 := compare(v, lv)
+			c2, ok2 := compare(v, hv)
+			return ok1 && ok2 && c1 >= 0 && c2 <= 0, nil
+		}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var list []operand
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, o)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) (bool, error) {
+			v, ok, err := left(it)
+			if err != nil || !ok {
+				return false, err
+			}
+			for _, o := range list {
+				ov, _, err := o(it)
+				if err != nil {
+					return false, err
+				}
+				if equal(v, ov) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}, nil
+	}
+
+	op := p.next()
+	if op.kind != tokPunct || !isComparator(op.text) {
+		p.pos--
+		return nil, p.errorf("expected a comparator")
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) (bool, error) {
+		lv, lok, err := left(it)
+		if err != nil {
+			return false, err
+		}
+		rv, rok, err := right(it)
+		if err != nil {
+			return false, err
+		}
+		if !lok || !rok {
+			return op.text == "<>", nil
+		}
+		switch op.text {
+		case "=":
+			return equal(lv, rv), nil
+		case "<>":
+			return !equal(lv, rv), nil
+		}
+		c, ok := compare(lv, rv)
+		if !ok {
+			return false, nil
+		}
+		switch op.text {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}, nil
+}
+
+func isComparator(s string) bool {
+	switch s {
+	case "=", "<>", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// parseOperand parses a value placeholder, a size() call or a document path.
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokValue:
+		p.next()
+		v, ok := p.values[t.text]
+		if !ok {
+			return nil, fmt.Errorf("ValidationException: value %s used in expression %q is not defined", t.text, p.expr)
+		}
+		return func(item) (types.AttributeValue, bool, error) { return v, true, nil }, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "size") && p.toks[p.pos+1].text == "(":
+		p.next()
+		p.next()
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) (types.AttributeValue, bool, error) {
+			v, ok := getPath(it, pth)
+			if !ok {
+				return nil, false, nil
+			}
+			n, ok := size(v)
+			if !ok {
+				return nil, false, nil
+			}
+			return &types.AttributeValueMemberN{Value: strconv.Itoa(n)}, true, nil
+		}, nil
+	default:
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) (types.AttributeValue, bool, error) {
+			v, ok := getPath(it, pth)
+			return v, ok, nil
+		}, nil
+	}
+}
+
+func (p *parser) parseName() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case tokIdent:
+		return t.text, nil
+	case tokName:
+		name, ok := p.names[t.text]
+		if !ok {
+			return "", fmt.Errorf("ValidationException: name %s used in expression %q is not defined", t.text, p.expr)
+		}
+		return name, nil
+	}
+	p.pos--
+	return "", p.errorf("expected an attribute name")
+}
+
+func (p *parser) parsePath() (path, error) {
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	pth := path{{name: name}}
+	for {
+		switch {
+		case p.isPunct("."):
+			p.next()
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			pth = append(pth, pathElem{name: name})
+		case p.isPunct("["):
+			p.next()
+			t := p.next()
+			if t.kind != tokNumber {
+				return nil, p.errorf("expected a list index")
+			}
+			idx, _ := strconv.Atoi(t.text)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			pth = append(pth, pathElem{index: idx, isIdx: true})
+		default:
+			return pth, nil
+		}
+	}
+}
+
+// parseProjection parses a projection expression into the paths it selects.
+func parseProjection(expr string, names map[string]string) ([]path, error) {
+	p, err := newParser(expr, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	var paths []path
+	for {
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, pth)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected token")
+	}
+	return paths, nil
+}
+
+func getPath(it item, pth path) (types.AttributeValue, bool) {
+	var cur types.AttributeValue = &types.AttributeValueMemberM{Value: it}
+	for _, e := range pth {
+		switch v := cur.(type) {
+		case *types.AttributeValueMemberM:
+			if e.isIdx {
+				return nil, false
+			}
+			next, ok := v.Value[e.name]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case *types.AttributeValueMemberL:
+			if !e.isIdx || e.index >= len(v.Value) {
+				return nil, false
+			}
+			cur = v.Value[e.index]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
@@ -0,0 +1,5302 @@
+package ledgertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newLedger returns a Ledger of db with opts that logs nothing.
+func newLedger(db ledger.DynamoDBAPI, opts ...ledger.Option) *ledger.Ledger {
+	quiet := ledger.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return ledger.NewLedger(db, append([]ledger.Option{quiet}, opts...)...)
+}
+
+func TestTransferCredits(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 500, "bob": 0, "fees": 0, "tax": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{
+		TenantID:    "nil",
+		FeeSchedule: &ledger.FeeSchedule{Type: ledger.FeeFlat, Flat: 2, CollectionAccount: "fees"},
+		Tax:         &ledger.TaxSchedule{Rate: 10, CollectionAccount: "tax"},
+	})
+	if err != nil {
+		t.Fatalf("PutTenantConfig() error = %v", err)
+	}
+
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{
+		TenantID:    "nil",
+		AccountID:   "alice",
+		FromAccount: "alice",
+		ToAccount:   "bob",
+		Amount:      100,
+	})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v, response %+v", err, resp)
+	}
+
+	for account, want := range map[string]float64{"alice": 397.8, "bob": 100, "fees": 2, "tax": 0.2} {
+		got, err := ledger.InquireBalance(ctx, db, "nil", account)
+		if err != nil {
+			t.Fatalf("InquireBalance(%s) error = %v", account, err)
+		}
+		if got != want {
+			t.Errorf("balance of %s = %v, want %v", account, got, want)
+		}
+	}
+
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", resp.Data.TransactionID)
+	if err != nil || tx == nil {
+		t.Fatalf("GetTransaction() = %v, %v", tx, err)
+	}
+	if len(tx.Legs) != 4 || tx.JournalID != resp.Data.TransactionID {
+		t.Errorf("GetTransaction() legs = %+v, journal %s", tx.Legs, tx.JournalID)
+	}
+	if got := len(db.Items(ledger.LedgerTable)); got != 4 {
+		t.Errorf("ledger entries = %d, want 4", got)
+	}
+
+	resp, err = ledger.TransferCredits(ctx, db, ledger.TransactionEntry{
+		TenantID:    "nil",
+		AccountID:   "bob",
+		FromAccount: "bob",
+		ToAccount:   "alice",
+		Amount:      1000,
+	})
+	if err == nil || resp.Code != "insufficient_balance" {
+		t.Errorf("TransferCredits() overdraft = %+v, %v", resp, err)
+	}
+}
+
+func TestDelayedTransferCancel(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 5000, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", LargeTransferThreshold: 1000}); err != nil {
+		t.Fatalf("PutTenantConfig() error = %v", err)
+	}
+
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{
+		TenantID:    "nil",
+		AccountID:   "alice",
+		FromAccount: "alice",
+		ToAccount:   "bob",
+		Amount:      2000,
+	})
+	if err != nil || resp.Code != "transfer_delayed" {
+		t.Fatalf("TransferCredits() = %+v, %v, want transfer_delayed", resp, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 5000 {
+		t.Errorf("balance while held = %v, want 5000", balance)
+	}
+
+	if err := ledger.CancelDelayedTransfer(ctx, db, "nil", "bob", resp.Data.TransactionID); err == nil {
+		t.Errorf("CancelDelayedTransfer() by the receiver should fail")
+	}
+	if err := ledger.CancelDelayedTransfer(ctx, db, "nil", "alice", resp.Data.TransactionID); err != nil {
+		t.Fatalf("CancelDelayedTransfer() error = %v", err)
+	}
+	held, err := ledger.GetDelayedTransfer(ctx, db, "nil", resp.Data.TransactionID)
+	if err != nil {
+		t.Fatalf("GetDelayedTransfer() error = %v", err)
+	}
+	if held.Status != ledger.DelayedTransferCancelled {
+		t.Errorf("status = %s, want %s", held.Status, ledger.DelayedTransferCancelled)
+	}
+}
+
+func TestTxComposerCompensates(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	adjust := func(account, expr, amount string) types.TransactWriteItem {
+		return types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(ledger.NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+				"AccountID": &types.AttributeValueMemberS{Value: account},
+			},
+			UpdateExpression:          aws.String("SET amount = amount " + expr + " :amount"),
+			ConditionExpression:       aws.String("attribute_exists(AccountID)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":amount": &types.AttributeValueMemberN{Value: amount}},
+		}}
+	}
+
+	composer := ledger.NewTxComposer()
+	composer.Add(
+		ledger.TxGroup{Name: "debit", Items: []types.TransactWriteItem{adjust("alice", "-", "40")}, Compensate: []types.TransactWriteItem{adjust("alice", "+", "40")}},
+		ledger.TxGroup{Name: "credit", Items: []types.TransactWriteItem{adjust("alice", "+", "1"), adjust("carol", "+", "40")}},
+	)
+	err := composer.Execute(ctx, db)
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		t.Fatalf("Execute() error = %v, want TransactionCanceledException", err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 100 {
+		t.Errorf("balance after compensation = %v, want 100", balance)
+	}
+}
+
+func TestUpdateTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v", err)
+	}
+	id := resp.Data.TransactionID
+
+	tx, err := ledger.UpdateTransaction(ctx, db, "nil", id, 0, map[string]interface{}{"Comment": "rent"})
+	if err != nil {
+		t.Fatalf("UpdateTransaction() error = %v", err)
+	}
+	if tx.Comment != "rent" || tx.Version != 1 || tx.Amount != 10 {
+		t.Errorf("UpdateTransaction() = %+v", tx)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		version int64
+		updates map[string]interface{}
+		wantErr error
+	}{
+		{"stale version", id, 0, map[string]interface{}{"Comment": "stale"}, ledger.ErrVersionConflict},
+		{"missing transaction", "missing", 0, map[string]interface{}{"Comment": "x"}, ledger.ErrTransactionNotFound},
+		{"immutable field", id, 1, map[string]interface{}{"Amount": 1.0}, nil},
+		{"no fields", id, 1, nil, nil},
+	}
+	for _, tt := range tests {
+		_, err := ledger.UpdateTransaction(ctx, db, "nil", tt.id, tt.version, tt.updates)
+		if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+			t.Errorf("%s: UpdateTransaction() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if got := len(db.Items(ledger.TransactionsTable)); got != 1 {
+		t.Errorf("transactions = %d, want 1", got)
+	}
+}
+
+func TestGetEventsSince(t *testing.T) {
+	defer func(delay time.Duration) { ledger.AccountEventSettleDelay = delay }(ledger.AccountEventSettleDelay)
+	ledger.AccountEventSettleDelay = -time.Second
+
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	transfer := func(amount float64) string {
+		resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: amount})
+		if err != nil {
+			t.Fatalf("TransferCredits() error = %v", err)
+		}
+		return resp.Data.TransactionID
+	}
+
+	first := transfer(10)
+	events, cursor, err := ledger.GetEventsSince(ctx, db, "nil", "bob", "", 10)
+	if err != nil {
+		t.Fatalf("GetEventsSince() error = %v", err)
+	}
+	if len(events) != 1 || events[0].TransactionID != first || events[0].Amount != 10 || cursor != events[0].EventID {
+		t.Fatalf("GetEventsSince() = %+v, %s", events, cursor)
+	}
+
+	events, next, err := ledger.GetEventsSince(ctx, db, "nil", "bob", cursor, 10)
+	if err != nil || len(events) != 0 || next != cursor {
+		t.Errorf("GetEventsSince() with nothing new = %+v, %s, %v", events, next, err)
+	}
+
+	second := transfer(5)
+	events, _, err = ledger.WaitForEvents(ctx, db, "nil", "alice", "", 10, time.Second, 10*time.Millisecond)
+	if err != nil || len(events) != 2 || events[1].TransactionID != second || events[1].Amount != -5 {
+		t.Errorf("WaitForEvents() = %+v, %v", events, err)
+	}
+
+	if _, _, err := ledger.GetEventsSince(ctx, db, "nil", "bob", "not-a-cursor", 10); err == nil {
+		t.Errorf("GetEventsSince() with an invalid cursor should fail")
+	}
+}
+
+func TestTransitionStatus(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v", err)
+	}
+	id := resp.Data.TransactionID
+
+	if _, err := ledger.TransitionStatus(ctx, db, "nil", id, ledger.TransactionFailed, "ops", "typo"); !errors.Is(err, ledger.ErrInvalidTransition) {
+		t.Errorf("TransitionStatus() completed to failed error = %v, want ErrInvalidTransition", err)
+	}
+	tx, err := ledger.TransitionStatus(ctx, db, "nil", id, ledger.TransactionReversed, "ops", "customer dispute")
+	if err != nil {
+		t.Fatalf("TransitionStatus() error = %v", err)
+	}
+	if *tx.Status != ledger.TransactionReversed || len(tx.StatusHistory) != 1 || tx.Version != 1 {
+		t.Fatalf("TransitionStatus() = %+v", tx)
+	}
+	change := tx.StatusHistory[0]
+	if change.From != ledger.TransactionCompleted || change.To != ledger.TransactionReversed || change.Actor != "ops" || change.Reason != "customer dispute" {
+		t.Errorf("status history = %+v", change)
+	}
+	if _, err := ledger.TransitionStatus(ctx, db, "nil", id, ledger.TransactionCompleted, "ops", ""); !errors.Is(err, ledger.ErrInvalidTransition) {
+		t.Errorf("TransitionStatus() out of reversed error = %v, want ErrInvalidTransition", err)
+	}
+	if _, err := ledger.TransitionStatus(ctx, db, "nil", "missing", ledger.TransactionCompleted, "ops", ""); !errors.Is(err, ledger.ErrTransactionNotFound) {
+		t.Errorf("TransitionStatus() of a missing transaction error = %v", err)
+	}
+}
+
+func TestLedgerLogger(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db := ledger.NewLedger(NewDB(), ledger.WithLogger(logger))
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v", err)
+	}
+
+	var posted, calls int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		switch record["msg"] {
+		case "transfer posted":
+			posted++
+			if record["txid"] != resp.Data.TransactionID || record["tenant"] != "nil" || record["account"] != "alice" || record["latency"] == nil {
+				t.Errorf("transfer log = %v", record)
+			}
+		case "dynamodb call":
+			calls++
+		}
+	}
+	if posted != 1 || calls == 0 {
+		t.Errorf("logged %d transfers and %d dynamodb calls:\n%s", posted, calls, buf.String())
+	}
+}
+
+type recordingTracer struct{ spans []*recordingSpan }
+
+type recordingSpan struct {
+	name  string
+	attrs map[string]any
+	err   error
+	ended bool
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attrs ...ledger.Attribute) (context.Context, ledger.Span) {
+	span := &recordingSpan{name: name, attrs: map[string]any{}}
+	span.SetAttributes(attrs...)
+	r.spans = append(r.spans, span)
+	return ctx, span
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...ledger.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+func (s *recordingSpan) RecordError(err error) { s.err = err }
+func (s *recordingSpan) End()                  { s.ended = true }
+
+type recordingMetrics struct{ values map[string]float64 }
+
+func (m *recordingMetrics) AddCounter(ctx context.Context, name string, value float64, attrs ...ledger.Attribute) {
+	m.values[name] += value
+}
+func (m *recordingMetrics) RecordHistogram(ctx context.Context, name string, value float64, attrs ...ledger.Attribute) {
+	m.values[name+".samples"]++
+}
+
+func TestLedgerInstrumentation(t *testing.T) {
+	ctx := context.Background()
+	tracer := &recordingTracer{}
+	metrics := &recordingMetrics{values: map[string]float64{}}
+	db := newLedger(NewDB(), ledger.WithTracer(tracer), ledger.WithMetrics(metrics))
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	for _, amount := range []float64{10, 15, 500} {
+		ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: amount})
+	}
+	if _, err := ledger.InquireBalance(ctx, db, "nil", "alice"); err != nil {
+		t.Fatalf("InquireBalance() error = %v", err)
+	}
+
+	want := map[string]float64{
+		ledger.MetricTransferCount:                 2,
+		ledger.MetricTransferVolume:                25,
+		ledger.MetricTransferFailures:              1,
+		ledger.MetricTransferDuration + ".samples": 3,
+	}
+	for name, value := range want {
+		if metrics.values[name] != value {
+			t.Errorf("metric %s = %v, want %v", name, metrics.values[name], value)
+		}
+	}
+	if metrics.values[ledger.MetricDynamoDBDuration+".samples"] == 0 {
+		t.Errorf("no DynamoDB latency recorded")
+	}
+
+	names := map[string]int{}
+	for _, span := range tracer.spans {
+		names[span.name]++
+		if !span.ended {
+			t.Errorf("span %s was not ended", span.name)
+		}
+		if span.name == "ledger.TransferCredits" && span.attrs["code"] == "insufficient_balance" && span.err == nil {
+			t.Errorf("failed transfer span has no error")
+		}
+	}
+	if names["ledger.TransferCredits"] != 3 || names["ledger.InquireBalance"] != 1 || names["dynamodb.TransactWriteItems"] != 2 {
+		t.Errorf("spans = %v", names)
+	}
+}
+
+type fakeObjectStore struct{ objects map[string]string }
+
+func (f *fakeObjectStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeObjectStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestAnnotations(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0, "carol": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v", err)
+	}
+	id := resp.Data.TransactionID
+	note := "dinner"
+
+	if _, err := ledger.AnnotateTransaction(ctx, db, "nil", "carol", id, ledger.AnnotationUpdate{Note: &note}); err == nil {
+		t.Errorf("AnnotateTransaction() by a stranger should fail")
+	}
+	if _, err := ledger.AnnotateTransaction(ctx, db, "nil", "alice", id, ledger.AnnotationUpdate{Note: &note, Tags: []string{"🍕"}}); err != nil {
+		t.Fatalf("AnnotateTransaction() error = %v", err)
+	}
+	store := &fakeObjectStore{objects: map[string]string{}}
+	receipt, err := ledger.AttachReceipt(ctx, db, store, "nil", "alice", id, "image/png", []byte("png"))
+	if err != nil {
+		t.Fatalf("AttachReceipt() error = %v", err)
+	}
+	if store.objects[receipt.Key] != "png" {
+		t.Errorf("receipt not uploaded under %s", receipt.Key)
+	}
+	if _, err := ledger.AttachReceipt(ctx, db, store, "nil", "alice", id, "text/html", []byte("<p>")); err == nil {
+		t.Errorf("AttachReceipt() with an unsupported type should fail")
+	}
+
+	history, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Limit: 10})
+	if err != nil || len(history) != 1 {
+		t.Fatalf("GetAllNilTransactions() = %v, %v", history, err)
+	}
+	got := history[0].Annotation
+	if got == nil || got.Note != note || len(got.Tags) != 1 || len(got.Receipts) != 1 {
+		t.Errorf("annotation = %+v", got)
+	}
+
+	if history[0].Amount != 10 {
+		t.Errorf("transaction changed: %+v", history[0])
+	}
+	bobHistory, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "bob", Limit: 10})
+	if err != nil || len(bobHistory) != 1 || bobHistory[0].Annotation != nil {
+		t.Errorf("bob sees alice's annotation: %+v, %v", bobHistory, err)
+	}
+}
+
+// throttlingDB leaves the last item of every BatchWriteItem call, and the
+// last key of every BatchGetItem call, unprocessed until it ran out of
+// throttles.
+type throttlingDB struct {
+	*DB
+	throttles int
+}
+
+func (db *throttlingDB) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	if db.throttles == 0 {
+		return db.DB.BatchWriteItem(ctx, params, optFns...)
+	}
+	db.throttles--
+	unprocessed := map[string][]types.WriteRequest{}
+	written := map[string][]types.WriteRequest{}
+	for table, reqs := range params.RequestItems {
+		written[table] = reqs[:len(reqs)-1]
+		unprocessed[table] = reqs[len(reqs)-1:]
+	}
+	if _, err := db.DB.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: written}, optFns...); err != nil {
+		return nil, err
+	}
+	return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+}
+
+func (db *throttlingDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	if db.throttles == 0 {
+		return db.DB.BatchGetItem(ctx, params, optFns...)
+	}
+	db.throttles--
+	unprocessed := map[string]types.KeysAndAttributes{}
+	read := map[string]types.KeysAndAttributes{}
+	for table, req := range params.RequestItems {
+		keys := req.Keys
+		req.Keys = keys[:len(keys)-1]
+		read[table] = req
+		req.Keys = keys[len(keys)-1:]
+		unprocessed[table] = req
+	}
+	out, err := db.DB.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: read}, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	out.UnprocessedKeys = unprocessed
+	return out, nil
+}
+
+func TestCreateAccountsBatch(t *testing.T) {
+	backoff := ledger.BatchWriteBackoff
+	ledger.BatchWriteBackoff = time.Millisecond
+	t.Cleanup(func() { ledger.BatchWriteBackoff = backoff })
+
+	ctx := context.Background()
+	db := &throttlingDB{DB: NewDB(), throttles: 3}
+	var users []ledger.User
+	for i := 0; i < 60; i++ {
+		users = append(users, ledger.User{AccountID: fmt.Sprintf("acc-%02d", i), Amount: float64(i)})
+	}
+	users = append(users, ledger.User{AccountID: "acc-07"}, ledger.User{})
+
+	results, err := ledger.CreateAccountsBatch(ctx, db, "", users)
+	if err == nil || !strings.Contains(err.Error(), "2 of 62") {
+		t.Errorf("CreateAccountsBatch() error = %v, want 2 of 62 failed", err)
+	}
+	if len(results) != len(users) {
+		t.Fatalf("got %d results, want %d", len(results), len(users))
+	}
+	for i, result := range results[:60] {
+		if result.AccountID != users[i].AccountID || result.Err != nil {
+			t.Errorf("results[%d] = %+v", i, result)
+		}
+	}
+	if !errors.Is(results[60].Err, ledger.ErrDuplicateAccount) {
+		t.Errorf("duplicate result error = %v", results[60].Err)
+	}
+	if results[61].Err == nil {
+		t.Error("empty account id was accepted")
+	}
+	if n := len(db.Items(ledger.NilUsers)); n != 60 {
+		t.Errorf("stored %d accounts, want 60", n)
+	}
+	balance, err := ledger.InquireBalance(ctx, db, "nil", "acc-59")
+	if err != nil || balance != 59 {
+		t.Errorf("InquireBalance() = %v, %v, want 59", balance, err)
+	}
+
+	db.throttles = 100
+	results, err = ledger.CreateAccountsBatch(ctx, db, "nil", []ledger.User{{AccountID: "a"}, {AccountID: "b"}})
+	if err == nil || results[0].Err != nil || results[1].Err == nil {
+		t.Errorf("exhausted retries: results = %+v, error = %v", results, err)
+	}
+}
+
+func TestProcessScheduledReports(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	for _, amount := range []float64{30, 500} {
+		ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: amount})
+	}
+
+	var posted []byte
+	var signature string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(ledger.ReportSignatureHeader)
+	}))
+	defer server.Close()
+	emails := map[string]string{}
+	delivery := &ledger.ReportDelivery{
+		Email: func(ctx context.Context, to, subject, body string) error {
+			emails[to] = subject + "\n" + body
+			return nil
+		},
+		HTTPClient: server.Client(),
+	}
+
+	due := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	subs := []ledger.ReportSubscription{
+		{Report: ledger.ReportSettlementSummary, Schedule: ledger.ReportDaily, Channel: ledger.ReportByEmail, Destination: "finance@nil.sd"},
+		{Report: ledger.ReportFailedDigest, Schedule: ledger.ReportDaily, Channel: ledger.ReportToWebhook, Destination: server.URL, Secret: "s3cret"},
+		{Report: ledger.ReportFloat, Schedule: ledger.ReportDaily, Channel: ledger.ReportToS3},
+	}
+	for _, sub := range subs {
+		sub.NextRunAt = due.Unix()
+		if _, err := ledger.PutReportSubscription(ctx, db, sub); err != nil {
+			t.Fatalf("PutReportSubscription() error = %v", err)
+		}
+	}
+
+	if err := ledger.ProcessScheduledReports(ctx, db, delivery, due.Add(-time.Minute)); err != nil || len(emails) != 0 {
+		t.Fatalf("before due: error = %v, emails = %v", err, emails)
+	}
+	err := ledger.ProcessScheduledReports(ctx, db, delivery, due)
+	if err == nil || !strings.Contains(err.Error(), "s3 delivery is not configured") {
+		t.Errorf("ProcessScheduledReports() error = %v, want the s3 failure", err)
+	}
+
+	if body := emails["finance@nil.sd"]; !strings.Contains(body, "Completed transactions: 1\nVolume: 30.00") || !strings.Contains(body, "Failed transactions: 1") {
+		t.Errorf("settlement email = %q", body)
+	}
+	var digest ledger.Report
+	if err := json.Unmarshal(posted, &digest); err != nil || digest.Failed == nil || digest.Failed.Count != 1 || digest.Failed.Transactions[0].Amount != 500 {
+		t.Errorf("webhook report = %s, error = %v", posted, err)
+	}
+	if signature == "" {
+		t.Error("webhook was not signed")
+	}
+
+	stored, err := ledger.ListReportSubscriptions(ctx, db, "nil")
+	if err != nil || len(stored) != 3 {
+		t.Fatalf("ListReportSubscriptions() = %v, %v", stored, err)
+	}
+	for _, sub := range stored {
+		if sub.LastRunAt != due.Unix() || sub.NextRunAt != due.Add(24*time.Hour).Unix() {
+			t.Errorf("%s: last run %d, next run %d", sub.Report, sub.LastRunAt, sub.NextRunAt)
+		}
+		if failed := sub.Channel == ledger.ReportToS3; failed != (sub.LastError != "") {
+			t.Errorf("%s: LastError = %q", sub.Report, sub.LastError)
+		}
+	}
+
+	// Already sent for this period.
+	emails = map[string]string{}
+	if err := ledger.ProcessScheduledReports(ctx, db, delivery, due); err != nil || len(emails) != 0 {
+		t.Errorf("second run: error = %v, emails = %v", err, emails)
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for _, b := range []ledger.AnomalyBaseline{
+		{TenantID: "nil", Key: "all#count", Mean: 1, Samples: 100},
+		{TenantID: "nil", Key: "corridor:international#count", Mean: 50, Samples: 100},
+	} {
+		item, _ := attributevalue.MarshalMap(b)
+		db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.AnomalyBaselinesTable), Item: item})
+	}
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 1})
+	}
+
+	var alerts []ledger.Anomaly
+	alerter := ledger.DefaultAnomalyAlerter
+	ledger.DefaultAnomalyAlerter = func(ctx context.Context, a ledger.Anomaly) error {
+		alerts = append(alerts, a)
+		return nil
+	}
+	t.Cleanup(func() { ledger.DefaultAnomalyAlerter = alerter })
+
+	end := time.Now().Add(time.Minute)
+	anomalies, err := ledger.DetectAnomalies(ctx, db, "nil", end, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("DetectAnomalies() error = %v", err)
+	}
+	got := map[string]string{}
+	for _, a := range anomalies {
+		got[a.Segment+"#"+a.Metric] = a.Kind
+	}
+	want := map[string]string{"all#count": ledger.AnomalySpike, "corridor:international#count": ledger.AnomalyDrop}
+	if len(got) != len(want) || got["all#count"] != want["all#count"] || got["corridor:international#count"] != want["corridor:international#count"] {
+		t.Errorf("anomalies = %v, want %v", got, want)
+	}
+	if len(alerts) != len(anomalies) {
+		t.Errorf("%d alerts for %d anomalies", len(alerts), len(anomalies))
+	}
+	stored, err := ledger.ListAnomalies(ctx, db, "nil", end.Add(-time.Minute))
+	if err != nil || len(stored) != len(anomalies) {
+		t.Errorf("ListAnomalies() = %d anomalies, %v", len(stored), err)
+	}
+
+	// The window was learned: rerunning it finds nothing new, and the new
+	// segments now have a baseline.
+	again, err := ledger.DetectAnomalies(ctx, db, "nil", end, time.Hour, nil)
+	if err != nil || len(again) != 0 {
+		t.Errorf("rerun = %v, %v, want no anomalies", again, err)
+	}
+	if n := len(db.Items(ledger.AnomalyBaselinesTable)); n < 6 {
+		t.Errorf("%d baselines stored, want the window's segments learned", n)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	l := newLedger(db, ledger.WithAuditLog())
+	admin := ledger.WithActor(ctx, "admin-7")
+
+	if err := ledger.CreateAccountWithBalance(admin, l, "nil", "alice", 100); err != nil {
+		t.Fatalf("CreateAccountWithBalance() error = %v", err)
+	}
+	if err := ledger.CreateAccount(admin, l, "nil", ledger.User{AccountID: "bob", Password: "hunter2"}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	res, err := ledger.TransferCredits(ledger.WithActor(ctx, "alice"), l, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 30})
+	if err != nil {
+		t.Fatalf("TransferCredits() error = %v", err)
+	}
+	txID := res.Data.TransactionID
+	if _, err := ledger.UpdateTransaction(admin, l, "nil", txID, 0, map[string]interface{}{"Comment": "rent"}); err != nil {
+		t.Fatalf("UpdateTransaction() error = %v", err)
+	}
+	if _, err := ledger.UpdateTransaction(admin, l, "nil", txID, 0, map[string]interface{}{"Comment": "stale"}); !errors.Is(err, ledger.ErrVersionConflict) {
+		t.Fatalf("stale UpdateTransaction() error = %v", err)
+	}
+	if _, err := ledger.TransitionStatus(ctx, l, "nil", txID, ledger.TransactionReversed, "compliance-2", "chargeback"); err != nil {
+		t.Fatalf("TransitionStatus() error = %v", err)
+	}
+
+	entries, next, err := ledger.QueryAuditLog(ctx, db, "nil", ledger.AuditQuery{})
+	if err != nil || next != "" {
+		t.Fatalf("QueryAuditLog() next = %q, error = %v", next, err)
+	}
+	var ops []string
+	for _, e := range entries {
+		ops = append(ops, e.Operation+"/"+e.Actor)
+		if strings.Contains(e.Before+e.After, "hunter2") {
+			t.Errorf("%s snapshot leaks the password", e.Operation)
+		}
+	}
+	want := []string{
+		"CreateAccount/admin-7", "CreateAccount/admin-7", "TransferCredits/alice",
+		"UpdateTransaction/admin-7", "UpdateTransaction/admin-7", "TransitionStatus/compliance-2",
+	}
+	if strings.Join(ops, " ") != strings.Join(want, " ") {
+		t.Errorf("audited %v, want %v", ops, want)
+	}
+	transfer := entries[2]
+	if !strings.Contains(transfer.Before, `"alice":100`) || !strings.Contains(transfer.After, `"alice":70`) || !strings.Contains(transfer.After, txID) {
+		t.Errorf("transfer snapshots before %s after %s", transfer.Before, transfer.After)
+	}
+	if entries[4].Error == "" || entries[4].After != "" {
+		t.Errorf("failed update recorded as %+v", entries[4])
+	}
+	if !strings.Contains(entries[5].After, `"status":3`) {
+		t.Errorf("status change after = %s", entries[5].After)
+	}
+
+	byActor, _, err := ledger.QueryAuditLog(ctx, db, "nil", ledger.AuditQuery{Actor: "admin-7", Operation: ledger.AuditUpdateTransaction})
+	if err != nil || len(byActor) != 2 {
+		t.Errorf("filtered QueryAuditLog() = %d entries, %v", len(byActor), err)
+	}
+	page, next, err := ledger.QueryAuditLog(ctx, db, "nil", ledger.AuditQuery{Limit: 4})
+	if err != nil || len(page) != 4 || next == "" {
+		t.Fatalf("first page = %d entries, next %q, %v", len(page), next, err)
+	}
+	page, _, err = ledger.QueryAuditLog(ctx, db, "nil", ledger.AuditQuery{Limit: 4, Cursor: next})
+	if err != nil || len(page) != 2 || page[0].EntryID != entries[4].EntryID {
+		t.Errorf("second page = %d entries, %v", len(page), err)
+	}
+
+	// Plain clients are not audited.
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 0)
+	if n := len(db.Items(ledger.AuditLogTable)); n != len(entries) {
+		t.Errorf("%d entries after an unaudited call, want %d", n, len(entries))
+	}
+}
+
+func TestTransferSignature(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	sign := func(uuid string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(uuid)))
+	}
+
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	transfer := func(uuid, signed string) (ledger.NilResponse, error) {
+		return ledger.TransferCredits(ctx, db, ledger.TransactionEntry{
+			TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10,
+			InitiatorUUID: uuid, SignedUUID: signed,
+		})
+	}
+
+	// Tenants without keys are not checked.
+	if _, err := transfer("u-0", ""); err != nil {
+		t.Fatalf("unsigned transfer without keys: %v", err)
+	}
+	if err := ledger.RegisterTenantPublicKey(ctx, db, "nil", "k1", "garbage"); err == nil {
+		t.Error("RegisterTenantPublicKey(garbage) succeeded")
+	}
+	if err := ledger.RegisterTenantPublicKey(ctx, db, "nil", "k1", pemKey); err != nil {
+		t.Fatalf("RegisterTenantPublicKey() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name, uuid, signed string
+	}{
+		{"unsigned", "u-1", ""},
+		{"signature of another uuid", "u-2", sign("u-3")},
+		{"garbage signature", "u-4", "bm9wZQ=="},
+	} {
+		res, err := transfer(tt.uuid, tt.signed)
+		if !errors.Is(err, ledger.ErrSignatureInvalid) || res.Code != "signature_invalid" {
+			t.Errorf("%s: code %q, error %v", tt.name, res.Code, err)
+		}
+	}
+	if res, err := transfer("u-5", sign("u-5")); err != nil || res.Status != "success" {
+		t.Fatalf("signed transfer: %+v, %v", res, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 80 {
+		t.Errorf("alice balance = %v, want 80", balance)
+	}
+
+	if err := ledger.RevokeTenantPublicKey(ctx, db, "nil", "k1"); err != nil {
+		t.Fatalf("RevokeTenantPublicKey() error = %v", err)
+	}
+	if keys, err := ledger.GetTenantPublicKeys(ctx, db, "nil"); err != nil || len(keys) != 0 {
+		t.Errorf("keys after revoke = %v, %v", keys, err)
+	}
+}
+
+// failingDB fails every PutItem while fail is set, as DynamoDB does when it
+// throttles.
+type failingDB struct {
+	*DB
+	fail bool
+}
+
+func (db *failingDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if db.fail {
+		return nil, errors.New("ProvisionedThroughputExceededException")
+	}
+	return db.DB.PutItem(ctx, params, optFns...)
+}
+
+func TestDegradedMode(t *testing.T) {
+	ctx := context.Background()
+	db := &failingDB{DB: NewDB()}
+	l := newLedger(db,
+		ledger.WithDegradation(ledger.DegradationPolicy{MaxWriteErrorRate: 0.5, MinWrites: 4, Window: time.Minute, MinDuration: time.Minute}))
+
+	ledger.CreateAccountWithBalance(ctx, l, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, l, "nil", "bob", 0)
+	if res, err := ledger.TransferCredits(ctx, l, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil || res.Mode != "" {
+		t.Fatalf("normal transfer: mode %q, error %v", res.Mode, err)
+	}
+
+	db.fail = true
+	for i := 0; i < 8; i++ {
+		ledger.CreateAccount(ctx, l, "nil", ledger.User{AccountID: fmt.Sprintf("acc-%d", i)})
+	}
+	if mode := l.Mode(); mode != ledger.ModeDegraded {
+		t.Fatalf("Mode() = %s after failing writes, want degraded", mode)
+	}
+	db.fail = false
+
+	res, err := ledger.TransferCredits(ctx, l, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil || res.Status != "success" || res.Mode != ledger.ModeDegraded {
+		t.Fatalf("degraded transfer: %+v, %v", res, err)
+	}
+	if _, err := ledger.DetectAnomalies(ctx, l, "nil", time.Now(), time.Hour, nil); !errors.Is(err, ledger.ErrDegraded) {
+		t.Errorf("DetectAnomalies() error = %v, want ErrDegraded", err)
+	}
+	if err := ledger.ProcessScheduledReports(ctx, l, nil, time.Now()); !errors.Is(err, ledger.ErrDegraded) {
+		t.Errorf("ProcessScheduledReports() error = %v, want ErrDegraded", err)
+	}
+	sub := ledger.ReportSubscription{AdminID: "admin-1", Report: ledger.ReportSettlementSummary, Schedule: ledger.ReportDaily, Channel: ledger.ReportByEmail, Destination: "ops@example.com"}
+	if _, err := ledger.PutReportSubscription(ctx, l, sub); !errors.Is(err, ledger.ErrDegraded) {
+		t.Errorf("PutReportSubscription() error = %v, want ErrDegraded", err)
+	}
+
+	var ran []string
+	work := func(name string) func(context.Context) error {
+		return func(context.Context) error { ran = append(ran, name); return nil }
+	}
+	ledger.Defer(ctx, l, "a", work("a"))
+	ledger.Defer(ctx, l, "b", work("b"))
+	if len(ran) != 0 || l.Deferred() != 2 {
+		t.Fatalf("ran %v with %d deferred, want 2 deferred", ran, l.Deferred())
+	}
+	if err := l.RunDeferred(ctx); err != nil || len(ran) != 0 {
+		t.Fatalf("RunDeferred() while degraded ran %v, %v", ran, err)
+	}
+
+	l.ForceMode(ctx, ledger.ModeNormal)
+	if err := l.RunDeferred(ctx); err != nil || strings.Join(ran, ",") != "a,b" || l.Deferred() != 0 {
+		t.Errorf("RunDeferred() ran %v, %d left, %v", ran, l.Deferred(), err)
+	}
+	ledger.Defer(ctx, l, "c", work("c"))
+	if strings.Join(ran, ",") != "a,b,c" {
+		t.Errorf("Defer() in normal mode did not run at once: %v", ran)
+	}
+}
+
+func TestSnapshotsStatementAndReconcile(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	day1 := time.Now().UTC().Truncate(24 * time.Hour).Add(-72 * time.Hour)
+	day2, day3 := day1.Add(24*time.Hour), day1.Add(48*time.Hour)
+
+	completed := ledger.TransactionCompleted
+	for i, tx := range []ledger.TransactionEntry{
+		{FromAccount: "alice", ToAccount: "bob", Amount: 10, TransactionDate: day1.Add(10 * time.Hour).Unix()},
+		{FromAccount: "bob", ToAccount: "alice", Amount: 5, TransactionDate: day2.Add(10 * time.Hour).Unix()},
+		{FromAccount: "alice", ToAccount: "bob", Amount: 20, TransactionDate: day3.Add(10 * time.Hour).Unix()},
+	} {
+		tx.TenantID, tx.SystemTransactionID, tx.Status = "nil", fmt.Sprintf("tx-%d", i), &completed
+		item, err := attributevalue.MarshalMap(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.TransactionsTable), Item: item})
+	}
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 75)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 25)
+
+	// No snapshot yet: the opening balance is rewound from the current one.
+	statement, err := ledger.GetStatement(ctx, db, "nil", "alice", day1, day2)
+	if err != nil || statement.OpeningBalance != 100 || statement.ClosingBalance != 90 || len(statement.Transactions) != 1 {
+		t.Fatalf("GetStatement(day1) = %+v, %v", statement, err)
+	}
+
+	if n, err := ledger.CloseAccountingDay(ctx, db, "nil", day1); err != nil || n != 2 {
+		t.Fatalf("CloseAccountingDay() = %d, %v", n, err)
+	}
+	if n, err := ledger.CloseAccountingDay(ctx, db, "nil", day1.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("rerun of CloseAccountingDay() = %d, %v", n, err)
+	}
+	if _, err := ledger.CloseAccountingDay(ctx, db, "nil", time.Now()); err == nil {
+		t.Error("CloseAccountingDay(today) succeeded")
+	}
+	snapshot, err := ledger.GetSnapshot(ctx, db, "nil", "bob", day3)
+	if err != nil || snapshot == nil || snapshot.Day != day1.Format("2006-01-02") || snapshot.Balance != 10 {
+		t.Fatalf("GetSnapshot() = %+v, %v", snapshot, err)
+	}
+	if snapshot, _ := ledger.GetSnapshot(ctx, db, "nil", "bob", day2.Add(-time.Second)); snapshot != nil {
+		t.Errorf("GetSnapshot() before the day closed = %+v", snapshot)
+	}
+
+	statement, err = ledger.GetStatement(ctx, db, "nil", "alice", day2, day3)
+	if err != nil || statement.OpeningBalance != 90 || statement.ClosingBalance != 95 || len(statement.Transactions) != 1 {
+		t.Errorf("GetStatement(day2) = %+v, %v", statement, err)
+	}
+	// The snapshot is moved forward over day2 to open day3.
+	statement, err = ledger.GetStatement(ctx, db, "nil", "alice", day3, time.Now())
+	if err != nil || statement.OpeningBalance != 95 || statement.ClosingBalance != 75 {
+		t.Errorf("GetStatement(day3) = %+v, %v", statement, err)
+	}
+
+	r, err := ledger.Reconcile(ctx, db, "nil", "alice")
+	if err != nil || !r.Balanced() || r.SnapshotDay != snapshot.Day || r.Expected != 75 {
+		t.Errorf("Reconcile() = %+v, %v", r, err)
+	}
+	db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ledger.NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+			"AccountID": &types.AttributeValueMemberS{Value: "alice"},
+		},
+		UpdateExpression:          aws.String("SET amount = :amount"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":amount": &types.AttributeValueMemberN{Value: "80"}},
+	})
+	if r, err := ledger.Reconcile(ctx, db, "nil", "alice"); err != nil || r.Balanced() || r.Difference != 5 {
+		t.Errorf("Reconcile() of a tampered account = %+v, %v", r, err)
+	}
+}
+
+// queryLogDB records the index of every query.
+type queryLogDB struct {
+	*DB
+	indexes []string
+}
+
+func (db *queryLogDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	db.indexes = append(db.indexes, aws.ToString(params.IndexName))
+	return db.DB.Query(ctx, params, optFns...)
+}
+
+func TestGetTransactionsBetween(t *testing.T) {
+	ctx := context.Background()
+	db := &queryLogDB{DB: NewDB()}
+	for _, account := range []string{"alice", "bob", "carol"} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, 100)
+	}
+	for _, tr := range []struct {
+		from, to string
+		amount   float64
+	}{
+		{"alice", "bob", 10}, {"bob", "alice", 5}, {"alice", "carol", 7}, {"carol", "bob", 3},
+	} {
+		if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: tr.from, FromAccount: tr.from, ToAccount: tr.to, Amount: tr.amount}); err != nil {
+			t.Fatalf("TransferCredits(%s -> %s) error = %v", tr.from, tr.to, err)
+		}
+	}
+
+	db.indexes = nil
+	between, err := ledger.GetTransactionsBetween(ctx, db, "nil", "alice", "bob", ledger.TransactionFilter{})
+	if err != nil || len(between) != 2 {
+		t.Fatalf("GetTransactionsBetween() = %d transactions, %v", len(between), err)
+	}
+	for _, index := range db.indexes {
+		if index != "FromAccountIndex" && index != "ToAccountIndex" {
+			t.Errorf("GetTransactionsBetween() queried index %q", index)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter ledger.TransactionFilter
+		want   int
+	}{
+		{"sent", ledger.TransactionFilter{AccountID: "alice", Direction: ledger.DirectionSent}, 2},
+		{"received", ledger.TransactionFilter{AccountID: "alice", Direction: ledger.DirectionReceived}, 1},
+		{"sent to counterparty", ledger.TransactionFilter{AccountID: "alice", Direction: ledger.DirectionSent, Counterparty: "carol"}, 1},
+		{"counterparty", ledger.TransactionFilter{AccountID: "bob", Counterparty: "carol"}, 1},
+		{"counterparty with limit", ledger.TransactionFilter{AccountID: "bob", Counterparty: "alice", Limit: 1}, 1},
+		{"no counterparty", ledger.TransactionFilter{AccountID: "carol", Counterparty: "nobody"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", tt.filter)
+			if err != nil || len(got) != tt.want {
+				t.Errorf("GetAllNilTransactions() = %d transactions, %v, want %d", len(got), err, tt.want)
+			}
+		})
+	}
+	if _, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Direction: "sideways"}); err == nil {
+		t.Error("unknown direction accepted")
+	}
+}
+
+// deniedDB refuses puts to one table, as DynamoDB does when the role lacks
+// dynamodb:PutItem on it.
+type deniedDB struct {
+	*DB
+	table string
+}
+
+func (db *deniedDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if aws.ToString(params.TableName) == db.table {
+		return nil, errors.New("AccessDeniedException: not authorized to perform dynamodb:PutItem")
+	}
+	return db.DB.PutItem(ctx, params, optFns...)
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	if err := ledger.NewLedger(db).Validate(ctx, "nil"); err != nil {
+		t.Fatalf("Validate() of a complete setup = %v", err)
+	}
+	for _, schema := range Schemas() {
+		if n := len(db.Items(schema.Name)); n != 0 {
+			t.Errorf("Validate() left %d items in %s", n, schema.Name)
+		}
+	}
+
+	db.mu.Lock()
+	delete(db.tables, ledger.LedgerTable)
+	delete(db.tables, ledger.AnomaliesTable)
+	db.mu.Unlock()
+	db.CreateTable(TableSchema{Name: ledger.TransactionsTable, HashKey: "TenantID", RangeKey: "TransactionID", Indexes: []IndexSchema{
+		{Name: "FromAccountIndex", HashKey: "FromAccount"},
+	}})
+	db.CreateTable(TableSchema{Name: ledger.AccountEventsTable, HashKey: "StreamID", RangeKey: "EventID"})
+	db.CreateTable(TableSchema{Name: ledger.TenantKeysTable, HashKey: "TenantID"})
+	cfg, _ := attributevalue.MarshalMap(ledger.TenantConfig{TenantID: "nil", FeeSchedule: &ledger.FeeSchedule{Type: ledger.FeeFlat, Flat: 1, CollectionAccount: "fees"}})
+	db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.TenantConfigTable), Item: cfg})
+
+	err := ledger.NewLedger(&deniedDB{DB: db, table: ledger.AuditLogTable}, ledger.WithAuditLog()).Validate(ctx, "nil")
+	if err == nil {
+		t.Fatal("Validate() of a broken setup succeeded")
+	}
+	for _, want := range []string{
+		"table LedgerTable does not exist; create it with hash key TenantID and range key TransactionID",
+		"index FromAccountIndex of table TransactionsTable has hash key FromAccount and no range key, want hash key TenantID and range key FromAccount",
+		"table TransactionsTable has no index ToAccountIndex",
+		"table AccountEvents does not expire items; enable TTL on attribute ExpiresAt",
+		"table TenantKeys has hash key TenantID and no range key",
+		"cannot write table AuditLog; grant dynamodb:PutItem",
+		"tenant nil: collection account fees: account not found",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error lacks %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), ledger.AnomaliesTable) {
+		t.Errorf("Validate() reported the optional table %s", ledger.AnomaliesTable)
+	}
+}
+
+func TestTransactionsIterator(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 1000)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	for i := 0; i < 23; i++ {
+		if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := ledger.NewTransactionsIterator(db, "nil", ledger.TransactionFilter{Limit: 5})
+	seen := map[string]bool{}
+	for it.Next(ctx) {
+		seen[it.Transaction().SystemTransactionID] = true
+	}
+	if err := it.Err(); err != nil || len(seen) != 23 {
+		t.Errorf("iterated %d distinct transactions, error %v, want 23", len(seen), err)
+	}
+	if it.Next(ctx) {
+		t.Error("Next() after the end = true")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	it = ledger.NewTransactionsIterator(db, "nil", ledger.TransactionFilter{})
+	if it.Next(canceled) || !errors.Is(it.Err(), context.Canceled) {
+		t.Errorf("Next() with a canceled context: error %v", it.Err())
+	}
+}
+
+// flakyDB fails GetItem and UpdateItem calls with the errors queued for
+// them, one per call, before serving them.
+type flakyDB struct {
+	*DB
+	errs map[string][]error
+}
+
+func (db *flakyDB) next(op string) error {
+	if len(db.errs[op]) == 0 {
+		return nil
+	}
+	err := db.errs[op][0]
+	db.errs[op] = db.errs[op][1:]
+	return err
+}
+
+func (db *flakyDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if err := db.next("GetItem"); err != nil {
+		return nil, err
+	}
+	return db.DB.GetItem(ctx, params, optFns...)
+}
+
+func (db *flakyDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if err := db.next("UpdateItem"); err != nil {
+		return nil, err
+	}
+	return db.DB.UpdateItem(ctx, params, optFns...)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	db := &flakyDB{DB: NewDB(), errs: map[string][]error{}}
+	metrics := &recordingMetrics{values: map[string]float64{}}
+	l := newLedger(db,
+		ledger.WithRetry(ledger.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}),
+		ledger.WithMetrics(metrics))
+	ledger.CreateAccountWithBalance(ctx, l, "nil", "alice", 100)
+
+	throttled := &types.ProvisionedThroughputExceededException{Message: aws.String("throttled")}
+	db.errs["GetItem"] = []error{throttled, throttled}
+	if balance, err := ledger.InquireBalance(ctx, l, "nil", "alice"); err != nil || balance != 100 {
+		t.Fatalf("InquireBalance() after 2 throttles = %v, %v", balance, err)
+	}
+	if got := metrics.values[ledger.MetricDynamoDBRetries]; got != 2 {
+		t.Errorf("%s = %v, want 2", ledger.MetricDynamoDBRetries, got)
+	}
+
+	db.errs["GetItem"] = []error{throttled, throttled, throttled}
+	if _, err := ledger.InquireBalance(ctx, l, "nil", "alice"); err == nil {
+		t.Error("InquireBalance() succeeded after MaxAttempts throttles")
+	}
+
+	key := map[string]types.AttributeValue{
+		"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+		"AccountID": &types.AttributeValueMemberS{Value: "alice"},
+	}
+	internal := &types.InternalServerError{Message: aws.String("internal error")}
+	update := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ledger.NilUsers),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET amount = amount + :d"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":d": &types.AttributeValueMemberN{Value: "1"}},
+	}
+	db.errs["UpdateItem"] = []error{internal}
+	if _, err := l.UpdateItem(ctx, update); !errors.As(err, &internal) {
+		t.Errorf("unconditional UpdateItem() error = %v, want the internal error unretried", err)
+	}
+
+	update.ConditionExpression = aws.String("attribute_exists(AccountID)")
+	db.errs["UpdateItem"] = []error{internal}
+	if _, err := l.UpdateItem(ctx, update); err != nil {
+		t.Errorf("conditional UpdateItem() error = %v, want it retried", err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, l, "nil", "alice"); balance != 101 {
+		t.Errorf("balance = %v after one applied update, want 101", balance)
+	}
+}
+
+func TestTransferRequest(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30})
+	if err != nil || res.Status != "success" {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", res.Data.TransactionID)
+	if err != nil || tx.AccountID != "alice" || tx.FromAccount != "alice" || tx.ToAccount != "bob" || *tx.Status != ledger.TransactionCompleted {
+		t.Errorf("stored transaction = %+v, %v", tx, err)
+	}
+
+	// The sender's balance would be checked on bob while alice is debited.
+	if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{AccountID: "bob", FromAccount: "alice", ToAccount: "bob", Amount: 10}); err == nil {
+		t.Error("TransferCredits() with AccountID and FromAccount differing succeeded")
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 70 {
+		t.Errorf("alice's balance = %v, want 70", balance)
+	}
+}
+
+func TestTransferNarratives(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+
+	for _, narrative := range []string{"Rent\nfor MAY\x00", "Groceries", ""} {
+		if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1, Narrative: narrative}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1, Narrative: strings.Repeat("a", ledger.MaxNarrativeLength+1)})
+	if !errors.Is(err, ledger.ErrInvalidNarrative) || res.Code != "invalid_narrative" {
+		t.Errorf("Transfer() with a long narrative = %s, %v", res.Code, err)
+	}
+
+	found, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Search: "rent for may"})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("search found %d transactions, error %v, want 1", len(found), err)
+	}
+	tx := found[0]
+	if tx.Narrative != "Rent for MAY" || tx.Comment != ledger.NarrativeTransfer {
+		t.Errorf("narrative %q, comment %q", tx.Narrative, tx.Comment)
+	}
+
+	version := tx.Version
+	if _, err := ledger.UpdateTransaction(ctx, db, "nil", tx.SystemTransactionID, version, map[string]interface{}{"Narrative": "Deposit\tJune"}); err != nil {
+		t.Fatal(err)
+	}
+	found, _, err = ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Search: "deposit june"})
+	if err != nil || len(found) != 1 || found[0].Narrative != "Deposit June" {
+		t.Errorf("search after update = %+v, %v", found, err)
+	}
+}
+
+func TestOverdraftAndMinimumBalance(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 50)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 50)
+
+	if err := ledger.SetOverdraftLimit(ctx, db, "nil", "nobody", 10); err == nil {
+		t.Error("SetOverdraftLimit() on a missing account succeeded")
+	}
+	if err := ledger.SetOverdraftLimit(ctx, db, "nil", "alice", 100); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 120})
+	if err != nil {
+		t.Fatalf("overdrawing transfer: %+v, %v", res, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != -70 {
+		t.Errorf("alice's balance = %v, want -70", balance)
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", res.Data.TransactionID)
+	if err != nil || !tx.Legs[0].Overdraft || tx.Legs[1].Overdraft {
+		t.Errorf("legs = %+v, %v, want only the debit flagged as overdraft", tx.Legs, err)
+	}
+	if res, _ := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 40}); res.Code != "insufficient_balance" {
+		t.Errorf("transfer beyond the overdraft limit: code %s", res.Code)
+	}
+
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", MinimumBalance: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "carol", ToAccount: "bob", Amount: 45}); res.Code != "insufficient_balance" {
+		t.Errorf("transfer below the minimum balance: code %s", res.Code)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "carol", ToAccount: "bob", Amount: 40}); err != nil {
+		t.Errorf("transfer down to the minimum balance: %+v, %v", res, err)
+	}
+}
+
+func TestTransactionMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "shop", 0)
+
+	for i, tags := range [][]string{{"food", " food"}, {"rent"}, nil} {
+		req := ledger.TransferRequest{FromAccount: "alice", ToAccount: "shop", Amount: 1, Tags: tags,
+			Metadata: map[string]string{"order_id": fmt.Sprintf("ord-%d", i), "channel": "web"}}
+		if res, err := ledger.Transfer(ctx, db, req); err != nil {
+			t.Fatalf("Transfer() = %+v, %v", res, err)
+		}
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "shop", Amount: 1, Metadata: map[string]string{"": "x"}}); !errors.Is(err, ledger.ErrInvalidMetadata) || res.Code != "invalid_metadata" {
+		t.Errorf("Transfer() with an empty metadata key = %s, %v", res.Code, err)
+	}
+
+	found, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Tag: "food"})
+	if err != nil || len(found) != 1 || !slices.Equal(found[0].Tags, []string{"food"}) || found[0].Metadata["order_id"] != "ord-0" {
+		t.Errorf("tag filter = %+v, %v", found, err)
+	}
+	found, _, err = ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Metadata: map[string]string{"order_id": "ord-1", "channel": "web"}})
+	if err != nil || len(found) != 1 || found[0].Tags[0] != "rent" {
+		t.Errorf("metadata filter = %+v, %v", found, err)
+	}
+	found, _, err = ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice", Metadata: map[string]string{"channel": "web"}, Limit: 10})
+	if err != nil || len(found) != 3 {
+		t.Errorf("metadata filter found %d transactions, error %v, want 3", len(found), err)
+	}
+}
+
+// capacityDB reports the capacity consumed by queries when it is requested,
+// as DynamoDB does.
+type capacityDB struct {
+	*DB
+	units float64
+}
+
+func (db *capacityDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	out, err := db.DB.Query(ctx, params, optFns...)
+	if out != nil && params.ReturnConsumedCapacity == types.ReturnConsumedCapacityTotal {
+		out.ConsumedCapacity = &types.ConsumedCapacity{TableName: params.TableName, CapacityUnits: aws.Float64(db.units)}
+	}
+	return out, err
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	raw := &capacityDB{DB: NewDB(), units: 2}
+	db := ledger.NewLedger(raw, ledger.WithLogger(logger), ledger.WithSlowQueryLog(ledger.SlowQueryPolicy{CapacityUnits: 10}))
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 10, Narrative: "rent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := ledger.TransactionFilter{AccountID: "alice", Search: "rent"}
+	if _, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", filter); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "slow dynamodb call") {
+		t.Fatalf("cheap query logged as slow:\n%s", buf.String())
+	}
+
+	raw.units = 25
+	if _, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", filter); err != nil {
+		t.Fatal(err)
+	}
+	var slow []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if record["msg"] == "slow dynamodb call" {
+			slow = append(slow, record)
+		}
+	}
+	if len(slow) == 0 {
+		t.Fatalf("expensive query not logged:\n%s", buf.String())
+	}
+	for _, record := range slow {
+		if record["op"] != "Query" || record["capacity_units"] != 25.0 || record["key_condition"] == "" {
+			t.Errorf("slow query log = %v", record)
+		}
+		if line, _ := json.Marshal(record); strings.Contains(string(line), "alice") || strings.Contains(string(line), "rent") {
+			t.Errorf("slow query log leaks values: %s", line)
+		}
+	}
+}
+
+// fakeSwitch reports the status of escrow transactions by payment reference.
+type fakeSwitch map[string]ledger.SwitchStatus
+
+func (s fakeSwitch) TransactionStatus(ctx context.Context, tx ledger.EscrowTransaction) (ledger.SwitchStatus, error) {
+	status, ok := s[tx.PaymentReference]
+	if !ok {
+		return ledger.SwitchPending, errors.New("unknown payment reference")
+	}
+	return status, nil
+}
+
+func TestReconcileSwitchTransactions(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, ledger.ESCROW_TENANT, ledger.ESCROW_ACCOUNT, 0)
+	for _, ref := range []string{"settled", "failed", "pending", "unknown"} {
+		_, err := ledger.EscrowRequest(ctx, db, ledger.EscrowEntry{FromAccount: "alice", FromTenantID: "nil", ToAccount: "bank-1", ToTenantID: "bank",
+			Amount: 10, InitiatorUUID: "uuid-" + ref, PaymentReference: ref})
+		if err != nil {
+			t.Fatalf("EscrowRequest(%s) error = %v", ref, err)
+		}
+	}
+	sw := fakeSwitch{"settled": ledger.SwitchSettled, "failed": ledger.SwitchFailed, "pending": ledger.SwitchPending}
+
+	if got, err := ledger.ReconcileSwitchTransactions(ctx, db, sw, 10*time.Minute, time.Now()); err != nil || got.Checked != 0 {
+		t.Errorf("reconciled recent transactions: %+v, %v", got, err)
+	}
+	later := time.Now().Add(time.Hour)
+	got, err := ledger.ReconcileSwitchTransactions(ctx, db, sw, 10*time.Minute, later)
+	want := ledger.SwitchReconciliation{Checked: 4, Settled: 1, Failed: 1, Pending: 2, Refunded: 1}
+	if got != want || err == nil {
+		t.Errorf("ReconcileSwitchTransactions() = %+v, %v, want %+v and the unknown reference's error", got, err, want)
+	}
+	for ref, status := range map[string]ledger.Status{"settled": ledger.StatusCompleted, "failed": ledger.StatusFailed, "pending": ledger.StatusInProgress} {
+		resp, err := db.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(ledger.EscrowTransactionsTable),
+			KeyConditionExpression:    aws.String("#uuid = :uuid"),
+			ExpressionAttributeNames:  map[string]string{"#uuid": "UUID"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":uuid": &types.AttributeValueMemberS{Value: "uuid-" + ref}},
+		})
+		var txs []ledger.EscrowTransaction
+		if err == nil {
+			err = attributevalue.UnmarshalListOfMaps(resp.Items, &txs)
+		}
+		if err != nil || len(txs) != 1 || txs[0].Status != status {
+			t.Errorf("escrow transaction %s = %+v, %v, want status %s", ref, txs, err, status)
+		}
+	}
+	if alice, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); alice.Amount != 70 {
+		t.Errorf("alice has %.2f after one refund, want 70", alice.Amount)
+	}
+
+	sw["unknown"] = ledger.SwitchPending
+	sw["pending"] = ledger.SwitchFailed
+	if got, err := ledger.ReconcileSwitchTransactions(ctx, db, sw, 10*time.Minute, later); err != nil || got.Checked != 2 || got.Refunded != 1 {
+		t.Errorf("second run = %+v, %v", got, err)
+	}
+	if alice, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); alice.Amount != 80 {
+		t.Errorf("alice has %.2f after two refunds, want 80", alice.Amount)
+	}
+}
+
+// racingDB posts another transfer just before the first journal it sees, as
+// a concurrent request would.
+type racingDB struct {
+	*DB
+	race func()
+}
+
+func (db *racingDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	if race := db.race; race != nil {
+		db.race = nil
+		race()
+	}
+	return db.DB.TransactWriteItems(ctx, params, optFns...)
+}
+
+func TestTransferReceiverVersion(t *testing.T) {
+	ctx := context.Background()
+	db := &racingDB{DB: NewDB()}
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	// A write that changes bob without posting to his chain, such as a
+	// profile update.
+	version := int64(0)
+	touchBob := func() {
+		version++
+		db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(ledger.NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+				"AccountID": &types.AttributeValueMemberS{Value: "bob"},
+			},
+			UpdateExpression:          aws.String("SET Version = :version"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}},
+		})
+	}
+
+	db.race = touchBob
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil {
+		t.Fatalf("Transfer() racing a write to the receiver = %+v, %v", res, err)
+	}
+	if bob, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "bob"}); bob.Amount != 10 {
+		t.Errorf("bob has %.2f, want 10", bob.Amount)
+	}
+
+	var race func()
+	race = func() { touchBob(); db.race = race }
+	db.race = race
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err == nil || res.Code != "credit_failed" {
+		t.Errorf("Transfer() to a receiver that keeps changing = %+v, %v", res, err)
+	}
+	db.race = nil
+	if alice, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); alice.Amount != 90 {
+		t.Errorf("alice has %.2f after a failed transfer, want 90", alice.Amount)
+	}
+}
+
+func TestTransferIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB(),
+		ledger.WithConflictRetry(ledger.RetryPolicy{MaxAttempts: 50, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}))
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, db, "nil", account)
+		return b
+	}
+
+	req := ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30, InitiatorUUID: "req-1"}
+	first, err := ledger.Transfer(ctx, db, req)
+	if err != nil {
+		t.Fatalf("Transfer() = %+v, %v", first, err)
+	}
+	// A retry is answered as the transfer was, without moving money again.
+	if res, err := ledger.Transfer(ctx, db, req); err != nil || res.Data.TransactionID != first.Data.TransactionID || balance("alice") != 70 || balance("bob") != 30 {
+		t.Errorf("repeated Transfer() = %+v, %v with alice at %.2f, want %s", res, err, balance("alice"), first.Data.TransactionID)
+	}
+	req.Amount = 40
+	if res, err := ledger.Transfer(ctx, db, req); !errors.Is(err, ledger.ErrIdempotencyKeyReused) || res.Code != "idempotency_key_reused" || balance("alice") != 70 {
+		t.Errorf("Transfer() reusing a key = %+v, %v, want ErrIdempotencyKeyReused", res, err)
+	}
+
+	// Of concurrent attempts of one transfer, one is posted and every one is
+	// answered with it.
+	req = ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10, InitiatorUUID: "req-2"}
+	ids := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := ledger.Transfer(ctx, db, req)
+			if err != nil {
+				t.Errorf("concurrent Transfer() = %+v, %v", res, err)
+			}
+			ids[i] = res.Data.TransactionID
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("concurrent Transfer() answered with %q, want one transaction", ids)
+			break
+		}
+	}
+	if balance("alice") != 60 || balance("bob") != 40 {
+		t.Errorf("alice and bob have %.2f and %.2f, want 60 and 40", balance("alice"), balance("bob"))
+	}
+}
+
+func TestConcurrentCreditsToHotAccount(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB(),
+		ledger.WithConflictRetry(ledger.RetryPolicy{MaxAttempts: 50, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}))
+	const senders = 8
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "merchant", 0)
+	for i := 0; i < senders; i++ {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", fmt.Sprintf("buyer%d", i), 10)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from := fmt.Sprintf("buyer%d", i)
+			if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: from, ToAccount: "merchant", Amount: 5}); err != nil {
+				t.Errorf("Transfer(%s) = %+v, %v", from, res, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "merchant"); balance != 5*senders {
+		t.Errorf("merchant has %.2f, want %d", balance, 5*senders)
+	}
+	if report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", "merchant"); err != nil || !report.Valid() || report.Entries != senders {
+		t.Errorf("VerifyLedgerIntegrity() = %+v, %v", report, err)
+	}
+}
+
+func TestVerifyLedgerIntegrity(t *testing.T) {
+	ctx := context.Background()
+	db := &racingDB{DB: NewDB()}
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0, "carol": 50} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount)
+	}
+	var ids []string
+	transfer := func(from, to string, amount float64) {
+		t.Helper()
+		res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: from, ToAccount: to, Amount: amount})
+		if err != nil {
+			t.Fatalf("Transfer(%s -> %s) = %+v, %v", from, to, res, err)
+		}
+		ids = append(ids, res.Data.TransactionID)
+	}
+	transfer("alice", "bob", 10)
+	// carol credits bob between alice's read of bob and her journal, so
+	// alice's journal is posted again on bob's new head.
+	db.race = func() { transfer("carol", "bob", 5) }
+	transfer("alice", "bob", 20)
+	transfer("bob", "alice", 1)
+
+	verify := func(account string) *ledger.IntegrityReport {
+		t.Helper()
+		r, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", account)
+		if err != nil {
+			t.Fatalf("VerifyLedgerIntegrity(%s) error = %v", account, err)
+		}
+		return r
+	}
+	if r := verify("bob"); !r.Valid() || r.Entries != 4 {
+		t.Fatalf("bob's chain = %+v", r)
+	}
+	if bob, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "bob"}); bob.Amount != 34 {
+		t.Errorf("bob has %.2f, want 34", bob.Amount)
+	}
+
+	key := func(id string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: "nil"},
+			"TransactionID": &types.AttributeValueMemberS{Value: id},
+		}
+	}
+	db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ledger.LedgerTable),
+		Key:                       key(ids[0] + "#credit"),
+		UpdateExpression:          aws.String("SET Amount = :amount"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":amount": &types.AttributeValueMemberN{Value: "1000"}},
+	})
+	if r := verify("bob"); len(r.Problems) != 1 || r.Problems[0].Kind != ledger.IntegrityAltered || r.Problems[0].TransactionID != ids[0]+"#credit" {
+		t.Errorf("altered entry: %+v", r)
+	}
+
+	// bob's last entry is the debit of his transfer to alice.
+	db.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(ledger.LedgerTable), Key: key(ids[3] + "#debit")})
+	r := verify("bob")
+	kinds := map[string][]string{}
+	for _, p := range r.Problems {
+		kinds[p.TransactionID] = append(kinds[p.TransactionID], p.Kind)
+	}
+	if !slices.Equal(kinds[""], []string{ledger.IntegrityMissing}) || !slices.Contains(kinds[ids[2]+"#credit"], ledger.IntegrityUnlinked) ||
+		!slices.Equal(kinds[ids[0]+"#credit"], []string{ledger.IntegrityAltered, ledger.IntegrityUnlinked}) {
+		t.Errorf("bob's chain after deleting his latest entry: %+v", r)
+	}
+	if r := verify("carol"); !r.Valid() {
+		t.Errorf("carol's chain = %+v", r)
+	}
+	// Unhashed entries are only tolerated from before carol's chain began.
+	for id, at := range map[string]int64{"legacy": 1, "unhashed": time.Now().Unix() + 60} {
+		item, _ := attributevalue.MarshalMap(ledger.LedgerEntry{TenantID: "nil", AccountID: "carol", SystemTransactionID: id, Type: ledger.LegCredit, Amount: 5, Time: at})
+		db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.LedgerTable), Item: item})
+	}
+	if r := verify("carol"); r.Unchained != 1 || len(r.Problems) != 1 || r.Problems[0].Kind != ledger.IntegrityUnhashed || r.Problems[0].TransactionID != "unhashed" {
+		t.Errorf("carol's chain with unhashed entries = %+v", r)
+	}
+	forged, _ := attributevalue.MarshalMap(ledger.LedgerEntry{TenantID: "nil", AccountID: "alice", SystemTransactionID: "forged#credit", Type: ledger.LegCredit, Amount: 500, Hash: "f00d"})
+	db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.LedgerTable), Item: forged})
+	r = verify("alice")
+	for _, p := range r.Problems {
+		if p.TransactionID != "forged#credit" {
+			t.Errorf("problem with a genuine entry: %+v", p)
+		}
+	}
+	if len(r.Problems) != 2 || r.Problems[1].Kind != ledger.IntegrityUnlinked {
+		t.Errorf("inserted entry: %+v", r)
+	}
+}
+
+// blockingDB holds journals until release is closed, signalling started
+// when the first one arrives.
+type blockingDB struct {
+	*DB
+	started, release chan struct{}
+	once             sync.Once
+}
+
+func (db *blockingDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.once.Do(func() { close(db.started) })
+	<-db.release
+	return db.DB.TransactWriteItems(ctx, params, optFns...)
+}
+
+func TestMaintenance(t *testing.T) {
+	ctx := context.Background()
+	raw := &blockingDB{DB: NewDB(), started: make(chan struct{}), release: make(chan struct{})}
+	close(raw.release)
+	db := newLedger(raw, ledger.WithAuditLog())
+	ledger.CreateAccountWithBalance(ctx, raw.DB, "nil", "alice", 5000)
+	ledger.CreateAccountWithBalance(ctx, raw.DB, "nil", "bob", 0)
+	ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", LargeTransferThreshold: 1000, LargeTransferDelay: 1})
+	held, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 2000})
+	if err != nil || held.Code != "transfer_delayed" {
+		t.Fatalf("Transfer() = %+v, %v", held, err)
+	}
+
+	ops := ledger.WithActor(ctx, "oncall-1")
+	if err := ledger.StartMaintenance(ops, db, "nil", "", time.Time{}); err == nil {
+		t.Error("StartMaintenance() without a reason succeeded")
+	}
+	if err := ledger.StartMaintenance(ops, db, "nil", "migration", time.Now().Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	var maintenance *ledger.MaintenanceError
+	if !errors.As(err, &maintenance) || !errors.Is(err, ledger.ErrMaintenance) || res.Code != "tenant_maintenance" || res.RetryAfter < 590 || res.RetryAfter > 600 {
+		t.Errorf("Transfer() under maintenance = %+v, %v", res, err)
+	}
+	if txs, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", ledger.TransactionFilter{AccountID: "alice"}); err != nil || len(txs) != 0 {
+		t.Errorf("transfers refused for maintenance were recorded: %+v, %v", txs, err)
+	}
+	if balance, err := ledger.InquireBalance(ctx, db, "nil", "alice"); err != nil || balance != 5000 {
+		t.Errorf("InquireBalance() under maintenance = %v, %v", balance, err)
+	}
+	// Changing the config keeps the tenant under maintenance.
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", LargeTransferThreshold: 1000, LargeTransferDelay: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.ProcessDelayedTransfers(ctx, db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ledger.GetDelayedTransfer(ctx, db, "nil", held.Data.TransactionID); got.Status != ledger.DelayedTransferPending {
+		t.Errorf("held transfer released under maintenance: %s", got.Status)
+	}
+
+	if err := ledger.EndMaintenance(ops, db, "nil"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.ProcessDelayedTransfers(ctx, db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ledger.GetDelayedTransfer(ctx, db, "nil", held.Data.TransactionID); got.Status != ledger.DelayedTransferReleased {
+		t.Errorf("held transfer after maintenance: %s", got.Status)
+	}
+
+	// A transfer in flight when maintenance starts is drained, not cut off.
+	raw.started, raw.release, raw.once = make(chan struct{}), make(chan struct{}), sync.Once{}
+	done := make(chan error)
+	go func() {
+		_, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10})
+		done <- err
+	}()
+	<-raw.started
+	drained := make(chan error)
+	go func() { drained <- ledger.StartMaintenance(ops, db, "nil", "incident", time.Time{}) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("StartMaintenance() returned with a transfer in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(raw.release)
+	if err := <-done; err != nil {
+		t.Errorf("transfer in flight failed: %v", err)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("StartMaintenance() error = %v", err)
+	}
+
+	entries, _, err := ledger.QueryAuditLog(ctx, db, "nil", ledger.AuditQuery{})
+	var audited []string
+	for _, e := range entries {
+		if e.Operation == ledger.AuditStartMaintenance || e.Operation == ledger.AuditEndMaintenance {
+			audited = append(audited, e.Operation+":"+e.Actor)
+		}
+	}
+	want := []string{"StartMaintenance:oncall-1", "EndMaintenance:oncall-1", "StartMaintenance:oncall-1"}
+	if err != nil || !slices.Equal(audited, want) {
+		t.Errorf("maintenance audit = %v, %v, want %v", audited, err, want)
+	}
+}
+
+// creatingDB starts empty and creates tables as DynamoDB does.
+type creatingDB struct {
+	*DB
+	created int
+}
+
+func (db *creatingDB) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	schema := TableSchema{Name: aws.ToString(params.TableName)}
+	schema.HashKey, schema.RangeKey = keyNames(params.KeySchema)
+	for _, index := range params.GlobalSecondaryIndexes {
+		hash, rng := keyNames(index.KeySchema)
+		schema.Indexes = append(schema.Indexes, IndexSchema{Name: aws.ToString(index.IndexName), HashKey: hash, RangeKey: rng})
+	}
+	db.DB.CreateTable(schema)
+	db.created++
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (db *creatingDB) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, err := db.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	t.schema.TTLAttribute = aws.ToString(params.TimeToLiveSpecification.AttributeName)
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+func keyNames(elements []types.KeySchemaElement) (hash, rng string) {
+	for _, e := range elements {
+		if e.KeyType == types.KeyTypeHash {
+			hash = aws.ToString(e.AttributeName)
+		} else {
+			rng = aws.ToString(e.AttributeName)
+		}
+	}
+	return hash, rng
+}
+
+func TestEnsureTables(t *testing.T) {
+	ctx := context.Background()
+	raw := &creatingDB{DB: &DB{tables: map[string]*table{}}}
+	db := newLedger(raw, ledger.WithTablePrefix("dev_"))
+	if err := db.EnsureTables(ctx); err != nil {
+		t.Fatalf("EnsureTables() = %v", err)
+	}
+	created := raw.created
+	if err := db.EnsureTables(ctx); err != nil || raw.created != created {
+		t.Fatalf("second EnsureTables() = %v, created %d more tables", err, raw.created-created)
+	}
+	if _, ok := raw.tables["dev_"+ledger.EscrowTransactionsTable]; !ok {
+		t.Fatalf("EnsureTables() did not create %s", "dev_"+ledger.EscrowTransactionsTable)
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Validate(ctx, "nil"); err != nil {
+		t.Fatalf("Validate() after EnsureTables() = %v", err)
+	}
+
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 30}); err != nil {
+		t.Fatalf("TransferCredits() = %v", err)
+	}
+	if missing, err := ledger.CheckUsersExist(ctx, db, "nil", []string{"alice", "bob"}); err != nil {
+		t.Errorf("CheckUsersExist() = %v, %v", missing, err)
+	}
+	if balance, err := ledger.InquireBalance(ctx, db, "nil", "bob"); err != nil || balance != 30 {
+		t.Errorf("InquireBalance() = %v, %v, want 30", balance, err)
+	}
+	if n := len(raw.Items("dev_" + ledger.TransactionsTable)); n != 1 {
+		t.Errorf("%d transactions stored under the prefix, want 1", n)
+	}
+	if _, ok := raw.tables[ledger.NilUsers]; ok {
+		t.Errorf("unprefixed table %s was created", ledger.NilUsers)
+	}
+}
+
+func TestGetPortfolio(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice-savings", 50.5)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice-usd", 20)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice-eur", 10)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 70)
+	for account, currency := range map[string]string{"alice-usd": "USD", "alice-eur": "EUR"} {
+		db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(ledger.NilUsers),
+			Key:                       map[string]types.AttributeValue{"TenantID": &types.AttributeValueMemberS{Value: "nil"}, "AccountID": &types.AttributeValueMemberS{Value: account}},
+			UpdateExpression:          aws.String("SET currency = :currency"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":currency": &types.AttributeValueMemberS{Value: currency}},
+		})
+	}
+	for _, account := range []string{"alice-savings", "alice-usd", "alice-eur"} {
+		if err := ledger.SetAccountOwner(ctx, db, "nil", account, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.SetAccountOwner(ctx, db, "nil", "carol", "alice"); err == nil {
+		t.Error("SetAccountOwner() of a missing account succeeded")
+	}
+	if err := ledger.PutExchangeRate(ctx, db, "nil", "usd", 600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ledger.GetPortfolio(ctx, db, "nil", "alice")
+	if err != nil {
+		t.Fatalf("GetPortfolio() = %v", err)
+	}
+	var accounts []string
+	for _, a := range p.Accounts {
+		accounts = append(accounts, a.AccountID)
+	}
+	if want := []string{"alice", "alice-eur", "alice-savings", "alice-usd"}; !slices.Equal(accounts, want) {
+		t.Errorf("portfolio accounts = %v, want %v", accounts, want)
+	}
+	if p.Subtotals["SDG"] != 150.5 || p.Subtotals["USD"] != 20 || p.Subtotals["EUR"] != 10 {
+		t.Errorf("subtotals = %v", p.Subtotals)
+	}
+	if p.BaseCurrency != "SDG" || p.Total != 12150.5 || !slices.Equal(p.Unconverted, []string{"EUR"}) {
+		t.Errorf("total = %v %v, unconverted %v, want SDG 12150.5 with EUR unconverted", p.Total, p.BaseCurrency, p.Unconverted)
+	}
+
+	ledger.SetAccountOwner(ctx, db, "nil", "alice-eur", "")
+	if p, err := ledger.GetPortfolio(ctx, db, "nil", "alice"); err != nil || len(p.Accounts) != 3 {
+		t.Errorf("GetPortfolio() after removing an owner = %+v, %v", p, err)
+	}
+	if _, err := ledger.GetPortfolio(ctx, db, "nil", "nobody"); err == nil {
+		t.Error("GetPortfolio() of an unknown owner succeeded")
+	}
+}
+
+// cancellingDB cancels the request's context while its journal is posted,
+// committing the journal first when commit is set.
+type cancellingDB struct {
+	*DB
+	cancel context.CancelFunc
+	commit bool
+}
+
+func (db *cancellingDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	if db.commit {
+		db.DB.TransactWriteItems(ctx, params, optFns...)
+	}
+	db.cancel()
+	return nil, ctx.Err()
+}
+
+func TestIndeterminateTransfer(t *testing.T) {
+	ctx := context.Background()
+	raw := &cancellingDB{DB: NewDB()}
+	db := newLedger(raw)
+	ledger.CreateAccountWithBalance(ctx, raw.DB, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, raw.DB, "nil", "bob", 0)
+	req := ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30}
+	transfer := func() (ledger.NilResponse, error) {
+		reqCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		raw.cancel = cancel
+		return ledger.Transfer(reqCtx, db, req)
+	}
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, raw.DB, "nil", account)
+		return b
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if res, err := ledger.Transfer(cancelled, db, req); err == nil || res.Code != "request_cancelled" || len(raw.Items(ledger.TransactionsTable)) != 0 {
+		t.Fatalf("Transfer() with a cancelled context = %+v, %v", res, err)
+	}
+
+	res, err := transfer()
+	if !errors.Is(err, ledger.ErrIndeterminate) || res.Code != "transaction_indeterminate" || res.Data.TransactionID == "" {
+		t.Fatalf("interrupted Transfer() = %+v, %v", res, err)
+	}
+	txid := res.Data.TransactionID
+	if tx, err := ledger.ResolveIndeterminate(ctx, db, "nil", txid); !errors.Is(err, ledger.ErrIndeterminate) {
+		t.Errorf("ResolveIndeterminate() of a recent transfer = %+v, %v", tx, err)
+	}
+	age := func(txid string) {
+		db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(ledger.TransactionsTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID":      &types.AttributeValueMemberS{Value: "nil"},
+				"TransactionID": &types.AttributeValueMemberS{Value: txid},
+			},
+			UpdateExpression:          aws.String("SET TransactionDate = :date"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":date": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-2*ledger.IndeterminateSettleTime).Unix(), 10)}},
+		})
+	}
+	age(txid)
+	tx, err := ledger.ResolveIndeterminate(ctx, db, "nil", txid)
+	if err != nil || *tx.Status != ledger.TransactionFailed || balance("alice") != 100 || balance("bob") != 0 {
+		t.Fatalf("ResolveIndeterminate() of an unposted journal = %+v, %v", tx, err)
+	}
+
+	// The journal was posted, but its record says otherwise.
+	res, _ = transfer()
+	txid = res.Data.TransactionID
+	entry, _ := attributevalue.MarshalMap(ledger.LedgerEntry{TenantID: "nil", AccountID: "bob", SystemTransactionID: txid + "#credit", Amount: 30})
+	raw.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.LedgerTable), Item: entry})
+	age(txid)
+	if tx, err := ledger.ResolveIndeterminate(ctx, db, "nil", txid); err != nil || *tx.Status != ledger.TransactionCompleted {
+		t.Errorf("ResolveIndeterminate() of a posted journal = %+v, %v", tx, err)
+	}
+
+	raw.commit = true
+	if res, err := transfer(); err != nil || res.Code != "successful_transaction" || balance("bob") != 30 {
+		t.Errorf("Transfer() committed before its cancellation = %+v, %v", res, err)
+	}
+}
+
+func TestBonuses(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "promo", 1000)
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, db, "nil", account)
+		return b
+	}
+	bonus := func(account string) float64 {
+		b, _ := ledger.InquireBonusBalance(ctx, db, "nil", account)
+		return b
+	}
+	now := time.Now()
+	if _, err := ledger.GrantBonus(ctx, db, "nil", "alice", 30, now.Add(time.Hour), "welcome"); err == nil {
+		t.Error("GrantBonus() without a funding account succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", BonusFundingAccount: "promo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.GrantBonus(ctx, db, "nil", "alice", 30, now.Add(2*time.Hour), "welcome"); err != nil {
+		t.Fatalf("GrantBonus() = %v", err)
+	}
+	if _, err := ledger.GrantBonus(ctx, db, "nil", "alice", 20, now.Add(time.Hour), "weekend"); err != nil {
+		t.Fatalf("GrantBonus() = %v", err)
+	}
+	if _, err := ledger.GrantBonus(ctx, db, "nil", "alice", 20, now.Add(-time.Hour), "late"); err == nil {
+		t.Error("GrantBonus() of an expired bonus succeeded")
+	}
+	if bonus("alice") != 50 || balance("alice") != 100 || balance("promo") != 950 {
+		t.Fatalf("after grants alice has %v and %v in bonuses, promo %v", balance("alice"), bonus("alice"), balance("promo"))
+	}
+
+	// Bonuses are spent first, soonest to expire first.
+	req := ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 25}
+	if _, err := ledger.Transfer(ctx, db, req); err != nil {
+		t.Fatalf("Transfer() = %v", err)
+	}
+	buckets, _ := ledger.GetBonuses(ctx, db, "nil", "alice")
+	if len(buckets) != 1 || buckets[0].Campaign != "welcome" || buckets[0].Amount != 25 || balance("alice") != 100 || balance("bob") != 25 {
+		t.Errorf("after spending 25 alice has %v with bonuses %+v, bob %v", balance("alice"), buckets, balance("bob"))
+	}
+	// Then the balance, and the sender may not spend more than both.
+	req.Amount = 35
+	if _, err := ledger.Transfer(ctx, db, req); err != nil {
+		t.Fatalf("Transfer() = %v", err)
+	}
+	if bonus("alice") != 0 || balance("alice") != 90 || balance("bob") != 60 {
+		t.Errorf("after spending 35 alice has %v and %v in bonuses, bob %v", balance("alice"), bonus("alice"), balance("bob"))
+	}
+	req.Amount = 90.01
+	if _, err := ledger.Transfer(ctx, db, req); err == nil {
+		t.Error("Transfer() above the balance succeeded")
+	}
+
+	// Unspent bonuses go back to the funding account when they expire.
+	ledger.GrantBonus(ctx, db, "nil", "alice", 10, now.Add(time.Hour), "flash")
+	ledger.GrantBonus(ctx, db, "nil", "alice", 5, now.Add(3*time.Hour), "loyalty")
+	if n, err := ledger.ExpireBonuses(ctx, db, "nil", now); err != nil || n != 0 {
+		t.Errorf("ExpireBonuses() before expiry = %d, %v", n, err)
+	}
+	n, err := ledger.ExpireBonuses(ctx, db, "nil", now.Add(2*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("ExpireBonuses() = %d, %v, want 1 bucket", n, err)
+	}
+	if bonus("alice") != 5 || balance("promo") != 950-15+10 {
+		t.Errorf("after expiry alice has %v in bonuses, promo %v", bonus("alice"), balance("promo"))
+	}
+
+	for _, account := range []string{"alice", "bob", "promo"} {
+		report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", account)
+		if err != nil || !report.Valid() {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+}
+
+func TestDepositAndWithdraw(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "treasury", 0)
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, db, "nil", account)
+		return b
+	}
+	deposit := ledger.CashRequest{AccountID: "alice", Amount: 100, Channel: ledger.ChannelBank, BankReference: "FT2401"}
+	if _, err := ledger.DepositCredits(ctx, db, deposit); err == nil {
+		t.Error("DepositCredits() without a treasury account succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", TreasuryAccount: "treasury"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.DepositCredits(ctx, db, ledger.CashRequest{AccountID: "alice", Amount: 100, Channel: ledger.ChannelBank}); err == nil {
+		t.Error("DepositCredits() of a bank deposit without a reference succeeded")
+	}
+
+	tx, err := ledger.DepositCredits(ctx, db, deposit)
+	if err != nil {
+		t.Fatalf("DepositCredits() = %v", err)
+	}
+	if tx.FromAccount != "treasury" || tx.ToAccount != "alice" || tx.Metadata[ledger.MetadataBankReference] != "FT2401" || tx.Metadata[ledger.MetadataChannel] != ledger.ChannelBank {
+		t.Errorf("deposit = %+v", tx)
+	}
+	if balance("alice") != 100 || balance("treasury") != -100 {
+		t.Errorf("after deposit alice has %v, treasury %v", balance("alice"), balance("treasury"))
+	}
+
+	withdrawal := ledger.CashRequest{AccountID: "alice", Amount: 60, Channel: ledger.ChannelAgent, AgentID: "agent-7"}
+	if _, err := ledger.WithdrawCredits(ctx, db, withdrawal); err != nil {
+		t.Fatalf("WithdrawCredits() = %v", err)
+	}
+	if _, err := ledger.WithdrawCredits(ctx, db, withdrawal); err == nil {
+		t.Error("WithdrawCredits() above the balance succeeded")
+	}
+	if balance("alice") != 40 || balance("treasury") != -40 {
+		t.Errorf("after withdrawal alice has %v, treasury %v", balance("alice"), balance("treasury"))
+	}
+
+	var entries []ledger.LedgerEntry
+	attributevalue.UnmarshalListOfMaps(db.Items(ledger.LedgerTable), &entries)
+	var legs []string
+	for _, e := range entries {
+		legs = append(legs, e.AccountID+" "+e.Type)
+	}
+	slices.Sort(legs)
+	if want := []string{"alice deposit", "alice withdrawal", "treasury credit", "treasury debit"}; !slices.Equal(legs, want) {
+		t.Errorf("ledger entries = %v, want %v", legs, want)
+	}
+	for _, account := range []string{"alice", "treasury"} {
+		if report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", account); err != nil || !report.Valid() {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+}
+
+func TestPayouts(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "agent", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "payouts", 0)
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", PayoutHoldingAccount: "payouts"}); err != nil {
+		t.Fatal(err)
+	}
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, db, "nil", account)
+		return b
+	}
+	req := ledger.PayoutRequest{FromAccount: "alice", Amount: 30, RecipientName: "Mona", RecipientIDNumber: "P123"}
+	code, payout, err := ledger.CreatePayout(ctx, db, req)
+	if err != nil {
+		t.Fatalf("CreatePayout() = %v", err)
+	}
+	if len(code) != 10 || payout.Status != ledger.PayoutPending || balance("alice") != 70 || balance("payouts") != 30 {
+		t.Fatalf("CreatePayout() = %q, %+v; alice has %v", code, payout, balance("alice"))
+	}
+	req.Amount = 80
+	if _, _, err := ledger.CreatePayout(ctx, db, req); err == nil {
+		t.Error("CreatePayout() above the balance succeeded")
+	}
+
+	matchID := func(id string) ledger.RecipientVerifier {
+		return func(ctx context.Context, p ledger.Payout) error {
+			if p.RecipientIDNumber != id {
+				return errors.New("ID does not match")
+			}
+			return nil
+		}
+	}
+	if _, err := ledger.RedeemPayout(ctx, db, "nil", code, "agent", matchID("X999")); err == nil {
+		t.Error("RedeemPayout() with the wrong ID succeeded")
+	}
+	if _, err := ledger.RedeemPayout(ctx, db, "nil", "0000000000", "agent", matchID("P123")); err == nil {
+		t.Error("RedeemPayout() of an unknown code succeeded")
+	}
+	if _, err := ledger.CancelPayout(ctx, db, "nil", code, "agent"); err == nil {
+		t.Error("CancelPayout() by another account succeeded")
+	}
+	redeemed, err := ledger.RedeemPayout(ctx, db, "nil", code, "agent", matchID("P123"))
+	if err != nil || redeemed.Status != ledger.PayoutRedeemed || balance("agent") != 30 || balance("payouts") != 0 {
+		t.Fatalf("RedeemPayout() = %+v, %v; agent has %v", redeemed, err, balance("agent"))
+	}
+	if _, err := ledger.RedeemPayout(ctx, db, "nil", code, "agent", matchID("P123")); err == nil {
+		t.Error("second RedeemPayout() succeeded")
+	}
+	if _, err := ledger.CancelPayout(ctx, db, "nil", code, "alice"); err == nil {
+		t.Error("CancelPayout() of a redeemed payout succeeded")
+	}
+
+	req.Amount = 20
+	code, _, _ = ledger.CreatePayout(ctx, db, req)
+	if p, err := ledger.CancelPayout(ctx, db, "nil", code, "alice"); err != nil || p.Status != ledger.PayoutCancelled || balance("alice") != 70 {
+		t.Errorf("CancelPayout() = %+v, %v; alice has %v", p, err, balance("alice"))
+	}
+
+	code, _, _ = ledger.CreatePayout(ctx, db, req)
+	if n, err := ledger.ExpirePayouts(ctx, db, "nil", time.Now()); err != nil || n != 0 {
+		t.Errorf("ExpirePayouts() before expiry = %d, %v", n, err)
+	}
+	if n, err := ledger.ExpirePayouts(ctx, db, "nil", time.Now().Add(ledger.DefaultPayoutTTL+time.Minute)); err != nil || n != 1 {
+		t.Errorf("ExpirePayouts() = %d, %v, want 1", n, err)
+	}
+	if p, _ := ledger.GetPayout(ctx, db, "nil", code); p.Status != ledger.PayoutExpired || balance("alice") != 70 || balance("payouts") != 0 {
+		t.Errorf("expired payout = %+v; alice has %v", p, balance("alice"))
+	}
+
+	req.Amount = 20.005
+	if _, _, err := ledger.CreatePayout(ctx, db, req); err == nil {
+		t.Error("CreatePayout() of a sub-cent amount succeeded")
+	}
+	// The payout passes the controls of a transfer out of alice's account.
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", PayoutHoldingAccount: "payouts", LargeTransferThreshold: 10}); err != nil {
+		t.Fatal(err)
+	}
+	req.Amount = 20
+	if _, _, err := ledger.CreatePayout(ctx, db, req); !errors.Is(err, ledger.ErrTransferDelayed) || balance("alice") != 70 {
+		t.Errorf("CreatePayout() above the large transfer threshold error = %v; alice has %v", err, balance("alice"))
+	}
+
+	for _, account := range []string{"alice", "agent", "payouts"} {
+		if report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", account); err != nil || !report.Valid() {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+}
+
+func TestSendToUnregistered(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for _, user := range []ledger.User{
+		{AccountID: "alice", MobileNumber: "0912345678", Amount: 100},
+		{AccountID: "bob", MobileNumber: "0998765432"},
+		{AccountID: "claims"},
+	} {
+		if err := ledger.CreateAccount(ctx, db, "nil", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 30); err == nil {
+		t.Error("SendToUnregistered() without a pending claims account succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", PendingClaimsAccount: "claims"}); err != nil {
+		t.Fatal(err)
+	}
+	balance := func(account string) float64 {
+		b, _ := ledger.InquireBalance(ctx, db, "nil", account)
+		return b
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0998765432", 30); !errors.Is(err, ledger.ErrRecipientRegistered) {
+		t.Errorf("SendToUnregistered() to a registered number error = %v, want ErrRecipientRegistered", err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 300); err == nil {
+		t.Error("SendToUnregistered() above the balance succeeded")
+	}
+	claim, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 30)
+	if err != nil {
+		t.Fatalf("SendToUnregistered() = %v", err)
+	}
+	if claim.Status != ledger.ClaimPending || claim.PhoneNumber != "*******111" || balance("alice") != 70 || balance("claims") != 30 {
+		t.Fatalf("SendToUnregistered() = %+v; alice has %v", claim, balance("alice"))
+	}
+
+	if _, err := ledger.ClaimTransfer(ctx, db, "nil", claim.ClaimID, "bob"); err == nil {
+		t.Error("ClaimTransfer() by another number succeeded")
+	}
+	if err := ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "carol", MobileNumber: "0911000111"}); err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ledger.ListClaimsFor(ctx, db, "nil", "carol"); err != nil || len(claims) != 1 || claims[0].ClaimID != claim.ClaimID {
+		t.Errorf("ListClaimsFor() = %+v, %v", claims, err)
+	}
+	claimed, err := ledger.ClaimTransfer(ctx, db, "nil", claim.ClaimID, "carol")
+	if err != nil || claimed.Status != ledger.ClaimClaimed || balance("carol") != 30 || balance("claims") != 0 {
+		t.Fatalf("ClaimTransfer() = %+v, %v; carol has %v", claimed, err, balance("carol"))
+	}
+	if _, err := ledger.ClaimTransfer(ctx, db, "nil", claim.ClaimID, "carol"); err == nil {
+		t.Error("second ClaimTransfer() succeeded")
+	}
+
+	claim, _ = ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911222333", 20)
+	if n, err := ledger.ExpireClaims(ctx, db, "nil", time.Now()); err != nil || n != 0 {
+		t.Errorf("ExpireClaims() before expiry = %d, %v", n, err)
+	}
+	if n, err := ledger.ExpireClaims(ctx, db, "nil", time.Now().Add(ledger.DefaultClaimTTL+time.Minute)); err != nil || n != 1 {
+		t.Errorf("ExpireClaims() = %d, %v, want 1", n, err)
+	}
+	if c, _ := ledger.GetPendingClaim(ctx, db, "nil", claim.ClaimID); c.Status != ledger.ClaimRefunded || balance("alice") != 70 || balance("claims") != 0 {
+		t.Errorf("expired claim = %+v; alice has %v", c, balance("alice"))
+	}
+
+	// The send passes the controls of a transfer out of alice's account.
+	err = ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", PendingClaimsAccount: "claims",
+		LargeTransferThreshold: 40, VelocityRules: []ledger.VelocityRule{{MaxTransfers: 1, Window: 3600}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911222333", 50); !errors.Is(err, ledger.ErrTransferDelayed) {
+		t.Errorf("SendToUnregistered() above the large transfer threshold error = %v, want ErrTransferDelayed", err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911222333", 5); !errors.Is(err, ledger.ErrRateLimited) || balance("alice") != 70 {
+		t.Errorf("SendToUnregistered() over the velocity rule error = %v; alice has %v", err, balance("alice"))
+	}
+
+	for _, account := range []string{"alice", "carol", "claims"} {
+		if report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", account); err != nil || !report.Valid() {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+}
+
+func TestImportLedgerEntries(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 90)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 10)
+
+	const file = `external_ref,account_id,type,amount,time
+T1,alice,debit,10,2023-01-02T10:00:00Z
+T1,bob,credit,10,2023-01-02T10:00:00Z
+T2,alice,debit,5,2023-01-03
+T2,bob,credit,4,2023-01-03
+T3,alice,debit,1,1672700000
+T3,carol,credit,1,1672700000
+,alice,debit,1,2023-01-03
+`
+	report, err := ledger.ImportLedgerEntries(ctx, db, "nil", strings.NewReader(file), ledger.ImportCSV)
+	if err == nil || report.Rows != 7 || report.Imported != 1 || report.Entries != 2 || len(report.Errors) != 3 {
+		t.Fatalf("ImportLedgerEntries() = %+v, %v", report, err)
+	}
+	rows := []int{report.Errors[0].Row, report.Errors[1].Row, report.Errors[2].Row}
+	if !slices.Equal(rows, []int{7, 3, 5}) || report.Errors[1].ExternalRef != "T2" {
+		t.Errorf("ImportLedgerEntries() errors = %+v", report.Errors)
+	}
+	entries, err := ledger.GetLedgerEntries(ctx, db, "nil", "bob")
+	if err != nil || len(entries) != 1 || entries[0].ExternalRef != "T1" || entries[0].Amount != 10 || entries[0].Time != 1672653600 {
+		t.Fatalf("GetLedgerEntries() = %+v, %v", entries, err)
+	}
+	if b, _ := ledger.InquireBalance(ctx, db, "nil", "bob"); b != 10 {
+		t.Errorf("bob has %v after the import, want 10", b)
+	}
+
+	rowsJSON := `[
+		{"external_ref": "T1", "account_id": "alice", "type": "debit", "amount": 10, "time": "2023-01-02T10:00:00Z"},
+		{"external_ref": "T1", "account_id": "bob", "type": "credit", "amount": 10, "time": "2023-01-02T10:00:00Z"},
+		{"external_ref": "T4", "account_id": "bob", "type": "debit", "amount": 2.5, "time": "2023-01-04"},
+		{"external_ref": "T4", "account_id": "alice", "type": "credit", "amount": 1.5, "time": "2023-01-04"},
+		{"external_ref": "T4", "account_id": "alice", "type": "credit", "amount": 1, "time": "2023-01-04"}
+	]`
+	report, err = ledger.ImportLedgerEntries(ctx, db, "nil", strings.NewReader(rowsJSON), ledger.ImportJSON)
+	if err != nil || report.Imported != 1 || report.Duplicates != 1 || report.Entries != 3 {
+		t.Fatalf("ImportLedgerEntries() again = %+v, %v", report, err)
+	}
+	if entries, _ := ledger.GetLedgerEntries(ctx, db, "nil", "alice"); len(entries) != 3 {
+		t.Errorf("alice has %d ledger entries, want 3", len(entries))
+	}
+	if _, err := ledger.ImportLedgerEntries(ctx, db, "nil", strings.NewReader("account_id,amount\n"), ledger.ImportCSV); err == nil {
+		t.Error("ImportLedgerEntries() without the required columns succeeded")
+	}
+}
+
+func TestTransferConflictRetry(t *testing.T) {
+	ctx := context.Background()
+	setup := func(policy ledger.RetryPolicy) (*racingDB, *ledger.Ledger) {
+		db := &racingDB{DB: NewDB()}
+		l := newLedger(db, ledger.WithConflictRetry(policy))
+		for id, amount := range map[string]float64{"alice": 100, "bob": 0, "carol": 0} {
+			ledger.CreateAccountWithBalance(ctx, l, "nil", id, amount)
+		}
+		return db, l
+	}
+	concurrent := func(db *racingDB, amount float64) func() {
+		return func() {
+			if res, err := ledger.Transfer(ctx, db.DB, ledger.TransferRequest{FromAccount: "alice", ToAccount: "carol", Amount: amount}); err != nil {
+				t.Fatalf("concurrent Transfer() = %+v, %v", res, err)
+			}
+		}
+	}
+	balance := func(l *ledger.Ledger, id string) float64 {
+		b, _ := ledger.InquireBalance(ctx, l, "nil", id)
+		return b
+	}
+
+	db, l := setup(ledger.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	db.race = concurrent(db, 30)
+	res, err := ledger.Transfer(ctx, l, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 50})
+	if err != nil || res.Code != "successful_transaction" {
+		t.Fatalf("Transfer() racing another = %+v, %v", res, err)
+	}
+	if balance(l, "alice") != 20 || balance(l, "bob") != 50 || balance(l, "carol") != 30 {
+		t.Errorf("balances = %v, %v, %v, want 20, 50, 30", balance(l, "alice"), balance(l, "bob"), balance(l, "carol"))
+	}
+	if report, err := ledger.VerifyLedgerIntegrity(ctx, l, "nil", "alice"); err != nil || !report.Valid() {
+		t.Errorf("VerifyLedgerIntegrity() = %+v, %v", report, err)
+	}
+
+	// The balance is checked again on the sender read after the race.
+	db, l = setup(ledger.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	db.race = concurrent(db, 80)
+	if res, err := ledger.Transfer(ctx, l, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 50}); err == nil || res.Code != "insufficient_balance" {
+		t.Errorf("Transfer() racing one that spent the balance = %+v, %v", res, err)
+	}
+	if balance(l, "alice") != 20 || balance(l, "bob") != 0 {
+		t.Errorf("balances = %v, %v, want 20, 0", balance(l, "alice"), balance(l, "bob"))
+	}
+
+	db, l = setup(ledger.RetryPolicy{MaxAttempts: 1})
+	db.race = concurrent(db, 30)
+	if res, err := ledger.Transfer(ctx, l, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 50}); err == nil || res.Code != "debit_failed" {
+		t.Errorf("Transfer() racing another without retries = %+v, %v", res, err)
+	}
+}
+
+func TestResolveAccountTenant(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	for _, acc := range []struct{ tenant, id string }{{"acme", "alice"}, {"acme", "bob"}, {"globex", "bob"}} {
+		if err := ledger.CreateAccount(ctx, db, acc.tenant, ledger.User{AccountID: acc.id, FullName: acc.id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tenant, err := ledger.ResolveAccountTenant(ctx, db, "alice"); err != nil || tenant != "acme" {
+		t.Errorf("ResolveAccountTenant(alice) = %q, %v", tenant, err)
+	}
+	if _, err := ledger.ResolveAccountTenant(ctx, db, "bob"); !errors.Is(err, ledger.ErrAmbiguousAccount) {
+		t.Errorf("ResolveAccountTenant(bob) error = %v, want ErrAmbiguousAccount", err)
+	}
+	if _, err := ledger.ResolveAccountTenant(ctx, db, "carol"); !errors.Is(err, ledger.ErrAccountNotFound) {
+		t.Errorf("ResolveAccountTenant(carol) error = %v, want ErrAccountNotFound", err)
+	}
+	if user, err := ledger.LookupAccount(ctx, db, "alice"); err != nil || user.TenantID != "acme" || user.FullName != "alice" {
+		t.Errorf("LookupAccount(alice) = %+v, %v", user, err)
+	}
+	if _, err := ledger.LookupAccount(ctx, db, "bob"); !errors.Is(err, ledger.ErrAmbiguousAccount) {
+		t.Errorf("LookupAccount(bob) error = %v, want ErrAmbiguousAccount", err)
+	}
+}
+
+func TestBalanceSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	for id, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", id, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sent []string
+	defer func(n ledger.Notifier) { ledger.DefaultNotifier = n }(ledger.DefaultNotifier)
+	ledger.DefaultNotifier = func(ctx context.Context, tenantId, accountId, message string) error {
+		sent = append(sent, accountId+": "+message)
+		return nil
+	}
+
+	low, err := ledger.CreateSubscription(ctx, db, ledger.BalanceSubscription{AccountID: "alice", Kind: ledger.SubscriptionBalanceBelow, Threshold: 50})
+	if err != nil {
+		t.Fatalf("CreateSubscription() error = %v", err)
+	}
+	if _, err := ledger.CreateSubscription(ctx, db, ledger.BalanceSubscription{AccountID: "bob", Kind: ledger.SubscriptionCreditAbove, Threshold: 20, Locale: "ar"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []ledger.BalanceSubscription{
+		{AccountID: "alice", Kind: "balance_above", Threshold: 10},
+		{AccountID: "alice", Kind: ledger.SubscriptionCreditAbove, Threshold: -1},
+		{AccountID: "carol", Kind: ledger.SubscriptionBalanceBelow, Threshold: 10},
+	} {
+		if _, err := ledger.CreateSubscription(ctx, db, bad); err == nil {
+			t.Errorf("CreateSubscription(%+v) succeeded", bad)
+		}
+	}
+
+	transfer := func(amount float64) {
+		t.Helper()
+		res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: amount, InitiatorUUID: fmt.Sprint("sub-", amount)})
+		if err != nil {
+			t.Fatalf("Transfer(%v) = %+v, %v", amount, res, err)
+		}
+	}
+	transfer(10) // alice 90, bob receives 10
+	if len(sent) != 0 {
+		t.Fatalf("notifications = %q, want none", sent)
+	}
+	transfer(45) // alice 45, bob receives 45
+	want := []string{"alice: Your balance fell below 50.00 SDG.", "bob: استلمت 45.00 SDG من alice."}
+	if !slices.Equal(sent, want) {
+		t.Fatalf("notifications = %q, want %q", sent, want)
+	}
+	sent = nil
+	transfer(5) // alice stays below 50
+	if len(sent) != 0 {
+		t.Errorf("notifications below the threshold = %q, want none", sent)
+	}
+
+	if subs, err := ledger.ListSubscriptions(ctx, db, "", "alice"); err != nil || len(subs) != 1 || subs[0].SubscriptionID != low.SubscriptionID {
+		t.Errorf("ListSubscriptions() = %+v, %v", subs, err)
+	}
+	if err := ledger.DeleteSubscription(ctx, db, "", "alice", low.SubscriptionID); err != nil {
+		t.Fatalf("DeleteSubscription() error = %v", err)
+	}
+	if err := ledger.DeleteSubscription(ctx, db, "", "alice", low.SubscriptionID); err == nil {
+		t.Error("second DeleteSubscription() succeeded")
+	}
+	if subs, _ := ledger.ListSubscriptions(ctx, db, "", "alice"); len(subs) != 0 {
+		t.Errorf("ListSubscriptions() after delete = %+v", subs)
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	for i, city := range []string{"Khartoum", "Omdurman", "Khartoum", "Khartoum", "Bahri"} {
+		user := ledger.User{AccountID: fmt.Sprintf("acc-%d", i), FullName: "Sara Ali Ahmed", MobileNumber: "0912345678", City: city, IsVerified: i != 2, Amount: float64(i * 100)}
+		if err := ledger.CreateAccount(ctx, db, "acme", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.CreateAccount(ctx, db, "other", ledger.User{AccountID: "acc-9", City: "Khartoum"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(accounts []ledger.AccountSummary) []string {
+		var ids []string
+		for _, a := range accounts {
+			ids = append(ids, a.AccountID)
+		}
+		return ids
+	}
+
+	all, next, err := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{}, "")
+	if err != nil || len(all) != 5 || next != "" {
+		t.Fatalf("ListAccounts() = %v, %q, %v", ids(all), next, err)
+	}
+	if a := all[1]; a.FullName != "Sara A. A." || a.MobileNumber != "*******678" || a.Balance != 100 || a.Status != ledger.AccountActive || a.City != "Omdurman" {
+		t.Errorf("ListAccounts() summary = %+v", a)
+	}
+
+	verified, minBalance, maxBalance := true, 50.0, 350.0
+	filter := ledger.AccountFilter{City: "Khartoum", IsVerified: &verified, MinBalance: &minBalance, MaxBalance: &maxBalance}
+	if got, _, err := ledger.ListAccounts(ctx, db, "acme", filter, ""); err != nil || !slices.Equal(ids(got), []string{"acc-3"}) {
+		t.Errorf("ListAccounts(filtered) = %v, %v", ids(got), err)
+	}
+	now := time.Now()
+	if got, _, _ := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{CreatedFrom: now.Add(-time.Hour), CreatedTo: now.Add(time.Hour)}, ""); len(got) != 5 {
+		t.Errorf("ListAccounts(created today) = %v", ids(got))
+	}
+	if got, _, _ := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{CreatedTo: now.Add(-time.Hour)}, ""); len(got) != 0 {
+		t.Errorf("ListAccounts(created before) = %v", ids(got))
+	}
+
+	var paged []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, next, err := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{Limit: 2, City: "Khartoum"}, cursor)
+		if err != nil || pages > 3 {
+			t.Fatalf("ListAccounts(page %d) = %v, %v", pages, ids(page), err)
+		}
+		paged = append(paged, ids(page)...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !slices.Equal(paged, []string{"acc-0", "acc-2", "acc-3"}) {
+		t.Errorf("ListAccounts() pages = %v", paged)
+	}
+	if _, _, err := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{Status: "closed"}, ""); err == nil {
+		t.Error("ListAccounts() with an unknown status succeeded")
+	}
+}
+
+func TestUpdateAccount(t *testing.T) {
+	ctx := ledger.WithActor(context.Background(), "support-3")
+	db := newLedger(NewDB(), ledger.WithAuditLog())
+	if err := ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "alice", FullName: "Alice", MobileNumber: "0911111111", Amount: 50}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "acme", AccountID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, mobile := "Alice Osman", "0922222222"
+	updated, err := ledger.UpdateAccount(ctx, db, "acme", "alice", ledger.AccountPatch{FullName: &name, MobileNumber: &mobile, Version: user.Version})
+	if err != nil {
+		t.Fatalf("UpdateAccount() error = %v", err)
+	}
+	if updated.FullName != name || updated.MobileNumber != mobile || updated.Amount != 50 || updated.Version <= user.Version {
+		t.Errorf("UpdateAccount() = %+v", updated)
+	}
+	if matches, _ := ledger.FindAccount(ctx, db, "acme", ledger.AccountQuery{MobileNumber: mobile}); len(matches) != 1 {
+		t.Errorf("FindAccount() by the new number = %+v", matches)
+	}
+	if matches, _ := ledger.FindAccount(ctx, db, "acme", ledger.AccountQuery{MobileNumber: "0911111111"}); len(matches) != 0 {
+		t.Errorf("FindAccount() by the old number = %+v", matches)
+	}
+
+	city := "Bahri"
+	if _, err := ledger.UpdateAccount(ctx, db, "acme", "alice", ledger.AccountPatch{City: &city, Version: user.Version}); !errors.Is(err, ledger.ErrAccountConflict) {
+		t.Errorf("UpdateAccount() with a stale version error = %v, want ErrAccountConflict", err)
+	}
+	dependants := -1
+	if _, err := ledger.UpdateAccount(ctx, db, "acme", "alice", ledger.AccountPatch{Dependants: &dependants, Version: updated.Version}); validation.Fields(err) == nil {
+		t.Errorf("UpdateAccount() with negative dependants error = %v", err)
+	}
+	var patch ledger.AccountPatch
+	for _, body := range []string{`{"amount":100}`, `{"account_id":"bob"}`, `{"TenantID":"other"}`} {
+		if err := json.Unmarshal([]byte(body), &patch); !errors.Is(err, ledger.ErrImmutableField) {
+			t.Errorf("unmarshal %s error = %v, want ErrImmutableField", body, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"city":"Bahri","version":7}`), &patch); err != nil || *patch.City != "Bahri" || patch.Version != 7 {
+		t.Errorf("unmarshal patch = %+v, %v", patch, err)
+	}
+
+	entries, _, err := ledger.QueryAuditLog(ctx, db, "acme", ledger.AuditQuery{Operation: ledger.AuditUpdateAccount})
+	if err != nil || len(entries) != 3 || entries[0].Actor != "support-3" || entries[0].Error != "" || entries[1].Error == "" {
+		t.Errorf("QueryAuditLog() = %+v, %v", entries, err)
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	ctx := context.Background()
+	defer func(p ledger.Argon2Params) { ledger.PasswordHashParams = p }(ledger.PasswordHashParams)
+	ledger.PasswordHashParams = ledger.Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	mem := NewDB()
+	db := newLedger(mem)
+	if err := ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "alice", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	password := func(accountId string) string {
+		user, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "acme", AccountID: accountId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Password
+	}
+	if stored := password("alice"); !strings.HasPrefix(stored, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("stored password = %q, want a hash", stored)
+	}
+	for pw, want := range map[string]bool{"hunter2": true, "hunter3": false, "": false} {
+		if ok, err := ledger.VerifyPassword(ctx, db, "acme", "alice", pw); err != nil || ok != want {
+			t.Errorf("VerifyPassword(%q) = %v, %v, want %v", pw, ok, err, want)
+		}
+	}
+
+	// Accounts written before passwords were hashed hold them in plaintext.
+	for _, id := range []string{"bob", "carol"} {
+		item, _ := attributevalue.MarshalMap(ledger.User{TenantID: "acme", AccountID: id, Password: "pw-" + id})
+		if _, err := mem.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.NilUsers), Item: item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := ledger.VerifyPassword(ctx, db, "acme", "bob", "pw-bob"); err != nil || !ok {
+		t.Errorf("VerifyPassword() of a plaintext password = %v, %v", ok, err)
+	}
+	if stored := password("bob"); !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("plaintext password after VerifyPassword = %q, want a hash", stored)
+	}
+	if n, err := ledger.MigratePasswords(ctx, db, "acme"); err != nil || n != 1 {
+		t.Errorf("MigratePasswords() = %d, %v, want carol only", n, err)
+	}
+	if ok, _ := ledger.VerifyPassword(ctx, db, "acme", "carol", "pw-carol"); !ok || !strings.HasPrefix(password("carol"), "$argon2id$") {
+		t.Errorf("carol's password after MigratePasswords = %q", password("carol"))
+	}
+
+	ledger.PasswordHashParams.Time = 2
+	before := password("alice")
+	if ok, _ := ledger.VerifyPassword(ctx, db, "acme", "alice", "hunter2"); !ok || password("alice") == before || !strings.HasPrefix(password("alice"), "$argon2id$v=19$m=64,t=2,p=1$") {
+		t.Errorf("password after raising the parameters = %q, want a rehash", password("alice"))
+	}
+
+	// A password that looks like a hash is hashed like any other.
+	forged := "$argon2id$v=19$m=64,t=2,p=1$c2FsdA$a2V5"
+	if err := ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "mallory", Password: forged}); err != nil {
+		t.Fatal(err)
+	}
+	if stored := password("mallory"); stored == forged {
+		t.Errorf("stored password = %q, want it hashed", stored)
+	}
+	if ok, _ := ledger.VerifyPassword(ctx, db, "acme", "mallory", forged); !ok {
+		t.Error("VerifyPassword() of a password that looks like a hash = false")
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+type sequenceIDs struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (s *sequenceIDs) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	return fmt.Sprintf("tx-%03d", s.n)
+}
+
+func TestClockAndIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	run := func() []ledger.LedgerEntry {
+		db := newLedger(NewDB(), ledger.WithClock(fixedClock(now)), ledger.WithIDGenerator(&sequenceIDs{}))
+		for _, id := range []string{"alice", "bob"} {
+			if err := ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: id, Amount: 100}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 40})
+		if err != nil {
+			t.Fatalf("TransferCredits() error = %v, response %+v", err, resp)
+		}
+		if resp.Data.TransactionID != "tx-001" {
+			t.Errorf("TransactionID = %q, want tx-001", resp.Data.TransactionID)
+		}
+		split, err := ledger.SplitTransfer(ctx, db, ledger.SplitTransferRequest{FromAccount: "alice", Splits: []ledger.Split{{To: "bob", Amount: 10}}})
+		if err != nil || split.SystemTransactionID != "tx-002" || split.TransactionDate != now.Unix() {
+			t.Errorf("SplitTransfer() = %+v, %v, want tx-002 at %d", split, err, now.Unix())
+		}
+		user, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.LastActivity != now.Unix() {
+			t.Errorf("LastActivity = %d, want %d", user.LastActivity, now.Unix())
+		}
+		entries, err := ledger.GetLedgerEntries(ctx, db, "nil", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "escrow"})
+		ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "claims"})
+		if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", EscrowHoldingAccount: "escrow", PendingClaimsAccount: "claims"}); err != nil {
+			t.Fatal(err)
+		}
+		hold, err := ledger.EscrowTransfer(ctx, db, ledger.EscrowTransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 5, Arbitrator: "market"})
+		if err != nil || hold.EscrowID != "tx-003" || hold.CreatedAt != now.Unix() {
+			t.Errorf("EscrowTransfer() = %+v, %v, want tx-003 at %d", hold, err, now.Unix())
+		}
+		if funding, err := ledger.GetTransaction(ctx, db, "nil", "alice", "tx-003"); err != nil || funding.TransactionDate != now.Unix() {
+			t.Errorf("escrow funding transaction = %+v, %v, want one at %d", funding, err, now.Unix())
+		}
+		claim, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 5)
+		if err != nil || claim.ClaimID != "tx-004" || claim.CreatedAt != now.Unix() || claim.ExpiresAt != now.Add(ledger.DefaultClaimTTL).Unix() {
+			t.Errorf("SendToUnregistered() = %+v, %v, want tx-004 at %d", claim, err, now.Unix())
+		}
+		return entries
+	}
+
+	first := run()
+	if len(first) != 2 || first[0].JournalID != "tx-001" || first[0].Time != now.Unix() || first[1].JournalID != "tx-002" {
+		t.Fatalf("entries = %+v", first)
+	}
+	if second := run(); fmt.Sprintf("%+v", second) != fmt.Sprintf("%+v", first) {
+		t.Errorf("entries of a second run = %+v, want %+v", second, first)
+	}
+}
+
+// attributedMetrics sums counters by name and attributes.
+type attributedMetrics struct{ values map[string]float64 }
+
+func (m *attributedMetrics) AddCounter(ctx context.Context, name string, value float64, attrs ...ledger.Attribute) {
+	key := name
+	for _, attr := range attrs {
+		key += fmt.Sprintf(" %s=%v", attr.Key, attr.Value)
+	}
+	m.values[key] += value
+}
+func (m *attributedMetrics) RecordHistogram(ctx context.Context, name string, value float64, attrs ...ledger.Attribute) {
+}
+
+func TestCapacityMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := &attributedMetrics{values: map[string]float64{}}
+	raw := &capacityDB{DB: NewDB(), units: 1.5}
+	db := newLedger(raw, ledger.WithMetrics(metrics), ledger.WithCapacityMetrics())
+	if err := ledger.CreateAccountWithBalance(ctx, db, "acme", "alice", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ledger.GetTransactions(ctx, db, "acme", "alice", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.ListAccounts(ledger.WithOperation(ctx, "list_accounts", "acme"), db, "acme", ledger.AccountFilter{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.ListAccounts(ctx, db, "acme", ledger.AccountFilter{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		ledger.MetricDynamoDBReadCapacity + " op=Query table=TransactionsTable operation=GetTransactions tenant=acme": 1.5,
+		ledger.MetricDynamoDBReadCapacity + " op=Query table=NilUsers operation=list_accounts tenant=acme":            1.5,
+		ledger.MetricDynamoDBReadCapacity + " op=Query table=NilUsers":                                                1.5,
+	}
+	for key, units := range want {
+		if got := metrics.values[key]; got != units {
+			t.Errorf("%s = %v, want %v; recorded %v", key, got, units, metrics.values)
+		}
+	}
+}
+
+// failingWriter fails once it has written n pages.
+type failingWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return w.Buffer.Write(p)
+}
+
+func TestExportFullLedger(t *testing.T) {
+	ctx := context.Background()
+	raw := NewDB()
+	db := newLedger(raw)
+	for _, tenant := range []string{"acme", "other"} {
+		for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+			if err := ledger.CreateAccountWithBalance(ctx, db, tenant, account, amount); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: tenant, AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := map[string]bool{}
+	for _, item := range raw.Items(ledger.LedgerTable) {
+		if item["TenantID"].(*types.AttributeValueMemberS).Value == "acme" {
+			want[item["TransactionID"].(*types.AttributeValueMemberS).Value] = true
+		}
+	}
+	exported := func(out string) map[string]bool {
+		got := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			var entry ledger.LedgerEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("line %q: %v", line, err)
+			}
+			if entry.TenantID != "acme" || got[entry.SystemTransactionID] {
+				t.Errorf("exported %+v", entry)
+			}
+			got[entry.SystemTransactionID] = true
+		}
+		return got
+	}
+
+	var buf bytes.Buffer
+	checkpoint, err := ledger.ExportFullLedger(ctx, db, "acme", &buf, ledger.FullExportOptions{Segments: 3, PageSize: 2, PagesPerSecond: 1000})
+	if err != nil {
+		t.Fatalf("ExportFullLedger() error = %v", err)
+	}
+	if got := exported(buf.String()); len(got) != len(want) || checkpoint.Exported != int64(len(want)) {
+		t.Errorf("exported %d entries, checkpoint %+v, want %d", len(got), checkpoint, len(want))
+	}
+
+	// An interrupted export resumes from its last checkpoint.
+	out := &failingWriter{n: 2}
+	var saved ledger.ExportCheckpoint
+	_, err = ledger.ExportFullLedger(ctx, db, "acme", out, ledger.FullExportOptions{Segments: 3, PageSize: 2,
+		Checkpoint: func(c ledger.ExportCheckpoint) error { saved = c; return nil }})
+	if err == nil || saved.Exported == 0 {
+		t.Fatalf("ExportFullLedger() to a failing writer = %v, checkpoint %+v", err, saved)
+	}
+	out.n = -1
+	checkpoint, err = ledger.ExportFullLedger(ctx, db, "acme", out, ledger.FullExportOptions{Resume: &saved})
+	if err != nil {
+		t.Fatalf("resumed ExportFullLedger() error = %v", err)
+	}
+	if got := exported(out.String()); len(got) != len(want) || checkpoint.Exported != int64(len(want)) {
+		t.Errorf("resumed export has %d entries, checkpoint %+v, want %d", len(got), checkpoint, len(want))
+	}
+	if _, err := ledger.ExportFullLedger(ctx, db, "other", &buf, ledger.FullExportOptions{Resume: &saved}); err == nil {
+		t.Error("ExportFullLedger() resumed a checkpoint of another tenant")
+	}
+}
+
+func TestTransactionTree(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "buyer", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "merchant", 100)
+	transfer := func(req ledger.TransferRequest) (string, error) {
+		t.Helper()
+		req.TenantID = "nil"
+		res, err := ledger.Transfer(ctx, db, req)
+		return res.Data.TransactionID, err
+	}
+	payment, err := transfer(ledger.TransferRequest{FromAccount: "buyer", ToAccount: "merchant", Amount: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := transfer(ledger.TransferRequest{FromAccount: "merchant", ToAccount: "buyer", Amount: 10, ParentTransactionID: payment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transfer(ledger.TransferRequest{FromAccount: "merchant", ToAccount: "buyer", Amount: 1, ParentTransactionID: "missing"}); !errors.Is(err, ledger.ErrTransactionNotFound) {
+		t.Errorf("Transfer() with a missing parent error = %v, want ErrTransactionNotFound", err)
+	}
+	fee, _ := transfer(ledger.TransferRequest{FromAccount: "buyer", ToAccount: "merchant", Amount: 1})
+	unrelated, _ := transfer(ledger.TransferRequest{FromAccount: "buyer", ToAccount: "merchant", Amount: 2})
+
+	if err := ledger.SetParentTransaction(ctx, db, "nil", fee, payment); err != nil {
+		t.Fatalf("SetParentTransaction() error = %v", err)
+	}
+	if err := ledger.SetParentTransaction(ctx, db, "nil", fee, unrelated); err == nil {
+		t.Error("SetParentTransaction() replaced the parent")
+	}
+	if err := ledger.SetParentTransaction(ctx, db, "nil", payment, refund); !errors.Is(err, ledger.ErrTransactionCycle) {
+		t.Errorf("SetParentTransaction() of a cycle error = %v, want ErrTransactionCycle", err)
+	}
+	if err := ledger.LinkTransactions(ctx, db, "nil", refund, refund); err == nil {
+		t.Error("LinkTransactions() linked a transaction to itself")
+	}
+	if err := ledger.LinkTransactions(ctx, db, "nil", refund, "missing"); !errors.Is(err, ledger.ErrTransactionNotFound) {
+		t.Errorf("LinkTransactions() with a missing transaction error = %v, want ErrTransactionNotFound", err)
+	}
+	if err := ledger.LinkTransactions(ctx, db, "nil", refund, unrelated); err != nil {
+		t.Fatalf("LinkTransactions() error = %v", err)
+	}
+
+	// The graph is the same from any of its transactions, rooted at the
+	// transaction's own root.
+	for id, root := range map[string]string{payment: payment, fee: payment, unrelated: unrelated} {
+		tree, err := ledger.GetTransactionTree(ctx, db, "nil", id)
+		if err != nil {
+			t.Fatalf("GetTransactionTree(%s) error = %v", id, err)
+		}
+		if tree.RootID != root || tree.Transactions[0].SystemTransactionID != root || len(tree.Transactions) != 4 || tree.Truncated {
+			t.Fatalf("GetTransactionTree(%s) = %+v", id, tree)
+		}
+		nodes := map[string]ledger.TransactionNode{}
+		for _, node := range tree.Transactions {
+			nodes[node.SystemTransactionID] = node
+		}
+		if children := nodes[payment].Children; len(children) != 2 || !slices.Contains(children, refund) || !slices.Contains(children, fee) {
+			t.Errorf("children of the payment = %v, want the refund and fee", children)
+		}
+		if got := nodes[refund]; got.ParentTransactionID != payment || !slices.Equal(got.RelatedTransactionIDs, []string{unrelated}) {
+			t.Errorf("refund = %+v", got)
+		}
+		if got := nodes[unrelated].RelatedTransactionIDs; !slices.Equal(got, []string{refund}) {
+			t.Errorf("related of the linked transfer = %v, want the refund", got)
+		}
+	}
+	if _, err := ledger.GetTransactionTree(ctx, db, "nil", "missing"); !errors.Is(err, ledger.ErrTransactionNotFound) {
+		t.Errorf("GetTransactionTree() of a missing transaction error = %v", err)
+	}
+}
+
+// accountReadsDB counts the reads of accounts.
+type accountReadsDB struct {
+	*DB
+	reads int
+}
+
+func (db *accountReadsDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if aws.ToString(params.TableName) == ledger.NilUsers {
+		db.reads++
+	}
+	return db.DB.GetItem(ctx, params, optFns...)
+}
+
+// manualClock is a Clock moved by the test.
+type manualClock struct{ now time.Time }
+
+func (c *manualClock) Now() time.Time { return c.now }
+
+func TestAccountCache(t *testing.T) {
+	ctx := context.Background()
+	raw := &accountReadsDB{DB: NewDB()}
+	clock := &manualClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	db := newLedger(raw,
+		ledger.WithClock(clock), ledger.WithAccountCache(2, time.Minute))
+	for account, amount := range map[string]float64{"merchant": 0, "alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	balance := func(account string, want float64, wantReads int) {
+		t.Helper()
+		before := raw.reads
+		got, err := ledger.InquireBalance(ctx, db, "nil", account)
+		if err != nil || got != want {
+			t.Errorf("InquireBalance(%s) = %.2f, %v; want %.2f", account, got, err, want)
+		}
+		if reads := raw.reads - before; reads != wantReads {
+			t.Errorf("InquireBalance(%s) read the account %d times, want %d", account, reads, wantReads)
+		}
+	}
+
+	balance("merchant", 0, 1)
+	balance("merchant", 0, 0)
+	before := raw.reads
+	if user, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "merchant"}); err != nil || user.AccountID != "merchant" || raw.reads != before {
+		t.Errorf("GetAccount() = %+v, %v, with %d reads; want it cached", user, err, raw.reads-before)
+	}
+
+	// A transfer evicts its accounts.
+	if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "nil", FromAccount: "alice", ToAccount: "merchant", Amount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	balance("merchant", 10, 1)
+	balance("merchant", 10, 0)
+
+	// The least recently used account is evicted for a third one.
+	balance("alice", 90, 1)
+	balance("bob", 0, 1)
+	balance("alice", 90, 0)
+	balance("merchant", 10, 1)
+
+	// Cached accounts expire.
+	clock.now = clock.now.Add(2 * time.Minute)
+	balance("merchant", 10, 1)
+
+	// Strongly consistent reads bypass the cache.
+	consistent := newLedger(raw,
+		ledger.WithAccountCache(0, 0), ledger.WithConsistentReads())
+	for i := 0; i < 2; i++ {
+		before := raw.reads
+		if _, err := ledger.InquireBalance(ctx, consistent, "nil", "merchant"); err != nil || raw.reads != before+1 {
+			t.Errorf("consistent InquireBalance() = %v, with %d reads; want 1", err, raw.reads-before)
+		}
+	}
+}
+
+func TestDualControl(t *testing.T) {
+	db := NewDB()
+	ctx := context.Background()
+	alice := ledger.WithActor(ctx, "alice@ops")
+	bob := ledger.WithActor(ctx, "bob@ops")
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", DailySpendLimit: 1000, DualControl: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sensitive settings cannot be changed directly anymore; others can.
+	err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", DailySpendLimit: 5000, DualControl: true})
+	if !errors.Is(err, ledger.ErrDualControl) {
+		t.Fatalf("PutTenantConfig() of a sensitive setting error = %v, want ErrDualControl", err)
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", DailySpendLimit: 1000, DualControl: true, PayoutTTL: 3600}); err != nil {
+		t.Fatalf("PutTenantConfig() of another setting error = %v", err)
+	}
+	if err := ledger.RegisterTenantPublicKey(ctx, db, "nil", "k1", "garbage"); !errors.Is(err, ledger.ErrDualControl) {
+		t.Errorf("RegisterTenantPublicKey() error = %v, want ErrDualControl", err)
+	}
+
+	proposed := ledger.TenantConfig{DailySpendLimit: 5000, DualControl: true, PayoutTTL: 3600, MinimumBalance: 10}
+	if _, err := ledger.ProposeConfigChange(ctx, db, ledger.ConfigChange{Kind: ledger.ConfigChangeTenantConfig, Config: &proposed}); err == nil {
+		t.Error("ProposeConfigChange() without an actor succeeded")
+	}
+	change, err := ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeTenantConfig, Config: &proposed})
+	if err != nil {
+		t.Fatalf("ProposeConfigChange() error = %v", err)
+	}
+	want := []ledger.ConfigFieldChange{{Field: "daily_spend_limit", From: "1000", To: "5000"}, {Field: "minimum_balance", To: "10"}}
+	if change.Status != ledger.ConfigChangePending || !slices.Equal(change.Diff, want) {
+		t.Fatalf("ProposeConfigChange() = %+v, want diff %+v", change, want)
+	}
+	if pending, err := ledger.ListConfigChanges(ctx, db, "nil", ledger.ConfigChangePending); err != nil || len(pending) != 1 {
+		t.Errorf("ListConfigChanges() = %+v, %v", pending, err)
+	}
+
+	if _, err := ledger.ApproveConfigChange(alice, db, "nil", change.ChangeID); err == nil {
+		t.Error("ApproveConfigChange() by the proposer succeeded")
+	}
+	approved, err := ledger.ApproveConfigChange(bob, db, "nil", change.ChangeID)
+	if err != nil || approved.Status != ledger.ConfigChangeApplied || approved.ReviewedBy != "bob@ops" {
+		t.Fatalf("ApproveConfigChange() = %+v, %v", approved, err)
+	}
+	cfg, _ := ledger.GetTenantConfig(ctx, db, "nil")
+	if cfg.DailySpendLimit != 5000 || cfg.MinimumBalance != 10 || cfg.PayoutTTL != 3600 || !cfg.DualControl {
+		t.Errorf("config after approval = %+v", cfg)
+	}
+
+	// A scheduled change applies once it is due, unless what it changes
+	// was changed in the meantime.
+	later := time.Now().Add(time.Hour)
+	proposed.DailySpendLimit = 7000
+	scheduled, err := ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeTenantConfig, Config: &proposed, ActivateAt: later.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposed.DailySpendLimit = 6000
+	stale, err := ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeTenantConfig, Config: &proposed, ActivateAt: later.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ledger.ConfigChange{scheduled, stale} {
+		if c, err := ledger.ApproveConfigChange(bob, db, "nil", c.ChangeID); err != nil || c.Status != ledger.ConfigChangeScheduled {
+			t.Fatalf("ApproveConfigChange() of a scheduled change = %+v, %v", c, err)
+		}
+	}
+	if err := ledger.ActivateConfigChanges(ctx, db, time.Now()); err != nil {
+		t.Fatalf("ActivateConfigChanges() before ActivateAt error = %v", err)
+	}
+	if cfg, _ := ledger.GetTenantConfig(ctx, db, "nil"); cfg.DailySpendLimit != 5000 {
+		t.Errorf("DailySpendLimit before ActivateAt = %v", cfg.DailySpendLimit)
+	}
+	// The first change to apply makes the other stale, whichever it is.
+	if err := ledger.ActivateConfigChanges(ctx, db, later); err == nil {
+		t.Error("ActivateConfigChanges() with a stale change succeeded")
+	}
+	failed, _ := ledger.ListConfigChanges(ctx, db, "nil", ledger.ConfigChangeFailed)
+	applied, _ := ledger.ListConfigChanges(ctx, db, "nil", ledger.ConfigChangeApplied)
+	if len(failed) != 1 || len(applied) != 2 {
+		t.Errorf("after activation %d failed and %d applied, want 1 and 2", len(failed), len(applied))
+	}
+
+	if err := ledger.RejectConfigChange(bob, db, "nil", change.ChangeID, "too late"); err == nil {
+		t.Error("RejectConfigChange() of an applied change succeeded")
+	}
+	if _, err := ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeRevokeKey, KeyID: "k1"}); err == nil {
+		t.Error("ProposeConfigChange() revoking a missing key succeeded")
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	keyChange, err := ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeRegisterKey, KeyID: "k1", PublicKey: pemKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.RejectConfigChange(bob, db, "nil", keyChange.ChangeID, "unknown key"); err != nil {
+		t.Fatalf("RejectConfigChange() error = %v", err)
+	}
+	if _, err := ledger.ApproveConfigChange(bob, db, "nil", keyChange.ChangeID); err == nil {
+		t.Error("ApproveConfigChange() of a rejected change succeeded")
+	}
+	keyChange, _ = ledger.ProposeConfigChange(alice, db, ledger.ConfigChange{Kind: ledger.ConfigChangeRegisterKey, KeyID: "k1", PublicKey: pemKey})
+	if _, err := ledger.ApproveConfigChange(bob, db, "nil", keyChange.ChangeID); err != nil {
+		t.Fatalf("ApproveConfigChange() of a key error = %v", err)
+	}
+	if keys, err := ledger.GetTenantPublicKeys(ctx, db, "nil"); err != nil || len(keys) != 1 || keys[0].PublicKey != pemKey {
+		t.Errorf("GetTenantPublicKeys() = %+v, %v", keys, err)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	metrics := &recordingMetrics{values: map[string]float64{}}
+	db := newLedger(NewDB(), ledger.WithMetrics(metrics))
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0, "carol": 0} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount)
+	}
+	if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.CloseAccountingDay(ctx, db, "nil", time.Now().Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []ledger.Anomaly
+	defer func(alerter ledger.AnomalyAlerter) { ledger.DefaultAnomalyAlerter = alerter }(ledger.DefaultAnomalyAlerter)
+	ledger.DefaultAnomalyAlerter = func(ctx context.Context, a ledger.Anomaly) error {
+		alerts = append(alerts, a)
+		return nil
+	}
+
+	w := &ledger.Watchdog{DB: db, Tenants: []string{"nil"}}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		check, err := w.CheckNext(ctx, "nil")
+		if err != nil || !check.Consistent() || check.Reconciliation == nil {
+			t.Fatalf("CheckNext() = %+v, %v", check, err)
+		}
+		seen[check.AccountID] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("a sweep checked %v, want every account", seen)
+	}
+	if check, _ := w.CheckNext(ctx, "empty"); check != nil {
+		t.Errorf("CheckNext() of a tenant without accounts = %+v", check)
+	}
+
+	db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ledger.NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+			"AccountID": &types.AttributeValueMemberS{Value: "bob"},
+		},
+		UpdateExpression:          aws.String("SET amount = :amount"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":amount": &types.AttributeValueMemberN{Value: "50"}},
+	})
+	for i := 0; i < 2; i++ {
+		if check, err := w.CheckAccount(ctx, "nil", "bob"); err != nil || check.Consistent() {
+			t.Fatalf("CheckAccount() of a tampered account = %+v, %v", check, err)
+		}
+	}
+	anomalies, err := ledger.ListAnomalies(ctx, db, "nil", time.Now().Add(-time.Minute))
+	if err != nil || len(anomalies) != 1 || len(alerts) != 1 {
+		t.Fatalf("anomalies = %+v, %v; alerts = %+v", anomalies, err, alerts)
+	}
+	if a := anomalies[0]; a.Segment != "account:bob" || a.Metric != ledger.AnomalyMetricBalance || a.Observed != 50 || a.Expected != 10 {
+		t.Errorf("anomaly = %+v", a)
+	}
+	if metrics.values[ledger.MetricConsistencyChecks] != 5 {
+		t.Errorf("%s = %v, want 5", ledger.MetricConsistencyChecks, metrics.values[ledger.MetricConsistencyChecks])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	w.Interval = time.Millisecond
+	if err := w.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() = %v", err)
+	}
+}
+
+// faultyDB fails the writes for which fail returns true, given the tables
+// they write to: one for a put, that of each item for a transaction.
+type faultyDB struct {
+	*DB
+	fail func(tables []string) bool
+}
+
+func (db *faultyDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if db.fail != nil && db.fail([]string{aws.ToString(params.TableName)}) {
+		return nil, errors.New("ProvisionedThroughputExceededException: injected")
+	}
+	return db.DB.PutItem(ctx, params, optFns...)
+}
+
+func (db *faultyDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	var tables []string
+	for _, item := range params.TransactItems {
+		switch {
+		case item.Put != nil:
+			tables = append(tables, aws.ToString(item.Put.TableName))
+		case item.Update != nil:
+			tables = append(tables, aws.ToString(item.Update.TableName))
+		case item.Delete != nil:
+			tables = append(tables, aws.ToString(item.Delete.TableName))
+		case item.ConditionCheck != nil:
+			tables = append(tables, aws.ToString(item.ConditionCheck.TableName))
+		}
+	}
+	if db.fail != nil && db.fail(tables) {
+		return nil, errors.New("ProvisionedThroughputExceededException: injected")
+	}
+	return db.DB.TransactWriteItems(ctx, params, optFns...)
+}
+
+// writesTo is a faultyDB fail func failing the writes to table.
+func writesTo(table string) func([]string) bool {
+	return func(tables []string) bool { return slices.Contains(tables, table) }
+}
+
+func TestFailedOperations(t *testing.T) {
+	ctx := context.Background()
+	faulty := &faultyDB{DB: NewDB()}
+	db := newLedger(faulty)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+
+	// The record of a refused transfer cannot be stored.
+	faulty.fail = writesTo(ledger.TransactionsTable)
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "ghost", Amount: 10})
+	if err == nil || res.Code != "user_not_found" {
+		t.Fatalf("Transfer() to a missing account = %+v, %v", res, err)
+	}
+	// The refund of an escrow debit whose credit failed cannot be made: it is
+	// the transfer's second journal, after the debit.
+	journals := 0
+	faulty.fail = func(tables []string) bool {
+		if !slices.Contains(tables, ledger.AccountEventsTable) {
+			return false
+		}
+		journals++
+		return journals == 2
+	}
+	if _, err := ledger.EscrowTransferCredits(ctx, db, ledger.EscrowTransaction{FromTenantID: "nil", FromAccount: "alice", ToTenantID: "bank", ToAccount: "ghost", Amount: 30}); err == nil {
+		t.Fatal("EscrowTransferCredits() to a missing account succeeded")
+	}
+	faulty.fail = nil
+	if alice, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); alice.Amount != 70 {
+		t.Fatalf("alice has %.2f before the replay, want 70", alice.Amount)
+	}
+
+	ops, err := ledger.ListFailedOperations(ctx, db, "nil")
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("ListFailedOperations() = %+v, %v", ops, err)
+	}
+	kinds := map[string]ledger.FailedOperation{}
+	for _, op := range ops {
+		kinds[op.Kind] = op
+	}
+	if op := kinds[ledger.FailedOpSaveRecord]; op.Record == nil || op.Record.Status != ledger.TransactionFailed || op.Error == "" {
+		t.Errorf("dead-lettered record = %+v", op)
+	}
+	if op := kinds[ledger.FailedOpRefund]; op.AccountID != "alice" || op.Amount != 30 || op.Status != ledger.FailedOperationPending {
+		t.Errorf("dead-lettered refund = %+v", op)
+	}
+
+	faulty.fail = writesTo(ledger.FailedOperationsTable)
+	if n, err := ledger.ReplayFailedOperations(ctx, db); n != 0 || err == nil {
+		t.Errorf("ReplayFailedOperations() while DynamoDB fails = %d, %v", n, err)
+	}
+	faulty.fail = nil
+	if n, err := ledger.ReplayFailedOperations(ctx, db); n != 2 || err != nil {
+		t.Fatalf("ReplayFailedOperations() = %d, %v", n, err)
+	}
+	if n, err := ledger.ReplayFailedOperations(ctx, db); n != 0 || err != nil {
+		t.Errorf("second ReplayFailedOperations() = %d, %v", n, err)
+	}
+	if alice, _ := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); alice.Amount != 100 {
+		t.Errorf("alice has %.2f after the replay, want 100", alice.Amount)
+	}
+	// The escrow debit and its refund, a reversal journal, are chained onto
+	// alice's ledger.
+	entries, _ := ledger.GetLedgerEntries(ctx, db, "nil", "alice")
+	reversals := 0
+	for _, e := range entries {
+		if e.Type == ledger.LegReversal && e.Amount == 30 && e.JournalID == kinds[ledger.FailedOpRefund].TransactionID {
+			reversals++
+		}
+	}
+	if reversals != 1 {
+		t.Errorf("alice has %d reversal entries of the refund, want 1: %+v", reversals, entries)
+	}
+	if report, err := ledger.VerifyLedgerIntegrity(ctx, db, "nil", "alice"); err != nil || !report.Valid() || report.Entries != 2 {
+		t.Errorf("VerifyLedgerIntegrity(alice) = %+v, %v", report, err)
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", kinds[ledger.FailedOpSaveRecord].TransactionID)
+	if err != nil || tx.Status == nil || *tx.Status != ledger.TransactionFailed {
+		t.Errorf("replayed record = %+v, %v", tx, err)
+	}
+	ops, _ = ledger.ListFailedOperations(ctx, db, "nil")
+	for _, op := range ops {
+		if op.Status != ledger.FailedOperationReplayed || op.Attempts != 2 {
+			t.Errorf("replayed operation = %+v", op)
+		}
+	}
+}
+
+func TestReserveProof(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 25.5, "carol": 0, "treasury": 1000} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount)
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", TreasuryAccount: "treasury"}); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	proof, err := ledger.PublishReserveProof(ctx, db, "nil", "reserves-1", priv)
+	if err != nil {
+		t.Fatalf("PublishReserveProof() error = %v", err)
+	}
+	if proof.Accounts != 3 || proof.Liabilities["SDG"] != 125.5 || proof.MerkleRoot == "" {
+		t.Errorf("proof = %+v", proof)
+	}
+	latest, err := ledger.GetLatestReserveProof(ctx, db, "nil")
+	if err != nil || latest == nil || latest.ProofID != proof.ProofID {
+		t.Fatalf("GetLatestReserveProof() = %+v, %v", latest, err)
+	}
+	if err := ledger.VerifyReserveProof(*latest, pemKey); err != nil {
+		t.Errorf("VerifyReserveProof() error = %v", err)
+	}
+	forged := *latest
+	forged.Liabilities = map[string]float64{"SDG": 1}
+	if err := ledger.VerifyReserveProof(forged, pemKey); !errors.Is(err, ledger.ErrSignatureInvalid) {
+		t.Errorf("VerifyReserveProof() of altered liabilities = %v", err)
+	}
+
+	inclusion, err := ledger.GetReserveInclusion(ctx, db, "nil", proof.ProofID, "bob")
+	if err != nil || inclusion.Balance != 25.5 || !inclusion.Verify(*latest) {
+		t.Errorf("GetReserveInclusion(bob) = %+v, %v", inclusion, err)
+	}
+	if _, err := ledger.GetReserveInclusion(ctx, db, "nil", proof.ProofID, "treasury"); err == nil {
+		t.Error("the treasury account is in the proof")
+	}
+}
+
+func TestPIIEncryption(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	keyring := &ledger.StaticKeyring{}
+	if err := keyring.AddKey("acme", "k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetIndexKey("acme", bytes.Repeat([]byte{9}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	db := newLedger(mem, ledger.WithPIIEncryption(keyring))
+
+	// An account written before encryption was turned on.
+	if err := ledger.CreateAccount(ctx, newLedger(mem), "acme", ledger.User{AccountID: "old", MobileNumber: "0911111111"}); err != nil {
+		t.Fatal(err)
+	}
+	alice := ledger.User{AccountID: "alice", MobileNumber: "0912345678", IDNumber: "A-1234", Amount: 10}
+	if err := ledger.CreateAccount(ctx, db, "acme", alice); err != nil {
+		t.Fatal(err)
+	}
+	stored := func(account, attr string) string {
+		t.Helper()
+		out, err := mem.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(ledger.NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: "acme"},
+				"AccountID": &types.AttributeValueMemberS{Value: account},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Item[attr].(*types.AttributeValueMemberS).Value
+	}
+	if v := stored("alice", "mobile_number"); !strings.HasPrefix(v, "enc:v1:k1:") {
+		t.Errorf("stored mobile number = %q, want it encrypted", v)
+	}
+	if v := stored("alice", "pic_id_card"); v != "" {
+		t.Errorf("empty picture stored as %q", v)
+	}
+	got, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "acme", AccountID: "alice"})
+	if err != nil || got.MobileNumber != alice.MobileNumber || got.IDNumber != alice.IDNumber {
+		t.Fatalf("GetAccount() = %+v, %v", got, err)
+	}
+	if _, err := ledger.GetAccount(ctx, newLedger(mem), ledger.TransactionEntry{TenantID: "acme", AccountID: "alice"}); err == nil {
+		t.Error("GetAccount() without the keyring decrypted the account")
+	}
+
+	// Transfers do not need the keys.
+	if _, err := ledger.Transfer(ctx, newLedger(mem), ledger.TransferRequest{TenantID: "acme", FromAccount: "alice", ToAccount: "old", Amount: 5}); err != nil {
+		t.Fatalf("Transfer() without the keyring: %v", err)
+	}
+
+	if err := keyring.AddKey("acme", "k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ledger.RotatePIIKeys(ctx, db, "acme"); n != 2 || err != nil {
+		t.Fatalf("RotatePIIKeys() = %d, %v", n, err)
+	}
+	for _, account := range []string{"alice", "old"} {
+		if v := stored(account, "mobile_number"); !strings.HasPrefix(v, "enc:v1:k2:") {
+			t.Errorf("mobile number of %s after rotation = %q", account, v)
+		}
+	}
+	if n, err := ledger.RotatePIIKeys(ctx, db, "acme"); n != 0 || err != nil {
+		t.Errorf("second RotatePIIKeys() = %d, %v", n, err)
+	}
+	got, err = ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "acme", AccountID: "old"})
+	if err != nil || got.MobileNumber != "0911111111" || got.Amount != 5 {
+		t.Errorf("GetAccount() after rotation = %+v, %v", got, err)
+	}
+}
+
+func TestFindAccount(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	plain := newLedger(mem)
+	for _, user := range []ledger.User{
+		{AccountID: "alice", FullName: "Alice Mohamed Osman", MobileNumber: "0912345678", IDNumber: "A-1234", IsVerified: true},
+		{AccountID: "bob", FullName: "Bob", MobileNumber: "0998765432"},
+	} {
+		if err := ledger.CreateAccount(ctx, plain, "acme", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.CreateAccount(ctx, plain, "other", ledger.User{AccountID: "alice", MobileNumber: "0912345678"}); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := ledger.FindAccount(ctx, plain, "acme", ledger.AccountQuery{MobileNumber: " 0912345678"})
+	want := ledger.AccountMatch{TenantID: "acme", AccountID: "alice", FullName: "Alice M. O.", MobileNumber: "*******678", IDNumber: "***234", IsVerified: true}
+	if err != nil || len(matches) != 1 || matches[0] != want {
+		t.Fatalf("FindAccount() by mobile number = %+v, %v", matches, err)
+	}
+	if matches, err := ledger.FindAccount(ctx, plain, "acme", ledger.AccountQuery{IDNumber: "A-1234"}); err != nil || len(matches) != 1 || matches[0].AccountID != "alice" {
+		t.Errorf("FindAccount() by id number = %+v, %v", matches, err)
+	}
+	if matches, err := ledger.FindAccount(ctx, plain, "acme", ledger.AccountQuery{MobileNumber: "0900000000"}); err != nil || len(matches) != 0 {
+		t.Errorf("FindAccount() of an unknown number = %+v, %v", matches, err)
+	}
+	if _, err := ledger.FindAccount(ctx, plain, "acme", ledger.AccountQuery{}); err == nil {
+		t.Error("FindAccount() without a number succeeded")
+	}
+
+	// Turning encryption on rewrites the lookups as HMACs.
+	keyring := &ledger.StaticKeyring{}
+	keyring.AddKey("acme", "k1", bytes.Repeat([]byte{1}, 32))
+	keyring.SetIndexKey("acme", bytes.Repeat([]byte{2}, 32))
+	encrypted := newLedger(mem, ledger.WithPIIEncryption(keyring))
+	if matches, err := ledger.FindAccount(ctx, encrypted, "acme", ledger.AccountQuery{MobileNumber: "0998765432"}); err != nil || len(matches) != 0 {
+		t.Errorf("FindAccount() before the accounts are rotated = %+v, %v", matches, err)
+	}
+	if n, err := ledger.RotatePIIKeys(ctx, encrypted, "acme"); n != 2 || err != nil {
+		t.Fatalf("RotatePIIKeys() = %d, %v", n, err)
+	}
+	if matches, err := ledger.FindAccount(ctx, encrypted, "acme", ledger.AccountQuery{MobileNumber: "0998765432"}); err != nil || len(matches) != 1 || matches[0].MobileNumber != "*******432" {
+		t.Errorf("FindAccount() of an encrypted account = %+v, %v", matches, err)
+	}
+	if err := ledger.CreateAccount(ctx, encrypted, "acme", ledger.User{AccountID: "carol", IDNumber: "C77"}); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := ledger.FindAccount(ctx, encrypted, "acme", ledger.AccountQuery{IDNumber: "C77"}); err != nil || len(matches) != 1 || matches[0].IDNumber != "***" {
+		t.Errorf("FindAccount() of a new encrypted account = %+v, %v", matches, err)
+	}
+	if n, err := ledger.IndexAccounts(ctx, encrypted, "acme"); n != 0 || err != nil {
+		t.Errorf("IndexAccounts() of indexed accounts = %d, %v", n, err)
+	}
+}
+
+func TestPaymentRequests(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "shop", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 10)
+
+	if _, err := ledger.CreatePaymentRequest(ctx, db, "nil", "ghost", 10, time.Now().Add(time.Hour), "order-1"); err == nil {
+		t.Error("CreatePaymentRequest() for a missing merchant succeeded")
+	}
+	request, err := ledger.CreatePaymentRequest(ctx, db, "nil", "shop", 25, time.Now().Add(time.Hour), "order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A payer who cannot afford it leaves it pending.
+	if res, err := ledger.PayRequest(ctx, db, "nil", "bob", request.RequestID); err == nil || res.Code != "insufficient_balance" {
+		t.Fatalf("PayRequest() by bob = %+v, %v", res, err)
+	}
+	if got, _ := ledger.GetPaymentRequest(ctx, db, "nil", request.RequestID); got.Status != ledger.PaymentRequestPending || got.LastError != "insufficient_balance" {
+		t.Errorf("request after a refused payment = %+v", got)
+	}
+	res, err := ledger.PayRequest(ctx, db, "nil", "alice", request.RequestID)
+	if err != nil || res.Status != "success" {
+		t.Fatalf("PayRequest() by alice = %+v, %v", res, err)
+	}
+	got, _ := ledger.GetPaymentRequest(ctx, db, "nil", request.RequestID)
+	if got.Status != ledger.PaymentRequestPaid || got.PaidBy != "alice" || got.TransactionID != res.Data.TransactionID {
+		t.Errorf("paid request = %+v", got)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "shop"); balance != 25 {
+		t.Errorf("shop has %.2f, want 25", balance)
+	}
+	if _, err := ledger.PayRequest(ctx, db, "nil", "alice", request.RequestID); !errors.Is(err, ledger.ErrPaymentRequestNotPayable) {
+		t.Errorf("paying a paid request: %v", err)
+	}
+
+	soon, _ := ledger.CreatePaymentRequest(ctx, db, "nil", "shop", 5, time.Now().Add(time.Second), "order-2")
+	cancelled, _ := ledger.CreatePaymentRequest(ctx, db, "nil", "shop", 5, time.Now().Add(time.Hour), "order-3")
+	if err := ledger.CancelPaymentRequest(ctx, db, "nil", "alice", cancelled.RequestID); err == nil {
+		t.Error("CancelPaymentRequest() by another account succeeded")
+	}
+	if err := ledger.CancelPaymentRequest(ctx, db, "nil", "shop", cancelled.RequestID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ledger.ExpirePaymentRequests(ctx, db, time.Now().Add(time.Minute)); n != 1 || err != nil {
+		t.Fatalf("ExpirePaymentRequests() = %d, %v", n, err)
+	}
+	if _, err := ledger.PayRequest(ctx, db, "nil", "alice", soon.RequestID); !errors.Is(err, ledger.ErrPaymentRequestNotPayable) {
+		t.Errorf("paying an expired request: %v", err)
+	}
+
+	all, err := ledger.ListPaymentRequests(ctx, db, "nil", "shop", "")
+	if err != nil || len(all) != 3 {
+		t.Fatalf("ListPaymentRequests() = %+v, %v", all, err)
+	}
+	statuses := map[string]string{}
+	for _, r := range all {
+		statuses[r.Reference] = r.Status
+	}
+	want := map[string]string{"order-1": ledger.PaymentRequestPaid, "order-2": ledger.PaymentRequestExpired, "order-3": ledger.PaymentRequestCancelled}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if paid, err := ledger.ListPaymentRequests(ctx, db, "nil", "shop", ledger.PaymentRequestPaid); err != nil || len(paid) != 1 {
+		t.Errorf("ListPaymentRequests(paid) = %+v, %v", paid, err)
+	}
+}
+
+func TestPayFromQR(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "shop", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+
+	static, err := ledger.GenerateQR(ledger.QRCode{MerchantID: "shop", MerchantName: "Corner Shop", MerchantCity: "Khartoum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ledger.PayFromQR(ctx, db, "nil", "alice", static, 0); err == nil || res.Code != "invalid_amount" {
+		t.Errorf("PayFromQR() of a static code without an amount = %+v, %v", res, err)
+	}
+	if res, err := ledger.PayFromQR(ctx, db, "nil", "alice", static, 15); err != nil || res.Status != "success" {
+		t.Fatalf("PayFromQR() of a static code = %+v, %v", res, err)
+	}
+	if res, err := ledger.PayFromQR(ctx, db, "other", "alice", static, 15); !errors.Is(err, ledger.ErrInvalidQR) {
+		t.Errorf("PayFromQR() of another tenant's code = %+v, %v", res, err)
+	}
+
+	request, _ := ledger.CreatePaymentRequest(ctx, db, "nil", "shop", 20, time.Now().Add(time.Hour), "order-9")
+	dynamic, err := ledger.GenerateQR(ledger.PaymentRequestQR(request, "Corner Shop", "Khartoum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ledger.PayFromQR(ctx, db, "nil", "alice", dynamic, 0); err != nil || res.Data.Amount != 20 {
+		t.Fatalf("PayFromQR() of a payment request = %+v, %v", res, err)
+	}
+	if got, _ := ledger.GetPaymentRequest(ctx, db, "nil", request.RequestID); got.Status != ledger.PaymentRequestPaid {
+		t.Errorf("request paid by QR is %s", got.Status)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "shop"); balance != 35 {
+		t.Errorf("shop has %.2f, want 35", balance)
+	}
+}
+
+func TestSettlement(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	for _, tenant := range []string{"nil", "bank", "wallet"} {
+		ledger.CreateAccountWithBalance(ctx, db, tenant, "settlement", 0)
+		if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: tenant, SettlementAccount: "settlement"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "bank", "bob", 0)
+
+	if _, err := ledger.EscrowTransferCredits(ctx, db, ledger.EscrowTransaction{FromTenantID: "nil", FromAccount: "alice", ToTenantID: "bank", ToAccount: "bob", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// Both sides of the escrow transfer are chained onto their accounts.
+	for tenant, account := range map[string]string{"nil": "alice", "bank": "bob"} {
+		report, err := ledger.VerifyLedgerIntegrity(ctx, db, tenant, account)
+		if err != nil || !report.Valid() || report.Unchained != 0 || report.Entries != 1 {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+	today := time.Now().UTC().Format(ledger.SettlementPeriodFormat)
+	obligations, err := ledger.GetObligations(ctx, db, today)
+	if err != nil || len(obligations) != 1 || obligations[0].Pair != "bank#nil" || obligations[0].Amount != -30 {
+		t.Fatalf("GetObligations() = %+v, %v; want bank owed 30 by nil", obligations, err)
+	}
+	if _, err := ledger.RunSettlement(ctx, db, today); err == nil {
+		t.Error("RunSettlement() of a period that has not ended succeeded")
+	}
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	period := yesterday.Format(ledger.SettlementPeriodFormat)
+	for _, o := range []struct {
+		from, to string
+		amount   float64
+	}{{"nil", "bank", 50}, {"bank", "nil", 20}, {"wallet", "bank", 10}, {"nil", "wallet", 5}} {
+		if err := ledger.AccumulateInterTenantObligations(ctx, db, o.from, o.to, o.amount, yesterday); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reported *ledger.SettlementBatch
+	defer func(reporter ledger.SettlementReporter) { ledger.DefaultSettlementReporter = reporter }(ledger.DefaultSettlementReporter)
+	ledger.DefaultSettlementReporter = func(ctx context.Context, batch *ledger.SettlementBatch) error {
+		reported = batch
+		return nil
+	}
+	batch, err := ledger.RunSettlement(ctx, db, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nil owes 50 - 20 + 5 = 35, wallet 10 - 5 = 5; bank is owed 40.
+	want := map[string]float64{"nil": -35, "bank": 40, "wallet": -5}
+	for tenant, net := range want {
+		if batch.Net[tenant] != net {
+			t.Errorf("net of %s = %.2f, want %.2f", tenant, batch.Net[tenant], net)
+		}
+		if balance, _ := ledger.InquireBalance(ctx, db, tenant, "settlement"); balance != net {
+			t.Errorf("settlement account of %s has %.2f, want %.2f", tenant, balance, net)
+		}
+	}
+	if batch.Status != ledger.SettlementCompleted || len(batch.Positions) != 2 || len(batch.Settled) != 2 {
+		t.Errorf("batch = %+v, want 2 settled positions", batch)
+	}
+	if reported == nil || !strings.Contains(reported.Report(), "nil                  -> bank") {
+		t.Errorf("report = %v", reported)
+	}
+
+	again, err := ledger.RunSettlement(ctx, db, period)
+	if err != nil || again.Status != ledger.SettlementCompleted {
+		t.Fatalf("RunSettlement() again = %+v, %v", again, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "bank", "settlement"); balance != 40 {
+		t.Errorf("bank settlement account has %.2f after a rerun, want 40", balance)
+	}
+	// Settlement entries are chained like any other.
+	for tenant := range want {
+		report, err := ledger.VerifyLedgerIntegrity(ctx, db, tenant, "settlement")
+		if err != nil || !report.Valid() || report.Unchained != 0 || report.Entries == 0 {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", tenant, report, err)
+		}
+	}
+}
+
+// readsDB records, per account, whether its last NilUsers read was strongly
+// consistent.
+type readsDB struct {
+	*DB
+	consistent map[string]bool
+}
+
+func (db *readsDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if aws.ToString(params.TableName) == ledger.NilUsers {
+		if account, ok := params.Key["AccountID"].(*types.AttributeValueMemberS); ok {
+			db.consistent[account.Value] = aws.ToBool(params.ConsistentRead)
+		}
+	}
+	return db.DB.GetItem(ctx, params, optFns...)
+}
+
+func TestConsistentReads(t *testing.T) {
+	ctx := context.Background()
+	db := &readsDB{DB: NewDB(), consistent: map[string]bool{}}
+	eventual := newLedger(db)
+	ledger.CreateAccountWithBalance(ctx, eventual, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, eventual, "nil", "bob", 0)
+
+	if res, err := ledger.Transfer(ctx, eventual, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	if !db.consistent["alice"] || db.consistent["bob"] {
+		t.Errorf("transfer reads consistent = %v, want only the sender's", db.consistent)
+	}
+	ledger.InquireBalance(ctx, eventual, "nil", "bob")
+	if db.consistent["bob"] {
+		t.Error("InquireBalance() read consistently without WithConsistentReads")
+	}
+
+	consistent := newLedger(db, ledger.WithConsistentReads())
+	if balance, err := ledger.InquireBalance(ctx, consistent, "nil", "bob"); err != nil || balance != 10 || !db.consistent["bob"] {
+		t.Errorf("InquireBalance() = %.2f, %v, consistent %v", balance, err, db.consistent["bob"])
+	}
+	db.consistent["bob"] = false
+	if _, err := ledger.GetAccount(ctx, consistent, ledger.TransactionEntry{TenantID: "nil", AccountID: "bob"}); err != nil || !db.consistent["bob"] {
+		t.Errorf("GetAccount() = %v, consistent %v", err, db.consistent["bob"])
+	}
+}
+
+func TestScreening(t *testing.T) {
+	ctx := context.Background()
+	var screened []ledger.TransferRequest
+	hook := ledger.ScreeningHookFunc(func(ctx context.Context, req ledger.TransferRequest) error {
+		screened = append(screened, req)
+		switch req.ToAccount {
+		case "sanctioned":
+			return &ledger.ScreeningRejection{ReasonCode: "sanctions_match", Reason: "listed on the UN sanctions list"}
+		case "offline":
+			return errors.New("screening service unavailable")
+		}
+		return nil
+	})
+	db := newLedger(NewDB(), ledger.WithScreening(hook))
+	for _, account := range []string{"bob", "sanctioned", "offline"} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, 0)
+	}
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10, PurposeCode: "bribes"}); err == nil || res.Code != "invalid_purpose_code" {
+		t.Errorf("Transfer() with an unknown purpose code = %+v, %v", res, err)
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10, PurposeCode: ledger.PurposeFamilySupport})
+	if err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	if tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", res.Data.TransactionID); err != nil || tx.PurposeCode != ledger.PurposeFamilySupport {
+		t.Errorf("GetTransaction() = %+v, %v; want the purpose code stored", tx, err)
+	}
+
+	res, err = ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "sanctioned", Amount: 10})
+	if !errors.Is(err, ledger.ErrTransferBlocked) || res.Code != "transfer_blocked" || res.Details != "sanctions_match" {
+		t.Fatalf("Transfer() to a sanctioned account = %+v, %v", res, err)
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "alice", res.Data.TransactionID)
+	if err != nil || tx.Status == nil || *tx.Status != ledger.TransactionBlocked || tx.BlockReason != "sanctions_match" {
+		t.Errorf("blocked transaction = %+v, %v", tx, err)
+	}
+
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "offline", Amount: 10}); err == nil || res.Code != "screening_error" {
+		t.Errorf("Transfer() with the screening hook failing = %+v, %v", res, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 90 {
+		t.Errorf("alice has %.2f, want 90", balance)
+	}
+	if len(screened) != 3 {
+		t.Errorf("screened %d transfers, want 3", len(screened))
+	}
+}
+
+func TestSubAccounts(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alicia", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "fees", 0)
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", FeeSchedule: &ledger.FeeSchedule{Type: ledger.FeeFlat, Flat: 1, CollectionAccount: "fees"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wallet := range []string{"savings", "escrow"} {
+		if err := ledger.CreateSubAccount(ctx, db, "nil", "alice", wallet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.CreateSubAccount(ctx, db, "nil", "alice", "savings"); err == nil {
+		t.Error("CreateSubAccount() of an existing wallet succeeded")
+	}
+	if err := ledger.CreateSubAccount(ctx, db, "nil", "ghost", "savings"); err == nil {
+		t.Error("CreateSubAccount() under a missing account succeeded")
+	}
+	ledger.CreateSubAccount(ctx, db, "nil", "alicia", "savings")
+
+	if res, err := ledger.TransferBetweenSubAccounts(ctx, db, "nil", "alice", ledger.MainWallet, "savings", 40); err != nil {
+		t.Fatalf("TransferBetweenSubAccounts() = %+v, %v", res, err)
+	}
+	if res, err := ledger.TransferBetweenSubAccounts(ctx, db, "nil", "alice", "savings", "escrow", 15); err != nil {
+		t.Fatalf("TransferBetweenSubAccounts() = %+v, %v", res, err)
+	}
+	if res, err := ledger.TransferBetweenSubAccounts(ctx, db, "nil", "alice", "savings", "savings", 1); err == nil {
+		t.Errorf("TransferBetweenSubAccounts() to the same wallet = %+v", res)
+	}
+	for wallet, want := range map[string]float64{ledger.MainWallet: 60, "savings": 25, "escrow": 15} {
+		if balance, err := ledger.InquireSubAccountBalance(ctx, db, "nil", "alice", wallet); err != nil || balance != want {
+			t.Errorf("balance of %s = %.2f, %v; want %.2f without fees", wallet, balance, err, want)
+		}
+	}
+
+	wallets, err := ledger.ListSubAccounts(ctx, db, "nil", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range wallets {
+		got = append(got, w.WalletID+"="+w.AccountID)
+	}
+	if want := "main=alice escrow=alice#escrow savings=alice#savings"; strings.Join(got, " ") != want {
+		t.Errorf("ListSubAccounts() = %v, want %s", got, want)
+	}
+	if p, err := ledger.GetPortfolio(ctx, db, "nil", "alice"); err != nil || p.Total != 100 {
+		t.Errorf("GetPortfolio() = %+v, %v; want the wallets included", p, err)
+	}
+}
+
+func TestEscrowTransfer(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "buyer", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "seller", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "escrow", 0)
+	req := ledger.EscrowTransferRequest{FromAccount: "buyer", ToAccount: "seller", Amount: 40, Arbitrator: "market", Narrative: "order 17"}
+	if _, err := ledger.EscrowTransfer(ctx, db, req); err == nil {
+		t.Error("EscrowTransfer() without an escrow holding account succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", EscrowHoldingAccount: "escrow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := ledger.EscrowTransfer(ctx, db, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunded, err := ledger.EscrowTransfer(ctx, db, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "escrow"); balance != 80 {
+		t.Errorf("escrow holds %.2f, want 80", balance)
+	}
+	funding, err := ledger.GetTransaction(ctx, db, "nil", "buyer", released.EscrowID)
+	if err != nil || funding.Status == nil || *funding.Status != ledger.TransactionPending || funding.Metadata["escrow_id"] != released.EscrowID {
+		t.Fatalf("funding transaction = %+v, %v; want pending", funding, err)
+	}
+
+	if _, err := ledger.ReleaseEscrow(ctx, db, "nil", released.EscrowID, "buyer", "delivered"); !errors.Is(err, ledger.ErrNotArbitrator) {
+		t.Errorf("ReleaseEscrow() by the buyer: %v, want ErrNotArbitrator", err)
+	}
+	hold, err := ledger.ReleaseEscrow(ctx, db, "nil", released.EscrowID, "market", "delivered")
+	if err != nil || hold.Status != ledger.EscrowReleased {
+		t.Fatalf("ReleaseEscrow() = %+v, %v", hold, err)
+	}
+	if _, err := ledger.RefundEscrow(ctx, db, "nil", released.EscrowID, "market", "changed my mind"); !errors.Is(err, ledger.ErrEscrowNotHeld) {
+		t.Errorf("RefundEscrow() of a released escrow: %v, want ErrEscrowNotHeld", err)
+	}
+	if _, err := ledger.RefundEscrow(ctx, db, "nil", refunded.EscrowID, "market", "not delivered"); err != nil {
+		t.Fatal(err)
+	}
+
+	for account, want := range map[string]float64{"buyer": 60, "seller": 40, "escrow": 0} {
+		if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+			t.Errorf("%s has %.2f, want %.2f", account, balance, want)
+		}
+	}
+	funding, err = ledger.GetTransaction(ctx, db, "nil", "buyer", released.EscrowID)
+	if err != nil || *funding.Status != ledger.TransactionCompleted || len(funding.StatusHistory) != 1 || funding.StatusHistory[0].Actor != "market" {
+		t.Errorf("funding transaction after release = %+v, %v", funding, err)
+	}
+	settlement, err := ledger.GetTransaction(ctx, db, "nil", "seller", hold.SettlementID)
+	if err != nil || settlement.ToAccount != "seller" || settlement.Comment != ledger.NarrativeEscrowReleased {
+		t.Errorf("release transaction = %+v, %v", settlement, err)
+	}
+
+	// The escrow passes the checks of a transfer to the seller before the
+	// money is held.
+	req.Amount = 10.005
+	if _, err := ledger.EscrowTransfer(ctx, db, req); err == nil {
+		t.Error("EscrowTransfer() of a sub-cent amount succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", EscrowHoldingAccount: "escrow", LargeTransferThreshold: 10}); err != nil {
+		t.Fatal(err)
+	}
+	req.Amount = 20
+	if _, err := ledger.EscrowTransfer(ctx, db, req); !errors.Is(err, ledger.ErrTransferDelayed) {
+		t.Errorf("EscrowTransfer() above the large transfer threshold error = %v, want ErrTransferDelayed", err)
+	}
+	if _, err := ledger.MarkDormantAccounts(ctx, db, "nil", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.EscrowTransfer(ctx, db, req); !errors.Is(err, ledger.ErrAccountDormant) {
+		t.Errorf("EscrowTransfer() from a dormant account error = %v, want ErrAccountDormant", err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "buyer"); balance != 60 {
+		t.Errorf("buyer has %.2f after the refused escrows, want 60", balance)
+	}
+}
+
+func TestTenantAnalytics(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB(), ledger.WithAnalytics())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 0)
+	for _, transfer := range []struct {
+		to     string
+		amount float64
+	}{{"bob", 30}, {"carol", 20}, {"bob", 500}} {
+		ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "nil", FromAccount: "alice", ToAccount: transfer.to, Amount: transfer.amount})
+	}
+
+	now := time.Now()
+	days, err := ledger.GetTenantAnalytics(ctx, db, "nil", now.AddDate(0, 0, -1), now, ledger.AnalyticsByDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 {
+		t.Fatalf("GetTenantAnalytics() = %+v, want one day", days)
+	}
+	day := days[0]
+	if day.Period != now.UTC().Format("2006-01-02") || day.Transfers != 3 || day.Completed != 2 || day.Failed != 1 ||
+		day.Volume != 50 || day.AverageAmount != 25 || day.ActiveAccounts != 3 {
+		t.Errorf("GetTenantAnalytics() = %+v", day)
+	}
+	if day.FailureRate < 0.33 || day.FailureRate > 0.34 {
+		t.Errorf("FailureRate = %f, want 1/3", day.FailureRate)
+	}
+
+	months, err := ledger.GetTenantAnalytics(ctx, db, "nil", now.AddDate(0, -1, 0), now, ledger.AnalyticsByMonth)
+	if err != nil || len(months) != 1 || months[0].Period != now.UTC().Format("2006-01") || months[0].Transfers != 3 {
+		t.Errorf("GetTenantAnalytics() by month = %+v, %v", months, err)
+	}
+	if _, err := ledger.GetTenantAnalytics(ctx, db, "nil", now, now, "year"); !errors.Is(err, ledger.ErrInvalidGroupBy) {
+		t.Errorf("GetTenantAnalytics() by year: %v, want ErrInvalidGroupBy", err)
+	}
+}
+
+func TestVelocityRules(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 0)
+	dup := ledger.TenantConfig{TenantID: "nil", VelocityRules: []ledger.VelocityRule{{MaxTransfers: 2, Window: 3600}, {MaxTransfers: 5, Window: 3600}}}
+	if err := ledger.PutTenantConfig(ctx, db, dup); err == nil {
+		t.Error("PutTenantConfig() with two rules of one window succeeded")
+	}
+	cfg := ledger.TenantConfig{TenantID: "nil", VelocityRules: []ledger.VelocityRule{{MaxTransfers: 5, Window: 60}, {MaxTransfers: 2, Window: 3600}}}
+	if err := ledger.PutTenantConfig(ctx, db, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := func(from string) (ledger.NilResponse, error) {
+		return ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "nil", FromAccount: from, ToAccount: "carol", Amount: 1})
+	}
+	for i := 0; i < 2; i++ {
+		if res, err := transfer("alice"); err != nil {
+			t.Fatalf("transfer %d: %v (%s)", i, err, res.Code)
+		}
+	}
+	res, err := transfer("alice")
+	if !errors.Is(err, ledger.ErrRateLimited) || res.Code != "rate_limited" || res.RetryAfter <= 0 || res.RetryAfter > 3600 {
+		t.Errorf("third transfer = %+v, %v; want rate_limited with a retry hint", res, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 98 {
+		t.Errorf("alice has %.2f, want 98", balance)
+	}
+	// Counters are per account.
+	if res, err := transfer("bob"); err != nil {
+		t.Errorf("transfer from bob: %v (%s)", err, res.Code)
+	}
+}
+
+func TestSplitTransfer(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 5)
+
+	for _, splits := range [][]ledger.Split{
+		nil,
+		{{To: "bob", Amount: 10}, {To: "bob", Amount: 5}},
+		{{To: "alice", Amount: 10}},
+		{{To: "bob", Amount: 0.001}},
+		{{To: "bob", Amount: 60}, {To: "carol", Amount: 50}},
+		{{To: "bob", Amount: 10}, {To: "dave", Amount: 5}},
+	} {
+		if _, err := ledger.SplitTransfer(ctx, db, ledger.SplitTransferRequest{FromAccount: "alice", Splits: splits}); err == nil {
+			t.Errorf("SplitTransfer(%+v) succeeded", splits)
+		}
+	}
+
+	tx, err := ledger.SplitTransfer(ctx, db, ledger.SplitTransferRequest{FromAccount: "alice", Splits: []ledger.Split{{To: "bob", Amount: 30}, {To: "carol", Amount: 12.5}}, Narrative: "dinner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for account, want := range map[string]float64{"alice": 57.5, "bob": 30, "carol": 17.5} {
+		if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+			t.Errorf("%s has %.2f, want %.2f", account, balance, want)
+		}
+	}
+	stored, err := ledger.GetTransaction(ctx, db, "nil", "alice", tx.SystemTransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Amount != 42.5 || stored.ToAccount != ledger.SplitToAccount || *stored.Status != ledger.TransactionCompleted || len(stored.Legs) != 3 {
+		t.Errorf("split transaction = %+v", stored)
+	}
+	if leg := stored.Legs[2]; leg.AccountID != "carol" || leg.Type != ledger.LegCredit || leg.Amount != 12.5 {
+		t.Errorf("carol's leg = %+v", leg)
+	}
+}
+
+func TestSplitTransferApprovalAndDelay(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 5000)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "carol", 0)
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", ApprovalThreshold: 1000, RequiredApprovals: 1, Approvers: []string{"ops1"}}); err != nil {
+		t.Fatal(err)
+	}
+	balances := func(want map[string]float64) {
+		t.Helper()
+		for account, want := range want {
+			if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+				t.Errorf("%s has %.2f, want %.2f", account, balance, want)
+			}
+		}
+	}
+
+	// Splits each below the threshold still need approval for their total.
+	split := ledger.SplitTransferRequest{FromAccount: "alice", Splits: []ledger.Split{{To: "bob", Amount: 600}, {To: "carol", Amount: 600}}}
+	tx, err := ledger.SplitTransfer(ctx, db, split)
+	if err != nil || *tx.Status != ledger.TransactionPending || tx.Amount != 1200 {
+		t.Fatalf("SplitTransfer() above the approval threshold = %+v, %v", tx, err)
+	}
+	balances(map[string]float64{"alice": 5000, "bob": 0, "carol": 0})
+	approval, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "ops1"), db, "", tx.SystemTransactionID)
+	if err != nil || approval.Status != ledger.TransferApproved || len(approval.Splits) != 2 {
+		t.Fatalf("ApproveTransfer() = %+v, %v", approval, err)
+	}
+	balances(map[string]float64{"alice": 3800, "bob": 600, "carol": 600})
+	if stored, err := ledger.GetTransaction(ctx, db, "nil", "alice", approval.TransactionID); err != nil || stored.ToAccount != ledger.SplitToAccount || len(stored.Legs) != 3 {
+		t.Errorf("approved split = %+v, %v", stored, err)
+	}
+
+	// And large splits are held for release.
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", LargeTransferThreshold: 500, LargeTransferDelay: 60}); err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	defer func(n ledger.Notifier) { ledger.DefaultNotifier = n }(ledger.DefaultNotifier)
+	ledger.DefaultNotifier = func(ctx context.Context, tenantId, accountId, message string) error {
+		notified = append(notified, accountId+": "+message)
+		return nil
+	}
+	split.Splits = []ledger.Split{{To: "bob", Amount: 300}, {To: "carol", Amount: 300}}
+	tx, err = ledger.SplitTransfer(ctx, db, split)
+	if err != nil || *tx.Status != ledger.TransactionHeld {
+		t.Fatalf("SplitTransfer() above the large transfer threshold = %+v, %v", tx, err)
+	}
+	balances(map[string]float64{"alice": 3800, "bob": 600, "carol": 600})
+	// Only the sender hears of a held split; its receivers do once it is sent.
+	if len(notified) != 1 || !strings.HasPrefix(notified[0], "alice: Your transfer of 600.00 to 2 receivers will be sent at ") {
+		t.Errorf("notifications of a held split = %q", notified)
+	}
+	notified = nil
+	if err := ledger.ProcessDelayedTransfers(ctx, db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(notified)
+	if len(notified) != 3 || !strings.HasPrefix(notified[0], "alice: Your transfer "+tx.SystemTransactionID+" of 600.00 to 2 receivers has been sent.") ||
+		!strings.HasPrefix(notified[1], "bob: You received 300.00 from alice.") || !strings.HasPrefix(notified[2], "carol: You received 300.00 from alice.") {
+		t.Errorf("notifications of a released split = %q", notified)
+	}
+	if held, err := ledger.GetDelayedTransfer(ctx, db, "nil", tx.SystemTransactionID); err != nil || held.Status != ledger.DelayedTransferReleased || held.TransactionID == "" {
+		t.Errorf("released split = %+v, %v", held, err)
+	}
+	balances(map[string]float64{"alice": 3200, "bob": 900, "carol": 900})
+}
+
+func TestSearchTransactions(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+
+	ids := map[string]string{}
+	for _, req := range []ledger.TransferRequest{
+		{FromAccount: "alice", ToAccount: "bob", Amount: 1, Reference: "INV-0042", Narrative: "Rent for May"},
+		{FromAccount: "alice", ToAccount: "bob", Amount: 2, Reference: "inv 0043"},
+		{FromAccount: "alice", ToAccount: "bob", Amount: 3, Reference: "ORD-7", Narrative: "groceries"},
+		{FromAccount: "alice", ToAccount: "bob", Amount: 4},
+	} {
+		res, err := ledger.Transfer(ctx, db, req)
+		if err != nil {
+			t.Fatalf("transfer %+v: %v", req, err)
+		}
+		ids[fmt.Sprint(req.Amount)] = res.Data.TransactionID
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1, Reference: strings.Repeat("x", 65)}); !errors.Is(err, ledger.ErrInvalidReference) || res.Code != "invalid_reference" {
+		t.Errorf("long reference = %s, %v", res.Code, err)
+	}
+
+	for _, tc := range []struct {
+		search ledger.TransactionSearch
+		want   []string
+	}{
+		{ledger.TransactionSearch{Reference: "inv0042"}, []string{"1"}},
+		{ledger.TransactionSearch{Reference: "INV-004"}, []string{"1", "2"}},
+		{ledger.TransactionSearch{Reference: "inv", Comment: "rent"}, []string{"1"}},
+		{ledger.TransactionSearch{Comment: "Transfer"}, []string{"1", "2", "3", "4"}},
+		{ledger.TransactionSearch{Comment: "cer", Match: ledger.MatchContains}, []string{"3"}},
+		{ledger.TransactionSearch{Comment: "cer"}, nil},
+		{ledger.TransactionSearch{Reference: "ord", AccountID: "carol"}, nil},
+	} {
+		found, _, err := ledger.SearchTransactions(ctx, db, "nil", tc.search)
+		if err != nil {
+			t.Fatalf("SearchTransactions(%+v): %v", tc.search, err)
+		}
+		got := map[string]bool{}
+		for _, tx := range found {
+			got[tx.SystemTransactionID] = true
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("SearchTransactions(%+v) found %d transactions, want %d", tc.search, len(got), len(tc.want))
+		}
+		for _, amount := range tc.want {
+			if !got[ids[amount]] {
+				t.Errorf("SearchTransactions(%+v) did not find the transfer of %s", tc.search, amount)
+			}
+		}
+	}
+	if found, _, _ := ledger.SearchTransactions(ctx, db, "nil", ledger.TransactionSearch{Reference: "ord-7"}); len(found) != 1 || found[0].Reference != "ORD-7" {
+		t.Errorf("search by ord-7 = %+v, want the reference ORD-7", found)
+	}
+	if _, _, err := ledger.SearchTransactions(ctx, db, "nil", ledger.TransactionSearch{Reference: " - "}); err == nil {
+		t.Error("a search without terms succeeded")
+	}
+}
+
+func TestTenantCurrency(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	db := newLedger(mem)
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "t1", DefaultCurrency: "XYZ"}); !errors.Is(err, ledger.ErrInvalidCurrency) {
+		t.Errorf("config with currency XYZ = %v, want ErrInvalidCurrency", err)
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "t1", DefaultCurrency: "USD"}); err != nil {
+		t.Fatal(err)
+	}
+	ledger.CreateAccountWithBalance(ctx, db, "t1", "alice", 100)
+	if err := ledger.CreateAccount(ctx, db, "t1", ledger.User{AccountID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.CreateAccount(ctx, db, "t1", ledger.User{AccountID: "carol", Currency: "eur"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.CreateAccount(ctx, db, "t1", ledger.User{AccountID: "dave", Currency: "dollars"}); !errors.Is(err, ledger.ErrInvalidCurrency) {
+		t.Errorf("account in dollars = %v, want ErrInvalidCurrency", err)
+	}
+	for account, want := range map[string]string{"alice": "USD", "bob": "USD", "carol": "EUR", "": "USD"} {
+		if got, err := ledger.AccountCurrency(ctx, db, "t1", account); err != nil || got != want {
+			t.Errorf("AccountCurrency(%q) = %s, %v; want %s", account, got, err, want)
+		}
+	}
+
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "t1", FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Data.Currency != "USD" {
+		t.Errorf("response currency = %q, want USD", res.Data.Currency)
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "t1", "alice", res.Data.TransactionID)
+	if err != nil || tx.Currency != "USD" {
+		t.Errorf("transaction = %+v, %v; want it in USD", tx, err)
+	}
+	var entries []ledger.LedgerEntry
+	attributevalue.UnmarshalListOfMaps(mem.Items(ledger.LedgerTable), &entries)
+	for _, entry := range entries {
+		if entry.Currency != "USD" {
+			t.Errorf("entry %s is in %q, want USD", entry.SystemTransactionID, entry.Currency)
+		}
+	}
+	// Nothing is converted, so a transfer into another currency is refused.
+	res, err = ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "t1", FromAccount: "alice", ToAccount: "carol", Amount: 50})
+	if !errors.Is(err, ledger.ErrCurrencyMismatch) || res.Code != "currency_mismatch" {
+		t.Errorf("transfer from USD to EUR = %v, %v; want ErrCurrencyMismatch", res.Code, err)
+	}
+	for account, want := range map[string]float64{"alice": 90, "carol": 0} {
+		if got, _ := ledger.InquireBalance(ctx, db, "t1", account); got != want {
+			t.Errorf("balance of %s = %v, want %v", account, got, want)
+		}
+	}
+	// Tenants without a configured currency keep the default.
+	if got, _ := ledger.AccountCurrency(ctx, db, "nil", ""); got != ledger.DefaultCurrency {
+		t.Errorf("default currency = %s, want %s", got, ledger.DefaultCurrency)
+	}
+}
+
+func TestInquireBalances(t *testing.T) {
+	backoff := ledger.BatchWriteBackoff
+	ledger.BatchWriteBackoff = time.Millisecond
+	t.Cleanup(func() { ledger.BatchWriteBackoff = backoff })
+
+	ctx := context.Background()
+	db := &throttlingDB{DB: NewDB()}
+	var ids []string
+	for i := 0; i < 150; i++ {
+		id := fmt.Sprintf("acc-%03d", i)
+		ledger.CreateAccountWithBalance(ctx, db, "nil", id, float64(i))
+		ids = append(ids, id)
+	}
+	ids = append(ids, "ghost-2", "acc-007", "ghost-1", "ghost-2")
+
+	db.throttles = 2
+	balances, missing, err := ledger.InquireBalances(ctx, db, "", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 150 || balances["acc-007"] != 7 || balances["acc-149"] != 149 {
+		t.Errorf("got %d balances, acc-007 = %v, acc-149 = %v", len(balances), balances["acc-007"], balances["acc-149"])
+	}
+	if !slices.Equal(missing, []string{"ghost-2", "ghost-1"}) {
+		t.Errorf("missing = %v, want [ghost-2 ghost-1]", missing)
+	}
+
+	db.throttles = 10
+	if _, _, err := ledger.InquireBalances(ctx, db, "", ids[:3]); err == nil {
+		t.Error("InquireBalances() with keys left unprocessed succeeded")
+	}
+}
+
+func TestTransactionCategories(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	db := newLedger(mem)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "shop", 0)
+
+	for _, req := range []ledger.TransferRequest{
+		{FromAccount: "alice", ToAccount: "shop", Amount: 1, Category: "gambling"},
+		{FromAccount: "alice", ToAccount: "shop", Amount: 1, MCC: "54x1"},
+	} {
+		if res, err := ledger.Transfer(ctx, db, req); err == nil || res.Code != "invalid_category" {
+			t.Errorf("Transfer(%+v) = %s, %v; want invalid_category", req, res.Code, err)
+		}
+	}
+	for _, req := range []ledger.TransferRequest{
+		{FromAccount: "alice", ToAccount: "shop", Amount: 10, MCC: "5411"},
+		{FromAccount: "alice", ToAccount: "shop", Amount: 20, MCC: "5812"},
+		{FromAccount: "alice", ToAccount: "shop", Amount: 30, Category: ledger.CategoryGroceries},
+		{FromAccount: "alice", ToAccount: "shop", Amount: 5},
+	} {
+		if _, err := ledger.Transfer(ctx, db, req); err != nil {
+			t.Fatalf("Transfer(%+v) = %v", req, err)
+		}
+	}
+
+	total := func(filter ledger.TransactionFilter) float64 {
+		txs, _, err := ledger.GetAllNilTransactions(ctx, db, "nil", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum float64
+		for _, tx := range txs {
+			sum += tx.Amount
+		}
+		return sum
+	}
+	if got := total(ledger.TransactionFilter{AccountID: "alice", Category: ledger.CategoryGroceries}); got != 40 {
+		t.Errorf("groceries = %v, want 40", got)
+	}
+	if got := total(ledger.TransactionFilter{AccountID: "alice", Category: ledger.CategoryDining, MCC: "5812"}); got != 20 {
+		t.Errorf("dining at 5812 = %v, want 20", got)
+	}
+
+	var entries []ledger.LedgerEntry
+	attributevalue.UnmarshalListOfMaps(mem.Items(ledger.LedgerTable), &entries)
+	categorized := 0
+	for _, entry := range entries {
+		if entry.Category == ledger.CategoryDining && entry.MCC == "5812" {
+			categorized++
+		}
+	}
+	if categorized != 2 {
+		t.Errorf("%d ledger entries in dining at 5812, want the debit and the credit", categorized)
+	}
+}
+
+func TestDisputes(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "buyer", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "merchant", 0)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "disputes", 0)
+	transfer := func(amount float64) string {
+		t.Helper()
+		res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "nil", FromAccount: "buyer", ToAccount: "merchant", Amount: amount})
+		if err != nil || res.Status != "success" {
+			t.Fatalf("Transfer() = %+v, %v", res, err)
+		}
+		return res.Data.TransactionID
+	}
+	reversed, released := transfer(30), transfer(20)
+
+	open := ledger.OpenDisputeRequest{TransactionID: reversed, Reason: "never delivered", Actor: "buyer"}
+	if _, err := ledger.OpenDispute(ctx, db, open); err == nil {
+		t.Error("OpenDispute() without a dispute holding account succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", DisputeHoldingAccount: "disputes"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.OpenDispute(ctx, db, ledger.OpenDisputeRequest{TransactionID: released, Amount: 25, Reason: "overcharged", Actor: "buyer"}); !errors.Is(err, ledger.ErrNotDisputable) {
+		t.Errorf("OpenDispute() of more than transferred: %v, want ErrNotDisputable", err)
+	}
+	dispute, err := ledger.OpenDispute(ctx, db, open)
+	if err != nil || dispute.Status != ledger.DisputeOpen || dispute.Amount != 30 || dispute.ToAccount != "merchant" {
+		t.Fatalf("OpenDispute() = %+v, %v", dispute, err)
+	}
+	if _, err := ledger.OpenDispute(ctx, db, open); !errors.Is(err, ledger.ErrDisputeExists) {
+		t.Errorf("second OpenDispute(): %v, want ErrDisputeExists", err)
+	}
+	partial, err := ledger.OpenDispute(ctx, db, ledger.OpenDisputeRequest{TransactionID: released, Amount: 5, Reason: "overcharged", Actor: "buyer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for account, want := range map[string]float64{"merchant": 15, "disputes": 35} {
+		if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+			t.Errorf("%s has %.2f while disputed, want %.2f", account, balance, want)
+		}
+	}
+
+	if _, err := ledger.AddDisputeEvidence(ctx, db, "nil", reversed, "buyer", "disputes/"+reversed+"/receipt.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	dispute, err = ledger.ResolveDispute(ctx, db, "nil", reversed, ledger.DisputeReversed, "ops", "merchant did not answer")
+	if err != nil || dispute.Status != ledger.DisputeReversed || len(dispute.History) != 2 || len(dispute.Evidence) != 1 {
+		t.Fatalf("ResolveDispute() = %+v, %v", dispute, err)
+	}
+	if _, err := ledger.ResolveDispute(ctx, db, "nil", reversed, ledger.DisputeReleased, "ops", ""); !errors.Is(err, ledger.ErrDisputeNotOpen) {
+		t.Errorf("ResolveDispute() of a resolved dispute: %v, want ErrDisputeNotOpen", err)
+	}
+	if _, err := ledger.AddDisputeEvidence(ctx, db, "nil", reversed, "merchant", "late.pdf"); !errors.Is(err, ledger.ErrDisputeNotOpen) {
+		t.Errorf("AddDisputeEvidence() to a resolved dispute: %v, want ErrDisputeNotOpen", err)
+	}
+	if _, err := ledger.ResolveDispute(ctx, db, "nil", partial.TransactionID, ledger.DisputeReleased, "ops", "price was agreed"); err != nil {
+		t.Fatal(err)
+	}
+
+	for account, want := range map[string]float64{"buyer": 80, "merchant": 20, "disputes": 0} {
+		if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+			t.Errorf("%s has %.2f, want %.2f", account, balance, want)
+		}
+	}
+	tx, err := ledger.GetTransaction(ctx, db, "nil", "buyer", reversed)
+	if err != nil || *tx.Status != ledger.TransactionReversed || len(tx.StatusHistory) != 1 || tx.StatusHistory[0].Actor != "ops" {
+		t.Errorf("reversed transfer = %+v, %v", tx, err)
+	}
+	if tx, err := ledger.GetTransaction(ctx, db, "nil", "buyer", released); err != nil || *tx.Status != ledger.TransactionCompleted {
+		t.Errorf("partially disputed transfer = %+v, %v; want completed", tx, err)
+	}
+	for _, account := range []string{"buyer", "merchant"} {
+		if disputes, err := ledger.GetAccountDisputes(ctx, db, "nil", account); err != nil || len(disputes) != 2 {
+			t.Errorf("GetAccountDisputes(%s) = %d disputes, %v; want 2", account, len(disputes), err)
+		}
+	}
+	// The freeze and reversal of the dispute follow from the transfer.
+	if tree, err := ledger.GetTransactionTree(ctx, db, "nil", reversed); err != nil || len(tree.Transactions) != 3 || len(tree.Transactions[0].Children) != 2 {
+		t.Errorf("GetTransactionTree() of the disputed transfer = %+v, %v", tree, err)
+	}
+}
+
+func TestInputValidation(t *testing.T) {
+	ctx := context.Background()
+	// Every call to the nil DynamoDBAPI panics: invalid input must be
+	// refused before the database is used.
+	db := struct{ ledger.DynamoDBAPI }{}
+	for _, tt := range []struct {
+		name   string
+		req    ledger.TransferRequest
+		fields []string
+	}{
+		{"no sender", ledger.TransferRequest{ToAccount: "bob", Amount: 1}, []string{"from_account"}},
+		{"tenant charset", ledger.TransferRequest{TenantID: "acme corp", FromAccount: "alice", ToAccount: "bob", Amount: 1}, []string{"tenant_id"}},
+		{"account charset", ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob'; --", Amount: 1}, []string{"to_account"}},
+		{"self transfer", ledger.TransferRequest{FromAccount: "alice", ToAccount: "alice", Amount: 1}, []string{"to_account"}},
+		{"negative amount", ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: -5}, []string{"amount"}},
+		{"amount finer than any currency", ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1.00005}, []string{"amount"}},
+		{"every problem", ledger.TransferRequest{FromAccount: "alice", ToAccount: "alice"}, []string{"to_account", "amount"}},
+	} {
+		res, err := ledger.Transfer(ctx, db, tt.req)
+		var fields []string
+		for _, e := range validation.Fields(err) {
+			fields = append(fields, e.Field)
+		}
+		if res.Code != "invalid_request" || !slices.Equal(fields, tt.fields) {
+			t.Errorf("%s: Transfer() = %s, %v; want invalid fields %v", tt.name, res.Code, err, tt.fields)
+		}
+	}
+
+	if _, err := ledger.InquireBalance(ctx, db, "nil", ""); validation.Fields(err) == nil {
+		t.Errorf("InquireBalance() of no account: %v, want a validation error", err)
+	}
+	if err := ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice smith"}); validation.Fields(err) == nil {
+		t.Errorf("CreateAccount() with a space in the ID: %v, want a validation error", err)
+	}
+	if _, err := ledger.DepositCredits(ctx, db, ledger.CashRequest{AccountID: "alice", Amount: 0, Channel: ledger.ChannelBank}); validation.Fields(err) == nil {
+		t.Errorf("DepositCredits() of nothing: %v, want a validation error", err)
+	}
+}
+
+func TestTransferAmountAndSelfTransferGuards(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+
+	// Amounts with more decimals than SDG has pass validation, as another
+	// currency may have them, and are refused by the transfer.
+	for _, tt := range []struct {
+		amount float64
+		want   error
+		code   string
+	}{
+		{0.01, nil, ""},
+		{99.99, nil, ""},
+		{0, ledger.ErrInvalidAmount, "invalid_request"},
+		{math.Copysign(0, -1), ledger.ErrInvalidAmount, "invalid_request"},
+		{-0.01, ledger.ErrInvalidAmount, "invalid_request"},
+		{-100, ledger.ErrInvalidAmount, "invalid_request"},
+		{0.001, ledger.ErrInvalidAmount, "invalid_amount"},
+		{0.015, ledger.ErrInvalidAmount, "invalid_amount"},
+		{0.00001, ledger.ErrInvalidAmount, "invalid_request"},
+		{math.NaN(), ledger.ErrInvalidAmount, "invalid_request"},
+		{math.Inf(1), ledger.ErrInvalidAmount, "invalid_request"},
+	} {
+		before, _ := ledger.InquireBalance(ctx, db, "nil", "alice")
+		entry := ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: tt.amount}
+		res, err := ledger.TransferCredits(ctx, db, entry)
+		after, _ := ledger.InquireBalance(ctx, db, "nil", "alice")
+		if tt.want == nil {
+			if err != nil || res.Code != "successful_transaction" || after != roundTo(before-tt.amount) {
+				t.Errorf("TransferCredits(%v) = %s, %v; balance %.2f to %.2f", tt.amount, res.Code, err, before, after)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) || res.Code != tt.code || after != before {
+			t.Errorf("TransferCredits(%v) = %s, %v; balance %.2f to %.2f, want %v and no change", tt.amount, res.Code, err, before, after, tt.want)
+		}
+	}
+
+	before, _ := ledger.InquireBalance(ctx, db, "nil", "alice")
+	res, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "alice", Amount: 10})
+	if !errors.Is(err, ledger.ErrSelfTransfer) || errors.Is(err, ledger.ErrInvalidAmount) || res.Code != "invalid_request" {
+		t.Errorf("self transfer = %s, %v; want ErrSelfTransfer", res.Code, err)
+	}
+	if after, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); after != before {
+		t.Errorf("self transfer moved alice's balance from %.2f to %.2f", before, after)
+	}
+	if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "alice", Amount: -1}); !errors.Is(err, ledger.ErrSelfTransfer) || !errors.Is(err, ledger.ErrInvalidAmount) {
+		t.Errorf("negative self transfer: %v, want ErrSelfTransfer and ErrInvalidAmount", err)
+	}
+}
+
+func TestThreeDecimalTransfer(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	db := newLedger(mem)
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "kw", DefaultCurrency: "KWD"}); err != nil {
+		t.Fatal(err)
+	}
+	ledger.CreateAccountWithBalance(ctx, db, "kw", "alice", 10)
+	ledger.CreateAccountWithBalance(ctx, db, "kw", "bob", 0)
+
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "kw", FromAccount: "alice", ToAccount: "bob", Amount: 1.005})
+	if err != nil || res.Status != "success" {
+		t.Fatalf("transfer of 1.005 KWD = %+v, %v", res, err)
+	}
+	if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "kw", FromAccount: "alice", ToAccount: "bob", Amount: 1.0005}); !errors.Is(err, ledger.ErrInvalidAmount) {
+		t.Errorf("transfer of 1.0005 KWD = %v, want ErrInvalidAmount", err)
+	}
+	for account, want := range map[string]float64{"alice": 8.995, "bob": 1.005} {
+		if got, _ := ledger.InquireBalance(ctx, db, "kw", account); got != want {
+			t.Errorf("balance of %s = %v, want %v", account, got, want)
+		}
+		report, err := ledger.VerifyLedgerIntegrity(ctx, db, "kw", account)
+		if err != nil || !report.Valid() {
+			t.Errorf("VerifyLedgerIntegrity(%s) = %+v, %v", account, report, err)
+		}
+	}
+	var entries []ledger.LedgerEntry
+	attributevalue.UnmarshalListOfMaps(mem.Items(ledger.LedgerTable), &entries)
+	var posted int
+	for _, entry := range entries {
+		if entry.JournalID != res.Data.TransactionID {
+			continue
+		}
+		if posted++; entry.Amount != 1.005 {
+			t.Errorf("%s entry of %s = %v, want 1.005", entry.Type, entry.AccountID, entry.Amount)
+		}
+	}
+	if posted != 2 {
+		t.Errorf("transfer posted %d entries, want 2", posted)
+	}
+}
+
+func roundTo(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// countingReplica counts the reads served by a read replica.
+type countingReplica struct {
+	*DB
+	reads int
+}
+
+func (r *countingReplica) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	r.reads++
+	return r.DB.GetItem(ctx, params, optFns...)
+}
+
+func (r *countingReplica) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	r.reads++
+	return r.DB.Query(ctx, params, optFns...)
+}
+
+func (r *countingReplica) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	r.reads++
+	return r.DB.BatchGetItem(ctx, params, optFns...)
+}
+
+func TestReadReplica(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	replica := &countingReplica{DB: mem}
+	var invalidated []string
+	invalidate := func(ctx context.Context, tenantId string, accountIds []string) {
+		invalidated = append(invalidated, tenantId+":"+strings.Join(accountIds, ","))
+	}
+	db := newLedger(mem, ledger.WithReadReplica(replica, invalidate))
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "alice", 100)
+	ledger.CreateAccountWithBalance(ctx, db, "nil", "bob", 0)
+
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	if replica.reads != 0 {
+		t.Errorf("a transfer made %d reads from the replica, want none", replica.reads)
+	}
+	if want := []string{"nil:alice,bob"}; !slices.Equal(invalidated, want) {
+		t.Errorf("invalidated %v, want %v", invalidated, want)
+	}
+
+	if balance, err := ledger.InquireBalance(ctx, db, "nil", "bob"); err != nil || balance != 10 {
+		t.Errorf("InquireBalance() = %.2f, %v", balance, err)
+	}
+	if _, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.InquireBalances(ctx, db, "nil", []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.GetTransactions(ctx, db, "nil", "alice", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	if replica.reads != 4 {
+		t.Errorf("the replica served %d reads, want 4", replica.reads)
+	}
+
+	// Strongly consistent reads stay on DynamoDB.
+	consistent := newLedger(mem, ledger.WithConsistentReads(), ledger.WithReadReplica(replica, nil))
+	if balance, err := ledger.InquireBalance(ctx, consistent, "nil", "bob"); err != nil || balance != 10 {
+		t.Errorf("consistent InquireBalance() = %.2f, %v", balance, err)
+	}
+	if replica.reads != 4 {
+		t.Errorf("a consistent read was served by the replica")
+	}
+}
+
+func TestTransactionReceipts(t *testing.T) {
+	ctx := context.Background()
+	mem := NewDB()
+	signingKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	keys := ledger.StaticReceiptKeys{
+		"nil":  {KeyID: "receipts-1", Ed25519: signingKey},
+		"acme": {KeyID: "receipts-hmac", HMACSecret: []byte("shared secret")},
+	}
+	db := newLedger(mem, ledger.WithReceiptSigning(keys))
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", FullName: "Alice", Amount: 100})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob", FullName: "Bob <Shop>"})
+
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 12.5, Narrative: "groceries"})
+	if err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	receipt, err := ledger.GenerateReceipt(ctx, db, "", res.Data.TransactionID)
+	if err != nil {
+		t.Fatalf("GenerateReceipt() error = %v", err)
+	}
+	if receipt.Amount != "12.50" || receipt.Fee != "0.00" || receipt.From.Name != "Alice" || receipt.To.AccountID != "bob" || receipt.Status != "Completed" {
+		t.Errorf("GenerateReceipt() = %+v", receipt)
+	}
+	if receipt.Signature == nil || receipt.Signature.KeyID != "receipts-1" || receipt.Signature.Algorithm != ledger.KeyAlgorithmEd25519 {
+		t.Fatalf("receipt signature = %+v", receipt.Signature)
+	}
+
+	// The same transaction renders to the same document.
+	again, err := ledger.GenerateReceipt(ctx, db, "nil", res.Data.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := json.Marshal(receipt)
+	second, _ := json.Marshal(again)
+	if !bytes.Equal(first, second) {
+		t.Errorf("receipts differ:\n%s\n%s", first, second)
+	}
+
+	// A receiver verifies the JSON offline with the public key.
+	var received ledger.TransactionReceipt
+	if err := json.Unmarshal(first, &received); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	if err := ledger.VerifyReceipt(&received, publicKey); err != nil {
+		t.Errorf("VerifyReceipt() error = %v", err)
+	}
+	received.Amount = "125.00"
+	if err := ledger.VerifyReceipt(&received, publicKey); !errors.Is(err, ledger.ErrSignatureInvalid) {
+		t.Errorf("VerifyReceipt() of an altered receipt error = %v", err)
+	}
+
+	html, err := receipt.HTML()
+	if err != nil {
+		t.Fatalf("HTML() error = %v", err)
+	}
+	if !bytes.Contains(html, []byte("12.50 SDG")) || !bytes.Contains(html, []byte("Bob &lt;Shop&gt;")) {
+		t.Errorf("HTML() = %s", html)
+	}
+
+	ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "carol", Amount: 10})
+	ledger.CreateAccount(ctx, db, "acme", ledger.User{AccountID: "dave"})
+	res, err = ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "acme", FromAccount: "carol", ToAccount: "dave", Amount: 5})
+	if err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	receipt, err = ledger.GenerateReceipt(ctx, db, "acme", res.Data.TransactionID)
+	if err != nil || receipt.Signature.Algorithm != ledger.ReceiptAlgorithmHMAC {
+		t.Fatalf("GenerateReceipt() = %+v, %v", receipt, err)
+	}
+	if err := ledger.VerifyReceipt(receipt, []byte("shared secret")); err != nil {
+		t.Errorf("VerifyReceipt() error = %v", err)
+	}
+	if err := ledger.VerifyReceipt(receipt, []byte("guessed secret")); !errors.Is(err, ledger.ErrSignatureInvalid) {
+		t.Errorf("VerifyReceipt() with the wrong secret error = %v", err)
+	}
+
+	// Refused transfers have no receipt.
+	ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1000})
+	failed := ledger.TransactionFailed
+	it := ledger.NewTransactionsIterator(db, "nil", ledger.TransactionFilter{AccountID: "alice", TransactionStatus: &failed})
+	if !it.Next(ctx) {
+		t.Fatalf("the refused transfer was not recorded: %v", it.Err())
+	}
+	if _, err := ledger.GenerateReceipt(ctx, db, "nil", it.Transaction().SystemTransactionID); !errors.Is(err, ledger.ErrReceiptUnavailable) {
+		t.Errorf("GenerateReceipt() of a refused transfer error = %v", err)
+	}
+	if _, err := ledger.GenerateReceipt(ctx, db, "nil", "missing"); !errors.Is(err, ledger.ErrTransactionNotFound) {
+		t.Errorf("GenerateReceipt() of a missing transaction error = %v", err)
+	}
+}
+
+func TestDormantAccounts(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 100})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "treasury"})
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", TreasuryAccount: "treasury"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is idle since an hour ago.
+	marked, err := ledger.MarkDormantAccounts(ctx, db, "", time.Now().Add(-time.Hour))
+	if err != nil || len(marked) != 0 {
+		t.Fatalf("MarkDormantAccounts() = %v, %v", marked, err)
+	}
+	// A cutoff in the future makes every account idle, except the treasury.
+	marked, err = ledger.MarkDormantAccounts(ctx, db, "", time.Now().Add(time.Hour))
+	slices.Sort(marked)
+	if err != nil || !slices.Equal(marked, []string{"alice", "bob"}) {
+		t.Fatalf("MarkDormantAccounts() = %v, %v", marked, err)
+	}
+	if again, err := ledger.MarkDormantAccounts(ctx, db, "", time.Now().Add(time.Hour)); err != nil || len(again) != 0 {
+		t.Errorf("MarkDormantAccounts() of dormant accounts = %v, %v", again, err)
+	}
+	dormant, err := ledger.ListDormantAccounts(ctx, db, "")
+	if err != nil || len(dormant) != 2 || dormant[0].DormantSince == 0 {
+		t.Fatalf("ListDormantAccounts() = %+v, %v", dormant, err)
+	}
+
+	// Money can come in, but not go out.
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10})
+	if !errors.Is(err, ledger.ErrAccountDormant) || res.Code != "account_dormant" {
+		t.Errorf("Transfer() from a dormant account = %+v, %v", res, err)
+	}
+	if _, err := ledger.WithdrawCredits(ctx, db, ledger.CashRequest{AccountID: "alice", Amount: 10, Channel: ledger.ChannelBank, BankReference: "FT1"}); !errors.Is(err, ledger.ErrAccountDormant) {
+		t.Errorf("WithdrawCredits() from a dormant account error = %v", err)
+	}
+	if _, err := ledger.DepositCredits(ctx, db, ledger.CashRequest{AccountID: "alice", Amount: 10, Channel: ledger.ChannelBank, BankReference: "FT2"}); err != nil {
+		t.Errorf("DepositCredits() into a dormant account error = %v", err)
+	}
+
+	if err := ledger.ReactivateAccount(ctx, db, "", "alice", ledger.KYCRefresh{IDNumber: "P1"}); err == nil {
+		t.Error("ReactivateAccount() without a verifier succeeded")
+	}
+	if err := ledger.ReactivateAccount(ctx, db, "", "treasury", ledger.KYCRefresh{IDNumber: "P1", VerifiedBy: "officer-1"}); err == nil {
+		t.Error("ReactivateAccount() of an active account succeeded")
+	}
+	if err := ledger.ReactivateAccount(ctx, db, "", "alice", ledger.KYCRefresh{IDType: "passport", IDNumber: "P1", VerifiedBy: "officer-1"}); err != nil {
+		t.Fatalf("ReactivateAccount() error = %v", err)
+	}
+	alice, err := ledger.GetAccount(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice"})
+	if err != nil || alice.DormantSince != 0 || !alice.IsVerified || alice.IDNumber != "P1" || alice.KYCVerifiedBy != "officer-1" {
+		t.Errorf("reactivated account = %+v, %v", alice, err)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 10}); err != nil {
+		t.Errorf("Transfer() from a reactivated account = %+v, %v", res, err)
+	}
+	if dormant, err := ledger.ListDormantAccounts(ctx, db, ""); err != nil || len(dormant) != 1 || dormant[0].AccountID != "bob" {
+		t.Errorf("ListDormantAccounts() = %+v, %v", dormant, err)
+	}
+}
+
+func TestKYCTierLimits(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 1000})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "treasury"})
+	err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", TreasuryAccount: "treasury", KYCTierLimits: []ledger.KYCTierLimits{
+		{Tier: 0, MaxBalance: 200, MaxTransaction: 100, MaxMonthlyVolume: 150},
+		{Tier: 1, MaxBalance: 5000, MaxTransaction: 1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", KYCTierLimits: []ledger.KYCTierLimits{{Tier: 4}}}); err == nil {
+		t.Error("PutTenantConfig() with an unknown tier succeeded")
+	}
+	if err := ledger.SetKYCTier(ctx, db, "", "alice", 4); err == nil {
+		t.Error("SetKYCTier(4) succeeded")
+	}
+	if err := ledger.SetKYCTier(ctx, db, "", "missing", 1); err == nil {
+		t.Error("SetKYCTier() of a missing account succeeded")
+	}
+
+	// Alice, at tier 0, sends at most 100 a transfer and 150 a month.
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 120}); !errors.Is(err, ledger.ErrKYCLimitExceeded) || res.Code != "kyc_limit_exceeded" {
+		t.Errorf("Transfer() over the transaction limit = %+v, %v", res, err)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 100}); err != nil {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 60}); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("Transfer() over the monthly limit = %+v, %v", res, err)
+	}
+	if _, err := ledger.WithdrawCredits(ctx, db, ledger.CashRequest{AccountID: "alice", Amount: 60, Channel: ledger.ChannelBank, BankReference: "FT1"}); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("WithdrawCredits() over the monthly limit error = %v", err)
+	}
+
+	// Bob, also at tier 0, holds at most 200.
+	if _, err := ledger.DepositCredits(ctx, db, ledger.CashRequest{AccountID: "bob", Amount: 150, Channel: ledger.ChannelBank, BankReference: "FT2"}); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("DepositCredits() over the balance limit error = %v", err)
+	}
+	if err := ledger.SetKYCTier(ctx, db, "", "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 150}); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("Transfer() over the receiver's balance limit = %+v, %v", res, err)
+	}
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 100}); err != nil {
+		t.Errorf("Transfer() at tier 1 = %+v, %v", res, err)
+	}
+	if err := ledger.SetKYCTier(ctx, db, "", "bob", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.DepositCredits(ctx, db, ledger.CashRequest{AccountID: "bob", Amount: 150, Channel: ledger.ChannelBank, BankReference: "FT3"}); err != nil {
+		t.Errorf("DepositCredits() at tier 1 error = %v", err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "bob"); balance != 350 {
+		t.Errorf("InquireBalance(bob) = %v, want 350", balance)
+	}
+}
+
+func TestKYCTierLimitsOfEveryPath(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 1000})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob", Amount: 150})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "carol"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "escrow"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "claims"})
+	err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", EscrowHoldingAccount: "escrow", PendingClaimsAccount: "claims", KYCTierLimits: []ledger.KYCTierLimits{
+		{Tier: 0, MaxBalance: 200, MaxTransaction: 100},
+		{Tier: 1, MaxBalance: 5000, MaxTransaction: 1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice, at tier 0, sends at most 100 at a time, however it is sent.
+	split := ledger.SplitTransferRequest{FromAccount: "alice", Splits: []ledger.Split{{To: "bob", Amount: 10}, {To: "carol", Amount: 110}}}
+	if _, err := ledger.SplitTransfer(ctx, db, split); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("SplitTransfer() over the transaction limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+	escrow := ledger.EscrowTransferRequest{FromAccount: "alice", ToAccount: "carol", Amount: 120, Arbitrator: "market"}
+	if _, err := ledger.EscrowTransfer(ctx, db, escrow); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("EscrowTransfer() over the transaction limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 120); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("SendToUnregistered() over the transaction limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+
+	// Bob, also at tier 0, holds at most 200.
+	split.Splits = []ledger.Split{{To: "carol", Amount: 30}, {To: "bob", Amount: 60}}
+	if _, err := ledger.SplitTransfer(ctx, db, split); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("SplitTransfer() over a receiver's balance limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+	escrow.ToAccount, escrow.Amount = "bob", 60
+	if _, err := ledger.EscrowTransfer(ctx, db, escrow); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("EscrowTransfer() over the seller's balance limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+	claim, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "dave", MobileNumber: "0911000111", Amount: 150})
+	if _, err := ledger.ClaimTransfer(ctx, db, "nil", claim.ClaimID, "dave"); !errors.Is(err, ledger.ErrKYCLimitExceeded) {
+		t.Errorf("ClaimTransfer() over the balance limit error = %v, want ErrKYCLimitExceeded", err)
+	}
+	if err := ledger.SetKYCTier(ctx, db, "", "dave", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.ClaimTransfer(ctx, db, "nil", claim.ClaimID, "dave"); err != nil {
+		t.Errorf("ClaimTransfer() at tier 1 error = %v", err)
+	}
+	for account, want := range map[string]float64{"alice": 940, "bob": 150, "carol": 0, "dave": 210} {
+		if balance, _ := ledger.InquireBalance(ctx, db, "nil", account); balance != want {
+			t.Errorf("%s has %.2f, want %.2f", account, balance, want)
+		}
+	}
+}
+
+func TestCampaignCashback(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 1000})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "shop"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "promotions"})
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", BonusFundingAccount: "promotions"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := ledger.CreateCampaign(ctx, db, ledger.Campaign{Name: "Bad", CashbackPercent: 5, StartsAt: now.Unix(), EndsAt: now.Unix()}); err == nil {
+		t.Error("CreateCampaign() of an empty period succeeded")
+	}
+	campaign, err := ledger.CreateCampaign(ctx, db, ledger.Campaign{
+		Name:            "Groceries cashback",
+		Tag:             "merchant",
+		MCCs:            []string{"5411"},
+		CashbackPercent: 5,
+		MaxPerAccount:   8,
+		Budget:          11,
+		StartsAt:        now.Add(-time.Hour).Unix(),
+		EndsAt:          now.Add(time.Hour).Unix(),
+	})
+	if err != nil || campaign.FundingAccount != "promotions" {
+		t.Fatalf("CreateCampaign() = %+v, %v", campaign, err)
+	}
+
+	transfer := func(amount float64, tags []string, mcc string) float64 {
+		t.Helper()
+		res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "shop", Amount: amount, Tags: tags, MCC: mcc})
+		if err != nil {
+			t.Fatalf("Transfer() = %+v, %v", res, err)
+		}
+		return res.Data.Cashback
+	}
+	if got := transfer(100, []string{"merchant"}, "5411"); got != 5 {
+		t.Errorf("cashback = %v, want 5", got)
+	}
+	// Transfers without the tag or to other merchants earn nothing.
+	if got := transfer(100, nil, "5411"); got != 0 {
+		t.Errorf("cashback without the tag = %v", got)
+	}
+	if got := transfer(100, []string{"merchant"}, "5812"); got != 0 {
+		t.Errorf("cashback of another MCC = %v", got)
+	}
+	// Alice earns at most 8 a month.
+	if got := transfer(100, []string{"merchant"}, "5411"); got != 3 {
+		t.Errorf("cashback up to the monthly cap = %v, want 3", got)
+	}
+	if got := transfer(100, []string{"merchant"}, "5411"); got != 0 {
+		t.Errorf("cashback over the monthly cap = %v", got)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 508 {
+		t.Errorf("InquireBalance(alice) = %v, want 508", balance)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "promotions"); balance != -8 {
+		t.Errorf("InquireBalance(promotions) = %v, want -8", balance)
+	}
+	it := ledger.NewTransactionsIterator(db, "nil", ledger.TransactionFilter{AccountID: "alice", Metadata: map[string]string{"campaign_id": campaign.CampaignID}})
+	var paid int
+	for it.Next(ctx) {
+		if tx := it.Transaction(); tx.Comment != ledger.NarrativeCashback || tx.FromAccount != "promotions" {
+			t.Errorf("cashback transaction = %+v", tx)
+		}
+		paid++
+	}
+	if paid != 2 {
+		t.Errorf("%d cashback transactions, want 2: %v", paid, it.Err())
+	}
+	got, err := ledger.GetCampaign(ctx, db, "", campaign.CampaignID)
+	if err != nil || got.Spent != 8 {
+		t.Errorf("GetCampaign() = %+v, %v", got, err)
+	}
+
+	// The budget is shared by all accounts.
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob", Amount: 1000})
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "bob", ToAccount: "shop", Amount: 100, Tags: []string{"merchant"}, MCC: "5411"})
+	if err != nil || res.Data.Cashback != 3 {
+		t.Errorf("Transfer() up to the budget = %+v, %v", res, err)
+	}
+	if err := ledger.EndCampaign(ctx, db, "", campaign.CampaignID); err != nil {
+		t.Errorf("EndCampaign() error = %v", err)
+	}
+	if campaigns, err := ledger.ListCampaigns(ctx, db, ""); err != nil || len(campaigns) != 1 || campaigns[0].Spent != 11 {
+		t.Errorf("ListCampaigns() = %+v, %v", campaigns, err)
+	}
+}
+
+func TestAgentFloat(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "agent"})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 500})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "treasury"})
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", TreasuryAccount: "treasury"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ledger.AssignFloat(ctx, db, ledger.FloatRequest{AgentID: "agent", Amount: 100, BankReference: "FT1"}); err == nil {
+		t.Error("AssignFloat() to an account that is not an agent succeeded")
+	}
+	if err := ledger.RegisterAgent(ctx, db, "", "agent", ledger.AgentFloatLimits{MinFloat: 50, MaxFloat: 40}); err == nil {
+		t.Error("RegisterAgent() with a maximum below the minimum succeeded")
+	}
+	if err := ledger.RegisterAgent(ctx, db, "", "agent", ledger.AgentFloatLimits{MinFloat: 50, MaxFloat: 1000}); err != nil {
+		t.Fatalf("RegisterAgent() error = %v", err)
+	}
+	if _, err := ledger.AssignFloat(ctx, db, ledger.FloatRequest{AgentID: "agent", Amount: 1200, BankReference: "FT1"}); !errors.Is(err, ledger.ErrFloatLimitExceeded) {
+		t.Errorf("AssignFloat() over the maximum float error = %v", err)
+	}
+	if _, err := ledger.AssignFloat(ctx, db, ledger.FloatRequest{AgentID: "agent", Amount: 600, BankReference: "FT2"}); err != nil {
+		t.Fatalf("AssignFloat() error = %v", err)
+	}
+
+	// Cash-ins spend the float down to its minimum.
+	if res, err := ledger.AgentCashIn(ctx, db, ledger.TransferRequest{FromAccount: "agent", ToAccount: "alice", Amount: 200}); err != nil {
+		t.Fatalf("AgentCashIn() = %+v, %v", res, err)
+	}
+	if res, err := ledger.AgentCashIn(ctx, db, ledger.TransferRequest{FromAccount: "agent", ToAccount: "alice", Amount: 400}); !errors.Is(err, ledger.ErrFloatLimitExceeded) || res.Code != "float_limit_exceeded" {
+		t.Errorf("AgentCashIn() below the minimum float = %+v, %v", res, err)
+	}
+	// Cash-outs fill it up to its maximum.
+	if res, err := ledger.AgentCashOut(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "agent", Amount: 300}); err != nil {
+		t.Fatalf("AgentCashOut() = %+v, %v", res, err)
+	}
+	if res, err := ledger.AgentCashOut(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "agent", Amount: 400}); !errors.Is(err, ledger.ErrFloatLimitExceeded) {
+		t.Errorf("AgentCashOut() over the maximum float = %+v, %v", res, err)
+	}
+	if res, err := ledger.AgentCashOut(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "treasury", Amount: 10}); err == nil || res.Code != "not_an_agent" {
+		t.Errorf("AgentCashOut() to an account that is not an agent = %+v, %v", res, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "agent"); balance != 700 {
+		t.Errorf("InquireBalance(agent) = %v, want 700", balance)
+	}
+
+	now := time.Now()
+	report, err := ledger.GetAgentFloatReport(ctx, db, "", now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil || len(report) != 1 {
+		t.Fatalf("GetAgentFloatReport() = %+v, %v", report, err)
+	}
+	want := ledger.AgentFloatDay{AgentID: "agent", Day: now.UTC().Format(time.DateOnly), FloatAssigned: 600, CashIn: 200, CashInCount: 1, CashOut: 300, CashOutCount: 1, Net: 700}
+	if report[0] != want {
+		t.Errorf("GetAgentFloatReport() = %+v, want %+v", report[0], want)
+	}
+	if report, err := ledger.GetAgentFloatReport(ctx, db, "", now.Add(time.Hour), now.Add(2*time.Hour), "agent"); err != nil || len(report) != 0 {
+		t.Errorf("GetAgentFloatReport() of a later period = %+v, %v", report, err)
+	}
+}
+
+func TestTransferApprovals(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 5000})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob"})
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", ApprovalThreshold: 1000, RequiredApprovals: 3, Approvers: []string{"ops1", "ops2"}}); err == nil {
+		t.Error("PutTenantConfig() with fewer approvers than required approvals succeeded")
+	}
+	if err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", ApprovalThreshold: 1000, RequiredApprovals: 2, Approvers: []string{"ops1", "ops2", "ops3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 500}); err != nil || res.Code != "successful_transaction" {
+		t.Fatalf("Transfer() below the threshold = %+v, %v", res, err)
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 2000})
+	if err != nil || res.Code != "approval_required" {
+		t.Fatalf("Transfer() above the threshold = %+v, %v", res, err)
+	}
+	transferId := res.Data.TransactionID
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 4500 {
+		t.Errorf("InquireBalance(alice) while pending approval = %v, want 4500", balance)
+	}
+	if pending, err := ledger.ListPendingApprovals(ctx, db, ""); err != nil || len(pending) != 1 {
+		t.Errorf("ListPendingApprovals() = %+v, %v", pending, err)
+	}
+
+	if _, err := ledger.ApproveTransfer(ctx, db, "", transferId); err == nil {
+		t.Error("ApproveTransfer() without an actor succeeded")
+	}
+	if _, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "mallory"), db, "", transferId); err == nil {
+		t.Error("ApproveTransfer() by someone who is not an approver succeeded")
+	}
+	pending, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "ops1"), db, "", transferId)
+	if err != nil || pending.Status != ledger.TransferPendingApproval {
+		t.Fatalf("ApproveTransfer(ops1) = %+v, %v", pending, err)
+	}
+	if _, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "ops1"), db, "", transferId); err == nil {
+		t.Error("ApproveTransfer() twice by the same approver succeeded")
+	}
+	pending, err = ledger.ApproveTransfer(ledger.WithActor(ctx, "ops2"), db, "", transferId)
+	if err != nil || pending.Status != ledger.TransferApproved || pending.TransactionID == "" {
+		t.Fatalf("ApproveTransfer(ops2) = %+v, %v", pending, err)
+	}
+	if got := pending.ApprovedBy; len(got) != 2 || got[0] != "ops1" || got[1] != "ops2" {
+		t.Errorf("ApprovedBy = %v, want [ops1 ops2]", got)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "bob"); balance != 2500 {
+		t.Errorf("InquireBalance(bob) = %v, want 2500", balance)
+	}
+	if err := ledger.RejectTransfer(ledger.WithActor(ctx, "ops3"), db, "", transferId, "too late"); err == nil {
+		t.Error("RejectTransfer() of an executed transfer succeeded")
+	}
+
+	// A single rejection cancels the transfer.
+	res, _ = ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 1500})
+	if _, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "ops1"), db, "", res.Data.TransactionID); err != nil {
+		t.Fatalf("ApproveTransfer() error = %v", err)
+	}
+	if err := ledger.RejectTransfer(ledger.WithActor(ctx, "ops3"), db, "", res.Data.TransactionID, "unknown beneficiary"); err != nil {
+		t.Fatalf("RejectTransfer() error = %v", err)
+	}
+	if _, err := ledger.ApproveTransfer(ledger.WithActor(ctx, "ops2"), db, "", res.Data.TransactionID); err == nil {
+		t.Error("ApproveTransfer() of a rejected transfer succeeded")
+	}
+	rejected, err := ledger.GetTransferApproval(ctx, db, "", res.Data.TransactionID)
+	if err != nil || rejected.Status != ledger.TransferRejected || rejected.RejectedBy != "ops3" {
+		t.Errorf("GetTransferApproval() = %+v, %v", rejected, err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 2500 {
+		t.Errorf("InquireBalance(alice) = %v, want 2500", balance)
+	}
+}
+
+func TestApprovalThresholdOfEveryPath(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	for account, amount := range map[string]float64{"alice": 1000, "bob": 0, "escrow": 0, "claims": 0, "payouts": 0} {
+		ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount)
+	}
+	err := ledger.PutTenantConfig(ctx, db, ledger.TenantConfig{TenantID: "nil", ApprovalThreshold: 100, RequiredApprovals: 1, Approvers: []string{"ops1"},
+		EscrowHoldingAccount: "escrow", PendingClaimsAccount: "claims", PayoutHoldingAccount: "payouts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry points that cannot wait for approval refuse amounts above
+	// the threshold.
+	escrow := ledger.EscrowTransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 150, Arbitrator: "market"}
+	if _, err := ledger.EscrowTransfer(ctx, db, escrow); !errors.Is(err, ledger.ErrApprovalRequired) {
+		t.Errorf("EscrowTransfer() above the approval threshold error = %v, want ErrApprovalRequired", err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 150); !errors.Is(err, ledger.ErrApprovalRequired) {
+		t.Errorf("SendToUnregistered() above the approval threshold error = %v, want ErrApprovalRequired", err)
+	}
+	payout := ledger.PayoutRequest{FromAccount: "alice", Amount: 150, RecipientName: "Mona"}
+	if _, _, err := ledger.CreatePayout(ctx, db, payout); !errors.Is(err, ledger.ErrApprovalRequired) {
+		t.Errorf("CreatePayout() above the approval threshold error = %v, want ErrApprovalRequired", err)
+	}
+	if pending, err := ledger.ListPendingApprovals(ctx, db, "nil"); err != nil || len(pending) != 0 {
+		t.Errorf("ListPendingApprovals() = %+v, %v, want none", pending, err)
+	}
+
+	escrow.Amount, payout.Amount = 100, 100
+	if _, err := ledger.EscrowTransfer(ctx, db, escrow); err != nil {
+		t.Errorf("EscrowTransfer() at the approval threshold error = %v", err)
+	}
+	if _, err := ledger.SendToUnregistered(ctx, db, "nil", "alice", "0911000111", 100); err != nil {
+		t.Errorf("SendToUnregistered() at the approval threshold error = %v", err)
+	}
+	if _, _, err := ledger.CreatePayout(ctx, db, payout); err != nil {
+		t.Errorf("CreatePayout() at the approval threshold error = %v", err)
+	}
+	if balance, _ := ledger.InquireBalance(ctx, db, "nil", "alice"); balance != 700 {
+		t.Errorf("alice has %.2f, want 700", balance)
+	}
+}
+
+func TestArchiveTransactions(t *testing.T) {
+	ctx := context.Background()
+	raw := NewDB()
+	db := newLedger(raw)
+	store := &fakeObjectStore{objects: map[string]string{}}
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 100})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob"})
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if archive, err := ledger.ArchiveTransactions(ctx, db, store, "", now.Add(-time.Hour), 0); err != nil || len(archive.Partitions) != 0 {
+		t.Fatalf("ArchiveTransactions() of nothing = %+v, %v", archive, err)
+	}
+	archive, err := ledger.ArchiveTransactions(ctx, db, store, "", now.Add(time.Hour), 90*24*time.Hour)
+	if err != nil {
+		t.Fatalf("ArchiveTransactions() error = %v", err)
+	}
+	if len(archive.Partitions) != 2 || archive.ExpiresAt == 0 {
+		t.Fatalf("ArchiveTransactions() = %+v, want a transactions and a ledger entries partition", archive)
+	}
+	for _, partition := range archive.Partitions {
+		if _, ok := store.objects[partition.Key]; !ok || !strings.HasPrefix(partition.Key, "archive/nil/"+now.UTC().Format(time.DateOnly)+"/") {
+			t.Errorf("partition %+v was not uploaded under its tenant and day", partition)
+		}
+	}
+	item, _ := raw.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(ledger.TransactionsTable), Key: map[string]types.AttributeValue{
+		"TenantID":      &types.AttributeValueMemberS{Value: "nil"},
+		"TransactionID": &types.AttributeValueMemberS{Value: res.Data.TransactionID},
+	}})
+	if item.Item["ArchiveID"] == nil || item.Item["ExpiresAt"] == nil {
+		t.Errorf("archived transaction = %v, want ArchiveID and ExpiresAt", item.Item)
+	}
+	if again, err := ledger.ArchiveTransactions(ctx, db, store, "", now.Add(time.Hour), 0); err != nil || len(again.Partitions) != 0 {
+		t.Errorf("ArchiveTransactions() run again = %+v, %v", again, err)
+	}
+
+	restored, err := ledger.RestoreFromArchive(ctx, db, store, "", now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("RestoreFromArchive() error = %v", err)
+	}
+	if len(restored.Transactions) != 1 || restored.Transactions[0].SystemTransactionID != res.Data.TransactionID || restored.Transactions[0].Amount != 30 {
+		t.Errorf("restored transactions = %+v", restored.Transactions)
+	}
+	if len(restored.LedgerEntries) != 2 {
+		t.Errorf("restored %d ledger entries, want 2", len(restored.LedgerEntries))
+	}
+	if restored, err := ledger.RestoreFromArchive(ctx, db, store, "", now.Add(-48*time.Hour), now.Add(-24*time.Hour)); err != nil || len(restored.Transactions) != 0 {
+		t.Errorf("RestoreFromArchive() of an earlier period = %+v, %v", restored, err)
+	}
+}
+
+func TestGetBalanceAt(t *testing.T) {
+	ctx := context.Background()
+	db := newLedger(NewDB())
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "alice", Amount: 100})
+	ledger.CreateAccount(ctx, db, "nil", ledger.User{AccountID: "bob"})
+	before := time.Now().Add(-time.Second)
+	if _, err := ledger.Transfer(ctx, db, ledger.TransferRequest{FromAccount: "alice", ToAccount: "bob", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	// Without snapshots, the current balance is rewound.
+	for _, tt := range []struct {
+		account string
+		at      time.Time
+		want    float64
+	}{
+		{"alice", before, 100},
+		{"alice", after, 70},
+		{"bob", before, 0},
+		{"bob", after, 30},
+	} {
+		if got, err := ledger.GetBalanceAt(ctx, db, "", tt.account, tt.at); err != nil || got != tt.want {
+			t.Errorf("GetBalanceAt(%s, %v) = %v, %v, want %v", tt.account, tt.at, got, err, tt.want)
+		}
+	}
+
+	// With one, the entries since are replayed on it.
+	yesterday := time.Now().UTC().Add(-24 * time.Hour)
+	midnight := time.Now().UTC().Truncate(24 * time.Hour)
+	item, _ := attributevalue.MarshalMap(ledger.AccountSnapshot{
+		AccountKey: "nil#alice", Day: yesterday.Format(time.DateOnly), TenantID: "nil", AccountID: "alice", Balance: 100, ClosedAt: midnight.Unix(),
+	})
+	if _, err := db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ledger.SnapshotsTable), Item: item}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ledger.GetBalanceAt(ctx, db, "", "alice", after); err != nil || got != 70 {
+		t.Errorf("GetBalanceAt() from a snapshot = %v, %v, want 70", got, err)
+	}
+	if got, err := ledger.GetBalanceAt(ctx, db, "", "alice", midnight); err != nil || got != 100 {
+		t.Errorf("GetBalanceAt() at the snapshot = %v, %v, want 100", got, err)
+	}
+}
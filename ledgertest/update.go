@@ -0,0 +1,317 @@
+package ledgertest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// action is one action of an update expression. Values are computed against
+// the item as it was before the update, as DynamoDB does.
+type action struct {
+	kind  string // SET, REMOVE, ADD or DELETE
+	path  path
+	value operand
+}
+
+// update applies an update expression to a copy of an item.
+type update func(it item) (item, error)
+
+func parseUpdate(expr string, names map[string]string, values map[string]types.AttributeValue) (update, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+	var actions []action
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		kind := strings.ToUpper(t.text)
+		if t.kind != tokIdent || !slices.Contains([]string{"SET", "REMOVE", "ADD", "DELETE"}, kind) {
+			p.pos--
+			return nil, p.errorf("expected SET, REMOVE, ADD or DELETE")
+		}
+		for {
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			a := action{kind: kind, path: pth}
+			switch kind {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				if a.value, err = p.parseSetValue(); err != nil {
+					return nil, err
+				}
+			case "ADD", "DELETE":
+				if a.value, err = p.parseOperand(); err != nil {
+					return nil, err
+				}
+			}
+			actions = append(actions, a)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if len(actions) == 0 {
+		return nil, p.errorf("empty update expression")
+	}
+
+	return func(old item) (item, error) {
+		values := make([]types.AttributeValue, len(actions))
+		for i, a := range actions {
+			if a.value == nil {
+				continue
+			}
+			v, ok, err := a.value(old)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("ValidationException: the provided expression refers to an attribute that does not exist in the item")
+			}
+			values[i] = v
+		}
+
+		it := copyItem(old)
+		for i, a := range actions {
+			var err error
+			switch a.kind {
+			case "SET":
+				err = setPath(it, a.path, copyValue(values[i]))
+			case "REMOVE":
+				removePath(it, a.path)
+			case "ADD":
+				err = addValue(it, a.path, values[i])
+			case "DELETE":
+				err = deleteValue(it, a.path, values[i])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return it, nil
+	}, nil
+}
+
+// parseSetValue parses the right hand side of a SET action.
+func (p *parser) parseSetValue() (operand, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct("+") && !p.isPunct("-") {
+		return left, nil
+	}
+	subtract := p.next().text == "-"
+	right, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) (types.AttributeValue, bool, error) {
+		a, aok, err := left(it)
+		if err != nil || !aok {
+			return nil, aok, err
+		}
+		b, bok, err := right(it)
+		if err != nil || !bok {
+			return nil, bok, err
+		}
+		v, err := arith(a, b, subtract)
+		return v, err == nil, err
+	}, nil
+}
+
+func (p *parser) parseSetOperand() (operand, error) {
+	t := p.peek()
+	if t.kind != tokIdent || p.toks[p.pos+1].text != "(" {
+		return p.parseOperand()
+	}
+	switch strings.ToLower(t.text) {
+	case "if_not_exists":
+		p.next()
+		p.next()
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		fallback, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) (types.AttributeValue, bool, error) {
+			if v, ok := getPath(it, pth); ok {
+				return v, true, nil
+			}
+			return fallback(it)
+		}, nil
+	case "list_append":
+		p.next()
+		p.next()
+		a, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		b, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) (types.AttributeValue, bool, error) {
+			av, aok, err := a(it)
+			if err != nil || !aok {
+				return nil, aok, err
+			}
+			bv, bok, err := b(it)
+			if err != nil || !bok {
+				return nil, bok, err
+			}
+			al, ok1 := av.(*types.AttributeValueMemberL)
+			bl, ok2 := bv.(*types.AttributeValueMemberL)
+			if !ok1 || !ok2 {
+				return nil, false, fmt.Errorf("ValidationException: list_append operands must be lists")
+			}
+			return &types.AttributeValueMemberL{Value: append(slices.Clone(al.Value), bl.Value...)}, true, nil
+		}, nil
+	}
+	return p.parseOperand()
+}
+
+// parent returns the container holding the last element of pth.
+func parent(it item, pth path) (types.AttributeValue, error) {
+	if len(pth) == 1 {
+		return &types.AttributeValueMemberM{Value: it}, nil
+	}
+	v, ok := getPath(it, pth[:len(pth)-1])
+	if !ok {
+		return nil, fmt.Errorf("ValidationException: the document path provided in the update expression is invalid for update")
+	}
+	return v, nil
+}
+
+func setPath(it item, pth path, v types.AttributeValue) error {
+	container, err := parent(it, pth)
+	if err != nil {
+		return err
+	}
+	last := pth[len(pth)-1]
+	switch c := container.(type) {
+	case *types.AttributeValueMemberM:
+		if !last.isIdx {
+			c.Value[last.name] = v
+			return nil
+		}
+	case *types.AttributeValueMemberL:
+		if last.isIdx {
+			if last.index >= len(c.Value) {
+				c.Value = append(c.Value, v)
+			} else {
+				c.Value[last.index] = v
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("ValidationException: the document path provided in the update expression is invalid for update")
+}
+
+func removePath(it item, pth path) {
+	container, err := parent(it, pth)
+	if err != nil {
+		return
+	}
+	last := pth[len(pth)-1]
+	switch c := container.(type) {
+	case *types.AttributeValueMemberM:
+		delete(c.Value, last.name)
+	case *types.AttributeValueMemberL:
+		if last.isIdx && last.index < len(c.Value) {
+			c.Value = slices.Delete(c.Value, last.index, last.index+1)
+		}
+	}
+}
+
+func addValue(it item, pth path, v types.AttributeValue) error {
+	cur, ok := getPath(it, pth)
+	if !ok {
+		return setPath(it, pth, copyValue(v))
+	}
+	switch c := cur.(type) {
+	case *types.AttributeValueMemberN:
+		sum, err := arith(c, v, false)
+		if err != nil {
+			return err
+		}
+		return setPath(it, pth, sum)
+	case *types.AttributeValueMemberSS:
+		add, ok := v.(*types.AttributeValueMemberSS)
+		if !ok {
+			break
+		}
+		for _, s := range add.Value {
+			if !slices.Contains(c.Value, s) {
+				c.Value = append(c.Value, s)
+			}
+		}
+		return nil
+	case *types.AttributeValueMemberNS:
+		add, ok := v.(*types.AttributeValueMemberNS)
+		if !ok {
+			break
+		}
+		for _, n := range add.Value {
+			if !contains(c, &types.AttributeValueMemberN{Value: n}) {
+				c.Value = append(c.Value, n)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("ValidationException: an operand in the update expression has an incorrect data type")
+}
+
+func deleteValue(it item, pth path, v types.AttributeValue) error {
+	cur, ok := getPath(it, pth)
+	if !ok {
+		return nil
+	}
+	switch c := cur.(type) {
+	case *types.AttributeValueMemberSS:
+		del, ok := v.(*types.AttributeValueMemberSS)
+		if !ok {
+			break
+		}
+		c.Value = slices.DeleteFunc(c.Value, func(s string) bool { return slices.Contains(del.Value, s) })
+		if len(c.Value) == 0 {
+			removePath(it, pth)
+		}
+		return nil
+	case *types.AttributeValueMemberNS:
+		del, ok := v.(*types.AttributeValueMemberNS)
+		if !ok {
+			break
+		}
+		c.Value = slices.DeleteFunc(c.Value, func(n string) bool {
+			return contains(del, &types.AttributeValueMemberN{Value: n})
+		})
+		if len(c.Value) == 0 {
+			removePath(it, pth)
+		}
+		return nil
+	}
+	return fmt.Errorf("ValidationException: an operand in the update expression has an incorrect data type")
+}
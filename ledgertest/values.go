@@ -0,0 +1,294 @@
+package ledgertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func parseNumber(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return nil, fmt.Errorf("ValidationException: invalid number %q", s)
+	}
+	return r, nil
+}
+
+// formatNumber renders r the shortest way that keeps its value.
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := strings.TrimRight(r.FloatString(38), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// arith adds or subtracts two number values.
+func arith(a, b types.AttributeValue, subtract bool) (types.AttributeValue, error) {
+	an, aok := a.(*types.AttributeValueMemberN)
+	bn, bok := b.(*types.AttributeValueMemberN)
+	if !aok || !bok {
+		return nil, fmt.Errorf("ValidationException: an operand in the update expression has an incorrect data type")
+	}
+	x, err := parseNumber(an.Value)
+	if err != nil {
+		return nil, err
+	}
+	y, err := parseNumber(bn.Value)
+	if err != nil {
+		return nil, err
+	}
+	if subtract {
+		x.Sub(x, y)
+	} else {
+		x.Add(x, y)
+	}
+	return &types.AttributeValueMemberN{Value: formatNumber(x)}, nil
+}
+
+func typeName(v types.AttributeValue) string {
+	switch v.(type) {
+	case *types.AttributeValueMemberS:
+		return "S"
+	case *types.AttributeValueMemberN:
+		return "N"
+	case *types.AttributeValueMemberB:
+		return "B"
+	case *types.AttributeValueMemberBOOL:
+		return "BOOL"
+	case *types.AttributeValueMemberNULL:
+		return "NULL"
+	case *types.AttributeValueMemberSS:
+		return "SS"
+	case *types.AttributeValueMemberNS:
+		return "NS"
+	case *types.AttributeValueMemberBS:
+		return "BS"
+	case *types.AttributeValueMemberL:
+		return "L"
+	case *types.AttributeValueMemberM:
+		return "M"
+	}
+	return ""
+}
+
+// compare orders two scalar values of the same type. It reports false for
+// values that cannot be ordered.
+func compare(a, b types.AttributeValue) (int, bool) {
+	switch x := a.(type) {
+	case *types.AttributeValueMemberS:
+		if y, ok := b.(*types.AttributeValueMemberS); ok {
+			return strings.Compare(x.Value, y.Value), true
+		}
+	case *types.AttributeValueMemberN:
+		if y, ok := b.(*types.AttributeValueMemberN); ok {
+			xn, err1 := parseNumber(x.Value)
+			yn, err2 := parseNumber(y.Value)
+			if err1 != nil || err2 != nil {
+				return 0, false
+			}
+			return xn.Cmp(yn), true
+		}
+	case *types.AttributeValueMemberB:
+		if y, ok := b.(*types.AttributeValueMemberB); ok {
+			return bytes.Compare(x.Value, y.Value), true
+		}
+	}
+	return 0, false
+}
+
+func equal(a, b types.AttributeValue) bool {
+	if typeName(a) != typeName(b) {
+		return false
+	}
+	switch x := a.(type) {
+	case *types.AttributeValueMemberS, *types.AttributeValueMemberN, *types.AttributeValueMemberB:
+		c, ok := compare(a, b)
+		return ok && c == 0
+	case *types.AttributeValueMemberBOOL:
+		return x.Value == b.(*types.AttributeValueMemberBOOL).Value
+	case *types.AttributeValueMemberNULL:
+		return true
+	case *types.AttributeValueMemberSS:
+		return sameSet(x.Value, b.(*types.AttributeValueMemberSS).Value)
+	case *types.AttributeValueMemberNS:
+		return sameSet(canonicalNumbers(x.Value), canonicalNumbers(b.(*types.AttributeValueMemberNS).Value))
+	case *types.AttributeValueMemberBS:
+		return sameSet(encodeBytes(x.Value), encodeBytes(b.(*types.AttributeValueMemberBS).Value))
+	case *types.AttributeValueMemberL:
+		y := b.(*types.AttributeValueMemberL)
+		if len(x.Value) != len(y.Value) {
+			return false
+		}
+		for i := range x.Value {
+			if !equal(x.Value[i], y.Value[i]) {
+				return false
+			}
+		}
+		return true
+	case *types.AttributeValueMemberM:
+		y := b.(*types.AttributeValueMemberM)
+		if len(x.Value) != len(y.Value) {
+			return false
+		}
+		for k, v := range x.Value {
+			w, ok := y.Value[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, s := range a {
+		if !slices.Contains(b, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func canonicalNumbers(ns []string) []string {
+	out := make([]string, len(ns))
+	for i, n := range ns {
+		if r, err := parseNumber(n); err == nil {
+			out[i] = formatNumber(r)
+		} else {
+			out[i] = n
+		}
+	}
+	return out
+}
+
+func encodeBytes(bs [][]byte) []string {
+	out := make([]string, len(bs))
+	for i, b := range bs {
+		out[i] = base64.StdEncoding.EncodeToString(b)
+	}
+	return out
+}
+
+func size(v types.AttributeValue) (int, bool) {
+	switch x := v.(type) {
+	case *types.AttributeValueMemberS:
+		return len(x.Value), true
+	case *types.AttributeValueMemberB:
+		return len(x.Value), true
+	case *types.AttributeValueMemberSS:
+		return len(x.Value), true
+	case *types.AttributeValueMemberNS:
+		return len(x.Value), true
+	case *types.AttributeValueMemberBS:
+		return len(x.Value), true
+	case *types.AttributeValueMemberL:
+		return len(x.Value), true
+	case *types.AttributeValueMemberM:
+		return len(x.Value), true
+	}
+	return 0, false
+}
+
+func beginsWith(a, b types.AttributeValue) bool {
+	switch x := a.(type) {
+	case *types.AttributeValueMemberS:
+		y, ok := b.(*types.AttributeValueMemberS)
+		return ok && strings.HasPrefix(x.Value, y.Value)
+	case *types.AttributeValueMemberB:
+		y, ok := b.(*types.AttributeValueMemberB)
+		return ok && bytes.HasPrefix(x.Value, y.Value)
+	}
+	return false
+}
+
+func contains(a, b types.AttributeValue) bool {
+	switch x := a.(type) {
+	case *types.AttributeValueMemberS:
+		y, ok := b.(*types.AttributeValueMemberS)
+		return ok && strings.Contains(x.Value, y.Value)
+	case *types.AttributeValueMemberSS:
+		y, ok := b.(*types.AttributeValueMemberS)
+		return ok && slices.Contains(x.Value, y.Value)
+	case *types.AttributeValueMemberNS:
+		y, ok := b.(*types.AttributeValueMemberN)
+		return ok && slices.ContainsFunc(x.Value, func(n string) bool {
+			return equal(&types.AttributeValueMemberN{Value: n}, y)
+		})
+	case *types.AttributeValueMemberL:
+		return slices.ContainsFunc(x.Value, func(v types.AttributeValue) bool { return equal(v, b) })
+	}
+	return false
+}
+
+// copyValue deep copies a value so stored items never alias caller memory.
+func copyValue(v types.AttributeValue) types.AttributeValue {
+	switch x := v.(type) {
+	case *types.AttributeValueMemberS:
+		return &types.AttributeValueMemberS{Value: x.Value}
+	case *types.AttributeValueMemberN:
+		return &types.AttributeValueMemberN{Value: x.Value}
+	case *types.AttributeValueMemberB:
+		return &types.AttributeValueMemberB{Value: bytes.Clone(x.Value)}
+	case *types.AttributeValueMemberBOOL:
+		return &types.AttributeValueMemberBOOL{Value: x.Value}
+	case *types.AttributeValueMemberNULL:
+		return &types.AttributeValueMemberNULL{Value: x.Value}
+	case *types.AttributeValueMemberSS:
+		return &types.AttributeValueMemberSS{Value: slices.Clone(x.Value)}
+	case *types.AttributeValueMemberNS:
+		return &types.AttributeValueMemberNS{Value: slices.Clone(x.Value)}
+	case *types.AttributeValueMemberBS:
+		out := make([][]byte, len(x.Value))
+		for i, b := range x.Value {
+			out[i] = bytes.Clone(b)
+		}
+		return &types.AttributeValueMemberBS{Value: out}
+	case *types.AttributeValueMemberL:
+		out := make([]types.AttributeValue, len(x.Value))
+		for i, e := range x.Value {
+			out[i] = copyValue(e)
+		}
+		return &types.AttributeValueMemberL{Value: out}
+	case *types.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: copyItem(x.Value)}
+	}
+	return v
+}
+
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	out := make(item, len(it))
+	for k, v := range it {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+// keyString encodes a key attribute so it can index a Go map.
+func keyString(v types.AttributeValue) (string, error) {
+	switch x := v.(type) {
+	case *types.AttributeValueMemberS:
+		return "S:" + x.Value, nil
+	case *types.AttributeValueMemberN:
+		r, err := parseNumber(x.Value)
+		if err != nil {
+			return "", err
+		}
+		return "N:" + formatNumber(r), nil
+	case *types.AttributeValueMemberB:
+		return "B:" + base64.StdEncoding.EncodeToString(x.Value), nil
+	}
+	return "", fmt.Errorf("ValidationException: key attributes must be of type S, N or B")
+}
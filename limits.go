@@ -0,0 +1,273 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var CustomerLimitsTable = "CustomerLimits"
+
+// CustomerLimitIncreaseDelay is how long a loosened customer limit waits
+// before it takes effect. Tightening a limit is always immediate.
+var CustomerLimitIncreaseDelay = 24 * time.Hour
+
+// StepUpVerifier verifies a step-up authentication token (OTP, biometric
+// assertion, ...) for the customer changing their limits.
+type StepUpVerifier func(ctx context.Context, tenantId, accountId, token string) error
+
+// CustomerLimits are limits a customer sets on their own account. They can
+// only be stricter than the tenant limits.
+type CustomerLimits struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	AccountID string `dynamodbav:"AccountID" json:"account_id,omitempty"`
+	// DailySpendCap caps the total sent per UTC day; zero falls back to the tenant limit.
+	DailySpendCap        float64 `dynamodbav:"DailySpendCap" json:"daily_spend_cap,omitempty"`
+	DisableInternational bool    `dynamodbav:"DisableInternational" json:"disable_international,omitempty"`
+	DisableAgentCashOut  bool    `dynamodbav:"DisableAgentCashOut" json:"disable_agent_cash_out,omitempty"`
+	// CardFreeDays are weekdays (e.g. "Friday") on which no outgoing transfer is allowed.
+	CardFreeDays []string `dynamodbav:"CardFreeDays" json:"card_free_days,omitempty"`
+
+	// Pending holds loosened limits waiting for PendingActivatesAt.
+	Pending            *CustomerLimits `dynamodbav:"Pending,omitempty" json:"pending,omitempty"`
+	PendingActivatesAt int64           `dynamodbav:"PendingActivatesAt,omitempty" json:"pending_activates_at,omitempty"`
+	UpdatedAt          int64           `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// Effective returns the limits in force at the given unix time, taking a
+// pending change into account once its delay has passed.
+func (l CustomerLimits) Effective(now int64) CustomerLimits {
+	if l.Pending != nil && now >= l.PendingActivatesAt {
+		effective := *l.Pending
+		effective.TenantID = l.TenantID
+		effective.AccountID = l.AccountID
+		return effective
+	}
+	l.Pending = nil
+	l.PendingActivatesAt = 0
+	return l
+}
+
+// isLooserThan reports whether moving from cur to l relaxes any limit.
+func (l CustomerLimits) isLooserThan(cur CustomerLimits) bool {
+	if cur.DailySpendCap != 0 && (l.DailySpendCap == 0 || l.DailySpendCap > cur.DailySpendCap) {
+		return true
+	}
+	if cur.DisableInternational && !l.DisableInternational {
+		return true
+	}
+	if cur.DisableAgentCashOut && !l.DisableAgentCashOut {
+		return true
+	}
+	for _, day := range cur.CardFreeDays {
+		if !slices.Contains(l.CardFreeDays, day) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l CustomerLimits) validate(tenantCfg *TenantConfig) error {
+	if l.DailySpendCap < 0 {
+		return errors.New("daily spend cap must not be negative")
+	}
+	if tenantCfg.DailySpendLimit != 0 && l.DailySpendCap > tenantCfg.DailySpendLimit {
+		return fmt.Errorf("daily spend cap %.2f exceeds tenant limit %.2f", l.DailySpendCap, tenantCfg.DailySpendLimit)
+	}
+	for _, day := range l.CardFreeDays {
+		if !isWeekday(day) {
+			return fmt.Errorf("unknown weekday: %s", day)
+		}
+	}
+	return nil
+}
+
+// check returns an error if the limits forbid the transfer. spentToday is what
+// the sender has already sent during the current UTC day.
+func (l CustomerLimits) check(trEntry TransactionEntry, tenantCfg *TenantConfig, spentToday float64, now time.Time) error {
+	if slices.Contains(l.CardFreeDays, now.UTC().Weekday().String()) {
+		return fmt.Errorf("outgoing transfers are disabled on %s", now.UTC().Weekday())
+	}
+	if l.DisableInternational && trEntry.IsInternational {
+		return errors.New("international transfers are disabled for this account")
+	}
+	if l.DisableAgentCashOut && trEntry.IsCashOut {
+		return errors.New("agent cash-out is disabled for this account")
+	}
+	if limit := dailySpendLimit(l, tenantCfg); limit != 0 && spentToday+trEntry.Amount > limit {
+		return fmt.Errorf("daily spend limit of %.2f exceeded", limit)
+	}
+	return nil
+}
+
+// dailySpendLimit returns the stricter of the customer and tenant daily limits,
+// zero meaning unlimited.
+func dailySpendLimit(l CustomerLimits, tenantCfg *TenantConfig) float64 {
+	switch {
+	case l.DailySpendCap == 0:
+		return tenantCfg.DailySpendLimit
+	case tenantCfg.DailySpendLimit == 0:
+		return l.DailySpendCap
+	default:
+		return min(l.DailySpendCap, tenantCfg.DailySpendLimit)
+	}
+}
+
+func isWeekday(day string) bool {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if d.String() == day {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCustomerLimits retrieves the limits a customer set on their account,
+// including any pending change. An account without limits gets an empty record.
+func GetCustomerLimits(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*CustomerLimits, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(CustomerLimitsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get limits for account %s: %v", accountId, err)
+	}
+	if result.Item == nil {
+		return &CustomerLimits{TenantID: tenantId, AccountID: accountId}, nil
+	}
+
+	var limits CustomerLimits
+	if err := attributevalue.UnmarshalMap(result.Item, &limits); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal customer limits: %v", err)
+	}
+	return &limits, nil
+}
+
+// SetCustomerLimits changes the limits of an account after verifying the
+// step-up token. Stricter limits apply immediately; looser limits are stored
+// as pending and only take effect after CustomerLimitIncreaseDelay.
+func SetCustomerLimits(ctx context.Context, dbSvc DynamoDBAPI, verify StepUpVerifier, stepUpToken string, limits CustomerLimits) (*CustomerLimits, error) {
+	if limits.TenantID == "" {
+		limits.TenantID = "nil"
+	}
+	if limits.AccountID == "" {
+		return nil, errors.New("accountID is required")
+	}
+	if verify == nil {
+		return nil, errors.New("step-up verification is required to change limits")
+	}
+	if err := verify(ctx, limits.TenantID, limits.AccountID, stepUpToken); err != nil {
+		return nil, fmt.Errorf("step-up verification failed: %w", err)
+	}
+
+	tenantCfg, err := GetTenantConfig(ctx, dbSvc, limits.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.validate(tenantCfg); err != nil {
+		return nil, err
+	}
+
+	stored, err := GetCustomerLimits(ctx, dbSvc, limits.TenantID, limits.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	now := clockOf(dbSvc).Now().UTC()
+	current := stored.Effective(now.Unix())
+	limits.Pending = nil
+	limits.PendingActivatesAt = 0
+
+	next := limits
+	if limits.isLooserThan(current) {
+		next = current
+		next.Pending = &limits
+		next.PendingActivatesAt = now.Add(CustomerLimitIncreaseDelay).Unix()
+	}
+	next.UpdatedAt = now.Unix()
+
+	item, err := attributevalue.MarshalMap(next)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal customer limits: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(CustomerLimitsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store customer limits: %v", err)
+	}
+	return &next, nil
+}
+
+// enforceSpendingLimits checks a transfer against the sender's own limits and
+// the tenant limits. The daily total is only queried when a cap applies.
+func enforceSpendingLimits(ctx context.Context, dbSvc DynamoDBAPI, tenantCfg *TenantConfig, req TransferRequest) error {
+	stored, err := GetCustomerLimits(ctx, dbSvc, req.TenantID, req.FromAccount)
+	if err != nil {
+		return err
+	}
+	now := clockOf(dbSvc).Now().UTC()
+	limits := stored.Effective(now.Unix())
+
+	var spentToday float64
+	if dailySpendLimit(limits, tenantCfg) != 0 {
+		startOfDay := now.Truncate(24 * time.Hour).Unix()
+		spentToday, err = sumOutgoingSince(ctx, dbSvc, req.TenantID, req.FromAccount, startOfDay)
+		if err != nil {
+			return err
+		}
+	}
+	return limits.check(req.Entry(), tenantCfg, spentToday, now)
+}
+
+// sumOutgoingSince sums the successful transfers sent by an account since the given unix time.
+func sumOutgoingSince(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, since int64) (float64, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TransactionsTable),
+		IndexName:              aws.String("FromAccountIndex"),
+		KeyConditionExpression: aws.String("TenantID = :tenantId AND FromAccount = :accountId"),
+		FilterExpression:       aws.String("TransactionDate >= :since AND TransactionStatus = :ok"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId":  &types.AttributeValueMemberS{Value: tenantId},
+			":accountId": &types.AttributeValueMemberS{Value: accountId},
+			":since":     &types.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+			":ok":        &types.AttributeValueMemberN{Value: strconv.Itoa(int(TransactionCompleted))},
+		},
+		ProjectionExpression: aws.String("Amount"),
+	}
+
+	var total float64
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return 0, fmt.Errorf("failed to sum outgoing transfers: %v", err)
+		}
+		var rows []struct {
+			Amount float64 `dynamodbav:"Amount"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &rows); err != nil {
+			return 0, fmt.Errorf("failed to unmarshal transfers: %v", err)
+		}
+		for _, row := range rows {
+			total += row.Amount
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return total, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
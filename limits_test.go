@@ -0,0 +1,71 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCustomerLimitsIsLooserThan(t *testing.T) {
+	current := CustomerLimits{DailySpendCap: 500, DisableInternational: true, CardFreeDays: []string{"Friday"}}
+	tests := []struct {
+		name string
+		next CustomerLimits
+		want bool
+	}{
+		{"same", current, false},
+		{"lower cap", CustomerLimits{DailySpendCap: 100, DisableInternational: true, CardFreeDays: []string{"Friday", "Saturday"}}, false},
+		{"higher cap", CustomerLimits{DailySpendCap: 600, DisableInternational: true, CardFreeDays: []string{"Friday"}}, true},
+		{"cap removed", CustomerLimits{DisableInternational: true, CardFreeDays: []string{"Friday"}}, true},
+		{"international enabled", CustomerLimits{DailySpendCap: 500, CardFreeDays: []string{"Friday"}}, true},
+		{"card-free day removed", CustomerLimits{DailySpendCap: 500, DisableInternational: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.next.isLooserThan(current); got != tt.want {
+				t.Errorf("isLooserThan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomerLimitsEffective(t *testing.T) {
+	limits := CustomerLimits{
+		AccountID:          "0111493885",
+		DailySpendCap:      100,
+		Pending:            &CustomerLimits{DailySpendCap: 1000},
+		PendingActivatesAt: 2000,
+	}
+	if got := limits.Effective(1999); got.DailySpendCap != 100 || got.Pending != nil {
+		t.Errorf("Effective() before activation = %+v, want cap 100", got)
+	}
+	if got := limits.Effective(2000); got.DailySpendCap != 1000 || got.AccountID != "0111493885" {
+		t.Errorf("Effective() after activation = %+v, want cap 1000", got)
+	}
+}
+
+func TestCustomerLimitsCheck(t *testing.T) {
+	friday := time.Date(2024, 5, 24, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		limits     CustomerLimits
+		tenantCfg  TenantConfig
+		trEntry    TransactionEntry
+		spentToday float64
+		wantErr    bool
+	}{
+		{"no limits", CustomerLimits{}, TenantConfig{}, TransactionEntry{Amount: 1e6}, 1e6, false},
+		{"within customer cap", CustomerLimits{DailySpendCap: 100}, TenantConfig{}, TransactionEntry{Amount: 40}, 60, false},
+		{"over customer cap", CustomerLimits{DailySpendCap: 100}, TenantConfig{}, TransactionEntry{Amount: 41}, 60, true},
+		{"tenant stricter", CustomerLimits{DailySpendCap: 100}, TenantConfig{DailySpendLimit: 50}, TransactionEntry{Amount: 51}, 0, true},
+		{"card-free day", CustomerLimits{CardFreeDays: []string{"Friday"}}, TenantConfig{}, TransactionEntry{Amount: 1}, 0, true},
+		{"international disabled", CustomerLimits{DisableInternational: true}, TenantConfig{}, TransactionEntry{Amount: 1, IsInternational: true}, 0, true},
+		{"cash-out disabled", CustomerLimits{DisableAgentCashOut: true}, TenantConfig{}, TransactionEntry{Amount: 1, IsCashOut: true}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.check(tt.trEntry, &tt.tenantCfg, tt.spentToday, friday); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
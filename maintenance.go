@@ -0,0 +1,215 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultMaintenanceRetryAfter is the retry hint given while a maintenance
+// has no expected end, or has overrun it.
+const DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+// ErrMaintenance matches the *MaintenanceError returned for money movements
+// refused while their tenant is under maintenance.
+var ErrMaintenance = errors.New("tenant_maintenance")
+
+// MaintenanceError is returned for money movements refused while their
+// tenant is under maintenance. Nothing was written; retry the request after
+// RetryAfter.
+type MaintenanceError struct {
+	TenantID   string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("tenant_maintenance: tenant %s is under maintenance (%s), retry in %s", e.TenantID, e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+// Code is the error code reported to API clients.
+func (e *MaintenanceError) Code() string {
+	return "tenant_maintenance"
+}
+
+func (e *MaintenanceError) Is(target error) bool {
+	return target == ErrMaintenance
+}
+
+// Maintenance is set on the config of a tenant under maintenance. While it
+// is, transfers and escrow requests are refused, and held transfers due for
+// release wait; reads are served as usual.
+type Maintenance struct {
+	Reason string `dynamodbav:"Reason" json:"reason"`
+	Actor  string `dynamodbav:"Actor" json:"actor"`
+	Since  int64  `dynamodbav:"Since" json:"since"`
+	// Until is when the maintenance is expected to end, in Unix seconds;
+	// zero when unknown.
+	Until int64 `dynamodbav:"Until,omitempty" json:"until,omitempty"`
+}
+
+// retryAfter returns how long clients should wait before retrying at now.
+func (m *Maintenance) retryAfter(now time.Time) time.Duration {
+	if until := time.Unix(m.Until, 0); m.Until > 0 && until.After(now) {
+		return until.Sub(now)
+	}
+	return DefaultMaintenanceRetryAfter
+}
+
+// maintenanceError returns the error refusing money movements of the
+// tenant, or nil when it is not under maintenance.
+func (cfg *TenantConfig) maintenanceError() error {
+	if cfg.Maintenance == nil {
+		return nil
+	}
+	return &MaintenanceError{TenantID: cfg.TenantID, Reason: cfg.Maintenance.Reason, RetryAfter: cfg.Maintenance.retryAfter(time.Now())}
+}
+
+// maintenanceResponse is the response to a transfer refused for
+// maintenance, carrying the retry hint.
+func maintenanceResponse(req TransferRequest, err error) NilResponse {
+	response := failedResponse(req, "tenant_maintenance", "The service is under maintenance, please retry later.", err.Error())
+	var maintenance *MaintenanceError
+	if errors.As(err, &maintenance) {
+		response.RetryAfter = int64(math.Ceil(maintenance.RetryAfter.Seconds()))
+	}
+	return response
+}
+
+// StartMaintenance puts a tenant under maintenance, e.g. for a migration or
+// during an incident. until is when it is expected to end, used for the
+// retry hint; the zero time means unknown. The actor is taken from the
+// context, as for the audit log.
+//
+// Once the flag is stored, StartMaintenance waits for the transfers of the
+// tenant already in flight in this process to finish when dbSvc is a
+// Ledger, so that on return no new money movement starts and none is left
+// running. Cancel ctx to stop waiting; the tenant stays under maintenance.
+func StartMaintenance(ctx context.Context, dbSvc DynamoDBAPI, tenantId, reason string, until time.Time) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if reason == "" {
+		return errors.New("a reason is required to start maintenance")
+	}
+	m := Maintenance{Reason: reason, Actor: ActorFrom(ctx), Since: getCurrentTimestamp()}
+	if !until.IsZero() {
+		m.Until = until.Unix()
+	}
+	av, err := attributevalue.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance: %v", err)
+	}
+	err = setMaintenance(ctx, dbSvc, tenantId, "SET Maintenance = :maintenance", map[string]types.AttributeValue{":maintenance": av})
+	recordAudit(ctx, dbSvc, AuditStartMaintenance, tenantId, tenantId, m, nil, m, err)
+	if err != nil {
+		return err
+	}
+	loggerOf(dbSvc).WarnContext(ctx, "tenant maintenance started", "tenant", tenantId, "reason", reason, "actor", m.Actor)
+	if l, ok := dbSvc.(*Ledger); ok {
+		if err := l.inflight.drain(ctx, tenantId); err != nil {
+			return fmt.Errorf("tenant %s is under maintenance, but its transfers in flight did not finish: %w", tenantId, err)
+		}
+	}
+	return nil
+}
+
+// EndMaintenance lets a tenant move money again.
+func EndMaintenance(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	var before *Maintenance
+	if auditing(dbSvc) {
+		if cfg, err := GetTenantConfig(ctx, dbSvc, tenantId); err == nil {
+			before = cfg.Maintenance
+		}
+	}
+	err := setMaintenance(ctx, dbSvc, tenantId, "REMOVE Maintenance", nil)
+	recordAudit(ctx, dbSvc, AuditEndMaintenance, tenantId, tenantId, nil, before, nil, err)
+	if err != nil {
+		return err
+	}
+	loggerOf(dbSvc).WarnContext(ctx, "tenant maintenance ended", "tenant", tenantId, "actor", ActorFrom(ctx))
+	return nil
+}
+
+// setMaintenance updates the Maintenance of a tenant's config in place, so
+// the rest of the config is kept.
+func setMaintenance(ctx context.Context, dbSvc DynamoDBAPI, tenantId, update string, values map[string]types.AttributeValue) error {
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TenantConfigTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update maintenance of tenant %s: %v", tenantId, err)
+	}
+	return nil
+}
+
+// inflight counts the transfers a Ledger is running, per tenant.
+type inflight struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// begin counts a transfer of tenantId until the returned function is
+// called. It is safe on a nil *inflight, which counts nothing.
+func (f *inflight) begin(tenantId string) func() {
+	if f == nil {
+		return func() {}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts == nil {
+		f.counts = map[string]int{}
+	}
+	f.counts[tenantId]++
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.counts[tenantId]--; f.counts[tenantId] == 0 {
+			delete(f.counts, tenantId)
+		}
+	}
+}
+
+func (f *inflight) count(tenantId string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[tenantId]
+}
+
+// drain waits until no transfer of tenantId is in flight.
+func (f *inflight) drain(ctx context.Context, tenantId string) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for f.count(tenantId) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// beginTransfer counts a transfer as in flight on dbSvc when it is a Ledger.
+func beginTransfer(dbSvc DynamoDBAPI, tenantId string) func() {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.inflight.begin(tenantId)
+	}
+	return func() {}
+}
@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		until int64
+		want  time.Duration
+	}{
+		{"unknown end", 0, DefaultMaintenanceRetryAfter},
+		{"expected end", now.Add(90 * time.Second).Unix(), 90 * time.Second},
+		{"overrun", now.Add(-time.Minute).Unix(), DefaultMaintenanceRetryAfter},
+	}
+	for _, tt := range tests {
+		m := &Maintenance{Reason: "migration", Until: tt.until}
+		if got := m.retryAfter(now); got != tt.want {
+			t.Errorf("%s: retryAfter() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if err := (&TenantConfig{TenantID: "nil"}).maintenanceError(); err != nil {
+		t.Errorf("maintenanceError() without maintenance = %v", err)
+	}
+	err := (&TenantConfig{TenantID: "nil", Maintenance: &Maintenance{Reason: "incident"}}).maintenanceError()
+	if !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("maintenanceError() = %v", err)
+	}
+	res := maintenanceResponse(TransferRequest{InitiatorUUID: "uuid"}, err)
+	if res.Code != "tenant_maintenance" || res.RetryAfter != 300 || res.Data.UUID != "uuid" {
+		t.Errorf("maintenanceResponse() = %+v", res)
+	}
+}
+
+func TestInflightDrain(t *testing.T) {
+	var f inflight
+	end := f.begin("nil")
+	f.begin("other")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := f.drain(ctx, "nil"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("drain() with a transfer in flight = %v", err)
+	}
+	end()
+	if err := f.drain(context.Background(), "nil"); err != nil {
+		t.Errorf("drain() = %v", err)
+	}
+	var none *inflight
+	none.begin("nil")()
+}
@@ -0,0 +1,245 @@
+package ledger
+
+import (
+	"math"
+	"strings"
+	"sync"
+)
+
+// Locales of the message catalog. Other locales can be added with
+// SetMessage.
+const (
+	LocaleEnglish = "en"
+	LocaleArabic  = "ar"
+)
+
+// MessageVars are the variables of message templates, written in them as
+// {amount}, {currency} and {counterparty}. The amount is formatted with the
+// precision of the currency.
+type MessageVars struct {
+	Amount       float64
+	Currency     string
+	Counterparty string
+}
+
+var (
+	messagesMu sync.RWMutex
+	// messages holds the templates of every code by locale. Response codes
+	// are the Code of NilResponse; the descriptions of transactions are
+	// keyed by "narrative." and their kind, and balance alerts by
+	// "subscription." and theirs.
+	messages = map[string]map[string]string{
+		"successful_transaction": {
+			LocaleEnglish: "You sent {amount} {currency} to {counterparty}.",
+			LocaleArabic:  "تم تحويل {amount} {currency} إلى {counterparty}.",
+		},
+		"insufficient_balance": {
+			LocaleEnglish: "Your balance is not enough to send {amount} {currency}.",
+			LocaleArabic:  "رصيدك غير كافٍ لتحويل {amount} {currency}.",
+		},
+		"user_not_found": {
+			LocaleEnglish: "The account was not found.",
+			LocaleArabic:  "الحساب غير موجود.",
+		},
+		"debit_failed": {
+			LocaleEnglish: "The amount could not be debited from your account. Please try again.",
+			LocaleArabic:  "تعذر خصم المبلغ من حسابك. يرجى المحاولة مرة أخرى.",
+		},
+		"credit_failed": {
+			LocaleEnglish: "The amount could not be credited to {counterparty}. Please try again.",
+			LocaleArabic:  "تعذر إيداع المبلغ في حساب {counterparty}. يرجى المحاولة مرة أخرى.",
+		},
+		"invalid_request": {
+			LocaleEnglish: "The request is not valid.",
+			LocaleArabic:  "الطلب غير صالح.",
+		},
+		"invalid_amount": {
+			LocaleEnglish: "The amount {amount} is not valid.",
+			LocaleArabic:  "المبلغ {amount} غير صالح.",
+		},
+		"limit_exceeded": {
+			LocaleEnglish: "Sending {amount} {currency} exceeds the limits of your account.",
+			LocaleArabic:  "تحويل {amount} {currency} يتجاوز حدود حسابك.",
+		},
+		ErrKYCLimitExceeded.Error(): {
+			LocaleEnglish: "Sending {amount} {currency} exceeds the limits of your account's verification level.",
+			LocaleArabic:  "تحويل {amount} {currency} يتجاوز حدود مستوى التحقق لحسابك.",
+		},
+		ErrRateLimited.Error(): {
+			LocaleEnglish: "You made too many transfers. Please try again later.",
+			LocaleArabic:  "لقد أجريت عددًا كبيرًا من التحويلات. يرجى المحاولة لاحقًا.",
+		},
+		ErrTransferBlocked.Error(): {
+			LocaleEnglish: "The transfer to {counterparty} was blocked.",
+			LocaleArabic:  "تم حظر التحويل إلى {counterparty}.",
+		},
+		ErrAccountDormant.Error(): {
+			LocaleEnglish: "Your account is dormant. Please contact support to reactivate it.",
+			LocaleArabic:  "حسابك خامل. يرجى التواصل مع الدعم لإعادة تفعيله.",
+		},
+		ErrFloatLimitExceeded.Error(): {
+			LocaleEnglish: "The transfer exceeds the float limits of the agent.",
+			LocaleArabic:  "التحويل يتجاوز حدود رصيد الوكيل.",
+		},
+		"tenant_maintenance": {
+			LocaleEnglish: "The service is under maintenance. Please try again later.",
+			LocaleArabic:  "الخدمة قيد الصيانة. يرجى المحاولة لاحقًا.",
+		},
+		"transfer_delayed": {
+			LocaleEnglish: "Your transfer of {amount} {currency} to {counterparty} is on hold and will be sent later.",
+			LocaleArabic:  "تحويلك بمبلغ {amount} {currency} إلى {counterparty} معلق وسيتم إرساله لاحقًا.",
+		},
+		"approval_required": {
+			LocaleEnglish: "Your transfer of {amount} {currency} to {counterparty} is waiting for approval.",
+			LocaleArabic:  "تحويلك بمبلغ {amount} {currency} إلى {counterparty} بانتظار الموافقة.",
+		},
+		"request_cancelled": {
+			LocaleEnglish: "The request was cancelled.",
+			LocaleArabic:  "تم إلغاء الطلب.",
+		},
+		"transaction_indeterminate": {
+			LocaleEnglish: "Your transfer is being confirmed. Check its status before trying again.",
+			LocaleArabic:  "جارٍ تأكيد تحويلك. يرجى التحقق من حالته قبل المحاولة مرة أخرى.",
+		},
+		"subscription.balance_below": {
+			LocaleEnglish: "Your balance fell below {amount} {currency}.",
+			LocaleArabic:  "انخفض رصيدك إلى أقل من {amount} {currency}.",
+		},
+		"subscription.credit_above": {
+			LocaleEnglish: "You received {amount} {currency} from {counterparty}.",
+			LocaleArabic:  "استلمت {amount} {currency} من {counterparty}.",
+		},
+		"narrative.transfer_sent": {
+			LocaleEnglish: "Transfer to {counterparty}",
+			LocaleArabic:  "تحويل إلى {counterparty}",
+		},
+		"narrative.transfer_received": {
+			LocaleEnglish: "Transfer from {counterparty}",
+			LocaleArabic:  "تحويل من {counterparty}",
+		},
+		"narrative.wallet_transfer": {
+			LocaleEnglish: "Transfer between your wallets",
+			LocaleArabic:  "تحويل بين محافظك",
+		},
+		"narrative.deposit": {
+			LocaleEnglish: "Deposit",
+			LocaleArabic:  "إيداع",
+		},
+		"narrative.withdrawal": {
+			LocaleEnglish: "Withdrawal",
+			LocaleArabic:  "سحب",
+		},
+		"narrative.cash_pickup": {
+			LocaleEnglish: "Cash pickup",
+			LocaleArabic:  "استلام نقدي",
+		},
+		"narrative.cash_pickup_refund": {
+			LocaleEnglish: "Cash pickup refund",
+			LocaleArabic:  "استرداد استلام نقدي",
+		},
+		"narrative.cashback": {
+			LocaleEnglish: "Cashback",
+			LocaleArabic:  "استرداد نقدي",
+		},
+		"narrative.agent_cash_in": {
+			LocaleEnglish: "Cash-in at agent {counterparty}",
+			LocaleArabic:  "إيداع نقدي لدى الوكيل {counterparty}",
+		},
+		"narrative.agent_cash_out": {
+			LocaleEnglish: "Cash-out at agent {counterparty}",
+			LocaleArabic:  "سحب نقدي لدى الوكيل {counterparty}",
+		},
+	}
+)
+
+// narrativeKinds maps system narratives to the kind of their description.
+// Transfers of other narratives are described as sent or received.
+var narrativeKinds = map[string]string{
+	NarrativeWalletTransfer: "wallet_transfer",
+	NarrativeDeposit:        "deposit",
+	NarrativeWithdrawal:     "withdrawal",
+	NarrativePayout:         "cash_pickup",
+	NarrativePayoutRefund:   "cash_pickup_refund",
+	NarrativeCashback:       "cashback",
+	NarrativeAgentCashIn:    "agent_cash_in",
+	NarrativeAgentCashOut:   "agent_cash_out",
+}
+
+// SetMessage sets the template of a code in a locale, adding to or
+// replacing the built-in catalog, e.g. to word messages for a tenant's
+// customers or to add a locale. Set it at startup.
+func SetMessage(code, locale, template string) {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	if messages[code] == nil {
+		messages[code] = map[string]string{}
+	}
+	messages[code][normalizeLocale(locale)] = template
+}
+
+// Localize returns the text of a code in a locale, with its variables
+// filled in. A locale with a region, such as "ar-SD", uses its language's
+// templates, and a code without a template in the locale uses English. It
+// reports false for codes the catalog does not have.
+func Localize(code, locale string, vars MessageVars) (string, bool) {
+	messagesMu.RLock()
+	templates := messages[code]
+	template, ok := templates[normalizeLocale(locale)]
+	if !ok {
+		template, ok = templates[LocaleEnglish]
+	}
+	messagesMu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	// Without a currency, {currency} is dropped with the space before it.
+	currency := " {currency}"
+	if vars.Currency != "" {
+		currency = "{currency}"
+	}
+	return strings.NewReplacer(
+		currency, vars.Currency,
+		"{amount}", FormatAmount(math.Abs(vars.Amount), vars.Currency),
+		"{counterparty}", vars.Counterparty,
+	).Replace(template), true
+}
+
+// Describe returns display-ready text for the transaction in a locale, from
+// the point of view of accountId, such as "Transfer to bob".
+func (tx TransactionEntry) Describe(accountId, locale string) string {
+	kind, ok := narrativeKinds[tx.Comment]
+	counterparty := tx.ToAccount
+	if tx.ToAccount == accountId {
+		counterparty = tx.FromAccount
+	}
+	if !ok {
+		kind = "transfer_sent"
+		if tx.ToAccount == accountId {
+			kind = "transfer_received"
+		}
+	}
+	text, _ := Localize("narrative."+kind, locale, MessageVars{Amount: tx.NetAmount(accountId), Currency: tx.Currency, Counterparty: counterparty})
+	return text
+}
+
+// localizeResponse sets the message of a transfer's response in the locale
+// the transfer asked for. Responses of codes the catalog does not have keep
+// their English message.
+func localizeResponse(req TransferRequest, response *NilResponse) {
+	if req.Locale == "" {
+		return
+	}
+	vars := MessageVars{Amount: req.Amount, Currency: response.Data.Currency, Counterparty: req.ToAccount}
+	if text, ok := Localize(response.Code, req.Locale, vars); ok {
+		response.Message = text
+	}
+}
+
+// normalizeLocale returns the language of a locale, lower cased: "ar" for
+// "ar-SD", "AR_sd" or an Accept-Language header of "ar-SD,en;q=0.8".
+func normalizeLocale(locale string) string {
+	if i := strings.IndexAny(locale, "-_;,"); i >= 0 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(locale))
+}
@@ -0,0 +1,52 @@
+package ledger
+
+import "testing"
+
+func TestLocalize(t *testing.T) {
+	vars := MessageVars{Amount: 1500, Currency: "SDG", Counterparty: "bob"}
+	tests := []struct {
+		code, locale string
+		vars         MessageVars
+		want         string
+		wantOk       bool
+	}{
+		{"successful_transaction", "en", vars, "You sent 1500.00 SDG to bob.", true},
+		{"successful_transaction", "ar", vars, "تم تحويل 1500.00 SDG إلى bob.", true},
+		{"successful_transaction", "ar-SD,en;q=0.8", vars, "تم تحويل 1500.00 SDG إلى bob.", true},
+		{"successful_transaction", "fr", vars, "You sent 1500.00 SDG to bob.", true},
+		{"successful_transaction", "en", MessageVars{Amount: 2.5, Counterparty: "bob"}, "You sent 2.50 to bob.", true},
+		{"narrative.transfer_received", "AR_sd", vars, "تحويل من bob", true},
+		{"no_such_code", "en", vars, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Localize(tt.code, tt.locale, tt.vars)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("Localize(%q, %q) = %q, %v, want %q, %v", tt.code, tt.locale, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	SetMessage("test_code", "fr", "Envoyé {amount}")
+	if got, _ := Localize("test_code", "fr-FR", vars); got != "Envoyé 1500.00" {
+		t.Errorf("Localize() after SetMessage = %q", got)
+	}
+}
+
+func TestTransactionDescribe(t *testing.T) {
+	tx := TransactionEntry{FromAccount: "alice", ToAccount: "bob", Amount: 10, Currency: "SDG"}
+	if got := tx.Describe("alice", "en"); got != "Transfer to bob" {
+		t.Errorf("Describe(sender) = %q", got)
+	}
+	if got := tx.Describe("bob", "ar"); got != "تحويل من alice" {
+		t.Errorf("Describe(receiver) = %q", got)
+	}
+	tx.Comment = NarrativeDeposit
+	if got := tx.Describe("bob", "ar"); got != "إيداع" {
+		t.Errorf("Describe(deposit) = %q", got)
+	}
+
+	response := NilResponse{Code: "insufficient_balance", Message: "insufficient balance"}
+	localizeResponse(TransferRequest{Amount: 20, ToAccount: "bob", Locale: "ar"}, &response)
+	if response.Message != "رصيدك غير كافٍ لتحويل 20.00." {
+		t.Errorf("localizeResponse() message = %q", response.Message)
+	}
+}
@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bounds of the metadata and tags of a transaction, which are stored on its
+// record and count against DynamoDB's item size. Tags are at most
+// MaxTagLength characters, like annotation tags.
+const (
+	MaxMetadataEntries     = 20
+	MaxMetadataKeyLength   = 64
+	MaxMetadataValueLength = 256
+	MaxTransactionTags     = 10
+)
+
+// ErrInvalidMetadata is returned for transfers whose metadata or tags are
+// out of bounds.
+var ErrInvalidMetadata = errors.New("invalid_metadata")
+
+// normalizeTags trims tags and drops empty and repeated ones, keeping the
+// first occurrence.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// validateMetadata checks metadata and normalized tags against their bounds.
+func validateMetadata(metadata map[string]string, tags []string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return fmt.Errorf("%w: %d metadata entries, at most %d allowed", ErrInvalidMetadata, len(metadata), MaxMetadataEntries)
+	}
+	for key, value := range metadata {
+		if err := checkMetadataText("metadata key", key, MaxMetadataKeyLength); err != nil {
+			return err
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%w: value of metadata key %q is longer than %d characters or has control characters", ErrInvalidMetadata, key, MaxMetadataValueLength)
+		}
+	}
+	if len(tags) > MaxTransactionTags {
+		return fmt.Errorf("%w: %d tags, at most %d allowed", ErrInvalidMetadata, len(tags), MaxTransactionTags)
+	}
+	for _, tag := range tags {
+		if err := checkMetadataText("tag", tag, MaxTagLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkMetadataText(what, s string, maxLength int) error {
+	switch {
+	case strings.TrimSpace(s) == "":
+		return fmt.Errorf("%w: empty %s", ErrInvalidMetadata, what)
+	case utf8.RuneCountInString(s) > maxLength:
+		return fmt.Errorf("%w: %s %q is longer than %d characters", ErrInvalidMetadata, what, s, maxLength)
+	case strings.IndexFunc(s, unicode.IsControl) >= 0:
+		return fmt.Errorf("%w: %s %q has control characters", ErrInvalidMetadata, what, s)
+	}
+	return nil
+}
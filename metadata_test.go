@@ -0,0 +1,45 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	got := normalizeTags([]string{" food ", "", "food", "rent"})
+	if want := []string{"food", "rent"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeTags() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= MaxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		tags     []string
+		wantErr  bool
+	}{
+		{"valid", map[string]string{"order_id": "ord-1"}, []string{"food"}, false},
+		{"empty key", map[string]string{"": "v"}, nil, true},
+		{"long value", map[string]string{"k": strings.Repeat("v", MaxMetadataValueLength+1)}, nil, true},
+		{"control character", map[string]string{"k": "a\nb"}, nil, true},
+		{"too many entries", tooMany, nil, true},
+		{"long tag", nil, []string{strings.Repeat("t", MaxTagLength+1)}, true},
+		{"too many tags", nil, strings.Split("a,b,c,d,e,f,g,h,i,j,k", ","), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetadata(tt.metadata, tt.tags)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidMetadata)) {
+				t.Errorf("validateMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
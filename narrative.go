@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/adonese/ledger/validation"
+)
+
+// MaxNarrativeLength is the most characters a narrative may have.
+const MaxNarrativeLength = validation.MaxCommentLength
+
+// ErrInvalidNarrative is returned for narratives that are too long once
+// sanitized.
+var ErrInvalidNarrative = errors.New("invalid_narrative")
+
+// System narratives, stored as the Comment of transactions by the operation
+// that created them. The caller's own text goes in Narrative.
+const (
+	NarrativeTransfer             = "Transfer credits"
+	NarrativeThirdPartyTransfer   = "Transfer by third-party app"
+	NarrativeReleasedTransfer     = "Released held transfer"
+	NarrativeWalletTransfer       = "Transfer between wallets"
+	NarrativeDeposit              = "Deposit"
+	NarrativeWithdrawal           = "Withdrawal"
+	NarrativePayout               = "Cash pickup"
+	NarrativePayoutRedeemed       = "Cash pickup paid out"
+	NarrativePayoutRefund         = "Cash pickup refund"
+	NarrativeUnregisteredTransfer = "Transfer to unregistered recipient"
+	NarrativeClaimedTransfer      = "Transfer claimed"
+	NarrativeClaimRefund          = "Unclaimed transfer refund"
+	NarrativeEscrow               = "Escrow"
+	NarrativeEscrowReleased       = "Escrow released"
+	NarrativeEscrowRefunded       = "Escrow refunded"
+	NarrativeSplitTransfer        = "Split transfer"
+	NarrativeDisputeFrozen        = "Disputed amount frozen"
+	NarrativeDisputeReversed      = "Dispute reversed"
+	NarrativeDisputeReleased      = "Dispute released"
+	NarrativeCashback             = "Cashback"
+	NarrativeAgentCashIn          = "Agent cash-in"
+	NarrativeAgentCashOut         = "Agent cash-out"
+	NarrativeApprovedTransfer     = "Approved transfer"
+	NarrativeFailedTransfer       = "failed"
+)
+
+// transferNarrative returns the system narrative of a transfer.
+func transferNarrative(req TransferRequest, opts transferOptions) string {
+	switch {
+	case opts.comment != "":
+		return opts.comment
+	case opts.approved:
+		return NarrativeApprovedTransfer
+	case opts.skipDelay:
+		return NarrativeReleasedTransfer
+	case opts.betweenWallets:
+		return NarrativeWalletTransfer
+	case req.ThirdPartyID != "":
+		return NarrativeThirdPartyTransfer
+	}
+	return NarrativeTransfer
+}
+
+// SanitizeNarrative cleans caller supplied text before it is stored: control
+// and invisible formatting characters are dropped, line breaks and runs of
+// spaces become one space, and invalid UTF-8 is removed. It fails with
+// ErrInvalidNarrative when the result is longer than MaxNarrativeLength.
+//
+// Narratives are only ever sent to DynamoDB as expression attribute values,
+// never spliced into expressions, so quotes and operators are kept as typed.
+func SanitizeNarrative(s string) (string, error) {
+	s = strings.ToValidUTF8(s, "")
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			space = b.Len() > 0
+			continue
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r), r == utf8.RuneError:
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	s = b.String()
+	if err := validation.Comment("narrative", s); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidNarrative, err)
+	}
+	return s, nil
+}
+
+// narrativeSearchKey is the form narratives are stored and searched in, so
+// searches ignore case.
+func narrativeSearchKey(narrative string) string {
+	return strings.ToLower(narrative)
+}
@@ -0,0 +1,32 @@
+package ledger
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeNarrative(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"Rent for May", "Rent for May", false},
+		{"  Rent\tfor\r\nMay  ", "Rent for May", false},
+		{"Rent\x00\x1b[31m", "Rent[31m", false},
+		{"Re\u200bnt\xff", "Rent", false},
+		{"x' OR #a = :b", "x' OR #a = :b", false},
+		{strings.Repeat("a", MaxNarrativeLength), strings.Repeat("a", MaxNarrativeLength), false},
+		{strings.Repeat("é", MaxNarrativeLength+1), "", true},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeNarrative(tt.in)
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidNarrative)) {
+			t.Errorf("SanitizeNarrative(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("SanitizeNarrative(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -76,6 +76,31 @@ func HandleDynamoDBStream(ctx context.Context, event events.DynamoDBEvent) error
 	return nil
 }
 
+// Notifier delivers a message to the owner of an account, e.g. over SMS or push.
+type Notifier func(ctx context.Context, tenantId, accountId, message string) error
+
+// DefaultNotifier is used for the notifications the ledger sends on its own.
+// While it is nil, the default, notifications are only logged at info level
+// by the Ledger's logger; deployments set it to their own gateway.
+var DefaultNotifier Notifier
+
+// notify sends a message through DefaultNotifier. Notifications are best
+// effort and never fail the operation that raised them; in degraded mode they
+// are deferred.
+func notify(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, message string) {
+	notifier := DefaultNotifier
+	if notifier == nil {
+		loggerOf(dbSvc).InfoContext(ctx, "notification", "tenant", tenantId, "account", accountId, "message", message)
+		return
+	}
+	err := Defer(ctx, dbSvc, "notify "+accountId, func(ctx context.Context) error {
+		return notifier(ctx, tenantId, accountId, message)
+	})
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "failed to notify account", "tenant", tenantId, "account", accountId, "error", err)
+	}
+}
+
 func SendSMS(sms SMS) error {
 	log.Printf("the message is: %+v", sms)
 	v := url.Values{}
@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// balanceFloor returns the lowest balance a transfer may leave on an
+// account: minus its overdraft limit when it has one, and the tenant's
+// minimum balance otherwise.
+func (cfg *TenantConfig) balanceFloor(account *User) float64 {
+	if account.OverdraftLimit > 0 {
+		return -account.OverdraftLimit
+	}
+	return cfg.MinimumBalance
+}
+
+// SetOverdraftLimit lets transfers take an account's balance down to minus
+// limit; zero removes the overdraft, so the tenant's MinimumBalance applies
+// again. Lowering the limit below what is already overdrawn does not change
+// the balance, but blocks further debits.
+func SetOverdraftLimit(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, limit float64) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if limit < 0 {
+		return errors.New("overdraft limit must not be negative")
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:    aws.String("REMOVE OverdraftLimit"),
+		ConditionExpression: aws.String("attribute_exists(AccountID)"),
+	}
+	if limit > 0 {
+		input.UpdateExpression = aws.String("SET OverdraftLimit = :limit")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":limit": &types.AttributeValueMemberN{Value: formatAmount(limit)},
+		}
+	}
+	_, err := dbSvc.UpdateItem(ctx, input)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("account %s does not exist", accountId)
+	} else if err != nil {
+		err = fmt.Errorf("failed to set overdraft limit of %s: %v", accountId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	recordAudit(ctx, dbSvc, AuditSetOverdraftLimit, tenantId, accountId, map[string]any{"overdraft_limit": limit}, before, after, err)
+	return err
+}
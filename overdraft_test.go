@@ -0,0 +1,16 @@
+package ledger
+
+import "testing"
+
+func TestBalanceFloor(t *testing.T) {
+	cfg := &TenantConfig{MinimumBalance: 10}
+	if got := cfg.balanceFloor(&User{}); got != 10 {
+		t.Errorf("floor without overdraft = %v, want the minimum balance 10", got)
+	}
+	if got := cfg.balanceFloor(&User{OverdraftLimit: 50}); got != -50 {
+		t.Errorf("floor with overdraft = %v, want -50", got)
+	}
+	if err := (&TenantConfig{MinimumBalance: -1}).Validate(); err == nil {
+		t.Error("Validate() accepted a negative minimum balance")
+	}
+}
@@ -0,0 +1,71 @@
+package ledger
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrInvalidPageToken is returned by DecodePageToken for a token it did not
+// issue.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// pageKey is a key attribute in a page token.
+type pageKey struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+// EncodePageToken encodes the key a page stopped at, such as the one
+// returned by GetAllNilTransactions, as an opaque URL-safe token for API
+// clients to ask for the next page with. The nil key of the last page
+// encodes as "".
+func EncodePageToken(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	token := map[string]pageKey{}
+	for name, v := range key {
+		switch v := v.(type) {
+		case *types.AttributeValueMemberS:
+			token[name] = pageKey{S: v.Value}
+		case *types.AttributeValueMemberN:
+			token[name] = pageKey{N: v.Value}
+		default:
+			return "", fmt.Errorf("unsupported page key attribute %s", name)
+		}
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal page token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodePageToken decodes a token of EncodePageToken back to the key to
+// start the next page at; "" decodes to nil, the first page.
+func DecodePageToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrInvalidPageToken, token)
+	}
+	var keys map[string]pageKey
+	if err := json.Unmarshal(data, &keys); err != nil || len(keys) == 0 {
+		return nil, fmt.Errorf("%w %q", ErrInvalidPageToken, token)
+	}
+	key := map[string]types.AttributeValue{}
+	for name, v := range keys {
+		if v.N != "" {
+			key[name] = &types.AttributeValueMemberN{Value: v.N}
+		} else {
+			key[name] = &types.AttributeValueMemberS{Value: v.S}
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,32 @@
+package ledger
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestPageToken(t *testing.T) {
+	token, err := EncodePageToken(nil)
+	if err != nil || token != "" {
+		t.Fatalf("EncodePageToken(nil) = %q, %v", token, err)
+	}
+	key := map[string]types.AttributeValue{
+		"TenantID":        &types.AttributeValueMemberS{Value: "acme"},
+		"TransactionDate": &types.AttributeValueMemberN{Value: "1700000000"},
+	}
+	if token, err = EncodePageToken(key); err != nil {
+		t.Fatalf("EncodePageToken() error = %v", err)
+	}
+	got, err := DecodePageToken(token)
+	if err != nil || !reflect.DeepEqual(got, key) {
+		t.Errorf("DecodePageToken() = %v, %v, want %v", got, err, key)
+	}
+	for _, bad := range []string{"!", "bnVsbA"} {
+		if _, err := DecodePageToken(bad); !errors.Is(err, ErrInvalidPageToken) {
+			t.Errorf("DecodePageToken(%q) error = %v, want ErrInvalidPageToken", bad, err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// PaymentRequestsTable holds the payment requests of merchants, keyed by
+// TenantID and RequestID. It needs a MerchantCreatedAtIndex GSI
+// (MerchantKey, CreatedAt) for listing and a StatusExpiresAtIndex GSI
+// (Status, ExpiresAt) for the expiry job.
+var PaymentRequestsTable = "PaymentRequests"
+
+const (
+	PaymentRequestPending   = "pending"
+	PaymentRequestPaying    = "paying"
+	PaymentRequestPaid      = "paid"
+	PaymentRequestExpired   = "expired"
+	PaymentRequestCancelled = "cancelled"
+)
+
+// ErrPaymentRequestNotPayable is returned for a payment request that is
+// paid, being paid, cancelled or expired.
+var ErrPaymentRequestNotPayable = errors.New("payment_request_not_payable")
+
+// PaymentRequest is an amount a merchant asks to be paid, e.g. an invoice or
+// the checkout of a QR code. Anyone holding its ID can pay it once, until it
+// expires.
+type PaymentRequest struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id"`
+	RequestID string `dynamodbav:"RequestID" json:"request_id"`
+	// MerchantID is the account paid.
+	MerchantID  string  `dynamodbav:"MerchantID" json:"merchant_id"`
+	MerchantKey string  `dynamodbav:"MerchantKey" json:"-"`
+	Amount      float64 `dynamodbav:"Amount" json:"amount"`
+	// Reference is the merchant's own reference, e.g. an order number. It
+	// is the narrative of the payment.
+	Reference string `dynamodbav:"Reference,omitempty" json:"reference,omitempty"`
+	Status    string `dynamodbav:"Status" json:"status"`
+	ExpiresAt int64  `dynamodbav:"ExpiresAt" json:"expires_at"`
+	// PaidBy and TransactionID are set once the request is paid.
+	PaidBy        string `dynamodbav:"PaidBy,omitempty" json:"paid_by,omitempty"`
+	TransactionID string `dynamodbav:"TransactionID,omitempty" json:"transaction_id,omitempty"`
+	// LastError is the reason the last attempt to pay it failed.
+	LastError string `dynamodbav:"LastError,omitempty" json:"last_error,omitempty"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt int64  `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// Payable reports whether the request can be paid at now.
+func (p *PaymentRequest) Payable(now time.Time) bool {
+	return p.Status == PaymentRequestPending && now.Unix() < p.ExpiresAt
+}
+
+func merchantKey(tenantId, merchantId string) string {
+	return tenantId + "#" + merchantId
+}
+
+// CreatePaymentRequest creates a request for amount to be paid to the
+// merchant's account before expiresAt, and returns it with its ID.
+func CreatePaymentRequest(ctx context.Context, dbSvc DynamoDBAPI, tenantId, merchantId string, amount float64, expiresAt time.Time, reference string) (*PaymentRequest, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	now := time.Now().UTC()
+	switch {
+	case merchantId == "":
+		return nil, errors.New("merchant id is required")
+	case amount <= 0:
+		return nil, fmt.Errorf("invalid amount %.2f", amount)
+	case !expiresAt.After(now):
+		return nil, errors.New("payment request expires in the past")
+	}
+	reference, err := SanitizeNarrative(reference)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getAccount(ctx, dbSvc, tenantId, merchantId); err != nil {
+		return nil, fmt.Errorf("failed to get merchant account %s: %v", merchantId, err)
+	}
+	request := PaymentRequest{
+		TenantID:    tenantId,
+		RequestID:   ksuid.New().String(),
+		MerchantID:  merchantId,
+		MerchantKey: merchantKey(tenantId, merchantId),
+		Amount:      amount,
+		Reference:   reference,
+		Status:      PaymentRequestPending,
+		ExpiresAt:   expiresAt.Unix(),
+		CreatedAt:   now.Unix(),
+		UpdatedAt:   now.Unix(),
+	}
+	item, err := attributevalue.MarshalMap(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payment request: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(PaymentRequestsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(RequestID)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store payment request: %v", err)
+	}
+	return &request, nil
+}
+
+// GetPaymentRequest retrieves a payment request by its ID.
+func GetPaymentRequest(ctx context.Context, dbSvc DynamoDBAPI, tenantId, requestId string) (*PaymentRequest, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(PaymentRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"RequestID": &types.AttributeValueMemberS{Value: requestId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment request %s: %v", requestId, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("payment request %s not found", requestId)
+	}
+	var request PaymentRequest
+	if err := attributevalue.UnmarshalMap(result.Item, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payment request: %v", err)
+	}
+	return &request, nil
+}
+
+// PayRequest pays a payment request from the payer's account, with the
+// same checks as Transfer, and marks it paid. The request is claimed first,
+// so it is paid at most once however many payers try. A transfer the
+// ledger refuses, e.g. for insufficient balance, leaves the request pending
+// with the reason in LastError, so it can be paid again. A large transfer
+// held for review pays the request; its TransactionID is then the ID of the
+// held transfer.
+func PayRequest(ctx context.Context, dbSvc DynamoDBAPI, tenantId, payerId, requestId string) (NilResponse, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	request, err := GetPaymentRequest(ctx, dbSvc, tenantId, requestId)
+	if err != nil {
+		return NilResponse{Status: "error", Code: "payment_request_not_found", Message: "The payment request does not exist.", Details: err.Error()}, err
+	}
+	req := TransferRequest{
+		TenantID:      tenantId,
+		FromAccount:   payerId,
+		ToAccount:     request.MerchantID,
+		Amount:        request.Amount,
+		InitiatorUUID: request.RequestID,
+		Narrative:     request.Reference,
+		Metadata:      map[string]string{"payment_request": request.RequestID},
+	}
+	now := time.Now().UTC()
+	if !request.Payable(now) {
+		return failedResponse(req, ErrPaymentRequestNotPayable.Error(), "The payment request cannot be paid.", fmt.Sprintf("The payment request is %s.", request.displayStatus(now))), ErrPaymentRequestNotPayable
+	}
+	err = setPaymentRequestStatus(ctx, dbSvc, request, PaymentRequestPending, PaymentRequestPaying, "ExpiresAt > :now", nil)
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return failedResponse(req, ErrPaymentRequestNotPayable.Error(), "The payment request cannot be paid.", "The payment request was paid, cancelled or expired meanwhile."), ErrPaymentRequestNotPayable
+		}
+		return failedResponse(req, "payment_request_failed", "Failed to pay the payment request.", err.Error()), err
+	}
+
+	response, transferErr := transferCredits(ctx, dbSvc, req, transferOptions{})
+	status := PaymentRequestPaid
+	updates := map[string]types.AttributeValue{
+		"PaidBy":        &types.AttributeValueMemberS{Value: payerId},
+		"TransactionID": &types.AttributeValueMemberS{Value: response.Data.TransactionID},
+	}
+	if transferErr != nil {
+		status = PaymentRequestPending
+		updates = map[string]types.AttributeValue{
+			"LastError": &types.AttributeValueMemberS{Value: response.Code},
+		}
+	}
+	if err := setPaymentRequestStatus(ctx, dbSvc, request, PaymentRequestPaying, status, "", updates); err != nil {
+		// The transfer stands; only the request's status is stale.
+		loggerOf(dbSvc).ErrorContext(ctx, "failed to record payment request status", "tenant", tenantId, "request", requestId, "status", status, "error", err)
+	}
+	return response, transferErr
+}
+
+// displayStatus is the status of the request, as expired once it is past
+// its expiry even if the expiry job has not marked it yet.
+func (p *PaymentRequest) displayStatus(now time.Time) string {
+	if p.Status == PaymentRequestPending && now.Unix() >= p.ExpiresAt {
+		return PaymentRequestExpired
+	}
+	return p.Status
+}
+
+// CancelPaymentRequest cancels a pending payment request on behalf of its
+// merchant.
+func CancelPaymentRequest(ctx context.Context, dbSvc DynamoDBAPI, tenantId, merchantId, requestId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	request := &PaymentRequest{TenantID: tenantId, RequestID: requestId, MerchantID: merchantId}
+	err := setPaymentRequestStatus(ctx, dbSvc, request, PaymentRequestPending, PaymentRequestCancelled, "MerchantID = :merchant", nil)
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("payment request %s cannot be cancelled", requestId)
+		}
+		return err
+	}
+	return nil
+}
+
+// ListPaymentRequests returns the merchant's payment requests, newest
+// first, with the given status or all of them when status is "".
+func ListPaymentRequests(ctx context.Context, dbSvc DynamoDBAPI, tenantId, merchantId, status string) ([]PaymentRequest, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(PaymentRequestsTable),
+		IndexName:              aws.String("MerchantCreatedAtIndex"),
+		KeyConditionExpression: aws.String("MerchantKey = :merchant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":merchant": &types.AttributeValueMemberS{Value: merchantKey(tenantId, merchantId)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if status != "" {
+		input.FilterExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames = map[string]string{"#status": "Status"}
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+	}
+	var requests []PaymentRequest
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query payment requests: %v", err)
+		}
+		var page []PaymentRequest
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal payment requests: %v", err)
+		}
+		requests = append(requests, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return requests, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// ExpirePaymentRequests is run periodically to mark the pending payment
+// requests past their expiry as expired, and returns how many it marked.
+// Requests past their expiry cannot be paid even before it runs.
+func ExpirePaymentRequests(ctx context.Context, dbSvc DynamoDBAPI, now time.Time) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(PaymentRequestsTable),
+		IndexName:                aws.String("StatusExpiresAtIndex"),
+		KeyConditionExpression:   aws.String("#status = :pending AND ExpiresAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: PaymentRequestPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	expired := 0
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return expired, fmt.Errorf("failed to query payment requests: %v", err)
+		}
+		var page []PaymentRequest
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return expired, fmt.Errorf("failed to unmarshal payment requests: %v", err)
+		}
+		for i := range page {
+			err := setPaymentRequestStatus(ctx, dbSvc, &page[i], PaymentRequestPending, PaymentRequestExpired, "", nil)
+			var condErr *types.ConditionalCheckFailedException
+			switch {
+			case err == nil:
+				expired++
+			case errors.As(err, &condErr):
+				// Paid or cancelled in the meantime.
+			default:
+				errs = append(errs, err)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return expired, errors.Join(errs...)
+}
+
+// setPaymentRequestStatus moves a request from one status to another,
+// under an extra condition when it is not "", and sets updates with it.
+// The condition may use :now and, for the merchant, :merchant.
+func setPaymentRequestStatus(ctx context.Context, dbSvc DynamoDBAPI, request *PaymentRequest, from, to, condition string, updates map[string]types.AttributeValue) error {
+	now := strconv.FormatInt(getCurrentTimestamp(), 10)
+	expr := "SET #status = :to, UpdatedAt = :now"
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: from},
+		":to":   &types.AttributeValueMemberS{Value: to},
+		":now":  &types.AttributeValueMemberN{Value: now},
+	}
+	for name, value := range updates {
+		expr += fmt.Sprintf(", %s = :%s", name, name)
+		values[":"+name] = value
+	}
+	cond := "#status = :from"
+	if condition != "" {
+		cond += " AND " + condition
+		if strings.Contains(condition, ":merchant") {
+			values[":merchant"] = &types.AttributeValueMemberS{Value: request.MerchantID}
+		}
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(PaymentRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: request.TenantID},
+			"RequestID": &types.AttributeValueMemberS{Value: request.RequestID},
+		},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return err
+		}
+		return fmt.Errorf("failed to update payment request %s: %v", request.RequestID, err)
+	}
+	return nil
+}
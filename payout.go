@@ -0,0 +1,412 @@
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PayoutsTable holds cash pickup payouts, keyed by TenantID and the hash of
+// their code.
+var PayoutsTable = "Payouts"
+
+// DefaultPayoutTTL is how long a payout can be redeemed when the tenant sets
+// no PayoutTTL.
+var DefaultPayoutTTL = 72 * time.Hour
+
+// payoutCodeDigits is the length of payout codes.
+const payoutCodeDigits = 10
+
+const (
+	PayoutPending   = "pending"
+	PayoutRedeemed  = "redeemed"
+	PayoutCancelled = "cancelled"
+	PayoutExpired   = "expired"
+)
+
+// Payout is money sent for cash pickup by a recipient without an account.
+// The sender's funds are held in the tenant's PayoutHoldingAccount until an
+// agent pays the recipient out, or they are refunded on cancellation or
+// expiry. The code the recipient presents is only stored hashed.
+type Payout struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id"`
+	CodeHash string `dynamodbav:"CodeHash" json:"-"`
+	// PayoutID is the journal that funded the payout.
+	PayoutID    string  `dynamodbav:"PayoutID" json:"payout_id"`
+	FromAccount string  `dynamodbav:"FromAccount" json:"from_account"`
+	Amount      float64 `dynamodbav:"Amount" json:"amount"`
+	// RecipientName and RecipientIDNumber are what the agent checks the
+	// recipient's ID against.
+	RecipientName     string `dynamodbav:"RecipientName" json:"recipient_name"`
+	RecipientIDNumber string `dynamodbav:"RecipientIDNumber,omitempty" json:"recipient_id_number,omitempty"`
+	RecipientMobile   string `dynamodbav:"RecipientMobile,omitempty" json:"recipient_mobile,omitempty"`
+	Status            string `dynamodbav:"Status" json:"status"`
+	ExpiresAt         int64  `dynamodbav:"ExpiresAt" json:"expires_at"`
+	// PaidTo is the account the held funds went to: the agent's on
+	// redemption, the sender's on a refund.
+	PaidTo    string `dynamodbav:"PaidTo,omitempty" json:"paid_to,omitempty"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt int64  `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// PayoutRequest is a payout to be created by CreatePayout.
+type PayoutRequest struct {
+	TenantID          string  `json:"tenant_id,omitempty"`
+	FromAccount       string  `json:"from_account"`
+	Amount            float64 `json:"amount"`
+	RecipientName     string  `json:"recipient_name"`
+	RecipientIDNumber string  `json:"recipient_id_number,omitempty"`
+	RecipientMobile   string  `json:"recipient_mobile,omitempty"`
+	InitiatorUUID     string  `json:"uuid,omitempty"`
+}
+
+// RecipientVerifier checks the ID of the person collecting a payout
+// against its recipient, failing when they do not match.
+type RecipientVerifier func(ctx context.Context, payout Payout) error
+
+func (c *TenantConfig) payoutTTL() time.Duration {
+	if c.PayoutTTL <= 0 {
+		return DefaultPayoutTTL
+	}
+	return time.Duration(c.PayoutTTL) * time.Second
+}
+
+func hashPayoutCode(tenantId, code string) string {
+	sum := sha256.Sum256([]byte(tenantId + "#" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+func newPayoutCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(0).Exp(big.NewInt(10), big.NewInt(payoutCodeDigits), nil))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate payout code: %v", err)
+	}
+	return fmt.Sprintf("%0*d", payoutCodeDigits, n), nil
+}
+
+// CreatePayout debits the sender into the tenant's PayoutHoldingAccount and
+// issues the code the recipient collects the payout with. The code is only
+// returned here, so the sender must pass it on to the recipient and keep it
+// to cancel the payout.
+//
+// The payout passes the controls of a transfer to the holding account. It
+// cannot wait for approval or be held, so an amount over the tenant's
+// ApprovalThreshold or LargeTransferThreshold fails with ErrApprovalRequired
+// or ErrTransferDelayed.
+func CreatePayout(ctx context.Context, dbSvc DynamoDBAPI, req PayoutRequest) (code string, payout *Payout, err error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	if req.FromAccount == "" || req.RecipientName == "" {
+		return "", nil, errors.New("a payout needs a sender and a recipient name")
+	}
+	err = validation.Collect(
+		validation.TenantID("tenant_id", req.TenantID),
+		validation.AccountID("from_account", req.FromAccount),
+		validation.AmountPrecision("amount", req.Amount, maxPrecision()),
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, req.TenantID)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return "", nil, err
+	}
+	if cfg.PayoutHoldingAccount == "" {
+		return "", nil, fmt.Errorf("tenant %s has no payout holding account", req.TenantID)
+	}
+	sender, err := readAccount(ctx, dbSvc, req.TenantID, req.FromAccount)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read account %s: %v", req.FromAccount, err)
+	}
+	if err := checkDormant(sender); err != nil {
+		return "", nil, err
+	}
+	currency := cfg.accountCurrency(sender)
+	if err := checkPrecision(req.Amount, currency); err != nil {
+		return "", nil, err
+	}
+	remaining := RoundAmount(sender.Amount-req.Amount, currency)
+	if remaining < cfg.balanceFloor(sender) {
+		return "", nil, errors.New("insufficient balance")
+	}
+	now := clockOf(dbSvc).Now().UTC()
+	err = cfg.checkTransfer(ctx, dbSvc, transferCheck{
+		req:    TransferRequest{TenantID: req.TenantID, FromAccount: req.FromAccount, ToAccount: cfg.PayoutHoldingAccount, Amount: req.Amount},
+		sender: sender,
+		now:    now,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	code, err = newPayoutCode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	timestamp := now.Unix()
+	payout = &Payout{
+		TenantID:          req.TenantID,
+		CodeHash:          hashPayoutCode(req.TenantID, code),
+		PayoutID:          newID(dbSvc),
+		FromAccount:       req.FromAccount,
+		Amount:            req.Amount,
+		RecipientName:     req.RecipientName,
+		RecipientIDNumber: req.RecipientIDNumber,
+		RecipientMobile:   req.RecipientMobile,
+		Status:            PayoutPending,
+		ExpiresAt:         now.Add(cfg.payoutTTL()).Unix(),
+		CreatedAt:         timestamp,
+		UpdatedAt:         timestamp,
+	}
+	item, err := attributevalue.MarshalMap(payout)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal payout: %v", err)
+	}
+	legs := []JournalLeg{
+		{AccountID: req.FromAccount, Type: LegDebit, Amount: req.Amount, Overdraft: remaining < 0},
+		{AccountID: cfg.PayoutHoldingAccount, Type: LegCredit, Amount: req.Amount},
+	}
+	record, err := payoutRecord(*payout, payout.PayoutID, NarrativePayout, req.FromAccount, cfg.PayoutHoldingAccount, legs, req.InitiatorUUID, timestamp)
+	if err != nil {
+		return "", nil, err
+	}
+	accounts := map[string]*User{req.FromAccount: sender}
+	err = postJournal(ctx, dbSvc, req.TenantID, payout.PayoutID, req.InitiatorUUID, sender, legs, nil, accounts, timestamp, record, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(PayoutsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(CodeHash)"),
+	}})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fund payout: %v", err)
+	}
+	notify(ctx, dbSvc, req.TenantID, req.FromAccount, fmt.Sprintf(
+		"Your cash pickup of %.2f for %s is ready until %s. Reference: %s",
+		req.Amount, req.RecipientName, time.Unix(payout.ExpiresAt, 0).UTC().Format(time.RFC3339), payout.PayoutID))
+	return code, payout, nil
+}
+
+// payoutRecord returns the transaction item recording a movement of a
+// payout's funds at timestamp.
+func payoutRecord(payout Payout, journalId, comment, from, to string, legs []JournalLeg, initiatorUUID string, timestamp int64) (types.TransactWriteItem, error) {
+	record := newTransactionRecord(TransferRequest{
+		TenantID:      payout.TenantID,
+		FromAccount:   from,
+		ToAccount:     to,
+		Amount:        payout.Amount,
+		InitiatorUUID: initiatorUUID,
+		Metadata:      map[string]string{"payout_id": payout.PayoutID},
+	}, comment, journalId, timestamp)
+	record.Status = TransactionCompleted
+	record.JournalID = journalId
+	record.Legs = legs
+	if journalId != payout.PayoutID {
+		record.ParentTransactionID = payout.PayoutID
+	}
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: av}}, nil
+}
+
+// GetPayout returns the payout of a code.
+func GetPayout(ctx context.Context, dbSvc DynamoDBAPI, tenantId, code string) (*Payout, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(PayoutsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"CodeHash": &types.AttributeValueMemberS{Value: hashPayoutCode(tenantId, code)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payout: %v", err)
+	}
+	if result.Item == nil {
+		return nil, errors.New("payout not found")
+	}
+	var payout Payout
+	if err := attributevalue.UnmarshalMap(result.Item, &payout); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payout: %v", err)
+	}
+	return &payout, nil
+}
+
+// RedeemPayout pays a payout out through an agent: once verify accepts the
+// recipient's ID, the held funds are credited to the agent's account, which
+// has handed over the cash. A payout is redeemed at most once, and not
+// after it expired or was cancelled.
+func RedeemPayout(ctx context.Context, dbSvc DynamoDBAPI, tenantId, code, agentAccount string, verify RecipientVerifier) (*Payout, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if verify == nil {
+		return nil, errors.New("payouts cannot be redeemed without verifying the recipient")
+	}
+	payout, err := GetPayout(ctx, dbSvc, tenantId, code)
+	if err != nil {
+		return nil, err
+	}
+	if payout.Status != PayoutPending || clockOf(dbSvc).Now().Unix() >= payout.ExpiresAt {
+		return nil, fmt.Errorf("payout %s cannot be redeemed", payout.PayoutID)
+	}
+	if err := verify(ctx, *payout); err != nil {
+		return nil, fmt.Errorf("recipient of payout %s not verified: %w", payout.PayoutID, err)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	if err := settlePayout(ctx, dbSvc, cfg, payout, agentAccount, PayoutRedeemed, clockOf(dbSvc).Now()); err != nil {
+		return nil, err
+	}
+	notify(ctx, dbSvc, tenantId, payout.FromAccount, fmt.Sprintf("Your cash pickup %s of %.2f has been collected by %s.", payout.PayoutID, payout.Amount, payout.RecipientName))
+	return payout, nil
+}
+
+// CancelPayout refunds a pending payout to its sender.
+func CancelPayout(ctx context.Context, dbSvc DynamoDBAPI, tenantId, code, accountId string) (*Payout, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	payout, err := GetPayout(ctx, dbSvc, tenantId, code)
+	if err != nil {
+		return nil, err
+	}
+	if payout.FromAccount != accountId || payout.Status != PayoutPending {
+		return nil, fmt.Errorf("payout %s cannot be cancelled", payout.PayoutID)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if err := settlePayout(ctx, dbSvc, cfg, payout, accountId, PayoutCancelled, clockOf(dbSvc).Now()); err != nil {
+		return nil, err
+	}
+	notify(ctx, dbSvc, tenantId, accountId, fmt.Sprintf("Your cash pickup %s has been cancelled and %.2f refunded.", payout.PayoutID, payout.Amount))
+	return payout, nil
+}
+
+// ExpirePayouts refunds the payouts of a tenant that expired unredeemed by
+// now. It is meant to be run periodically; a refund that fails is left for
+// the next run, and the errors are joined. It returns the number of payouts
+// expired.
+func ExpirePayouts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, now time.Time) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(PayoutsTable),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		FilterExpression:         aws.String("#status = :pending AND ExpiresAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant":  &types.AttributeValueMemberS{Value: tenantId},
+			":pending": &types.AttributeValueMemberS{Value: PayoutPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	var expired int
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return expired, fmt.Errorf("failed to query payouts: %v", err)
+		}
+		var payouts []Payout
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &payouts); err != nil {
+			return expired, fmt.Errorf("failed to unmarshal payouts: %v", err)
+		}
+		for i := range payouts {
+			payout := &payouts[i]
+			if err := settlePayout(ctx, dbSvc, cfg, payout, payout.FromAccount, PayoutExpired, now); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			expired++
+			notify(ctx, dbSvc, tenantId, payout.FromAccount, fmt.Sprintf("Your cash pickup %s expired and %.2f has been refunded.", payout.PayoutID, payout.Amount))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return expired, errors.Join(errs...)
+}
+
+// settlePayout moves a pending payout's held funds to an account and sets
+// its status, in one transaction guarded by the payout still being pending:
+// unexpired at the given time to be redeemed, expired to be expired.
+func settlePayout(ctx context.Context, dbSvc DynamoDBAPI, cfg *TenantConfig, payout *Payout, to, status string, at time.Time) error {
+	if cfg.PayoutHoldingAccount == "" {
+		return fmt.Errorf("tenant %s has no payout holding account", cfg.TenantID)
+	}
+	timestamp := clockOf(dbSvc).Now().Unix()
+	comment := NarrativePayoutRefund
+	if status == PayoutRedeemed {
+		comment = NarrativePayoutRedeemed
+	}
+	update := &types.Update{
+		TableName: aws.String(PayoutsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: payout.TenantID},
+			"CodeHash": &types.AttributeValueMemberS{Value: payout.CodeHash},
+		},
+		UpdateExpression:         aws.String("SET #status = :status, PaidTo = :to, UpdatedAt = :now"),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":  &types.AttributeValueMemberS{Value: status},
+			":pending": &types.AttributeValueMemberS{Value: PayoutPending},
+			":to":      &types.AttributeValueMemberS{Value: to},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+		},
+	}
+	switch status {
+	case PayoutRedeemed:
+		update.ConditionExpression = aws.String("#status = :pending AND ExpiresAt > :at")
+	case PayoutExpired:
+		update.ConditionExpression = aws.String("#status = :pending AND ExpiresAt <= :at")
+	}
+	if status == PayoutRedeemed || status == PayoutExpired {
+		update.ExpressionAttributeValues[":at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)}
+	}
+	_, err := settleHeld(ctx, dbSvc, payout.TenantID, cfg.PayoutHoldingAccount, to, payout.Amount, timestamp, func(journalId string, legs []JournalLeg) ([]types.TransactWriteItem, error) {
+		record, err := payoutRecord(*payout, journalId, comment, cfg.PayoutHoldingAccount, to, legs, "", timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return []types.TransactWriteItem{record, {Update: update}}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle payout %s: %v", payout.PayoutID, err)
+	}
+	payout.Status, payout.PaidTo, payout.UpdatedAt = status, to, timestamp
+	return nil
+}
@@ -0,0 +1,28 @@
+package ledger
+
+import "testing"
+
+func TestNewPayoutCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := newPayoutCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != payoutCodeDigits {
+			t.Fatalf("newPayoutCode() = %q, want %d digits", code, payoutCodeDigits)
+		}
+		for _, c := range code {
+			if c < '0' || c > '9' {
+				t.Fatalf("newPayoutCode() = %q, want digits only", code)
+			}
+		}
+		seen[code] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("newPayoutCode() repeated codes: %d distinct of 100", len(seen))
+	}
+	if hashPayoutCode("a", "0123456789") == hashPayoutCode("b", "0123456789") {
+		t.Error("hashPayoutCode() does not depend on the tenant")
+	}
+}
@@ -0,0 +1,416 @@
+package ledger
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// piiAttributes are the attributes of NilUsers items holding personal data,
+// which are encrypted when the Ledger has a PIIKeyring.
+var piiAttributes = []string{"id_number", "mobile_number", "pic_id_card"}
+
+// piiPrefix starts every encrypted value, followed by the key ID and the
+// base64 nonce and ciphertext, separated by colons.
+const piiPrefix = "enc:v1:"
+
+// ErrPIIKeyNotFound is returned when a value was encrypted with a key the
+// keyring does not hold.
+var ErrPIIKeyNotFound = errors.New("pii key not found")
+
+// PIIKeyring holds the AES keys the personal data of each tenant's accounts
+// is encrypted with. A tenant may have several keys while rotating; values
+// are always encrypted with the current one and decrypted with the one they
+// name. An implementation may keep data keys wrapped by a KMS and unwrap
+// them on first use.
+type PIIKeyring interface {
+	// CurrentKey returns the ID and key new values of the tenant are
+	// encrypted with.
+	CurrentKey(ctx context.Context, tenantId string) (string, []byte, error)
+	// Key returns a key of the tenant by ID, or ErrPIIKeyNotFound.
+	Key(ctx context.Context, tenantId, keyId string) ([]byte, error)
+	// IndexKey returns the HMAC key of the tenant's lookup values, which
+	// FindAccount searches instead of the encrypted numbers. It is not
+	// rotated with the encryption keys: changing it needs IndexAccounts to
+	// rewrite every account before lookups find them again.
+	IndexKey(ctx context.Context, tenantId string) ([]byte, error)
+}
+
+// StaticKeyring is a PIIKeyring of keys held in memory, e.g. read from a
+// secrets manager when the service starts.
+type StaticKeyring struct {
+	mu        sync.RWMutex
+	keys      map[string]map[string][]byte
+	current   map[string]string
+	indexKeys map[string][]byte
+}
+
+// AddKey adds a 16, 24 or 32 byte AES key to the tenant's keys and makes it
+// the current one. Earlier keys stay available for decryption.
+func (k *StaticKeyring) AddKey(tenantId, keyId string, key []byte) error {
+	if keyId == "" || strings.Contains(keyId, ":") {
+		return fmt.Errorf("invalid key id %q", keyId)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid key %s: %v", keyId, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.keys = map[string]map[string][]byte{}
+		k.current = map[string]string{}
+	}
+	if k.keys[tenantId] == nil {
+		k.keys[tenantId] = map[string][]byte{}
+	}
+	k.keys[tenantId][keyId] = append([]byte(nil), key...)
+	k.current[tenantId] = keyId
+	return nil
+}
+
+// SetIndexKey sets the tenant's HMAC key for lookup values, of at least 16
+// bytes.
+func (k *StaticKeyring) SetIndexKey(tenantId string, key []byte) error {
+	if len(key) < 16 {
+		return fmt.Errorf("index key of tenant %s is %d bytes, want at least 16", tenantId, len(key))
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.indexKeys == nil {
+		k.indexKeys = map[string][]byte{}
+	}
+	k.indexKeys[tenantId] = append([]byte(nil), key...)
+	return nil
+}
+
+func (k *StaticKeyring) CurrentKey(ctx context.Context, tenantId string) (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keyId, ok := k.current[tenantId]
+	if !ok {
+		return "", nil, fmt.Errorf("no pii key for tenant %s: %w", tenantId, ErrPIIKeyNotFound)
+	}
+	return keyId, k.keys[tenantId][keyId], nil
+}
+
+func (k *StaticKeyring) Key(ctx context.Context, tenantId, keyId string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[tenantId][keyId]
+	if !ok {
+		return nil, fmt.Errorf("pii key %s of tenant %s: %w", keyId, tenantId, ErrPIIKeyNotFound)
+	}
+	return key, nil
+}
+
+func (k *StaticKeyring) IndexKey(ctx context.Context, tenantId string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.indexKeys[tenantId]
+	if !ok {
+		return nil, fmt.Errorf("no index key for tenant %s: %w", tenantId, ErrPIIKeyNotFound)
+	}
+	return key, nil
+}
+
+// WithPIIEncryption encrypts the ID number, mobile number and ID card
+// picture of accounts with AES-GCM under their tenant's current key, when
+// accounts are created, and decrypts them when they are read. Accounts
+// written before keep their plaintext until RotatePIIKeys rewrites them.
+func WithPIIEncryption(keyring PIIKeyring) Option {
+	return func(l *Ledger) {
+		l.pii = keyring
+	}
+}
+
+// piiKeyringOf returns the keyring of dbSvc, or nil when PII is not
+// encrypted.
+func piiKeyringOf(dbSvc DynamoDBAPI) PIIKeyring {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.pii
+	}
+	return nil
+}
+
+// protectPII sets the lookup values of a new NilUsers item and encrypts
+// its PII attributes in place. Empty values are left empty.
+func protectPII(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, item map[string]types.AttributeValue) error {
+	for name, attr := range lookupAttributes {
+		value, ok := item[name].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" {
+			continue
+		}
+		lookup, err := lookupValue(ctx, dbSvc, tenantId, name, value.Value)
+		if err != nil {
+			return err
+		}
+		item[attr] = &types.AttributeValueMemberS{Value: lookup}
+	}
+	keyring := piiKeyringOf(dbSvc)
+	if keyring == nil {
+		return nil
+	}
+	keyId, key, err := keyring.CurrentKey(ctx, tenantId)
+	if err != nil {
+		return fmt.Errorf("failed to get pii key: %v", err)
+	}
+	accountId := item["AccountID"].(*types.AttributeValueMemberS).Value
+	for _, name := range piiAttributes {
+		value, ok := item[name].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" || strings.HasPrefix(value.Value, piiPrefix) {
+			continue
+		}
+		sealed, err := sealPII(keyId, key, piiAAD(tenantId, accountId, name), value.Value)
+		if err != nil {
+			return err
+		}
+		item[name] = &types.AttributeValueMemberS{Value: sealed}
+	}
+	return nil
+}
+
+// decryptPII decrypts the PII fields of an account read from NilUsers.
+// Plaintext values, of accounts written without encryption, are returned
+// as they are.
+func decryptPII(ctx context.Context, dbSvc DynamoDBAPI, user *User) error {
+	tenantId := user.TenantID
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	for name, field := range map[string]*string{"id_number": &user.IDNumber, "mobile_number": &user.MobileNumber, "pic_id_card": &user.PicIDCard} {
+		if !strings.HasPrefix(*field, piiPrefix) {
+			continue
+		}
+		keyring := piiKeyringOf(dbSvc)
+		if keyring == nil {
+			return errors.New("failed to decrypt account: no pii keyring")
+		}
+		plain, _, err := openPII(ctx, keyring, tenantId, piiAAD(tenantId, user.AccountID, name), *field)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s of account %s: %v", name, user.AccountID, err)
+		}
+		*field = plain
+	}
+	return nil
+}
+
+// piiAAD binds a ciphertext to the attribute of the account it was written
+// to, so it cannot be copied to another account or field.
+func piiAAD(tenantId, accountId, name string) []byte {
+	return []byte(tenantId + "#" + accountId + "#" + name)
+}
+
+func sealPII(keyId string, key, aad []byte, plaintext string) (string, error) {
+	aead, err := newPIICipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), aad)
+	return piiPrefix + keyId + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openPII decrypts a value and returns it with the ID of its key.
+func openPII(ctx context.Context, keyring PIIKeyring, tenantId string, aad []byte, value string) (string, string, error) {
+	keyId, data, ok := strings.Cut(strings.TrimPrefix(value, piiPrefix), ":")
+	if !ok {
+		return "", "", errors.New("malformed encrypted value")
+	}
+	key, err := keyring.Key(ctx, tenantId, keyId)
+	if err != nil {
+		return "", keyId, err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil {
+		return "", keyId, fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	aead, err := newPIICipher(key)
+	if err != nil {
+		return "", keyId, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", keyId, errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return "", keyId, fmt.Errorf("failed to decrypt with key %s: %v", keyId, err)
+	}
+	return string(plain), keyId, nil
+}
+
+func newPIICipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pii key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// RotatePIIKeys re-encrypts the PII of the tenant's accounts that is in
+// plaintext or under a key other than the tenant's current one, and returns
+// how many accounts it rewrote. Add the new key to the keyring first and
+// retire the old one once this returns. It also writes the lookup values of
+// accounts that lack them, like IndexAccounts. Each account is rewritten
+// only if its PII is unchanged since it was read, so it is safe to run while
+// the ledger is serving; an account updated meanwhile is skipped and left
+// for the next run.
+func RotatePIIKeys(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	keyring := piiKeyringOf(dbSvc)
+	if keyring == nil {
+		return 0, errors.New("pii encryption is not configured")
+	}
+	keyId, key, err := keyring.CurrentKey(ctx, tenantId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pii key: %v", err)
+	}
+	return rewritePII(ctx, dbSvc, tenantId, &piiKey{id: keyId, key: key})
+}
+
+// IndexAccounts writes the lookup values FindAccount searches to the
+// tenant's accounts that lack them or whose values are stale, e.g. those
+// created before FindAccount or before PII encryption was turned on, and
+// returns how many accounts it rewrote. It leaves their encryption as it
+// is.
+func IndexAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	return rewritePII(ctx, dbSvc, tenantId, nil)
+}
+
+// piiKey is an encryption key and its ID.
+type piiKey struct {
+	id  string
+	key []byte
+}
+
+// rewritePII walks the tenant's accounts and rewrites their PII under
+// current, unless it is nil, and their lookup values.
+func rewritePII(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, current *piiKey) (int, error) {
+	projection := "AccountID, " + strings.Join(piiAttributes, ", ")
+	for _, attr := range lookupAttributes {
+		projection += ", " + attr
+	}
+	rewritten := 0
+	var cursor map[string]types.AttributeValue
+	for {
+		resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(NilUsers),
+			KeyConditionExpression: aws.String("TenantID = :tenant"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			},
+			ProjectionExpression: aws.String(projection),
+			ExclusiveStartKey:    cursor,
+		})
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		for _, item := range resp.Items {
+			changed, err := rewriteAccountPII(ctx, dbSvc, tenantId, current, item)
+			if err != nil {
+				return rewritten, err
+			}
+			if changed {
+				rewritten++
+			}
+		}
+		if resp.LastEvaluatedKey == nil {
+			return rewritten, nil
+		}
+		cursor = resp.LastEvaluatedKey
+	}
+}
+
+// rewriteAccountPII rewrites the PII attributes of one account that are not
+// under the current key, and its lookup values that are missing or stale.
+func rewriteAccountPII(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, current *piiKey, item map[string]types.AttributeValue) (bool, error) {
+	id, _ := item["AccountID"].(*types.AttributeValueMemberS)
+	if id == nil {
+		return false, nil
+	}
+	keyring := piiKeyringOf(dbSvc)
+	var sets, conditions []string
+	values := map[string]types.AttributeValue{}
+	for i, name := range piiAttributes {
+		value, ok := item[name].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" {
+			continue
+		}
+		aad := piiAAD(tenantId, id.Value, name)
+		plain, keyId := value.Value, ""
+		if strings.HasPrefix(plain, piiPrefix) {
+			if keyring == nil {
+				return false, fmt.Errorf("account %s is encrypted but pii encryption is not configured", id.Value)
+			}
+			var err error
+			plain, keyId, err = openPII(ctx, keyring, tenantId, aad, value.Value)
+			if err != nil {
+				return false, fmt.Errorf("failed to decrypt %s of account %s: %v", name, id.Value, err)
+			}
+		}
+		changed := false
+		if current != nil && keyId != current.id {
+			sealed, err := sealPII(current.id, current.key, aad, plain)
+			if err != nil {
+				return false, err
+			}
+			sets = append(sets, fmt.Sprintf("%s = :new%d", name, i))
+			values[fmt.Sprintf(":new%d", i)] = &types.AttributeValueMemberS{Value: sealed}
+			changed = true
+		}
+		if attr, ok := lookupAttributes[name]; ok {
+			lookup, err := lookupValue(ctx, dbSvc, tenantId, name, plain)
+			if err != nil {
+				return false, err
+			}
+			if old, _ := item[attr].(*types.AttributeValueMemberS); old == nil || old.Value != lookup {
+				sets = append(sets, fmt.Sprintf("%s = :lookup%d", attr, i))
+				values[fmt.Sprintf(":lookup%d", i)] = &types.AttributeValueMemberS{Value: lookup}
+				changed = true
+			}
+		}
+		if changed {
+			conditions = append(conditions, fmt.Sprintf("%s = :old%d", name, i))
+			values[fmt.Sprintf(":old%d", i)] = value
+		}
+	}
+	if len(sets) == 0 {
+		return false, nil
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": id,
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeValues: values,
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		loggerOf(dbSvc).InfoContext(ctx, "account changed while rewriting its pii", "tenant", tenantId, "account", id.Value)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to rewrite account %s: %v", id.Value, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,39 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSealPII(t *testing.T) {
+	ctx := context.Background()
+	keyring := &StaticKeyring{}
+	if err := keyring.AddKey("acme", "k1", bytes.Repeat([]byte{7}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.AddKey("acme", "k:2", bytes.Repeat([]byte{7}, 16)); err == nil {
+		t.Error("AddKey() accepted a key id with a colon")
+	}
+	if err := keyring.AddKey("acme", "k3", []byte("short")); err == nil {
+		t.Error("AddKey() accepted a 5 byte key")
+	}
+	keyId, key, err := keyring.CurrentKey(ctx, "acme")
+	if err != nil || keyId != "k1" {
+		t.Fatalf("CurrentKey() = %q, %v", keyId, err)
+	}
+	aad := piiAAD("acme", "alice", "id_number")
+	sealed, err := sealPII(keyId, key, aad, "A-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, id, err := openPII(ctx, keyring, "acme", aad, sealed); err != nil || plain != "A-1234" || id != "k1" {
+		t.Errorf("openPII() = %q, %q, %v", plain, id, err)
+	}
+	if _, _, err := openPII(ctx, keyring, "acme", piiAAD("acme", "bob", "id_number"), sealed); err == nil {
+		t.Error("openPII() decrypted a value copied to another account")
+	}
+	if _, _, err := openPII(ctx, keyring, "other", aad, sealed); err == nil {
+		t.Error("openPII() decrypted with another tenant's keys")
+	}
+}
@@ -0,0 +1,257 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ExchangeRatesTable holds the exchange rates of each tenant, keyed by
+// TenantID and Currency.
+var ExchangeRatesTable = "ExchangeRates"
+
+// ExchangeRate is the value of one unit of Currency in the tenant's base
+// currency.
+type ExchangeRate struct {
+	TenantID  string  `dynamodbav:"TenantID" json:"tenant_id"`
+	Currency  string  `dynamodbav:"Currency" json:"currency"`
+	Rate      float64 `dynamodbav:"Rate" json:"rate"`
+	UpdatedAt int64   `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// PortfolioAccount is an account in a Portfolio.
+type PortfolioAccount struct {
+	AccountID string  `json:"account_id"`
+	Currency  string  `json:"currency"`
+	Balance   float64 `json:"balance"`
+}
+
+// Portfolio is what one identity holds across its accounts.
+type Portfolio struct {
+	TenantID string             `json:"tenant_id"`
+	OwnerID  string             `json:"owner_id"`
+	Accounts []PortfolioAccount `json:"accounts"`
+	// Subtotals is the balance held in each currency.
+	Subtotals map[string]float64 `json:"subtotals"`
+	// BaseCurrency is the tenant's, which Total is in.
+	BaseCurrency string `json:"base_currency"`
+	// Total is the sum of the subtotals at the tenant's exchange rates.
+	Total float64 `json:"total"`
+	// Unconverted lists the currencies without an exchange rate, which are
+	// left out of Total.
+	Unconverted []string `json:"unconverted,omitempty"`
+}
+
+// PutExchangeRate sets the value of one unit of currency in the tenant's
+// base currency, replacing the previous rate.
+func PutExchangeRate(ctx context.Context, dbSvc DynamoDBAPI, tenantId, currency string, rate float64) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if currency == "" || rate <= 0 {
+		return errors.New("an exchange rate needs a currency and a positive rate")
+	}
+	item, err := attributevalue.MarshalMap(ExchangeRate{TenantID: tenantId, Currency: strings.ToUpper(currency), Rate: rate, UpdatedAt: getCurrentTimestamp()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal exchange rate: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ExchangeRatesTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put exchange rate of %s: %v", currency, err)
+	}
+	return nil
+}
+
+// GetExchangeRates returns the tenant's exchange rates by currency.
+func GetExchangeRates(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (map[string]float64, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ExchangeRatesTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	rates := map[string]float64{}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query exchange rates: %v", err)
+		}
+		var page []ExchangeRate
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal exchange rates: %v", err)
+		}
+		for _, r := range page {
+			rates[r.Currency] = r.Rate
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return rates, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// SetAccountOwner records ownerId as the holder of an account, so it is
+// part of the owner's portfolio; an empty ownerId removes it. The owner is
+// usually the customer's main account, which is always part of its own
+// portfolio.
+func SetAccountOwner(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, ownerId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	var before *User
+	if auditing(dbSvc) {
+		before = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		UpdateExpression:    aws.String("REMOVE OwnerID"),
+		ConditionExpression: aws.String("attribute_exists(AccountID)"),
+	}
+	if ownerId != "" {
+		input.UpdateExpression = aws.String("SET OwnerID = :owner")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerId},
+		}
+	}
+	_, err := dbSvc.UpdateItem(ctx, input)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		err = fmt.Errorf("account %s does not exist", accountId)
+	} else if err != nil {
+		err = fmt.Errorf("failed to set owner of %s: %v", accountId, err)
+	}
+	var after *User
+	if auditing(dbSvc) && err == nil {
+		after = auditAccount(ctx, dbSvc, tenantId, accountId)
+	}
+	recordAudit(ctx, dbSvc, AuditSetAccountOwner, tenantId, accountId, map[string]any{"owner_id": ownerId}, before, after, err)
+	return err
+}
+
+// GetPortfolio aggregates the balances of every account held by ownerId:
+// the account of that ID itself and those whose OwnerID it is. Balances are
+// subtotalled per currency and converted to the tenant's base currency for
+// the total.
+func GetPortfolio(ctx context.Context, dbSvc DynamoDBAPI, tenantId, ownerId string) (*Portfolio, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	accounts, err := ownedAccounts(ctx, dbSvc, tenantId, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no accounts are held by %s", ownerId)
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := GetExchangeRates(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Portfolio{TenantID: tenantId, OwnerID: ownerId, Subtotals: map[string]float64{}, BaseCurrency: cfg.BaseCurrency}
+	if p.BaseCurrency == "" {
+		p.BaseCurrency = cfg.currency()
+	}
+	for _, account := range accounts {
+		currency := strings.ToUpper(account.Currency)
+		if currency == "" {
+			currency = cfg.currency()
+		}
+		p.Accounts = append(p.Accounts, PortfolioAccount{AccountID: account.AccountID, Currency: currency, Balance: account.Amount})
+		p.Subtotals[currency] += account.Amount
+	}
+	currencies := make([]string, 0, len(p.Subtotals))
+	for currency := range p.Subtotals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		p.Subtotals[currency] = roundAmount(p.Subtotals[currency])
+		rate, ok := rates[currency]
+		if currency == p.BaseCurrency {
+			rate, ok = 1, true
+		}
+		if !ok {
+			p.Unconverted = append(p.Unconverted, currency)
+			continue
+		}
+		p.Total += p.Subtotals[currency] * rate
+	}
+	p.Total = roundAmount(p.Total)
+	return p, nil
+}
+
+// ownedAccounts returns the account ownerId and the accounts it holds,
+// sorted by AccountID.
+func ownedAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId, ownerId string) ([]User, error) {
+	var accounts []User
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: ownerId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account %s: %v", ownerId, err)
+	}
+	if result.Item != nil {
+		var owner User
+		if err := attributevalue.UnmarshalMap(result.Item, &owner); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal account: %v", err)
+		}
+		accounts = append(accounts, owner)
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		IndexName:              aws.String("OwnerIDIndex"),
+		KeyConditionExpression: aws.String("TenantID = :tenant AND OwnerID = :owner"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":owner":  &types.AttributeValueMemberS{Value: ownerId},
+		},
+	}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts held by %s: %v", ownerId, err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for _, account := range page {
+			if account.AccountID != ownerId {
+				accounts = append(accounts, account)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].AccountID < accounts[j].AccountID })
+	return accounts, nil
+}
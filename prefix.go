@@ -0,0 +1,108 @@
+package ledger
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// WithTablePrefix prefixes the name of every table the ledger uses, so
+// several environments or test runs can share one DynamoDB. The package
+// functions keep using the unprefixed names, such as NilUsers; the Ledger
+// adds the prefix to the requests it sends and removes it from the tables
+// named in responses.
+func WithTablePrefix(prefix string) Option {
+	return func(l *Ledger) {
+		l.tablePrefix = prefix
+	}
+}
+
+// tableName returns the name of a table in DynamoDB.
+func (l *Ledger) tableName(name *string) *string {
+	if name == nil || l.tablePrefix == "" {
+		return name
+	}
+	return aws.String(l.tablePrefix + *name)
+}
+
+func (l *Ledger) prefixTransactWrite(params *dynamodb.TransactWriteItemsInput) *dynamodb.TransactWriteItemsInput {
+	p := *params
+	p.TransactItems = make([]types.TransactWriteItem, len(params.TransactItems))
+	for i, item := range params.TransactItems {
+		if c := item.ConditionCheck; c != nil {
+			check := *c
+			check.TableName = l.tableName(c.TableName)
+			item.ConditionCheck = &check
+		}
+		if put := item.Put; put != nil {
+			prefixed := *put
+			prefixed.TableName = l.tableName(put.TableName)
+			item.Put = &prefixed
+		}
+		if update := item.Update; update != nil {
+			prefixed := *update
+			prefixed.TableName = l.tableName(update.TableName)
+			item.Update = &prefixed
+		}
+		if del := item.Delete; del != nil {
+			prefixed := *del
+			prefixed.TableName = l.tableName(del.TableName)
+			item.Delete = &prefixed
+		}
+		p.TransactItems[i] = item
+	}
+	return &p
+}
+
+func (l *Ledger) prefixBatchGet(params *dynamodb.BatchGetItemInput) *dynamodb.BatchGetItemInput {
+	p := *params
+	p.RequestItems = prefixKeys(l.tablePrefix, params.RequestItems)
+	return &p
+}
+
+func (l *Ledger) prefixBatchWrite(params *dynamodb.BatchWriteItemInput) *dynamodb.BatchWriteItemInput {
+	p := *params
+	p.RequestItems = prefixKeys(l.tablePrefix, params.RequestItems)
+	return &p
+}
+
+// unprefixBatchGet names the tables of a response as the package does, so
+// callers find their items and can resend the unprocessed keys.
+func (l *Ledger) unprefixBatchGet(out *dynamodb.BatchGetItemOutput) {
+	if l.tablePrefix == "" {
+		return
+	}
+	out.Responses = unprefixKeys(l.tablePrefix, out.Responses)
+	out.UnprocessedKeys = unprefixKeys(l.tablePrefix, out.UnprocessedKeys)
+}
+
+func (l *Ledger) unprefixBatchWrite(out *dynamodb.BatchWriteItemOutput) {
+	if l.tablePrefix == "" {
+		return
+	}
+	out.UnprocessedItems = unprefixKeys(l.tablePrefix, out.UnprocessedItems)
+}
+
+func prefixKeys[V any](prefix string, byTable map[string]V) map[string]V {
+	if byTable == nil {
+		return nil
+	}
+	out := make(map[string]V, len(byTable))
+	for name, v := range byTable {
+		out[prefix+name] = v
+	}
+	return out
+}
+
+func unprefixKeys[V any](prefix string, byTable map[string]V) map[string]V {
+	if byTable == nil {
+		return nil
+	}
+	out := make(map[string]V, len(byTable))
+	for name, v := range byTable {
+		out[strings.TrimPrefix(name, prefix)] = v
+	}
+	return out
+}
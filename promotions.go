@@ -0,0 +1,354 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CampaignsTable holds the tenants' promotion campaigns, keyed by TenantID
+// and CampaignID.
+var CampaignsTable = "Campaigns"
+
+// CampaignUsageTable holds the cashback each account earned from a
+// campaign per month, keyed by TenantID and UsageID, with a TTL on
+// ExpiresAt.
+var CampaignUsageTable = "CampaignUsage"
+
+// Campaign is a promotion paying cashback on the transfers it matches,
+// from its FundingAccount to the sender, while it runs and its budget
+// lasts.
+type Campaign struct {
+	TenantID   string `dynamodbav:"TenantID" json:"tenant_id"`
+	CampaignID string `dynamodbav:"CampaignID" json:"campaign_id"`
+	Name       string `dynamodbav:"Name" json:"name"`
+	// Tag and MCCs select the transfers rewarded: those carrying Tag, to a
+	// merchant of one of MCCs. Either left empty matches every transfer.
+	Tag  string   `dynamodbav:"Tag,omitempty" json:"tag,omitempty"`
+	MCCs []string `dynamodbav:"MCCs,omitempty" json:"mccs,omitempty"`
+	// CashbackPercent of the amount of each transfer is paid back, up to
+	// MaxPerAccount per account per UTC calendar month when set.
+	CashbackPercent float64 `dynamodbav:"CashbackPercent" json:"cashback_percent"`
+	MaxPerAccount   float64 `dynamodbav:"MaxPerAccount,omitempty" json:"max_per_account,omitempty"`
+	// Budget caps the cashback paid by the campaign, Spent so far; zero
+	// means no cap.
+	Budget float64 `dynamodbav:"Budget,omitempty" json:"budget,omitempty"`
+	Spent  float64 `dynamodbav:"Spent" json:"spent"`
+	// FundingAccount pays the cashback, without a balance check; the
+	// tenant's BonusFundingAccount when empty.
+	FundingAccount string `dynamodbav:"FundingAccount" json:"funding_account"`
+	StartsAt       int64  `dynamodbav:"StartsAt" json:"starts_at"`
+	EndsAt         int64  `dynamodbav:"EndsAt" json:"ends_at"`
+	CreatedAt      int64  `dynamodbav:"CreatedAt" json:"created_at"`
+}
+
+// active reports whether the campaign runs at the given unix time and has
+// budget left.
+func (c *Campaign) active(at int64) bool {
+	return c.StartsAt <= at && at < c.EndsAt && (c.Budget == 0 || c.Spent < c.Budget)
+}
+
+// matches reports whether the campaign rewards the transfer.
+func (c *Campaign) matches(req TransferRequest) bool {
+	if c.Tag != "" && !slices.Contains(req.Tags, c.Tag) {
+		return false
+	}
+	if len(c.MCCs) > 0 && !slices.Contains(c.MCCs, req.MCC) {
+		return false
+	}
+	return c.FundingAccount != req.FromAccount
+}
+
+// cashback returns what the campaign pays on a transfer of amount, given
+// what the sender already earned from it this month.
+func (c *Campaign) cashback(amount, earned float64) float64 {
+	cashback := roundAmount(amount * c.CashbackPercent / 100)
+	if c.MaxPerAccount > 0 {
+		cashback = min(cashback, roundAmount(c.MaxPerAccount-earned))
+	}
+	if c.Budget > 0 {
+		cashback = min(cashback, roundAmount(c.Budget-c.Spent))
+	}
+	return cashback
+}
+
+// CreateCampaign starts a campaign of the tenant, which transfers are
+// matched against from StartsAt until EndsAt.
+func CreateCampaign(ctx context.Context, dbSvc DynamoDBAPI, campaign Campaign) (*Campaign, error) {
+	if campaign.TenantID == "" {
+		campaign.TenantID = "nil"
+	}
+	if campaign.Name == "" {
+		return nil, errors.New("campaign name is required")
+	}
+	if campaign.CashbackPercent <= 0 || campaign.CashbackPercent > 100 {
+		return nil, errors.New("cashback percent must be above 0 and at most 100")
+	}
+	if campaign.MaxPerAccount < 0 || campaign.Budget < 0 {
+		return nil, errors.New("campaign caps must not be negative")
+	}
+	if campaign.EndsAt <= campaign.StartsAt {
+		return nil, errors.New("campaign must end after it starts")
+	}
+	if campaign.FundingAccount == "" {
+		cfg, err := GetTenantConfig(ctx, dbSvc, campaign.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.BonusFundingAccount == "" {
+			return nil, fmt.Errorf("campaign has no funding account and tenant %s has no bonus funding account", campaign.TenantID)
+		}
+		campaign.FundingAccount = cfg.BonusFundingAccount
+	}
+	if _, err := readAccount(ctx, dbSvc, campaign.TenantID, campaign.FundingAccount); err != nil {
+		return nil, fmt.Errorf("failed to read funding account %s: %v", campaign.FundingAccount, err)
+	}
+	campaign.CampaignID = newID(dbSvc)
+	campaign.Spent = 0
+	campaign.CreatedAt = clockOf(dbSvc).Now().Unix()
+	item, err := attributevalue.MarshalMap(campaign)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal campaign: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(CampaignsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(CampaignID)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store campaign: %v", err)
+	}
+	return &campaign, nil
+}
+
+// GetCampaign returns a campaign of the tenant, with what it has spent.
+func GetCampaign(ctx context.Context, dbSvc DynamoDBAPI, tenantId, campaignId string) (*Campaign, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(CampaignsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: tenantId},
+			"CampaignID": &types.AttributeValueMemberS{Value: campaignId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get campaign %s: %v", campaignId, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("campaign %s does not exist", campaignId)
+	}
+	var campaign Campaign
+	if err := attributevalue.UnmarshalMap(result.Item, &campaign); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal campaign: %v", err)
+	}
+	return &campaign, nil
+}
+
+// ListCampaigns returns the campaigns of the tenant, ended ones included.
+func ListCampaigns(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]Campaign, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(CampaignsTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var campaigns []Campaign
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query campaigns: %v", err)
+		}
+		var page []Campaign
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal campaigns: %v", err)
+		}
+		campaigns = append(campaigns, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return campaigns, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// EndCampaign stops a campaign before its EndsAt. Cashback already paid
+// is kept.
+func EndCampaign(ctx context.Context, dbSvc DynamoDBAPI, tenantId, campaignId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(CampaignsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: tenantId},
+			"CampaignID": &types.AttributeValueMemberS{Value: campaignId},
+		},
+		UpdateExpression:    aws.String("SET EndsAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(CampaignID) AND EndsAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(clockOf(dbSvc).Now().Unix(), 10)},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return fmt.Errorf("campaign %s does not exist or has ended", campaignId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to end campaign %s: %v", campaignId, err)
+	}
+	return nil
+}
+
+// applyCashback pays the cashback of the active campaigns matching a
+// completed transfer to its sender, returning the total paid. Cashback is
+// best effort: a campaign that cannot pay, e.g. as another transfer used
+// up its budget first, is logged and skipped, and the transfer stands.
+func applyCashback(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest, transactionId string, timestamp int64) float64 {
+	campaigns, err := ListCampaigns(ctx, dbSvc, req.TenantID)
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return 0
+	}
+	if err != nil {
+		loggerOf(dbSvc).WarnContext(ctx, "failed to evaluate campaigns", "tenant", req.TenantID, "txid", transactionId, "error", err)
+		return 0
+	}
+	var total float64
+	for i := range campaigns {
+		campaign := &campaigns[i]
+		if !campaign.active(timestamp) || !campaign.matches(req) {
+			continue
+		}
+		paid, err := payCashback(ctx, dbSvc, campaign, req, transactionId, timestamp)
+		if err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "cashback not paid", "tenant", req.TenantID, "campaign", campaign.CampaignID,
+				"account", req.FromAccount, "txid", transactionId, "error", err)
+			continue
+		}
+		total = roundAmount(total + paid)
+	}
+	return total
+}
+
+// payCashback posts the cashback of one campaign on a transfer in a
+// journal of its own, which also counts it against the campaign's budget
+// and the sender's monthly cap, so concurrent transfers cannot overspend
+// either.
+func payCashback(ctx context.Context, dbSvc DynamoDBAPI, campaign *Campaign, req TransferRequest, transactionId string, timestamp int64) (float64, error) {
+	month := time.Unix(timestamp, 0).UTC()
+	usageKey := map[string]types.AttributeValue{
+		"TenantID": &types.AttributeValueMemberS{Value: req.TenantID},
+		"UsageID":  &types.AttributeValueMemberS{Value: fmt.Sprintf("%s#%s#%s", campaign.CampaignID, req.FromAccount, month.Format("2006-01"))},
+	}
+	var earned float64
+	if campaign.MaxPerAccount > 0 {
+		result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(CampaignUsageTable), Key: usageKey, ConsistentRead: aws.Bool(true)})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get campaign usage: %v", err)
+		}
+		var usage struct {
+			Amount float64 `dynamodbav:"Amount"`
+		}
+		if err := attributevalue.UnmarshalMap(result.Item, &usage); err != nil {
+			return 0, fmt.Errorf("failed to unmarshal campaign usage: %v", err)
+		}
+		earned = usage.Amount
+	}
+	cashback := campaign.cashback(req.Amount, earned)
+	if cashback <= 0 {
+		return 0, nil
+	}
+	account, err := readAccount(ctx, dbSvc, req.TenantID, req.FromAccount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read account %s: %v", req.FromAccount, err)
+	}
+
+	amount := &types.AttributeValueMemberN{Value: formatAmount(cashback)}
+	spend := &types.Update{
+		TableName: aws.String(CampaignsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":   &types.AttributeValueMemberS{Value: req.TenantID},
+			"CampaignID": &types.AttributeValueMemberS{Value: campaign.CampaignID},
+		},
+		UpdateExpression:    aws.String("SET Spent = Spent + :amount"),
+		ConditionExpression: aws.String("EndsAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":amount": amount,
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+		},
+	}
+	if campaign.Budget > 0 {
+		spend.ConditionExpression = aws.String("EndsAt > :now AND Spent <= :room")
+		spend.ExpressionAttributeValues[":room"] = &types.AttributeValueMemberN{Value: formatAmount(campaign.Budget - cashback)}
+	}
+	// Usage is kept into the next month, past which it is no longer read.
+	nextMonth := time.Date(month.Year(), month.Month()+2, 1, 0, 0, 0, 0, time.UTC).Unix()
+	use := &types.Update{
+		TableName:        aws.String(CampaignUsageTable),
+		Key:              usageKey,
+		UpdateExpression: aws.String("ADD Amount :amount SET ExpiresAt = :expiresAt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":amount":    amount,
+			":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(nextMonth, 10)},
+		},
+	}
+	if campaign.MaxPerAccount > 0 {
+		use.ConditionExpression = aws.String("attribute_not_exists(Amount) OR Amount <= :room")
+		use.ExpressionAttributeValues[":room"] = &types.AttributeValueMemberN{Value: formatAmount(campaign.MaxPerAccount - cashback)}
+	}
+
+	uid := newID(dbSvc)
+	transfer := TransferRequest{
+		TenantID:      req.TenantID,
+		FromAccount:   campaign.FundingAccount,
+		ToAccount:     req.FromAccount,
+		Amount:        cashback,
+		InitiatorUUID: req.InitiatorUUID,
+		Narrative:     campaign.Name,
+		Metadata:      map[string]string{"campaign_id": campaign.CampaignID, "transaction_id": transactionId},
+	}
+	transaction := newTransactionRecord(transfer, NarrativeCashback, uid, timestamp)
+	transaction.AccountID = req.FromAccount
+	transaction.Currency = account.Currency
+	// Like every account of the journal, the busy funding account is guarded
+	// by its version, and the journal is posted again when it moved.
+	legs := []JournalLeg{
+		{AccountID: req.FromAccount, Type: LegCashback, Amount: cashback},
+		{AccountID: campaign.FundingAccount, Type: LegDebit, Amount: cashback},
+	}
+	transaction.JournalID = uid
+	transaction.Legs = legs
+	transaction.ParentTransactionID = transactionId
+	transaction.Status = TransactionCompleted
+	av, err := attributevalue.MarshalMap(transaction)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	accounts := map[string]*User{req.FromAccount: account}
+	err = postJournal(ctx, dbSvc, req.TenantID, uid, req.InitiatorUUID, account, legs, nil, accounts, timestamp,
+		types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: av}},
+		types.TransactWriteItem{Update: spend},
+		types.TransactWriteItem{Update: use},
+	)
+	if err != nil {
+		return 0, err
+	}
+	recordAnalytics(ctx, dbSvc, transaction, TransactionCompleted)
+	loggerOf(dbSvc).InfoContext(ctx, "cashback paid", "tenant", req.TenantID, "campaign", campaign.CampaignID,
+		"account", req.FromAccount, "amount", cashback, "txid", transactionId)
+	return cashback, nil
+}
@@ -0,0 +1,282 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metric names recorded for external providers.
+const (
+	MetricProviderCalls    = "ledger.provider.calls"
+	MetricProviderFailures = "ledger.provider.failures"
+	MetricProviderDuration = "ledger.provider.duration"
+)
+
+// DefaultProviderWindow is how far back provider health looks.
+const DefaultProviderWindow = 5 * time.Minute
+
+// maxProviderSamples bounds the memory kept per provider; busier providers
+// are judged on their most recent calls.
+const maxProviderSamples = 1000
+
+// SLA is what a provider must meet over the window to be healthy.
+type SLA struct {
+	// MaxFailureRate is the highest tolerated share of failed calls.
+	MaxFailureRate float64
+	// MaxP95 is the highest tolerated 95th percentile latency; zero means
+	// latency is not judged.
+	MaxP95 time.Duration
+	// MinCalls is how many calls the window needs before the provider can
+	// be judged unhealthy.
+	MinCalls int
+}
+
+// DefaultSLA applies to providers without their own.
+var DefaultSLA = SLA{MaxFailureRate: 0.2, MinCalls: 5}
+
+// ProviderHealth is how an external provider performed over the window.
+type ProviderHealth struct {
+	Provider    string        `json:"provider"`
+	Calls       int           `json:"calls"`
+	Failures    int           `json:"failures"`
+	FailureRate float64       `json:"failure_rate"`
+	P50         time.Duration `json:"p50"`
+	P95         time.Duration `json:"p95"`
+	Healthy     bool          `json:"healthy"`
+	// Breaker is the state of the provider's circuit breaker.
+	Breaker     string    `json:"breaker"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+type providerSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+type providerStats struct {
+	samples     []providerSample
+	lastError   string
+	lastFailure time.Time
+}
+
+// Providers tracks the latency and failures of the external integrations
+// the ledger calls (PSPs, billers, KYC, SMS and email gateways), guards each
+// with a circuit breaker and fails over to a secondary provider where one is
+// configured. It is safe for concurrent use.
+type Providers struct {
+	// Metrics, if set, receives a count, failure count and latency for
+	// every call.
+	Metrics Metrics
+
+	mu        sync.Mutex
+	window    time.Duration
+	stats     map[string]*providerStats
+	slas      map[string]SLA
+	secondary map[string]string
+	now       func() time.Time
+
+	breakers       map[string]*breaker
+	breakerConfigs map[string]BreakerConfig
+	queue          []queuedCall
+}
+
+// NewProviders returns a tracker judging providers over window, or
+// DefaultProviderWindow when zero.
+func NewProviders(window time.Duration) *Providers {
+	if window <= 0 {
+		window = DefaultProviderWindow
+	}
+	return &Providers{
+		window:    window,
+		stats:     map[string]*providerStats{},
+		slas:      map[string]SLA{},
+		secondary: map[string]string{},
+		now:       time.Now,
+
+		breakers:       map[string]*breaker{},
+		breakerConfigs: map[string]BreakerConfig{},
+	}
+}
+
+// SetSLA sets the SLA a provider is judged against.
+func (p *Providers) SetSLA(provider string, sla SLA) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slas[provider] = sla
+}
+
+// SetFailover makes Call use secondary when primary fails or is unhealthy.
+func (p *Providers) SetFailover(primary, secondary string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secondary[primary] = secondary
+}
+
+// Call invokes fn for provider and records the outcome. While the provider's
+// circuit breaker is open, fn is not called and a *ProviderUnavailableError
+// is returned. When the provider has a secondary, the secondary is tried if
+// the call fails, and tried first while the provider is unhealthy. fn is told
+// which provider to call.
+func (p *Providers) Call(ctx context.Context, provider string, fn func(ctx context.Context, provider string) error) error {
+	p.mu.Lock()
+	secondary, hasSecondary := p.secondary[provider]
+	p.mu.Unlock()
+	if !hasSecondary {
+		return p.call(ctx, provider, fn)
+	}
+
+	order := []string{provider, secondary}
+	if !p.Health(provider).Healthy && p.Health(secondary).Healthy {
+		order = []string{secondary, provider}
+	}
+	err := p.call(ctx, order[0], fn)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if err2 := p.call(ctx, order[1], fn); err2 != nil {
+		return errors.Join(err, err2)
+	}
+	return nil
+}
+
+func (p *Providers) call(ctx context.Context, provider string, fn func(ctx context.Context, provider string) error) error {
+	if err := p.allow(provider); err != nil {
+		return err
+	}
+	start := p.now()
+	err := fn(ctx, provider)
+	p.Record(ctx, provider, p.now().Sub(start), err)
+	p.trip(provider, err)
+	return err
+}
+
+// Record adds the outcome of a call made outside Call.
+func (p *Providers) Record(ctx context.Context, provider string, latency time.Duration, err error) {
+	if p.Metrics != nil {
+		attr := Attr("provider", provider)
+		p.Metrics.AddCounter(ctx, MetricProviderCalls, 1, attr)
+		p.Metrics.RecordHistogram(ctx, MetricProviderDuration, latency.Seconds(), attr)
+		if err != nil {
+			p.Metrics.AddCounter(ctx, MetricProviderFailures, 1, attr)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.stats[provider]
+	if !ok {
+		stats = &providerStats{}
+		p.stats[provider] = stats
+	}
+	now := p.now()
+	stats.samples = append(stats.samples, providerSample{at: now, latency: latency, failed: err != nil})
+	if len(stats.samples) > maxProviderSamples {
+		stats.samples = stats.samples[len(stats.samples)-maxProviderSamples:]
+	}
+	if err != nil {
+		stats.lastError = err.Error()
+		stats.lastFailure = now
+	}
+}
+
+// Health returns how a provider performed over the window. A provider never
+// called is healthy.
+func (p *Providers) Health(provider string) ProviderHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health(provider)
+}
+
+// AllHealth returns the health of every provider called, by name.
+func (p *Providers) AllHealth() []ProviderHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.stats))
+	for name := range p.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	health := make([]ProviderHealth, len(names))
+	for i, name := range names {
+		health[i] = p.health(name)
+	}
+	return health
+}
+
+func (p *Providers) health(provider string) (h ProviderHealth) {
+	h = ProviderHealth{Provider: provider, Healthy: true, Breaker: BreakerClosed}
+	if b, ok := p.breakers[provider]; ok && b.state != BreakerClosed {
+		// An open breaker overrides the SLA.
+		h.Breaker = b.state
+		defer func() { h.Healthy = false }()
+	}
+	stats, ok := p.stats[provider]
+	if !ok {
+		return h
+	}
+	// Drop the samples that left the window.
+	cutoff := p.now().Add(-p.window)
+	i := sort.Search(len(stats.samples), func(i int) bool { return stats.samples[i].at.After(cutoff) })
+	stats.samples = stats.samples[i:]
+
+	h.LastError, h.LastFailure = stats.lastError, stats.lastFailure
+	h.Calls = len(stats.samples)
+	if h.Calls == 0 {
+		return h
+	}
+	latencies := make([]time.Duration, h.Calls)
+	for i, s := range stats.samples {
+		latencies[i] = s.latency
+		if s.failed {
+			h.Failures++
+		}
+	}
+	slices.Sort(latencies)
+	h.P50 = latencies[(h.Calls-1)*50/100]
+	h.P95 = latencies[(h.Calls-1)*95/100]
+	h.FailureRate = float64(h.Failures) / float64(h.Calls)
+
+	sla, ok := p.slas[provider]
+	if !ok {
+		sla = DefaultSLA
+	}
+	if h.Calls >= sla.MinCalls {
+		h.Healthy = h.FailureRate <= sla.MaxFailureRate && (sla.MaxP95 == 0 || h.P95 <= sla.MaxP95)
+	}
+	return h
+}
+
+// Notifier returns a Notifier sending through the notifier of provider,
+// tracked by p and failing over as configured; messages no provider can take
+// are queued. notifiers maps provider names to their notifiers, e.g. two SMS
+// gateways.
+func (p *Providers) Notifier(provider string, notifiers map[string]Notifier) Notifier {
+	return func(ctx context.Context, tenantId, accountId, message string) error {
+		return p.CallOrQueue(ctx, provider, func(ctx context.Context, name string) error {
+			notifier, ok := notifiers[name]
+			if !ok {
+				return errors.New("no notifier for provider " + name)
+			}
+			return notifier(ctx, tenantId, accountId, message)
+		})
+	}
+}
+
+// EmailSender returns an EmailSender like Notifier does for notifiers.
+func (p *Providers) EmailSender(provider string, senders map[string]EmailSender) EmailSender {
+	return func(ctx context.Context, to, subject, body string) error {
+		return p.CallOrQueue(ctx, provider, func(ctx context.Context, name string) error {
+			sender, ok := senders[name]
+			if !ok {
+				return errors.New("no email sender for provider " + name)
+			}
+			return sender(ctx, to, subject, body)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock advances by step every time it is read.
+type fakeClock struct {
+	t    time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.t = c.t.Add(c.step)
+	return c.t
+}
+
+func TestProvidersHealth(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), step: time.Millisecond}
+	p := NewProviders(time.Minute)
+	p.now = clock.now
+	p.SetSLA("slow", SLA{MaxFailureRate: 1, MaxP95: time.Millisecond, MinCalls: 1})
+
+	fail := errors.New("gateway timeout")
+	for i := 0; i < 10; i++ {
+		var err error
+		if i%2 == 0 {
+			err = fail
+		}
+		p.Call(ctx, "sms", func(ctx context.Context, provider string) error { return err })
+	}
+	p.Call(ctx, "slow", func(ctx context.Context, provider string) error {
+		clock.t = clock.t.Add(time.Second)
+		return nil
+	})
+
+	tests := []struct {
+		provider    string
+		wantCalls   int
+		wantRate    float64
+		wantHealthy bool
+	}{
+		{"sms", 10, 0.5, false},
+		{"slow", 1, 0, false},
+		{"unknown", 0, 0, true},
+	}
+	for _, tt := range tests {
+		h := p.Health(tt.provider)
+		if h.Calls != tt.wantCalls || h.FailureRate != tt.wantRate || h.Healthy != tt.wantHealthy {
+			t.Errorf("Health(%s) = %+v, want %d calls, rate %v, healthy %v", tt.provider, h, tt.wantCalls, tt.wantRate, tt.wantHealthy)
+		}
+	}
+	if h := p.Health("sms"); h.LastError != "gateway timeout" {
+		t.Errorf("LastError = %q", h.LastError)
+	}
+	if all := p.AllHealth(); len(all) != 2 || all[0].Provider != "slow" {
+		t.Errorf("AllHealth() = %+v", all)
+	}
+
+	// Old calls leave the window.
+	clock.t = clock.t.Add(2 * time.Minute)
+	if h := p.Health("sms"); h.Calls != 0 || !h.Healthy {
+		t.Errorf("Health() after the window = %+v", h)
+	}
+}
+
+func TestProvidersFailover(t *testing.T) {
+	ctx := context.Background()
+	p := NewProviders(time.Minute)
+	p.SetFailover("primary", "secondary")
+
+	down := map[string]bool{"primary": true}
+	var calls []string
+	send := p.Notifier("primary", map[string]Notifier{
+		"primary": func(ctx context.Context, tenantId, accountId, message string) error {
+			calls = append(calls, "primary")
+			return errIf(down["primary"])
+		},
+		"secondary": func(ctx context.Context, tenantId, accountId, message string) error {
+			calls = append(calls, "secondary")
+			return errIf(down["secondary"])
+		},
+	})
+
+	if err := send(ctx, "nil", "alice", "hi"); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if len(calls) != 2 || calls[1] != "secondary" {
+		t.Errorf("calls = %v, want primary then secondary", calls)
+	}
+
+	// Once the primary is unhealthy the secondary is tried first.
+	for i := 0; i < DefaultSLA.MinCalls; i++ {
+		send(ctx, "nil", "alice", "hi")
+	}
+	calls = nil
+	send(ctx, "nil", "alice", "hi")
+	if len(calls) != 1 || calls[0] != "secondary" {
+		t.Errorf("calls = %v, want only secondary", calls)
+	}
+
+	down["secondary"] = true
+	if err := send(ctx, "nil", "alice", "hi"); err == nil {
+		t.Error("send() succeeded with both providers down")
+	}
+}
+
+func errIf(failed bool) error {
+	if failed {
+		return errors.New("down")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Purpose codes a transfer may declare in TransferRequest.PurposeCode, for
+// regulatory reporting and compliance screening.
+const (
+	PurposeFamilySupport = "family_support"
+	PurposeSalary        = "salary"
+	PurposeGoods         = "goods"
+	PurposeServices      = "services"
+	PurposeBills         = "bills"
+	PurposeRent          = "rent"
+	PurposeEducation     = "education"
+	PurposeMedical       = "medical"
+	PurposeDonation      = "donation"
+	PurposeLoan          = "loan"
+	PurposeSavings       = "savings"
+	PurposeOther         = "other"
+)
+
+var purposeCodes = map[string]bool{
+	PurposeFamilySupport: true,
+	PurposeSalary:        true,
+	PurposeGoods:         true,
+	PurposeServices:      true,
+	PurposeBills:         true,
+	PurposeRent:          true,
+	PurposeEducation:     true,
+	PurposeMedical:       true,
+	PurposeDonation:      true,
+	PurposeLoan:          true,
+	PurposeSavings:       true,
+	PurposeOther:         true,
+}
+
+// PurposeCodes returns the valid purpose codes, sorted.
+func PurposeCodes() []string {
+	codes := make([]string, 0, len(purposeCodes))
+	for code := range purposeCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ValidatePurposeCode checks that code is one of PurposeCodes. An empty
+// code is valid: declaring a purpose is optional.
+func ValidatePurposeCode(code string) error {
+	if code == "" || purposeCodes[code] {
+		return nil
+	}
+	return fmt.Errorf("unknown purpose code %q; use one of %s", code, strings.Join(PurposeCodes(), ", "))
+}
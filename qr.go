@@ -29,7 +29,7 @@ func (qr *QRPaymentRequest) IsPaid() bool {
 	return qr.Status == "COMPLETED"
 }
 
-func GenerateQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64) (*QRPaymentRequest, error) {
+func GenerateQRPayment(ctx context.Context, dbSvc DynamoDBAPI, tenantID, accountID string, amount float64) (*QRPaymentRequest, error) {
 
 	uuid := ksuid.New().String()
 	timestamp := time.Now().UTC().Unix()
@@ -63,7 +63,7 @@ func GenerateQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, ac
 	return &qrPayment, nil
 }
 
-func InquireQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID string) (*QRPaymentRequest, error) {
+func InquireQRPayment(ctx context.Context, dbSvc DynamoDBAPI, tenantID, paymentID string) (*QRPaymentRequest, error) {
 	key := map[string]types.AttributeValue{
 		"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
 		"PaymentID": &types.AttributeValueMemberS{Value: paymentID},
@@ -90,7 +90,7 @@ func InquireQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, pay
 	return &qrPayment, nil
 }
 
-func PerformQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID, personPayingAccount string) error {
+func PerformQRPayment(ctx context.Context, dbSvc DynamoDBAPI, tenantID, paymentID, personPayingAccount string) error {
 	qrPayment, err := InquireQRPayment(ctx, dbSvc, tenantID, paymentID)
 	if err != nil {
 		return err
@@ -141,7 +141,7 @@ func PerformQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, pay
 	return nil
 }
 
-func GetAllQRPaymentsForUser(ctx context.Context, dbSvc *dynamodb.Client, tenantID, creatorAccountID string) ([]QRPaymentRequest, error) {
+func GetAllQRPaymentsForUser(ctx context.Context, dbSvc DynamoDBAPI, tenantID, creatorAccountID string) ([]QRPaymentRequest, error) {
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String("QRPaymentsTable"),
 		IndexName:              aws.String("CreatorAccountIDIndex"),
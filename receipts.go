@@ -0,0 +1,267 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"time"
+)
+
+// ReceiptVersion is the version of the receipt document GenerateReceipt
+// produces.
+const ReceiptVersion = 1
+
+// ReceiptAlgorithmHMAC signs receipts with HMAC-SHA256; receipts signed with
+// an Ed25519 key have the algorithm KeyAlgorithmEd25519.
+const ReceiptAlgorithmHMAC = "hmac-sha256"
+
+// ErrReceiptUnavailable is returned by GenerateReceipt for a transaction
+// that did not move money: only completed and reversed transfers have a
+// receipt.
+var ErrReceiptUnavailable = errors.New("receipt_unavailable")
+
+// TransactionReceipt is the receipt of a transfer, not to be confused with
+// the receipt files of AttachReceipt. Amounts are formatted with two decimals
+// and the time in RFC 3339 UTC, so the same transaction always gives the same
+// document, and the same signature.
+type TransactionReceipt struct {
+	Version       int          `json:"version"`
+	TenantID      string       `json:"tenant_id"`
+	TransactionID string       `json:"transaction_id"`
+	Status        string       `json:"status"`
+	From          ReceiptParty `json:"from"`
+	To            ReceiptParty `json:"to"`
+	Amount        string       `json:"amount"`
+	Fee           string       `json:"fee"`
+	Tax           string       `json:"tax"`
+	FeePaidBy     string       `json:"fee_paid_by,omitempty"`
+	Currency      string       `json:"currency"`
+	Narrative     string       `json:"narrative,omitempty"`
+	Reference     string       `json:"reference,omitempty"`
+	Time          string       `json:"time"`
+	// Signature is over Payload; it is nil when the Ledger has no
+	// WithReceiptSigning.
+	Signature *ReceiptSignature `json:"signature,omitempty"`
+}
+
+// ReceiptParty is the sender or receiver of a transfer.
+type ReceiptParty struct {
+	AccountID string `json:"account_id"`
+	Name      string `json:"name,omitempty"`
+}
+
+// ReceiptSignature is the base64 signature of a receipt by a tenant key.
+type ReceiptSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Value     string `json:"value"`
+}
+
+// ReceiptKey is a key a tenant signs receipts with. Ed25519 signatures can
+// be verified offline by anyone holding the public key; HMACSecret, used
+// when Ed25519 is not set, only by those sharing the secret.
+type ReceiptKey struct {
+	KeyID      string
+	Ed25519    ed25519.PrivateKey
+	HMACSecret []byte
+}
+
+// ReceiptKeyring returns the key each tenant signs its receipts with.
+type ReceiptKeyring interface {
+	ReceiptKey(ctx context.Context, tenantId string) (*ReceiptKey, error)
+}
+
+// StaticReceiptKeys is a ReceiptKeyring of fixed keys, by tenant ID.
+type StaticReceiptKeys map[string]ReceiptKey
+
+func (k StaticReceiptKeys) ReceiptKey(ctx context.Context, tenantId string) (*ReceiptKey, error) {
+	key, ok := k[tenantId]
+	if !ok {
+		return nil, fmt.Errorf("no receipt key for tenant %s", tenantId)
+	}
+	return &key, nil
+}
+
+// WithReceiptSigning signs the receipts of GenerateReceipt with the keys of
+// keyring.
+func WithReceiptSigning(keyring ReceiptKeyring) Option {
+	return func(l *Ledger) {
+		l.receiptKeys = keyring
+	}
+}
+
+// receiptKeyringOf returns the receipt keyring of dbSvc, or nil when
+// receipts are not signed.
+func receiptKeyringOf(dbSvc DynamoDBAPI) ReceiptKeyring {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.receiptKeys
+	}
+	return nil
+}
+
+// GenerateReceipt returns the receipt of a completed or reversed transfer,
+// signed with the tenant's receipt key; see WithReceiptSigning. Receivers
+// check it with VerifyReceipt, and show it with its HTML.
+func GenerateReceipt(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) (*TransactionReceipt, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	tx, err := getTransactionForUpdate(ctx, dbSvc, tenantId, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Status == nil || (*tx.Status != TransactionCompleted && *tx.Status != TransactionReversed) {
+		return nil, fmt.Errorf("%w: transaction %s did not move money", ErrReceiptUnavailable, transactionId)
+	}
+	receipt := &TransactionReceipt{
+		Version:       ReceiptVersion,
+		TenantID:      tenantId,
+		TransactionID: tx.SystemTransactionID,
+		Status:        tx.Status.String(),
+		From:          receiptParty(ctx, dbSvc, tenantId, tx.FromAccount),
+		To:            receiptParty(ctx, dbSvc, tenantId, tx.ToAccount),
+		Amount:        FormatAmount(tx.Amount, tx.Currency),
+		Fee:           FormatAmount(tx.Fee, tx.Currency),
+		Tax:           FormatAmount(tx.Tax, tx.Currency),
+		Currency:      tx.Currency,
+		Narrative:     tx.Narrative,
+		Reference:     tx.Reference,
+		Time:          time.Unix(tx.TransactionDate, 0).UTC().Format(time.RFC3339),
+	}
+	if tx.Fee > 0 {
+		receipt.FeePaidBy = tx.FeePaidBy
+	}
+	keyring := receiptKeyringOf(dbSvc)
+	if keyring == nil {
+		return receipt, nil
+	}
+	key, err := keyring.ReceiptKey(ctx, tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipt key: %v", err)
+	}
+	if err := receipt.sign(key); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// receiptParty names an account on a receipt. The name of an account that
+// cannot be read, e.g. since deleted, is left out.
+func receiptParty(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ReceiptParty {
+	party := ReceiptParty{AccountID: accountId}
+	if account, err := getAccount(ctx, dbSvc, tenantId, accountId); err == nil {
+		party.Name = account.FullName
+	}
+	return party
+}
+
+// Payload returns the bytes a receipt's signature is over: its JSON without
+// the signature, with the fields in the order of TransactionReceipt and no
+// whitespace.
+func (r TransactionReceipt) Payload() ([]byte, error) {
+	r.Signature = nil
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal receipt: %v", err)
+	}
+	return payload, nil
+}
+
+func (r *TransactionReceipt) sign(key *ReceiptKey) error {
+	payload, err := r.Payload()
+	if err != nil {
+		return err
+	}
+	signature := &ReceiptSignature{KeyID: key.KeyID}
+	switch {
+	case len(key.Ed25519) == ed25519.PrivateKeySize:
+		signature.Algorithm = KeyAlgorithmEd25519
+		signature.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(key.Ed25519, payload))
+	case len(key.HMACSecret) > 0:
+		signature.Algorithm = ReceiptAlgorithmHMAC
+		signature.Value = base64.StdEncoding.EncodeToString(receiptMAC(key.HMACSecret, payload))
+	default:
+		return fmt.Errorf("receipt key %s has neither an Ed25519 key nor an HMAC secret", key.KeyID)
+	}
+	r.Signature = signature
+	return nil
+}
+
+func receiptMAC(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// VerifyReceipt checks the signature of a receipt, e.g. one received as
+// JSON. key is the tenant's Ed25519 public key, or its HMAC secret for
+// receipts signed with ReceiptAlgorithmHMAC. It returns ErrSignatureInvalid
+// for an unsigned, altered or forged receipt.
+func VerifyReceipt(receipt *TransactionReceipt, key []byte) error {
+	if receipt.Signature == nil {
+		return fmt.Errorf("%w: the receipt is not signed", ErrSignatureInvalid)
+	}
+	payload, err := receipt.Payload()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(receipt.Signature.Value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSignatureInvalid, err)
+	}
+	var valid bool
+	switch receipt.Signature.Algorithm {
+	case KeyAlgorithmEd25519:
+		valid = len(key) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(key), payload, sig)
+	case ReceiptAlgorithmHMAC:
+		valid = hmac.Equal(receiptMAC(key, payload), sig)
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrSignatureInvalid, receipt.Signature.Algorithm)
+	}
+	if !valid {
+		return fmt.Errorf("%w: the receipt does not match its signature", ErrSignatureInvalid)
+	}
+	return nil
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Receipt {{.TransactionID}}</title>
+</head>
+<body>
+<h1>Receipt</h1>
+<table>
+<tr><th>Transaction</th><td>{{.TransactionID}}</td></tr>
+<tr><th>Status</th><td>{{.Status}}</td></tr>
+<tr><th>Date</th><td>{{.Time}}</td></tr>
+<tr><th>From</th><td>{{with .From.Name}}{{.}} {{end}}({{.From.AccountID}})</td></tr>
+<tr><th>To</th><td>{{with .To.Name}}{{.}} {{end}}({{.To.AccountID}})</td></tr>
+<tr><th>Amount</th><td>{{.Amount}} {{.Currency}}</td></tr>
+<tr><th>Fee</th><td>{{.Fee}} {{.Currency}}{{with .FeePaidBy}} paid by {{.}}{{end}}</td></tr>
+<tr><th>Tax</th><td>{{.Tax}} {{.Currency}}</td></tr>
+{{with .Narrative}}<tr><th>Narrative</th><td>{{.}}</td></tr>
+{{end}}{{with .Reference}}<tr><th>Reference</th><td>{{.}}</td></tr>
+{{end}}</table>
+{{with .Signature}}<p>Signed with {{.Algorithm}} key {{.KeyID}}: <code>{{.Value}}</code></p>
+{{end}}</body>
+</html>
+`))
+
+// HTML renders a receipt as an HTML page, e.g. to print it to PDF. The same
+// receipt always renders to the same bytes.
+func (r *TransactionReceipt) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := receiptTemplate.Execute(&buf, r); err != nil {
+		return nil, fmt.Errorf("failed to render receipt: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package ledger
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// ReadReplica serves eventually consistent reads in front of DynamoDB, such
+// as an Amazon DAX client, which implements it.
+type ReadReplica interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+}
+
+// ReplicaInvalidator is called after every journal posted with the accounts
+// whose balance and entries it changed, so a cache in the read replica can
+// evict them.
+type ReplicaInvalidator func(ctx context.Context, tenantId string, accountIds []string)
+
+// WithReadReplica sends the reads of InquireBalance, InquireBalances,
+// GetAccount and GetTransactions to replica, such as a DAX cluster, to cut
+// their latency and read capacity. Writes, transfers and strongly consistent
+// reads, including all reads under WithConsistentReads, stay on DynamoDB,
+// so a replica serving stale items never affects money movement.
+//
+// Writes do not go through the replica, so its item cache only sees them
+// once its TTL expires; invalidate, when not nil, is called after every
+// journal to evict the accounts it changed.
+func WithReadReplica(replica ReadReplica, invalidate ReplicaInvalidator) Option {
+	return func(l *Ledger) {
+		l.readReplica = replica
+		l.invalidateReplica = invalidate
+	}
+}
+
+// replicaOf returns a copy of the Ledger dbSvc reading from its read
+// replica, or dbSvc itself when it has none. The copy is instrumented like
+// the Ledger.
+func replicaOf(dbSvc DynamoDBAPI) DynamoDBAPI {
+	l, ok := dbSvc.(*Ledger)
+	if !ok || l.readReplica == nil {
+		return dbSvc
+	}
+	replica := *l
+	replica.db = &replicaDB{DynamoDBAPI: l.db, replica: l.readReplica}
+	return &replica
+}
+
+// invalidateReplica tells the read replica of dbSvc which accounts the legs
+// of a journal changed.
+func invalidateReplica(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, legs []JournalLeg) {
+	l, ok := dbSvc.(*Ledger)
+	if !ok || l.invalidateReplica == nil {
+		return
+	}
+	var accountIds []string
+	seen := map[string]bool{}
+	for _, leg := range legs {
+		if !seen[leg.AccountID] {
+			seen[leg.AccountID] = true
+			accountIds = append(accountIds, leg.AccountID)
+		}
+	}
+	l.invalidateReplica(ctx, tenantId, accountIds)
+}
+
+// replicaDB sends eventually consistent reads to a replica and everything
+// else to DynamoDB.
+type replicaDB struct {
+	DynamoDBAPI
+	replica ReadReplica
+}
+
+func (r *replicaDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if aws.ToBool(params.ConsistentRead) {
+		return r.DynamoDBAPI.GetItem(ctx, params, optFns...)
+	}
+	return r.replica.GetItem(ctx, params, optFns...)
+}
+
+func (r *replicaDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if aws.ToBool(params.ConsistentRead) {
+		return r.DynamoDBAPI.Query(ctx, params, optFns...)
+	}
+	return r.replica.Query(ctx, params, optFns...)
+}
+
+func (r *replicaDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	for _, keys := range params.RequestItems {
+		if aws.ToBool(keys.ConsistentRead) {
+			return r.DynamoDBAPI.BatchGetItem(ctx, params, optFns...)
+		}
+	}
+	return r.replica.BatchGetItem(ctx, params, optFns...)
+}
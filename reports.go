@@ -0,0 +1,501 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// ReportSubscriptionsTable holds the scheduled reports of tenant admins. It
+// needs a StatusNextRunAtIndex GSI (Status, NextRunAt) for the report job.
+var ReportSubscriptionsTable = "ReportSubscriptions"
+
+// ReportType is a report that can be scheduled.
+type ReportType string
+
+const (
+	// ReportSettlementSummary totals the transactions of the period.
+	ReportSettlementSummary ReportType = "settlement_summary"
+	// ReportFailedDigest lists the transactions that failed in the period.
+	ReportFailedDigest ReportType = "failed_digest"
+	// ReportFloat is the total of all account balances when generated.
+	ReportFloat ReportType = "float"
+)
+
+// ReportSchedule is how often a report is sent. Periods are UTC days and
+// weeks starting on Monday; a report is sent once its period has ended.
+type ReportSchedule string
+
+const (
+	ReportDaily  ReportSchedule = "daily"
+	ReportWeekly ReportSchedule = "weekly"
+)
+
+// ReportChannel is how a report is delivered.
+type ReportChannel string
+
+const (
+	// ReportByEmail mails the report to the Destination address.
+	ReportByEmail ReportChannel = "email"
+	// ReportToS3 stores the report in ReportsBucket under the Destination
+	// key prefix.
+	ReportToS3 ReportChannel = "s3"
+	// ReportToWebhook posts the report to the Destination URL.
+	ReportToWebhook ReportChannel = "webhook"
+)
+
+const (
+	ReportSubscriptionActive = "active"
+	ReportSubscriptionPaused = "paused"
+)
+
+// MaxFailedDigestItems caps the transactions listed in a failed-transaction
+// digest; the digest still counts all of them.
+const MaxFailedDigestItems = 100
+
+// ReportSubscription is a report a tenant admin receives on a schedule.
+type ReportSubscription struct {
+	TenantID       string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	SubscriptionID string `dynamodbav:"SubscriptionID" json:"subscription_id,omitempty"`
+	// AdminID is the tenant admin who set up the subscription.
+	AdminID     string         `dynamodbav:"AdminID" json:"admin_id"`
+	Report      ReportType     `dynamodbav:"Report" json:"report"`
+	Schedule    ReportSchedule `dynamodbav:"Schedule" json:"schedule"`
+	Channel     ReportChannel  `dynamodbav:"Channel" json:"channel"`
+	Destination string         `dynamodbav:"Destination" json:"destination,omitempty"`
+	// Secret signs webhook deliveries; see ReportSignatureHeader.
+	Secret    string `dynamodbav:"Secret,omitempty" json:"secret,omitempty"`
+	Status    string `dynamodbav:"Status" json:"status"`
+	NextRunAt int64  `dynamodbav:"NextRunAt" json:"next_run_at"`
+	LastRunAt int64  `dynamodbav:"LastRunAt,omitempty" json:"last_run_at,omitempty"`
+	// LastError is why the last delivery failed, if it did.
+	LastError string `dynamodbav:"LastError,omitempty" json:"last_error,omitempty"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+	UpdatedAt int64  `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// Validate checks that the subscription can be delivered.
+func (s *ReportSubscription) Validate() error {
+	switch s.Report {
+	case ReportSettlementSummary, ReportFailedDigest, ReportFloat:
+	default:
+		return fmt.Errorf("unknown report: %q", s.Report)
+	}
+	if _, err := s.Schedule.period(); err != nil {
+		return err
+	}
+	switch s.Status {
+	case "", ReportSubscriptionActive, ReportSubscriptionPaused:
+	default:
+		return fmt.Errorf("unknown subscription status: %q", s.Status)
+	}
+	switch s.Channel {
+	case ReportByEmail:
+		if _, err := mail.ParseAddress(s.Destination); err != nil {
+			return fmt.Errorf("invalid report email address %q: %v", s.Destination, err)
+		}
+	case ReportToS3:
+	case ReportToWebhook:
+		u, err := url.Parse(s.Destination)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("report webhook must be an https URL: %q", s.Destination)
+		}
+	default:
+		return fmt.Errorf("unknown report channel: %q", s.Channel)
+	}
+	return nil
+}
+
+func (s ReportSchedule) period() (time.Duration, error) {
+	switch s {
+	case ReportDaily:
+		return 24 * time.Hour, nil
+	case ReportWeekly:
+		return 7 * 24 * time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unknown report schedule: %q", s)
+	}
+}
+
+// nextRun returns the end of the period containing t.
+func (s ReportSchedule) nextRun(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if s == ReportWeekly {
+		// Days since Monday.
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return day.AddDate(0, 0, 7)
+	}
+	return day.AddDate(0, 0, 1)
+}
+
+// PutReportSubscription creates or replaces a report subscription. A new
+// subscription gets an ID and is first sent at the end of the current
+// period.
+func PutReportSubscription(ctx context.Context, dbSvc DynamoDBAPI, sub ReportSubscription) (*ReportSubscription, error) {
+	if sub.TenantID == "" {
+		sub.TenantID = "nil"
+	}
+	if err := sub.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if sub.SubscriptionID == "" {
+		sub.SubscriptionID = ksuid.New().String()
+		sub.CreatedAt = now.Unix()
+	}
+	if sub.Status == "" {
+		sub.Status = ReportSubscriptionActive
+	}
+	if sub.NextRunAt == 0 {
+		sub.NextRunAt = sub.Schedule.nextRun(now).Unix()
+	}
+	sub.UpdatedAt = now.Unix()
+
+	item, err := attributevalue.MarshalMap(sub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report subscription: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ReportSubscriptionsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store report subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+// ListReportSubscriptions returns the report subscriptions of a tenant.
+func ListReportSubscriptions(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]ReportSubscription, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ReportSubscriptionsTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	var subs []ReportSubscription
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query report subscriptions: %v", err)
+		}
+		var page []ReportSubscription
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal report subscriptions: %v", err)
+		}
+		subs = append(subs, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return subs, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// DeleteReportSubscription removes a report subscription.
+func DeleteReportSubscription(ctx context.Context, dbSvc DynamoDBAPI, tenantId, subscriptionId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ReportSubscriptionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":       &types.AttributeValueMemberS{Value: tenantId},
+			"SubscriptionID": &types.AttributeValueMemberS{Value: subscriptionId},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete report subscription %s: %v", subscriptionId, err)
+	}
+	return nil
+}
+
+// Report is a generated report. Only the section of its type is set.
+type Report struct {
+	TenantID    string     `json:"tenant_id"`
+	Type        ReportType `json:"type"`
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	GeneratedAt time.Time  `json:"generated_at"`
+
+	Settlement *SettlementSummary `json:"settlement,omitempty"`
+	Failed     *FailedDigest      `json:"failed,omitempty"`
+	Float      *FloatReport       `json:"float,omitempty"`
+}
+
+// SettlementSummary totals the transactions of a period by outcome.
+type SettlementSummary struct {
+	Completed int     `json:"completed"`
+	Volume    float64 `json:"volume"`
+	Fees      float64 `json:"fees"`
+	Taxes     float64 `json:"taxes"`
+	Failed    int     `json:"failed"`
+	// Other counts transactions still pending, held or reversed.
+	Other int `json:"other"`
+}
+
+// FailedDigest lists the failed transactions of a period, up to
+// MaxFailedDigestItems of them.
+type FailedDigest struct {
+	Count        int                `json:"count"`
+	Transactions []TransactionEntry `json:"transactions"`
+}
+
+// FloatReport is the money held in a tenant's accounts.
+type FloatReport struct {
+	Accounts int     `json:"accounts"`
+	Total    float64 `json:"total"`
+	// Negative sums the overdrawn balances, which Total already includes.
+	Negative float64 `json:"negative,omitempty"`
+}
+
+// GenerateReport builds a report of a tenant for the period [from, to). The
+// float report ignores the period and reflects the balances when generated.
+func GenerateReport(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, reportType ReportType, from, to time.Time) (*Report, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	report := &Report{TenantID: tenantId, Type: reportType, From: from.UTC(), To: to.UTC(), GeneratedAt: time.Now().UTC()}
+	var err error
+	switch reportType {
+	case ReportSettlementSummary:
+		report.Settlement = &SettlementSummary{}
+		err = eachTransaction(ctx, dbSvc, tenantId, from, to, nil, report.Settlement.add)
+	case ReportFailedDigest:
+		digest := &FailedDigest{Transactions: []TransactionEntry{}}
+		report.Failed = digest
+		failed := TransactionFailed
+		err = eachTransaction(ctx, dbSvc, tenantId, from, to, &failed, func(tx TransactionEntry) {
+			digest.Count++
+			if len(digest.Transactions) < MaxFailedDigestItems {
+				digest.Transactions = append(digest.Transactions, tx)
+			}
+		})
+	case ReportFloat:
+		report.Float, err = floatReport(ctx, dbSvc, tenantId)
+	default:
+		return nil, fmt.Errorf("unknown report: %q", reportType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *SettlementSummary) add(tx TransactionEntry) {
+	status := TransactionCompleted
+	if tx.Status != nil {
+		status = *tx.Status
+	}
+	switch status {
+	case TransactionCompleted:
+		s.Completed++
+		s.Volume += tx.Amount
+		s.Fees += tx.Fee
+		s.Taxes += tx.Tax
+	case TransactionFailed:
+		s.Failed++
+	default:
+		s.Other++
+	}
+}
+
+// eachTransaction calls fn with every transaction of the tenant dated in
+// [from, to), optionally only those with the given status.
+func eachTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, from, to time.Time, status *TransactionStatus, fn func(TransactionEntry)) error {
+	it := NewTransactionsIterator(dbSvc, tenantId, TransactionFilter{
+		StartTime:         from.Unix(),
+		EndTime:           to.Unix() - 1,
+		TransactionStatus: status,
+	})
+	for it.Next(ctx) {
+		fn(it.Transaction())
+	}
+	return it.Err()
+}
+
+func floatReport(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (*FloatReport, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(NilUsers),
+		KeyConditionExpression:   aws.String("TenantID = :tenantId"),
+		ProjectionExpression:     aws.String("#amount"),
+		ExpressionAttributeNames: map[string]string{"#amount": "amount"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	report := &FloatReport{}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []struct {
+			Amount float64 `dynamodbav:"amount"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for _, account := range page {
+			report.Accounts++
+			report.Total += account.Amount
+			if account.Amount < 0 {
+				report.Negative += account.Amount
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// Title is the subject line of the report.
+func (r *Report) Title() string {
+	names := map[ReportType]string{
+		ReportSettlementSummary: "Settlement summary",
+		ReportFailedDigest:      "Failed transactions",
+		ReportFloat:             "Float report",
+	}
+	if r.Type == ReportFloat {
+		return fmt.Sprintf("%s for %s at %s", names[r.Type], r.TenantID, r.GeneratedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s for %s, %s to %s", names[r.Type], r.TenantID, r.From.Format("2006-01-02"), r.To.Add(-time.Second).Format("2006-01-02"))
+}
+
+// Text renders the report as plain text, e.g. for email.
+func (r *Report) Text() string {
+	var b strings.Builder
+	b.WriteString(r.Title() + "\n\n")
+	switch {
+	case r.Settlement != nil:
+		s := r.Settlement
+		fmt.Fprintf(&b, "Completed transactions: %d\nVolume: %.2f\nFees: %.2f\nTaxes: %.2f\nFailed transactions: %d\nPending or reversed: %d\n",
+			s.Completed, s.Volume, s.Fees, s.Taxes, s.Failed, s.Other)
+	case r.Failed != nil:
+		fmt.Fprintf(&b, "Failed transactions: %d\n", r.Failed.Count)
+		for _, tx := range r.Failed.Transactions {
+			fmt.Fprintf(&b, "%s  %s -> %s  %.2f  %s\n", time.Unix(tx.TransactionDate, 0).UTC().Format(time.RFC3339),
+				tx.FromAccount, tx.ToAccount, tx.Amount, tx.SystemTransactionID)
+		}
+		if more := r.Failed.Count - len(r.Failed.Transactions); more > 0 {
+			fmt.Fprintf(&b, "... and %d more\n", more)
+		}
+	case r.Float != nil:
+		fmt.Fprintf(&b, "Accounts: %d\nTotal balance: %.2f\nOverdrawn balances: %.2f\n", r.Float.Accounts, r.Float.Total, r.Float.Negative)
+	}
+	return b.String()
+}
+
+// ProcessScheduledReports is run periodically to generate and deliver the
+// reports whose period has ended. Each subscription is claimed before it is
+// generated, so concurrent runs send it once. A failed delivery is recorded
+// in LastError and not retried; missed periods are caught up one per run.
+// It returns ErrDegraded without doing anything while the ledger is degraded.
+func ProcessScheduledReports(ctx context.Context, dbSvc DynamoDBAPI, delivery *ReportDelivery, now time.Time) error {
+	if degraded(dbSvc) {
+		return fmt.Errorf("%w: scheduled reports skipped", ErrDegraded)
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(ReportSubscriptionsTable),
+		IndexName:                aws.String("StatusNextRunAtIndex"),
+		KeyConditionExpression:   aws.String("#status = :active AND NextRunAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: ReportSubscriptionActive},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to query report subscriptions: %v", err)
+		}
+		var page []ReportSubscription
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return fmt.Errorf("failed to unmarshal report subscriptions: %v", err)
+		}
+		for _, sub := range page {
+			errs = append(errs, runScheduledReport(ctx, dbSvc, delivery, sub))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return errors.Join(errs...)
+}
+
+func runScheduledReport(ctx context.Context, dbSvc DynamoDBAPI, delivery *ReportDelivery, sub ReportSubscription) error {
+	period, err := sub.Schedule.period()
+	if err != nil {
+		return err
+	}
+	to := time.Unix(sub.NextRunAt, 0).UTC()
+	from := to.Add(-period)
+	key := map[string]types.AttributeValue{
+		"TenantID":       &types.AttributeValueMemberS{Value: sub.TenantID},
+		"SubscriptionID": &types.AttributeValueMemberS{Value: sub.SubscriptionID},
+	}
+
+	_, err = dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ReportSubscriptionsTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET NextRunAt = :next, LastRunAt = :due, UpdatedAt = :now"),
+		ConditionExpression: aws.String("NextRunAt = :due"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":next": &types.AttributeValueMemberN{Value: strconv.FormatInt(sub.Schedule.nextRun(to).Unix(), 10)},
+			":due":  &types.AttributeValueMemberN{Value: strconv.FormatInt(sub.NextRunAt, 10)},
+			":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			// Claimed by another run in the meantime.
+			return nil
+		}
+		return fmt.Errorf("failed to claim report subscription %s: %v", sub.SubscriptionID, err)
+	}
+
+	report, err := GenerateReport(ctx, dbSvc, sub.TenantID, sub.Report, from, to)
+	if err == nil {
+		err = delivery.Deliver(ctx, sub, report)
+	}
+	update := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ReportSubscriptionsTable),
+		Key:              key,
+		UpdateExpression: aws.String("REMOVE LastError"),
+	}
+	if err != nil {
+		update.UpdateExpression = aws.String("SET LastError = :err")
+		update.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":err": &types.AttributeValueMemberS{Value: err.Error()},
+		}
+		loggerOf(dbSvc).WarnContext(ctx, "failed to send scheduled report", "tenant", sub.TenantID, "subscription", sub.SubscriptionID, "error", err)
+	}
+	if _, updateErr := dbSvc.UpdateItem(ctx, update); updateErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to record report delivery %s: %v", sub.SubscriptionID, updateErr))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send report %s: %w", sub.SubscriptionID, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// ReportsBucket is the S3 bucket reports delivered to S3 are stored in.
+var ReportsBucket = "nil-reports"
+
+// ReportSignatureHeader carries the hex HMAC-SHA256 of a webhook delivery's
+// body, keyed with the subscription's Secret, so receivers can verify it.
+const ReportSignatureHeader = "X-Ledger-Signature"
+
+// EmailSender sends a plain text email.
+type EmailSender func(ctx context.Context, to, subject, body string) error
+
+// SESEmailSender sends emails through SES from the given address.
+func SESEmailSender(sesSvc *ses.Client, from string) EmailSender {
+	return func(ctx context.Context, to, subject, body string) error {
+		_, err := sesSvc.SendEmail(ctx, &ses.SendEmailInput{
+			Source:      aws.String(from),
+			Destination: &sestypes.Destination{ToAddresses: []string{to}},
+			Message: &sestypes.Message{
+				Subject: &sestypes.Content{Data: aws.String(subject)},
+				Body:    &sestypes.Body{Text: &sestypes.Content{Data: aws.String(body)}},
+			},
+		})
+		return err
+	}
+}
+
+// ReportDelivery holds the clients reports are delivered with. A channel
+// whose client is not set fails its deliveries.
+type ReportDelivery struct {
+	Email EmailSender
+	Store ObjectPutter
+	// HTTPClient posts webhooks; http.DefaultClient is used when nil.
+	HTTPClient *http.Client
+}
+
+// Deliver sends a report over the channel of the subscription.
+func (d *ReportDelivery) Deliver(ctx context.Context, sub ReportSubscription, report *Report) error {
+	switch sub.Channel {
+	case ReportByEmail:
+		if d.Email == nil {
+			return errors.New("email delivery is not configured")
+		}
+		return d.Email(ctx, sub.Destination, report.Title(), report.Text())
+	case ReportToS3:
+		if d.Store == nil {
+			return errors.New("s3 delivery is not configured")
+		}
+		body, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		_, err = d.Store.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(ReportsBucket),
+			Key:           aws.String(reportKey(sub.Destination, report)),
+			Body:          bytes.NewReader(body),
+			ContentType:   aws.String("application/json"),
+			ContentLength: int64(len(body)),
+		})
+		return err
+	case ReportToWebhook:
+		return d.postWebhook(ctx, sub, report)
+	default:
+		return fmt.Errorf("unknown report channel: %q", sub.Channel)
+	}
+}
+
+// reportKey is where a report is stored, e.g.
+// prefix/nil/settlement_summary/2024-05-01.json.
+func reportKey(prefix string, report *Report) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	date := report.From.Format("2006-01-02")
+	if report.Type == ReportFloat {
+		date = report.GeneratedAt.Format("2006-01-02T150405Z")
+	}
+	return fmt.Sprintf("%s%s/%s/%s.json", prefix, report.TenantID, report.Type, date)
+}
+
+func (d *ReportDelivery) postWebhook(ctx context.Context, sub ReportSubscription, report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Destination, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(body)
+		req.Header.Set(ReportSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := d.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("report webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportScheduleNextRun(t *testing.T) {
+	// 2024-03-06 is a Wednesday.
+	wed := time.Date(2024, 3, 6, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule ReportSchedule
+		at       time.Time
+		want     time.Time
+	}{
+		{"daily", ReportDaily, wed, time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{"daily at midnight", ReportDaily, time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"weekly", ReportWeekly, wed, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"weekly on sunday", ReportWeekly, time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"weekly on monday", ReportWeekly, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.nextRun(tt.at); !got.Equal(tt.want) {
+				t.Errorf("nextRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportSubscriptionValidate(t *testing.T) {
+	valid := ReportSubscription{Report: ReportFloat, Schedule: ReportDaily, Channel: ReportByEmail, Destination: "ops@nil.sd"}
+	tests := []struct {
+		name    string
+		modify  func(*ReportSubscription)
+		wantErr string
+	}{
+		{"valid", func(s *ReportSubscription) {}, ""},
+		{"unknown report", func(s *ReportSubscription) { s.Report = "revenue" }, "unknown report"},
+		{"unknown schedule", func(s *ReportSubscription) { s.Schedule = "hourly" }, "unknown report schedule"},
+		{"bad email", func(s *ReportSubscription) { s.Destination = "ops" }, "invalid report email"},
+		{"s3 without prefix", func(s *ReportSubscription) { s.Channel, s.Destination = ReportToS3, "" }, ""},
+		{"http webhook", func(s *ReportSubscription) { s.Channel, s.Destination = ReportToWebhook, "http://example.com/hook" }, "https"},
+		{"webhook", func(s *ReportSubscription) { s.Channel, s.Destination = ReportToWebhook, "https://example.com/hook" }, ""},
+		{"unknown channel", func(s *ReportSubscription) { s.Channel = "fax" }, "unknown report channel"},
+		{"unknown status", func(s *ReportSubscription) { s.Status = "deleted" }, "unknown subscription status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := valid
+			tt.modify(&sub)
+			err := sub.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSettlementSummaryAdd(t *testing.T) {
+	failed, pending := TransactionFailed, TransactionPending
+	var s SettlementSummary
+	for _, tx := range []TransactionEntry{
+		{Amount: 100, Fee: 1, Tax: 0.1},
+		{Amount: 50, Fee: 0.5},
+		{Amount: 20, Status: &failed},
+		{Amount: 10, Status: &pending},
+	} {
+		s.add(tx)
+	}
+	want := SettlementSummary{Completed: 2, Volume: 150, Fees: 1.5, Taxes: 0.1, Failed: 1, Other: 1}
+	if s != want {
+		t.Errorf("summary = %+v, want %+v", s, want)
+	}
+}
+
+func TestReportKeyAndText(t *testing.T) {
+	from := time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC)
+	report := &Report{
+		TenantID: "nil", Type: ReportFailedDigest, From: from, To: from.AddDate(0, 0, 1),
+		Failed: &FailedDigest{Count: 3, Transactions: []TransactionEntry{{FromAccount: "alice", ToAccount: "bob", Amount: 5, SystemTransactionID: "tx1"}}},
+	}
+	if got, want := reportKey("daily", report), "daily/nil/failed_digest/2024-03-06.json"; got != want {
+		t.Errorf("reportKey() = %q, want %q", got, want)
+	}
+	text := report.Text()
+	for _, want := range []string{"Failed transactions for nil, 2024-03-06 to 2024-03-06", "Failed transactions: 3", "alice -> bob", "and 2 more"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Text() = %q, missing %q", text, want)
+		}
+	}
+}
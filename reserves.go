@@ -0,0 +1,367 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReserveProofsTable holds the published proofs of reserves, keyed by
+// TenantID and ProofID, and ReserveInclusionsTable each account's proof of
+// inclusion in them, keyed by ProofKey (tenant and proof) and AccountID.
+var (
+	ReserveProofsTable     = "ReserveProofs"
+	ReserveInclusionsTable = "ReserveInclusions"
+)
+
+// ReserveProof is a signed summary of what a tenant owes its customers. It
+// reveals no account: the balances are committed to by MerkleRoot, a tree of
+// salted account hashes, and each customer can check that their balance is
+// in it with their ReserveInclusion.
+type ReserveProof struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id"`
+	// ProofID orders the proofs of a tenant by the time they were made.
+	ProofID string `dynamodbav:"ProofID" json:"proof_id"`
+	// Liabilities is the total balance of customer accounts per currency.
+	// Overdrawn accounts count as zero; they are owed to the tenant, not by
+	// it.
+	Liabilities map[string]float64 `dynamodbav:"Liabilities" json:"liabilities"`
+	Accounts    int                `dynamodbav:"Accounts" json:"accounts"`
+	MerkleRoot  string             `dynamodbav:"MerkleRoot" json:"merkle_root"`
+	GeneratedAt int64              `dynamodbav:"GeneratedAt" json:"generated_at"`
+	// KeyID names the key that signed the proof, for auditors to look up
+	// its public key.
+	KeyID string `dynamodbav:"KeyID" json:"key_id"`
+	// Signature is the base64 signature of Payload.
+	Signature string `dynamodbav:"Signature" json:"signature"`
+}
+
+// Payload returns the signed contents of the proof: its JSON without the
+// signature.
+func (p ReserveProof) Payload() string {
+	p.Signature = ""
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// ReserveInclusion proves that an account's balance is in a ReserveProof.
+// It is only given to the account's owner, since the balance is private.
+type ReserveInclusion struct {
+	ProofKey  string  `dynamodbav:"ProofKey" json:"-"`
+	TenantID  string  `dynamodbav:"TenantID" json:"tenant_id"`
+	ProofID   string  `dynamodbav:"ProofID" json:"proof_id"`
+	AccountID string  `dynamodbav:"AccountID" json:"account_id"`
+	Currency  string  `dynamodbav:"Currency" json:"currency"`
+	Balance   float64 `dynamodbav:"Balance" json:"balance"`
+	// Nonce salts the account's leaf, so leaves cannot be matched to
+	// accounts by guessing balances.
+	Nonce string `dynamodbav:"Nonce" json:"nonce"`
+	// Index is the position of the leaf and Siblings the hashes on its path
+	// to the root, from the leaf up; an empty sibling means the node had
+	// none and moved up unchanged.
+	Index    int      `dynamodbav:"Index" json:"index"`
+	Siblings []string `dynamodbav:"Siblings" json:"siblings"`
+}
+
+// leaf returns the hash of the account's Merkle leaf.
+func (r ReserveInclusion) leaf() string {
+	contents, _ := json.Marshal([]string{r.TenantID, r.ProofID, r.AccountID, r.Currency, strconv.FormatFloat(r.Balance, 'f', 2, 64), r.Nonce})
+	sum := sha256.Sum256(append([]byte{0}, contents...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether the account's balance is in the proof.
+func (r ReserveInclusion) Verify(proof ReserveProof) bool {
+	if r.TenantID != proof.TenantID || r.ProofID != proof.ProofID {
+		return false
+	}
+	hash, index := r.leaf(), r.Index
+	for _, sibling := range r.Siblings {
+		switch {
+		case sibling == "":
+		case index%2 == 0:
+			hash = merkleNode(hash, sibling)
+		default:
+			hash = merkleNode(sibling, hash)
+		}
+		index /= 2
+	}
+	return hash == proof.MerkleRoot
+}
+
+func merkleNode(left, right string) string {
+	l, _ := hex.DecodeString(left)
+	r, _ := hex.DecodeString(right)
+	sum := sha256.Sum256(bytes.Join([][]byte{{1}, l, r}, nil))
+	return hex.EncodeToString(sum[:])
+}
+
+// merkleTree returns the root of the leaves and the path of each leaf. A
+// node without a sibling moves up unchanged.
+func merkleTree(leaves []string) (string, [][]string) {
+	if len(leaves) == 0 {
+		return "", nil
+	}
+	paths := make([][]string, len(leaves))
+	level := leaves
+	// positions[i] is where leaf i is on the current level.
+	positions := make([]int, len(leaves))
+	for i := range positions {
+		positions[i] = i
+	}
+	for len(level) > 1 {
+		next := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		for leaf, pos := range positions {
+			sibling := pos ^ 1
+			if sibling < len(level) {
+				paths[leaf] = append(paths[leaf], level[sibling])
+			} else {
+				paths[leaf] = append(paths[leaf], "")
+			}
+			positions[leaf] = pos / 2
+		}
+		level = next
+	}
+	return level[0], paths
+}
+
+// PublishReserveProof builds and signs a proof of a tenant's reserves from
+// the balances of its customer accounts, and stores it along with each
+// account's inclusion proof. The tenant's treasury, fee and tax collection
+// and bonus funding accounts are its own money and are left out. It is run
+// by a job, e.g. daily; each run makes a new proof.
+//
+// signer is an Ed25519 or RSA private key, whose public key auditors get
+// under keyId. RSA signatures are PKCS #1 v1.5 over the SHA-256 of the
+// payload, like the signatures of tenant keys.
+func PublishReserveProof(ctx context.Context, dbSvc DynamoDBAPI, tenantId, keyId string, signer crypto.Signer) (*ReserveProof, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	internal := map[string]bool{cfg.TreasuryAccount: true, cfg.BonusFundingAccount: true, cfg.SettlementAccount: true}
+	if cfg.FeeSchedule != nil {
+		internal[cfg.FeeSchedule.CollectionAccount] = true
+	}
+	if cfg.Tax != nil {
+		internal[cfg.Tax.CollectionAccount] = true
+	}
+
+	now := getCurrentTimestamp()
+	proof := &ReserveProof{
+		TenantID:    tenantId,
+		ProofID:     fmt.Sprintf("%019d", now),
+		Liabilities: map[string]float64{},
+		GeneratedAt: now,
+		KeyID:       keyId,
+	}
+	var inclusions []ReserveInclusion
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(NilUsers),
+		KeyConditionExpression:   aws.String("TenantID = :tenant"),
+		ProjectionExpression:     aws.String("AccountID, amount, #currency"),
+		ExpressionAttributeNames: map[string]string{"#currency": "currency"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for _, account := range page {
+			if internal[account.AccountID] {
+				continue
+			}
+			nonce := make([]byte, 16)
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, fmt.Errorf("failed to generate nonce: %v", err)
+			}
+			currency := cfg.accountCurrency(&account)
+			inclusions = append(inclusions, ReserveInclusion{
+				ProofKey:  tenantId + "#" + proof.ProofID,
+				TenantID:  tenantId,
+				ProofID:   proof.ProofID,
+				AccountID: account.AccountID,
+				Currency:  currency,
+				Balance:   roundAmount(account.Amount),
+				Nonce:     hex.EncodeToString(nonce),
+			})
+			proof.Liabilities[currency] = roundAmount(proof.Liabilities[currency] + max(account.Amount, 0))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	// Leaves are ordered by hash, which the nonces make random, so a leaf's
+	// position says nothing about its account.
+	leaves := make([]string, len(inclusions))
+	for i := range inclusions {
+		leaves[i] = inclusions[i].leaf()
+	}
+	sort.Sort(byLeaf{inclusions, leaves})
+	var paths [][]string
+	proof.MerkleRoot, paths = merkleTree(leaves)
+	proof.Accounts = len(inclusions)
+
+	var requests []types.WriteRequest
+	for i := range inclusions {
+		inclusions[i].Index, inclusions[i].Siblings = i, paths[i]
+		item, err := attributevalue.MarshalMap(inclusions[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal reserve inclusion: %v", err)
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+	for start := 0; start < len(requests); start += maxBatchWriteItems {
+		if _, err := batchWrite(ctx, dbSvc, ReserveInclusionsTable, requests[start:min(start+maxBatchWriteItems, len(requests))]); err != nil {
+			return nil, fmt.Errorf("failed to store reserve inclusions: %v", err)
+		}
+	}
+
+	if proof.Signature, err = signPayload(signer, proof.Payload()); err != nil {
+		return nil, err
+	}
+	// The proof is stored last, so a published proof always has its
+	// inclusions.
+	item, err := attributevalue.MarshalMap(proof)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal reserve proof: %v", err)
+	}
+	if _, err := dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ReserveProofsTable),
+		Item:      item,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to store reserve proof: %v", err)
+	}
+	return proof, nil
+}
+
+type byLeaf struct {
+	inclusions []ReserveInclusion
+	leaves     []string
+}
+
+func (b byLeaf) Len() int           { return len(b.leaves) }
+func (b byLeaf) Less(i, j int) bool { return b.leaves[i] < b.leaves[j] }
+func (b byLeaf) Swap(i, j int) {
+	b.leaves[i], b.leaves[j] = b.leaves[j], b.leaves[i]
+	b.inclusions[i], b.inclusions[j] = b.inclusions[j], b.inclusions[i]
+}
+
+// signPayload signs payload as verifySignature checks it, and returns the
+// signature base64 encoded.
+func signPayload(signer crypto.Signer, payload string) (string, error) {
+	var sig []byte
+	var err error
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, []byte(payload), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256([]byte(payload))
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign reserve proof: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyReserveProof checks the signature of a proof against a PEM encoded
+// Ed25519 or RSA public key.
+func VerifyReserveProof(proof ReserveProof, pemKey string) error {
+	key, _, err := parsePublicKey(pemKey)
+	if err != nil {
+		return err
+	}
+	if !verifySignature(key, proof.Payload(), proof.Signature) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// GetLatestReserveProof returns the newest proof of a tenant, or nil if it
+// has none.
+func GetLatestReserveProof(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (*ReserveProof, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(ReserveProofsTable),
+		KeyConditionExpression: aws.String("TenantID = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reserve proofs: %v", err)
+	}
+	if len(resp.Items) == 0 {
+		return nil, nil
+	}
+	var proof ReserveProof
+	if err := attributevalue.UnmarshalMap(resp.Items[0], &proof); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reserve proof: %v", err)
+	}
+	return &proof, nil
+}
+
+// GetReserveInclusion returns the proof that an account's balance is in a
+// tenant's proof of reserves.
+func GetReserveInclusion(ctx context.Context, dbSvc DynamoDBAPI, tenantId, proofId, accountId string) (*ReserveInclusion, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	resp, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ReserveInclusionsTable),
+		Key: map[string]types.AttributeValue{
+			"ProofKey":  &types.AttributeValueMemberS{Value: tenantId + "#" + proofId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reserve inclusion: %v", err)
+	}
+	if resp.Item == nil {
+		return nil, errors.New("account is not in the reserve proof")
+	}
+	var inclusion ReserveInclusion
+	if err := attributevalue.UnmarshalMap(resp.Item, &inclusion); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reserve inclusion: %v", err)
+	}
+	return &inclusion, nil
+}
@@ -0,0 +1,32 @@
+package ledger
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	if root, paths := merkleTree(nil); root != "" || paths != nil {
+		t.Errorf("merkleTree(nil) = %q, %v", root, paths)
+	}
+	for n := 1; n <= 9; n++ {
+		inclusions := make([]ReserveInclusion, n)
+		leaves := make([]string, n)
+		for i := range inclusions {
+			inclusions[i] = ReserveInclusion{TenantID: "t1", ProofID: "p1", AccountID: fmt.Sprint("acct-", i), Currency: "SDG", Balance: float64(i), Nonce: "00"}
+			leaves[i] = inclusions[i].leaf()
+		}
+		root, paths := merkleTree(leaves)
+		proof := ReserveProof{TenantID: "t1", ProofID: "p1", MerkleRoot: root}
+		for i, inclusion := range inclusions {
+			inclusion.Index, inclusion.Siblings = i, paths[i]
+			if !inclusion.Verify(proof) {
+				t.Errorf("%d leaves: leaf %d does not verify", n, i)
+			}
+			inclusion.Balance++
+			if inclusion.Verify(proof) {
+				t.Errorf("%d leaves: leaf %d verifies with another balance", n, i)
+			}
+		}
+	}
+}
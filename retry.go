@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// MetricDynamoDBRetries counts DynamoDB calls retried by the retry policy, by
+// op and error code.
+const MetricDynamoDBRetries = "ledger.dynamodb.retries"
+
+// RetryPolicy decides how a Ledger retries DynamoDB calls failing with
+// transient errors.
+//
+// Calls DynamoDB rejected, such as throttled calls and transaction conflicts,
+// were not applied and are always retried. Calls that failed on DynamoDB's
+// side may or may not have been applied; they are only retried when a repeat
+// cannot apply twice: reads, conditional writes, whose repeat fails its
+// condition instead, and transactions with a ClientRequestToken.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a call is tried, the first included.
+	MaxAttempts int
+	// BaseDelay caps the delay before the first retry; the cap doubles on
+	// every further retry up to MaxDelay. Delays are drawn at random under
+	// the cap, so clients throttled together do not retry together.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used by WithRetry for zero fields.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// WithRetry retries DynamoDB calls failing with transient errors. Retries
+// stop early when the context is done.
+func WithRetry(policy RetryPolicy) Option {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = max(DefaultRetryPolicy.MaxDelay, policy.BaseDelay)
+	}
+	return func(l *Ledger) {
+		l.retry = &policy
+	}
+}
+
+// DefaultConflictRetry is how transfers are retried when the sender moved
+// since it was read, unless set with WithConflictRetry.
+var DefaultConflictRetry = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    200 * time.Millisecond,
+}
+
+// WithConflictRetry sets how a transfer is retried when another write to the
+// sender, such as a concurrent transfer, moved the sender's version since
+// it was read. The sender is read again and its balance checked again before
+// every retry. Journals are retried the same way when an account they
+// credit moved. A MaxAttempts of 1 turns retrying off; zero fields are taken
+// from DefaultConflictRetry.
+func WithConflictRetry(policy RetryPolicy) Option {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultConflictRetry.MaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultConflictRetry.BaseDelay
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = max(DefaultConflictRetry.MaxDelay, policy.BaseDelay)
+	}
+	return func(l *Ledger) {
+		l.conflictRetry = &policy
+	}
+}
+
+// conflictRetryOf returns the conflict retry policy of a Ledger, or
+// DefaultConflictRetry.
+func conflictRetryOf(dbSvc DynamoDBAPI) *RetryPolicy {
+	if l, ok := dbSvc.(*Ledger); ok && l.conflictRetry != nil {
+		return l.conflictRetry
+	}
+	return &DefaultConflictRetry
+}
+
+// Delay returns the jittered delay before retry n, counted from 0: drawn
+// uniformly up to BaseDelay doubled n times, capped at MaxDelay.
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	ceiling := p.MaxDelay
+	if n < 32 && p.BaseDelay<<n < ceiling && p.BaseDelay<<n > 0 {
+		ceiling = p.BaseDelay << n
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// withRetry runs a DynamoDB call under the retry policy. idempotent tells
+// whether the call may be repeated after an error that leaves unknown
+// whether it was applied.
+func (l *Ledger) withRetry(ctx context.Context, op string, idempotent bool, fn func() error) error {
+	err := fn()
+	if l.retry == nil {
+		return err
+	}
+	for n := 0; n < l.retry.MaxAttempts-1 && err != nil; n++ {
+		code, ok := retryable(err, idempotent)
+		if !ok {
+			return err
+		}
+		l.metrics.AddCounter(ctx, MetricDynamoDBRetries, 1, Attr("op", op), Attr("code", code))
+		delay := l.retry.Delay(n)
+		l.logger.DebugContext(ctx, "retrying dynamodb call", "op", op, "code", code, "attempt", n+2, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// retryable returns the code of err and whether a call failing with it may
+// be retried.
+func retryable(err error, idempotent bool) (string, bool) {
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		return "TransactionCanceled", transactionRejected(canceled)
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return "", false
+	}
+	code := apiErr.ErrorCode()
+	switch code {
+	case "ProvisionedThroughputExceededException", "RequestLimitExceeded", "ThrottlingException",
+		"TransactionConflictException", "TransactionInProgressException":
+		return code, true
+	case "InternalServerError", "ServiceUnavailable":
+		return code, idempotent
+	}
+	return code, false
+}
+
+// transactionRejected reports whether a transaction was canceled only for
+// conflicts or throttling, rather than a failed condition, so none of it was
+// applied and running it again may succeed.
+func transactionRejected(canceled *types.TransactionCanceledException) bool {
+	rejected := false
+	for _, reason := range canceled.CancellationReasons {
+		switch aws.ToString(reason.Code) {
+		case "", "None":
+		case "TransactionConflict", "ThrottlingError", "ProvisionedThroughputExceeded":
+			rejected = true
+		default:
+			return false
+		}
+	}
+	return rejected
+}
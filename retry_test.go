@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRetryable(t *testing.T) {
+	canceled := func(codes ...string) error {
+		var reasons []types.CancellationReason
+		for _, code := range codes {
+			reasons = append(reasons, types.CancellationReason{Code: aws.String(code)})
+		}
+		return &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	tests := []struct {
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{&types.ProvisionedThroughputExceededException{}, false, true},
+		{fmt.Errorf("wrapped: %w", &types.RequestLimitExceeded{}), false, true},
+		{&types.TransactionConflictException{}, false, true},
+		{canceled("None", "TransactionConflict"), false, true},
+		{canceled("ConditionalCheckFailed", "TransactionConflict"), false, false},
+		{canceled("None"), false, false},
+		{&types.InternalServerError{}, false, false},
+		{&types.InternalServerError{}, true, true},
+		{&types.ConditionalCheckFailedException{}, true, false},
+		{errors.New("connection reset"), true, false},
+	}
+	for _, tt := range tests {
+		if _, got := retryable(tt.err, tt.idempotent); got != tt.want {
+			t.Errorf("retryable(%v, %v) = %v, want %v", tt.err, tt.idempotent, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for n, ceiling := range []time.Duration{10, 20, 40, 50, 50, 50} {
+		for i := 0; i < 100; i++ {
+			if d := p.Delay(n); d < 0 || d > ceiling*time.Millisecond {
+				t.Fatalf("delay(%d) = %s, want at most %s", n, d, ceiling*time.Millisecond)
+			}
+		}
+	}
+	if d := p.Delay(100); d > p.MaxDelay {
+		t.Errorf("delay(100) = %s, want at most MaxDelay", d)
+	}
+}
@@ -0,0 +1,289 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// API is the part of the DynamoDB client Migrate uses. *dynamodb.Client
+// satisfies it.
+type API interface {
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+var _ API = (*dynamodb.Client)(nil)
+
+// Defaults used by Migrate.
+const (
+	DefaultPollInterval = 5 * time.Second
+	DefaultWaitTimeout  = 30 * time.Minute
+)
+
+type options struct {
+	prefix       string
+	tables       []Table
+	pollInterval time.Duration
+	waitTimeout  time.Duration
+}
+
+// Option configures Migrate.
+type Option func(*options)
+
+// WithTablePrefix migrates the tables of a Ledger created with the same
+// ledger.WithTablePrefix.
+func WithTablePrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// WithTables migrates tables instead of Tables().
+func WithTables(tables ...Table) Option {
+	return func(o *options) {
+		o.tables = tables
+	}
+}
+
+// WithPollInterval sets how often Migrate checks whether new tables and
+// indexes are active, and how long it waits for each at most.
+func WithPollInterval(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = interval
+		o.waitTimeout = timeout
+	}
+}
+
+// Migrate brings the database in line with the declared tables: it creates
+// missing tables, billed per request, adds missing indexes one at a time as
+// DynamoDB requires, and enables TTL, waiting for each change to be active.
+// Running it again changes nothing.
+//
+// Keys cannot be changed in place, so a table or index whose keys differ
+// from the declaration is reported rather than changed, with what to do
+// about it. Migrate goes on with the other tables and returns every problem
+// joined.
+func Migrate(ctx context.Context, client API, opts ...Option) error {
+	o := options{tables: Tables(), pollInterval: DefaultPollInterval, waitTimeout: DefaultWaitTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var errs []error
+	for _, table := range o.tables {
+		table.Name = o.prefix + table.Name
+		if err := migrateTable(ctx, client, o, table); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func migrateTable(ctx context.Context, client API, o options, table Table) error {
+	out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table.Name)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		if _, err := client.CreateTable(ctx, createTableInput(table)); err != nil {
+			return fmt.Errorf("failed to create table %s: %v", table.Name, err)
+		}
+		if err := waitActive(ctx, client, o, table.Name, ""); err != nil {
+			return err
+		}
+		return migrateTTL(ctx, client, table)
+	case err != nil:
+		return fmt.Errorf("failed to describe table %s: %v", table.Name, err)
+	}
+
+	desc := out.Table
+	var errs []error
+	if hash, rng := keyNames(desc.KeySchema); hash != table.HashKey.Name || rng != table.RangeKey.Name {
+		errs = append(errs, fmt.Errorf("table %s has %s, want %s; keys cannot be changed in place, so create a new table and copy the items over", table.Name, keyDescription(hash, rng), keyDescription(table.HashKey.Name, table.RangeKey.Name)))
+	}
+	keys := []Key{table.HashKey, table.RangeKey}
+	for _, index := range table.Indexes {
+		keys = append(keys, index.HashKey, index.RangeKey)
+	}
+	for _, def := range desc.AttributeDefinitions {
+		for _, k := range keys {
+			if k.Name == aws.ToString(def.AttributeName) && k.Type != def.AttributeType {
+				errs = append(errs, fmt.Errorf("key attribute %s of table %s is of type %s, want %s; create a new table and copy the items over, converting the attribute", k.Name, table.Name, def.AttributeType, k.Type))
+				break
+			}
+		}
+	}
+	for _, index := range table.Indexes {
+		existing := findIndex(desc.GlobalSecondaryIndexes, index.Name)
+		if existing != nil {
+			if hash, rng := keyNames(existing.KeySchema); hash != index.HashKey.Name || rng != index.RangeKey.Name {
+				errs = append(errs, fmt.Errorf("index %s of table %s has %s, want %s; delete the index and run Migrate again to recreate it", index.Name, table.Name, keyDescription(hash, rng), keyDescription(index.HashKey.Name, index.RangeKey.Name)))
+			}
+			continue
+		}
+		if err := addIndex(ctx, client, o, table, index); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := migrateTTL(ctx, client, table); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func addIndex(ctx context.Context, client API, o options, table Table, index Index) error {
+	_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(table.Name),
+		AttributeDefinitions: attributeDefinitions(index.HashKey, index.RangeKey),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+			Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:  aws.String(index.Name),
+				KeySchema:  keySchema(index.HashKey, index.RangeKey),
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add index %s to table %s: %v", index.Name, table.Name, err)
+	}
+	return waitActive(ctx, client, o, table.Name, index.Name)
+}
+
+func migrateTTL(ctx context.Context, client API, table Table) error {
+	if table.TTL == "" {
+		return nil
+	}
+	out, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table.Name)})
+	if err != nil {
+		return fmt.Errorf("failed to describe the TTL of table %s: %v", table.Name, err)
+	}
+	if ttl := out.TimeToLiveDescription; ttl != nil && aws.ToString(ttl.AttributeName) == table.TTL &&
+		(ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table.Name),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(table.TTL),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on attribute %s of table %s; a table has at most one TTL attribute, so disable any other first: %v", table.TTL, table.Name, err)
+	}
+	return nil
+}
+
+// waitActive waits for a table, or one of its indexes when index is set, to
+// become active.
+func waitActive(ctx context.Context, client API, o options, tableName, index string) error {
+	what := "table " + tableName
+	if index != "" {
+		what = fmt.Sprintf("index %s of table %s", index, tableName)
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.waitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+	for {
+		out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return fmt.Errorf("failed to describe %s: %v", what, err)
+		}
+		if active(out.Table, index) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not become active: %w", what, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func active(desc *types.TableDescription, index string) bool {
+	if desc == nil || desc.TableStatus != types.TableStatusActive {
+		return false
+	}
+	if index == "" {
+		return true
+	}
+	found := findIndex(desc.GlobalSecondaryIndexes, index)
+	return found != nil && found.IndexStatus == types.IndexStatusActive
+}
+
+func createTableInput(table Table) *dynamodb.CreateTableInput {
+	keys := []Key{table.HashKey, table.RangeKey}
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String(table.Name),
+		KeySchema:   keySchema(table.HashKey, table.RangeKey),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	for _, index := range table.Indexes {
+		keys = append(keys, index.HashKey, index.RangeKey)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(index.Name),
+			KeySchema:  keySchema(index.HashKey, index.RangeKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	input.AttributeDefinitions = attributeDefinitions(keys...)
+	return input
+}
+
+// attributeDefinitions defines each key attribute once, skipping zero Keys.
+func attributeDefinitions(keys ...Key) []types.AttributeDefinition {
+	var defs []types.AttributeDefinition
+	defined := map[string]bool{}
+	for _, k := range keys {
+		if k.Name == "" || defined[k.Name] {
+			continue
+		}
+		defined[k.Name] = true
+		defs = append(defs, types.AttributeDefinition{AttributeName: aws.String(k.Name), AttributeType: k.Type})
+	}
+	return defs
+}
+
+func keySchema(hash, rng Key) []types.KeySchemaElement {
+	elements := []types.KeySchemaElement{{AttributeName: aws.String(hash.Name), KeyType: types.KeyTypeHash}}
+	if rng.Name != "" {
+		elements = append(elements, types.KeySchemaElement{AttributeName: aws.String(rng.Name), KeyType: types.KeyTypeRange})
+	}
+	return elements
+}
+
+func keyNames(elements []types.KeySchemaElement) (hash, rng string) {
+	for _, e := range elements {
+		switch e.KeyType {
+		case types.KeyTypeHash:
+			hash = aws.ToString(e.AttributeName)
+		case types.KeyTypeRange:
+			rng = aws.ToString(e.AttributeName)
+		}
+	}
+	return hash, rng
+}
+
+func keyDescription(hash, rng string) string {
+	if rng == "" {
+		return fmt.Sprintf("hash key %s and no range key", hash)
+	}
+	return fmt.Sprintf("hash key %s and range key %s", hash, rng)
+}
+
+func findIndex(indexes []types.GlobalSecondaryIndexDescription, name string) *types.GlobalSecondaryIndexDescription {
+	for i := range indexes {
+		if aws.ToString(indexes[i].IndexName) == name {
+			return &indexes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package schema
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeAPI keeps table descriptions. New tables and indexes report CREATING
+// the first time they are described, as DynamoDB does while it builds them.
+type fakeAPI struct {
+	tables  map[string]*types.TableDescription
+	ttl     map[string]string
+	creates int
+	updates int
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{tables: map[string]*types.TableDescription{}, ttl: map[string]string{}}
+}
+
+func (f *fakeAPI) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	desc, ok := f.tables[aws.ToString(params.TableName)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("not found")}
+	}
+	out := *desc
+	out.GlobalSecondaryIndexes = append([]types.GlobalSecondaryIndexDescription(nil), desc.GlobalSecondaryIndexes...)
+	desc.TableStatus = types.TableStatusActive
+	for i := range desc.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes[i].IndexStatus = types.IndexStatusActive
+	}
+	return &dynamodb.DescribeTableOutput{Table: &out}, nil
+}
+
+func (f *fakeAPI) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	f.creates++
+	desc := &types.TableDescription{
+		TableName:            params.TableName,
+		TableStatus:          types.TableStatusCreating,
+		KeySchema:            params.KeySchema,
+		AttributeDefinitions: params.AttributeDefinitions,
+	}
+	for _, index := range params.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName: index.IndexName, KeySchema: index.KeySchema, IndexStatus: types.IndexStatusCreating,
+		})
+	}
+	f.tables[aws.ToString(params.TableName)] = desc
+	return &dynamodb.CreateTableOutput{TableDescription: desc}, nil
+}
+
+func (f *fakeAPI) UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	f.updates++
+	desc := f.tables[aws.ToString(params.TableName)]
+	for _, update := range params.GlobalSecondaryIndexUpdates {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName: update.Create.IndexName, KeySchema: update.Create.KeySchema, IndexStatus: types.IndexStatusCreating,
+		})
+	}
+	desc.AttributeDefinitions = append(desc.AttributeDefinitions, params.AttributeDefinitions...)
+	return &dynamodb.UpdateTableOutput{TableDescription: desc}, nil
+}
+
+func (f *fakeAPI) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if attr, ok := f.ttl[aws.ToString(params.TableName)]; ok {
+		desc.AttributeName = aws.String(attr)
+		desc.TimeToLiveStatus = types.TimeToLiveStatusEnabled
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+func (f *fakeAPI) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.ttl[aws.ToString(params.TableName)] = aws.ToString(params.TimeToLiveSpecification.AttributeName)
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	fast := WithPollInterval(time.Millisecond, time.Second)
+	if err := Migrate(ctx, api, WithTablePrefix("dev_"), fast); err != nil {
+		t.Fatalf("Migrate() = %v", err)
+	}
+	if api.creates != len(Tables()) {
+		t.Errorf("Migrate() created %d tables, want %d", api.creates, len(Tables()))
+	}
+	if got := api.ttl["dev_"+ledger.AccountEventsTable]; got != "ExpiresAt" {
+		t.Errorf("TTL of %s = %q, want ExpiresAt", ledger.AccountEventsTable, got)
+	}
+	defined := map[string]types.ScalarAttributeType{}
+	for _, def := range api.tables["dev_"+ledger.EscrowTransactionsTable].AttributeDefinitions {
+		defined[aws.ToString(def.AttributeName)] = def.AttributeType
+	}
+	if defined["UUID"] != types.ScalarAttributeTypeS || defined["TransactionStatus"] != types.ScalarAttributeTypeN || defined["TransactionDate"] != types.ScalarAttributeTypeN {
+		t.Errorf("%s attributes = %v", ledger.EscrowTransactionsTable, defined)
+	}
+
+	if err := Migrate(ctx, api, WithTablePrefix("dev_"), fast); err != nil || api.creates != len(Tables()) || api.updates != 0 {
+		t.Errorf("second Migrate() = %v, with %d creates and %d updates", err, api.creates-len(Tables()), api.updates)
+	}
+
+	// An older deployment with a missing index is upgraded in place.
+	transactions := api.tables["dev_"+ledger.TransactionsTable]
+	transactions.GlobalSecondaryIndexes = transactions.GlobalSecondaryIndexes[:1]
+	if err := Migrate(ctx, api, WithTablePrefix("dev_"), fast); err != nil || api.updates != 4 {
+		t.Fatalf("Migrate() of a table missing indexes = %v, with %d updates, want 4", err, api.updates)
+	}
+	if n := len(api.tables["dev_"+ledger.TransactionsTable].GlobalSecondaryIndexes); n != 5 {
+		t.Errorf("%s has %d indexes after Migrate(), want 5", ledger.TransactionsTable, n)
+	}
+}
+
+func TestMigrateReportsKeyMismatches(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	api.tables[ledger.NilUsers] = &types.TableDescription{
+		TableStatus: types.TableStatusActive,
+		KeySchema:   keySchema(S("AccountID"), Key{}),
+	}
+	api.tables[ledger.TransactionsTable] = &types.TableDescription{
+		TableStatus:          types.TableStatusActive,
+		KeySchema:            keySchema(S("TenantID"), S("TransactionID")),
+		AttributeDefinitions: attributeDefinitions(S("TenantID"), S("TransactionID"), S("TransactionDate")),
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndexDescription{
+			{IndexName: aws.String("FromAccountIndex"), KeySchema: keySchema(S("FromAccount"), Key{}), IndexStatus: types.IndexStatusActive},
+		},
+	}
+	tables := Tables()[:3]
+	err := Migrate(ctx, api, WithTables(tables...), WithPollInterval(time.Millisecond, time.Second))
+	if err == nil {
+		t.Fatal("Migrate() of mismatched tables succeeded")
+	}
+	for _, want := range []string{
+		"table NilUsers has hash key AccountID and no range key, want hash key TenantID and range key AccountID; keys cannot be changed in place",
+		"index FromAccountIndex of table TransactionsTable has hash key FromAccount and no range key, want hash key TenantID and range key FromAccount; delete the index",
+		"key attribute TransactionDate of table TransactionsTable is of type S, want N",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Migrate() error lacks %q:\n%v", want, err)
+		}
+	}
+	if _, ok := api.tables[ledger.LedgerTable]; !ok {
+		t.Errorf("Migrate() stopped before creating %s", ledger.LedgerTable)
+	}
+}
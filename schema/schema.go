@@ -0,0 +1,67 @@
+// Package schema declares the DynamoDB tables and indexes the ledger
+// expects, and migrates a database to them.
+//
+// The tables are those the ledger validates and creates, ledger.TableSpecs,
+// read from the ledger's table name variables when called, so set them
+// before migrating when a deployment renames tables.
+package schema
+
+import (
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Key is a key attribute of a table or index.
+type Key struct {
+	Name string
+	Type types.ScalarAttributeType
+}
+
+// S and N are string and number key attributes.
+func S(name string) Key { return Key{Name: name, Type: types.ScalarAttributeTypeS} }
+func N(name string) Key { return Key{Name: name, Type: types.ScalarAttributeTypeN} }
+
+// Index is a global secondary index. Indexes project every attribute.
+type Index struct {
+	Name    string
+	HashKey Key
+	// RangeKey is the zero Key when the index has none.
+	RangeKey Key
+}
+
+// Table is a table the ledger uses.
+type Table struct {
+	Name    string
+	HashKey Key
+	// RangeKey is the zero Key when the table has none.
+	RangeKey Key
+	Indexes  []Index
+	// TTL is the attribute items expire on, if any.
+	TTL string
+}
+
+// Tables returns the tables used by the ledger: those of
+// ledger.TableSpecs, with their key attributes typed.
+func Tables() []Table {
+	specs := ledger.TableSpecs()
+	tables := make([]Table, 0, len(specs))
+	for _, spec := range specs {
+		table := Table{Name: spec.Name, HashKey: keyAttr(spec.HashKey), RangeKey: keyAttr(spec.RangeKey), TTL: spec.TTL}
+		for _, index := range spec.Indexes {
+			table.Indexes = append(table.Indexes, Index{Name: index.Name, HashKey: keyAttr(index.HashKey), RangeKey: keyAttr(index.RangeKey)})
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// keyAttr returns the key attribute of a name, or the zero Key for none.
+func keyAttr(name string) Key {
+	switch {
+	case name == "":
+		return Key{}
+	case ledger.NumericKey(name):
+		return N(name)
+	}
+	return S(name)
+}
@@ -0,0 +1,81 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrTransferBlocked is returned for a transfer rejected by the screening
+// hook.
+var ErrTransferBlocked = errors.New("transfer_blocked")
+
+// ScreeningHook checks transfers for compliance, e.g. against sanctions
+// lists or AML rules, before they are executed. Screen returns nil to let a
+// transfer through and a *ScreeningRejection to block it. Any other error
+// fails the transfer without blocking it, so a screening service that is
+// down never lets a transfer through unscreened.
+type ScreeningHook interface {
+	Screen(ctx context.Context, req TransferRequest) error
+}
+
+// ScreeningHookFunc adapts a function to a ScreeningHook.
+type ScreeningHookFunc func(ctx context.Context, req TransferRequest) error
+
+func (f ScreeningHookFunc) Screen(ctx context.Context, req TransferRequest) error {
+	return f(ctx, req)
+}
+
+// ScreeningRejection is returned by a ScreeningHook blocking a transfer.
+// ReasonCode, e.g. "sanctions_match", is stored on the blocked transaction;
+// Reason is for the operators reviewing it and is not shown to the sender.
+type ScreeningRejection struct {
+	ReasonCode string
+	Reason     string
+}
+
+func (r *ScreeningRejection) Error() string {
+	if r.Reason == "" {
+		return "transfer blocked: " + r.ReasonCode
+	}
+	return fmt.Sprintf("transfer blocked: %s: %s", r.ReasonCode, r.Reason)
+}
+
+// WithScreening has every transfer screened by hook before it is executed.
+// Blocked transfers are recorded with status TransactionBlocked and the
+// rejection's reason code.
+func WithScreening(hook ScreeningHook) Option {
+	return func(l *Ledger) {
+		l.screening = hook
+	}
+}
+
+// screeningHookOf returns the screening hook of dbSvc, or nil when transfers
+// are not screened.
+func screeningHookOf(dbSvc DynamoDBAPI) ScreeningHook {
+	if l, ok := dbSvc.(*Ledger); ok {
+		return l.screening
+	}
+	return nil
+}
+
+// screenTransfer runs the screening hook on a transfer. It returns the
+// rejection of a blocked transfer, or the error of a hook that failed.
+func screenTransfer(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) (*ScreeningRejection, error) {
+	hook := screeningHookOf(dbSvc)
+	if hook == nil {
+		return nil, nil
+	}
+	err := hook.Screen(ctx, req)
+	if err == nil {
+		return nil, nil
+	}
+	var rejection *ScreeningRejection
+	if errors.As(err, &rejection) {
+		if rejection.ReasonCode == "" {
+			rejection.ReasonCode = "screening_rejected"
+		}
+		return rejection, nil
+	}
+	return nil, fmt.Errorf("failed to screen transfer: %w", err)
+}
@@ -0,0 +1,168 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReferenceIndex is the index of TransactionsTable finding a tenant's
+// transactions by reference. Its range key is ReferenceLookup, so only
+// transactions with a reference are indexed.
+const ReferenceIndex = "ReferenceIndex"
+
+// MaxReferenceLength is the most characters a reference may have.
+const MaxReferenceLength = 64
+
+// ErrInvalidReference is returned for references that are too long once
+// sanitized.
+var ErrInvalidReference = errors.New("invalid_reference")
+
+// SanitizeReference cleans a caller supplied reference like
+// SanitizeNarrative, failing with ErrInvalidReference when the result is
+// longer than MaxReferenceLength.
+func SanitizeReference(s string) (string, error) {
+	s, err := SanitizeNarrative(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: at most %d characters allowed", ErrInvalidReference, MaxReferenceLength)
+	}
+	if n := utf8.RuneCountInString(s); n > MaxReferenceLength {
+		return "", fmt.Errorf("%w: %d characters, at most %d allowed", ErrInvalidReference, n, MaxReferenceLength)
+	}
+	return s, nil
+}
+
+// referenceLookupKey is the form references are indexed and searched in:
+// lower case letters and digits only, so "INV-0042", "inv 0042" and
+// "inv0042" are the same reference.
+func referenceLookupKey(reference string) string {
+	var b strings.Builder
+	for _, r := range reference {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// SearchMatch is how TransactionSearch.Comment is matched.
+type SearchMatch string
+
+const (
+	MatchPrefix   SearchMatch = "prefix"
+	MatchContains SearchMatch = "contains"
+)
+
+// TransactionSearch selects the transactions SearchTransactions returns. At
+// least one of Reference and Comment is set.
+type TransactionSearch struct {
+	// Reference matches the transactions whose reference starts with it,
+	// ignoring case, spaces and punctuation.
+	Reference string
+	// Comment matches the transactions whose system comment or narrative
+	// starts with, or with MatchContains contains, it, ignoring the case of
+	// the narrative.
+	Comment string
+	Match   SearchMatch
+	// AccountID limits the search to the transactions of an account.
+	AccountID        string
+	LastEvaluatedKey map[string]types.AttributeValue
+	Limit            int32
+}
+
+// SearchTransactions returns a tenant's transactions matching search, such
+// as those of a reference a customer quotes to support, and the key to pass
+// as LastEvaluatedKey for the next page. A search by reference queries
+// ReferenceIndex; one by Comment alone reads the tenant's transactions,
+// newest first, and a page may hold fewer than Limit matches.
+func SearchTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, search TransactionSearch) ([]TransactionEntry, map[string]types.AttributeValue, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if search.Match == "" {
+		search.Match = MatchPrefix
+	}
+	if search.Match != MatchPrefix && search.Match != MatchContains {
+		return nil, nil, fmt.Errorf("unknown match: %s", search.Match)
+	}
+	reference, err := SanitizeReference(search.Reference)
+	if err != nil {
+		return nil, nil, err
+	}
+	comment, err := SanitizeNarrative(search.Comment)
+	if err != nil {
+		return nil, nil, err
+	}
+	lookup := referenceLookupKey(reference)
+	if lookup == "" && comment == "" {
+		return nil, nil, errors.New("a reference or comment to search for is required")
+	}
+	if search.Limit == 0 {
+		search.Limit = 25
+	}
+
+	keyCondition := "TenantID = :tenantId"
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+	}
+	input := &dynamodb.QueryInput{
+		TableName:        aws.String(TransactionsTable),
+		Limit:            aws.Int32(search.Limit),
+		ScanIndexForward: aws.Bool(false),
+	}
+	if lookup != "" {
+		input.IndexName = aws.String(ReferenceIndex)
+		keyCondition += " AND begins_with(#referenceLookup, :reference)"
+		names["#referenceLookup"] = "ReferenceLookup"
+		values[":reference"] = &types.AttributeValueMemberS{Value: lookup}
+	}
+
+	var filters []string
+	if comment != "" {
+		function := "begins_with"
+		if search.Match == MatchContains {
+			function = "contains"
+		}
+		filters = append(filters, fmt.Sprintf("(%s(#comment, :comment) OR %s(#narrativeSearch, :narrative))", function, function))
+		names["#comment"] = "Comment"
+		names["#narrativeSearch"] = "NarrativeSearch"
+		values[":comment"] = &types.AttributeValueMemberS{Value: comment}
+		values[":narrative"] = &types.AttributeValueMemberS{Value: narrativeSearchKey(comment)}
+	}
+	if search.AccountID != "" {
+		filters = append(filters, "(#fromAccount = :accountID OR #toAccount = :accountID)")
+		names["#fromAccount"] = "FromAccount"
+		names["#toAccount"] = "ToAccount"
+		values[":accountID"] = &types.AttributeValueMemberS{Value: search.AccountID}
+	}
+	input.KeyConditionExpression = aws.String(keyCondition)
+	input.ExpressionAttributeValues = values
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+	if len(search.LastEvaluatedKey) > 0 {
+		input.ExclusiveStartKey = search.LastEvaluatedKey
+	}
+
+	output, err := dbSvc.Query(ctx, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to search transactions: %v", err)
+	}
+	var transactions []TransactionEntry
+	if err := attributevalue.UnmarshalListOfMaps(output.Items, &transactions); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
+	}
+	return transactions, output.LastEvaluatedKey, nil
+}
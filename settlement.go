@@ -0,0 +1,461 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// InterTenantObligationsTable holds what tenants owe each other for the
+// transfers between them, keyed by Period, the UTC day, and Pair, the two
+// tenants in order.
+var InterTenantObligationsTable = "InterTenantObligations"
+
+// SettlementBatchesTable holds the settlement batches run by RunSettlement,
+// keyed by Period.
+var SettlementBatchesTable = "SettlementBatches"
+
+// SettlementPeriodFormat is the layout of settlement periods: one per UTC
+// day.
+const SettlementPeriodFormat = "2006-01-02"
+
+const (
+	SettlementRunning   = "running"
+	SettlementCompleted = "completed"
+)
+
+// SettlementReporter publishes the report of a completed settlement batch.
+type SettlementReporter func(ctx context.Context, batch *SettlementBatch) error
+
+// DefaultSettlementReporter is called with every batch RunSettlement
+// completes. It only logs; deployments send the report to the tenants and
+// their banks.
+var DefaultSettlementReporter SettlementReporter = func(ctx context.Context, batch *SettlementBatch) error {
+	slog.Default().InfoContext(ctx, "settlement completed", "period", batch.Period, "positions", len(batch.Positions), "report", batch.Report())
+	return nil
+}
+
+// Obligation is the net of the transfers between two tenants in a period.
+// Amount is what TenantA owes TenantB; negative when TenantB owes TenantA.
+type Obligation struct {
+	Period    string  `dynamodbav:"Period" json:"period"`
+	Pair      string  `dynamodbav:"Pair" json:"pair"`
+	TenantA   string  `dynamodbav:"TenantA" json:"tenant_a"`
+	TenantB   string  `dynamodbav:"TenantB" json:"tenant_b"`
+	Amount    float64 `dynamodbav:"Amount" json:"amount"`
+	Transfers int64   `dynamodbav:"Transfers" json:"transfers"`
+	UpdatedAt int64   `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// SettlementPosition is a payment of a settlement batch: Payer's settlement
+// account pays Amount into Payee's.
+type SettlementPosition struct {
+	Payer  string  `dynamodbav:"Payer" json:"payer"`
+	Payee  string  `dynamodbav:"Payee" json:"payee"`
+	Amount float64 `dynamodbav:"Amount" json:"amount"`
+}
+
+func (p SettlementPosition) key() string {
+	return p.Payer + "#" + p.Payee
+}
+
+// SettlementBatch settles the obligations of a period. The obligations are
+// netted per tenant, so each tenant either only pays or only gets paid, and
+// the fewest payments that clear them are its positions.
+type SettlementBatch struct {
+	Period string `dynamodbav:"Period" json:"period"`
+	Status string `dynamodbav:"Status" json:"status"`
+	// Net is each tenant's net position: positive when it is owed.
+	Net       map[string]float64   `dynamodbav:"Net" json:"net"`
+	Positions []SettlementPosition `dynamodbav:"Positions" json:"positions"`
+	// Settled maps the positions paid, by "payer#payee", to the
+	// transaction of their settlement entries.
+	Settled     map[string]string `dynamodbav:"Settled" json:"settled"`
+	CreatedAt   int64             `dynamodbav:"CreatedAt" json:"created_at"`
+	CompletedAt int64             `dynamodbav:"CompletedAt,omitempty" json:"completed_at,omitempty"`
+}
+
+// Report renders the batch as a plain text settlement report.
+func (b *SettlementBatch) Report() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Settlement %s (%s)\n", b.Period, b.Status)
+	tenants := make([]string, 0, len(b.Net))
+	for tenant := range b.Net {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	sb.WriteString("Net positions:\n")
+	for _, tenant := range tenants {
+		fmt.Fprintf(&sb, "  %-20s %14.2f\n", tenant, b.Net[tenant])
+	}
+	sb.WriteString("Payments:\n")
+	for _, p := range b.Positions {
+		tx := b.Settled[p.key()]
+		if tx == "" {
+			tx = "unsettled"
+		}
+		fmt.Fprintf(&sb, "  %-20s -> %-20s %14.2f  %s\n", p.Payer, p.Payee, p.Amount, tx)
+	}
+	return sb.String()
+}
+
+// obligationUpdate returns the update adding a transfer of amount from one
+// tenant to another to their obligation of the period of timestamp.
+func obligationUpdate(fromTenant, toTenant string, amount float64, timestamp int64) *types.Update {
+	a, b := fromTenant, toTenant
+	if b < a {
+		a, b, amount = b, a, -amount
+	}
+	return &types.Update{
+		TableName: aws.String(InterTenantObligationsTable),
+		Key: map[string]types.AttributeValue{
+			"Period": &types.AttributeValueMemberS{Value: time.Unix(timestamp, 0).UTC().Format(SettlementPeriodFormat)},
+			"Pair":   &types.AttributeValueMemberS{Value: a + "#" + b},
+		},
+		UpdateExpression: aws.String("SET TenantA = :a, TenantB = :b, UpdatedAt = :now ADD Amount :amount, Transfers :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":a":      &types.AttributeValueMemberS{Value: a},
+			":b":      &types.AttributeValueMemberS{Value: b},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+			":amount": &types.AttributeValueMemberN{Value: formatAmount(amount)},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+	}
+}
+
+// AccumulateInterTenantObligations records that amount moved from a
+// customer of fromTenant to one of toTenant at t, so that fromTenant owes it
+// to toTenant at the settlement of t's period. EscrowTransferCredits records
+// its transfers itself, in the same transaction as the credit; this is for
+// money moved between tenants otherwise.
+func AccumulateInterTenantObligations(ctx context.Context, dbSvc DynamoDBAPI, fromTenant, toTenant string, amount float64, t time.Time) error {
+	switch {
+	case fromTenant == "" || toTenant == "":
+		return errors.New("both tenants are required")
+	case fromTenant == toTenant:
+		return errors.New("a tenant has no obligations to itself")
+	case amount <= 0 || math.IsNaN(amount):
+		return fmt.Errorf("invalid amount %.2f", amount)
+	}
+	update := obligationUpdate(fromTenant, toTenant, amount, t.Unix())
+	if _, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+	}); err != nil {
+		return fmt.Errorf("failed to update obligation: %v", err)
+	}
+	return nil
+}
+
+// GetObligations returns the obligations between tenants of a period.
+func GetObligations(ctx context.Context, dbSvc DynamoDBAPI, period string) ([]Obligation, error) {
+	var obligations []Obligation
+	var cursor map[string]types.AttributeValue
+	for {
+		resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(InterTenantObligationsTable),
+			KeyConditionExpression: aws.String("Period = :period"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":period": &types.AttributeValueMemberS{Value: period},
+			},
+			ExclusiveStartKey: cursor,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query obligations: %v", err)
+		}
+		var page []Obligation
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal obligations: %v", err)
+		}
+		obligations = append(obligations, page...)
+		if resp.LastEvaluatedKey == nil {
+			return obligations, nil
+		}
+		cursor = resp.LastEvaluatedKey
+	}
+}
+
+// RunSettlement settles the obligations between tenants of a period, which
+// must have ended. It nets them into a settlement batch, then pays each of
+// its positions from the payer's SettlementAccount into the payee's, with a
+// debit and a credit ledger entry, and finally reports the completed batch
+// through DefaultSettlementReporter.
+//
+// The batch is stored before any payment is made and every payment is
+// recorded on it in the same transaction, so running the settlement of a
+// period again resumes it, or returns the completed batch, without paying
+// anything twice.
+func RunSettlement(ctx context.Context, dbSvc DynamoDBAPI, period string) (*SettlementBatch, error) {
+	start, err := time.Parse(SettlementPeriodFormat, period)
+	if err != nil {
+		return nil, fmt.Errorf("invalid settlement period %q: %v", period, err)
+	}
+	if !clockOf(dbSvc).Now().UTC().After(start.AddDate(0, 0, 1)) {
+		return nil, fmt.Errorf("settlement period %s has not ended", period)
+	}
+
+	batch, err := GetSettlementBatch(ctx, dbSvc, period)
+	if err != nil {
+		return nil, err
+	}
+	if batch == nil {
+		if batch, err = createSettlementBatch(ctx, dbSvc, period); err != nil {
+			return nil, err
+		}
+	}
+	if batch.Status == SettlementCompleted {
+		return batch, nil
+	}
+
+	for _, position := range batch.Positions {
+		if batch.Settled[position.key()] != "" {
+			continue
+		}
+		transactionId, err := settlePosition(ctx, dbSvc, period, position)
+		if err != nil {
+			var canceled *types.TransactionCanceledException
+			if !errors.As(err, &canceled) {
+				return batch, err
+			}
+			// Another run may have paid it since the batch was read.
+			current, getErr := GetSettlementBatch(ctx, dbSvc, period)
+			if getErr != nil || current == nil || current.Settled[position.key()] == "" {
+				return batch, fmt.Errorf("failed to settle %s: %v", position.key(), err)
+			}
+			transactionId = current.Settled[position.key()]
+		}
+		batch.Settled[position.key()] = transactionId
+	}
+
+	now := clockOf(dbSvc).Now().Unix()
+	if _, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(SettlementBatchesTable),
+		Key: map[string]types.AttributeValue{
+			"Period": &types.AttributeValueMemberS{Value: period},
+		},
+		UpdateExpression: aws.String("SET #status = :completed, CompletedAt = :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed": &types.AttributeValueMemberS{Value: SettlementCompleted},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	}); err != nil {
+		return batch, fmt.Errorf("failed to complete settlement batch: %v", err)
+	}
+	batch.Status, batch.CompletedAt = SettlementCompleted, now
+
+	if DefaultSettlementReporter != nil {
+		if err := DefaultSettlementReporter(ctx, batch); err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "failed to report settlement", "period", period, "error", err)
+		}
+	}
+	return batch, nil
+}
+
+// GetSettlementBatch returns the settlement batch of a period, or nil if it
+// was never run.
+func GetSettlementBatch(ctx context.Context, dbSvc DynamoDBAPI, period string) (*SettlementBatch, error) {
+	resp, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(SettlementBatchesTable),
+		Key: map[string]types.AttributeValue{
+			"Period": &types.AttributeValueMemberS{Value: period},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settlement batch: %v", err)
+	}
+	if resp.Item == nil {
+		return nil, nil
+	}
+	var batch SettlementBatch
+	if err := attributevalue.UnmarshalMap(resp.Item, &batch); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settlement batch: %v", err)
+	}
+	if batch.Settled == nil {
+		batch.Settled = map[string]string{}
+	}
+	return &batch, nil
+}
+
+// createSettlementBatch nets the obligations of a period into a new batch,
+// or returns the batch another run created first.
+func createSettlementBatch(ctx context.Context, dbSvc DynamoDBAPI, period string) (*SettlementBatch, error) {
+	obligations, err := GetObligations(ctx, dbSvc, period)
+	if err != nil {
+		return nil, err
+	}
+	batch := &SettlementBatch{
+		Period:    period,
+		Status:    SettlementRunning,
+		Net:       map[string]float64{},
+		Settled:   map[string]string{},
+		CreatedAt: clockOf(dbSvc).Now().Unix(),
+	}
+	for _, o := range obligations {
+		batch.Net[o.TenantA] = roundAmount(batch.Net[o.TenantA] - o.Amount)
+		batch.Net[o.TenantB] = roundAmount(batch.Net[o.TenantB] + o.Amount)
+	}
+	batch.Positions = settlementPositions(batch.Net)
+
+	item, err := attributevalue.MarshalMap(batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal settlement batch: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(SettlementBatchesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Period)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return GetSettlementBatch(ctx, dbSvc, period)
+		}
+		return nil, fmt.Errorf("failed to create settlement batch: %v", err)
+	}
+	return batch, nil
+}
+
+// settlementPositions pairs the tenants that owe with those that are owed,
+// largest first, until every net position is cleared.
+func settlementPositions(net map[string]float64) []SettlementPosition {
+	type balance struct {
+		tenant string
+		amount float64
+	}
+	var payers, payees []balance
+	for tenant, amount := range net {
+		switch {
+		case amount < 0:
+			payers = append(payers, balance{tenant, -amount})
+		case amount > 0:
+			payees = append(payees, balance{tenant, amount})
+		}
+	}
+	byAmount := func(b []balance) {
+		sort.Slice(b, func(i, j int) bool {
+			if b[i].amount != b[j].amount {
+				return b[i].amount > b[j].amount
+			}
+			return b[i].tenant < b[j].tenant
+		})
+	}
+	byAmount(payers)
+	byAmount(payees)
+
+	var positions []SettlementPosition
+	for i, j := 0, 0; i < len(payers) && j < len(payees); {
+		amount := roundAmount(math.Min(payers[i].amount, payees[j].amount))
+		if amount > 0 {
+			positions = append(positions, SettlementPosition{Payer: payers[i].tenant, Payee: payees[j].tenant, Amount: amount})
+		}
+		payers[i].amount = roundAmount(payers[i].amount - amount)
+		payees[j].amount = roundAmount(payees[j].amount - amount)
+		if payers[i].amount <= 0 {
+			i++
+		}
+		if payees[j].amount <= 0 {
+			j++
+		}
+	}
+	return positions
+}
+
+// settlePosition pays a position between the settlement accounts of its
+// tenants and records it on the batch, in one transaction that fails if the
+// position was already paid. The payment is a journal in each tenant: a
+// debit of the payer's account and a credit of the payee's, guarded by
+// their versions and linked to their hash chains like any other transfer.
+// Settlement accounts can go negative: they mirror what the tenants hold at
+// the settlement bank.
+func settlePosition(ctx context.Context, dbSvc DynamoDBAPI, period string, position SettlementPosition) (string, error) {
+	accounts := map[string]string{}
+	for _, tenant := range []string{position.Payer, position.Payee} {
+		cfg, err := GetTenantConfig(ctx, dbSvc, tenant)
+		if err != nil {
+			return "", err
+		}
+		if cfg.SettlementAccount == "" {
+			return "", fmt.Errorf("tenant %s has no settlement account", tenant)
+		}
+		accounts[tenant] = cfg.SettlementAccount
+	}
+
+	transactionId := newID(dbSvc)
+	timestamp := clockOf(dbSvc).Now().Unix()
+	record := &types.Update{
+		TableName: aws.String(SettlementBatchesTable),
+		Key: map[string]types.AttributeValue{
+			"Period": &types.AttributeValueMemberS{Value: period},
+		},
+		UpdateExpression:    aws.String("SET Settled.#position = :tx"),
+		ConditionExpression: aws.String("attribute_not_exists(Settled.#position)"),
+		ExpressionAttributeNames: map[string]string{
+			"#position": position.key(),
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tx": &types.AttributeValueMemberS{Value: transactionId},
+		},
+	}
+	retry := conflictRetryOf(dbSvc)
+	for attempt := 1; ; attempt++ {
+		items := []types.TransactWriteItem{{Update: record}}
+		for _, leg := range []struct {
+			tenant, kind string
+		}{
+			{position.Payer, LegDebit},
+			{position.Payee, LegCredit},
+		} {
+			account, err := fetchAccount(ctx, dbSvc, leg.tenant, accounts[leg.tenant], true)
+			if err != nil {
+				return "", fmt.Errorf("failed to get settlement account of %s: %v", leg.tenant, err)
+			}
+			journalLeg := JournalLeg{AccountID: account.AccountID, Type: leg.kind, Amount: position.Amount}
+			journalLeg.Overdraft = leg.kind == LegDebit && roundAmount(account.Amount-position.Amount) < 0
+			journal, err := journalItems(leg.tenant, transactionId, "", account.AccountID, []JournalLeg{journalLeg}, nil,
+				map[string]*User{account.AccountID: account}, timestamp, nextVersion(dbSvc))
+			if err != nil {
+				return "", err
+			}
+			items = append(items, journal...)
+		}
+
+		_, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			invalidateReplica(ctx, dbSvc, position.Payer, []JournalLeg{{AccountID: accounts[position.Payer]}})
+			invalidateReplica(ctx, dbSvc, position.Payee, []JournalLeg{{AccountID: accounts[position.Payee]}})
+			return transactionId, nil
+		}
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return "", fmt.Errorf("failed to settle %s: %v", position.key(), err)
+		}
+		// The batch's record comes first: it failing means the position was
+		// paid already, and an account failing that it moved since it was
+		// read.
+		if attempt >= retry.MaxAttempts || !chainConflict(err) {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(retry.Delay(attempt - 1)):
+		}
+	}
+}
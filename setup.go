@@ -0,0 +1,208 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// tableActiveTimeout bounds how long EnsureTables waits for a new table to
+// become active.
+const tableActiveTimeout = 2 * time.Minute
+
+// clientConfig is how NewLedgerFromConfig builds its DynamoDB client.
+type clientConfig struct {
+	endpoint    string
+	region      string
+	credentials aws.CredentialsProvider
+}
+
+// WithEndpoint sends requests to endpoint, such as http://localhost:8000 for
+// DynamoDB Local or http://localhost:4566 for LocalStack. It only applies to
+// NewLedgerFromConfig.
+func WithEndpoint(endpoint string) Option {
+	return func(l *Ledger) {
+		l.client.endpoint = endpoint
+	}
+}
+
+// WithRegion sets the AWS region. It only applies to NewLedgerFromConfig.
+func WithRegion(region string) Option {
+	return func(l *Ledger) {
+		l.client.region = region
+	}
+}
+
+// WithCredentials sets static AWS credentials in place of the default
+// credential chain. It only applies to NewLedgerFromConfig.
+func WithCredentials(accessKey, secretKey string) Option {
+	return func(l *Ledger) {
+		l.client.credentials = credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")
+	}
+}
+
+// NewLedgerFromConfig creates the DynamoDB client as well as the Ledger. The
+// client is configured from the environment as by the AWS SDK, overridden by
+// WithEndpoint, WithRegion and WithCredentials; the region defaults to
+// AWS_REGION when the environment sets none. To run against DynamoDB Local:
+//
+//	l, err := ledger.NewLedgerFromConfig(ctx,
+//		ledger.WithEndpoint("http://localhost:8000"),
+//		ledger.WithCredentials("local", "local"),
+//		ledger.WithTablePrefix("dev_"),
+//	)
+//	if err == nil {
+//		err = l.EnsureTables(ctx)
+//	}
+func NewLedgerFromConfig(ctx context.Context, opts ...Option) (*Ledger, error) {
+	l := NewLedger(nil, opts...)
+	var loadOpts []func(*config.LoadOptions) error
+	if l.client.region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(l.client.region))
+	}
+	if l.client.credentials != nil {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(l.client.credentials))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %v", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = AWS_REGION
+	}
+	l.db = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if l.client.endpoint != "" {
+			o.BaseEndpoint = aws.String(l.client.endpoint)
+		}
+	})
+	return l, nil
+}
+
+// TableCreator is implemented by clients that can create tables, such as
+// *dynamodb.Client. EnsureTables needs the client a Ledger wraps to
+// implement it.
+type TableCreator interface {
+	TableDescriber
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+var _ TableCreator = (*dynamodb.Client)(nil)
+
+// EnsureTables creates the tables the ledger uses that do not exist yet,
+// with their indexes and TTL, billed per request, and waits for them to be
+// active. It is meant for development and tests against DynamoDB Local or
+// LocalStack; production tables are provisioned with the infrastructure.
+// Existing tables are left as they are: Validate reports whether they are
+// usable.
+func (l *Ledger) EnsureTables(ctx context.Context) error {
+	creator, ok := l.db.(TableCreator)
+	if !ok {
+		return errors.New("the dynamodb client cannot create tables")
+	}
+	var errs []error
+	for _, spec := range TableSpecs() {
+		if err := l.ensureTable(ctx, creator, spec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Ledger) ensureTable(ctx context.Context, creator TableCreator, spec TableSpec) error {
+	name := l.tableName(aws.String(spec.Name))
+	_, err := creator.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: name})
+	var notFound *types.ResourceNotFoundException
+	if err == nil {
+		return nil
+	}
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to describe table %s: %v", *name, err)
+	}
+
+	if _, err := creator.CreateTable(ctx, createTableInput(*name, spec)); err != nil {
+		return fmt.Errorf("failed to create table %s: %v", *name, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(creator)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: name}, tableActiveTimeout); err != nil {
+		return fmt.Errorf("table %s did not become active: %v", *name, err)
+	}
+	if spec.TTL != "" {
+		_, err := creator.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: name,
+			TimeToLiveSpecification: &types.TimeToLiveSpecification{
+				AttributeName: aws.String(spec.TTL),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable TTL on table %s: %v", *name, err)
+		}
+	}
+	l.logger.InfoContext(ctx, "created table", "table", *name, "indexes", len(spec.Indexes))
+	return nil
+}
+
+// numericKeys are the key attributes stored as numbers; the others are
+// strings.
+var numericKeys = map[string]bool{
+	"TransactionDate":   true,
+	"TransactionStatus": true,
+	"ReleaseAt":         true,
+	"NextRunAt":         true,
+	"ActivateAt":        true,
+	"CreatedAt":         true,
+	"ExpiresAt":         true,
+}
+
+// NumericKey reports whether a key attribute is stored as a number.
+func NumericKey(attr string) bool {
+	return numericKeys[attr]
+}
+
+func createTableInput(name string, spec TableSpec) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String(name),
+		KeySchema:   keySchemaElements(spec.HashKey, spec.RangeKey),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	defined := map[string]bool{}
+	define := func(attrs ...string) {
+		for _, attr := range attrs {
+			if attr == "" || defined[attr] {
+				continue
+			}
+			defined[attr] = true
+			attrType := types.ScalarAttributeTypeS
+			if NumericKey(attr) {
+				attrType = types.ScalarAttributeTypeN
+			}
+			input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(attr), AttributeType: attrType})
+		}
+	}
+	define(spec.HashKey, spec.RangeKey)
+	for _, index := range spec.Indexes {
+		define(index.HashKey, index.RangeKey)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(index.Name),
+			KeySchema:  keySchemaElements(index.HashKey, index.RangeKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	return input
+}
+
+func keySchemaElements(hash, rng string) []types.KeySchemaElement {
+	elements := []types.KeySchemaElement{{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash}}
+	if rng != "" {
+		elements = append(elements, types.KeySchemaElement{AttributeName: aws.String(rng), KeyType: types.KeyTypeRange})
+	}
+	return elements
+}
@@ -0,0 +1,45 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCreateTableInput(t *testing.T) {
+	input := createTableInput("dev_EscrowTransactions", TableSpec{Name: EscrowTransactionsTable, HashKey: "UUID", RangeKey: "TransactionID", Indexes: []IndexSpec{
+		{"StatusTransactionDateIndex", "TransactionStatus", "TransactionDate"},
+	}})
+	want := map[string]types.ScalarAttributeType{
+		"UUID":              types.ScalarAttributeTypeS,
+		"TransactionID":     types.ScalarAttributeTypeS,
+		"TransactionStatus": types.ScalarAttributeTypeN,
+		"TransactionDate":   types.ScalarAttributeTypeN,
+	}
+	if len(input.AttributeDefinitions) != len(want) {
+		t.Fatalf("AttributeDefinitions = %+v", input.AttributeDefinitions)
+	}
+	for _, def := range input.AttributeDefinitions {
+		if want[aws.ToString(def.AttributeName)] != def.AttributeType {
+			t.Errorf("%s is defined as %s", aws.ToString(def.AttributeName), def.AttributeType)
+		}
+	}
+	if aws.ToString(input.TableName) != "dev_EscrowTransactions" || len(input.GlobalSecondaryIndexes) != 1 || input.BillingMode != types.BillingModePayPerRequest {
+		t.Errorf("createTableInput() = %+v", input)
+	}
+}
+
+func TestTablePrefix(t *testing.T) {
+	l := NewLedger(nil, WithTablePrefix("dev_"))
+	if got := aws.ToString(l.tableName(aws.String(NilUsers))); got != "dev_NilUsers" {
+		t.Errorf("tableName() = %q", got)
+	}
+	byTable := map[string]int{NilUsers: 1, LedgerTable: 2}
+	if got := unprefixKeys("dev_", prefixKeys("dev_", byTable)); len(got) != 2 || got[NilUsers] != 1 || got[LedgerTable] != 2 {
+		t.Errorf("unprefixKeys(prefixKeys()) = %v", got)
+	}
+	if got := aws.ToString(NewLedger(nil).tableName(aws.String(NilUsers))); got != NilUsers {
+		t.Errorf("tableName() without a prefix = %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+package ledger
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TenantKeysTable holds the public keys tenants sign transfers with, keyed by
+// TenantID and KeyID.
+var TenantKeysTable = "TenantKeys"
+
+// CredentialsTable holds the API keys of tenants, keyed by KeyID, and
+// CredentialsTenantIndex lists them by TenantID; see package auth.
+var CredentialsTable = "Credentials"
+
+const CredentialsTenantIndex = "TenantIndex"
+
+// Signature algorithms of tenant keys. RSA signatures are PKCS #1 v1.5 over
+// the SHA-256 of the payload; Ed25519 signatures are over the payload itself.
+const (
+	KeyAlgorithmEd25519 = "ed25519"
+	KeyAlgorithmRSA     = "rsa"
+)
+
+// ErrSignatureInvalid is returned for a transfer whose SignedUUID is not a
+// valid signature of its InitiatorUUID by one of the tenant's keys.
+var ErrSignatureInvalid = errors.New("signature_invalid")
+
+// TenantKey is a public key a tenant signs transfers with. A tenant may have
+// several, e.g. while rotating keys.
+type TenantKey struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id"`
+	KeyID     string `dynamodbav:"KeyID" json:"key_id"`
+	Algorithm string `dynamodbav:"Algorithm" json:"algorithm"`
+	// PublicKey is PEM encoded.
+	PublicKey string `dynamodbav:"PublicKey" json:"public_key"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+}
+
+// parsePublicKey parses a PEM encoded Ed25519 or RSA public key, as PKIX
+// ("PUBLIC KEY") or, for RSA, PKCS #1 ("RSA PUBLIC KEY").
+func parsePublicKey(pemKey string) (crypto.PublicKey, string, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, "", errors.New("failed to parse PEM block containing the public key")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse public key: %v", err)
+		}
+		return key, KeyAlgorithmRSA, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse public key: %v", err)
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, KeyAlgorithmEd25519, nil
+	case *rsa.PublicKey:
+		return key, KeyAlgorithmRSA, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verifySignature checks a base64 signature of payload.
+func verifySignature(key crypto.PublicKey, payload, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, []byte(payload), sig)
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256([]byte(payload))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig) == nil
+	default:
+		return false
+	}
+}
+
+// RegisterTenantPublicKey stores a PEM encoded Ed25519 or RSA public key for
+// verifying a tenant's transfers, replacing any key with the same ID. Once a
+// tenant has a key, every transfer of the tenant must be signed. Tenants
+// under DualControl register keys with ProposeConfigChange instead.
+func RegisterTenantPublicKey(ctx context.Context, dbSvc DynamoDBAPI, tenantId, keyId, pemKey string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if keyId == "" {
+		return errors.New("key id is required")
+	}
+	if err := checkKeyDualControl(ctx, dbSvc, tenantId); err != nil {
+		return err
+	}
+	item, err := tenantKeyItem(tenantId, keyId, pemKey)
+	if err != nil {
+		return err
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TenantKeysTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store tenant key: %v", err)
+	}
+	return nil
+}
+
+// RevokeTenantPublicKey removes a tenant's key. Transfers signed with it
+// are rejected from then on. Tenants under DualControl revoke keys with
+// ProposeConfigChange instead.
+func RevokeTenantPublicKey(ctx context.Context, dbSvc DynamoDBAPI, tenantId, keyId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if err := checkKeyDualControl(ctx, dbSvc, tenantId); err != nil {
+		return err
+	}
+	_, err := dbSvc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TenantKeysTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"KeyID":    &types.AttributeValueMemberS{Value: keyId},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke tenant key: %v", err)
+	}
+	return nil
+}
+
+// tenantKeyItem builds the stored item of a tenant key.
+func tenantKeyItem(tenantId, keyId, pemKey string) (map[string]types.AttributeValue, error) {
+	_, algorithm, err := parsePublicKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	item, err := attributevalue.MarshalMap(TenantKey{
+		TenantID:  tenantId,
+		KeyID:     keyId,
+		Algorithm: algorithm,
+		PublicKey: pemKey,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tenant key: %v", err)
+	}
+	return item, nil
+}
+
+// checkKeyDualControl returns ErrDualControl if the tenant's keys may only
+// be changed through ProposeConfigChange.
+func checkKeyDualControl(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) error {
+	cfg, err := GetTenantConfig(ctx, dbSvc, tenantId)
+	if err != nil {
+		return err
+	}
+	if cfg.DualControl {
+		return fmt.Errorf("%w: keys of tenant %s must be changed with ProposeConfigChange", ErrDualControl, tenantId)
+	}
+	return nil
+}
+
+// GetTenantPublicKeys returns the keys registered for a tenant.
+func GetTenantPublicKeys(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) ([]TenantKey, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TenantKeysTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tenant keys: %v", err)
+	}
+	var keys []TenantKey
+	if err := attributevalue.UnmarshalListOfMaps(resp.Items, &keys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant keys: %v", err)
+	}
+	return keys, nil
+}
+
+// VerifyTransferSignature checks that the SignedUUID of a transfer is the
+// base64 signature of its InitiatorUUID by one of the tenant's keys. Tenants
+// without registered keys are not checked. It returns ErrSignatureInvalid
+// when the signature is missing or does not verify.
+func VerifyTransferSignature(ctx context.Context, dbSvc DynamoDBAPI, trEntry TransactionEntry) error {
+	keys, err := GetTenantPublicKeys(ctx, dbSvc, trEntry.TenantID)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if trEntry.InitiatorUUID == "" || trEntry.SignedUUID == "" {
+		return fmt.Errorf("%w: transfer is not signed", ErrSignatureInvalid)
+	}
+	for _, k := range keys {
+		key, _, err := parsePublicKey(k.PublicKey)
+		if err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "unusable tenant key", "tenant", k.TenantID, "key", k.KeyID, "error", err)
+			continue
+		}
+		if verifySignature(key, trEntry.InitiatorUUID, trEntry.SignedUUID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no key of tenant %s verifies the signature", ErrSignatureInvalid, trEntry.TenantID)
+}
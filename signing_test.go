@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+)
+
+func TestParsePublicKeyAndVerify(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix := func(key any) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaPriv.PublicKey)}))
+
+	payload := "4f7c2a"
+	edSig := base64.StdEncoding.EncodeToString(ed25519.Sign(edPriv, []byte(payload)))
+	hashed := sha256.Sum256([]byte(payload))
+	rsaRaw, err := rsa.SignPKCS1v15(rand.Reader, rsaPriv, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig := base64.StdEncoding.EncodeToString(rsaRaw)
+
+	tests := []struct {
+		name      string
+		pem       string
+		algorithm string
+		signature string
+		want      bool
+	}{
+		{"ed25519", pkix(edPub), KeyAlgorithmEd25519, edSig, true},
+		{"rsa pkix", pkix(&rsaPriv.PublicKey), KeyAlgorithmRSA, rsaSig, true},
+		{"rsa pkcs1", pkcs1, KeyAlgorithmRSA, rsaSig, true},
+		{"wrong algorithm", pkix(edPub), KeyAlgorithmEd25519, rsaSig, false},
+		{"not base64", pkcs1, KeyAlgorithmRSA, "%%%", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, algorithm, err := parsePublicKey(tt.pem)
+			if err != nil {
+				t.Fatalf("parsePublicKey() error = %v", err)
+			}
+			if algorithm != tt.algorithm {
+				t.Errorf("algorithm = %q, want %q", algorithm, tt.algorithm)
+			}
+			if got := verifySignature(key, payload, tt.signature); got != tt.want {
+				t.Errorf("verifySignature() = %v, want %v", got, tt.want)
+			}
+			if tt.want && verifySignature(key, payload+"0", tt.signature) {
+				t.Error("signature verifies a different payload")
+			}
+		})
+	}
+
+	if _, _, err := parsePublicKey("not a key"); err == nil {
+		t.Error("parsePublicKey(garbage) succeeded")
+	}
+}
@@ -0,0 +1,90 @@
+package ledger
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SlowQueryPolicy decides which DynamoDB calls are logged as slow.
+type SlowQueryPolicy struct {
+	// Latency logs calls taking longer; zero disables the check.
+	Latency time.Duration
+	// CapacityUnits logs calls consuming more read or write capacity units.
+	// Setting it makes every call request its consumed capacity; zero
+	// disables the check.
+	CapacityUnits float64
+}
+
+// WithSlowQueryLog logs DynamoDB calls exceeding the policy at warn level,
+// with their table, index, key condition and filter. Expressions are logged
+// with attribute names resolved and values left as placeholders, and keys by
+// attribute name only, so no customer data reaches the logs.
+func WithSlowQueryLog(policy SlowQueryPolicy) Option {
+	return func(l *Ledger) {
+		l.slowQueries = &policy
+	}
+}
+
+// wantsCapacity reports whether calls should request their consumed
+// capacity.
+func (l *Ledger) wantsCapacity() bool {
+	return l.capacityMetrics || (l.slowQueries != nil && l.slowQueries.CapacityUnits > 0)
+}
+
+// slow reports whether a call exceeded the slow query policy.
+func (l *Ledger) slow(latency time.Duration, units float64) bool {
+	p := l.slowQueries
+	if p == nil {
+		return false
+	}
+	return (p.Latency > 0 && latency > p.Latency) || (p.CapacityUnits > 0 && units > p.CapacityUnits)
+}
+
+// capacityUnits adds up the capacity units consumed by a call.
+func capacityUnits(capacity ...*types.ConsumedCapacity) float64 {
+	var units float64
+	for _, c := range capacity {
+		if c != nil {
+			units += aws.ToFloat64(c.CapacityUnits)
+		}
+	}
+	return units
+}
+
+// capacityOf returns pointers to the elements of capacity, for
+// capacityUnits.
+func capacityOf(capacity []types.ConsumedCapacity) []*types.ConsumedCapacity {
+	out := make([]*types.ConsumedCapacity, len(capacity))
+	for i := range capacity {
+		out[i] = &capacity[i]
+	}
+	return out
+}
+
+var attributeNamePlaceholder = regexp.MustCompile(`#[A-Za-z0-9_]+`)
+
+// logExpression returns expr with attribute name placeholders resolved.
+// Value placeholders are kept, so the values stay out of the logs.
+func logExpression(expr *string, names map[string]string) string {
+	return attributeNamePlaceholder.ReplaceAllStringFunc(aws.ToString(expr), func(placeholder string) string {
+		if name, ok := names[placeholder]; ok {
+			return name
+		}
+		return placeholder
+	})
+}
+
+// logKey returns the attribute names of a key, with its values redacted.
+func logKey(key map[string]types.AttributeValue) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name+" = ?")
+	}
+	sort.Strings(names)
+	return strings.Join(names, " AND ")
+}
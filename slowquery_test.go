@@ -0,0 +1,44 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestSlowQueryRedaction(t *testing.T) {
+	names := map[string]string{"#tenant": "TenantID", "#search": "NarrativeSearch"}
+	got := logExpression(aws.String("#tenant = :tenant AND contains(#search, :search) AND #other > :min"), names)
+	if want := "TenantID = :tenant AND contains(NarrativeSearch, :search) AND #other > :min"; got != want {
+		t.Errorf("logExpression() = %q, want %q", got, want)
+	}
+	if got := logExpression(nil, names); got != "" {
+		t.Errorf("logExpression(nil) = %q", got)
+	}
+	key := map[string]types.AttributeValue{
+		"TenantID":  &types.AttributeValueMemberS{Value: "nil"},
+		"AccountID": &types.AttributeValueMemberS{Value: "0912345678"},
+	}
+	if got, want := logKey(key), "AccountID = ? AND TenantID = ?"; got != want {
+		t.Errorf("logKey() = %q, want %q", got, want)
+	}
+}
+
+func TestSlowQueryPolicy(t *testing.T) {
+	l := NewLedger(nil, WithSlowQueryLog(SlowQueryPolicy{Latency: time.Second}))
+	if l.wantsCapacity() || l.slow(time.Millisecond, 100) || !l.slow(2*time.Second, 0) {
+		t.Error("latency only policy")
+	}
+	l = NewLedger(nil, WithSlowQueryLog(SlowQueryPolicy{CapacityUnits: 5}))
+	if !l.wantsCapacity() || l.slow(time.Hour, 5) || !l.slow(0, 5.5) {
+		t.Error("capacity only policy")
+	}
+	if NewLedger(nil).slow(time.Hour, 1000) {
+		t.Error("slow call logged without a policy")
+	}
+	if got := capacityUnits(capacityOf([]types.ConsumedCapacity{{CapacityUnits: aws.Float64(1.5)}, {}})...) + capacityUnits(nil); got != 1.5 {
+		t.Errorf("capacityUnits() = %v", got)
+	}
+}
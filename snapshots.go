@@ -0,0 +1,394 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SnapshotsTable holds the closing balance of every account for every closed
+// accounting day, keyed by AccountKey (tenant and account) and Day.
+var SnapshotsTable = "AccountSnapshots"
+
+// snapshotDayLayout formats the Day of snapshots; it sorts by date.
+const snapshotDayLayout = "2006-01-02"
+
+// maxSnapshotAttempts bounds how often an account busy with transfers is
+// re-read while its closing balance is taken.
+const maxSnapshotAttempts = 3
+
+// AccountSnapshot is the balance of an account when an accounting day closed.
+// Days are UTC.
+type AccountSnapshot struct {
+	AccountKey string  `dynamodbav:"AccountKey" json:"-"`
+	Day        string  `dynamodbav:"Day" json:"day"`
+	TenantID   string  `dynamodbav:"TenantID" json:"tenant_id"`
+	AccountID  string  `dynamodbav:"AccountID" json:"account_id"`
+	Balance    float64 `dynamodbav:"Balance" json:"balance"`
+	// ClosedAt is the unix time the day ended at.
+	ClosedAt int64 `dynamodbav:"ClosedAt" json:"closed_at"`
+}
+
+// dayEnd returns when the UTC day of t ends.
+func dayEnd(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// CloseAccountingDay writes the closing balance of every account of a tenant
+// for the UTC day of day, and returns how many snapshots it wrote. It is run
+// by a job shortly after midnight; the balances are rewound from the current
+// ones, so a late run is still exact. Accounts already snapshotted for the
+// day are skipped, so reruns are harmless.
+func CloseAccountingDay(ctx context.Context, dbSvc DynamoDBAPI, tenantId string, day time.Time) (int, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	end := dayEnd(day)
+	if end.After(time.Now()) {
+		return 0, errors.New("the accounting day has not ended yet")
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenantId"),
+		ProjectionExpression:   aws.String("AccountID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantId": &types.AttributeValueMemberS{Value: tenantId},
+		},
+	}
+	written := 0
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return written, fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []struct {
+			AccountID string `dynamodbav:"AccountID"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return written, fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for _, account := range page {
+			ok, err := closeAccountDay(ctx, dbSvc, tenantId, account.AccountID, end)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("account %s: %w", account.AccountID, err))
+			} else if ok {
+				written++
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return written, errors.Join(errs...)
+}
+
+// closeAccountDay writes the snapshot of an account for the day ending at
+// end, reporting false when it already exists.
+func closeAccountDay(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, end time.Time) (bool, error) {
+	balance, err := balanceAt(ctx, dbSvc, tenantId, accountId, end)
+	if err != nil {
+		return false, err
+	}
+	item, err := attributevalue.MarshalMap(AccountSnapshot{
+		AccountKey: eventStreamID(tenantId, accountId),
+		Day:        end.Add(-time.Second).Format(snapshotDayLayout),
+		TenantID:   tenantId,
+		AccountID:  accountId,
+		Balance:    roundAmount(balance),
+		ClosedAt:   end.Unix(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal snapshot: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(SnapshotsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(AccountKey)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to store snapshot: %v", err)
+	}
+	return true, nil
+}
+
+// balanceAt rewinds the current balance of an account over the transactions
+// since t.
+func balanceAt(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, t time.Time) (float64, error) {
+	account, transactions, err := accountSince(ctx, dbSvc, tenantId, accountId, t.Unix())
+	if err != nil {
+		return 0, err
+	}
+	balance := account.Amount
+	for _, tx := range transactions {
+		balance -= tx.NetAmount(accountId)
+	}
+	return balance, nil
+}
+
+// accountSince returns an account and its successful transactions since the
+// given unix time. The account is read again afterwards, and the whole read
+// retried if a transfer moved it in between, so the two agree.
+func accountSince(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, since int64) (*User, []TransactionEntry, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := readAccount(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return nil, nil, err
+		}
+		transactions, err := getAccountTransactionsSince(ctx, dbSvc, tenantId, accountId, since)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := readAccount(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if before.Version == after.Version {
+			return after, transactions, nil
+		}
+		if attempt == maxSnapshotAttempts {
+			return nil, nil, errors.New("account kept changing while its balance was read")
+		}
+	}
+}
+
+// readAccount returns an account, read consistently.
+func readAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*User, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"AccountID": &types.AttributeValueMemberS{Value: accountId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %v", err)
+	}
+	if result.Item == nil {
+		return nil, errors.New("account not found")
+	}
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account: %v", err)
+	}
+	return &user, nil
+}
+
+// GetSnapshot returns the latest snapshot of an account taken at or before
+// t, or nil when there is none.
+func GetSnapshot(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, t time.Time) (*AccountSnapshot, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	// The snapshot of a day is taken at its end, i.e. at the start of the
+	// next day.
+	latestDay := t.UTC().Add(-24 * time.Hour).Format(snapshotDayLayout)
+	resp, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(SnapshotsTable),
+		KeyConditionExpression: aws.String("AccountKey = :key AND #day <= :day"),
+		ExpressionAttributeNames: map[string]string{
+			"#day": "Day",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key": &types.AttributeValueMemberS{Value: eventStreamID(tenantId, accountId)},
+			":day": &types.AttributeValueMemberS{Value: latestDay},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots: %v", err)
+	}
+	if len(resp.Items) == 0 {
+		return nil, nil
+	}
+	var snapshot AccountSnapshot
+	if err := attributevalue.UnmarshalMap(resp.Items[0], &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// GetBalanceAt returns the balance of an account as of at, for disputes and
+// regulatory inquiries. It starts from the latest snapshot taken at or
+// before at and replays the account's ledger entries since; accounts without
+// a snapshot are rewound from their current balance over the entries after
+// at instead. Entries posted within the second of at are included.
+func GetBalanceAt(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, at time.Time) (float64, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	snapshot, err := GetSnapshot(ctx, dbSvc, tenantId, accountId, at)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot != nil {
+		entries, err := accountLedgerEntries(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return 0, err
+		}
+		balance := snapshot.Balance
+		for _, entry := range entries {
+			if entry.Time >= snapshot.ClosedAt && entry.Time <= at.Unix() {
+				balance += entry.balanceDelta()
+			}
+		}
+		return roundAmount(balance), nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		before, err := readAccount(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return 0, err
+		}
+		entries, err := accountLedgerEntries(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return 0, err
+		}
+		after, err := readAccount(ctx, dbSvc, tenantId, accountId)
+		if err != nil {
+			return 0, err
+		}
+		if before.Version == after.Version {
+			balance := after.Amount
+			for _, entry := range entries {
+				if entry.Time > at.Unix() {
+					balance -= entry.balanceDelta()
+				}
+			}
+			return roundAmount(balance), nil
+		}
+		if attempt == maxSnapshotAttempts {
+			return 0, errors.New("account kept changing while its balance was read")
+		}
+	}
+}
+
+// Statement lists the successful transactions of an account over a period,
+// oldest first, with its balance before and after them.
+type Statement struct {
+	TenantID       string             `json:"tenant_id"`
+	AccountID      string             `json:"account_id"`
+	From           int64              `json:"from"`
+	To             int64              `json:"to"`
+	OpeningBalance float64            `json:"opening_balance"`
+	ClosingBalance float64            `json:"closing_balance"`
+	Transactions   []TransactionEntry `json:"transactions"`
+}
+
+// GetStatement returns the statement of an account from from up to, but
+// excluding, to. The opening balance starts from the nearest snapshot before
+// from, so only the transactions since that snapshot are read; accounts
+// without one are rewound from their current balance instead.
+func GetStatement(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string, from, to time.Time) (*Statement, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if !from.Before(to) {
+		return nil, errors.New("from must be before to")
+	}
+	snapshot, err := GetSnapshot(ctx, dbSvc, tenantId, accountId, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var opening float64
+	var transactions []TransactionEntry
+	if snapshot != nil {
+		opening = snapshot.Balance
+		if transactions, err = getAccountTransactionsSince(ctx, dbSvc, tenantId, accountId, snapshot.ClosedAt); err != nil {
+			return nil, err
+		}
+	} else {
+		if transactions, err = getAccountTransactionsSince(ctx, dbSvc, tenantId, accountId, from.Unix()); err != nil {
+			return nil, err
+		}
+		if opening, err = InquireBalance(ctx, dbSvc, tenantId, accountId); err != nil {
+			return nil, err
+		}
+		for _, tx := range transactions {
+			opening -= tx.NetAmount(accountId)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].TransactionDate < transactions[j].TransactionDate
+	})
+
+	statement := &Statement{TenantID: tenantId, AccountID: accountId, From: from.Unix(), To: to.Unix()}
+	for _, tx := range transactions {
+		switch {
+		case tx.TransactionDate < from.Unix():
+			// Between the snapshot and the period.
+			opening += tx.NetAmount(accountId)
+		case tx.TransactionDate < to.Unix():
+			statement.Transactions = append(statement.Transactions, tx)
+		}
+	}
+	statement.OpeningBalance = roundAmount(opening)
+	closing := opening
+	for _, tx := range statement.Transactions {
+		closing += tx.NetAmount(accountId)
+	}
+	statement.ClosingBalance = roundAmount(closing)
+	return statement, nil
+}
+
+// Reconciliation compares the balance of an account with its latest
+// snapshot plus the transactions since.
+type Reconciliation struct {
+	TenantID  string `json:"tenant_id"`
+	AccountID string `json:"account_id"`
+	// SnapshotDay is empty when the account has no snapshot, in which case
+	// the transactions are replayed from zero; an account funded when it was
+	// created then shows its initial balance as the difference.
+	SnapshotDay string  `json:"snapshot_day,omitempty"`
+	Expected    float64 `json:"expected"`
+	Actual      float64 `json:"actual"`
+	Difference  float64 `json:"difference"`
+}
+
+// Balanced reports whether the account matches its transactions.
+func (r *Reconciliation) Balanced() bool {
+	return r.Difference == 0
+}
+
+// Reconcile checks the balance of an account against its latest snapshot
+// and the transactions posted since, so only those are read.
+func Reconcile(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*Reconciliation, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	snapshot, err := GetSnapshot(ctx, dbSvc, tenantId, accountId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r := &Reconciliation{TenantID: tenantId, AccountID: accountId}
+	var since int64
+	if snapshot != nil {
+		r.SnapshotDay, r.Expected, since = snapshot.Day, snapshot.Balance, snapshot.ClosedAt
+	}
+	account, transactions, err := accountSince(ctx, dbSvc, tenantId, accountId, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range transactions {
+		r.Expected += tx.NetAmount(accountId)
+	}
+	r.Expected = roundAmount(r.Expected)
+	r.Actual = account.Amount
+	r.Difference = roundAmount(r.Actual - r.Expected)
+	return r, nil
+}
@@ -0,0 +1,21 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayEnd(t *testing.T) {
+	want := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	tests := []time.Time{
+		time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC),
+		// 01:30 in Khartoum is still May 1 in UTC.
+		time.Date(2024, 5, 2, 1, 30, 0, 0, time.FixedZone("CAT", 2*60*60)),
+	}
+	for _, day := range tests {
+		if got := dayEnd(day); !got.Equal(want) {
+			t.Errorf("dayEnd(%v) = %v, want %v", day, got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/adonese/ledger/validation"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxSplitRecipients is the most receivers a SplitTransfer can credit; it
+// keeps the journal within a single DynamoDB transaction.
+const MaxSplitRecipients = 25
+
+// SplitToAccount is the ToAccount of the transaction record of a
+// SplitTransfer, whose receivers are its credit legs.
+const SplitToAccount = "*split*"
+
+// Split is the share of one receiver of a SplitTransfer.
+type Split struct {
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// SplitTransferRequest is a transfer from one sender to several receivers.
+type SplitTransferRequest struct {
+	TenantID      string  `json:"tenant_id,omitempty"`
+	FromAccount   string  `json:"from_account"`
+	Splits        []Split `json:"splits"`
+	Narrative     string  `json:"narrative,omitempty"`
+	InitiatorUUID string  `json:"uuid,omitempty"`
+	// SignedUUID is the signature of InitiatorUUID, checked as a
+	// transfer's by VerifyTransferSignature.
+	SignedUUID string `json:"signed_uuid,omitempty"`
+}
+
+// SplitTransfer debits the sender once for the total of the splits and
+// credits every receiver, in one journal, e.g. to split a bill or pay out
+// commissions. It is recorded as one transaction whose Legs are the debit
+// followed by a credit per receiver. Splits are not charged fees, but pass
+// the controls of a transfer: each split is screened, and the total is held
+// to the sender's KYC tier, limits and velocity rules.
+//
+// A total above the tenant's ApprovalThreshold or LargeTransferThreshold
+// waits like a transfer for its approvers or its release. The returned
+// entry is then Pending or Held, and its TransactionID is that of the
+// TransferApproval or DelayedTransfer.
+func SplitTransfer(ctx context.Context, dbSvc DynamoDBAPI, req SplitTransferRequest) (*TransactionEntry, error) {
+	return splitTransfer(ctx, dbSvc, req, transferOptions{})
+}
+
+func splitTransfer(ctx context.Context, dbSvc DynamoDBAPI, req SplitTransferRequest, opts transferOptions) (*TransactionEntry, error) {
+	if req.TenantID == "" {
+		req.TenantID = "nil"
+	}
+	err := validation.Collect(
+		validation.TenantID("tenant_id", req.TenantID),
+		validation.AccountID("from_account", req.FromAccount),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Splits) == 0 || len(req.Splits) > MaxSplitRecipients {
+		return nil, fmt.Errorf("a split transfer needs 1 to %d receivers", MaxSplitRecipients)
+	}
+	var total float64
+	seen := map[string]bool{}
+	for _, split := range req.Splits {
+		err := validation.Collect(
+			validation.AccountID("to", split.To),
+			validation.Distinct("to", req.FromAccount, split.To),
+			validation.AmountPrecision("amount", split.Amount, maxPrecision()),
+		)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("split to %s: %w", split.To, err)
+		case seen[split.To]:
+			return nil, fmt.Errorf("receiver %s appears twice", split.To)
+		}
+		seen[split.To] = true
+		total += split.Amount
+	}
+	narrative, err := SanitizeNarrative(req.Narrative)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := GetTenantConfig(ctx, dbSvc, req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.maintenanceError(); err != nil {
+		return nil, err
+	}
+	transfer := TransferRequest{TenantID: req.TenantID, FromAccount: req.FromAccount, ToAccount: SplitToAccount, Narrative: narrative, InitiatorUUID: req.InitiatorUUID, SignedUUID: req.SignedUUID}
+	if err := VerifyTransferSignature(ctx, dbSvc, transfer.Entry()); err != nil {
+		return nil, err
+	}
+
+	sender, err := readAccount(ctx, dbSvc, req.TenantID, req.FromAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", req.FromAccount, err)
+	}
+	if err := checkDormant(sender); err != nil {
+		return nil, err
+	}
+	currency := cfg.accountCurrency(sender)
+	transfer.Amount = RoundAmount(total, currency)
+	accounts := map[string]*User{req.FromAccount: sender}
+	var splits []TransferRequest
+	var credits []credit
+	for _, split := range req.Splits {
+		if err := checkPrecision(split.Amount, currency); err != nil {
+			return nil, fmt.Errorf("split to %s: %w", split.To, err)
+		}
+		receiver, err := readAccount(ctx, dbSvc, req.TenantID, split.To)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read account %s: %v", split.To, err)
+		}
+		if err := cfg.currencyMismatchError(sender, receiver); err != nil {
+			return nil, fmt.Errorf("split to %s: %w", split.To, err)
+		}
+		accounts[split.To] = receiver
+		splits = append(splits, TransferRequest{TenantID: req.TenantID, FromAccount: req.FromAccount, ToAccount: split.To, Amount: split.Amount, Narrative: narrative, InitiatorUUID: req.InitiatorUUID})
+		credits = append(credits, credit{account: receiver, amount: split.Amount})
+	}
+	remaining := RoundAmount(sender.Amount-transfer.Amount, currency)
+	if remaining < cfg.balanceFloor(sender) {
+		return nil, errors.New("insufficient balance")
+	}
+	now := clockOf(dbSvc).Now()
+	err = cfg.checkTransfer(ctx, dbSvc, transferCheck{req: transfer, sender: sender, splits: splits, credits: credits, now: now, opts: opts})
+	if errors.Is(err, ErrApprovalRequired) || errors.Is(err, ErrTransferDelayed) {
+		pend, status := requestApproval, TransactionPending
+		if errors.Is(err, ErrTransferDelayed) {
+			pend, status = holdTransfer, TransactionHeld
+		}
+		response, err := pend(ctx, dbSvc, cfg, transfer, req.Splits)
+		if err != nil {
+			return nil, err
+		}
+		entry := transfer.Entry()
+		entry.SystemTransactionID = response.Data.TransactionID
+		entry.Comment = NarrativeSplitTransfer
+		entry.Currency = currency
+		entry.Status = &status
+		return &entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now.Unix()
+	uid := newID(dbSvc)
+	legs := []JournalLeg{{AccountID: req.FromAccount, Type: LegDebit, Amount: transfer.Amount, Overdraft: remaining < 0}}
+	for _, split := range req.Splits {
+		legs = append(legs, JournalLeg{AccountID: split.To, Type: LegCredit, Amount: split.Amount})
+	}
+	record := newTransactionRecord(transfer, NarrativeSplitTransfer, uid, timestamp)
+	record.Status = TransactionCompleted
+	record.Currency = currency
+	record.JournalID = uid
+	record.Legs = legs
+	av, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction entry: %v", err)
+	}
+	err = postJournal(ctx, dbSvc, req.TenantID, uid, req.InitiatorUUID, sender, legs, nil, accounts, timestamp, types.TransactWriteItem{Put: &types.Put{
+		TableName: aws.String(TransactionsTable),
+		Item:      av,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to post split transfer: %v", err)
+	}
+	for _, split := range req.Splits {
+		notify(ctx, dbSvc, req.TenantID, split.To, fmt.Sprintf("You received %.2f from %s. Transaction ID: %s", split.Amount, req.FromAccount, uid))
+	}
+	entry := record.Entry()
+	return &entry, nil
+}
+
+// executePending executes a transfer, or the split transfer of splits,
+// that waited for its approvers or its release, with opts.
+func executePending(ctx context.Context, dbSvc DynamoDBAPI, entry TransactionEntry, splits []Split, opts transferOptions) (NilResponse, error) {
+	req, err := TransferRequestFromEntry(entry)
+	if err != nil {
+		return NilResponse{}, err
+	}
+	if len(splits) == 0 {
+		return transferCredits(ctx, dbSvc, req, opts)
+	}
+	tx, err := splitTransfer(ctx, dbSvc, SplitTransferRequest{
+		TenantID:      req.TenantID,
+		FromAccount:   req.FromAccount,
+		Splits:        splits,
+		Narrative:     req.Narrative,
+		InitiatorUUID: req.InitiatorUUID,
+		SignedUUID:    req.SignedUUID,
+	}, opts)
+	if err != nil {
+		code := "split_failed"
+		var check *checkError
+		if errors.As(err, &check) {
+			code = check.code
+		}
+		return failedResponse(req, code, "The split transfer failed.", err.Error()), err
+	}
+	return NilResponse{Status: "success", Code: "successful_transaction", Data: data{TransactionID: tx.SystemTransactionID, Amount: tx.Amount, Currency: tx.Currency}}, nil
+}
+
+// receiverOf names the receiver of a pending transfer to its sender: the
+// number of receivers of a split.
+func receiverOf(to string, splits []Split) string {
+	if len(splits) > 0 {
+		return fmt.Sprintf("%d receivers", len(splits))
+	}
+	return to
+}
@@ -0,0 +1,174 @@
+// Package sse streams account events to HTTP clients as server-sent events.
+// It bridges the per-account event streams read by ledger.GetEventsSince to
+// browsers and apps that want balance updates pushed rather than polled.
+//
+// Every event is sent with its EventID as the SSE id, so a client that
+// reconnects resumes where it left off through the Last-Event-ID header
+// (or the cursor query parameter for clients that cannot set headers).
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/adonese/ledger"
+)
+
+// Authenticator resolves the account a request may stream. Returning an
+// error rejects the request with 401 Unauthorized.
+type Authenticator func(r *http.Request) (tenantId, accountId string, err error)
+
+// Defaults used for the zero values of Handler's fields.
+const (
+	DefaultPollInterval = time.Second
+	DefaultHeartbeat    = 15 * time.Second
+	DefaultBatchSize    = 100
+
+	// retryMillis is the reconnection delay suggested to clients.
+	retryMillis = 3000
+)
+
+// Handler serves the event stream of the authenticated account.
+type Handler struct {
+	DB           ledger.DynamoDBAPI
+	Authenticate Authenticator
+
+	// PollInterval is how often the event stream is read while idle.
+	PollInterval time.Duration
+	// Heartbeat is the longest the connection stays silent; a comment line
+	// is sent when no event went out for that long, keeping proxies from
+	// closing it.
+	Heartbeat time.Duration
+	// BatchSize is the most events read per poll.
+	BatchSize int32
+	// Logger logs the failures to read the event stream. When nil, the
+	// logger of DB is used if it is a *ledger.Ledger, and slog's default
+	// logger otherwise.
+	Logger *slog.Logger
+}
+
+func (h *Handler) logger() ledger.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	if l, ok := h.DB.(*ledger.Ledger); ok {
+		return l.Logger()
+	}
+	return slog.Default()
+}
+
+// ServeHTTP streams events until the client disconnects.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if h.Authenticate == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tenantId, accountId, err := h.Authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("cursor")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	flusher.Flush()
+
+	h.stream(r.Context(), w, flusher, tenantId, accountId, cursor)
+}
+
+func (h *Handler) stream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, tenantId, accountId, cursor string) {
+	poll := time.NewTicker(orDefault(h.PollInterval, DefaultPollInterval))
+	defer poll.Stop()
+	heartbeat := orDefault(h.Heartbeat, DefaultHeartbeat)
+	batchSize := h.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	lastWrite := time.Now()
+	for {
+		events, next, err := ledger.GetEventsSince(ctx, h.DB, tenantId, accountId, cursor, batchSize)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, ledger.ErrInvalidCursor):
+			// Retrying would never succeed, so the client has to start over.
+			writeEvent(w, "", "error", map[string]string{"message": err.Error()})
+			flusher.Flush()
+			return
+		case err != nil:
+			h.logger().WarnContext(ctx, "failed to read account events", "tenant", tenantId, "account", accountId, "error", err)
+		case len(events) > 0:
+			for _, event := range events {
+				if err := writeEvent(w, event.EventID, event.Type, event); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+			cursor = next
+			lastWrite = time.Now()
+			// A full batch means more may be waiting.
+			if len(events) == int(batchSize) {
+				continue
+			}
+		}
+
+		if time.Since(lastWrite) >= heartbeat {
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	return err
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
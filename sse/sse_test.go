@@ -0,0 +1,153 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgertest"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, func(amount float64)) {
+	t.Helper()
+	settle := ledger.AccountEventSettleDelay
+	ledger.AccountEventSettleDelay = -time.Second
+	t.Cleanup(func() { ledger.AccountEventSettleDelay = settle })
+
+	ctx := context.Background()
+	db := ledgertest.NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	transfer := func(amount float64) {
+		_, err := ledger.TransferCredits(ctx, db, ledger.TransactionEntry{TenantID: "nil", AccountID: "alice", FromAccount: "alice", ToAccount: "bob", Amount: amount})
+		if err != nil {
+			t.Fatalf("TransferCredits() error = %v", err)
+		}
+	}
+
+	handler := &Handler{
+		DB: db,
+		Authenticate: func(r *http.Request) (string, string, error) {
+			if r.Header.Get("Authorization") != "Bearer bob" {
+				return "", "", errors.New("bad token")
+			}
+			return "nil", "bob", nil
+		},
+		PollInterval: 5 * time.Millisecond,
+		Heartbeat:    20 * time.Millisecond,
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, transfer
+}
+
+// readFields connects to the stream and returns the SSE fields read until
+// want lines starting with prefix were seen.
+func readFields(t *testing.T, url, lastEventID, prefix string, want int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer bob")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var lines []string
+	seen := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for seen < want && scanner.Scan() {
+		line := scanner.Text()
+		lines = append(lines, line)
+		if strings.HasPrefix(line, prefix) {
+			seen++
+		}
+	}
+	if seen < want {
+		t.Fatalf("saw %d %q lines, want %d: %v", seen, prefix, want, lines)
+	}
+	return lines
+}
+
+func TestHandlerStreamsAndResumes(t *testing.T) {
+	server, transfer := newTestServer(t)
+	transfer(10)
+	transfer(20)
+
+	lines := readFields(t, server.URL, "", "data: ", 2)
+	var ids []string
+	for _, line := range lines {
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+		if strings.HasPrefix(line, "event: ") && line != "event: "+ledger.EventBalanceChanged {
+			t.Errorf("unexpected event line %q", line)
+		}
+	}
+	if len(ids) != 2 {
+		t.Fatalf("ids = %v, want 2", ids)
+	}
+
+	transfer(30)
+	lines = readFields(t, server.URL, ids[1], "data: ", 1)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "data: ") && !strings.Contains(line, `"amount":30`) {
+			t.Errorf("resumed stream sent %q, want the third transfer", line)
+		}
+	}
+}
+
+func TestHandlerHeartbeat(t *testing.T) {
+	server, _ := newTestServer(t)
+	readFields(t, server.URL, "", ": heartbeat", 2)
+}
+
+func TestHandlerRejects(t *testing.T) {
+	server, _ := newTestServer(t)
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "Bearer alice", http.StatusUnauthorized},
+		{"post", http.MethodPost, "Bearer bob", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: error = %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	lines := readFields(t, server.URL+"?cursor=bogus", "", "event: error", 1)
+	if last := lines[len(lines)-1]; last != "event: error" {
+		t.Errorf("invalid cursor sent %v", lines)
+	}
+}
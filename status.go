@@ -0,0 +1,186 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TransactionStatus is the status of a TransactionEntry. Completed and Failed
+// keep the 0 and 1 already stored in the TransactionStatus attribute.
+type TransactionStatus int
+
+const (
+	TransactionCompleted TransactionStatus = 0
+	TransactionFailed    TransactionStatus = 1
+	TransactionPending   TransactionStatus = 2
+	TransactionReversed  TransactionStatus = 3
+	TransactionHeld      TransactionStatus = 4
+	// TransactionIndeterminate is a transfer interrupted while its journal
+	// was posted; see ResolveIndeterminate.
+	TransactionIndeterminate TransactionStatus = 5
+	// TransactionBlocked is a transfer rejected by the screening hook; see
+	// WithScreening. It is final.
+	TransactionBlocked TransactionStatus = 6
+)
+
+var transactionStatusNames = map[TransactionStatus]string{
+	TransactionCompleted:     "Completed",
+	TransactionFailed:        "Failed",
+	TransactionPending:       "Pending",
+	TransactionReversed:      "Reversed",
+	TransactionHeld:          "Held",
+	TransactionIndeterminate: "Indeterminate",
+	TransactionBlocked:       "Blocked",
+}
+
+func (s TransactionStatus) String() string {
+	if name, ok := transactionStatusNames[s]; ok {
+		return name
+	}
+	return "TransactionStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// statusTransitions lists the statuses each status may move to. Failed,
+// Reversed and Blocked are final.
+var statusTransitions = map[TransactionStatus][]TransactionStatus{
+	TransactionPending:       {TransactionCompleted, TransactionFailed, TransactionHeld},
+	TransactionHeld:          {TransactionPending, TransactionCompleted, TransactionFailed},
+	TransactionCompleted:     {TransactionReversed},
+	TransactionIndeterminate: {TransactionCompleted, TransactionFailed},
+}
+
+// CanTransitionTo reports whether a transaction may move from s to next.
+func (s TransactionStatus) CanTransitionTo(next TransactionStatus) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrInvalidTransition is returned by TransitionStatus for a move the state
+// machine does not allow.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// StatusChange is an entry of a transaction's status history.
+type StatusChange struct {
+	From   TransactionStatus `dynamodbav:"From" json:"from"`
+	To     TransactionStatus `dynamodbav:"To" json:"to"`
+	Actor  string            `dynamodbav:"Actor" json:"actor"`
+	Reason string            `dynamodbav:"Reason" json:"reason,omitempty"`
+	Time   int64             `dynamodbav:"Time" json:"time"`
+}
+
+// TransitionStatus moves a transaction to a new status, appending who made
+// the change, when and why to its StatusHistory. Transactions stored without
+// a status are treated as pending. The update is conditional on the status
+// and version read, so concurrent transitions fail with ErrVersionConflict
+// rather than skipping a state.
+func TransitionStatus(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string, to TransactionStatus, actor, reason string) (*TransactionEntry, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if actor == "" {
+		return nil, errors.New("actor is required to change a transaction status")
+	}
+	tx, err := getTransactionForUpdate(ctx, dbSvc, tenantId, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := transitionStatus(ctx, dbSvc, *tx, to, actor, reason)
+	payload := map[string]any{"to": to, "reason": reason}
+	recordAudit(WithActor(ctx, actor), dbSvc, AuditTransitionStatus, tenantId, transactionId, payload, tx, updated, err)
+	return updated, err
+}
+
+// getTransactionForUpdate reads a transaction consistently, so its Version
+// can be used to update it.
+func getTransactionForUpdate(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) (*TransactionEntry, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+			"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction: %v", err)
+	}
+	if result.Item == nil {
+		return nil, ErrTransactionNotFound
+	}
+	var tx TransactionEntry
+	if err := attributevalue.UnmarshalMap(result.Item, &tx); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transaction: %v", err)
+	}
+	return &tx, nil
+}
+
+func transitionStatus(ctx context.Context, dbSvc DynamoDBAPI, tx TransactionEntry, to TransactionStatus, actor, reason string) (*TransactionEntry, error) {
+	key := map[string]types.AttributeValue{
+		"TenantID":      &types.AttributeValueMemberS{Value: tx.TenantID},
+		"TransactionID": &types.AttributeValueMemberS{Value: tx.SystemTransactionID},
+	}
+
+	from := TransactionPending
+	statusCondition := "attribute_not_exists(#status)"
+	if tx.Status != nil {
+		from = *tx.Status
+		statusCondition = "#status = :from"
+	}
+	if !from.CanTransitionTo(to) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	change, err := attributevalue.Marshal(StatusChange{From: from, To: to, Actor: actor, Reason: reason, Time: clockOf(dbSvc).Now().Unix()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal status change: %v", err)
+	}
+	values := map[string]types.AttributeValue{
+		":to":              &types.AttributeValueMemberN{Value: strconv.Itoa(int(to))},
+		":change":          &types.AttributeValueMemberL{Value: []types.AttributeValue{change}},
+		":empty":           &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		":expectedVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(tx.Version, 10)},
+		":newVersion":      &types.AttributeValueMemberN{Value: strconv.FormatInt(tx.Version+1, 10)},
+	}
+	if tx.Status != nil {
+		values[":from"] = &types.AttributeValueMemberN{Value: strconv.Itoa(int(from))}
+	}
+
+	updated, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(TransactionsTable),
+		Key:              key,
+		UpdateExpression: aws.String("SET #status = :to, #history = list_append(if_not_exists(#history, :empty), :change), #version = :newVersion"),
+		ConditionExpression: aws.String(statusCondition +
+			" AND (attribute_not_exists(#version) OR #version = :expectedVersion)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":  "TransactionStatus",
+			"#history": "StatusHistory",
+			"#version": "Version",
+		},
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return nil, ErrVersionConflict
+		}
+		return nil, fmt.Errorf("failed to update transaction status: %v", err)
+	}
+
+	var updatedTx TransactionEntry
+	if err := attributevalue.UnmarshalMap(updated.Attributes, &updatedTx); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal updated transaction: %v", err)
+	}
+	return &updatedTx, nil
+}
@@ -0,0 +1,33 @@
+package ledger
+
+import "testing"
+
+func TestTransactionStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to TransactionStatus
+		want     bool
+	}{
+		{TransactionPending, TransactionCompleted, true},
+		{TransactionPending, TransactionHeld, true},
+		{TransactionHeld, TransactionPending, true},
+		{TransactionHeld, TransactionFailed, true},
+		{TransactionCompleted, TransactionReversed, true},
+		{TransactionPending, TransactionReversed, false},
+		{TransactionCompleted, TransactionFailed, false},
+		{TransactionFailed, TransactionCompleted, false},
+		{TransactionReversed, TransactionCompleted, false},
+		{TransactionCompleted, TransactionCompleted, false},
+		{TransactionIndeterminate, TransactionCompleted, true},
+		{TransactionIndeterminate, TransactionFailed, true},
+		{TransactionIndeterminate, TransactionReversed, false},
+		{TransactionPending, TransactionIndeterminate, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+	if got := TransactionStatus(9).String(); got != "TransactionStatus(9)" {
+		t.Errorf("String() = %q", got)
+	}
+}
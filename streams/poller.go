@@ -0,0 +1,287 @@
+package streams
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// StreamsAPI is the part of the DynamoDB Streams client used by Poller.
+type StreamsAPI interface {
+	DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// Defaults used for the zero values of Poller's fields.
+const (
+	DefaultPollInterval = time.Second
+	DefaultBatchSize    = 100
+)
+
+// Checkpoint is the position of a consumer in a shard of a stream.
+type Checkpoint struct {
+	Consumer string `dynamodbav:"Consumer"`
+	ShardID  string `dynamodbav:"ShardID"`
+	// SequenceNumber is that of the last record applied.
+	SequenceNumber string `dynamodbav:"SequenceNumber,omitempty"`
+	// Closed is set once every record of a closed shard was applied.
+	Closed    bool  `dynamodbav:"Closed,omitempty"`
+	UpdatedAt int64 `dynamodbav:"UpdatedAt"`
+}
+
+// Poller reads a table's stream and applies its records with Handler, for
+// deployments that do not run the handler on Lambda. Its position in each
+// shard is checkpointed after every batch, so a restarted poller resumes
+// where it stopped; the records applied since the last checkpoint are
+// delivered again, which the handler tolerates.
+//
+// A shard is read only once its parent is closed, so the changes of an item
+// are applied in order. Only one poller per Consumer should run at a time.
+type Poller struct {
+	Streams   StreamsAPI
+	StreamARN string
+	Handler   *Handler
+	// Consumer names the poller's checkpoints; pollers of the same stream
+	// for different handlers need different names.
+	Consumer string
+
+	// PollInterval is how long Run waits after a poll that read nothing.
+	PollInterval time.Duration
+	// BatchSize is the most records read per request.
+	BatchSize int32
+}
+
+// Run polls the stream until ctx is done or a record fails to apply.
+func (p *Poller) Run(ctx context.Context) error {
+	interval := p.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		n, err := p.Poll(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll reads every shard of the stream up to its end and returns the number
+// of records applied.
+func (p *Poller) Poll(ctx context.Context) (int, error) {
+	shards, err := p.shards(ctx)
+	if err != nil {
+		return 0, err
+	}
+	checkpoints, err := p.checkpoints(ctx)
+	if err != nil {
+		return 0, err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.ToString(shard.ShardId)] = true
+	}
+
+	applied := 0
+	for progress := true; progress; {
+		progress = false
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			checkpoint, ok := checkpoints[id]
+			if !ok {
+				checkpoint = Checkpoint{Consumer: p.Consumer, ShardID: id}
+			}
+			if checkpoint.Closed {
+				continue
+			}
+			// A parent that expired from the stream has nothing left to read.
+			if parent := aws.ToString(shard.ParentShardId); parent != "" && listed[parent] && !checkpoints[parent].Closed {
+				continue
+			}
+			n, err := p.readShard(ctx, id, &checkpoint)
+			applied += n
+			checkpoints[id] = checkpoint
+			if err != nil {
+				return applied, err
+			}
+			// A closed shard lets its children be read in this poll.
+			progress = progress || checkpoint.Closed
+		}
+	}
+	return applied, nil
+}
+
+// readShard applies the records of a shard after its checkpoint, up to the
+// end of the shard or of the records written so far.
+func (p *Poller) readShard(ctx context.Context, shardId string, checkpoint *Checkpoint) (int, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(p.StreamARN),
+		ShardId:           aws.String(shardId),
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+	if checkpoint.SequenceNumber != "" {
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = aws.String(checkpoint.SequenceNumber)
+	}
+	iterator, err := p.Streams.GetShardIterator(ctx, input)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get iterator of shard %s: %v", shardId, err)
+	}
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	applied := 0
+	next := iterator.ShardIterator
+	for next != nil {
+		result, err := p.Streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: next, Limit: aws.Int32(batchSize)})
+		if err != nil {
+			return applied, fmt.Errorf("failed to get records of shard %s: %v", shardId, err)
+		}
+		for _, record := range result.Records {
+			rec, err := streamRecord(record, p.StreamARN)
+			if err == nil {
+				err = p.Handler.Apply(ctx, rec)
+			}
+			if err != nil {
+				if applied > 0 {
+					if err := p.saveCheckpoint(ctx, checkpoint); err != nil {
+						p.Handler.logger().ErrorContext(ctx, "failed to save stream checkpoint", "shard", shardId, "error", err)
+					}
+				}
+				return applied, err
+			}
+			checkpoint.SequenceNumber = rec.SequenceNumber
+			applied++
+		}
+		next = result.NextShardIterator
+		checkpoint.Closed = next == nil
+		if len(result.Records) > 0 || checkpoint.Closed {
+			if err := p.saveCheckpoint(ctx, checkpoint); err != nil {
+				return applied, err
+			}
+		}
+		if len(result.Records) == 0 {
+			break
+		}
+	}
+	return applied, nil
+}
+
+func (p *Poller) shards(ctx context.Context) ([]streamtypes.Shard, error) {
+	var shards []streamtypes.Shard
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(p.StreamARN)}
+	for {
+		result, err := p.Streams.DescribeStream(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe stream: %v", err)
+		}
+		if result.StreamDescription == nil {
+			return shards, nil
+		}
+		shards = append(shards, result.StreamDescription.Shards...)
+		if result.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = result.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// Checkpoints returns the checkpoints of a consumer by shard.
+func Checkpoints(ctx context.Context, dbSvc ledger.DynamoDBAPI, consumer string) (map[string]Checkpoint, error) {
+	checkpoints := map[string]Checkpoint{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ledger.StreamCheckpointsTable),
+		KeyConditionExpression: aws.String("Consumer = :consumer"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":consumer": &types.AttributeValueMemberS{Value: consumer},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query stream checkpoints: %v", err)
+		}
+		var page []Checkpoint
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal stream checkpoints: %v", err)
+		}
+		for _, checkpoint := range page {
+			checkpoints[checkpoint.ShardID] = checkpoint
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return checkpoints, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (p *Poller) checkpoints(ctx context.Context) (map[string]Checkpoint, error) {
+	return Checkpoints(ctx, p.Handler.DB, p.Consumer)
+}
+
+func (p *Poller) saveCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	checkpoint.UpdatedAt = time.Now().Unix()
+	item, err := attributevalue.MarshalMap(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stream checkpoint: %v", err)
+	}
+	_, err = p.Handler.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ledger.StreamCheckpointsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save stream checkpoint: %v", err)
+	}
+	return nil
+}
+
+func streamRecord(record streamtypes.Record, streamARN string) (Record, error) {
+	rec := Record{
+		EventID:   aws.ToString(record.EventID),
+		EventName: string(record.EventName),
+		Table:     tableOfARN(streamARN),
+	}
+	if record.Dynamodb == nil {
+		return rec, nil
+	}
+	rec.SequenceNumber = aws.ToString(record.Dynamodb.SequenceNumber)
+	var err error
+	if rec.Keys, err = fromStreamMap(record.Dynamodb.Keys); err != nil {
+		return rec, err
+	}
+	if rec.NewImage, err = fromStreamMap(record.Dynamodb.NewImage); err != nil {
+		return rec, err
+	}
+	rec.OldImage, err = fromStreamMap(record.Dynamodb.OldImage)
+	return rec, err
+}
+
+func fromStreamMap(m map[string]streamtypes.AttributeValue) (map[string]types.AttributeValue, error) {
+	if m == nil {
+		return nil, nil
+	}
+	out, err := attributevalue.FromDynamoDBStreamsMap(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert stream image: %v", err)
+	}
+	return out, nil
+}
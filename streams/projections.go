@@ -0,0 +1,347 @@
+package streams
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxSearchTokens is the most tokens a transaction is indexed under.
+const MaxSearchTokens = 40
+
+// transaction is the part of a TransactionsTable item the projections read.
+type transaction struct {
+	TenantID        string                    `dynamodbav:"TenantID"`
+	TransactionID   string                    `dynamodbav:"TransactionID"`
+	FromAccount     string                    `dynamodbav:"FromAccount"`
+	ToAccount       string                    `dynamodbav:"ToAccount"`
+	Amount          float64                   `dynamodbav:"Amount"`
+	Comment         string                    `dynamodbav:"Comment"`
+	Narrative       string                    `dynamodbav:"Narrative"`
+	Metadata        map[string]string         `dynamodbav:"Metadata"`
+	Tags            []string                  `dynamodbav:"Tags,stringset"`
+	PurposeCode     string                    `dynamodbav:"PurposeCode"`
+	TransactionDate int64                     `dynamodbav:"TransactionDate"`
+	Status          *ledger.TransactionStatus `dynamodbav:"TransactionStatus"`
+	Fee             float64                   `dynamodbav:"Fee"`
+	Tax             float64                   `dynamodbav:"Tax"`
+}
+
+func (t *transaction) completed() bool {
+	return t != nil && t.Status != nil && *t.Status == ledger.TransactionCompleted
+}
+
+// transactionImages returns the old and new images of a TransactionsTable
+// record, nil for the images it does not have.
+func transactionImages(rec Record) (before, after *transaction, err error) {
+	if rec.Table != ledger.TransactionsTable {
+		return nil, nil, nil
+	}
+	if rec.OldImage != nil {
+		before = &transaction{}
+		if err := attributevalue.UnmarshalMap(rec.OldImage, before); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal old image: %v", err)
+		}
+	}
+	if rec.NewImage != nil {
+		after = &transaction{}
+		if err := attributevalue.UnmarshalMap(rec.NewImage, after); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal new image: %v", err)
+		}
+	}
+	return before, after, nil
+}
+
+func projectionKey(projection, key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ProjectionID": &types.AttributeValueMemberS{Value: projection},
+		"ItemKey":      &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+func number(f float64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatFloat(f, 'f', -1, 64)}
+}
+
+// DailyAggregate is the count and volume of a tenant's transfers completed
+// on a day, in UTC.
+type DailyAggregate struct {
+	Date   string  `dynamodbav:"ItemKey" json:"date"`
+	Count  int64   `dynamodbav:"Count" json:"count"`
+	Volume float64 `dynamodbav:"Volume" json:"volume"`
+	Fees   float64 `dynamodbav:"Fees" json:"fees"`
+	Tax    float64 `dynamodbav:"Tax" json:"tax"`
+}
+
+// DailyAggregates counts every TransactionsTable record when it becomes
+// completed, by the day of its TransactionDate.
+type DailyAggregates struct{}
+
+func (DailyAggregates) Name() string { return "daily" }
+
+func dailyProjection(tenantId string) string {
+	return "daily#" + tenantId
+}
+
+func (DailyAggregates) Updates(rec Record) ([]types.TransactWriteItem, error) {
+	before, after, err := transactionImages(rec)
+	if err != nil || !after.completed() || before.completed() {
+		return nil, err
+	}
+	date := time.Unix(after.TransactionDate, 0).UTC().Format(ledger.SettlementPeriodFormat)
+	return []types.TransactWriteItem{{Update: &types.Update{
+		TableName:        aws.String(ledger.ProjectionsTable),
+		Key:              projectionKey(dailyProjection(after.TenantID), date),
+		UpdateExpression: aws.String("ADD #count :one, Volume :amount, Fees :fee, Tax :tax"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "Count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    number(1),
+			":amount": number(after.Amount),
+			":fee":    number(after.Fee),
+			":tax":    number(after.Tax),
+		},
+	}}}, nil
+}
+
+// GetDailyAggregates returns a tenant's aggregates of the days from from to
+// to, inclusive; days without completed transfers are left out.
+func GetDailyAggregates(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId string, from, to time.Time) ([]DailyAggregate, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	var aggregates []DailyAggregate
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ledger.ProjectionsTable),
+		KeyConditionExpression: aws.String("ProjectionID = :projection AND ItemKey BETWEEN :from AND :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":projection": &types.AttributeValueMemberS{Value: dailyProjection(tenantId)},
+			":from":       &types.AttributeValueMemberS{Value: from.UTC().Format(ledger.SettlementPeriodFormat)},
+			":to":         &types.AttributeValueMemberS{Value: to.UTC().Format(ledger.SettlementPeriodFormat)},
+		},
+	}
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query daily aggregates: %v", err)
+		}
+		var page []DailyAggregate
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal daily aggregates: %v", err)
+		}
+		aggregates = append(aggregates, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return aggregates, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// AccountCounter counts the ledger entries of an account.
+type AccountCounter struct {
+	AccountID    string  `dynamodbav:"ItemKey" json:"account_id"`
+	Credits      int64   `dynamodbav:"Credits" json:"credits"`
+	Debits       int64   `dynamodbav:"Debits" json:"debits"`
+	CreditVolume float64 `dynamodbav:"CreditVolume" json:"credit_volume"`
+	DebitVolume  float64 `dynamodbav:"DebitVolume" json:"debit_volume"`
+	// LastEntryAt is the time of the latest entry applied.
+	LastEntryAt int64 `dynamodbav:"LastEntryAt" json:"last_entry_at"`
+}
+
+// AccountCounters counts the entries inserted into LedgerTable per account.
+type AccountCounters struct{}
+
+func (AccountCounters) Name() string { return "account" }
+
+func accountProjection(tenantId string) string {
+	return "account#" + tenantId
+}
+
+func (AccountCounters) Updates(rec Record) ([]types.TransactWriteItem, error) {
+	if rec.Table != ledger.LedgerTable || rec.EventName != EventInsert {
+		return nil, nil
+	}
+	var entry ledger.LedgerEntry
+	if err := attributevalue.UnmarshalMap(rec.NewImage, &entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ledger entry: %v", err)
+	}
+	count, volume := "Credits", "CreditVolume"
+	switch entry.Type {
+	case "credit":
+	case "debit":
+		count, volume = "Debits", "DebitVolume"
+	default:
+		return nil, nil
+	}
+	return []types.TransactWriteItem{{Update: &types.Update{
+		TableName:        aws.String(ledger.ProjectionsTable),
+		Key:              projectionKey(accountProjection(entry.TenantID), entry.AccountID),
+		UpdateExpression: aws.String("ADD #count :one, #volume :amount SET LastEntryAt = :time"),
+		ExpressionAttributeNames: map[string]string{
+			"#count":  count,
+			"#volume": volume,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    number(1),
+			":amount": number(entry.Amount),
+			":time":   &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.Time, 10)},
+		},
+	}}}, nil
+}
+
+// GetAccountCounter returns the counters of an account, zero for an account
+// without entries.
+func GetAccountCounter(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId, accountId string) (*AccountCounter, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ledger.ProjectionsTable),
+		Key:       projectionKey(accountProjection(tenantId), accountId),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account counter: %v", err)
+	}
+	counter := &AccountCounter{AccountID: accountId}
+	if result.Item != nil {
+		if err := attributevalue.UnmarshalMap(result.Item, counter); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal account counter: %v", err)
+		}
+	}
+	return counter, nil
+}
+
+// SearchIndex indexes TransactionsTable records under the words of their
+// narratives, accounts, purpose code, tags and metadata values. A record
+// is indexed again on every change; words it lost stay indexed.
+type SearchIndex struct{}
+
+func (SearchIndex) Name() string { return "search" }
+
+func searchProjection(tenantId, token string) string {
+	return "search#" + tenantId + "#" + token
+}
+
+func (SearchIndex) Updates(rec Record) ([]types.TransactWriteItem, error) {
+	_, after, err := transactionImages(rec)
+	if err != nil || after == nil {
+		return nil, err
+	}
+	texts := []string{after.Narrative, after.Comment, after.FromAccount, after.ToAccount, after.PurposeCode}
+	texts = append(texts, after.Tags...)
+	for _, value := range after.Metadata {
+		texts = append(texts, value)
+	}
+	tokens := searchTokens(strings.Join(texts, " "))
+	if len(tokens) > MaxSearchTokens {
+		tokens = tokens[:MaxSearchTokens]
+	}
+	updates := make([]types.TransactWriteItem, 0, len(tokens))
+	for _, token := range tokens {
+		item := projectionKey(searchProjection(after.TenantID, token), after.TransactionID)
+		item["TransactionDate"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(after.TransactionDate, 10)}
+		item["Amount"] = number(after.Amount)
+		updates = append(updates, types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(ledger.ProjectionsTable),
+			Item:      item,
+		}})
+	}
+	return updates, nil
+}
+
+// searchTokens returns the distinct lower-cased words of s, in order,
+// leaving out words shorter than two characters.
+func searchTokens(s string) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// SearchHit is a transaction matching a search.
+type SearchHit struct {
+	TransactionID   string  `dynamodbav:"ItemKey" json:"transaction_id"`
+	TransactionDate int64   `dynamodbav:"TransactionDate" json:"time"`
+	Amount          float64 `dynamodbav:"Amount" json:"amount"`
+}
+
+// Search returns the tenant's transactions indexed under every word of
+// query, newest first.
+func Search(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId, query string) ([]SearchHit, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	tokens := searchTokens(query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	var hits []SearchHit
+	for i, token := range tokens {
+		matches, err := searchToken(ctx, dbSvc, tenantId, token)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			hits = matches
+			continue
+		}
+		found := make(map[string]bool, len(matches))
+		for _, hit := range matches {
+			found[hit.TransactionID] = true
+		}
+		kept := hits[:0]
+		for _, hit := range hits {
+			if found[hit.TransactionID] {
+				kept = append(kept, hit)
+			}
+		}
+		hits = kept
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].TransactionDate > hits[j].TransactionDate })
+	return hits, nil
+}
+
+func searchToken(ctx context.Context, dbSvc ledger.DynamoDBAPI, tenantId, token string) ([]SearchHit, error) {
+	var hits []SearchHit
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ledger.ProjectionsTable),
+		KeyConditionExpression: aws.String("ProjectionID = :projection"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":projection": &types.AttributeValueMemberS{Value: searchProjection(tenantId, token)},
+		},
+	}
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query search index: %v", err)
+		}
+		var page []SearchHit
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal search hits: %v", err)
+		}
+		hits = append(hits, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return hits, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,231 @@
+// Package streams maintains projections derived from the DynamoDB streams
+// of the ledger's TransactionsTable and LedgerTable: daily aggregates,
+// per-account counters and a search index, all stored in
+// ledger.ProjectionsTable.
+//
+// Records reach a Handler either from Lambda, through HandleLambda, or from
+// a Poller reading the stream itself and checkpointing its position in
+// ledger.StreamCheckpointsTable. Both deliver records at least once, so
+// each projection writes a marker keyed by the record's event ID in the
+// same transaction as its update, and a record delivered again is skipped.
+package streams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Event names of stream records.
+const (
+	EventInsert = "INSERT"
+	EventModify = "MODIFY"
+	EventRemove = "REMOVE"
+)
+
+// MarkerRetention is how long the marker of an applied record is kept. It
+// must exceed the stream's retention of 24 hours, after which a record can
+// no longer be delivered again.
+var MarkerRetention = 48 * time.Hour
+
+// Record is a change of an item of a table, as read from its stream.
+type Record struct {
+	// EventID is unique to the record and is what duplicates are detected
+	// by.
+	EventID   string
+	EventName string
+	// Table is the name of the table the item belongs to.
+	Table          string
+	SequenceNumber string
+	Keys           map[string]types.AttributeValue
+	NewImage       map[string]types.AttributeValue
+	OldImage       map[string]types.AttributeValue
+}
+
+// Projection derives items of ledger.ProjectionsTable from stream records.
+type Projection interface {
+	// Name identifies the projection in the markers of the records it
+	// applied; it must not change once records were applied.
+	Name() string
+	// Updates returns the writes that apply a record, none for a record
+	// the projection ignores. They are executed in one transaction, with
+	// the record's marker, so they are limited to 99 items.
+	Updates(rec Record) ([]types.TransactWriteItem, error)
+}
+
+// DefaultProjections returns the projections maintained by a Handler whose
+// Projections are nil.
+func DefaultProjections() []Projection {
+	return []Projection{DailyAggregates{}, AccountCounters{}, SearchIndex{}}
+}
+
+// Handler applies stream records to projections.
+type Handler struct {
+	DB          ledger.DynamoDBAPI
+	Projections []Projection
+	Logger      *slog.Logger
+}
+
+func (h *Handler) projections() []Projection {
+	if h.Projections == nil {
+		return DefaultProjections()
+	}
+	return h.Projections
+}
+
+func (h *Handler) logger() *slog.Logger {
+	if h.Logger == nil {
+		return slog.Default()
+	}
+	return h.Logger
+}
+
+// Apply applies a record to every projection. Projections that already
+// applied it are skipped, so a record may be applied any number of times.
+func (h *Handler) Apply(ctx context.Context, rec Record) error {
+	for _, projection := range h.projections() {
+		updates, err := projection.Updates(rec)
+		if err != nil {
+			return fmt.Errorf("failed to project record %s into %s: %v", rec.EventID, projection.Name(), err)
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		marker := types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(ledger.ProjectionsTable),
+			Item: map[string]types.AttributeValue{
+				"ProjectionID": &types.AttributeValueMemberS{Value: "applied#" + projection.Name()},
+				"ItemKey":      &types.AttributeValueMemberS{Value: rec.EventID},
+				"ExpiresAt":    &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(MarkerRetention).Unix(), 10)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(ProjectionID)"),
+		}}
+		_, err = h.DB.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: append([]types.TransactWriteItem{marker}, updates...),
+		})
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+			aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			h.logger().DebugContext(ctx, "stream record already applied", "event", rec.EventID, "projection", projection.Name())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply record %s to %s: %v", rec.EventID, projection.Name(), err)
+		}
+	}
+	return nil
+}
+
+// HandleLambda applies the records of a Lambda DynamoDB stream event, in
+// order. It stops at the first record that fails and reports it as the
+// batch item failure, so a function configured with
+// ReportBatchItemFailures is invoked again from that record on.
+func (h *Handler) HandleLambda(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	var response events.DynamoDBEventResponse
+	for _, record := range event.Records {
+		rec, err := lambdaRecord(record)
+		if err == nil {
+			err = h.Apply(ctx, rec)
+		}
+		if err != nil {
+			h.logger().ErrorContext(ctx, "failed to apply stream record", "event", record.EventID, "sequence", record.Change.SequenceNumber, "error", err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{ItemIdentifier: record.Change.SequenceNumber})
+			return response, nil
+		}
+	}
+	return response, nil
+}
+
+// tableOfARN returns the table of a stream ARN, of the form
+// arn:aws:dynamodb:region:account:table/name/stream/label.
+func tableOfARN(arn string) string {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+func lambdaRecord(record events.DynamoDBEventRecord) (Record, error) {
+	rec := Record{
+		EventID:        record.EventID,
+		EventName:      record.EventName,
+		Table:          tableOfARN(record.EventSourceArn),
+		SequenceNumber: record.Change.SequenceNumber,
+	}
+	var err error
+	if rec.Keys, err = fromLambdaMap(record.Change.Keys); err != nil {
+		return rec, err
+	}
+	if rec.NewImage, err = fromLambdaMap(record.Change.NewImage); err != nil {
+		return rec, err
+	}
+	rec.OldImage, err = fromLambdaMap(record.Change.OldImage)
+	return rec, err
+}
+
+func fromLambdaMap(m map[string]events.DynamoDBAttributeValue) (map[string]types.AttributeValue, error) {
+	if m == nil {
+		return nil, nil
+	}
+	out := make(map[string]types.AttributeValue, len(m))
+	for name, value := range m {
+		av, err := fromLambda(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", name, err)
+		}
+		out[name] = av
+	}
+	return out, nil
+}
+
+// fromLambda converts an attribute value of the aws-lambda-go events to its
+// SDK equivalent.
+func fromLambda(value events.DynamoDBAttributeValue) (types.AttributeValue, error) {
+	switch value.DataType() {
+	case events.DataTypeString:
+		return &types.AttributeValueMemberS{Value: value.String()}, nil
+	case events.DataTypeNumber:
+		return &types.AttributeValueMemberN{Value: value.Number()}, nil
+	case events.DataTypeBoolean:
+		return &types.AttributeValueMemberBOOL{Value: value.Boolean()}, nil
+	case events.DataTypeBinary:
+		return &types.AttributeValueMemberB{Value: value.Binary()}, nil
+	case events.DataTypeNull:
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	case events.DataTypeStringSet:
+		return &types.AttributeValueMemberSS{Value: value.StringSet()}, nil
+	case events.DataTypeNumberSet:
+		return &types.AttributeValueMemberNS{Value: value.NumberSet()}, nil
+	case events.DataTypeBinarySet:
+		return &types.AttributeValueMemberBS{Value: value.BinarySet()}, nil
+	case events.DataTypeList:
+		list := value.List()
+		out := make([]types.AttributeValue, len(list))
+		for i, v := range list {
+			av, err := fromLambda(v)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = av
+		}
+		return &types.AttributeValueMemberL{Value: out}, nil
+	case events.DataTypeMap:
+		out, err := fromLambdaMap(value.Map())
+		if err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberM{Value: out}, nil
+	}
+	return nil, fmt.Errorf("unsupported attribute type %v", value.DataType())
+}
@@ -0,0 +1,291 @@
+package streams
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgertest"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// tableRecords returns an INSERT record for every item of a table.
+func tableRecords(t *testing.T, db *ledgertest.DB, table string) []Record {
+	t.Helper()
+	items := db.Items(table)
+	records := make([]Record, len(items))
+	for i, item := range items {
+		records[i] = Record{EventID: fmt.Sprintf("%s-%d", table, i), EventName: EventInsert, Table: table, NewImage: item}
+	}
+	return records
+}
+
+func TestHandlerApply(t *testing.T) {
+	ctx := context.Background()
+	db := ledgertest.NewDB()
+	for account, amount := range map[string]float64{"alice": 100, "bob": 0} {
+		if err := ledger.CreateAccountWithBalance(ctx, db, "nil", account, amount); err != nil {
+			t.Fatalf("CreateAccountWithBalance() error = %v", err)
+		}
+	}
+	res, err := ledger.Transfer(ctx, db, ledger.TransferRequest{TenantID: "nil", FromAccount: "alice", ToAccount: "bob", Amount: 30, Narrative: "Rent for October"})
+	if err != nil {
+		t.Fatalf("Transfer() error = %v", err)
+	}
+
+	handler := &Handler{DB: db}
+	records := append(tableRecords(t, db, ledger.TransactionsTable), tableRecords(t, db, ledger.LedgerTable)...)
+	// Stream records are delivered at least once.
+	for round := 0; round < 2; round++ {
+		for _, rec := range records {
+			if err := handler.Apply(ctx, rec); err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+		}
+	}
+
+	today := time.Now()
+	aggregates, err := GetDailyAggregates(ctx, db, "nil", today.AddDate(0, 0, -1), today)
+	if err != nil {
+		t.Fatalf("GetDailyAggregates() error = %v", err)
+	}
+	if len(aggregates) != 1 || aggregates[0].Count != 1 || aggregates[0].Volume != 30 {
+		t.Errorf("GetDailyAggregates() = %+v, want one day with 1 transfer of 30", aggregates)
+	}
+
+	alice, err := GetAccountCounter(ctx, db, "nil", "alice")
+	if err != nil {
+		t.Fatalf("GetAccountCounter() error = %v", err)
+	}
+	if alice.Debits != 1 || alice.DebitVolume != 30 {
+		t.Errorf("alice counter = %+v, want 1 debit of 30", alice)
+	}
+	bob, err := GetAccountCounter(ctx, db, "nil", "bob")
+	if err != nil {
+		t.Fatalf("GetAccountCounter() error = %v", err)
+	}
+	if bob.Credits != 1 || bob.CreditVolume != 30 || bob.Debits != 0 {
+		t.Errorf("bob counter = %+v, want 1 credit of 30", bob)
+	}
+
+	hits, err := Search(ctx, db, "nil", "october RENT")
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(hits) != 1 || hits[0].TransactionID != res.Data.TransactionID {
+		t.Errorf("Search() = %+v, want %s", hits, res.Data.TransactionID)
+	}
+	if hits, _ := Search(ctx, db, "nil", "rent groceries"); len(hits) != 0 {
+		t.Errorf("Search() = %+v, want no hits for an unindexed word", hits)
+	}
+
+	// A record changed again is not counted again unless it becomes
+	// completed.
+	var modified Record
+	for _, rec := range records {
+		if rec.Table == ledger.TransactionsTable {
+			modified = Record{EventID: "modify", EventName: EventModify, Table: rec.Table, OldImage: rec.NewImage, NewImage: rec.NewImage}
+		}
+	}
+	if err := handler.Apply(ctx, modified); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if aggregates, _ := GetDailyAggregates(ctx, db, "nil", today, today); len(aggregates) != 1 || aggregates[0].Count != 1 {
+		t.Errorf("GetDailyAggregates() = %+v after a modification, want 1 transfer", aggregates)
+	}
+}
+
+func TestHandleLambda(t *testing.T) {
+	ctx := context.Background()
+	db := ledgertest.NewDB()
+	handler := &Handler{DB: db}
+	entry := func(seq, amount string) events.DynamoDBEventRecord {
+		return events.DynamoDBEventRecord{
+			EventID:        "event-" + seq,
+			EventName:      EventInsert,
+			EventSourceArn: "arn:aws:dynamodb:us-east-1:123456789012:table/" + ledger.LedgerTable + "/stream/2024-01-01T00:00:00.000",
+			Change: events.DynamoDBStreamRecord{
+				SequenceNumber: seq,
+				NewImage: map[string]events.DynamoDBAttributeValue{
+					"TenantID":      events.NewStringAttribute("nil"),
+					"AccountID":     events.NewStringAttribute("alice"),
+					"TransactionID": events.NewStringAttribute("tx-" + seq + "#credit"),
+					"Type":          events.NewStringAttribute("credit"),
+					"Amount":        events.NewNumberAttribute(amount),
+					"Time":          events.NewNumberAttribute("1700000000"),
+				},
+			},
+		}
+	}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		entry("100", "5"),
+		entry("200", "not a number"),
+		entry("300", "7"),
+	}}
+	response, err := handler.HandleLambda(ctx, event)
+	if err != nil {
+		t.Fatalf("HandleLambda() error = %v", err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "200" {
+		t.Errorf("BatchItemFailures = %+v, want the record 200", response.BatchItemFailures)
+	}
+	counter, err := GetAccountCounter(ctx, db, "nil", "alice")
+	if err != nil {
+		t.Fatalf("GetAccountCounter() error = %v", err)
+	}
+	if counter.Credits != 1 || counter.CreditVolume != 5 {
+		t.Errorf("counter = %+v, want only the record before the failure applied", counter)
+	}
+}
+
+// fakeStream serves shards of records to a Poller; a closed shard ends
+// after its records.
+type fakeStream struct {
+	mu      sync.Mutex
+	shards  []streamtypes.Shard
+	records map[string][]streamtypes.Record
+	closed  map[string]bool
+}
+
+func (s *fakeStream) DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &streamtypes.StreamDescription{Shards: s.shards}}, nil
+}
+
+func (s *fakeStream) GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shard := aws.ToString(params.ShardId)
+	position := 0
+	if params.ShardIteratorType == streamtypes.ShardIteratorTypeAfterSequenceNumber {
+		for i, record := range s.records[shard] {
+			if aws.ToString(record.Dynamodb.SequenceNumber) == aws.ToString(params.SequenceNumber) {
+				position = i + 1
+			}
+		}
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", shard, position))}, nil
+}
+
+func (s *fakeStream) GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shard, pos, _ := strings.Cut(aws.ToString(params.ShardIterator), ":")
+	position, _ := strconv.Atoi(pos)
+	records := s.records[shard][position:]
+	if len(records) > int(aws.ToInt32(params.Limit)) {
+		records = records[:aws.ToInt32(params.Limit)]
+	}
+	out := &dynamodbstreams.GetRecordsOutput{Records: records}
+	next := position + len(records)
+	if !s.closed[shard] || next < len(s.records[shard]) {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", shard, next))
+	}
+	return out, nil
+}
+
+func (s *fakeStream) add(shard string, seq int, account string, amount float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	str := func(v string) streamtypes.AttributeValue { return &streamtypes.AttributeValueMemberS{Value: v} }
+	num := func(v string) streamtypes.AttributeValue { return &streamtypes.AttributeValueMemberN{Value: v} }
+	s.records[shard] = append(s.records[shard], streamtypes.Record{
+		EventID:   aws.String(fmt.Sprintf("event-%d", seq)),
+		EventName: streamtypes.OperationTypeInsert,
+		Dynamodb: &streamtypes.StreamRecord{
+			SequenceNumber: aws.String(strconv.Itoa(seq)),
+			NewImage: map[string]streamtypes.AttributeValue{
+				"TenantID":      str("nil"),
+				"AccountID":     str(account),
+				"TransactionID": str(fmt.Sprintf("tx-%d#credit", seq)),
+				"Type":          str("credit"),
+				"Amount":        num(strconv.FormatFloat(amount, 'f', -1, 64)),
+				"Time":          num(strconv.Itoa(seq)),
+			},
+		},
+	})
+}
+
+func TestPoller(t *testing.T) {
+	ctx := context.Background()
+	db := ledgertest.NewDB()
+	stream := &fakeStream{
+		shards: []streamtypes.Shard{
+			{ShardId: aws.String("child"), ParentShardId: aws.String("parent")},
+			{ShardId: aws.String("parent")},
+		},
+		records: map[string][]streamtypes.Record{},
+		closed:  map[string]bool{"parent": true},
+	}
+	stream.add("parent", 1, "alice", 10)
+	stream.add("parent", 2, "alice", 20)
+	stream.add("child", 3, "alice", 40)
+
+	arn := "arn:aws:dynamodb:us-east-1:123456789012:table/" + ledger.LedgerTable + "/stream/2024-01-01T00:00:00.000"
+	newPoller := func() *Poller {
+		return &Poller{Streams: stream, StreamARN: arn, Handler: &Handler{DB: db}, Consumer: "projections", BatchSize: 1}
+	}
+	counter := func() *AccountCounter {
+		t.Helper()
+		counter, err := GetAccountCounter(ctx, db, "nil", "alice")
+		if err != nil {
+			t.Fatalf("GetAccountCounter() error = %v", err)
+		}
+		return counter
+	}
+
+	n, err := newPoller().Poll(ctx)
+	if err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Poll() = %d, want 3", n)
+	}
+	if c := counter(); c.Credits != 3 || c.CreditVolume != 70 || c.LastEntryAt != 3 {
+		t.Errorf("counter = %+v, want the parent's records applied before the child's", c)
+	}
+	checkpoints, err := Checkpoints(ctx, db, "projections")
+	if err != nil {
+		t.Fatalf("Checkpoints() error = %v", err)
+	}
+	if !checkpoints["parent"].Closed || checkpoints["child"].SequenceNumber != "3" || checkpoints["child"].Closed {
+		t.Errorf("Checkpoints() = %+v", checkpoints)
+	}
+
+	// A new poller resumes after the checkpoints.
+	stream.add("child", 4, "alice", 80)
+	if n, err := newPoller().Poll(ctx); err != nil || n != 1 {
+		t.Errorf("Poll() = %d, %v, want 1", n, err)
+	}
+	if c := counter(); c.Credits != 4 || c.CreditVolume != 150 {
+		t.Errorf("counter = %+v, want 4 credits of 150", c)
+	}
+
+	// Records delivered again after a lost checkpoint are skipped.
+	if _, err := db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ledger.StreamCheckpointsTable),
+		Key: map[string]types.AttributeValue{
+			"Consumer": &types.AttributeValueMemberS{Value: "projections"},
+			"ShardID":  &types.AttributeValueMemberS{Value: "child"},
+		},
+	}); err != nil {
+		t.Fatalf("DeleteItem() error = %v", err)
+	}
+	if _, err := newPoller().Poll(ctx); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if c := counter(); c.Credits != 4 || c.CreditVolume != 150 {
+		t.Errorf("counter = %+v after replaying a shard, want it unchanged", c)
+	}
+}
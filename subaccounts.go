@@ -0,0 +1,159 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MainWallet is the wallet of an account itself. Its sub-accounts are the
+// other wallets, such as "savings" or "escrow".
+const MainWallet = "main"
+
+// SubAccountID returns the AccountID of a customer's wallet: accountId for
+// MainWallet or an empty walletId, and accountId#walletId for the others.
+// Sub-accounts are accounts of their own under that ID, so their balances,
+// ledger entries and transactions are kept apart from the main account's,
+// and accounts without wallets are unchanged.
+func SubAccountID(accountId, walletId string) string {
+	if walletId == "" || walletId == MainWallet {
+		return accountId
+	}
+	return accountId + "#" + walletId
+}
+
+// SubAccount is a wallet of an account.
+type SubAccount struct {
+	WalletID  string  `json:"wallet_id"`
+	AccountID string  `json:"account_id"`
+	Currency  string  `json:"currency"`
+	Balance   float64 `json:"balance"`
+}
+
+// CreateSubAccount creates the wallet walletId under an existing account,
+// empty and in the account's currency. The main account owns it, so it is
+// part of the account's portfolio.
+func CreateSubAccount(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, walletId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	walletId = strings.TrimSpace(walletId)
+	switch {
+	case walletId == "" || walletId == MainWallet:
+		return fmt.Errorf("invalid wallet id %q", walletId)
+	case strings.Contains(walletId, "#") || strings.Contains(accountId, "#"):
+		return errors.New("account and wallet ids must not contain #")
+	}
+	parent, err := getAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return fmt.Errorf("account %s does not exist: %v", accountId, err)
+	}
+	currency := parent.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	item := map[string]types.AttributeValue{
+		"TenantID":    &types.AttributeValueMemberS{Value: tenantId},
+		"AccountID":   &types.AttributeValueMemberS{Value: SubAccountID(accountId, walletId)},
+		"OwnerID":     &types.AttributeValueMemberS{Value: accountId},
+		"WalletID":    &types.AttributeValueMemberS{Value: walletId},
+		"full_name":   &types.AttributeValueMemberS{Value: parent.FullName},
+		"is_verified": &types.AttributeValueMemberBOOL{Value: parent.IsVerified},
+		"created_at":  &types.AttributeValueMemberS{Value: time.Now().Local().String()},
+		"amount":      &types.AttributeValueMemberN{Value: "0.00"},
+		"currency":    &types.AttributeValueMemberS{Value: currency},
+		"Version":     &types.AttributeValueMemberN{Value: strconv.FormatInt(nextVersion(dbSvc), 10)},
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(NilUsers),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(AccountID)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("wallet %s of %s already exists", walletId, accountId)
+		}
+		return fmt.Errorf("failed to create wallet %s of %s: %v", walletId, accountId, err)
+	}
+	return nil
+}
+
+// TransferBetweenSubAccounts moves amount between two wallets of an
+// account; MainWallet is the account itself. The move is recorded like a
+// transfer, but is never charged fees, screened, limited or held.
+func TransferBetweenSubAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, fromWallet, toWallet string, amount float64) (NilResponse, error) {
+	from, to := SubAccountID(accountId, fromWallet), SubAccountID(accountId, toWallet)
+	req := TransferRequest{TenantID: tenantId, FromAccount: from, ToAccount: to, Amount: amount}
+	if from == to {
+		err := errors.New("the wallets must differ")
+		return failedResponse(req, "invalid_wallet", "The wallets must differ.", err.Error()), err
+	}
+	return transferCredits(ctx, dbSvc, req, transferOptions{betweenWallets: true})
+}
+
+// InquireSubAccountBalance returns the balance of a wallet of an account.
+func InquireSubAccountBalance(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, walletId string) (float64, error) {
+	return InquireBalance(ctx, dbSvc, tenantId, SubAccountID(accountId, walletId))
+}
+
+// ListSubAccounts returns the wallets of an account, the main wallet first
+// and the others by WalletID.
+func ListSubAccounts(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]SubAccount, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	main, err := getAccount(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("account %s does not exist: %v", accountId, err)
+	}
+	wallets := []SubAccount{subAccount(*main, MainWallet)}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenant AND begins_with(AccountID, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":prefix": &types.AttributeValueMemberS{Value: accountId + "#"},
+		},
+	}
+	var others []SubAccount
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query wallets of %s: %v", accountId, err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal wallets: %v", err)
+		}
+		for _, account := range page {
+			if account.WalletID != "" && account.OwnerID == accountId {
+				others = append(others, subAccount(account, account.WalletID))
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].WalletID < others[j].WalletID })
+	return append(wallets, others...), nil
+}
+
+func subAccount(account User, walletId string) SubAccount {
+	currency := account.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return SubAccount{WalletID: walletId, AccountID: account.AccountID, Currency: currency, Balance: account.Amount}
+}
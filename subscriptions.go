@@ -0,0 +1,199 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// BalanceSubscriptionsTable holds the balance alerts customers subscribed
+// to, keyed by AccountKey (tenant and account) and SubscriptionID.
+var BalanceSubscriptionsTable = "BalanceSubscriptions"
+
+// MaxSubscriptionsPerAccount caps the balance alerts of an account, since
+// all of them are evaluated on each of its transfers.
+const MaxSubscriptionsPerAccount = 10
+
+// SubscriptionKind is the condition a balance alert fires on.
+type SubscriptionKind string
+
+const (
+	// SubscriptionBalanceBelow fires when a transfer takes the balance from
+	// at least Threshold to below it.
+	SubscriptionBalanceBelow SubscriptionKind = "balance_below"
+	// SubscriptionCreditAbove fires when the account receives a transfer of
+	// more than Threshold.
+	SubscriptionCreditAbove SubscriptionKind = "credit_above"
+)
+
+// BalanceSubscription is a balance alert of an account. The ledger checks it
+// after each transfer of the account and notifies the account through
+// DefaultNotifier when it fires.
+type BalanceSubscription struct {
+	AccountKey     string           `dynamodbav:"AccountKey" json:"-"`
+	SubscriptionID string           `dynamodbav:"SubscriptionID" json:"subscription_id"`
+	TenantID       string           `dynamodbav:"TenantID" json:"tenant_id"`
+	AccountID      string           `dynamodbav:"AccountID" json:"account_id"`
+	Kind           SubscriptionKind `dynamodbav:"Kind" json:"kind"`
+	Threshold      float64          `dynamodbav:"Threshold" json:"threshold"`
+	// Locale is the language of the notifications; see Localize.
+	Locale    string `dynamodbav:"Locale,omitempty" json:"locale,omitempty"`
+	CreatedBy string `dynamodbav:"CreatedBy" json:"created_by"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at"`
+}
+
+// fires reports whether the subscription fires on a transfer moving its
+// account's balance from before to after.
+func (s *BalanceSubscription) fires(before, after float64) bool {
+	switch s.Kind {
+	case SubscriptionBalanceBelow:
+		return before >= s.Threshold && after < s.Threshold
+	case SubscriptionCreditAbove:
+		return roundAmount(after-before) > s.Threshold
+	}
+	return false
+}
+
+// CreateSubscription subscribes an account to a balance alert. An account
+// has at most MaxSubscriptionsPerAccount alerts.
+func CreateSubscription(ctx context.Context, dbSvc DynamoDBAPI, sub BalanceSubscription) (*BalanceSubscription, error) {
+	if sub.TenantID == "" {
+		sub.TenantID = "nil"
+	}
+	switch {
+	case sub.AccountID == "":
+		return nil, errors.New("account id is required")
+	case sub.Kind != SubscriptionBalanceBelow && sub.Kind != SubscriptionCreditAbove:
+		return nil, fmt.Errorf("unknown subscription kind: %q", sub.Kind)
+	case math.IsNaN(sub.Threshold) || math.IsInf(sub.Threshold, 0):
+		return nil, fmt.Errorf("invalid threshold: %v", sub.Threshold)
+	case sub.Kind == SubscriptionCreditAbove && sub.Threshold < 0:
+		return nil, fmt.Errorf("credit threshold must not be negative: %v", sub.Threshold)
+	}
+	if _, err := getAccount(ctx, dbSvc, sub.TenantID, sub.AccountID); err != nil {
+		return nil, fmt.Errorf("failed to get account %s: %v", sub.AccountID, err)
+	}
+	existing, err := ListSubscriptions(ctx, dbSvc, sub.TenantID, sub.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= MaxSubscriptionsPerAccount {
+		return nil, fmt.Errorf("account %s already has %d subscriptions", sub.AccountID, len(existing))
+	}
+
+	sub.AccountKey = eventStreamID(sub.TenantID, sub.AccountID)
+	sub.SubscriptionID = ksuid.New().String()
+	sub.Threshold = roundAmount(sub.Threshold)
+	sub.CreatedBy = ActorFrom(ctx)
+	sub.CreatedAt = time.Now().Unix()
+	item, err := attributevalue.MarshalMap(sub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal subscription: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(BalanceSubscriptionsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store subscription: %v", err)
+	}
+	return &sub, nil
+}
+
+// ListSubscriptions returns the balance alerts of an account.
+func ListSubscriptions(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) ([]BalanceSubscription, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(BalanceSubscriptionsTable),
+		KeyConditionExpression: aws.String("AccountKey = :account"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":account": &types.AttributeValueMemberS{Value: eventStreamID(tenantId, accountId)},
+		},
+	}
+	var subs []BalanceSubscription
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query subscriptions: %w", err)
+		}
+		var page []BalanceSubscription
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal subscriptions: %v", err)
+		}
+		subs = append(subs, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return subs, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// DeleteSubscription removes a balance alert of an account.
+func DeleteSubscription(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId, subscriptionId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(BalanceSubscriptionsTable),
+		Key: map[string]types.AttributeValue{
+			"AccountKey":     &types.AttributeValueMemberS{Value: eventStreamID(tenantId, accountId)},
+			"SubscriptionID": &types.AttributeValueMemberS{Value: subscriptionId},
+		},
+		ConditionExpression: aws.String("attribute_exists(SubscriptionID)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return fmt.Errorf("subscription %s of account %s not found", subscriptionId, accountId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete subscription %s: %v", subscriptionId, err)
+	}
+	return nil
+}
+
+// balanceChange is how a transfer moved the balance of one of its accounts.
+type balanceChange struct {
+	accountId     string
+	counterparty  string
+	before, after float64
+}
+
+// evaluateSubscriptions notifies the accounts of a completed transfer of the
+// balance alerts it fired. Alerts are best effort: failing to read them is
+// logged and never fails the transfer, and a deployment without
+// BalanceSubscriptionsTable has none.
+func evaluateSubscriptions(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId, currency string, changes ...balanceChange) {
+	for _, change := range changes {
+		subs, err := ListSubscriptions(ctx, dbSvc, tenantId, change.accountId)
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return
+		}
+		if err != nil {
+			loggerOf(dbSvc).WarnContext(ctx, "failed to evaluate subscriptions", "tenant", tenantId, "account", change.accountId, "txid", transactionId, "error", err)
+			continue
+		}
+		for i := range subs {
+			sub := &subs[i]
+			if !sub.fires(change.before, change.after) {
+				continue
+			}
+			vars := MessageVars{Amount: change.after - change.before, Currency: currency, Counterparty: change.counterparty}
+			if sub.Kind == SubscriptionBalanceBelow {
+				vars.Amount = sub.Threshold
+			}
+			text, _ := Localize("subscription."+string(sub.Kind), sub.Locale, vars)
+			notify(ctx, dbSvc, tenantId, change.accountId, text)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SwitchStatus is the final status of an escrow transaction at the external
+// switch or processor paying it out.
+type SwitchStatus int
+
+const (
+	// SwitchPending means the switch has not finished the transaction yet.
+	SwitchPending SwitchStatus = iota
+	// SwitchSettled means the switch paid the beneficiary.
+	SwitchSettled
+	// SwitchFailed means the switch will not pay the beneficiary, so the
+	// sender is refunded.
+	SwitchFailed
+)
+
+// Switch is the external switch or processor that settles escrow
+// transactions. Implementations route on the transaction's CashoutProvider
+// and look it up by its PaymentReference or TransactionID.
+type Switch interface {
+	TransactionStatus(ctx context.Context, tx EscrowTransaction) (SwitchStatus, error)
+}
+
+// SwitchReconciliation counts what a reconciliation run did.
+type SwitchReconciliation struct {
+	Checked  int `json:"checked"`
+	Settled  int `json:"settled"`
+	Failed   int `json:"failed"`
+	Pending  int `json:"pending"`
+	Refunded int `json:"refunded"`
+}
+
+// ReconcileSwitchTransactions is run periodically to close escrow
+// transactions whose callback from the switch never arrived. Every
+// transaction still in progress olderThan after it was made is looked up at
+// sw: settled ones are marked completed, and failed ones are marked failed
+// and their amount refunded to the sender from escrow. Transactions the
+// switch cannot report on are left for the next run; the others are still
+// processed and the errors returned joined.
+func ReconcileSwitchTransactions(ctx context.Context, dbSvc DynamoDBAPI, sw Switch, olderThan time.Duration, now time.Time) (SwitchReconciliation, error) {
+	var result SwitchReconciliation
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(EscrowTransactionsTable),
+		IndexName:                aws.String("StatusTransactionDateIndex"),
+		KeyConditionExpression:   aws.String("#status = :inProgress AND TransactionDate <= :cutoff"),
+		ExpressionAttributeNames: map[string]string{"#status": "TransactionStatus"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress": &types.AttributeValueMemberN{Value: strconv.Itoa(int(StatusInProgress))},
+			":cutoff":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-olderThan).Unix(), 10)},
+		},
+	}
+
+	var errs []error
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return result, fmt.Errorf("failed to query in-flight escrow transactions: %v", err)
+		}
+		var page []EscrowTransaction
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return result, fmt.Errorf("failed to unmarshal escrow transactions: %v", err)
+		}
+		for _, tx := range page {
+			result.Checked++
+			errs = append(errs, reconcileSwitchTransaction(ctx, dbSvc, sw, tx, &result))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	return result, errors.Join(errs...)
+}
+
+func reconcileSwitchTransaction(ctx context.Context, dbSvc DynamoDBAPI, sw Switch, tx EscrowTransaction, result *SwitchReconciliation) error {
+	logger := loggerOf(dbSvc)
+	status, err := sw.TransactionStatus(ctx, tx)
+	if err != nil {
+		result.Pending++
+		return fmt.Errorf("failed to get switch status of escrow transaction %s: %v", tx.SystemTransactionID, err)
+	}
+
+	var to Status
+	switch status {
+	case SwitchSettled:
+		to = StatusCompleted
+	case SwitchFailed:
+		to = StatusFailed
+	default:
+		result.Pending++
+		return nil
+	}
+	// Claiming the transaction with a conditional update makes sure a
+	// callback or another run arriving at the same time does not refund it
+	// twice.
+	if err := setEscrowStatus(ctx, dbSvc, tx, StatusInProgress, to); err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return nil
+		}
+		return err
+	}
+	if to == StatusCompleted {
+		result.Settled++
+		logger.InfoContext(ctx, "escrow transaction settled by switch reconciliation", "txid", tx.SystemTransactionID, "provider", tx.CashoutProvider)
+		return nil
+	}
+
+	result.Failed++
+	if err := ReverseEscrowTransferCredits(ctx, dbSvc, tx); err != nil {
+		logger.ErrorContext(ctx, "escrow refund failed", "txid", tx.SystemTransactionID, "account", tx.FromAccount, "amount", tx.Amount, "error", err)
+		return fmt.Errorf("failed to refund escrow transaction %s: %v", tx.SystemTransactionID, err)
+	}
+	result.Refunded++
+	logger.InfoContext(ctx, "escrow transaction failed by switch reconciliation and refunded", "txid", tx.SystemTransactionID, "provider", tx.CashoutProvider)
+	return nil
+}
+
+// setEscrowStatus moves an escrow transaction from one status to another,
+// failing with a ConditionalCheckFailedException when it is no longer in
+// from.
+func setEscrowStatus(ctx context.Context, dbSvc DynamoDBAPI, tx EscrowTransaction, from, to Status) error {
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(EscrowTransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"UUID":          &types.AttributeValueMemberS{Value: tx.InitiatorUUID},
+			"TransactionID": &types.AttributeValueMemberS{Value: tx.SystemTransactionID},
+		},
+		UpdateExpression:         aws.String("SET #status = :to"),
+		ConditionExpression:      aws.String("#status = :from"),
+		ExpressionAttributeNames: map[string]string{"#status": "TransactionStatus"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberN{Value: strconv.Itoa(int(from))},
+			":to":   &types.AttributeValueMemberN{Value: strconv.Itoa(int(to))},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		return fmt.Errorf("failed to update status of escrow transaction %s: %v", tx.SystemTransactionID, err)
+	}
+	return err
+}
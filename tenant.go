@@ -0,0 +1,258 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var TenantConfigTable = "TenantConfig"
+
+// TenantConfig holds the per-tenant settings applied by the ledger. A tenant
+// without a stored config gets the zero value, which means no limits.
+type TenantConfig struct {
+	TenantID string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	// DailySpendLimit caps the total an account can send per UTC day; zero means unlimited.
+	DailySpendLimit float64 `dynamodbav:"DailySpendLimit" json:"daily_spend_limit,omitempty"`
+	// FeeSchedule is charged on every transfer within the tenant; nil means free transfers.
+	FeeSchedule *FeeSchedule `dynamodbav:"FeeSchedule,omitempty" json:"fee_schedule,omitempty"`
+	// Tax is levied on the fee of every transfer; nil means no tax.
+	Tax *TaxSchedule `dynamodbav:"Tax,omitempty" json:"tax,omitempty"`
+	// Transfers above LargeTransferThreshold are held for LargeTransferDelay
+	// seconds (DefaultLargeTransferDelay when zero) before they are executed,
+	// giving the sender a window to cancel. Zero disables the hold.
+	LargeTransferThreshold float64 `dynamodbav:"LargeTransferThreshold" json:"large_transfer_threshold,omitempty"`
+	LargeTransferDelay     int64   `dynamodbav:"LargeTransferDelay" json:"large_transfer_delay,omitempty"`
+	// Transfers above ApprovalThreshold wait until RequiredApprovals of
+	// the Approvers sign them off with ApproveTransfer; a single
+	// RejectTransfer cancels them. Zero disables approvals.
+	ApprovalThreshold float64  `dynamodbav:"ApprovalThreshold,omitempty" json:"approval_threshold,omitempty"`
+	RequiredApprovals int      `dynamodbav:"RequiredApprovals,omitempty" json:"required_approvals,omitempty"`
+	Approvers         []string `dynamodbav:"Approvers,omitempty" json:"approvers,omitempty"`
+	// MinimumBalance is the balance transfers must leave on accounts without
+	// an overdraft limit; zero lets them empty the account.
+	MinimumBalance float64 `dynamodbav:"MinimumBalance,omitempty" json:"minimum_balance,omitempty"`
+	// DefaultCurrency is the ISO 4217 currency of the tenant's accounts
+	// created without one; the package's DefaultCurrency when empty.
+	DefaultCurrency string `dynamodbav:"DefaultCurrency,omitempty" json:"default_currency,omitempty"`
+	// BaseCurrency is what portfolio totals are converted to; the default
+	// currency when empty.
+	BaseCurrency string `dynamodbav:"BaseCurrency,omitempty" json:"base_currency,omitempty"`
+	// BonusFundingAccount pays for the bonuses granted by GrantBonus and
+	// gets back what expires unspent.
+	BonusFundingAccount string `dynamodbav:"BonusFundingAccount,omitempty" json:"bonus_funding_account,omitempty"`
+	// TreasuryAccount mirrors the tenant's money held outside the ledger,
+	// such as at its bank; DepositCredits and WithdrawCredits move funds
+	// between it and customer accounts.
+	TreasuryAccount string `dynamodbav:"TreasuryAccount,omitempty" json:"treasury_account,omitempty"`
+	// PayoutHoldingAccount holds the funds of cash pickup payouts until
+	// they are redeemed or refunded; see CreatePayout. Payouts can be
+	// redeemed for PayoutTTL seconds, DefaultPayoutTTL when zero.
+	PayoutHoldingAccount string `dynamodbav:"PayoutHoldingAccount,omitempty" json:"payout_holding_account,omitempty"`
+	PayoutTTL            int64  `dynamodbav:"PayoutTTL,omitempty" json:"payout_ttl,omitempty"`
+	// PendingClaimsAccount holds the funds sent to unregistered phone
+	// numbers until claimed or refunded; see SendToUnregistered. They can
+	// be claimed for ClaimTTL seconds, DefaultClaimTTL when zero.
+	PendingClaimsAccount string `dynamodbav:"PendingClaimsAccount,omitempty" json:"pending_claims_account,omitempty"`
+	ClaimTTL             int64  `dynamodbav:"ClaimTTL,omitempty" json:"claim_ttl,omitempty"`
+	// EscrowHoldingAccount holds the funds of EscrowTransfer until their
+	// arbitrator releases or refunds them.
+	EscrowHoldingAccount string `dynamodbav:"EscrowHoldingAccount,omitempty" json:"escrow_holding_account,omitempty"`
+	// DisputeHoldingAccount holds the amounts frozen by OpenDispute until
+	// the dispute is resolved.
+	DisputeHoldingAccount string `dynamodbav:"DisputeHoldingAccount,omitempty" json:"dispute_holding_account,omitempty"`
+	// SettlementAccount mirrors what the tenant holds at the settlement
+	// bank; RunSettlement pays what the tenant owes other tenants from it
+	// and what it is owed into it.
+	SettlementAccount string `dynamodbav:"SettlementAccount,omitempty" json:"settlement_account,omitempty"`
+	// VelocityRules cap how many transfers an account can send per window;
+	// a transfer over any of them is refused with rate_limited.
+	VelocityRules []VelocityRule `dynamodbav:"VelocityRules,omitempty" json:"velocity_rules,omitempty"`
+	// KYCTierLimits restrict accounts by how well their owner is verified;
+	// see SetKYCTier. A tier without limits is unrestricted.
+	KYCTierLimits []KYCTierLimits `dynamodbav:"KYCTierLimits,omitempty" json:"kyc_tier_limits,omitempty"`
+	// DualControl requires the settings that move money, such as fees,
+	// limits and system accounts, and the tenant's signing keys to be
+	// changed through ProposeConfigChange and approved by a second person.
+	DualControl bool `dynamodbav:"DualControl,omitempty" json:"dual_control,omitempty"`
+	// Maintenance is set while the tenant is under maintenance. It is only
+	// changed by StartMaintenance and EndMaintenance.
+	Maintenance *Maintenance `dynamodbav:"Maintenance,omitempty" json:"maintenance,omitempty"`
+	UpdatedAt   int64        `dynamodbav:"UpdatedAt" json:"updated_at,omitempty"`
+}
+
+// systemAccounts returns the accounts named by the config, each with what it
+// is used for.
+func (cfg *TenantConfig) systemAccounts() [][2]string {
+	var accounts [][2]string
+	if cfg.FeeSchedule != nil {
+		accounts = append(accounts, [2]string{"collection account", cfg.FeeSchedule.CollectionAccount})
+	}
+	if cfg.Tax != nil {
+		accounts = append(accounts, [2]string{"collection account", cfg.Tax.CollectionAccount})
+	}
+	if cfg.BonusFundingAccount != "" {
+		accounts = append(accounts, [2]string{"bonus funding account", cfg.BonusFundingAccount})
+	}
+	if cfg.TreasuryAccount != "" {
+		accounts = append(accounts, [2]string{"treasury account", cfg.TreasuryAccount})
+	}
+	if cfg.PayoutHoldingAccount != "" {
+		accounts = append(accounts, [2]string{"payout holding account", cfg.PayoutHoldingAccount})
+	}
+	if cfg.PendingClaimsAccount != "" {
+		accounts = append(accounts, [2]string{"pending claims account", cfg.PendingClaimsAccount})
+	}
+	if cfg.EscrowHoldingAccount != "" {
+		accounts = append(accounts, [2]string{"escrow holding account", cfg.EscrowHoldingAccount})
+	}
+	if cfg.DisputeHoldingAccount != "" {
+		accounts = append(accounts, [2]string{"dispute holding account", cfg.DisputeHoldingAccount})
+	}
+	if cfg.SettlementAccount != "" {
+		accounts = append(accounts, [2]string{"settlement account", cfg.SettlementAccount})
+	}
+	return accounts
+}
+
+// isSystemAccount reports whether the config names accountId as one of
+// its system accounts.
+func (cfg *TenantConfig) isSystemAccount(accountId string) bool {
+	for _, account := range cfg.systemAccounts() {
+		if account[1] == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the config is usable.
+func (cfg *TenantConfig) Validate() error {
+	if cfg.FeeSchedule != nil {
+		if err := cfg.FeeSchedule.Validate(); err != nil {
+			return fmt.Errorf("invalid fee schedule: %v", err)
+		}
+	}
+	if cfg.Tax != nil {
+		if err := cfg.Tax.Validate(); err != nil {
+			return fmt.Errorf("invalid tax schedule: %v", err)
+		}
+	}
+	if cfg.LargeTransferThreshold < 0 || cfg.LargeTransferDelay < 0 {
+		return errors.New("large transfer threshold and delay must not be negative")
+	}
+	if err := cfg.validateApprovals(); err != nil {
+		return err
+	}
+	if cfg.PayoutTTL < 0 {
+		return errors.New("payout TTL must not be negative")
+	}
+	if cfg.ClaimTTL < 0 {
+		return errors.New("claim TTL must not be negative")
+	}
+	if cfg.MinimumBalance < 0 {
+		return errors.New("minimum balance must not be negative; allow overdrafts per account instead")
+	}
+	if cfg.DefaultCurrency != "" {
+		if err := ValidateCurrency(cfg.DefaultCurrency); err != nil {
+			return err
+		}
+	}
+	if cfg.BaseCurrency != "" {
+		if err := ValidateCurrency(cfg.BaseCurrency); err != nil {
+			return err
+		}
+	}
+	windows := map[int64]bool{}
+	for _, rule := range cfg.VelocityRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if windows[rule.Window] {
+			return fmt.Errorf("more than one velocity rule per %ds window", rule.Window)
+		}
+		windows[rule.Window] = true
+	}
+	tiers := map[int]bool{}
+	for _, limits := range cfg.KYCTierLimits {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		if tiers[limits.Tier] {
+			return fmt.Errorf("more than one limit of KYC tier %d", limits.Tier)
+		}
+		tiers[limits.Tier] = true
+	}
+	return nil
+}
+
+// GetTenantConfig retrieves the config of a tenant, returning a default config
+// if the tenant has none stored.
+func GetTenantConfig(ctx context.Context, dbSvc DynamoDBAPI, tenantId string) (*TenantConfig, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TenantConfigTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+		},
+		// Read consistently so a maintenance just started is seen.
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant config for %s: %v", tenantId, err)
+	}
+	if result.Item == nil {
+		return &TenantConfig{TenantID: tenantId}, nil
+	}
+
+	var cfg TenantConfig
+	if err := attributevalue.UnmarshalMap(result.Item, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant config: %v", err)
+	}
+	return &cfg, nil
+}
+
+// PutTenantConfig stores the config of a tenant, replacing any existing one
+// except for its Maintenance, which is kept. It returns ErrDualControl for a
+// change to the sensitive settings of a tenant under DualControl.
+func PutTenantConfig(ctx context.Context, dbSvc DynamoDBAPI, cfg TenantConfig) error {
+	if cfg.TenantID == "" {
+		cfg.TenantID = "nil"
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	current, err := GetTenantConfig(ctx, dbSvc, cfg.TenantID)
+	if err != nil {
+		return err
+	}
+	diff, err := configDiff(*current, cfg)
+	if err != nil {
+		return err
+	}
+	if err := current.dualControlError(diff); err != nil {
+		return err
+	}
+	cfg.Maintenance = current.Maintenance
+	cfg.UpdatedAt = getCurrentTimestamp()
+
+	item, err := attributevalue.MarshalMap(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenant config: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TenantConfigTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store tenant config: %v", err)
+	}
+	return nil
+}
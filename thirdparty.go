@@ -0,0 +1,264 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	ThirdPartyAppsTable = "ThirdPartyApps"
+	ConsentsTable       = "Consents"
+)
+
+// ThirdPartyApp is an application registered by a tenant that is allowed to
+// initiate transfers on behalf of the tenant's customers.
+type ThirdPartyApp struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	AppID     string `dynamodbav:"AppID" json:"app_id,omitempty"`
+	Name      string `dynamodbav:"Name" json:"name,omitempty"`
+	Disabled  bool   `dynamodbav:"Disabled" json:"disabled,omitempty"`
+	CreatedAt int64  `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+}
+
+// Consent is the scope a customer granted to a third-party app: how much it
+// may move per transfer, to whom, and until when.
+type Consent struct {
+	TenantID      string   `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	ConsentID     string   `dynamodbav:"ConsentID" json:"consent_id,omitempty"`
+	AccountID     string   `dynamodbav:"AccountID" json:"account_id,omitempty"`
+	AppID         string   `dynamodbav:"AppID" json:"app_id,omitempty"`
+	MaxAmount     float64  `dynamodbav:"MaxAmount" json:"max_amount,omitempty"`
+	AllowedPayees []string `dynamodbav:"AllowedPayees" json:"allowed_payees,omitempty"`
+	ExpiresAt     int64    `dynamodbav:"ExpiresAt" json:"expires_at,omitempty"`
+	Revoked       bool     `dynamodbav:"Revoked" json:"revoked,omitempty"`
+	CreatedAt     int64    `dynamodbav:"CreatedAt" json:"created_at,omitempty"`
+}
+
+// Validate checks that the consent covers a transfer initiated by appID at the
+// given unix time. An empty AllowedPayees list allows any payee, and a zero
+// MaxAmount means no per-transfer cap.
+func (c *Consent) Validate(appID string, trEntry TransactionEntry, now int64) error {
+	if err := c.active(appID, now); err != nil {
+		return err
+	}
+	if c.AccountID != trEntry.FromAccount {
+		return fmt.Errorf("consent %s does not cover account %s", c.ConsentID, trEntry.FromAccount)
+	}
+	if c.MaxAmount != 0 && trEntry.Amount > c.MaxAmount {
+		return fmt.Errorf("amount %.2f exceeds consent limit %.2f", trEntry.Amount, c.MaxAmount)
+	}
+	if len(c.AllowedPayees) > 0 && !slices.Contains(c.AllowedPayees, trEntry.ToAccount) {
+		return fmt.Errorf("payee %s is not allowed by consent %s", trEntry.ToAccount, c.ConsentID)
+	}
+	return nil
+}
+
+// active checks that the consent was granted to appID and is still in force.
+func (c *Consent) active(appID string, now int64) error {
+	if c.Revoked {
+		return errors.New("consent has been revoked")
+	}
+	if c.AppID != appID {
+		return fmt.Errorf("consent %s was not granted to app %s", c.ConsentID, appID)
+	}
+	if c.ExpiresAt != 0 && now >= c.ExpiresAt {
+		return errors.New("consent has expired")
+	}
+	return nil
+}
+
+// RegisterThirdPartyApp registers a new third-party app under a tenant.
+func RegisterThirdPartyApp(ctx context.Context, dbSvc DynamoDBAPI, tenantId, name string) (*ThirdPartyApp, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	app := ThirdPartyApp{
+		TenantID:  tenantId,
+		AppID:     ksuid.New().String(),
+		Name:      name,
+		CreatedAt: getCurrentTimestamp(),
+	}
+
+	item, err := attributevalue.MarshalMap(app)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal third-party app: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ThirdPartyAppsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register third-party app: %v", err)
+	}
+	return &app, nil
+}
+
+// GetThirdPartyApp retrieves a registered app by tenant ID and app ID.
+func GetThirdPartyApp(ctx context.Context, dbSvc DynamoDBAPI, tenantId, appId string) (*ThirdPartyApp, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ThirdPartyAppsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantId},
+			"AppID":    &types.AttributeValueMemberS{Value: appId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get third-party app: %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("third-party app %s does not exist", appId)
+	}
+
+	var app ThirdPartyApp
+	if err := attributevalue.UnmarshalMap(result.Item, &app); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal third-party app: %v", err)
+	}
+	return &app, nil
+}
+
+// GrantConsent stores a consent for a customer account to a third-party app.
+// The app must be registered under the same tenant.
+func GrantConsent(ctx context.Context, dbSvc DynamoDBAPI, consent Consent) (*Consent, error) {
+	if consent.TenantID == "" {
+		consent.TenantID = "nil"
+	}
+	if consent.AccountID == "" || consent.AppID == "" {
+		return nil, errors.New("accountID and appID are required")
+	}
+	if consent.MaxAmount < 0 {
+		return nil, errors.New("max amount must not be negative")
+	}
+	if _, err := GetThirdPartyApp(ctx, dbSvc, consent.TenantID, consent.AppID); err != nil {
+		return nil, err
+	}
+
+	consent.ConsentID = ksuid.New().String()
+	consent.CreatedAt = getCurrentTimestamp()
+	consent.Revoked = false
+
+	item, err := attributevalue.MarshalMap(consent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal consent: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ConsentsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store consent: %v", err)
+	}
+	return &consent, nil
+}
+
+// GetConsent retrieves a consent by tenant ID and consent ID.
+func GetConsent(ctx context.Context, dbSvc DynamoDBAPI, tenantId, consentId string) (*Consent, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ConsentsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"ConsentID": &types.AttributeValueMemberS{Value: consentId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get consent: %v", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("consent %s does not exist", consentId)
+	}
+
+	var consent Consent
+	if err := attributevalue.UnmarshalMap(result.Item, &consent); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+	return &consent, nil
+}
+
+// RevokeConsent marks a consent as revoked. Revocation is permanent; the
+// customer has to grant a new consent to re-enable the app.
+func RevokeConsent(ctx context.Context, dbSvc DynamoDBAPI, tenantId, consentId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ConsentsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantId},
+			"ConsentID": &types.AttributeValueMemberS{Value: consentId},
+		},
+		UpdateExpression:    aws.String("SET Revoked = :revoked"),
+		ConditionExpression: aws.String("attribute_exists(ConsentID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke consent %s: %v", consentId, err)
+	}
+	return nil
+}
+
+// InitiateThirdPartyTransfer performs a transfer on behalf of a customer. The
+// consent is validated against the transfer on every initiation, and the app
+// and consent are recorded on the transaction so the customer can see which
+// app moved their money.
+func InitiateThirdPartyTransfer(ctx context.Context, dbSvc DynamoDBAPI, appId, consentId string, trEntry TransactionEntry) (NilResponse, error) {
+	if trEntry.TenantID == "" {
+		trEntry.TenantID = "nil"
+	}
+	consentError := func(err error) (NilResponse, error) {
+		return NilResponse{
+			Status:    "error",
+			Code:      "consent_invalid",
+			Message:   "The third-party app is not allowed to make this transfer.",
+			Details:   err.Error(),
+			Timestamp: trEntry.Timestamp,
+			Data: data{
+				UUID:       trEntry.InitiatorUUID,
+				SignedUUID: trEntry.SignedUUID,
+			},
+		}, err
+	}
+
+	app, err := GetThirdPartyApp(ctx, dbSvc, trEntry.TenantID, appId)
+	if err != nil {
+		return consentError(err)
+	}
+	if app.Disabled {
+		return consentError(fmt.Errorf("third-party app %s is disabled", appId))
+	}
+	consent, err := GetConsent(ctx, dbSvc, trEntry.TenantID, consentId)
+	if err != nil {
+		return consentError(err)
+	}
+	if err := consent.Validate(appId, trEntry, getCurrentTimestamp()); err != nil {
+		return consentError(err)
+	}
+
+	return transferCredits(ctx, dbSvc, TransferRequest{
+		TenantID:        trEntry.TenantID,
+		FromAccount:     trEntry.FromAccount,
+		ToAccount:       trEntry.ToAccount,
+		Amount:          trEntry.Amount,
+		InitiatorUUID:   trEntry.InitiatorUUID,
+		SignedUUID:      trEntry.SignedUUID,
+		Timestamp:       trEntry.Timestamp,
+		ThirdPartyID:    appId,
+		ConsentID:       consentId,
+		IsInternational: trEntry.IsInternational,
+		IsCashOut:       trEntry.IsCashOut,
+	}, transferOptions{})
+}
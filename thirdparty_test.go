@@ -0,0 +1,43 @@
+package ledger
+
+import "testing"
+
+func TestConsentValidate(t *testing.T) {
+	consent := Consent{
+		ConsentID:     "c1",
+		AccountID:     "0111493885",
+		AppID:         "app1",
+		MaxAmount:     100,
+		AllowedPayees: []string{"0111493888"},
+		ExpiresAt:     2000,
+	}
+	revoked := consent
+	revoked.Revoked = true
+	anyPayee := consent
+	anyPayee.AllowedPayees = nil
+
+	tests := []struct {
+		name    string
+		consent Consent
+		appID   string
+		trEntry TransactionEntry
+		now     int64
+		wantErr bool
+	}{
+		{"valid", consent, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0111493888", Amount: 100}, 1000, false},
+		{"wrong app", consent, "app2", TransactionEntry{FromAccount: "0111493885", ToAccount: "0111493888", Amount: 10}, 1000, true},
+		{"wrong account", consent, "app1", TransactionEntry{FromAccount: "0111493886", ToAccount: "0111493888", Amount: 10}, 1000, true},
+		{"expired", consent, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0111493888", Amount: 10}, 2000, true},
+		{"over limit", consent, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0111493888", Amount: 100.01}, 1000, true},
+		{"payee not allowed", consent, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0123456789", Amount: 10}, 1000, true},
+		{"any payee", anyPayee, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0123456789", Amount: 10}, 1000, false},
+		{"revoked", revoked, "app1", TransactionEntry{FromAccount: "0111493885", ToAccount: "0111493888", Amount: 10}, 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.consent.Validate(tt.appID, tt.trEntry, tt.now); (err != nil) != tt.wantErr {
+				t.Errorf("Consent.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
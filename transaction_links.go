@@ -0,0 +1,265 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ParentIndex is the index of TransactionsTable finding the transactions
+// that follow from a transaction. Its range key is ParentTransactionID, so
+// only transactions with a parent are indexed.
+const ParentIndex = "ParentIndex"
+
+// MaxTransactionTreeSize caps the transactions GetTransactionTree returns.
+const MaxTransactionTreeSize = 100
+
+// ErrTransactionCycle is returned by SetParentTransaction for a parent that
+// follows from the transaction itself.
+var ErrTransactionCycle = errors.New("transaction_cycle")
+
+// TransactionTree is the graph of transactions linked to one, as returned by
+// GetTransactionTree.
+type TransactionTree struct {
+	// RootID is the transaction without a parent that the transaction of
+	// the tree follows from, the transaction itself when it has no parent.
+	RootID string `json:"root_id"`
+	// Transactions are in the order they were reached from the root: the
+	// root, its children and related transactions, theirs, and so on.
+	Transactions []TransactionNode `json:"transactions"`
+	// Truncated is set when the graph has more than MaxTransactionTreeSize
+	// transactions.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// TransactionNode is a transaction of a TransactionTree.
+type TransactionNode struct {
+	TransactionEntry
+	// Children are the transactions whose parent is this one.
+	Children []string `json:"children,omitempty"`
+}
+
+// SetParentTransaction links a transaction to the transaction it follows
+// from, such as a refund to its payment. A transaction has one parent;
+// setting it again to another one fails.
+func SetParentTransaction(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId, parentId string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if parentId == "" {
+		return errors.New("parent transaction id is required")
+	}
+	// Walking up from the parent finds the transaction when it is among the
+	// parent's ancestors.
+	ancestor := parentId
+	for depth := 0; ancestor != ""; depth++ {
+		if ancestor == transactionId || depth == MaxTransactionTreeSize {
+			return fmt.Errorf("%w: %s follows from %s", ErrTransactionCycle, parentId, transactionId)
+		}
+		tx, err := getTransactionForUpdate(ctx, dbSvc, tenantId, ancestor)
+		if err != nil {
+			return fmt.Errorf("failed to get transaction %s: %w", ancestor, err)
+		}
+		ancestor = tx.ParentTransactionID
+	}
+
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(TransactionsTable),
+		Key:                 transactionKey(tenantId, transactionId),
+		UpdateExpression:    aws.String("SET ParentTransactionID = :parent"),
+		ConditionExpression: aws.String("attribute_exists(TransactionID) AND (attribute_not_exists(ParentTransactionID) OR ParentTransactionID = :parent)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":parent": &types.AttributeValueMemberS{Value: parentId},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		if condErr.Item == nil {
+			return ErrTransactionNotFound
+		}
+		return fmt.Errorf("transaction %s already has a parent", transactionId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set parent of transaction %s: %v", transactionId, err)
+	}
+	return nil
+}
+
+// LinkTransactions links transactions as related to each other, such as the
+// legs of a split or a chargeback and its representment. Links are
+// symmetric: each transaction lists the other in RelatedTransactionIDs.
+func LinkTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string, relatedIds ...string) error {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	if len(relatedIds) == 0 {
+		return errors.New("related transaction ids are required")
+	}
+	if slices.Contains(relatedIds, transactionId) {
+		return fmt.Errorf("transaction %s cannot be related to itself", transactionId)
+	}
+	// A transaction write has at most 100 items, one per transaction.
+	if len(relatedIds) > 99 {
+		return fmt.Errorf("at most 99 transactions can be linked at once, got %d", len(relatedIds))
+	}
+	link := func(id string, related []string) types.TransactWriteItem {
+		return types.TransactWriteItem{Update: &types.Update{
+			TableName:           aws.String(TransactionsTable),
+			Key:                 transactionKey(tenantId, id),
+			UpdateExpression:    aws.String("ADD RelatedTransactionIDs :related"),
+			ConditionExpression: aws.String("attribute_exists(TransactionID)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":related": &types.AttributeValueMemberSS{Value: related},
+			},
+		}}
+	}
+	relatedIds = slices.Clone(relatedIds)
+	slices.Sort(relatedIds)
+	relatedIds = slices.Compact(relatedIds)
+	items := []types.TransactWriteItem{link(transactionId, relatedIds)}
+	for _, id := range relatedIds {
+		items = append(items, link(id, []string{transactionId}))
+	}
+	_, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for i, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				id := transactionId
+				if i > 0 {
+					id = relatedIds[i-1]
+				}
+				return fmt.Errorf("transaction %s: %w", id, ErrTransactionNotFound)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to link transactions: %v", err)
+	}
+	return nil
+}
+
+// GetTransactionTree returns the graph of transactions linked to a
+// transaction: the root it follows from through its parents, and every
+// transaction reached from the root through children, parents and related
+// links.
+// Clients use it to show that a refund relates to a payment, or the fee,
+// cashback and reversal of a transfer. The graph is cut off at
+// MaxTransactionTreeSize transactions.
+func GetTransactionTree(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) (*TransactionTree, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	tx, err := getTransactionForUpdate(ctx, dbSvc, tenantId, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	for depth := 0; tx.ParentTransactionID != "" && depth < MaxTransactionTreeSize; depth++ {
+		parent, err := getTransactionForUpdate(ctx, dbSvc, tenantId, tx.ParentTransactionID)
+		if errors.Is(err, ErrTransactionNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tx = parent
+	}
+
+	tree := &TransactionTree{RootID: tx.SystemTransactionID}
+	seen := map[string]bool{tx.SystemTransactionID: true}
+	queue := []*TransactionEntry{tx}
+	// visit queues a transaction reached from another, once.
+	visit := func(linked *TransactionEntry) {
+		switch {
+		case seen[linked.SystemTransactionID]:
+		case len(seen) == MaxTransactionTreeSize:
+			tree.Truncated = true
+		default:
+			seen[linked.SystemTransactionID] = true
+			queue = append(queue, linked)
+		}
+	}
+	for len(queue) > 0 {
+		tx, queue = queue[0], queue[1:]
+		node := TransactionNode{TransactionEntry: *tx}
+		children, err := childTransactions(ctx, dbSvc, tenantId, tx.SystemTransactionID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range children {
+			node.Children = append(node.Children, children[i].SystemTransactionID)
+			visit(&children[i])
+		}
+		tree.Transactions = append(tree.Transactions, node)
+
+		for _, id := range append(slices.Clone(tx.RelatedTransactionIDs), tx.ParentTransactionID) {
+			if id == "" || seen[id] {
+				continue
+			}
+			linked, err := getTransactionForUpdate(ctx, dbSvc, tenantId, id)
+			if errors.Is(err, ErrTransactionNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			visit(linked)
+		}
+	}
+	return tree, nil
+}
+
+// childTransactions returns the transactions whose parent is a transaction.
+func childTransactions(ctx context.Context, dbSvc DynamoDBAPI, tenantId, transactionId string) ([]TransactionEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TransactionsTable),
+		IndexName:              aws.String(ParentIndex),
+		KeyConditionExpression: aws.String("TenantID = :tenant AND ParentTransactionID = :parent"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			":parent": &types.AttributeValueMemberS{Value: transactionId},
+		},
+	}
+	var children []TransactionEntry
+	for {
+		resp, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query child transactions: %v", err)
+		}
+		var page []TransactionEntry
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transactions: %v", err)
+		}
+		children = append(children, page...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return children, nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// checkParentTransaction fails for a transfer whose parent transaction does
+// not exist.
+func checkParentTransaction(ctx context.Context, dbSvc DynamoDBAPI, req TransferRequest) error {
+	if req.ParentTransactionID == "" {
+		return nil
+	}
+	if _, err := getTransactionForUpdate(ctx, dbSvc, req.TenantID, req.ParentTransactionID); err != nil {
+		return fmt.Errorf("parent transaction %s: %w", req.ParentTransactionID, err)
+	}
+	return nil
+}
+
+func transactionKey(tenantId, transactionId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"TenantID":      &types.AttributeValueMemberS{Value: tenantId},
+		"TransactionID": &types.AttributeValueMemberS{Value: transactionId},
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/google/uuid"
 )
 
 const SNS_TOPIC = "arn:aws:sns:us-east-1:767397764981:TransactionNotifications"
@@ -55,6 +54,36 @@ type User struct {
 	PublicKey         string  `json:"public_key,omitempty"`
 	TenantID          string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
 	Email             string  `dynamodbav:"Email" json:"email,omitempty"`
+	// OverdraftLimit is how far below zero transfers may take the balance;
+	// see SetOverdraftLimit.
+	OverdraftLimit float64 `dynamodbav:"OverdraftLimit,omitempty" json:"overdraft_limit,omitempty"`
+	// LastEntryHash is the Hash of the account's latest ledger entry, the
+	// head of its hash chain.
+	LastEntryHash string `dynamodbav:"LastEntryHash,omitempty" json:"last_entry_hash,omitempty"`
+	// OwnerID is the identity holding the account, such as the customer's
+	// main account for their sub-wallets and pockets; see SetAccountOwner.
+	OwnerID string `dynamodbav:"OwnerID,omitempty" json:"owner_id,omitempty"`
+	// WalletID is set on the sub-accounts created by CreateSubAccount, whose
+	// OwnerID is the main account.
+	WalletID string `dynamodbav:"WalletID,omitempty" json:"wallet_id,omitempty"`
+	// Bonuses is the promotional money held apart from Amount; see
+	// GrantBonus.
+	Bonuses []BonusBucket `dynamodbav:"Bonuses,omitempty" json:"bonuses,omitempty"`
+	// LastActivity is when the account was created or a journal last
+	// posted to it; DormantSince is set by MarkDormantAccounts and cleared
+	// by ReactivateAccount.
+	LastActivity int64 `dynamodbav:"LastActivity,omitempty" json:"last_activity,omitempty"`
+	DormantSince int64 `dynamodbav:"DormantSince,omitempty" json:"dormant_since,omitempty"`
+	// KYCVerifiedAt and KYCVerifiedBy record the latest identity check,
+	// such as the one reactivating a dormant account.
+	KYCVerifiedAt int64  `dynamodbav:"KYCVerifiedAt,omitempty" json:"kyc_verified_at,omitempty"`
+	KYCVerifiedBy string `dynamodbav:"KYCVerifiedBy,omitempty" json:"kyc_verified_by,omitempty"`
+	// KYCTier is how well the owner is verified, from 0 (unverified) to
+	// MaxKYCTier, and selects the tenant's KYCTierLimits.
+	KYCTier int `dynamodbav:"KYCTier,omitempty" json:"kyc_tier,omitempty"`
+	// AgentFloat is set on the accounts of cash agents, whose balance is
+	// their float; see RegisterAgent.
+	AgentFloat *AgentFloatLimits `dynamodbav:"AgentFloat,omitempty" json:"agent_float,omitempty"`
 }
 
 func NewDefaultAccount(accountId, mobileNumber, name, pubkey, tenantId string) User {
@@ -76,7 +105,7 @@ func NewDefaultAccount(accountId, mobileNumber, name, pubkey, tenantId string) U
 		IDNumber:          "",
 		PicIDCard:         "",
 		Amount:            0,
-		Currency:          "SDG",
+		Currency:          DefaultCurrency,
 		TenantID:          tenantId,
 	}
 }
@@ -106,13 +135,59 @@ type TransactionEntry struct {
 	FromAccount         string  `dynamodbav:"FromAccount" json:"from_account,omitempty"`
 	ToAccount           string  `dynamodbav:"ToAccount" json:"to_account,omitempty"`
 	Amount              float64 `dynamodbav:"Amount" json:"amount"`
+	// Currency is the sender's.
+	Currency            string  `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
 	Comment             string  `dynamodbav:"Comment" json:"comment,omitempty"`
+	// Narrative is the caller's description of the transaction; Comment is
+	// the system narrative of the operation.
+	Narrative           string  `dynamodbav:"Narrative,omitempty" json:"narrative,omitempty"`
+	// Metadata and Tags are attached by the caller, e.g. a merchant's order
+	// ID, and can be filtered on with TransactionFilter.
+	Metadata            map[string]string `dynamodbav:"Metadata,omitempty" json:"metadata,omitempty"`
+	Tags                []string `dynamodbav:"Tags,stringset,omitempty" json:"tags,omitempty"`
+	// PurposeCode is the declared purpose of the transfer; BlockReason the
+	// reason code of a transfer blocked by screening.
+	PurposeCode string `dynamodbav:"PurposeCode,omitempty" json:"purpose_code,omitempty"`
+	BlockReason string `dynamodbav:"BlockReason,omitempty" json:"block_reason,omitempty"`
+	// Reference is the caller's reference, found with SearchTransactions.
+	Reference string `dynamodbav:"Reference,omitempty" json:"reference,omitempty"`
+	// Category is the spending category and MCC the merchant category code
+	// of the transfer; see TransferRequest.
+	Category string `dynamodbav:"Category,omitempty" json:"category,omitempty"`
+	MCC      string `dynamodbav:"MCC,omitempty" json:"mcc,omitempty"`
 	TransactionDate     int64   `dynamodbav:"TransactionDate" json:"time,omitempty"`
-	Status              *int    `dynamodbav:"TransactionStatus" json:"status,omitempty"`
+	Status              *TransactionStatus `dynamodbav:"TransactionStatus" json:"status,omitempty"`
 	TenantID            string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
 	InitiatorUUID       string  `dynamodbav:"UUID" json:"uuid,omitempty"`
 	Timestamp           string  `dynamodbav:"timestamp" json:"timestamp,omitempty"`
 	SignedUUID          string  `dynamodbav:"signed_uuid" json:"signed_uuid,omitempty"`
+	ThirdPartyID        string  `dynamodbav:"ThirdPartyID" json:"third_party_id,omitempty"`
+	ConsentID           string  `dynamodbav:"ConsentID" json:"consent_id,omitempty"`
+	IsInternational     bool    `dynamodbav:"IsInternational" json:"is_international,omitempty"`
+	Fee                 float64 `dynamodbav:"Fee" json:"fee,omitempty"`
+	FeePaidBy           string  `dynamodbav:"FeePaidBy" json:"fee_paid_by,omitempty"`
+	FeeAccount          string  `dynamodbav:"FeeAccount" json:"fee_account,omitempty"`
+	Tax                 float64 `dynamodbav:"Tax" json:"tax,omitempty"`
+	TaxAccount          string  `dynamodbav:"TaxAccount" json:"tax_account,omitempty"`
+	JournalID           string  `dynamodbav:"JournalID" json:"journal_id,omitempty"`
+	// ParentTransactionID is the transaction this one follows from, such as
+	// the payment of a refund or the transfer of a cashback, and
+	// RelatedTransactionIDs the transactions linked to it as related; see
+	// GetTransactionTree.
+	ParentTransactionID   string   `dynamodbav:"ParentTransactionID,omitempty" json:"parent_transaction_id,omitempty"`
+	RelatedTransactionIDs []string `dynamodbav:"RelatedTransactionIDs,stringset,omitempty" json:"related_transaction_ids,omitempty"`
+	// Version is bumped by every UpdateTransaction for optimistic locking.
+	Version int64 `dynamodbav:"Version,omitempty" json:"version,omitempty"`
+
+	// Legs is the breakdown of the journal that posted the transaction.
+	Legs []JournalLeg `dynamodbav:"Legs,omitempty" json:"legs,omitempty"`
+
+	// StatusHistory records every change made through TransitionStatus.
+	StatusHistory []StatusChange `dynamodbav:"StatusHistory,omitempty" json:"status_history,omitempty"`
+
+	// Annotation is the account holder's private annotation, filled in by
+	// history queries for one account. It is never stored on the record.
+	Annotation *Annotation `dynamodbav:"-" json:"annotation,omitempty"`
 
 	// ... new fields ...
 	IsCashOut        bool    `json:"is_cash_out" gorm:"default:false"` // Flag for CashOut transactions
@@ -125,10 +200,11 @@ type TransactionEntry struct {
 }
 
 // Create a new transacton entry and populate it with default time and status of 1, using the current time.
+// The ID and time come from the IDGenerator and Clock of dbSvc.
 // Should we use pointer? or use func (n *TransactionEntry) New() which us better
-func NewTransactionEntry(fromAccount, toAccount, bankAccountNo, bankCode string, amount float64) TransactionEntry {
-	uid := uuid.New().String()
-	failedTransaction := 1
+func NewTransactionEntry(dbSvc DynamoDBAPI, fromAccount, toAccount, bankAccountNo, bankCode string, amount float64) TransactionEntry {
+	uid := newID(dbSvc)
+	failedTransaction := TransactionFailed
 	return TransactionEntry{
 		SystemTransactionID: uid,
 		FromAccount:         fromAccount,
@@ -136,21 +212,44 @@ func NewTransactionEntry(fromAccount, toAccount, bankAccountNo, bankCode string,
 		BankAccountNo: 	 bankAccountNo,
 		BankCode:            bankCode,
 		Amount:              amount,
-		Comment:             "failed",
-		TransactionDate:     getCurrentTimestamp(),
+		Comment:             NarrativeFailedTransfer,
+		TransactionDate:     clockOf(dbSvc).Now().Unix(),
 		Status:              &failedTransaction,
 	}
 }
 
 type TransactionFilter struct {
 	AccountID         string
-	TransactionStatus *int
+	TransactionStatus *TransactionStatus
 	StartTime         int64
 	EndTime           int64
 	LastEvaluatedKey  map[string]types.AttributeValue
 	Limit             int32
+	// Direction limits AccountID's transactions to those it sent or
+	// received; see DirectionSent and DirectionReceived.
+	Direction string
+	// Counterparty limits AccountID's transactions to those with another
+	// account.
+	Counterparty string
+	// Search limits transactions to those whose narrative contains it,
+	// ignoring case.
+	Search string
+	// Tag limits transactions to those tagged with it, and Metadata to those
+	// having all of its keys set to the given values.
+	Tag      string
+	Metadata map[string]string
+	// Category and MCC limit transactions to those of a spending category
+	// and merchant category code.
+	Category string
+	MCC      string
 }
 
+// Directions of a TransactionFilter.
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
 // NilRresponse
 // Status should be: error, success, pending
 // Code: a generic nil code message
@@ -171,6 +270,12 @@ type NilResponse struct {
 	Timestamp string `json:"timestamp,omitempty"`
 	Data      data   `json:"data"`
 	Details   string `json:"details,omitempty"`
+	// Mode is set to ModeDegraded when the ledger served the request in
+	// degraded mode.
+	Mode string `json:"mode,omitempty"`
+	// RetryAfter is how many seconds to wait before retrying a request
+	// refused for a temporary reason, such as tenant maintenance.
+	RetryAfter int64 `json:"retry_after,omitempty"`
 }
 
 type data struct {
@@ -178,8 +283,11 @@ type data struct {
 	UUID          string  `json:"uuid,omitempty"`
 	TransactionID string  `json:"transaction_id,omitempty"`
 	Amount        float64 `json:"amount,omitempty"`
+	Fee           float64 `json:"fee,omitempty"`
 	SignedUUID    string  `json:"signed_uuid,omitempty"`
 	Currency      string  `json:"currency,omitempty"`
+	// Cashback is what the tenant's campaigns paid back on the transfer.
+	Cashback      float64 `json:"cashback,omitempty"`
 }
 
 type Beneficiary struct {
@@ -0,0 +1,174 @@
+// Package ledger is the client based API of the ledger. Operations are
+// methods of a Client bound to one DynamoDB client and configuration, and
+// take requests whose fields each mean one thing.
+//
+// It is built on github.com/adonese/ledger, whose package level functions
+// remain for existing callers. Services can move to this package one call at
+// a time: Client.Ledger returns the configured v1 client for the operations
+// not covered here yet.
+package ledger
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	v1 "github.com/adonese/ledger"
+)
+
+// Types shared with v1, so callers of this package need not import it.
+type (
+	DynamoDBAPI       = v1.DynamoDBAPI
+	Option            = v1.Option
+	User              = v1.User
+	Transaction       = v1.TransactionEntry
+	TransactionStatus = v1.TransactionStatus
+	TransactionFilter = v1.TransactionFilter
+	Statement         = v1.Statement
+	// TransactionsIterator walks transactions page by page; see
+	// Client.Transactions.
+	TransactionsIterator = v1.TransactionsIterator
+)
+
+// Client runs ledger operations against one DynamoDB client.
+type Client struct {
+	l *v1.Ledger
+}
+
+// New returns a Client using db, configured with the v1 options such as
+// v1.WithLogger or v1.WithAuditLog.
+func New(db DynamoDBAPI, opts ...Option) *Client {
+	return &Client{l: v1.NewLedger(db, opts...)}
+}
+
+// Ledger returns the configured v1 client, to pass to the v1 functions this
+// package does not cover yet.
+func (c *Client) Ledger() *v1.Ledger {
+	return c.l
+}
+
+// tenant applies the default tenant of the v1 functions.
+func tenant(tenantId string) string {
+	if tenantId == "" {
+		return "nil"
+	}
+	return tenantId
+}
+
+// CreateAccount creates an account; user.Amount is its opening balance.
+func (c *Client) CreateAccount(ctx context.Context, tenantId string, user User) error {
+	user.TenantID = tenant(tenantId)
+	return v1.CreateAccount(ctx, c.l, user.TenantID, user)
+}
+
+// GetAccount returns an account.
+func (c *Client) GetAccount(ctx context.Context, tenantId, accountId string) (*User, error) {
+	return v1.GetAccount(ctx, c.l, v1.TransactionEntry{TenantID: tenant(tenantId), AccountID: accountId})
+}
+
+// LookupAccount returns an account known only by its ID, resolving its
+// tenant. It fails with ledger.ErrAmbiguousAccount when several tenants have
+// the ID.
+func (c *Client) LookupAccount(ctx context.Context, accountId string) (*User, error) {
+	return v1.LookupAccount(ctx, c.l, accountId)
+}
+
+// Balance returns the balance of an account.
+func (c *Client) Balance(ctx context.Context, tenantId, accountId string) (float64, error) {
+	return v1.InquireBalance(ctx, c.l, tenant(tenantId), accountId)
+}
+
+// BalanceAt returns the balance of an account as of a past moment.
+func (c *Client) BalanceAt(ctx context.Context, tenantId, accountId string, at time.Time) (float64, error) {
+	return v1.GetBalanceAt(ctx, c.l, tenant(tenantId), accountId, at)
+}
+
+// TransferRequest moves Amount from From to To within a tenant.
+type TransferRequest struct {
+	TenantID string
+	From     string
+	To       string
+	Amount   float64
+	// InitiatorUUID identifies the request; SignedUUID is its signature when
+	// the tenant requires signed transfers.
+	InitiatorUUID string
+	SignedUUID    string
+	// ThirdPartyID and ConsentID are set when an app transfers on the
+	// sender's behalf.
+	ThirdPartyID    string
+	ConsentID       string
+	IsInternational bool
+	// Narrative describes the transfer to the account holders; Metadata and
+	// Tags are for the caller to find it by, e.g. an order ID.
+	Narrative string
+	Metadata  map[string]string
+	Tags      []string
+}
+
+// TransferResult is the outcome of a transfer.
+type TransferResult struct {
+	TransactionID string
+	Amount        float64
+	Fee           float64
+	// Status is "success", "pending" for a held transfer, or "error".
+	Status string
+	// Code is the machine readable outcome, e.g. "insufficient_balance".
+	Code    string
+	Message string
+	// Mode is set when the ledger served the transfer in degraded mode.
+	Mode string
+}
+
+// Transfer runs a transfer. A transfer the ledger refused returns its result
+// as well as the error, so callers can report Code.
+func (c *Client) Transfer(ctx context.Context, req TransferRequest) (*TransferResult, error) {
+	if req.From == "" || req.To == "" {
+		return nil, errors.New("from and to accounts are required")
+	}
+	res, err := v1.Transfer(ctx, c.l, v1.TransferRequest{
+		TenantID:        tenant(req.TenantID),
+		FromAccount:     req.From,
+		ToAccount:       req.To,
+		Amount:          req.Amount,
+		InitiatorUUID:   req.InitiatorUUID,
+		SignedUUID:      req.SignedUUID,
+		ThirdPartyID:    req.ThirdPartyID,
+		ConsentID:       req.ConsentID,
+		IsInternational: req.IsInternational,
+		Narrative:       req.Narrative,
+		Metadata:        req.Metadata,
+		Tags:            req.Tags,
+	})
+	return &TransferResult{
+		TransactionID: res.Data.TransactionID,
+		Amount:        res.Data.Amount,
+		Fee:           res.Data.Fee,
+		Status:        res.Status,
+		Code:          res.Code,
+		Message:       res.Message,
+		Mode:          res.Mode,
+	}, err
+}
+
+// Transaction returns a transaction of an account.
+func (c *Client) Transaction(ctx context.Context, tenantId, accountId, transactionId string) (*Transaction, error) {
+	return v1.GetTransaction(ctx, c.l, tenant(tenantId), accountId, transactionId)
+}
+
+// Transactions returns an iterator over the transactions of a tenant matching
+// filter.
+func (c *Client) Transactions(tenantId string, filter TransactionFilter) *TransactionsIterator {
+	return v1.NewTransactionsIterator(c.l, tenant(tenantId), filter)
+}
+
+// TransitionStatus moves a transaction to another status, recording actor and
+// reason in its history.
+func (c *Client) TransitionStatus(ctx context.Context, tenantId, transactionId string, to TransactionStatus, actor, reason string) (*Transaction, error) {
+	return v1.TransitionStatus(ctx, c.l, tenant(tenantId), transactionId, to, actor, reason)
+}
+
+// Statement returns the statement of an account from from up to, but
+// excluding, to.
+func (c *Client) Statement(ctx context.Context, tenantId, accountId string, from, to time.Time) (*Statement, error) {
+	return v1.GetStatement(ctx, c.l, tenant(tenantId), accountId, from, to)
+}
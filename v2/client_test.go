@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	v1 "github.com/adonese/ledger"
+	"github.com/adonese/ledger/ledgertest"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := New(ledgertest.NewDB(), v1.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err := c.CreateAccount(ctx, "", User{AccountID: "alice", Amount: 100}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+	if err := c.CreateAccount(ctx, "", User{AccountID: "bob"}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+
+	res, err := c.Transfer(ctx, TransferRequest{From: "alice", To: "bob", Amount: 30})
+	if err != nil || res.Status != "success" || res.TransactionID == "" {
+		t.Fatalf("Transfer() = %+v, %v", res, err)
+	}
+	txID := res.TransactionID
+	res, err = c.Transfer(ctx, TransferRequest{From: "alice", To: "bob", Amount: 500})
+	if err == nil || res.Code != "insufficient_balance" {
+		t.Errorf("overdrawing Transfer() = %+v, %v", res, err)
+	}
+	if _, err := c.Transfer(ctx, TransferRequest{From: "alice", Amount: 1}); err == nil {
+		t.Error("Transfer() without a receiver succeeded")
+	}
+
+	if balance, err := c.Balance(ctx, "nil", "alice"); err != nil || balance != 70 {
+		t.Errorf("Balance() = %v, %v, want 70", balance, err)
+	}
+	if account, err := c.GetAccount(ctx, "", "bob"); err != nil || account.Amount != 30 {
+		t.Errorf("GetAccount() = %+v, %v", account, err)
+	}
+
+	completed := v1.TransactionCompleted
+	it := c.Transactions("", TransactionFilter{AccountID: "bob", Direction: v1.DirectionReceived, TransactionStatus: &completed})
+	n := 0
+	for it.Next(ctx) {
+		n++
+	}
+	if it.Err() != nil || n != 1 {
+		t.Errorf("Transactions() yielded %d, %v, want 1", n, it.Err())
+	}
+
+	statement, err := c.Statement(ctx, "", "alice", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil || statement.OpeningBalance != 100 || statement.ClosingBalance != 70 {
+		t.Errorf("Statement() = %+v, %v", statement, err)
+	}
+	tx, err := c.TransitionStatus(ctx, "", txID, v1.TransactionReversed, "ops", "chargeback")
+	if err != nil || tx.Status == nil || *tx.Status != v1.TransactionReversed {
+		t.Errorf("TransitionStatus() = %+v, %v", tx, err)
+	}
+	if got, err := c.Transaction(ctx, "", "alice", txID); err != nil || got.SystemTransactionID != txID {
+		t.Errorf("Transaction() = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,270 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TableDescriber is implemented by clients that can describe tables, such as
+// *dynamodb.Client and the ledgertest fake. Validate checks key schemas,
+// indexes and TTL only when the client a Ledger wraps implements it.
+type TableDescriber interface {
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+}
+
+var _ TableDescriber = (*dynamodb.Client)(nil)
+
+// validateProbeKey is the key value Validate probes tables with. Probes never
+// write: the put is conditioned on the item existing, which it does not.
+const validateProbeKey = "__ledger_validate__"
+
+// IndexSpec is a global secondary index the ledger queries. Indexes
+// project every attribute.
+type IndexSpec struct {
+	Name, HashKey, RangeKey string
+}
+
+// TableSpec is what the ledger expects of a table, as Validate checks it and
+// EnsureTables and schema.Migrate create it. Key attributes are strings,
+// except those NumericKey reports.
+type TableSpec struct {
+	Name              string
+	HashKey, RangeKey string
+	Indexes           []IndexSpec
+	// TTL is the attribute that should be enabled as the table's TTL.
+	TTL string
+	// Optional tables back features a deployment may not use; they are only
+	// checked when they exist.
+	Optional bool
+}
+
+// TableSpecs returns the tables used by the ledger, read from the table
+// name variables when called.
+func TableSpecs() []TableSpec {
+	return []TableSpec{
+		{Name: NilUsers, HashKey: "TenantID", RangeKey: "AccountID", Indexes: []IndexSpec{
+			{"OwnerIDIndex", "TenantID", "OwnerID"},
+			{MobileNumberIndex, "TenantID", "MobileLookup"},
+			{IDNumberIndex, "TenantID", "IDLookup"},
+			{AccountIDIndex, "AccountID", "TenantID"},
+		}},
+		{Name: LedgerTable, HashKey: "TenantID", RangeKey: "TransactionID"},
+		{Name: TransactionsTable, HashKey: "TenantID", RangeKey: "TransactionID", Indexes: []IndexSpec{
+			{"FromAccountIndex", "TenantID", "FromAccount"},
+			{"ToAccountIndex", "TenantID", "ToAccount"},
+			{"TransactionDateIndex", "TenantID", "TransactionDate"},
+			{ReferenceIndex, "TenantID", "ReferenceLookup"},
+			{ParentIndex, "TenantID", "ParentTransactionID"},
+		}},
+		{Name: TenantConfigTable, HashKey: "TenantID"},
+		{Name: CustomerLimitsTable, HashKey: "TenantID", RangeKey: "AccountID"},
+		{Name: AccountEventsTable, HashKey: "StreamID", RangeKey: "EventID", TTL: "ExpiresAt"},
+		{Name: IdempotencyKeysTable, HashKey: "TenantID", RangeKey: "IdempotencyKey", TTL: "ExpiresAt"},
+		{Name: DelayedTransfersTable, HashKey: "TenantID", RangeKey: "TransferID", Indexes: []IndexSpec{
+			{"StatusReleaseAtIndex", "Status", "ReleaseAt"},
+		}, Optional: true},
+		{Name: TransferApprovalsTable, HashKey: "TenantID", RangeKey: "TransferID", Optional: true},
+		{Name: ArchivesTable, HashKey: "TenantID", RangeKey: "ArchiveID", Optional: true},
+		{Name: CredentialsTable, HashKey: "KeyID", Indexes: []IndexSpec{
+			{CredentialsTenantIndex, "TenantID", "KeyID"},
+		}, Optional: true},
+		{Name: ThirdPartyAppsTable, HashKey: "TenantID", RangeKey: "AppID", Optional: true},
+		{Name: ConsentsTable, HashKey: "TenantID", RangeKey: "ConsentID", Optional: true},
+		{Name: AnnotationsTable, HashKey: "OwnerID", RangeKey: "TransactionID", Optional: true},
+		{Name: EscrowTransactionsTable, HashKey: "UUID", RangeKey: "TransactionID", Indexes: []IndexSpec{
+			{"StatusTransactionDateIndex", "TransactionStatus", "TransactionDate"},
+		}, Optional: true},
+		{Name: ReportSubscriptionsTable, HashKey: "TenantID", RangeKey: "SubscriptionID", Indexes: []IndexSpec{
+			{"StatusNextRunAtIndex", "Status", "NextRunAt"},
+		}, Optional: true},
+		{Name: AnomaliesTable, HashKey: "TenantID", RangeKey: "AnomalyID", Optional: true},
+		{Name: AnomalyBaselinesTable, HashKey: "TenantID", RangeKey: "Key", Optional: true},
+		{Name: AuditLogTable, HashKey: "TenantID", RangeKey: "EntryID", Optional: true},
+		{Name: TenantKeysTable, HashKey: "TenantID", RangeKey: "KeyID", Optional: true},
+		{Name: SnapshotsTable, HashKey: "AccountKey", RangeKey: "Day", Optional: true},
+		{Name: ExchangeRatesTable, HashKey: "TenantID", RangeKey: "Currency", Optional: true},
+		{Name: PayoutsTable, HashKey: "TenantID", RangeKey: "CodeHash", Optional: true},
+		{Name: PendingClaimsTable, HashKey: "TenantID", RangeKey: "ClaimID", Optional: true},
+		{Name: ConfigChangesTable, HashKey: "TenantID", RangeKey: "ChangeID", Indexes: []IndexSpec{
+			{"StatusActivateAtIndex", "Status", "ActivateAt"},
+		}, Optional: true},
+		{Name: ReserveProofsTable, HashKey: "TenantID", RangeKey: "ProofID", Optional: true},
+		{Name: ReserveInclusionsTable, HashKey: "ProofKey", RangeKey: "AccountID", Optional: true},
+		{Name: FailedOperationsTable, HashKey: "TenantID", RangeKey: "OperationID", Indexes: []IndexSpec{
+			{"StatusCreatedAtIndex", "Status", "CreatedAt"},
+		}, Optional: true},
+		{Name: PaymentRequestsTable, HashKey: "TenantID", RangeKey: "RequestID", Indexes: []IndexSpec{
+			{"MerchantCreatedAtIndex", "MerchantKey", "CreatedAt"},
+			{"StatusExpiresAtIndex", "Status", "ExpiresAt"},
+		}, Optional: true},
+		{Name: InterTenantObligationsTable, HashKey: "Period", RangeKey: "Pair", Optional: true},
+		{Name: SettlementBatchesTable, HashKey: "Period", Optional: true},
+		{Name: EscrowHoldsTable, HashKey: "TenantID", RangeKey: "EscrowID", Optional: true},
+		{Name: DisputesTable, HashKey: "TenantID", RangeKey: "TransactionID", Optional: true},
+		{Name: ProjectionsTable, HashKey: "ProjectionID", RangeKey: "ItemKey", TTL: "ExpiresAt", Optional: true},
+		{Name: StreamCheckpointsTable, HashKey: "Consumer", RangeKey: "ShardID", Optional: true},
+		{Name: TenantAnalyticsTable, HashKey: "TenantID", RangeKey: "Day", Optional: true},
+		{Name: VelocityCountersTable, HashKey: "TenantID", RangeKey: "CounterID", TTL: "ExpiresAt", Optional: true},
+		{Name: CampaignsTable, HashKey: "TenantID", RangeKey: "CampaignID", Optional: true},
+		{Name: CampaignUsageTable, HashKey: "TenantID", RangeKey: "UsageID", TTL: "ExpiresAt", Optional: true},
+		{Name: BalanceSubscriptionsTable, HashKey: "AccountKey", RangeKey: "SubscriptionID", Optional: true},
+	}
+}
+
+// Validate checks at startup that the ledger can serve transfers, so a
+// misconfiguration fails the deployment rather than the first customer:
+// every table exists with the key schema, indexes and TTL the ledger expects,
+// the ledger's role may read and write them, and the config of each of
+// tenants is usable. It returns every problem found, joined.
+func (l *Ledger) Validate(ctx context.Context, tenants ...string) error {
+	var errs []error
+	for _, spec := range TableSpecs() {
+		if spec.Name == AuditLogTable && l.audit {
+			spec.Optional = false
+		}
+		spec.Name = aws.ToString(l.tableName(&spec.Name))
+		exists, err := l.validateTable(ctx, spec)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if exists {
+			errs = append(errs, l.probeTable(ctx, spec)...)
+		}
+	}
+	for _, tenantId := range tenants {
+		if err := l.validateTenant(ctx, tenantId); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenantId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateTable checks the schema of a table, reporting whether it exists.
+// Without a TableDescriber, tables are assumed to exist and left to the
+// probes.
+func (l *Ledger) validateTable(ctx context.Context, spec TableSpec) (bool, error) {
+	describer, ok := l.db.(TableDescriber)
+	if !ok {
+		return true, nil
+	}
+	out, err := describer.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(spec.Name)})
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			if spec.Optional {
+				return false, nil
+			}
+			return false, fmt.Errorf("table %s does not exist; create it with %s", spec.Name, keyDescription(spec.HashKey, spec.RangeKey))
+		}
+		return false, fmt.Errorf("failed to describe table %s: %v", spec.Name, err)
+	}
+
+	var errs []error
+	desc := out.Table
+	if hash, rng := keySchema(desc.KeySchema); hash != spec.HashKey || rng != spec.RangeKey {
+		errs = append(errs, fmt.Errorf("table %s has %s, want %s", spec.Name, keyDescription(hash, rng), keyDescription(spec.HashKey, spec.RangeKey)))
+	}
+	for _, want := range spec.Indexes {
+		var found *types.GlobalSecondaryIndexDescription
+		for i := range desc.GlobalSecondaryIndexes {
+			if aws.ToString(desc.GlobalSecondaryIndexes[i].IndexName) == want.Name {
+				found = &desc.GlobalSecondaryIndexes[i]
+			}
+		}
+		if found == nil {
+			errs = append(errs, fmt.Errorf("table %s has no index %s; create it with %s", spec.Name, want.Name, keyDescription(want.HashKey, want.RangeKey)))
+			continue
+		}
+		if hash, rng := keySchema(found.KeySchema); hash != want.HashKey || rng != want.RangeKey {
+			errs = append(errs, fmt.Errorf("index %s of table %s has %s, want %s", want.Name, spec.Name, keyDescription(hash, rng), keyDescription(want.HashKey, want.RangeKey)))
+		}
+	}
+	if spec.TTL != "" {
+		ttl, err := describer.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(spec.Name)})
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("failed to describe the TTL of table %s: %v", spec.Name, err))
+		case ttl.TimeToLiveDescription == nil ||
+			aws.ToString(ttl.TimeToLiveDescription.AttributeName) != spec.TTL ||
+			(ttl.TimeToLiveDescription.TimeToLiveStatus != types.TimeToLiveStatusEnabled && ttl.TimeToLiveDescription.TimeToLiveStatus != types.TimeToLiveStatusEnabling):
+			errs = append(errs, fmt.Errorf("table %s does not expire items; enable TTL on attribute %s", spec.Name, spec.TTL))
+		}
+	}
+	return true, errors.Join(errs...)
+}
+
+func keySchema(elements []types.KeySchemaElement) (hash, rng string) {
+	for _, e := range elements {
+		switch e.KeyType {
+		case types.KeyTypeHash:
+			hash = aws.ToString(e.AttributeName)
+		case types.KeyTypeRange:
+			rng = aws.ToString(e.AttributeName)
+		}
+	}
+	return hash, rng
+}
+
+func keyDescription(hash, rng string) string {
+	if rng == "" {
+		return fmt.Sprintf("hash key %s and no range key", hash)
+	}
+	return fmt.Sprintf("hash key %s and range key %s", hash, rng)
+}
+
+// probeTable checks that the ledger may query and put items in a table.
+func (l *Ledger) probeTable(ctx context.Context, spec TableSpec) []error {
+	var errs []error
+	_, err := l.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(spec.Name),
+		KeyConditionExpression:    aws.String("#hash = :probe"),
+		ExpressionAttributeNames:  map[string]string{"#hash": spec.HashKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":probe": &types.AttributeValueMemberS{Value: validateProbeKey}},
+		Limit:                     aws.Int32(1),
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cannot read table %s; grant dynamodb:Query and dynamodb:GetItem: %v", spec.Name, err))
+	}
+
+	item := map[string]types.AttributeValue{spec.HashKey: &types.AttributeValueMemberS{Value: validateProbeKey}}
+	if spec.RangeKey != "" {
+		item[spec.RangeKey] = &types.AttributeValueMemberS{Value: validateProbeKey}
+	}
+	_, err = l.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(spec.Name),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_exists(#hash)"),
+		ExpressionAttributeNames: map[string]string{"#hash": spec.HashKey},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condErr) {
+		errs = append(errs, fmt.Errorf("cannot write table %s; grant dynamodb:PutItem: %v", spec.Name, err))
+	}
+	return errs
+}
+
+// validateTenant checks that the stored config of a tenant is usable and its
+// accounts it names exist.
+func (l *Ledger) validateTenant(ctx context.Context, tenantId string) error {
+	cfg, err := GetTenantConfig(ctx, l, tenantId)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	// Accounts named by the config, by what they are used for.
+	var errs []error
+	for _, account := range cfg.systemAccounts() {
+		if _, err := readAccount(ctx, l, cfg.TenantID, account[1]); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", account[0], account[1], err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,160 @@
+// Package validation checks the input of the ledger's public entry points
+// before anything is read from or written to DynamoDB: the format of tenant
+// and account IDs, amounts, comments and the accounts of a transfer.
+//
+// Every check returns nil or an *Error naming the field, a machine readable
+// code and a message. Collect gathers the results of several checks into
+// Errors, so a caller is told about every problem of a request at once.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of the checked input.
+const (
+	MaxTenantIDLength  = 64
+	MaxAccountIDLength = 128
+	// MaxCommentLength matches ledger.MaxNarrativeLength.
+	MaxCommentLength = 140
+	// AmountDecimals is the most decimals an amount may have.
+	AmountDecimals = 2
+)
+
+// Codes of an Error.
+const (
+	CodeRequired     = "required"
+	CodeInvalidChars = "invalid_characters"
+	CodeTooLong      = "too_long"
+	CodeNotPositive  = "not_positive"
+	CodeTooPrecise   = "too_precise"
+	CodeSelfTransfer = "self_transfer"
+)
+
+// Error is a field of a request that failed validation.
+type Error struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Errors are all the fields of a request that failed validation.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Collect returns the failed checks among errs as Errors, or nil when all of
+// them passed.
+func Collect(errs ...error) error {
+	var failed Errors
+	for _, err := range errs {
+		var e *Error
+		switch {
+		case err == nil:
+		case errors.As(err, &e):
+			failed = append(failed, e)
+		default:
+			failed = append(failed, &Error{Message: err.Error()})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// Fields returns the validation errors of err, or nil when err is not one.
+func Fields(err error) Errors {
+	var errs Errors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return Errors{e}
+	}
+	return nil
+}
+
+func invalid(field, code, format string, args ...any) error {
+	return &Error{Field: field, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// TenantID checks a tenant ID: 1 to MaxTenantIDLength ASCII letters,
+// digits, hyphens and underscores.
+func TenantID(field, id string) error {
+	return identifier(field, id, MaxTenantIDLength, "-_")
+}
+
+// AccountID checks an account ID: 1 to MaxAccountIDLength ASCII letters,
+// digits and the punctuation of phone numbers, emails and wallet IDs
+// ("-_.@+#:").
+func AccountID(field, id string) error {
+	return identifier(field, id, MaxAccountIDLength, "-_.@+#:")
+}
+
+func identifier(field, id string, maxLength int, punctuation string) error {
+	if id == "" {
+		return invalid(field, CodeRequired, "is required")
+	}
+	if len(id) > maxLength {
+		return invalid(field, CodeTooLong, "has %d characters, at most %d allowed", len(id), maxLength)
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && !strings.ContainsRune(punctuation, r) {
+			return invalid(field, CodeInvalidChars, "may only hold letters, digits and %q", punctuation)
+		}
+	}
+	return nil
+}
+
+// Amount checks that an amount is positive, finite and has at most
+// AmountDecimals decimals.
+func Amount(field string, amount float64) error {
+	return AmountPrecision(field, amount, AmountDecimals)
+}
+
+// AmountPrecision checks that an amount is positive, finite and has at most
+// decimals decimals, such as those of its currency.
+func AmountPrecision(field string, amount float64, decimals int) error {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 {
+		return invalid(field, CodeNotPositive, "must be positive")
+	}
+	scale := math.Pow10(decimals)
+	if math.Round(amount*scale)/scale != amount {
+		return invalid(field, CodeTooPrecise, "may have at most %d decimals", decimals)
+	}
+	return nil
+}
+
+// Comment checks that a caller supplied comment or narrative is at most
+// MaxCommentLength characters, counting runs of spaces as one as they are
+// stored. An empty comment is valid.
+func Comment(field, comment string) error {
+	if n := utf8.RuneCountInString(strings.Join(strings.Fields(comment), " ")); n > MaxCommentLength {
+		return invalid(field, CodeTooLong, "has %d characters, at most %d allowed", n, MaxCommentLength)
+	}
+	return nil
+}
+
+// Distinct checks that the receiver of a transfer is not its sender.
+func Distinct(field, from, to string) error {
+	if from != "" && from == to {
+		return invalid(field, CodeSelfTransfer, "must differ from the sender")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package validation
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func code(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+func TestChecks(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"tenant", TenantID("tenant_id", "acme-1_prod"), ""},
+		{"empty tenant", TenantID("tenant_id", ""), CodeRequired},
+		{"tenant with a dot", TenantID("tenant_id", "acme.prod"), CodeInvalidChars},
+		{"long tenant", TenantID("tenant_id", strings.Repeat("t", MaxTenantIDLength+1)), CodeTooLong},
+		{"phone account", AccountID("account_id", "+249912345678"), ""},
+		{"wallet account", AccountID("account_id", "alice#usd"), ""},
+		{"email account", AccountID("account_id", "alice@example.com"), ""},
+		{"account with a space", AccountID("account_id", "alice smith"), CodeInvalidChars},
+		{"non-ASCII account", AccountID("account_id", "алиса"), CodeInvalidChars},
+		{"long account", AccountID("account_id", strings.Repeat("a", MaxAccountIDLength+1)), CodeTooLong},
+		{"amount", Amount("amount", 10.25), ""},
+		{"cent", Amount("amount", 0.01), ""},
+		{"zero", Amount("amount", 0), CodeNotPositive},
+		{"negative", Amount("amount", -1), CodeNotPositive},
+		{"NaN", Amount("amount", math.NaN()), CodeNotPositive},
+		{"infinity", Amount("amount", math.Inf(1)), CodeNotPositive},
+		{"sub-cent", Amount("amount", 0.001), CodeTooPrecise},
+		{"fils", AmountPrecision("amount", 1.005, 3), ""},
+		{"sub-fils", AmountPrecision("amount", 1.0005, 3), CodeTooPrecise},
+		{"whole yen", AmountPrecision("amount", 0.5, 0), CodeTooPrecise},
+		{"comment", Comment("narrative", strings.Repeat("a", MaxCommentLength)), ""},
+		{"spaced comment", Comment("narrative", strings.Repeat("a ", MaxCommentLength/2)+"   "), ""},
+		{"long comment", Comment("narrative", strings.Repeat("é", MaxCommentLength+1)), CodeTooLong},
+		{"transfer", Distinct("to_account", "alice", "bob"), ""},
+		{"self transfer", Distinct("to_account", "alice", "alice"), CodeSelfTransfer},
+	}
+	for _, tt := range tests {
+		if got := code(tt.err); got != tt.want {
+			t.Errorf("%s: code %q (%v), want %q", tt.name, got, tt.err, tt.want)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	if err := Collect(nil, AccountID("from_account", "alice")); err != nil {
+		t.Errorf("Collect() of passed checks = %v, want nil", err)
+	}
+	err := Collect(AccountID("from_account", ""), nil, Amount("amount", -1))
+	fields := Fields(err)
+	if len(fields) != 2 || fields[0].Field != "from_account" || fields[1].Field != "amount" {
+		t.Fatalf("Fields(%v) = %v", err, fields)
+	}
+	if want := "from_account: is required; amount: must be positive"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	if Fields(errors.New("timeout")) != nil {
+		t.Error("Fields() of an error that is not a validation error is not nil")
+	}
+}
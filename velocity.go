@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// VelocityCountersTable holds the transfer counters of the velocity rules,
+// keyed by TenantID and CounterID. ExpiresAt should be enabled as the
+// table's TTL attribute.
+var VelocityCountersTable = "VelocityCounters"
+
+// ErrRateLimited is returned for a transfer refused by a velocity rule.
+var ErrRateLimited = errors.New("rate_limited")
+
+// VelocityRule caps the transfers an account can send in a window, such as
+// 10 per minute. Windows are fixed, aligned on multiples of their length
+// since the Unix epoch.
+type VelocityRule struct {
+	MaxTransfers int64 `dynamodbav:"MaxTransfers" json:"max_transfers"`
+	// Window is the length of the window in seconds.
+	Window int64 `dynamodbav:"Window" json:"window"`
+}
+
+func (r VelocityRule) validate() error {
+	if r.MaxTransfers <= 0 || r.Window <= 0 {
+		return fmt.Errorf("velocity rule of %d transfers per %ds: both must be positive", r.MaxTransfers, r.Window)
+	}
+	return nil
+}
+
+// RateLimitError is the error of a transfer refused by a velocity rule.
+type RateLimitError struct {
+	Rule VelocityRule
+	// RetryAfter is how long until the rule's window ends.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate_limited: at most %d transfers per %ds, retry in %s", e.Rule.MaxTransfers, e.Rule.Window, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// rateLimitedResponse is the response to a transfer refused by a velocity
+// rule, with the time until its window ends as the retry hint.
+func rateLimitedResponse(req TransferRequest, err error) NilResponse {
+	response := failedResponse(req, ErrRateLimited.Error(), "Too many transfers, please retry later.", err.Error())
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		response.RetryAfter = int64(math.Ceil(limited.RetryAfter.Seconds()))
+	}
+	return response
+}
+
+// enforceVelocityRules counts a transfer of the sender against every rule of
+// the tenant, atomically: when a rule's window is full, no counter is
+// incremented and a *RateLimitError is returned.
+func enforceVelocityRules(ctx context.Context, dbSvc DynamoDBAPI, tenantCfg *TenantConfig, req TransferRequest, now time.Time) error {
+	if len(tenantCfg.VelocityRules) == 0 {
+		return nil
+	}
+	items := make([]types.TransactWriteItem, 0, len(tenantCfg.VelocityRules))
+	for _, rule := range tenantCfg.VelocityRules {
+		start := now.Unix() - now.Unix()%rule.Window
+		items = append(items, types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(VelocityCountersTable),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: req.TenantID},
+				"CounterID": &types.AttributeValueMemberS{Value: fmt.Sprintf("%s#%d#%d", req.FromAccount, rule.Window, start)},
+			},
+			UpdateExpression:    aws.String("ADD Transfers :one SET ExpiresAt = :expiresAt"),
+			ConditionExpression: aws.String("attribute_not_exists(Transfers) OR Transfers < :max"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":one":       &types.AttributeValueMemberN{Value: "1"},
+				":max":       &types.AttributeValueMemberN{Value: strconv.FormatInt(rule.MaxTransfers, 10)},
+				":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(start+2*rule.Window, 10)},
+			},
+		}})
+	}
+	_, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for i, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" && i < len(tenantCfg.VelocityRules) {
+				rule := tenantCfg.VelocityRules[i]
+				remaining := rule.Window - now.Unix()%rule.Window
+				return &RateLimitError{Rule: rule, RetryAfter: time.Duration(remaining) * time.Second}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to count transfer against velocity rules: %v", err)
+	}
+	return nil
+}
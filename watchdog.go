@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MetricConsistencyChecks counts the accounts checked by a Watchdog, by
+// tenant and result. The share of consistent checks is the ledger's
+// consistency SLO.
+const MetricConsistencyChecks = "ledger.consistency.checks"
+
+// Results of a consistency check.
+const (
+	ConsistencyOK       = "consistent"
+	ConsistencyMismatch = "inconsistent"
+	ConsistencyError    = "error"
+)
+
+// Kinds and metrics of the anomalies opened by a Watchdog. Their Segment is
+// "account:" followed by the account ID.
+const (
+	AnomalyInconsistent   = "inconsistent"
+	AnomalyMetricBalance  = "balance"
+	AnomalyMetricChain    = "chain"
+	consistencyAnomalyKey = "consistency"
+)
+
+// DefaultWatchdogInterval is the pause between two accounts checked by a
+// Watchdog without an Interval.
+const DefaultWatchdogInterval = 10 * time.Second
+
+// WatchdogPageSize is how many accounts a Watchdog reads at a time.
+const WatchdogPageSize = 100
+
+// ConsistencyCheck is the result of checking one account.
+type ConsistencyCheck struct {
+	TenantID  string `json:"tenant_id"`
+	AccountID string `json:"account_id"`
+	// Reconciliation is nil for accounts without a snapshot: their opening
+	// balance is not in the ledger, so their balance cannot be checked.
+	Reconciliation *Reconciliation  `json:"reconciliation,omitempty"`
+	Integrity      *IntegrityReport `json:"integrity"`
+}
+
+// Consistent reports whether the account's balance matches its transactions
+// and its hash chain is intact.
+func (c *ConsistencyCheck) Consistent() bool {
+	return (c.Reconciliation == nil || c.Reconciliation.Balanced()) && c.Integrity.Valid()
+}
+
+// Watchdog checks the accounts of its tenants one at a time, forever, so
+// that drift between balances and the ledger, or a broken hash chain, is
+// found without waiting for an audit. Every check is counted in
+// MetricConsistencyChecks, and every inconsistent account is stored as an
+// Anomaly and passed to DefaultAnomalyAlerter, once until it is found
+// consistent again.
+//
+// It is meant to run at low priority next to the service: it checks one
+// account per Interval and pauses while the ledger is degraded. It walks
+// each tenant's accounts a page at a time, and checks a page's accounts in
+// random order, so every account is checked once per sweep and a drift is
+// not missed because its account is never drawn.
+type Watchdog struct {
+	DB      DynamoDBAPI
+	Tenants []string
+	// Interval is the pause between two checks; zero means
+	// DefaultWatchdogInterval.
+	Interval time.Duration
+
+	mu     sync.Mutex
+	sweeps map[string]*sweep
+	// open holds the anomalies opened, by tenant, account and metric.
+	open map[string]bool
+}
+
+// sweep is a Watchdog's walk through the accounts of a tenant: the page of
+// accounts left to check, in random order, and the key of the next page.
+type sweep struct {
+	queue  []string
+	cursor map[string]types.AttributeValue
+}
+
+// Run checks accounts until ctx is done, and returns its error. Failed
+// checks are logged and counted; they do not stop the watchdog.
+func (w *Watchdog) Run(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchdogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if len(w.Tenants) == 0 || degraded(w.DB) {
+			continue
+		}
+		tenantId := w.Tenants[i%len(w.Tenants)]
+		if _, err := w.CheckNext(ctx, tenantId); err != nil {
+			loggerOf(w.DB).WarnContext(ctx, "consistency check failed", "tenant", tenantId, "error", err)
+		}
+	}
+}
+
+// CheckNext checks the next account of the tenant. It returns nil when the
+// tenant has no accounts.
+func (w *Watchdog) CheckNext(ctx context.Context, tenantId string) (*ConsistencyCheck, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	accountId, err := w.nextAccount(ctx, tenantId)
+	if err != nil || accountId == "" {
+		return nil, err
+	}
+	return w.CheckAccount(ctx, tenantId, accountId)
+}
+
+// CheckAccount checks the balance of an account against its transactions
+// and its hash chain, records the result and opens an anomaly for each
+// inconsistency.
+func (w *Watchdog) CheckAccount(ctx context.Context, tenantId, accountId string) (*ConsistencyCheck, error) {
+	if tenantId == "" {
+		tenantId = "nil"
+	}
+	check, err := checkConsistency(ctx, w.DB, tenantId, accountId)
+	metrics := metricsOf(w.DB)
+	tenant := Attr("tenant", tenantId)
+	if err != nil {
+		metrics.AddCounter(ctx, MetricConsistencyChecks, 1, tenant, Attr("result", ConsistencyError))
+		return nil, err
+	}
+	result := ConsistencyOK
+	if !check.Consistent() {
+		result = ConsistencyMismatch
+	}
+	metrics.AddCounter(ctx, MetricConsistencyChecks, 1, tenant, Attr("result", result))
+
+	balance := check.Reconciliation != nil && !check.Reconciliation.Balanced()
+	if err := w.flag(ctx, check, AnomalyMetricBalance, balance); err != nil {
+		return check, err
+	}
+	return check, w.flag(ctx, check, AnomalyMetricChain, !check.Integrity.Valid())
+}
+
+func checkConsistency(ctx context.Context, dbSvc DynamoDBAPI, tenantId, accountId string) (*ConsistencyCheck, error) {
+	check := &ConsistencyCheck{TenantID: tenantId, AccountID: accountId}
+	r, err := Reconcile(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	if r.SnapshotDay != "" {
+		check.Reconciliation = r
+	}
+	check.Integrity, err = VerifyLedgerIntegrity(ctx, dbSvc, tenantId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// flag opens an anomaly for the metric of the checked account when bad, and
+// forgets it when the account is fine again, so the same inconsistency is
+// not reported on every check.
+func (w *Watchdog) flag(ctx context.Context, check *ConsistencyCheck, metric string, bad bool) error {
+	key := check.TenantID + "#" + check.AccountID + "#" + metric
+	w.mu.Lock()
+	if w.open == nil {
+		w.open = map[string]bool{}
+	}
+	opened := w.open[key]
+	if !bad {
+		delete(w.open, key)
+	}
+	w.mu.Unlock()
+	if !bad || opened {
+		return nil
+	}
+
+	anomaly := newConsistencyAnomaly(check, metric)
+	if err := putAnomaly(ctx, w.DB, anomaly); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.open[key] = true
+	w.mu.Unlock()
+	if DefaultAnomalyAlerter != nil {
+		if err := DefaultAnomalyAlerter(ctx, anomaly); err != nil {
+			loggerOf(w.DB).WarnContext(ctx, "failed to alert on anomaly", "tenant", check.TenantID, "anomaly", anomaly.AnomalyID, "error", err)
+		}
+	}
+	return nil
+}
+
+// newConsistencyAnomaly describes an inconsistency as an Anomaly. For the
+// balance, Observed and Expected are the actual and expected balances; for
+// the chain, Observed is the number of problems found.
+func newConsistencyAnomaly(check *ConsistencyCheck, metric string) Anomaly {
+	now := time.Now().Unix()
+	anomaly := Anomaly{
+		TenantID:    check.TenantID,
+		AnomalyID:   fmt.Sprintf("%019d#%s#%s#%s", now, consistencyAnomalyKey, check.AccountID, metric),
+		Segment:     "account:" + check.AccountID,
+		Metric:      metric,
+		Kind:        AnomalyInconsistent,
+		WindowStart: now,
+		WindowEnd:   now,
+		DetectedAt:  now,
+	}
+	switch metric {
+	case AnomalyMetricBalance:
+		anomaly.Observed = check.Reconciliation.Actual
+		anomaly.Expected = check.Reconciliation.Expected
+	case AnomalyMetricChain:
+		anomaly.Observed = float64(len(check.Integrity.Problems))
+	}
+	return anomaly
+}
+
+// nextAccount returns the next account of the tenant to check, reading
+// them a page at a time, or "" when the tenant has no accounts.
+func (w *Watchdog) nextAccount(ctx context.Context, tenantId string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sweeps == nil {
+		w.sweeps = map[string]*sweep{}
+	}
+	s := w.sweeps[tenantId]
+	if s == nil {
+		s = &sweep{}
+		w.sweeps[tenantId] = s
+	}
+	for attempt := 0; len(s.queue) == 0; attempt++ {
+		// A sweep that ends on an empty page starts over once; a second
+		// empty page means there are no accounts.
+		if attempt == 2 {
+			return "", nil
+		}
+		resp, err := w.DB.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(NilUsers),
+			KeyConditionExpression: aws.String("TenantID = :tenant"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":tenant": &types.AttributeValueMemberS{Value: tenantId},
+			},
+			ProjectionExpression: aws.String("AccountID"),
+			ExclusiveStartKey:    s.cursor,
+			Limit:                aws.Int32(WatchdogPageSize),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to query accounts: %v", err)
+		}
+		var page []struct{ AccountID string }
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return "", fmt.Errorf("failed to unmarshal accounts: %v", err)
+		}
+		for _, account := range page {
+			s.queue = append(s.queue, account.AccountID)
+		}
+		rand.Shuffle(len(s.queue), func(i, j int) { s.queue[i], s.queue[j] = s.queue[j], s.queue[i] })
+		s.cursor = resp.LastEvaluatedKey
+	}
+	accountId := s.queue[0]
+	s.queue = s.queue[1:]
+	return accountId, nil
+}